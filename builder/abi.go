@@ -0,0 +1,414 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// ABILibsFile lists the sonames provided by the package
+	ABILibsFile = "abi_libs"
+
+	// ABISymbolsFile lists the exported symbols as soname:symbol
+	ABISymbolsFile = "abi_symbols"
+
+	// ABIUsedLibsFile lists the sonames the package links against
+	ABIUsedLibsFile = "abi_used_libs"
+
+	// ABIUsedSymbolsFile lists the imported symbols as soname:symbol
+	ABIUsedSymbolsFile = "abi_used_symbols"
+
+	// ABIEmul32Suffix is appended to the name of each abi_* file for the
+	// 32-bit ELF files of emul32 builds
+	ABIEmul32Suffix = "32"
+)
+
+var (
+	// ErrABIBreak is returned when the package removes sonames or symbols
+	// that were provided by the previous release.
+	ErrABIBreak = errors.New("Package breaks the ABI of the previous release")
+
+	// abiLibraryDirs are searched within the build root to resolve the
+	// libraries providing imported symbols, for each architecture.
+	abiLibraryDirs = map[string][]string{
+		"": {
+			"/usr/lib64",
+			"/usr/lib",
+			"/lib64",
+			"/lib",
+		},
+		ABIEmul32Suffix: {
+			"/usr/lib32",
+			"/lib32",
+		},
+	}
+)
+
+// An ABIReport describes the libraries and symbols provided and used by the
+// ELF files of a package for a single architecture.
+type ABIReport struct {
+	Libs        []string
+	Symbols     []string
+	UsedLibs    []string
+	UsedSymbols []string
+}
+
+// ABIReports holds the report of each architecture found in the package,
+// keyed by the suffix of its abi_* files.
+type ABIReports map[string]*ABIReport
+
+// abiObject is the dynamic linking information of a single ELF file
+type abiObject struct {
+	arch     string // Suffix of the abi_* files of its architecture
+	soname   string
+	needed   []string
+	exported []string
+	imported []string
+}
+
+// readABIObject will read the dynamic section of the ELF file, returning
+// nil if the file is not a dynamically linked ELF.
+func readABIObject(path string) *abiObject {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if f.Type != elf.ET_DYN && f.Type != elf.ET_EXEC {
+		return nil
+	}
+	syms, err := f.DynamicSymbols()
+	if err != nil {
+		return nil
+	}
+	obj := &abiObject{}
+	if f.Class == elf.ELFCLASS32 {
+		obj.arch = ABIEmul32Suffix
+	}
+	if sonames, _ := f.DynString(elf.DT_SONAME); len(sonames) > 0 {
+		obj.soname = sonames[0]
+	}
+	obj.needed, _ = f.DynString(elf.DT_NEEDED)
+	for _, sym := range syms {
+		bind := elf.ST_BIND(sym.Info)
+		if sym.Name == "" || (bind != elf.STB_GLOBAL && bind != elf.STB_WEAK) {
+			continue
+		}
+		if sym.Section == elf.SHN_UNDEF {
+			obj.imported = append(obj.imported, sym.Name)
+			continue
+		}
+		switch elf.ST_TYPE(sym.Info) {
+		case elf.STT_FUNC, elf.STT_OBJECT, elf.STT_TLS, elf.STT_LOOS:
+			obj.exported = append(obj.exported, sym.Name)
+		}
+	}
+	return obj
+}
+
+// resolveInRoot will follow symlinks of the path within root, without
+// escaping it.
+func resolveInRoot(root, path string) string {
+	for i := 0; i < 40; i++ {
+		full := filepath.Join(root, path)
+		st, err := os.Lstat(full)
+		if err != nil {
+			return ""
+		}
+		if st.Mode()&os.ModeSymlink == 0 {
+			return full
+		}
+		link, err := os.Readlink(full)
+		if err != nil {
+			return ""
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = link
+	}
+	return ""
+}
+
+// NewABIReport will analyse every ELF file within the install directory,
+// resolving imported symbols against the libraries of the package and then
+// those of the build root. 32-bit files are reported apart from the others,
+// just as they're linked apart.
+func NewABIReport(installDir, root string) (ABIReports, error) {
+	provided := make(map[string]*abiObject)
+	var objects []*abiObject
+	err := filepath.Walk(installDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		obj := readABIObject(path)
+		if obj == nil {
+			return nil
+		}
+		objects = append(objects, obj)
+		if obj.soname != "" {
+			provided[obj.arch+":"+obj.soname] = obj
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Libraries of the build root are only loaded on demand
+	exports := make(map[string]map[string]bool)
+	for key, obj := range provided {
+		exports[key] = make(map[string]bool)
+		for _, sym := range obj.exported {
+			exports[key][sym] = true
+		}
+	}
+	exportsOf := func(arch, soname string) map[string]bool {
+		key := arch + ":" + soname
+		if set, ok := exports[key]; ok {
+			return set
+		}
+		set := make(map[string]bool)
+		for _, dir := range abiLibraryDirs[arch] {
+			path := resolveInRoot(root, filepath.Join(dir, soname))
+			if path == "" {
+				continue
+			}
+			if obj := readABIObject(path); obj != nil && obj.arch == arch {
+				for _, sym := range obj.exported {
+					set[sym] = true
+				}
+				break
+			}
+		}
+		exports[key] = set
+		return set
+	}
+
+	type abiSets struct {
+		libs, symbols, usedLibs, usedSymbols map[string]bool
+	}
+	arches := make(map[string]*abiSets)
+	for _, obj := range objects {
+		sets, ok := arches[obj.arch]
+		if !ok {
+			sets = &abiSets{make(map[string]bool), make(map[string]bool), make(map[string]bool), make(map[string]bool)}
+			arches[obj.arch] = sets
+		}
+		if obj.soname != "" {
+			sets.libs[obj.soname] = true
+			for _, sym := range obj.exported {
+				sets.symbols[obj.soname+":"+sym] = true
+			}
+		}
+		for _, lib := range obj.needed {
+			sets.usedLibs[lib] = true
+		}
+		for _, sym := range obj.imported {
+			for _, lib := range obj.needed {
+				if exportsOf(obj.arch, lib)[sym] {
+					sets.usedSymbols[lib+":"+sym] = true
+					break
+				}
+			}
+		}
+	}
+	reports := make(ABIReports)
+	for arch, sets := range arches {
+		reports[arch] = &ABIReport{
+			Libs:        sortedKeys(sets.libs),
+			Symbols:     sortedKeys(sets.symbols),
+			UsedLibs:    sortedKeys(sets.usedLibs),
+			UsedSymbols: sortedKeys(sets.usedSymbols),
+		}
+	}
+	return reports, nil
+}
+
+// sortedKeys returns the keys of the set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write will store the reports as abi_* files within the directory
+func (r ABIReports) Write(dir string) error {
+	for arch, report := range r {
+		if err := report.Write(dir, arch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write will store the report as abi_* files within the directory, their
+// names ending with the suffix of the architecture. Empty files are not
+// written.
+func (r *ABIReport) Write(dir, arch string) error {
+	for name, lines := range map[string][]string{
+		ABILibsFile:        r.Libs,
+		ABISymbolsFile:     r.Symbols,
+		ABIUsedLibsFile:    r.UsedLibs,
+		ABIUsedSymbolsFile: r.UsedSymbols,
+	} {
+		if len(lines) == 0 {
+			continue
+		}
+		path := filepath.Join(dir, name+arch)
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 00644); err != nil {
+			return fmt.Errorf("Failed to write %s, reason: %s\n", path, err)
+		}
+	}
+	return nil
+}
+
+// An ABIDiff records the changes in provided sonames and symbols between
+// two releases.
+type ABIDiff struct {
+	RemovedLibs    []string
+	AddedLibs      []string
+	RemovedSymbols []string
+	AddedSymbols   []string
+}
+
+// IsBreak determines whether anything provided previously has been removed
+func (d *ABIDiff) IsBreak() bool {
+	return len(d.RemovedLibs) > 0 || len(d.RemovedSymbols) > 0
+}
+
+// readABIFile will read the lines of an abi_* file, which may be missing
+func readABIFile(path string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return set, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Fields(string(b)) {
+		set[line] = true
+	}
+	return set, nil
+}
+
+// setDifference returns the sorted members of a not present in b
+func setDifference(a, b map[string]bool) []string {
+	var diff []string
+	for k := range a {
+		if !b[k] {
+			diff = append(diff, k)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// CompareABI will compare the abi_libs and abi_symbols files of the previous
+// release against those of the current build, for each architecture. The
+// sonames and symbols of emul32 are marked as such.
+func CompareABI(previousDir, currentDir string) (*ABIDiff, error) {
+	diff := &ABIDiff{}
+	for _, arch := range []string{"", ABIEmul32Suffix} {
+		sets := make(map[string]map[string]bool)
+		for _, dir := range []string{previousDir, currentDir} {
+			for _, name := range []string{ABILibsFile, ABISymbolsFile} {
+				set, err := readABIFile(filepath.Join(dir, name+arch))
+				if err != nil {
+					return nil, err
+				}
+				sets[dir+name] = set
+			}
+		}
+		prevLibs, curLibs := sets[previousDir+ABILibsFile], sets[currentDir+ABILibsFile]
+		prevSyms, curSyms := sets[previousDir+ABISymbolsFile], sets[currentDir+ABISymbolsFile]
+		diff.RemovedLibs = append(diff.RemovedLibs, abiLabel(arch, setDifference(prevLibs, curLibs))...)
+		diff.AddedLibs = append(diff.AddedLibs, abiLabel(arch, setDifference(curLibs, prevLibs))...)
+		diff.RemovedSymbols = append(diff.RemovedSymbols, abiLabel(arch, setDifference(prevSyms, curSyms))...)
+		diff.AddedSymbols = append(diff.AddedSymbols, abiLabel(arch, setDifference(curSyms, prevSyms))...)
+	}
+	return diff, nil
+}
+
+// abiLabel will mark the entries of the emul32 abi_* files as such
+func abiLabel(arch string, entries []string) []string {
+	if arch == "" {
+		return entries
+	}
+	for i := range entries {
+		entries[i] += " (emul32)"
+	}
+	return entries
+}
+
+// hasABIReport determines whether the directory holds any abi_libs or
+// abi_symbols file to compare against
+func hasABIReport(dir string) bool {
+	for _, arch := range []string{"", ABIEmul32Suffix} {
+		if PathExists(filepath.Join(dir, ABISymbolsFile+arch)) || PathExists(filepath.Join(dir, ABILibsFile+arch)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckABI will compare the ABI report of the build against the report of
+// the previous release, stored alongside the recipe, and fail on any break.
+func (p *Package) CheckABI(overlay *Overlay) error {
+	previousDir := filepath.Dir(p.Path)
+	if !hasABIReport(previousDir) {
+		log.Infoln("No ABI report for the previous release, skipping ABI check")
+		return nil
+	}
+	diff, err := CompareABI(previousDir, p.GetWorkDir(overlay))
+	if err != nil {
+		return fmt.Errorf("Failed to compare ABI reports, reason: %s\n", err)
+	}
+	for _, lib := range diff.AddedLibs {
+		log.Infof("ABI: added library %s\n", lib)
+	}
+	if len(diff.AddedSymbols) > 0 {
+		log.Infof("ABI: added %d symbols\n", len(diff.AddedSymbols))
+	}
+	if !diff.IsBreak() {
+		log.Infoln("ABI is compatible with the previous release")
+		return nil
+	}
+	for _, lib := range diff.RemovedLibs {
+		log.Errorf("ABI: removed library %s\n", lib)
+	}
+	for _, sym := range diff.RemovedSymbols {
+		log.Errorf("ABI: removed symbol %s\n", sym)
+	}
+	return ErrABIBreak
+}
@@ -0,0 +1,93 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompareABI(t *testing.T) {
+	previous := t.TempDir()
+	current := t.TempDir()
+	old := &ABIReport{
+		Libs:    []string{"libfoo.so.1"},
+		Symbols: []string{"libfoo.so.1:foo_init", "libfoo.so.1:foo_legacy"},
+	}
+	if err := old.Write(previous, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	compatible := &ABIReport{
+		Libs:     []string{"libfoo.so.1"},
+		Symbols:  []string{"libfoo.so.1:foo_init", "libfoo.so.1:foo_legacy", "libfoo.so.1:foo_new"},
+		UsedLibs: []string{"libc.so.6"},
+	}
+	if err := compatible.Write(current, ""); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := CompareABI(previous, current)
+	if err != nil {
+		t.Fatalf("Failed to compare: %s", err)
+	}
+	if diff.IsBreak() || !reflect.DeepEqual(diff.AddedSymbols, []string{"libfoo.so.1:foo_new"}) {
+		t.Fatalf("Unexpected diff for compatible release: %+v", diff)
+	}
+
+	broken := &ABIReport{
+		Libs:    []string{"libfoo.so.2"},
+		Symbols: []string{"libfoo.so.2:foo_init"},
+	}
+	if err := broken.Write(current, ""); err != nil {
+		t.Fatal(err)
+	}
+	if diff, err = CompareABI(previous, current); err != nil {
+		t.Fatalf("Failed to compare: %s", err)
+	}
+	if !diff.IsBreak() || !reflect.DeepEqual(diff.RemovedLibs, []string{"libfoo.so.1"}) || len(diff.RemovedSymbols) != 2 {
+		t.Fatalf("Unexpected diff for broken release: %+v", diff)
+	}
+}
+
+func TestCompareABIEmul32(t *testing.T) {
+	previous := t.TempDir()
+	current := t.TempDir()
+	old := ABIReports{
+		"":              {Libs: []string{"libfoo.so.1"}},
+		ABIEmul32Suffix: {Libs: []string{"libfoo.so.1"}},
+	}
+	if err := old.Write(previous); err != nil {
+		t.Fatal(err)
+	}
+	if !PathExists(filepath.Join(previous, ABILibsFile+ABIEmul32Suffix)) {
+		t.Fatalf("Report of emul32 wasn't written to %s", ABILibsFile+ABIEmul32Suffix)
+	}
+
+	// Dropping the emul32 library is a break, despite the 64-bit one
+	dropped := ABIReports{"": {Libs: []string{"libfoo.so.1"}}}
+	if err := dropped.Write(current); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := CompareABI(previous, current)
+	if err != nil {
+		t.Fatalf("Failed to compare: %s", err)
+	}
+	if !reflect.DeepEqual(diff.RemovedLibs, []string{"libfoo.so.1 (emul32)"}) {
+		t.Fatalf("Unexpected diff for dropped emul32: %+v", diff)
+	}
+}
@@ -0,0 +1,293 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrNotBuilt is returned when an operation requires the build root of
+	// a previous build, but none exists.
+	ErrNotBuilt = errors.New("Package must be built before it can be analysed")
+
+	// ErrNoABIReport is returned when the build root has no ABI report to
+	// derive linkage from.
+	ErrNoABIReport = errors.New("No ABI report found in build root, was it disabled?")
+
+	// libraryDirs are searched to find the owner of a linked library
+	libraryDirs = []string{
+		"/usr/lib64",
+		"/usr/lib",
+	}
+
+	// pkgconfigDirs are searched to find the owner of a pkgconfig() dependency
+	pkgconfigDirs = []string{
+		"/usr/lib64/pkgconfig",
+		"/usr/share/pkgconfig",
+	}
+)
+
+// DepAdvice is the result of comparing the builddeps of a package against
+// what the built package actually linked against.
+type DepAdvice struct {
+	Add    []string          // Missing dependencies
+	Remove []string          // Library dependencies that were never linked
+	Switch map[string]string // -devel dependencies with a pkgconfig() form
+
+	recipe []byte // The proposed recipe
+}
+
+// IsEmpty will determine whether there is any advice to give
+func (d *DepAdvice) IsEmpty() bool {
+	return len(d.Add) == 0 && len(d.Remove) == 0 && len(d.Switch) == 0
+}
+
+// linkedProvider is a package providing at least one linked library
+type linkedProvider struct {
+	name    string
+	devel   string   // The -devel package, if installed
+	pkgconf []string // pkgconfig() names provided by the -devel package
+}
+
+// preferred returns the best form in which to depend on the provider
+func (l *linkedProvider) preferred() string {
+	if len(l.pkgconf) > 0 {
+		return l.pkgconf[0]
+	}
+	if l.devel != "" {
+		return l.devel
+	}
+	return l.name
+}
+
+// satisfiedBy determines if the builddep already pulls in the provider
+func (l *linkedProvider) satisfiedBy(dep string) bool {
+	if dep == l.name || dep == l.devel {
+		return true
+	}
+	for _, pc := range l.pkgconf {
+		if dep == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// findProviders will map each library in the ABI report to the package
+// providing it, skipping anything guaranteed by the base components.
+func (p *Package) findProviders(pman *EopkgManager, overlay *Overlay) ([]*linkedProvider, error) {
+	report := filepath.Join(p.GetWorkDir(overlay), "abi_used_libs")
+	b, err := ioutil.ReadFile(report)
+	if err != nil {
+		return nil, ErrNoABIReport
+	}
+
+	implicit := make(map[string]bool)
+	for _, comp := range []string{"system.base", "system.devel"} {
+		pkgs, err := pman.ListInstalledComponent(comp)
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range pkgs {
+			implicit[pkg] = true
+		}
+	}
+
+	seen := make(map[string]bool)
+	var providers []*linkedProvider
+	for _, lib := range strings.Fields(string(b)) {
+		owner := ""
+		for _, dir := range libraryDirs {
+			if owner, err = pman.SearchFile(filepath.Join(dir, lib)); err != nil {
+				return nil, err
+			}
+			if owner != "" {
+				break
+			}
+		}
+		if owner == "" {
+			log.Warnf("Unable to find the owner of linked library %s\n", lib)
+			continue
+		}
+		if implicit[owner] || seen[owner] || owner == p.Name {
+			continue
+		}
+		seen[owner] = true
+
+		provider := &linkedProvider{name: owner}
+		if files, err := pman.ListFiles(owner + "-devel"); err == nil {
+			provider.devel = owner + "-devel"
+			for _, f := range files {
+				if strings.HasSuffix(f, ".pc") {
+					provider.pkgconf = append(provider.pkgconf, fmt.Sprintf("pkgconfig(%s)", strings.TrimSuffix(filepath.Base(f), ".pc")))
+				}
+			}
+		}
+		log.Debugf("Library %s is provided by %s\n", lib, provider.preferred())
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+// isLibraryDep determines if the builddep exists to provide a shared library,
+// as opposed to a tool or header-only dependency. It returns the name of the
+// runtime package when that is the case.
+func isLibraryDep(pman *EopkgManager, dep string) (string, bool) {
+	devel := ""
+	if strings.HasPrefix(dep, "pkgconfig(") && strings.HasSuffix(dep, ")") {
+		name := dep[len("pkgconfig(") : len(dep)-1]
+		for _, dir := range pkgconfigDirs {
+			if owner, err := pman.SearchFile(filepath.Join(dir, name+".pc")); err == nil && owner != "" {
+				devel = owner
+				break
+			}
+		}
+	} else if strings.HasSuffix(dep, "-devel") {
+		devel = dep
+	}
+	if devel == "" {
+		return "", false
+	}
+	runtime := strings.TrimSuffix(devel, "-devel")
+	files, err := pman.ListFiles(runtime)
+	if err != nil {
+		return "", false
+	}
+	for _, f := range files {
+		if strings.Contains(filepath.Base(f), ".so.") {
+			return runtime, true
+		}
+	}
+	return "", false
+}
+
+// AdviseDeps will inspect the previous build root of this package and
+// compare the linked libraries against the declared builddeps.
+func (p *Package) AdviseDeps(notif PidNotifier, pman *EopkgManager, overlay *Overlay) (*DepAdvice, error) {
+	if p.Type != PackageTypeYpkg {
+		return nil, fmt.Errorf("Dependency advice is only supported for package.yml")
+	}
+	if !PathExists(overlay.UpperDir) {
+		return nil, ErrNotBuilt
+	}
+	doc, err := ParseYmlDocumentFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	ChrootEnvironment = SaneEnvironment("root", "/root")
+	if err := p.ActivateRoot(overlay); err != nil {
+		return nil, err
+	}
+
+	providers, err := p.findProviders(pman, overlay)
+	if err != nil {
+		return nil, err
+	}
+
+	advice := &DepAdvice{Switch: make(map[string]string)}
+	deps := doc.GetList("builddeps")
+	var newDeps []string
+
+	// Walk the existing deps, switching or dropping as appropriate
+	for _, dep := range deps {
+		var match *linkedProvider
+		for _, provider := range providers {
+			if provider.satisfiedBy(dep) {
+				match = provider
+				break
+			}
+		}
+		if match != nil {
+			if dep != match.preferred() && !strings.HasPrefix(dep, "pkgconfig(") && len(match.pkgconf) > 0 {
+				advice.Switch[dep] = match.preferred()
+				dep = match.preferred()
+			}
+			newDeps = append(newDeps, dep)
+			continue
+		}
+		if runtime, ok := isLibraryDep(pman, dep); ok {
+			log.Debugf("Builddep %s provides %s, which is not linked\n", dep, runtime)
+			advice.Remove = append(advice.Remove, dep)
+			continue
+		}
+		newDeps = append(newDeps, dep)
+	}
+
+	// Now add anything that was missing entirely
+	for _, provider := range providers {
+		found := false
+		for _, dep := range deps {
+			if provider.satisfiedBy(dep) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			advice.Add = append(advice.Add, provider.preferred())
+		}
+	}
+	sort.Strings(advice.Add)
+	newDeps = append(newDeps, advice.Add...)
+
+	if !advice.IsEmpty() {
+		doc.SetList("builddeps", newDeps)
+	}
+	advice.recipe = doc.Bytes()
+	return advice, nil
+}
+
+// Patch will return a unified diff between the recipe and the proposed
+// recipe, using the host diff tool.
+func (d *DepAdvice) Patch(path string) (string, error) {
+	tmp, err := ioutil.TempFile("", "solbuild-advice")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(d.recipe); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	tmp.Close()
+
+	name := filepath.Base(path)
+	out, err := exec.Command("diff", "-u", "--label", "a/"+name, "--label", "b/"+name, path, tmp.Name()).Output()
+	// diff exits 1 when the files differ
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		err = nil
+	}
+	return string(out), err
+}
+
+// Apply will write the proposed recipe over the original
+func (d *DepAdvice) Apply(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, d.recipe, st.Mode())
+}
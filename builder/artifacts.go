@@ -0,0 +1,188 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// CollisionOverwrite replaces existing packages in the output directory
+	CollisionOverwrite = "overwrite"
+
+	// CollisionRefuse fails the build rather than replace existing packages
+	CollisionRefuse = "refuse"
+
+	// CollisionRename gives the new packages a free name instead
+	CollisionRename = "rename"
+)
+
+var (
+	// ArtifactName is the template the collected packages are named with,
+	// with an empty template keeping the names given by eopkg
+	ArtifactName string
+
+	// ArtifactCollision decides what happens when a collected package would
+	// replace a different file of the same name
+	ArtifactCollision = CollisionOverwrite
+
+	// CollisionDir is checked for existing packages instead of the working
+	// directory, when the packages are collected elsewhere first
+	CollisionDir string
+
+	// ErrUnknownCollision is returned for an unsupported collision policy
+	ErrUnknownCollision = errors.New("Unknown artifact collision policy, expected overwrite, refuse or rename")
+
+	// ErrArtifactCollision is returned when a package would replace an
+	// existing file, and the policy refuses to
+	ErrArtifactCollision = errors.New("Refusing to overwrite existing packages")
+
+	// artifactFieldPattern matches the {field} placeholders of a template
+	artifactFieldPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+	// artifactFields are the placeholders a template may use
+	artifactFields = []string{"name", "version", "release", "distrelease", "arch", "source", "profile", "build_id", "commit"}
+)
+
+// ValidCollision determines whether the collision policy is supported
+func ValidCollision(policy string) bool {
+	switch policy {
+	case "", CollisionOverwrite, CollisionRefuse, CollisionRename:
+		return true
+	}
+	return false
+}
+
+// ValidArtifactName will ensure the template only uses known placeholders,
+// and can't name a file outside of the output directory.
+func ValidArtifactName(template string) error {
+	if strings.Contains(template, "/") {
+		return fmt.Errorf("Artifact name %s can't contain a /", template)
+	}
+	for _, field := range artifactFieldPattern.FindAllString(template, -1) {
+		known := false
+		for _, name := range artifactFields {
+			known = known || field == "{"+name+"}"
+		}
+		if !known {
+			return fmt.Errorf("Unknown artifact name field %s, expected one of {%s}", field, strings.Join(artifactFields, "}, {"))
+		}
+	}
+	return nil
+}
+
+// expandArtifactName will name an eopkg, i.e. nano-5.7-69-1-x86_64.eopkg,
+// using the template. Packages that eopkg didn't name are left alone.
+func expandArtifactName(template, file string, fields map[string]string) string {
+	base := strings.TrimSuffix(file, ".eopkg")
+	parts := strings.Split(base, "-")
+	if template == "" || len(parts) < 5 || base == file || strings.HasSuffix(base, ".delta") {
+		return file
+	}
+	n := len(parts)
+	values := map[string]string{
+		"name":        strings.Join(parts[:n-4], "-"),
+		"version":     parts[n-4],
+		"release":     parts[n-3],
+		"distrelease": parts[n-2],
+		"arch":        parts[n-1],
+	}
+	for key, value := range fields {
+		values[key] = value
+	}
+	return artifactFieldPattern.ReplaceAllStringFunc(template, func(field string) string {
+		return values[field[1:len(field)-1]]
+	}) + ".eopkg"
+}
+
+// freeArtifactName returns the name the file may be collected as into the
+// output directory, numbering it when a different file already exists.
+func freeArtifactName(path, outDir string) (string, error) {
+	name := filepath.Base(path)
+	stem := strings.TrimSuffix(name, ".eopkg")
+	for i := 1; ; i++ {
+		tgt := filepath.Join(outDir, name)
+		if !PathExists(tgt) || sameFile(path, tgt) {
+			return name, nil
+		}
+		if ArtifactCollision != CollisionRename {
+			if ArtifactCollision == CollisionRefuse {
+				return "", fmt.Errorf("%s, %s already exists", ErrArtifactCollision, tgt)
+			}
+			log.Warnf("Overwriting existing package %s\n", tgt)
+			return name, nil
+		}
+		name = fmt.Sprintf("%s.%d.eopkg", stem, i)
+	}
+}
+
+// sameFile determines whether two files have identical contents
+func sameFile(a, b string) bool {
+	ha, err := FileSha256sum(a)
+	if err != nil {
+		return false
+	}
+	hb, err := FileSha256sum(b)
+	return err == nil && ha == hb
+}
+
+// nameArtifacts will rename the eopkgs within the collection directory to
+// the names they're collected as, before anything else refers to them.
+func (p *Package) nameArtifacts(o *Overlay, packages []string, outDir string) ([]string, error) {
+	fields := map[string]string{
+		"source":   p.Name,
+		"profile":  o.Back.Name,
+		"build_id": time.Now().UTC().Format("20060102T150405Z"),
+		"commit":   "unknown",
+	}
+	if commit := recipeCommit(p); len(commit) >= 40 {
+		// Keep any -dirty marker of the shortened commit
+		fields["commit"] = commit[:12] + commit[40:]
+	}
+	var named []string
+	for _, path := range packages {
+		tgt := filepath.Join(filepath.Dir(path), expandArtifactName(ArtifactName, filepath.Base(path), fields))
+		if tgt != path {
+			if PathExists(tgt) {
+				return nil, fmt.Errorf("Artifact name %s gives several packages the name %s\n", ArtifactName, filepath.Base(tgt))
+			}
+			if err := os.Rename(path, tgt); err != nil {
+				return nil, fmt.Errorf("Failed to rename package %s, reason: %s\n", filepath.Base(path), err)
+			}
+			path = tgt
+		}
+		name, err := freeArtifactName(path, outDir)
+		if err != nil {
+			return nil, err
+		}
+		if tgt = filepath.Join(filepath.Dir(path), name); tgt != path {
+			log.Warnf("Collecting %s as %s, as it already exists\n", filepath.Base(path), name)
+			if err := os.Rename(path, tgt); err != nil {
+				return nil, fmt.Errorf("Failed to rename package %s, reason: %s\n", filepath.Base(path), err)
+			}
+		}
+		named = append(named, tgt)
+	}
+	return named, nil
+}
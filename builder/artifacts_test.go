@@ -0,0 +1,73 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandArtifactName(t *testing.T) {
+	fields := map[string]string{"profile": "main-x86_64", "build_id": "20210102T030405Z"}
+	template := "{name}-{version}-{release}-{build_id}-{profile}"
+	if err := ValidArtifactName(template); err != nil {
+		t.Fatalf("Template should be valid: %s", err)
+	}
+	for _, invalid := range []string{"{name}/{arch}", "{name}-{colour}"} {
+		if err := ValidArtifactName(invalid); err == nil {
+			t.Fatalf("Template %s should be invalid", invalid)
+		}
+	}
+	name := expandArtifactName(template, "nano-devel-5.7-69-1-x86_64.eopkg", fields)
+	if name != "nano-devel-5.7-69-20210102T030405Z-main-x86_64.eopkg" {
+		t.Fatalf("Unexpected name: %s", name)
+	}
+	if name = expandArtifactName(template, "nano-68-69-1-x86_64.delta.eopkg", fields); name != "nano-68-69-1-x86_64.delta.eopkg" {
+		t.Fatalf("Deltas should keep their names, got %s", name)
+	}
+	if name = expandArtifactName("", "nano-5.7-69-1-x86_64.eopkg", fields); name != "nano-5.7-69-1-x86_64.eopkg" {
+		t.Fatalf("Empty template should keep the name, got %s", name)
+	}
+}
+
+func TestFreeArtifactName(t *testing.T) {
+	defer func() { ArtifactCollision = CollisionOverwrite }()
+	built := filepath.Join(t.TempDir(), "nano-5.7-69-1-x86_64.eopkg")
+	outDir := t.TempDir()
+	writeTestFile(t, built, "new")
+	writeTestFile(t, filepath.Join(outDir, "nano-5.7-69-1-x86_64.eopkg"), "old")
+	writeTestFile(t, filepath.Join(outDir, "nano-5.7-69-1-x86_64.1.eopkg"), "older")
+
+	if name, err := freeArtifactName(built, outDir); err != nil || name != "nano-5.7-69-1-x86_64.eopkg" {
+		t.Fatalf("Overwrite should keep the name, got %s %v", name, err)
+	}
+	ArtifactCollision = CollisionRefuse
+	if _, err := freeArtifactName(built, outDir); err == nil {
+		t.Fatalf("Refuse should fail on collision")
+	}
+	ArtifactCollision = CollisionRename
+	if name, err := freeArtifactName(built, outDir); err != nil || name != "nano-5.7-69-1-x86_64.2.eopkg" {
+		t.Fatalf("Rename should find a free name, got %s %v", name, err)
+	}
+
+	// Identical files never collide
+	writeTestFile(t, filepath.Join(outDir, "nano-5.7-69-1-x86_64.eopkg"), "new")
+	ArtifactCollision = CollisionRefuse
+	if name, err := freeArtifactName(built, outDir); err != nil || name != "nano-5.7-69-1-x86_64.eopkg" {
+		t.Fatalf("Identical file should not collide, got %s %v", name, err)
+	}
+}
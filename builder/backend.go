@@ -0,0 +1,229 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// BackendChroot runs build commands with chroot, the default
+	BackendChroot = "chroot"
+
+	// BackendPodman runs each build command in an OCI container with podman,
+	// using the overlay of the build as the root filesystem
+	BackendPodman = "podman"
+
+	// BackendNspawn runs each build command in a container with
+	// systemd-nspawn, using the overlay of the build as its directory
+	BackendNspawn = "nspawn"
+
+	// containerLabel marks the containers of a build with their root, so that
+	// any still running may be removed when tearing down the root
+	containerLabel = "solbuild.root"
+)
+
+var (
+	// ExecBackend is how commands are run within the build root
+	ExecBackend = BackendChroot
+
+	// ErrUnknownBackend is returned for an unsupported execution backend
+	ErrUnknownBackend = errors.New("Unknown execution backend")
+
+	// ErrBackendUnsupported is returned when the backend can't be combined
+	// with the other options of the build
+	ErrBackendUnsupported = errors.New("Container backends cannot be combined with rootless builds or --trace")
+)
+
+// ValidBackend determines whether the name is a supported execution backend
+func ValidBackend(name string) bool {
+	switch name {
+	case "", BackendChroot, BackendPodman, BackendNspawn:
+		return true
+	default:
+		return false
+	}
+}
+
+// backendTools are the host commands needed by each container backend
+var backendTools = map[string]string{
+	BackendPodman: "podman",
+	BackendNspawn: "systemd-nspawn",
+}
+
+// CheckBackend will ensure that the backend can be used on this host
+func CheckBackend(name string) error {
+	tool, ok := backendTools[name]
+	if !ok {
+		return nil
+	}
+	if Rootless || TraceBuild {
+		return ErrBackendUnsupported
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return fmt.Errorf("%s is required for the %s backend, reason: %s", tool, name, err)
+	}
+	return nil
+}
+
+// containerBackend determines whether commands run in containers, which
+// bring up their own virtual filesystems
+func containerBackend() bool {
+	_, ok := backendTools[ExecBackend]
+	return ok
+}
+
+// rootCommand returns the command line running command within the root at
+// dir. Container backends share the networking of solbuild, so that builds
+// which drop networking stay without it, while every other namespace is the
+// container's own.
+func rootCommand(dir, command string, interactive bool) []string {
+	switch ExecBackend {
+	case BackendPodman:
+		return podmanCommand(dir, command, interactive)
+	case BackendNspawn:
+		return nspawnCommand(dir, command, interactive)
+	default:
+		return []string{"chroot", dir, "/bin/sh", "-c", command}
+	}
+}
+
+// pipedRootCommand returns the command line running command within the root
+// without a terminal, but with our stdin still passed through to it
+func pipedRootCommand(dir, command string) []string {
+	args := rootCommand(dir, command, false)
+	if ExecBackend == BackendPodman {
+		// podman only forwards stdin when asked to, ahead of "/bin/sh -c"
+		n := len(args) - 3
+		return append(append(args[:n:n], "--interactive"), args[n:]...)
+	}
+	return args
+}
+
+// podmanCommand returns the command line running command with podman
+func podmanCommand(dir, command string, interactive bool) []string {
+	args := []string{
+		"podman", "run", "--rm",
+		"--rootfs", dir,
+		"--label", fmt.Sprintf("%s=%s", containerLabel, dir),
+		"--network", "host",
+		"--log-driver", "none",
+		"--security-opt", "label=disable",
+		"--user", "root",
+		"--workdir", "/",
+	}
+	// Keep the container within the cgroup limiting the build
+	if ActiveBuildCgroup != nil {
+		args = append(args, "--cgroups", "disabled")
+	}
+	if interactive {
+		args = append(args, "--interactive", "--tty")
+	}
+	// Values are taken from our environment so they're not on the command line
+	for _, env := range ChrootEnvironment {
+		args = append(args, "--env", strings.SplitN(env, "=", 2)[0])
+	}
+	return append(args, "/bin/sh", "-c", command)
+}
+
+// nspawnCommand returns the command line running command with
+// systemd-nspawn. The command runs as the second process of the container,
+// so anything it leaves running is killed along with the container.
+func nspawnCommand(dir, command string, interactive bool) []string {
+	args := []string{
+		"systemd-nspawn", "--quiet",
+		"--directory=" + dir,
+		"--register=no",
+		"--as-pid2",
+		"--resolv-conf=off",
+		"--timezone=off",
+		"--link-journal=no",
+		"--chdir=/",
+	}
+	// Keep the container within the cgroup limiting the build
+	if ActiveBuildCgroup != nil {
+		args = append(args, "--keep-unit")
+	}
+	if interactive {
+		args = append(args, "--console=interactive")
+	} else {
+		args = append(args, "--console=pipe")
+	}
+	for _, env := range ChrootEnvironment {
+		args = append(args, "--setenv="+strings.SplitN(env, "=", 2)[0])
+	}
+	return append(args, "/bin/sh", "-c", command)
+}
+
+// stopContainers will remove any containers still running within the root
+func stopContainers(dir string) {
+	switch ExecBackend {
+	case BackendPodman:
+		stopPodman(dir)
+	case BackendNspawn:
+		stopNspawn(dir)
+	}
+}
+
+// stopNspawn will terminate any systemd-nspawn still running for the root,
+// which kills every process within its container.
+func stopNspawn(dir string) {
+	match := []byte("--directory=" + dir + "\x00")
+	cmdlines, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, path := range cmdlines {
+		cmdline, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.Contains(cmdline, match) {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(path)))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		log.Debugf("Terminating systemd-nspawn %d still running in %s\n", pid, dir)
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			log.Warnf("Failed to terminate systemd-nspawn %d, reason: %s\n", pid, err)
+		}
+	}
+}
+
+// stopPodman will remove any podman containers still running for the root
+func stopPodman(dir string) {
+	filter := fmt.Sprintf("label=%s=%s", containerLabel, dir)
+	out, err := exec.Command("podman", "ps", "--quiet", "--filter", filter).Output()
+	if err != nil {
+		log.Warnf("Failed to list the containers of %s, reason: %s\n", dir, err)
+		return
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return
+	}
+	log.Debugf("Removing %d containers still running in %s\n", len(ids), dir)
+	if err := exec.Command("podman", append([]string{"rm", "--force"}, ids...)...).Run(); err != nil {
+		log.Warnf("Failed to remove the containers of %s, reason: %s\n", dir, err)
+	}
+}
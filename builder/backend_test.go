@@ -0,0 +1,89 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRootCommand(t *testing.T) {
+	defer func(backend string, env []string) {
+		ExecBackend = backend
+		ChrootEnvironment = env
+	}(ExecBackend, ChrootEnvironment)
+	ChrootEnvironment = []string{"PATH=/usr/bin:/bin", "HOME=/root"}
+
+	ExecBackend = BackendChroot
+	want := []string{"chroot", "/union", "/bin/sh", "-c", "true"}
+	if got := rootCommand("/union", "true", false); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong chroot command: %v", got)
+	}
+
+	ExecBackend = BackendPodman
+	want = []string{
+		"podman", "run", "--rm",
+		"--rootfs", "/union",
+		"--label", "solbuild.root=/union",
+		"--network", "host",
+		"--log-driver", "none",
+		"--security-opt", "label=disable",
+		"--user", "root",
+		"--workdir", "/",
+		"--interactive", "--tty",
+		"--env", "PATH",
+		"--env", "HOME",
+		"/bin/sh", "-c", "true",
+	}
+	if got := rootCommand("/union", "true", true); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong podman command: %v", got)
+	}
+
+	ExecBackend = BackendNspawn
+	want = []string{
+		"systemd-nspawn", "--quiet",
+		"--directory=/union",
+		"--register=no",
+		"--as-pid2",
+		"--resolv-conf=off",
+		"--timezone=off",
+		"--link-journal=no",
+		"--chdir=/",
+		"--console=pipe",
+		"--setenv=PATH",
+		"--setenv=HOME",
+		"/bin/sh", "-c", "true",
+	}
+	if got := rootCommand("/union", "true", false); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong nspawn command: %v", got)
+	}
+
+	if got := pipedRootCommand("/union", "true"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong piped nspawn command: %v", got)
+	}
+
+	ExecBackend = BackendPodman
+	got := pipedRootCommand("/union", "true")
+	if n := len(got); n < 4 || got[n-4] != "--interactive" || got[n-3] != "/bin/sh" {
+		t.Errorf("Expected podman to forward stdin without a tty: %v", got)
+	}
+	for _, arg := range got {
+		if arg == "--tty" {
+			t.Errorf("Expected no tty for a piped podman command: %v", got)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// BatchSucceeded is the status of a batch entry that was built
+	BatchSucceeded = "succeeded"
+
+	// BatchFailed is the status of a batch entry that failed to build
+	BatchFailed = "failed"
+)
+
+// ErrEmptyManifest is returned for a build manifest without any builds
+var ErrEmptyManifest = errors.New("Build manifest lists no builds")
+
+// A BatchEntry is a single build listed in a build manifest
+type BatchEntry struct {
+	Recipe  string `yaml:"recipe"`            // package.yml or pspec.xml to build
+	Profile string `yaml:"profile,omitempty"` // Profile to build with, if not the default
+	Output  string `yaml:"output,omitempty"`  // Directory the packages are collected into
+}
+
+// A BatchManifest lists the builds of a batch, with relative paths resolved
+// against the directory of the manifest.
+type BatchManifest struct {
+	Builds []*BatchEntry `yaml:"builds"`
+}
+
+// LoadBatchManifest will read and validate the build manifest at path
+func LoadBatchManifest(path string) (*BatchManifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BatchManifest{}
+	if err := yaml.UnmarshalStrict(b, manifest); err != nil {
+		return nil, fmt.Errorf("Invalid build manifest %s, reason: %s", path, err)
+	}
+	if len(manifest.Builds) == 0 {
+		return nil, ErrEmptyManifest
+	}
+	// Builds may run from elsewhere, so never leave the paths relative
+	base, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range manifest.Builds {
+		if entry.Recipe == "" {
+			return nil, fmt.Errorf("Build %d of %s has no recipe", i+1, path)
+		}
+		if !filepath.IsAbs(entry.Recipe) {
+			entry.Recipe = filepath.Join(base, entry.Recipe)
+		}
+		if strings.HasSuffix(entry.Recipe, string(filepath.Separator)) || PathExists(filepath.Join(entry.Recipe, "package.yml")) {
+			entry.Recipe = filepath.Join(entry.Recipe, "package.yml")
+		}
+		if entry.Output == "" {
+			entry.Output = "."
+		} else if !filepath.IsAbs(entry.Output) {
+			entry.Output = filepath.Join(base, entry.Output)
+		}
+	}
+	return manifest, nil
+}
+
+// Write will store the manifest at path, with the recipes and outputs
+// relative to its directory where possible.
+func (m *BatchManifest) Write(path string) error {
+	base, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	relative := func(p string) string {
+		if p == "" {
+			return p
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return p
+		}
+		if rel, err := filepath.Rel(base, abs); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+		return abs
+	}
+	out := &BatchManifest{}
+	for _, entry := range m.Builds {
+		out.Builds = append(out.Builds, &BatchEntry{
+			Recipe:  relative(entry.Recipe),
+			Profile: entry.Profile,
+			Output:  relative(entry.Output),
+		})
+	}
+	b, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 00644)
+}
+
+// A BatchResult is the outcome of a single build of a batch
+type BatchResult struct {
+	Recipe    string   `json:"recipe"`
+	Profile   string   `json:"profile,omitempty"`
+	Output    string   `json:"output"`
+	Status    string   `json:"status"`
+	Error     string   `json:"error,omitempty"`
+	Duration  float64  `json:"duration_seconds"`
+	Artifacts []string `json:"artifacts"`
+}
+
+// NewBatchResult will record the outcome of building the entry, listing the
+// artifacts of a successful build from its stamp.
+func NewBatchResult(entry *BatchEntry, duration time.Duration, buildErr error) *BatchResult {
+	result := &BatchResult{
+		Recipe:    entry.Recipe,
+		Profile:   entry.Profile,
+		Output:    entry.Output,
+		Status:    BatchSucceeded,
+		Duration:  duration.Seconds(),
+		Artifacts: []string{},
+	}
+	if out, err := filepath.Abs(entry.Output); err == nil {
+		result.Output = out
+	}
+	if buildErr != nil {
+		result.Status = BatchFailed
+		result.Error = buildErr.Error()
+		return result
+	}
+	pkg, err := NewPackage(entry.Recipe)
+	if err != nil {
+		result.Error = fmt.Sprintf("Unable to list artifacts, reason: %s", err)
+		return result
+	}
+	stamp, err := LoadBuildStamp(GetBuildStampPath(pkg, result.Output))
+	if err != nil {
+		result.Error = fmt.Sprintf("Unable to list artifacts, reason: %s", err)
+		return result
+	}
+	for _, file := range stamp.Files {
+		result.Artifacts = append(result.Artifacts, filepath.Join(result.Output, file))
+	}
+	return result
+}
+
+// BatchResults is the machine readable outcome of a batch of builds
+type BatchResults struct {
+	Manifest  string         `json:"manifest"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []*BatchResult `json:"results"`
+}
+
+// Add will record the result, counting its status
+func (r *BatchResults) Add(result *BatchResult) {
+	r.Results = append(r.Results, result)
+	if result.Status == BatchFailed {
+		r.Failed++
+	} else {
+		r.Succeeded++
+	}
+}
+
+// Write will store the results as JSON at the given path
+func (r *BatchResults) Write(path string) error {
+	b, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 00644)
+}
@@ -0,0 +1,102 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadBatchManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "nano", "package.yml"), "name: nano\nversion: 5.0\nrelease: 3\n")
+	writeTestFile(t, filepath.Join(dir, "builds.yml"), `builds:
+    - recipe: nano
+      profile: unstable-x86_64
+      output: out/nano
+    - recipe: /srv/zlib/pspec.xml
+`)
+	manifest, err := LoadBatchManifest(filepath.Join(dir, "builds.yml"))
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %s", err)
+	}
+	expected := []*BatchEntry{
+		{Recipe: filepath.Join(dir, "nano", "package.yml"), Profile: "unstable-x86_64", Output: filepath.Join(dir, "out", "nano")},
+		{Recipe: "/srv/zlib/pspec.xml", Output: "."},
+	}
+	if !reflect.DeepEqual(manifest.Builds, expected) {
+		t.Fatalf("Unexpected entries: %+v %+v", manifest.Builds[0], manifest.Builds[1])
+	}
+
+	// Relative manifests still resolve to absolute recipes
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if manifest, err = LoadBatchManifest("builds.yml"); err != nil {
+		t.Fatalf("Failed to load manifest: %s", err)
+	}
+	if !reflect.DeepEqual(manifest.Builds, expected) {
+		t.Fatalf("Unexpected entries of a relative manifest: %+v", manifest.Builds[0])
+	}
+
+	writeTestFile(t, filepath.Join(dir, "typo.yml"), "builds:\n    - recipe: nano\n      ouptut: out\n")
+	if _, err := LoadBatchManifest(filepath.Join(dir, "typo.yml")); err == nil {
+		t.Fatalf("Unknown keys should be refused")
+	}
+	writeTestFile(t, filepath.Join(dir, "empty.yml"), "builds: []\n")
+	if _, err := LoadBatchManifest(filepath.Join(dir, "empty.yml")); err != ErrEmptyManifest {
+		t.Fatalf("Empty manifest should be refused, got %v", err)
+	}
+}
+
+func TestBatchResult(t *testing.T) {
+	dir := t.TempDir()
+	recipe := filepath.Join(dir, "nano", "package.yml")
+	writeTestFile(t, recipe, "name: nano\nversion: 5.0\nrelease: 3\n")
+	out := filepath.Join(dir, "out")
+	pkg := &Package{Name: "nano", Version: "5.0", Release: 3}
+	stamp := &BuildStamp{Name: "nano", Files: []string{"nano-5.0-3-1-x86_64.eopkg", "abi_symbols"}}
+	writeTestFile(t, filepath.Join(out, "placeholder"), "")
+	if err := stamp.Write(GetBuildStampPath(pkg, out)); err != nil {
+		t.Fatal(err)
+	}
+	entry := &BatchEntry{Recipe: recipe, Output: out}
+
+	result := NewBatchResult(entry, time.Second, nil)
+	if result.Status != BatchSucceeded || result.Error != "" {
+		t.Fatalf("Expected success, got %+v", result)
+	}
+	if !reflect.DeepEqual(result.Artifacts, []string{filepath.Join(out, "nano-5.0-3-1-x86_64.eopkg"), filepath.Join(out, "abi_symbols")}) {
+		t.Fatalf("Unexpected artifacts %v", result.Artifacts)
+	}
+
+	results := &BatchResults{}
+	results.Add(result)
+	results.Add(NewBatchResult(entry, time.Second, errors.New("exit status 1")))
+	if results.Succeeded != 1 || results.Failed != 1 || results.Results[1].Status != BatchFailed {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+}
@@ -0,0 +1,232 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"github.com/getsolus/libosdev/disk"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// RootfsOverlay forms the build root as an overlayfs over the backing image
+	RootfsOverlay = "overlay"
+
+	// RootfsBtrfs forms the build root as a btrfs snapshot of the backing image
+	RootfsBtrfs = "btrfs"
+
+	// SubvolumeDir is where the base subvolumes live within the overlay root
+	SubvolumeDir = "subvolumes"
+
+	btrfsSuperMagic   = 0x9123683E // f_type of btrfs in statfs
+	btrfsSubvolumeIno = 256        // Inode of the root of every subvolume
+
+	subvolumeRecheck = 2 * time.Second // Wait between checks of a locked base subvolume
+)
+
+var (
+	// ErrUnknownRootfsBackend is returned for an unknown rootfs_backend
+	ErrUnknownRootfsBackend = errors.New("Unknown rootfs backend, use overlay or btrfs")
+)
+
+// ValidRootfsBackend will determine whether the rootfs backend is known
+func ValidRootfsBackend(backend string) error {
+	switch backend {
+	case "", RootfsOverlay, RootfsBtrfs:
+		return nil
+	default:
+		return ErrUnknownRootfsBackend
+	}
+}
+
+// IsBtrfs will determine whether the path lives on a btrfs filesystem
+func IsBtrfs(path string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false
+	}
+	return uint32(st.Type) == btrfsSuperMagic
+}
+
+// IsSubvolume will determine whether the path is the root of a btrfs subvolume
+func IsSubvolume(path string) bool {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return false
+	}
+	return st.Ino == btrfsSubvolumeIno && IsBtrfs(path)
+}
+
+// GetSubvolumePath will return the base subvolume that the build roots of
+// the backing image are snapshot from.
+func GetSubvolumePath(config *Config, back *BackingImage) string {
+	return filepath.Join(config.OverlayRootDir, SubvolumeDir, back.Name)
+}
+
+// rootfsBackend will settle the rootfs backend of a build, falling back to
+// overlayfs with the reason when btrfs snapshots can't be used.
+func rootfsBackend(profile *Profile, tmpfs bool, overlayRoot string) (backend, reason string) {
+	if profile.RootfsBackend != RootfsBtrfs {
+		return RootfsOverlay, ""
+	}
+	switch {
+	case Rootless:
+		return RootfsOverlay, "rootless builds"
+	case tmpfs:
+		return RootfsOverlay, "builds in a tmpfs"
+	case !IsBtrfs(overlayRoot):
+		return RootfsOverlay, fmt.Sprintf("%s, which is not on btrfs", overlayRoot)
+	}
+	if _, err := exec.LookPath("btrfs"); err != nil {
+		return RootfsOverlay, "hosts without btrfs-progs"
+	}
+	return RootfsBtrfs, ""
+}
+
+// setRootfsBackend will configure the overlay with the rootfs backend of the
+// profile, once the tmpfs has been settled.
+func (m *Manager) setRootfsBackend() {
+	if m.profile.RootfsBackend == RootfsBtrfs {
+		os.MkdirAll(m.Config.OverlayRootDir, 00755)
+	}
+	backend, reason := rootfsBackend(m.profile, m.overlay.EnableTmpfs, m.Config.OverlayRootDir)
+	if reason != "" {
+		log.Warnf("btrfs snapshots are unavailable for %s, using overlayfs\n", reason)
+	}
+	m.overlay.RootfsBackend = backend
+}
+
+// btrfs will run the btrfs tool with the given arguments
+func btrfs(args ...string) error {
+	return commands.ExecStdoutArgs("btrfs", args)
+}
+
+// removeSubvolume will delete the subvolume at path, or the directory should
+// it not be one.
+func removeSubvolume(path string) error {
+	if IsSubvolume(path) {
+		return btrfs("subvolume", "delete", path)
+	}
+	return os.RemoveAll(path)
+}
+
+// removeBuildRoot will remove the workspace of a build root, deleting the
+// snapshot within it first as that is instant, unlike removing every file.
+func removeBuildRoot(dir string) error {
+	if union := filepath.Join(dir, "union"); IsSubvolume(union) {
+		if err := btrfs("subvolume", "delete", union); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// imageStamp identifies the revision of the backing image a base subvolume
+// was populated from.
+func imageStamp(path string) (string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %d", st.ModTime().UnixNano(), st.Size()), nil
+}
+
+// populateSubvolume will make sure the base subvolume holds the contents of
+// the current backing image, copying them in again when the image changes.
+// Existing snapshots are independent of the base and stay intact.
+func (o *Overlay) populateSubvolume() error {
+	stamp, err := imageStamp(o.Back.ImagePath)
+	if err != nil {
+		return err
+	}
+	stampPath := o.SubvolumeDir + ".stamp"
+	if b, err := ioutil.ReadFile(stampPath); err == nil && string(b) == stamp && IsSubvolume(o.SubvolumeDir) {
+		return nil
+	}
+	log.Infof("Populating base subvolume from %s\n", o.Back.ImagePath)
+
+	fresh := o.SubvolumeDir + ".new"
+	if err := removeSubvolume(fresh); err != nil {
+		return fmt.Errorf("Failed to remove stale subvolume: dir='%s', reason: %s\n", fresh, err)
+	}
+	if err := btrfs("subvolume", "create", fresh); err != nil {
+		return fmt.Errorf("Failed to create subvolume: dir='%s', reason: %s\n", fresh, err)
+	}
+
+	mountMan := disk.GetMountManager()
+	log.Debugf("Mounting backing image: point='%s'\n", o.Back.ImagePath)
+	if err := mountMan.Mount(o.Back.ImagePath, o.ImgDir, "auto", "ro", "loop"); err != nil {
+		return fmt.Errorf("Failed to mount backing image: point='%s', reason: %s\n", o.Back.ImagePath, err)
+	}
+	o.mountedImg = true
+	if err := commands.ExecStdoutArgs("cp", []string{"-a", o.ImgDir + "/.", fresh}); err != nil {
+		return fmt.Errorf("Failed to copy backing image: dir='%s', reason: %s\n", fresh, err)
+	}
+	if err := mountMan.Unmount(o.ImgDir); err != nil {
+		return err
+	}
+	o.mountedImg = false
+
+	if err := removeSubvolume(o.SubvolumeDir); err != nil {
+		return fmt.Errorf("Failed to remove outdated subvolume: dir='%s', reason: %s\n", o.SubvolumeDir, err)
+	}
+	if err := os.Rename(fresh, o.SubvolumeDir); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stampPath, []byte(stamp), 00644)
+}
+
+// mountSnapshot will form the build root as a btrfs snapshot of the base
+// subvolume, or reuse the snapshot already in place for a kept root.
+func (o *Overlay) mountSnapshot() error {
+	if IsSubvolume(o.MountPoint) {
+		log.Debugf("Reusing btrfs snapshot: %s\n", o.MountPoint)
+		return EnsureEopkgLayout(o.MountPoint)
+	}
+
+	// Builds of other packages share the base subvolume, so wait our turn
+	lock, err := NewLockFile(o.SubvolumeDir + ".lock")
+	if err != nil {
+		return err
+	}
+	if err := lock.Wait(subvolumeRecheck); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if err := o.populateSubvolume(); err != nil {
+		return err
+	}
+
+	// The snapshot would otherwise be created within the mount point
+	if err := os.Remove(o.MountPoint); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Debugf("Snapshotting base subvolume: source='%s' target='%s'\n", o.SubvolumeDir, o.MountPoint)
+	if err := btrfs("subvolume", "snapshot", o.SubvolumeDir, o.MountPoint); err != nil {
+		return fmt.Errorf("Failed to snapshot base subvolume: point='%s', reason: %s\n", o.MountPoint, err)
+	}
+	return EnsureEopkgLayout(o.MountPoint)
+}
@@ -0,0 +1,53 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestValidRootfsBackend(t *testing.T) {
+	for _, backend := range []string{"", RootfsOverlay, RootfsBtrfs} {
+		if err := ValidRootfsBackend(backend); err != nil {
+			t.Errorf("Rootfs backend '%s' should be valid, got: %s", backend, err)
+		}
+	}
+	if err := ValidRootfsBackend("zfs"); err != ErrUnknownRootfsBackend {
+		t.Errorf("Expected ErrUnknownRootfsBackend, got: %v", err)
+	}
+}
+
+func TestRootfsBackendFallback(t *testing.T) {
+	dir := t.TempDir()
+	profile := &Profile{}
+	if backend, reason := rootfsBackend(profile, false, dir); backend != RootfsOverlay || reason != "" {
+		t.Fatalf("Expected overlay without a reason, got: %s (%s)", backend, reason)
+	}
+	profile.RootfsBackend = RootfsBtrfs
+	if backend, reason := rootfsBackend(profile, true, dir); backend != RootfsOverlay || reason == "" {
+		t.Fatalf("Expected a tmpfs build to fall back to overlay, got: %s (%s)", backend, reason)
+	}
+	if IsBtrfs(dir) {
+		t.Skip("Temporary directory is on btrfs")
+	}
+	if backend, reason := rootfsBackend(profile, false, dir); backend != RootfsOverlay || reason == "" {
+		t.Fatalf("Expected a root off btrfs to fall back to overlay, got: %s (%s)", backend, reason)
+	}
+	if IsSubvolume(dir) {
+		t.Fatalf("Directory %s should not be a subvolume", dir)
+	}
+}
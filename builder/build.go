@@ -21,8 +21,10 @@ import (
 	"fmt"
 	log "github.com/DataDrake/waterlog"
 	"github.com/getsolus/libosdev/disk"
+	"github.com/getsolus/solbuild/builder/source"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // CreateDirs creates any directories we may need later on
@@ -69,13 +71,15 @@ func (p *Package) CreateDirs(o *Overlay) error {
 
 // FetchSources will attempt to fetch the sources from the network
 // if necessary
-func (p *Package) FetchSources(o *Overlay) error {
+func (p *Package) FetchSources(o *Overlay, network source.Network) error {
+	restore := FetchLimits.throttle()
+	defer restore()
 	for _, source := range p.Sources {
 		// Already fetched, skip it
 		if source.IsFetched() {
 			continue
 		}
-		if err := source.Fetch(); err != nil {
+		if err := source.Fetch(network); err != nil {
 			return fmt.Errorf("Failed to fetch source %s, reason: %s\n", source.GetIdentifier(), err)
 		}
 	}
@@ -130,12 +134,10 @@ func (p *Package) BindSources(o *Overlay) error {
 func (p *Package) BindCcache(o *Overlay) error {
 	mountMan := disk.GetMountManager()
 	ccacheDir := p.GetCcacheDir(o)
+	ccacheSource := p.CcacheSource()
 
-	var ccacheSource string
-	if p.Type == PackageTypeXML {
-		ccacheSource = LegacyCcacheDirectory
-	} else {
-		ccacheSource = CcacheDirectory
+	if err := p.applyCcacheMaxSize(); err != nil {
+		return err
 	}
 
 	log.Debugf("Exposing ccache to build %s\n", ccacheDir)
@@ -285,20 +287,12 @@ func (p *Package) PrepYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager,
 		return fmt.Errorf("Failed to write packager file %s, reason: %s\n", fp, err)
 	}
 
-	wdir := p.GetWorkDirInternal()
-	ymlFile := filepath.Join(wdir, filepath.Base(p.Path))
-	cmd := fmt.Sprintf("ypkg-install-deps -f %s", ymlFile)
-	if DisableColors {
-		cmd += " -n"
-	}
-
 	// Install build dependencies
-	log.Debugf("Installing build dependencies %s\n", ymlFile)
+	log.Debugf("Installing build dependencies %s\n", p.Path)
 
-	if err := ChrootExec(notif, overlay.MountPoint, cmd); err != nil {
-		return fmt.Errorf("Failed to install build dependencies %s, reason: %s\n", ymlFile, err)
+	if err := p.installDeps(notif, pman, overlay); err != nil {
+		return fmt.Errorf("Failed to install build dependencies %s, reason: %s\n", p.Path, err)
 	}
-	notif.SetActivePID(0)
 
 	// Cleanup now
 	log.Debugln("Stopping D-BUS")
@@ -307,7 +301,7 @@ func (p *Package) PrepYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager,
 	}
 
 	// Chwn the directory before bringing up sources
-	cmd = fmt.Sprintf("chown -R %s:%s %s", BuildUser, BuildUser, BuildUserHome)
+	cmd := chownHomeCommand()
 	if err := ChrootExec(notif, overlay.MountPoint, cmd); err != nil {
 		return fmt.Errorf("Failed to set home directory permissions, reason: %s\n", err)
 	}
@@ -315,25 +309,79 @@ func (p *Package) PrepYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager,
 	return nil
 }
 
+// installDepsCommand returns the command to install the build dependencies
+// of a package.yml
+func (p *Package) installDepsCommand() string {
+	ymlFile := filepath.Join(p.GetWorkDirInternal(), filepath.Base(p.Path))
+	cmd := fmt.Sprintf("ypkg-install-deps -f %s", ymlFile)
+	if DisableColors {
+		cmd += " -n"
+	}
+	return cmd
+}
+
+// chownHomeCommand returns the command giving the build user their home
+func chownHomeCommand() string {
+	return fmt.Sprintf("chown -R %s:%s %s", BuildUser, BuildUser, BuildUserHome)
+}
+
+// ypkgBuildCommand returns the command to build a package.yml, passing the
+// unix timestamp of the last git update when there is history
+func (p *Package) ypkgBuildCommand(h *PackageHistory) string {
+	wdir := p.GetWorkDirInternal()
+	ymlFile := filepath.Join(wdir, filepath.Base(p.Path))
+	cmd := fmt.Sprintf("/bin/su %s -- fakeroot ypkg-build -D %s %s", BuildUser, wdir, ymlFile)
+	if DisableColors {
+		cmd += " -n"
+	}
+	if epoch := h.SourceDateEpoch(); epoch > 0 {
+		cmd += fmt.Sprintf(" -t %v", epoch)
+	}
+	return cmd
+}
+
+// xmlBuildCommand returns the command to build a pspec.xml
+func (p *Package) xmlBuildCommand() string {
+	wdir := p.GetWorkDirInternal()
+	xmlFile := filepath.Join(wdir, filepath.Base(p.Path))
+	// ignore-sandbox in case someone is stupid and activates it in eopkg.conf..
+	return eopkgCommand(fmt.Sprintf("eopkg build --ignore-sandbox --yes-all -O %s %s", wdir, xmlFile))
+}
+
 // BuildYpkg will take care of the ypkg specific build process and is called only
 // by Build()
-func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager, overlay *Overlay, h *PackageHistory) error {
+func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager, overlay *Overlay, h *PackageHistory, envLock *EnvironmentLock, secrets *Secrets) error {
 	if err := p.PrepYpkg(notif, usr, pman, overlay, h); err != nil {
 		return err
 	}
 
-	// Now kill networking
-	if !p.CanNetwork {
-		if err := DropNetworking(); err != nil {
+	// Record the fully populated root, and enforce any expected lock
+	if envLock != nil {
+		if err := envLock.ScanPackages(overlay.MountPoint); err != nil {
+			return fmt.Errorf("Failed to record installed packages, reason: %s\n", err)
+		}
+		if err := envLock.VerifyPackages(); err != nil {
 			return err
 		}
+	}
+	if err := p.checkPromotion(overlay); err != nil {
+		return err
+	}
 
-		// Ensure the overlay can network on localhost only
-		if err := overlay.ConfigureNetworking(); err != nil {
-			return err
+	// Prime the shared ccache while the network is still available
+	if CcacheSeedURL != "" {
+		if err := p.seedCcache(CcacheSeedURL, CcacheSeedKey, CcacheDirectory); err != nil {
+			log.Warnf("Unable to seed ccache, reason: %s\n", err)
 		}
-	} else {
-		log.Warnln("Package has explicitly requested networking, sandboxing disabled")
+	}
+
+	// Now kill networking
+	proxy, err := p.isolateNetwork(overlay)
+	if err != nil {
+		return err
+	}
+	if proxy != nil {
+		defer proxy.Close()
 	}
 
 	// Bring up sources
@@ -356,35 +404,104 @@ func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager
 		return err
 	}
 
+	// Ensure we have the cargo caches available
+	if err := p.BindCargo(overlay); err != nil {
+		return err
+	}
+
+	// Ensure we have the language dependency caches available
+	if err := p.BindLanguageCaches(overlay); err != nil {
+		return err
+	}
+
+	// Expose the extra mounts of solbuild.yml
+	if err := p.BindOverrideMounts(overlay); err != nil {
+		return err
+	}
+
 	// Now recopy the assets prior to build
 	if err := pman.CopyAssets(); err != nil {
 		return err
 	}
 
-	wdir := p.GetWorkDirInternal()
-	ymlFile := filepath.Join(wdir, filepath.Base(p.Path))
+	if err := p.applyAdaptiveJobs(pman); err != nil {
+		return err
+	}
+
+	if err := p.applyCompression(pman); err != nil {
+		return err
+	}
+
+	if err := p.applyCheckRetries(overlay); err != nil {
+		return fmt.Errorf("Failed to configure check retries, reason: %s\n", err)
+	}
+
+	appstream, err := p.startAppStreamSync(overlay, h)
+	if err != nil {
+		return fmt.Errorf("Failed to prepare AppStream releases, reason: %s\n", err)
+	}
+	if appstream != nil {
+		defer appstream.Stop()
+	}
+
+	if err := p.enterPhase(PhaseBuild); err != nil {
+		return err
+	}
 
 	// Now build the package
-	cmd := fmt.Sprintf("/bin/su %s -- fakeroot ypkg-build -D %s %s", BuildUser, wdir, ymlFile)
-	if DisableColors {
-		cmd += " -n"
+	cmd := p.ypkgBuildCommand(h)
+
+	// Pass unix timestamp of last git update to build tooling
+	env := ChrootEnvironment
+	buildEnv := append(append([]string{}, env...), variantEnvironment()...)
+	if epoch := h.SourceDateEpoch(); epoch > 0 {
+		buildEnv = append(buildEnv, fmt.Sprintf("SOURCE_DATE_EPOCH=%d", epoch))
 	}
-	// Pass unix timestamp of last git update
-	if h != nil && len(h.Updates) > 0 {
-		cmd += fmt.Sprintf(" -t %v", h.GetLastVersionTimestamp())
+
+	// Secrets are only visible to the build itself
+	if !secrets.IsEmpty() {
+		buildEnv = append(buildEnv, secrets.Environment()...)
 	}
+	ChrootEnvironment = buildEnv
+	defer func() {
+		ChrootEnvironment = env
+	}()
 
 	log.Infoln("Now starting build of package")
-	if err := ChrootExec(notif, overlay.MountPoint, cmd); err != nil {
+	oom := NewOOMMonitor()
+	err = p.execBuild(notif, overlay.MountPoint, BuildLimits.command()+coreLimitCommand()+variantCommand()+cmd)
+	p.collectCheckAttempts(overlay, usr)
+	if err != nil {
+		reportOOM(oom, overlay)
+		if cerr := p.CollectCrashArtifacts(overlay, usr); cerr != nil {
+			log.Warnf("Failed to collect crash artifacts, reason: %s\n", cerr)
+		}
 		return fmt.Errorf("Failed to start build of package, reason: %s\n", err)
 	}
 
-	// Generate ABI Report
+	// Refuse to emit any artifact containing a secret
+	installDir := filepath.Join(overlay.MountPoint, BuildUserHome, "YPKG", "root", p.Name, "install")
+	if err := secrets.ScanPaths(installDir, p.GetWorkDir(overlay)); err != nil {
+		return err
+	}
+
+	// Generate ABI Report, which only fails the build when checking the ABI
+	abiReported := false
 	if !DisableABIReport {
 		log.Debugln("Attempting to generate ABI report")
 		if err := p.GenerateABIReport(notif, overlay); err != nil {
 			log.Warnf("Failed to generate ABI report, reason: %s\n", err)
-			return nil
+		} else {
+			abiReported = true
+		}
+	}
+
+	if CheckABIBreaks {
+		if !abiReported {
+			return errors.New("Cannot check the ABI without generating an ABI report")
+		}
+		if err := p.CheckABI(overlay); err != nil {
+			return err
 		}
 	}
 
@@ -392,15 +509,20 @@ func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager
 	return nil
 }
 
+// execBuild will run the build command itself, tracing it if requested
+func (p *Package) execBuild(notif PidNotifier, dir, command string) error {
+	if TraceBuild {
+		return p.TracedChrootExec(notif, dir, command)
+	}
+	return chrootExecWrapped(notif, ActiveBuildCgroup.wrapper(), dir, command, nil)
+}
+
 // BuildXML will take care of building the legacy pspec.xml format, and is called only
 // by Build()
 func (p *Package) BuildXML(notif PidNotifier, pman *EopkgManager, overlay *Overlay) error {
 	// Just straight up build it with eopkg
 	log.Warnln("Full sandboxing is not possible with legacy format")
 
-	wdir := p.GetWorkDirInternal()
-	xmlFile := filepath.Join(wdir, filepath.Base(p.Path))
-
 	// Bring up sources
 	if err := p.BindSources(overlay); err != nil {
 		return fmt.Errorf("Cannot continue without sources.\n")
@@ -421,11 +543,23 @@ func (p *Package) BuildXML(notif PidNotifier, pman *EopkgManager, overlay *Overl
 		return err
 	}
 
-	// Now build the package, ignore-sandbox in case someone is stupid
-	// and activates it in eopkg.conf..
-	cmd := eopkgCommand(fmt.Sprintf("eopkg build --ignore-sandbox --yes-all -O %s %s", wdir, xmlFile))
+	if err := p.applyAdaptiveJobs(pman); err != nil {
+		return err
+	}
+
+	if err := p.applyCompression(pman); err != nil {
+		return err
+	}
+
+	if err := p.enterPhase(PhaseBuild); err != nil {
+		return err
+	}
+
+	cmd := p.xmlBuildCommand()
 	log.Infof("Now starting build of package %s\n", p.Name)
-	if err := ChrootExec(notif, overlay.MountPoint, cmd); err != nil {
+	oom := NewOOMMonitor()
+	if err := p.execBuild(notif, overlay.MountPoint, BuildLimits.command()+variantCommand()+cmd); err != nil {
+		reportOOM(oom, overlay)
 		return fmt.Errorf("Failed to start build of package.\n")
 	}
 	notif.SetActivePID(0)
@@ -439,23 +573,22 @@ func (p *Package) BuildXML(notif PidNotifier, pman *EopkgManager, overlay *Overl
 	return nil
 }
 
-// GenerateABIReport will take care of generating the abireport using abi-wizard
+// GenerateABIReport will analyse the installed files of the package and
+// write the abi_* files of each architecture into the work directory.
 func (p *Package) GenerateABIReport(notif PidNotifier, overlay *Overlay) error {
-	wdir := p.GetWorkDirInternal()
-	cmd := fmt.Sprintf("cd %s; abi-wizard %s/YPKG/root/%s/install", wdir, BuildUserHome, p.Name)
-	if err := ChrootExec(notif, overlay.MountPoint, cmd); err != nil {
-		log.Warnf("Failed to generate abi report %s\n", err)
-		return nil
+	installDir := filepath.Join(overlay.MountPoint, BuildUserHome, "YPKG", "root", p.Name, "install")
+	report, err := NewABIReport(installDir, overlay.MountPoint)
+	if err != nil {
+		return err
 	}
-
-	notif.SetActivePID(0)
-	return nil
+	return report.Write(p.GetWorkDir(overlay))
 }
 
 // CollectAssets will search for the build files and copy them back to the
 // users current directory. If solbuild was invoked via sudo, solbuild will
-// then attempt to set the owner as the original user.
-func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget string) error {
+// then attempt to set the owner as the original user. A non-zero epoch will
+// clamp the modification times of the collected files.
+func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget string, envLock *EnvironmentLock, epoch int64) error {
 	collectionDir := p.GetWorkDir(overlay)
 	collections, _ := filepath.Glob(filepath.Join(collectionDir, "*.eopkg"))
 	if len(collections) < 1 {
@@ -463,9 +596,59 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 		return errors.New("Internal error: .eopkg files are missing")
 	}
 
+	// Settle the names of the packages before anything refers to them
+	var err error
+	outDir := CollisionDir
+	if outDir == "" {
+		if outDir, err = filepath.Abs("."); err != nil {
+			return fmt.Errorf("Unable to find working directory, reason: %s\n", err)
+		}
+	}
+	if collections, err = p.nameArtifacts(overlay, collections, outDir); err != nil {
+		return err
+	}
+	p.collected = nil
+	for _, pkg := range collections {
+		p.collected = append(p.collected, filepath.Base(pkg))
+	}
+
+	// Sign the packages before they're vouched for by the manifest
+	var sigs []string
+	if SigningKey != "" {
+		if sigs, err = signPackages(SigningKey, collections); err != nil {
+			return err
+		}
+	}
+
+	// Record the uncommitted changes, and never vouch for them in a manifest
+	if p.IsTainted() {
+		if len(p.Changes) > 0 && manifestTarget != "" {
+			return ErrTaintedManifest
+		}
+		if manifestTarget != "" {
+			log.Warnf("Not writing a transit manifest, recipe commit is not trusted: %s\n", p.Untrusted)
+			manifestTarget = ""
+		}
+		taintPath, err := p.writeTaint(collectionDir)
+		if err != nil {
+			return err
+		}
+		collections = append(collections, taintPath)
+	}
+
 	// Prior to blitting the files out, let's grab the manifest if requested
 	if manifestTarget != "" {
 		tram := NewTransitManifest(manifestTarget)
+		if PackageCompression != nil {
+			tram.Manifest.Compression = PackageCompression.String()
+		}
+		if BuildCPU != nil {
+			tram.Manifest.CPUBaseline = BuildCPU.String()
+		}
+		if ActivePromotion != nil {
+			tram.Manifest.Promotion = ActivePromotion.Policy
+			tram.Promoted = p.promoted
+		}
 		for _, p := range collections {
 			if err := tram.AddFile(p); err != nil {
 				return fmt.Errorf("Failed to collect eopkg asset for transit manifest %s, reason: %s\n", p, err)
@@ -485,6 +668,32 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 		// Worked, great. Now ensure our next cycle collects, chowns, etc.
 		collections = append(collections, tramPath)
 	}
+	collections = append(collections, sigs...)
+
+	// Write out the environment lock
+	if envLock != nil {
+		lockPath := filepath.Join(collectionDir, EnvironmentLockFile)
+		if err := envLock.Write(lockPath); err != nil {
+			return fmt.Errorf("Failed to write environment lock, reason: %s\n", err)
+		}
+		collections = append(collections, lockPath)
+	}
+
+	// Collect the package diff
+	pkgdiffs, _ := filepath.Glob(filepath.Join(collectionDir, "*"+PackageDiffSuffix))
+	collections = append(collections, pkgdiffs...)
+
+	// Collect the bill of materials
+	for _, suffix := range []string{SBOMSuffixSPDX, SBOMSuffixCycloneDX} {
+		sboms, _ := filepath.Glob(filepath.Join(collectionDir, "*"+suffix))
+		collections = append(collections, sboms...)
+	}
+
+	// Collect the exported history
+	for _, format := range HistoryFormats {
+		histories, _ := filepath.Glob(filepath.Join(collectionDir, "*"+HistorySuffix(format)))
+		collections = append(collections, histories...)
+	}
 
 	// Collect files from abireport
 	abireportfiles, _ := filepath.Glob(filepath.Join(collectionDir, "abi_*"))
@@ -496,6 +705,10 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 	}
 
 	log.Debugf("Collecting files %d\n", len(collections))
+	p.outputs = nil
+	for _, file := range collections {
+		p.outputs = append(p.outputs, filepath.Base(file))
+	}
 
 	for _, p := range collections {
 		tgt, err := filepath.Abs(filepath.Join(".", filepath.Base(p)))
@@ -514,12 +727,30 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 		if err = os.Chown(tgt, usr.UID, usr.GID); err != nil {
 			log.Errorf("Error in restoring file ownership %s, reason: %s\n", filepath.Base(p), err)
 		}
+
+		if epoch > 0 {
+			if err := clampMtime(tgt, time.Unix(epoch, 0)); err != nil {
+				log.Errorf("Error in clamping modification time %s, reason: %s\n", filepath.Base(p), err)
+			}
+		}
 	}
 	return nil
 }
 
+// clampMtime will ensure the file was not modified after the given time
+func clampMtime(path string, clamp time.Time) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !st.ModTime().After(clamp) {
+		return nil
+	}
+	return os.Chtimes(path, clamp, clamp)
+}
+
 // Build will attempt to build the package in the overlayfs system
-func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Profile, pman *EopkgManager, overlay *Overlay, manifestTarget string) error {
+func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Profile, pman *EopkgManager, overlay *Overlay, manifestTarget string, envLock *EnvironmentLock, secrets *Secrets) error {
 	log.Debugf("Building package %s %s %d %s %s\n", p.Name, p.Version, p.Release, p.Type, overlay.Back.Name)
 
 	usr := GetUserInfo()
@@ -530,25 +761,163 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	} else {
 		env = SaneEnvironment(BuildUser, BuildUserHome)
 	}
+	env = append(env, PackageCompression.environment()...)
+	env = append(env, extractEnvironment()...)
+	env = append(env, BuildCPU.environment()...)
+	env = append(env, p.cacheEnvironment()...)
+	env = append(env, fmt.Sprintf("TMPDIR=%s", BuildTmpDir))
 	ChrootEnvironment = env
 
-	// Set up environment
-	if err := overlay.CleanExisting(); err != nil {
+	if p.Type == PackageTypeXML && !secrets.IsEmpty() {
+		return errors.New("Build secrets are only supported for package.yml")
+	}
+
+	if err := RunHooks(NewHookContext(HookPreFetch, p, profile.Name)); err != nil {
+		return err
+	}
+
+	if err := p.prepareRoot(notif, history, profile, pman, overlay); err != nil {
+		return err
+	}
+
+	// Results are compared after the build, once the network is gone
+	p.FetchRepoVersions(notif, overlay)
+	defer p.RemoveRepoVersions(overlay)
+
+	preBuild := NewHookContext(HookPreBuild, p, profile.Name)
+	if err := RunHooks(preBuild); err != nil {
+		return err
+	}
+	if err := p.runContainerHooks(notif, overlay, preBuild); err != nil {
+		return err
+	}
+
+	// The extra environment is given to the build alone, not its setup
+	ChrootEnvironment = append(append([]string{}, env...), p.Environment...)
+
+	// Call the relevant build function
+	tmpWatch := overlay.WatchBuildTmp()
+	var err error
+	if p.Type == PackageTypeYpkg {
+		err = p.BuildYpkg(notif, usr, pman, overlay, history, envLock, secrets)
+	} else {
+		err = p.BuildXML(notif, pman, overlay)
+	}
+	tmpWatch.Stop()
+	ChrootEnvironment = env
+	if err != nil {
+		return err
+	}
+	overlay.AuditTmp()
+
+	setLogPhase(PhaseTest)
+	if err := p.RunInstallTest(notif, pman, overlay); err != nil {
+		return err
+	}
+
+	setLogPhase(PhaseCollect)
+	postBuild := NewHookContext(HookPostBuild, p, profile.Name)
+	postBuild.Artifacts = p.builtArtifacts(overlay)
+	if err := p.runContainerHooks(notif, overlay, postBuild); err != nil {
+		return err
+	}
+
+	if SkipIdenticalRebuilds {
+		identical, err := p.IdenticalToRepo(overlay)
+		if err != nil {
+			log.Warnf("Unable to compare with the repository, reason: %s\n", err)
+		} else if identical {
+			log.Infoln("Rebuild is identical to the repository version, not collecting packages")
+			return nil
+		}
+	}
+
+	// Trace the packages back to the recipe before anything records them
+	if err := p.EmbedOrigin(overlay); err != nil {
+		return err
+	}
+
+	if err := p.CheckSizes(overlay); err != nil {
+		return err
+	}
+
+	if ReportPackageDiff {
+		if err := p.DiffAgainstRepo(overlay); err != nil {
+			log.Warnf("Unable to compare with the repository, reason: %s\n", err)
+		}
+	}
+
+	if SBOMFormat != "" {
+		if err := p.WriteSBOM(overlay, history); err != nil {
+			return err
+		}
+	}
+
+	if err := p.WriteHistory(overlay, history); err != nil {
+		return err
+	}
+
+	var epoch int64
+	if ClampMtimes {
+		epoch = history.SourceDateEpoch()
+	}
+	if err := p.CollectAssets(overlay, usr, manifestTarget, envLock, epoch); err != nil {
+		return err
+	}
+
+	postBuild = NewHookContext(HookPostBuild, p, profile.Name)
+	for _, name := range p.outputs {
+		if path, err := filepath.Abs(name); err == nil {
+			postBuild.Artifacts = append(postBuild.Artifacts, path)
+		}
+	}
+	return RunHooks(postBuild)
+}
+
+// prepareRoot brings up a fresh overlay for the package with the sources,
+// repositories and base components in place, ready for the build proper.
+func (p *Package) prepareRoot(notif PidNotifier, history *PackageHistory, profile *Profile, pman *EopkgManager, overlay *Overlay) error {
+	if err := p.enterPhase(PhaseFetch); err != nil {
 		return err
 	}
 
+	// Set up environment, unless the root was kept from the last build
+	reuse := p.reuseRoot(overlay)
+	if !reuse {
+		if err := overlay.CleanExisting(); err != nil {
+			return err
+		}
+	}
+
 	// Bring up the root
 	if err := p.ActivateRoot(overlay); err != nil {
 		return err
 	}
 
+	// Never collect the packages of the last build
+	if reuse {
+		log.Infoln("Reusing the kept build root")
+		if err := os.RemoveAll(p.GetWorkDir(overlay)); err != nil {
+			return fmt.Errorf("Failed to clean kept build root, reason: %s\n", err)
+		}
+	}
+
 	// Ensure source assets are in place
 	if err := p.CopyAssets(history, overlay); err != nil {
 		return fmt.Errorf("Failed to copy required source assets, reason: %s\n", err)
 	}
 
 	log.Debugln("Validating sources")
-	if err := p.FetchSources(overlay); err != nil {
+	if err := p.FetchSources(overlay, profile.FetchNetwork()); err != nil {
+		return err
+	}
+
+	// Catch patch drift before the expensive parts of the build
+	if err := p.CheckPatches(); err != nil {
+		return err
+	}
+
+	if err := p.enterPhase(PhaseSetup); err != nil {
 		return err
 	}
 
@@ -568,31 +937,26 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 		return fmt.Errorf("Configuring repositories failed, reason: %s\n", err)
 	}
 
-	log.Debugln("Upgrading system base")
-	if err := pman.Upgrade(); err != nil {
-		return fmt.Errorf("Failed to upgrade rootfs, reason: %s\n", err)
-	}
+	// A kept root has already been through this
+	if !reuse {
+		log.Debugln("Upgrading system base")
+		if err := pman.Upgrade(); err != nil {
+			return fmt.Errorf("Failed to upgrade rootfs, reason: %s\n", err)
+		}
 
-	log.Debugln("Asserting system.devel component installation")
-	if err := pman.InstallComponent("system.devel"); err != nil {
-		return fmt.Errorf("Failed to assert system.devel, reason: %s\n", err)
+		log.Debugln("Asserting system.devel component installation")
+		if err := pman.InstallComponent("system.devel"); err != nil {
+			return fmt.Errorf("Failed to assert system.devel, reason: %s\n", err)
+		}
 	}
 
 	// Ensure all directories are in place
 	if err := p.CreateDirs(overlay); err != nil {
 		return err
 	}
-
-	// Call the relevant build function
-	if p.Type == PackageTypeYpkg {
-		if err := p.BuildYpkg(notif, usr, pman, overlay, history); err != nil {
-			return err
-		}
-	} else {
-		if err := p.BuildXML(notif, pman, overlay); err != nil {
-			return err
-		}
+	if err := overlay.MountBuildTmp(); err != nil {
+		return err
 	}
-
-	return p.CollectAssets(overlay, usr, manifestTarget)
+	overlay.prepared = true
+	return nil
 }
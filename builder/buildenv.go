@@ -0,0 +1,93 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// BuildEnvironment holds the variables given to the build with --env,
+	// which take precedence over solbuild.yml and the profile
+	BuildEnvironment map[string]string
+
+	// ErrInvalidEnvironment is returned for an assignment without a valid name
+	ErrInvalidEnvironment = errors.New("Environment variables must be given as KEY=VAL")
+
+	// envName matches the names of environment variables
+	envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ParseEnvironment will parse comma separated KEY=VAL assignments. A comma
+// not followed by a new assignment is kept within the value, so that
+// RUSTFLAGS=-Clink-arg=a,b,CC=clang sets both RUSTFLAGS and CC.
+func ParseEnvironment(s string) (map[string]string, error) {
+	env := make(map[string]string)
+	var last string
+	for _, part := range strings.Split(s, ",") {
+		name := strings.SplitN(part, "=", 2)[0]
+		if !strings.Contains(part, "=") || !envName.MatchString(name) {
+			if last == "" {
+				return nil, ErrInvalidEnvironment
+			}
+			env[last] += "," + part
+			continue
+		}
+		last = name
+		env[name] = part[len(name)+1:]
+	}
+	return env, nil
+}
+
+// checkEnvironment will ensure every variable of env has a valid name
+func checkEnvironment(env map[string]string) error {
+	for name := range env {
+		if !envName.MatchString(name) {
+			return fmt.Errorf("Invalid environment variable name: %s", name)
+		}
+	}
+	return nil
+}
+
+// NewBuildEnvironment will decide the extra environment of the build. The
+// environment of the profile is overridden by solbuild.yml, which is in
+// turn overridden by --env. The variables are sorted for stable builds.
+func NewBuildEnvironment(profile *Profile, pkg *Package) ([]string, error) {
+	if err := checkEnvironment(profile.Environment); err != nil {
+		return nil, err
+	}
+	merged := make(map[string]string)
+	layers := []map[string]string{profile.Environment, nil, BuildEnvironment}
+	if pkg.Overrides != nil {
+		layers[1] = pkg.Overrides.Environment
+	}
+	for _, layer := range layers {
+		for name, value := range layer {
+			merged[name] = value
+		}
+	}
+	var env []string
+	for name, value := range merged {
+		env = append(env, fmt.Sprintf("%s=%s", name, value))
+	}
+	sort.Strings(env)
+	return env, nil
+}
@@ -0,0 +1,57 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEnvironment(t *testing.T) {
+	env, err := ParseEnvironment("RUSTFLAGS=-Clink-arg=a,b,CC=clang,EMPTY=")
+	if err != nil {
+		t.Fatalf("Failed to parse environment: %v", err)
+	}
+	expected := map[string]string{"RUSTFLAGS": "-Clink-arg=a,b", "CC": "clang", "EMPTY": ""}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, got %v", expected, env)
+	}
+	for _, invalid := range []string{"RUSTFLAGS", "1X=2", ",A=b", "A-B=c"} {
+		if _, err := ParseEnvironment(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestBuildEnvironment(t *testing.T) {
+	profile := &Profile{Environment: map[string]string{"A": "profile", "B": "profile", "C": "profile"}}
+	pkg := &Package{Overrides: &PackageOverrides{Environment: map[string]string{"B": "package", "C": "package"}}}
+	BuildEnvironment = map[string]string{"C": "flag"}
+	defer func() { BuildEnvironment = nil }()
+	env, err := NewBuildEnvironment(profile, pkg)
+	if err != nil {
+		t.Fatalf("Failed to decide environment: %v", err)
+	}
+	expected := []string{"A=profile", "B=package", "C=flag"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, got %v", expected, env)
+	}
+	profile.Environment["NOT VALID"] = "x"
+	if _, err := NewBuildEnvironment(profile, &Package{}); err == nil {
+		t.Error("Expected an invalid variable name to be rejected")
+	}
+}
@@ -0,0 +1,206 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// BuildTmpDir is the TMPDIR given to the build within the root
+	BuildTmpDir = "/tmp/solbuild"
+
+	// DefaultBuildTmpSize is the size of the tmpfs mounted as the TMPDIR of
+	// each build when the config doesn't set one
+	DefaultBuildTmpSize = "4G"
+
+	// tmpLeakThreshold is the size of a temporary file left outside of the
+	// TMPDIR of the build before it's reported
+	tmpLeakThreshold = 16 << 20
+
+	// tmpSampleInterval is how often the usage of the TMPDIR is sampled
+	tmpSampleInterval = 5 * time.Second
+)
+
+var (
+	// BuildTmpSize is the size of the tmpfs mounted as the TMPDIR of each
+	// build, set from the config by Manager.Build.
+	BuildTmpSize string
+
+	// tmpAuditDirs are the temporary directories of the root checked for
+	// files left behind by the build
+	tmpAuditDirs = []string{"/tmp", "/var/tmp", "/dev/shm"}
+)
+
+// buildTmpSize returns the size of the TMPDIR of the config, or the default
+func buildTmpSize(config *Config) (string, error) {
+	size := config.BuildTmpSize
+	if size == "" {
+		size = DefaultBuildTmpSize
+	}
+	if !ValidMemSize(size) {
+		return "", ErrInvalidMemSize
+	}
+	return size, nil
+}
+
+// A TmpLeak is a large file left in a temporary directory of the root,
+// outside of the TMPDIR of the build
+type TmpLeak struct {
+	Path string // Path within the root
+	Size int64
+}
+
+// MountBuildTmp will give the build a fresh TMPDIR of its own, limited to
+// BuildTmpSize when set.
+func (o *Overlay) MountBuildTmp() error {
+	dir := filepath.Join(o.MountPoint, BuildTmpDir)
+	// A kept root still has the TMPDIR of its last build
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("Failed to clean %s, reason: %s\n", BuildTmpDir, err)
+	}
+	if err := os.MkdirAll(dir, 00700); err != nil {
+		return fmt.Errorf("Failed to create %s, reason: %s\n", BuildTmpDir, err)
+	}
+	if BuildTmpSize != "" {
+		log.Debugf("Mounting build tmpfs: point='%s' size='%s'\n", dir, BuildTmpSize)
+		err := disk.GetMountManager().Mount("tmpfs-build", dir, "tmpfs",
+			fmt.Sprintf("size=%s", BuildTmpSize), "mode=700",
+			fmt.Sprintf("uid=%d", BuildUserID), fmt.Sprintf("gid=%d", BuildUserGID))
+		if err != nil {
+			return fmt.Errorf("Failed to mount %s, reason: %s\n", BuildTmpDir, err)
+		}
+		o.ExtraMounts = append(o.ExtraMounts, dir)
+		return nil
+	}
+	return os.Chown(dir, BuildUserID, BuildUserGID)
+}
+
+// tmpUsage will return the number of bytes used within the directory
+func tmpUsage(dir string, mounted bool) int64 {
+	if mounted {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			return 0
+		}
+		return int64(st.Blocks-st.Bfree) * int64(st.Bsize)
+	}
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// A TmpWatch samples the usage of the TMPDIR of a build to find its peak
+type TmpWatch struct {
+	dir     string
+	mounted bool
+	peak    int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// WatchBuildTmp will start sampling the usage of the TMPDIR of the build
+func (o *Overlay) WatchBuildTmp() *TmpWatch {
+	w := &TmpWatch{
+		dir:     filepath.Join(o.MountPoint, BuildTmpDir),
+		mounted: BuildTmpSize != "",
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// run samples the usage until stopped
+func (w *TmpWatch) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(tmpSampleInterval)
+	defer ticker.Stop()
+	for {
+		w.sample()
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample records the current usage if it's the highest seen
+func (w *TmpWatch) sample() {
+	if usage := tmpUsage(w.dir, w.mounted); usage > w.peak {
+		w.peak = usage
+	}
+}
+
+// Stop will stop sampling and report the peak usage of the TMPDIR
+func (w *TmpWatch) Stop() int64 {
+	close(w.stop)
+	<-w.done
+	w.sample()
+	limit := BuildTmpSize
+	if limit == "" {
+		limit = "unbounded"
+	}
+	log.Infof("Peak usage of %s: %.1f MiB (%s)\n", BuildTmpDir, float64(w.peak)/(1<<20), limit)
+	return w.peak
+}
+
+// findTmpLeaks will find the files of at least the threshold in size left in
+// the temporary directories of the root, outside of the TMPDIR of the build.
+func findTmpLeaks(root string, threshold int64) []TmpLeak {
+	var leaks []TmpLeak
+	skip := filepath.Join(root, BuildTmpDir)
+	for _, dir := range tmpAuditDirs {
+		filepath.Walk(filepath.Join(root, dir), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && path == skip {
+				return filepath.SkipDir
+			}
+			if info.Mode().IsRegular() && info.Size() >= threshold {
+				leaks = append(leaks, TmpLeak{Path: "/" + strings.TrimPrefix(path, root+"/"), Size: info.Size()})
+			}
+			return nil
+		})
+	}
+	return leaks
+}
+
+// AuditTmp will report large files the build left in temporary directories
+// outside of its TMPDIR, which would otherwise go unnoticed on shared
+// builders keeping their roots.
+func (o *Overlay) AuditTmp() []TmpLeak {
+	leaks := findTmpLeaks(o.MountPoint, tmpLeakThreshold)
+	for _, leak := range leaks {
+		log.Warnf("Build left %s (%.1f MiB) outside of %s\n", leak.Path, float64(leak.Size)/(1<<20), BuildTmpDir)
+	}
+	return leaks
+}
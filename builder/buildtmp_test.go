@@ -0,0 +1,70 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindTmpLeaks(t *testing.T) {
+	root := t.TempDir()
+	big := strings.Repeat("x", 1024)
+	writeTestFile(t, filepath.Join(root, "tmp", "leaked.o"), big)
+	writeTestFile(t, filepath.Join(root, "tmp", "small"), "x")
+	writeTestFile(t, filepath.Join(root, "var", "tmp", "cache", "blob"), big)
+	writeTestFile(t, filepath.Join(root, BuildTmpDir, "expected"), big)
+	if err := os.MkdirAll(filepath.Join(root, "dev"), 00755); err != nil {
+		t.Fatal(err)
+	}
+
+	leaks := findTmpLeaks(root, 1024)
+	if len(leaks) != 2 {
+		t.Fatalf("Expected 2 leaks, got %v", leaks)
+	}
+	if leaks[0].Path != "/tmp/leaked.o" || leaks[1].Path != "/var/tmp/cache/blob" {
+		t.Errorf("Unexpected leaks: %v", leaks)
+	}
+}
+
+func TestTmpUsage(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a"), "1234")
+	writeTestFile(t, filepath.Join(dir, "sub", "b"), "56")
+	if usage := tmpUsage(dir, false); usage != 6 {
+		t.Errorf("Expected 6 bytes in use, got %d", usage)
+	}
+}
+
+func TestBuildTmpSize(t *testing.T) {
+	for _, tc := range []struct {
+		size, want string
+		valid      bool
+	}{
+		{"", DefaultBuildTmpSize, true},
+		{"8G", "8G", true},
+		{"512M", "", false},
+		{"lots", "", false},
+	} {
+		size, err := buildTmpSize(&Config{BuildTmpSize: tc.size})
+		if (err == nil) != tc.valid || size != tc.want {
+			t.Errorf("%q: expected %q (valid %v), got %q (%v)", tc.size, tc.want, tc.valid, size, err)
+		}
+	}
+}
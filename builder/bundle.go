@@ -0,0 +1,499 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder/source"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// BundleVersion is the current format version of cache bundles
+	BundleVersion = "1.1"
+
+	// BundleManifestName is the name of the manifest stored at the end of
+	// every bundle
+	BundleManifestName = "solbuild-bundle.json"
+
+	// bundleStagingDir is where bundles are unpacked prior to verification,
+	// on the same filesystem as the caches so they can be moved into place.
+	bundleStagingDir = "/var/lib/solbuild/import"
+)
+
+var (
+	// ErrBundleManifest is returned when a bundle has a missing or invalid manifest
+	ErrBundleManifest = errors.New("Bundle manifest is missing or invalid")
+
+	// ErrBundleIntegrity is returned when the contents of a bundle do not
+	// match the manifest.
+	ErrBundleIntegrity = errors.New("Bundle contents do not match the manifest")
+
+	// ErrBundleLink is returned for a link which could escape its cache
+	ErrBundleLink = errors.New("Bundle contains a link pointing outside of its cache")
+)
+
+// A BundleSection is a cache directory that may be stored in a bundle
+type BundleSection struct {
+	Name string // Name of the section within the bundle
+	Dir  string // Cache directory on the host
+}
+
+// BundleSections are the caches that may be exported, in bundle order
+var BundleSections = []BundleSection{
+	{"images", ImagesDir},
+	{"sources", source.SourceDir},
+	{"packages", PackageCacheDirectory},
+	{"ccache", filepath.Dir(CcacheDirectory)},
+	{"sccache", filepath.Dir(SccacheDirectory)},
+}
+
+// BundleSectionNames returns the names of every exportable cache
+func BundleSectionNames() []string {
+	var names []string
+	for _, s := range BundleSections {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// A BundleFile records the integrity data of a single file in the bundle,
+// or the target of a symlink
+type BundleFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// A BundleManifest describes the contents of a cache bundle
+type BundleManifest struct {
+	Version  string       `json:"version"`
+	Created  time.Time    `json:"created"`
+	Sections []string     `json:"sections"`
+	Files    []BundleFile `json:"files"`
+}
+
+// TotalSize returns the combined size of every file in the bundle
+func (m *BundleManifest) TotalSize() int64 {
+	var total int64
+	for _, f := range m.Files {
+		total += f.Size
+	}
+	return total
+}
+
+// selectSections will find the named sections, or all when none are named
+func selectSections(names []string) ([]BundleSection, error) {
+	if len(names) == 0 {
+		return BundleSections, nil
+	}
+	var sections []BundleSection
+	for _, name := range names {
+		found := false
+		for _, s := range BundleSections {
+			if s.Name == name {
+				sections = append(sections, s)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown cache section '%s', expected one of: %s", name, strings.Join(BundleSectionNames(), ", "))
+		}
+	}
+	return sections, nil
+}
+
+// skipBundlePath determines whether a cache file is transient, and must
+// not be exported.
+func skipBundlePath(path string) bool {
+	return strings.HasSuffix(path, ".lock") || strings.HasPrefix(path, source.SourceStagingDir)
+}
+
+// ExportBundle will store the named caches, or all of them, in a single tar
+// archive at path. Archives ending in .gz or .tgz are compressed.
+func ExportBundle(path string, names []string) (*BundleManifest, error) {
+	sections, err := selectSections(names)
+	if err != nil {
+		return nil, err
+	}
+	return exportBundle(path, sections)
+}
+
+func exportBundle(path string, sections []BundleSection) (manifest *BundleManifest, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	defer func() {
+		if ferr := bw.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+	var w io.Writer = bw
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		gz := gzip.NewWriter(w)
+		defer func() {
+			if gerr := gz.Close(); err == nil {
+				err = gerr
+			}
+		}()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer func() {
+		if terr := tw.Close(); err == nil {
+			err = terr
+		}
+	}()
+
+	manifest = &BundleManifest{
+		Version: BundleVersion,
+		Created: time.Now().UTC(),
+	}
+	for _, section := range sections {
+		if !PathExists(section.Dir) {
+			log.Debugf("Skipping missing cache %s\n", section.Dir)
+			continue
+		}
+		manifest.Sections = append(manifest.Sections, section.Name)
+		log.Infof("Exporting %s from %s\n", section.Name, section.Dir)
+		if err = exportSection(tw, manifest, section); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{
+		Name:    BundleManifestName,
+		Mode:    00644,
+		Size:    int64(len(b)),
+		ModTime: manifest.Created,
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err = tw.Write(b); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// exportSection will add every file within the cache directory to the tar
+func exportSection(tw *tar.Writer, manifest *BundleManifest, section BundleSection) error {
+	return filepath.Walk(section.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if skipBundlePath(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(section.Dir, path)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			log.Debugf("Skipping special file %s\n", path)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(section.Name, rel))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if link != "" {
+			manifest.Files = append(manifest.Files, BundleFile{Path: hdr.Name, Link: link})
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(tw, h), file)
+		if err != nil {
+			return fmt.Errorf("Failed to export %s, reason: %s\n", path, err)
+		}
+		manifest.Files = append(manifest.Files, BundleFile{
+			Path:   hdr.Name,
+			Size:   n,
+			Sha256: hex.EncodeToString(h.Sum(nil)),
+		})
+		return nil
+	})
+}
+
+// ImportBundle will verify the bundle against its manifest and then merge
+// the caches within it into those of this host. Nothing is imported if any
+// file fails verification.
+func ImportBundle(path string) (*BundleManifest, error) {
+	if err := os.MkdirAll(filepath.Dir(bundleStagingDir), 00755); err != nil {
+		return nil, err
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(bundleStagingDir), filepath.Base(bundleStagingDir)+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	return importBundle(path, staging, BundleSections)
+}
+
+func importBundle(path, staging string, sections []BundleSection) (*BundleManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Support compressed bundles regardless of their name
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	dirs := make(map[string]string)
+	for _, s := range sections {
+		dirs[s.Name] = s.Dir
+	}
+
+	log.Infof("Unpacking bundle %s\n", path)
+	hashes := make(map[string]BundleFile)
+	var manifest *BundleManifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == BundleManifestName {
+			manifest = &BundleManifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, ErrBundleManifest
+			}
+			continue
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		section := strings.SplitN(name, string(filepath.Separator), 2)[0]
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") || dirs[section] == "" {
+			return nil, fmt.Errorf("Refusing to import unexpected path %s", hdr.Name)
+		}
+		target := filepath.Join(staging, name)
+		// Never write through a link unpacked earlier in the bundle
+		if err := checkStagingPath(staging, name); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 00755); err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)&os.ModePerm); err != nil {
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			if !bundleLinkConfined(name, hdr.Linkname) {
+				return nil, ErrBundleLink
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return nil, err
+			}
+			hashes[filepath.ToSlash(name)] = BundleFile{Path: filepath.ToSlash(name), Link: hdr.Linkname}
+		case tar.TypeLink:
+			return nil, ErrBundleLink
+		case tar.TypeReg:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.FileMode(hdr.Mode)&os.ModePerm)
+			if err != nil {
+				return nil, err
+			}
+			h := sha256.New()
+			n, err := io.Copy(io.MultiWriter(file, h), tr)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Failed to unpack %s, reason: %s\n", hdr.Name, err)
+			}
+			hashes[filepath.ToSlash(name)] = BundleFile{
+				Path:   filepath.ToSlash(name),
+				Size:   n,
+				Sha256: hex.EncodeToString(h.Sum(nil)),
+			}
+		default:
+			log.Debugf("Skipping special file %s\n", hdr.Name)
+			continue
+		}
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+	}
+
+	if manifest == nil || manifest.Version != BundleVersion {
+		return nil, ErrBundleManifest
+	}
+	if err := verifyBundle(manifest, hashes); err != nil {
+		return nil, err
+	}
+
+	// Verified, now merge each section into the host caches
+	for _, section := range manifest.Sections {
+		if dirs[section] == "" {
+			return nil, ErrBundleManifest
+		}
+		log.Infof("Importing %s into %s\n", section, dirs[section])
+		if err := mergeTree(filepath.Join(staging, section), dirs[section]); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// checkStagingPath ensures that neither the entry nor any directory leading
+// to it within the staging directory is a symlink
+func checkStagingPath(staging, name string) error {
+	path := staging
+	for _, component := range strings.Split(name, string(filepath.Separator)) {
+		path = filepath.Join(path, component)
+		st, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if st.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Refusing to import %s through a symlink", name)
+		}
+	}
+	return nil
+}
+
+// bundleLinkConfined returns true if the symlink at name, relative to the
+// staging directory, resolves within its own cache
+func bundleLinkConfined(name, link string) bool {
+	if link == "" || filepath.IsAbs(link) {
+		return false
+	}
+	section := strings.SplitN(name, string(filepath.Separator), 2)[0]
+	resolved := filepath.Join(filepath.Dir(name), link)
+	return strings.HasPrefix(resolved, section+string(filepath.Separator))
+}
+
+// verifyBundle ensures the unpacked files exactly match the manifest
+func verifyBundle(manifest *BundleManifest, unpacked map[string]BundleFile) error {
+	if len(manifest.Files) != len(unpacked) {
+		log.Errorf("Bundle has %d files, manifest lists %d\n", len(unpacked), len(manifest.Files))
+		return ErrBundleIntegrity
+	}
+	for _, want := range manifest.Files {
+		got, ok := unpacked[want.Path]
+		if !ok || got != want {
+			log.Errorf("Integrity check failed for %s\n", want.Path)
+			return ErrBundleIntegrity
+		}
+	}
+	return nil
+}
+
+// mergeTree moves the contents of src into dst, replacing existing files
+func mergeTree(src, dst string) error {
+	if !PathExists(src) {
+		return nil
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			if PathExists(target) {
+				return nil
+			}
+			if err := os.MkdirAll(target, info.Mode()&os.ModePerm); err != nil {
+				return err
+			}
+			// Caches such as ccache are owned by the build user
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				os.Lchown(target, int(st.Uid), int(st.Gid))
+			}
+			return nil
+		}
+		if st, err := os.Lstat(target); err == nil && st.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(path, target); err != nil {
+			return fmt.Errorf("Failed to import %s, reason: %s\n", target, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,150 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 00755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 00644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	exported := []BundleSection{
+		{"images", filepath.Join(src, "images")},
+		{"sources", filepath.Join(src, "sources")},
+	}
+	imported := []BundleSection{
+		{"images", filepath.Join(dst, "images")},
+		{"sources", filepath.Join(dst, "sources")},
+	}
+	writeTestFile(t, filepath.Join(src, "images", "main-x86_64.img"), "image")
+	writeTestFile(t, filepath.Join(src, "images", "main-x86_64.lock"), "")
+	writeTestFile(t, filepath.Join(src, "sources", "abc", "nano-5.8.tar.xz"), "tarball")
+	writeTestFile(t, filepath.Join(dst, "sources", "def", "existing.tar.xz"), "kept")
+	if err := os.Symlink("abc/nano-5.8.tar.xz", filepath.Join(src, "sources", "latest")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"cache.tar", "cache.tar.gz"} {
+		bundle := filepath.Join(src, name)
+		manifest, err := exportBundle(bundle, exported)
+		if err != nil {
+			t.Fatalf("Failed to export bundle: %s", err)
+		}
+		if len(manifest.Files) != 3 || manifest.TotalSize() != 12 {
+			t.Fatalf("Unexpected manifest: %+v", manifest)
+		}
+		if _, err := importBundle(bundle, t.TempDir(), imported); err != nil {
+			t.Fatalf("Failed to import %s: %s", name, err)
+		}
+		for path, want := range map[string]string{
+			"images/main-x86_64.img":      "image",
+			"sources/abc/nano-5.8.tar.xz": "tarball",
+			"sources/def/existing.tar.xz": "kept",
+			"sources/latest":              "tarball",
+		} {
+			b, err := ioutil.ReadFile(filepath.Join(dst, path))
+			if err != nil || string(b) != want {
+				t.Fatalf("Unexpected content of %s: %q %v", path, b, err)
+			}
+		}
+		if PathExists(filepath.Join(dst, "images", "main-x86_64.lock")) {
+			t.Fatalf("Lock files should not be exported")
+		}
+	}
+}
+
+func TestBundleTampered(t *testing.T) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "bad.tar")
+	f, err := os.Create(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	for name, content := range map[string]string{
+		"images/a.img":     "modified",
+		BundleManifestName: `{"version":"1.1","sections":["images"],"files":[{"path":"images/a.img","size":8,"sha256":"00"}]}`,
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 00644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	f.Close()
+
+	target := filepath.Join(dir, "images")
+	sections := []BundleSection{{"images", target}}
+	if _, err := importBundle(bundle, t.TempDir(), sections); err != ErrBundleIntegrity {
+		t.Fatalf("Expected integrity failure, got %v", err)
+	}
+	if PathExists(target) {
+		t.Fatalf("Nothing should be imported from a tampered bundle")
+	}
+}
+
+func writeTestBundle(t *testing.T, path string, headers []*tar.Header) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(make([]byte, hdr.Size))
+	}
+	tw.Close()
+}
+
+func TestBundleLinks(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	for name, headers := range map[string][]*tar.Header{
+		"absolute": {{Name: "images/a", Linkname: outside, Typeflag: tar.TypeSymlink}},
+		"escaping": {{Name: "images/a", Linkname: "../../outside", Typeflag: tar.TypeSymlink}},
+		"hardlink": {{Name: "images/a", Linkname: "/etc/shadow", Typeflag: tar.TypeLink}},
+		"through": {
+			{Name: "images/a", Linkname: "b", Typeflag: tar.TypeSymlink},
+			{Name: "images/a/c", Mode: 00644, Size: 1, Typeflag: tar.TypeReg},
+		},
+	} {
+		bundle := filepath.Join(dir, name+".tar")
+		writeTestBundle(t, bundle, headers)
+		sections := []BundleSection{{"images", filepath.Join(dir, "images")}}
+		if _, err := importBundle(bundle, t.TempDir(), sections); err == nil {
+			t.Errorf("Expected the %s link to be refused", name)
+		}
+	}
+	if PathExists(outside) || PathExists(filepath.Join(dir, "images")) {
+		t.Fatalf("Nothing should be written by a refused bundle")
+	}
+}
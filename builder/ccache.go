@@ -0,0 +1,221 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// CcacheConfigFile holds the configuration of a ccache directory, read by
+	// ccache within the build root
+	CcacheConfigFile = "ccache.conf"
+
+	// Counters within the stats files of ccache, which have kept the same
+	// positions since ccache 3
+	ccacheStatMiss            = 4
+	ccacheStatPreprocessedHit = 8
+	ccacheStatFiles           = 11
+	ccacheStatSizeKiB         = 12
+	ccacheStatDirectHit       = 22
+)
+
+var (
+	// CcacheMaxSize is the size the ccache is limited to by the profile, if any
+	CcacheMaxSize string
+
+	// ErrNoHostCcache is returned when trimming the ccache without ccache
+	// installed on the host
+	ErrNoHostCcache = errors.New("ccache must be installed on the host to trim the cache")
+)
+
+// CcacheStats are the counters of a ccache directory
+type CcacheStats struct {
+	Hits   int64 // Compilations served from the cache
+	Misses int64 // Compilations which had to be performed
+	Files  int64 // Files within the cache
+	Size   int64 // Size of the cache in bytes
+}
+
+// ReadCcacheStats will total the stats files of the ccache directory, which
+// ccache keeps at the top level and within its subdirectories.
+func ReadCcacheStats(dir string) *CcacheStats {
+	stats := &CcacheStats{}
+	var paths []string
+	for _, pattern := range []string{"stats", "[0-9a-f]/stats", "[0-9a-f]/[0-9a-f]/stats"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		paths = append(paths, matches...)
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		counters := strings.Fields(string(b))
+		counter := func(i int) int64 {
+			if i >= len(counters) {
+				return 0
+			}
+			value, _ := strconv.ParseInt(counters[i], 10, 64)
+			return value
+		}
+		stats.Hits += counter(ccacheStatDirectHit) + counter(ccacheStatPreprocessedHit)
+		stats.Misses += counter(ccacheStatMiss)
+		stats.Files += counter(ccacheStatFiles)
+		stats.Size += counter(ccacheStatSizeKiB) * 1024
+	}
+	return stats
+}
+
+// Since returns the hits and misses since the earlier stats, along with the
+// current contents of the cache.
+func (s *CcacheStats) Since(before *CcacheStats) *CcacheStats {
+	return &CcacheStats{
+		Hits:   s.Hits - before.Hits,
+		Misses: s.Misses - before.Misses,
+		Files:  s.Files,
+		Size:   s.Size,
+	}
+}
+
+// HitRate returns the percentage of compilations served from the cache
+func (s *CcacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) * 100 / float64(s.Hits+s.Misses)
+}
+
+// String describes the stats for the logs
+func (s *CcacheStats) String() string {
+	return fmt.Sprintf("%d hits, %d misses (%.1f%% hit rate), %d files using %.1f GiB",
+		s.Hits, s.Misses, s.HitRate(), s.Files, float64(s.Size)/(1<<30))
+}
+
+// CcacheSource returns the host directory holding the ccache of the package
+func (p *Package) CcacheSource() string {
+	if p.Type == PackageTypeXML {
+		return LegacyCcacheDirectory
+	}
+	return CcacheDirectory
+}
+
+// reportCcache will log how well the build made use of the ccache
+func (p *Package) reportCcache(before *CcacheStats) {
+	stats := ReadCcacheStats(p.CcacheSource()).Since(before)
+	if stats.Hits+stats.Misses == 0 {
+		log.Debugln("ccache was not used by the build")
+		return
+	}
+	log.Infof("ccache: %s\n", stats)
+}
+
+// readCcacheConfig returns the lines of the ccache configuration, if any
+func readCcacheConfig(dir string) []string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, CcacheConfigFile))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+}
+
+// GetCcacheMaxSize returns the max_size configured for the ccache directory,
+// or an empty string when ccache uses its default.
+func GetCcacheMaxSize(dir string) string {
+	for _, line := range readCcacheConfig(dir) {
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "max_size" {
+			return strings.TrimSpace(fields[1])
+		}
+	}
+	return ""
+}
+
+// SetCcacheMaxSize will set max_size in the configuration of the ccache
+// directory, which ccache enforces as it adds to the cache.
+func SetCcacheMaxSize(dir, size string) error {
+	if _, err := ParseSize(size); err != nil {
+		return err
+	}
+	if GetCcacheMaxSize(dir) == size {
+		return nil
+	}
+	var lines []string
+	for _, line := range readCcacheConfig(dir) {
+		if fields := strings.SplitN(line, "=", 2); len(fields) == 2 && strings.TrimSpace(fields[0]) == "max_size" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "max_size = "+size)
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, CcacheConfigFile), []byte(strings.Join(lines, "\n")+"\n"), 00644)
+}
+
+// applyCcacheMaxSize will limit the ccache of the package to the size set by
+// the profile, if any.
+func (p *Package) applyCcacheMaxSize() error {
+	if CcacheMaxSize == "" {
+		return nil
+	}
+	log.Debugf("Limiting ccache to %s\n", CcacheMaxSize)
+	if err := SetCcacheMaxSize(p.CcacheSource(), CcacheMaxSize); err != nil {
+		return fmt.Errorf("Failed to set the ccache size, reason: %s\n", err)
+	}
+	return nil
+}
+
+// CleanCcache will empty the ccache directory entirely, keeping only its
+// configuration, or trim it to its max_size with the ccache of the host.
+func CleanCcache(dir string, all bool) error {
+	if !all {
+		if _, err := exec.LookPath("ccache"); err != nil {
+			return ErrNoHostCcache
+		}
+		c := exec.Command("ccache", "--cleanup")
+		c.Env = append(os.Environ(), "CCACHE_DIR="+dir)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		return c.Run()
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == CcacheConfigFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder/source"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var (
+	// CcacheSeedURL is the template of the URL a ccache seed archive is
+	// fetched from before building, with an empty template disabling it.
+	CcacheSeedURL string
+
+	// CcacheSeedKey is the fingerprint of the GPG key every ccache seed must
+	// be signed with.
+	CcacheSeedKey string
+
+	// ErrNoCcacheSeedKey is returned when seeding without a key to verify the
+	// seeds with.
+	ErrNoCcacheSeedKey = errors.New("ccache seeds must be verified, set ccache_seed_key")
+
+	// ccacheSeedFields are the placeholders a seed URL may use
+	ccacheSeedFields = []string{"name", "version", "release"}
+)
+
+// ValidCcacheSeedURL will ensure the seed URL uses https and only known
+// placeholders
+func ValidCcacheSeedURL(template string) error {
+	if template != "" && !strings.HasPrefix(template, "https://") {
+		return fmt.Errorf("ccache seeds must be fetched over https, got %s", template)
+	}
+	for _, field := range artifactFieldPattern.FindAllString(template, -1) {
+		known := false
+		for _, name := range ccacheSeedFields {
+			known = known || field == "{"+name+"}"
+		}
+		if !known {
+			return fmt.Errorf("Unknown ccache seed field %s, expected one of {%s}", field, strings.Join(ccacheSeedFields, "}, {"))
+		}
+	}
+	return nil
+}
+
+// ccacheSeedURL returns the seed URL for the package
+func (p *Package) ccacheSeedURL(template string) string {
+	values := map[string]string{
+		"name":    p.Name,
+		"version": p.Version,
+		"release": strconv.Itoa(p.Release),
+	}
+	return artifactFieldPattern.ReplaceAllStringFunc(template, func(field string) string {
+		return values[field[1:len(field)-1]]
+	})
+}
+
+// ccacheSeedMarker returns where the ETag of the last seed of the package is
+// kept, so an unchanged seed isn't fetched again.
+func (p *Package) ccacheSeedMarker(dir string) string {
+	return filepath.Join(dir, ".seeds", p.Name)
+}
+
+// fetchSeedSignature will download the detached signature of the seed and
+// ensure the seed was signed by the key.
+func fetchSeedSignature(url, key, archive string) error {
+	resp, err := source.HTTPClient().Get(url + SignatureSuffix)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s for %s%s", resp.Status, url, SignatureSuffix)
+	}
+	sig, err := os.Create(archive + SignatureSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sig.Name())
+	_, err = io.Copy(sig, io.LimitReader(resp.Body, 1024*1024))
+	sig.Close()
+	if err != nil {
+		return err
+	}
+	return VerifySignature(sig.Name(), archive).signedBy(key)
+}
+
+// seedCcache will fetch the ccache seed archive of the package, verify its
+// signature against the key, and unpack it into the ccache directory shared
+// by builds as the build user. A missing seed isn't an error, as not every
+// package has one.
+func (p *Package) seedCcache(template, key, dir string) error {
+	if key == "" {
+		return ErrNoCcacheSeedKey
+	}
+	url := p.ccacheSeedURL(template)
+	marker := p.ccacheSeedMarker(dir)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if etag, err := ioutil.ReadFile(marker); err == nil {
+		req.Header.Set("If-None-Match", string(etag))
+	}
+	log.Debugf("Fetching ccache seed %s\n", url)
+	resp, err := source.HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		log.Debugf("ccache seed of %s is unchanged\n", p.Name)
+		return nil
+	case http.StatusNotFound:
+		log.Infof("No ccache seed published for %s\n", p.Name)
+		return nil
+	default:
+		return fmt.Errorf("Unexpected status %s for %s", resp.Status, url)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(marker), 00755); err != nil {
+		return err
+	}
+	archive, err := ioutil.TempFile(filepath.Dir(marker), p.Name+".*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	size, err := io.Copy(archive, resp.Body)
+	archive.Close()
+	if err != nil {
+		return err
+	}
+	if err := fetchSeedSignature(url, key, archive.Name()); err != nil {
+		return fmt.Errorf("Refusing unverified ccache seed %s, reason: %s", url, err)
+	}
+	log.Infof("Seeding ccache from %s (%d MiB)\n", url, size/1024/1024)
+
+	// The build user owns the cache, so unpacking as that user leaves the
+	// files as ccache expects without changing the ownership of the rest
+	if err := os.Chmod(archive.Name(), 00644); err != nil {
+		return err
+	}
+	if err := os.Chown(dir, BuildUserID, BuildUserGID); err != nil {
+		return err
+	}
+	// tar detects the compression, and refuses paths outside of the cache
+	c := exec.Command("tar", "-xf", archive.Name(), "-C", dir, "--no-same-owner", "--no-same-permissions")
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(BuildUserID), Gid: uint32(BuildUserGID)},
+	}
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to unpack %s, reason: %s: %s", url, err, strings.TrimSpace(string(out)))
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return ioutil.WriteFile(marker, []byte(etag), 00644)
+	}
+	return nil
+}
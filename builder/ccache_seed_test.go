@@ -0,0 +1,165 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCcacheSeedURL(t *testing.T) {
+	pkg := &Package{Name: "qt5-base", Version: "5.15.2", Release: 42}
+	if url := pkg.ccacheSeedURL("https://ccache.example.com/{name}-{release}.tar.zst"); url != "https://ccache.example.com/qt5-base-42.tar.zst" {
+		t.Fatalf("Unexpected seed URL %s", url)
+	}
+	if err := ValidCcacheSeedURL("https://ccache.example.com/{arch}/{name}.tar"); err == nil {
+		t.Fatalf("Unknown fields should be refused")
+	}
+	if err := ValidCcacheSeedURL("http://ccache.example.com/{name}.tar"); err == nil {
+		t.Fatalf("Seeds over plain http should be refused")
+	}
+}
+
+// testSigningKey will create a signing key in a temporary keyring used by
+// gpg until the returned function is called, returning its fingerprint.
+func testSigningKey(t *testing.T) (string, func()) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("Signing requires gpg")
+	}
+	home := t.TempDir()
+	previous, set := os.LookupEnv("GNUPGHOME")
+	os.Setenv("GNUPGHOME", home)
+	restore := func() {
+		if set {
+			os.Setenv("GNUPGHOME", previous)
+		} else {
+			os.Unsetenv("GNUPGHOME")
+		}
+	}
+	c := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "Seed <seed@example.com>", "ed25519", "sign", "never")
+	if out, err := c.CombinedOutput(); err != nil {
+		restore()
+		t.Fatalf("Failed to generate a key: %s: %s", err, out)
+	}
+	out, err := exec.Command("gpg", "--batch", "--with-colons", "--list-keys", "seed@example.com").Output()
+	if err != nil {
+		restore()
+		t.Fatalf("Failed to list the key: %s", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Split(line, ":"); fields[0] == "fpr" && len(fields) > 9 {
+			return fields[9], restore
+		}
+	}
+	restore()
+	t.Fatalf("No fingerprint for the generated key")
+	return "", nil
+}
+
+func TestSignedBy(t *testing.T) {
+	status := parseSignatureStatus("[GNUPG:] GOODSIG 89ABCDEF01234567 Seed\n[GNUPG:] VALIDSIG 0123456789ABCDEF0123456789ABCDEF01234567 2021-05-01\n")
+	for key, valid := range map[string]bool{
+		"0123456789ABCDEF0123456789ABCDEF01234567":          true,
+		"0123 4567 89ab cdef 0123 4567 89ab cdef 0123 4567": true,
+		"89ABCDEF01234567": true,
+		"01234567":         false,
+		"FFFFFFFFFFFFFFFF": false,
+	} {
+		if err := status.signedBy(key); (err == nil) != valid {
+			t.Errorf("Expected signature by %s valid to be %v, got %v", key, valid, err)
+		}
+	}
+	if err := parseSignatureStatus("[GNUPG:] BADSIG 89ABCDEF01234567 Seed\n").signedBy("89ABCDEF01234567"); err == nil {
+		t.Errorf("Bad signatures should be refused")
+	}
+}
+
+func TestSeedCcache(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Seeding ccache requires root")
+	}
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("Seeding ccache requires tar")
+	}
+	key, restore := testSigningKey(t)
+	defer restore()
+	var archive bytes.Buffer
+	if err := packTree(&archive, "testdata", nil); err != nil {
+		t.Fatal(err)
+	}
+	seed := filepath.Join(t.TempDir(), "nano.tar.gz")
+	if err := ioutil.WriteFile(seed, archive.Bytes(), 00644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := SignFile(key, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, _ := ioutil.ReadFile(sig)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nano.tar.gz"+SignatureSuffix {
+			w.Write(signature)
+			return
+		}
+		if r.URL.Path != "/nano.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		fetches++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(archive.Bytes())
+	}))
+	defer server.Close()
+
+	// The build user unpacks the seed, so must reach the cache
+	dir := t.TempDir()
+	if err := os.Chmod(filepath.Dir(dir), 00755); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Package{Name: "zlib"}).seedCcache(server.URL+"/{name}.tar.gz", key, dir); err != nil {
+		t.Fatalf("Missing seed should not be an error: %s", err)
+	}
+	pkg := &Package{Name: "nano"}
+	if err := pkg.seedCcache(server.URL+"/{name}.tar.gz", "FFFFFFFFFFFFFFFF", dir); err == nil {
+		t.Fatalf("Seeds signed by another key should be refused")
+	}
+	fetches = 0
+	for i := 0; i < 2; i++ {
+		if err := pkg.seedCcache(server.URL+"/{name}.tar.gz", key, dir); err != nil {
+			t.Fatalf("Failed to seed ccache: %s", err)
+		}
+	}
+	entries, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if fetches != 2 || len(entries) == 0 {
+		t.Fatalf("Expected the seed to be unpacked once, %d fetches and %d entries", fetches, len(entries))
+	}
+	if !PathExists(pkg.ccacheSeedMarker(dir)) {
+		t.Fatalf("ETag of the seed was not recorded")
+	}
+}
@@ -0,0 +1,75 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ccacheStatsFile returns the contents of a stats file with the given counters
+func ccacheStatsFile(counters map[int]int) string {
+	fields := make([]string, 30)
+	for i := range fields {
+		fields[i] = fmt.Sprint(counters[i])
+	}
+	return strings.Join(fields, "\n") + "\n"
+}
+
+func TestCcacheStats(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "stats"), ccacheStatsFile(map[int]int{ccacheStatMiss: 1}))
+	writeTestFile(t, filepath.Join(dir, "a", "stats"), ccacheStatsFile(map[int]int{
+		ccacheStatDirectHit: 6, ccacheStatMiss: 1, ccacheStatFiles: 4, ccacheStatSizeKiB: 8,
+	}))
+	writeTestFile(t, filepath.Join(dir, "b", "3", "stats"), ccacheStatsFile(map[int]int{
+		ccacheStatPreprocessedHit: 2, ccacheStatFiles: 1, ccacheStatSizeKiB: 2,
+	}))
+	stats := ReadCcacheStats(dir)
+	if stats.Hits != 8 || stats.Misses != 2 || stats.Files != 5 || stats.Size != 10*1024 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	since := stats.Since(&CcacheStats{Hits: 4, Misses: 2})
+	if since.Hits != 4 || since.Misses != 0 || since.HitRate() != 100 {
+		t.Fatalf("Unexpected stats since the build %+v", since)
+	}
+	if empty := ReadCcacheStats(filepath.Join(dir, "missing")); empty.HitRate() != 0 {
+		t.Fatalf("An empty ccache should have no hit rate")
+	}
+}
+
+func TestCcacheMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, CcacheConfigFile), "compression = true\nmax_size = 5G\n")
+	if size := GetCcacheMaxSize(dir); size != "5G" {
+		t.Fatalf("Unexpected max size %s", size)
+	}
+	if err := SetCcacheMaxSize(dir, "20G"); err != nil {
+		t.Fatal(err)
+	}
+	if size := GetCcacheMaxSize(dir); size != "20G" {
+		t.Fatalf("Unexpected max size %s", size)
+	}
+	if lines := readCcacheConfig(dir); len(lines) != 2 || lines[0] != "compression = true" {
+		t.Fatalf("Other settings should be kept, got %q", lines)
+	}
+	if err := SetCcacheMaxSize(dir, "lots"); err == nil {
+		t.Fatalf("Invalid sizes should be refused")
+	}
+}
@@ -0,0 +1,207 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// buildCgroupParent holds the cgroup of every build, directly beneath
+	// the root, as cgroups with processes can't delegate controllers
+	buildCgroupParent = "solbuild"
+
+	// cpuPeriod is the period of the CPU quota, in microseconds
+	cpuPeriod = 100000
+)
+
+var (
+	// ActiveBuildCgroup is the cgroup constraining the current build, if any
+	ActiveBuildCgroup *BuildCgroup
+
+	// ErrNoCgroup2 is returned when the unified cgroup hierarchy is missing
+	ErrNoCgroup2 = errors.New("Resource limits require the unified cgroup v2 hierarchy")
+
+	// cgroupControllers are those needed for the resource limits
+	cgroupControllers = []string{"cpu", "memory", "io"}
+)
+
+// ResourceLimits constrain the build command, so that a runaway linker or
+// test suite can't take down the build host.
+type ResourceLimits struct {
+	CPUQuota  float64 // CPUs worth of time the build may use, 0 for unlimited
+	MemoryMax int64   // Bytes of memory the build may use, 0 for unlimited
+	IOWeight  int     // Proportion of I/O relative to others, 0 for the default
+}
+
+// NewResourceLimits will parse the limits of a profile. The CPU quota is a
+// number of CPUs, i.e. 2.5, or a percentage of one, i.e. 250%, the memory
+// limit a size such as 8G, and the I/O weight from 1 to 10000.
+func NewResourceLimits(cpuQuota, memoryMax string, ioWeight int) (*ResourceLimits, error) {
+	limits := &ResourceLimits{IOWeight: ioWeight}
+	if cpuQuota != "" {
+		divisor := 1.0
+		quota := cpuQuota
+		if strings.HasSuffix(quota, "%") {
+			quota = strings.TrimSuffix(quota, "%")
+			divisor = 100
+		}
+		cpus, err := strconv.ParseFloat(quota, 64)
+		if err != nil || cpus <= 0 {
+			return nil, fmt.Errorf("Invalid CPU quota '%s', expected i.e. 2 or 250%%", cpuQuota)
+		}
+		limits.CPUQuota = cpus / divisor
+	}
+	max, err := ParseSize(memoryMax)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid memory limit '%s'", memoryMax)
+	}
+	limits.MemoryMax = max
+	if ioWeight < 0 || ioWeight > 10000 {
+		return nil, fmt.Errorf("Invalid I/O weight %d, expected 1 to 10000", ioWeight)
+	}
+	return limits, nil
+}
+
+// IsEmpty determines whether the build is left unconstrained
+func (l *ResourceLimits) IsEmpty() bool {
+	return l == nil || (l.CPUQuota == 0 && l.MemoryMax == 0 && l.IOWeight == 0)
+}
+
+// String describes the limits for the plan and logs
+func (l *ResourceLimits) String() string {
+	var parts []string
+	if l.CPUQuota > 0 {
+		parts = append(parts, fmt.Sprintf("%g CPUs", l.CPUQuota))
+	}
+	if l.MemoryMax > 0 {
+		parts = append(parts, fmt.Sprintf("%d MiB of memory", l.MemoryMax>>20))
+	}
+	if l.IOWeight > 0 {
+		parts = append(parts, fmt.Sprintf("I/O weight %d", l.IOWeight))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// settings returns the cgroup files to write for the limits
+func (l *ResourceLimits) settings() map[string]string {
+	settings := make(map[string]string)
+	if l.CPUQuota > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", int64(l.CPUQuota*cpuPeriod), cpuPeriod)
+	}
+	if l.MemoryMax > 0 {
+		settings["memory.max"] = strconv.FormatInt(l.MemoryMax, 10)
+	}
+	if l.IOWeight > 0 {
+		settings["io.weight"] = fmt.Sprintf("default %d", l.IOWeight)
+	}
+	return settings
+}
+
+// A BuildCgroup is a cgroup created for the duration of a build, which the
+// build command is run within.
+type BuildCgroup struct {
+	Path   string
+	Limits *ResourceLimits
+}
+
+// enableControllers will delegate the controllers to the children of dir
+func enableControllers(dir string) error {
+	control := filepath.Join(dir, "cgroup.subtree_control")
+	for _, controller := range cgroupControllers {
+		if err := ioutil.WriteFile(control, []byte("+"+controller), 00644); err != nil {
+			return fmt.Errorf("Failed to enable the %s controller in %s, reason: %s", controller, dir, err)
+		}
+	}
+	return nil
+}
+
+// NewBuildCgroup will create the cgroup of a build with the given limits
+func NewBuildCgroup(name string, limits *ResourceLimits) (*BuildCgroup, error) {
+	if !PathExists(filepath.Join(CgroupRoot, "cgroup.controllers")) {
+		return nil, ErrNoCgroup2
+	}
+	parent := filepath.Join(CgroupRoot, buildCgroupParent)
+	if err := os.MkdirAll(parent, 00755); err != nil {
+		return nil, err
+	}
+	if err := enableControllers(CgroupRoot); err != nil {
+		return nil, err
+	}
+	if err := enableControllers(parent); err != nil {
+		return nil, err
+	}
+	c := &BuildCgroup{
+		Path:   filepath.Join(parent, fmt.Sprintf("%s-%d", name, os.Getpid())),
+		Limits: limits,
+	}
+	if err := os.Mkdir(c.Path, 00755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	for file, value := range limits.settings() {
+		if err := ioutil.WriteFile(filepath.Join(c.Path, file), []byte(value), 00644); err != nil {
+			c.Remove()
+			return nil, fmt.Errorf("Failed to set %s of %s, reason: %s", file, c.Path, err)
+		}
+	}
+	log.Infof("Limiting the build to %s\n", limits)
+	ActiveBuildCgroup = c
+	return c, nil
+}
+
+// wrapper returns the command that moves itself into the cgroup before
+// running the command following it, so nothing escapes the limits.
+func (c *BuildCgroup) wrapper() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{"/bin/sh", "-c", `echo $$ > "$0/cgroup.procs" && exec "$@"`, c.Path}
+}
+
+// OOMKills returns the number of processes OOM killed within the cgroup
+func (c *BuildCgroup) OOMKills() int64 {
+	if c == nil {
+		return 0
+	}
+	return readCounter(filepath.Join(c.Path, "memory.events"), "oom_kill")
+}
+
+// Remove will kill anything left within the cgroup and remove it
+func (c *BuildCgroup) Remove() error {
+	if ActiveBuildCgroup == c {
+		ActiveBuildCgroup = nil
+	}
+	log.Debugf("Removing build cgroup %s\n", c.Path)
+	// cgroup.kill is only available from Linux 5.14
+	ioutil.WriteFile(filepath.Join(c.Path, "cgroup.kill"), []byte("1"), 00644)
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(c.Path); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("Failed to remove build cgroup %s, reason: %s", c.Path, err)
+}
@@ -0,0 +1,61 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResourceLimits(t *testing.T) {
+	limits, err := NewResourceLimits("250%", "8G", 50)
+	if err != nil {
+		t.Fatalf("Failed to parse resource limits: %s", err)
+	}
+	want := map[string]string{
+		"cpu.max":    "250000 100000",
+		"memory.max": "8589934592",
+		"io.weight":  "default 50",
+	}
+	if got := limits.settings(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected cgroup settings: %v", got)
+	}
+	if limits, err = NewResourceLimits("1.5", "", 0); err != nil || limits.settings()["cpu.max"] != "150000 100000" {
+		t.Fatalf("Failed to parse a quota of 1.5 CPUs: %v %s", limits, err)
+	}
+	if limits, err = NewResourceLimits("", "", 0); err != nil || !limits.IsEmpty() {
+		t.Fatalf("Unset limits should be empty")
+	}
+	invalid := []struct {
+		cpu, memory string
+		io          int
+	}{
+		{"none", "", 0},
+		{"-1", "", 0},
+		{"", "lots", 0},
+		{"", "", 10001},
+	}
+	for _, test := range invalid {
+		if _, err := NewResourceLimits(test.cpu, test.memory, test.io); err == nil {
+			t.Errorf("Expected %+v to be invalid", test)
+		}
+	}
+	var none *BuildCgroup
+	if none.wrapper() != nil || none.OOMKills() != 0 {
+		t.Errorf("Missing build cgroup should not wrap the build")
+	}
+}
@@ -0,0 +1,163 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckRetries is the number of attempts given to the check stage of a
+// package.yml build. Values below 2 disable retrying.
+var CheckRetries int
+
+const (
+	// checkAttemptLog is the prefix of the per-attempt check logs
+	checkAttemptLog = "check.attempt-"
+
+	// checkFlakyMarker records the attempts on which a retried check passed
+	checkFlakyMarker = "check.flaky"
+)
+
+// wrapCheckScript will wrap the lines of a check script in a loop that runs
+// it up to the given number of attempts. Each attempt is logged separately
+// within logDir, and any attempt succeeding after a failure is recorded.
+// The original lines are kept verbatim, so heredocs are unaffected.
+func wrapCheckScript(lines []string, attempts int, logDir string) []string {
+	indent := "    "
+	for _, line := range lines {
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed != "" {
+			indent = line[:len(line)-len(trimmed)]
+			break
+		}
+	}
+	logPath := filepath.Join(logDir, checkAttemptLog)
+	markerPath := filepath.Join(logDir, checkFlakyMarker)
+
+	var out []string
+	out = append(out, "__solbuild_check() {")
+	out = append(out, lines...)
+	out = append(out, strings.Split(fmt.Sprintf(`}
+__solbuild_attempt=1
+while true; do
+    __solbuild_log="%[1]s${__solbuild_attempt}.log"
+    echo "=== check attempt ${__solbuild_attempt} of %[2]d ===" >> "$__solbuild_log"
+    set +e
+    (set -e; __solbuild_check) 2>&1 | tee -a "$__solbuild_log"
+    __solbuild_rc=${PIPESTATUS[0]}
+    set -e
+    if [ "$__solbuild_rc" -eq 0 ]; then
+        if [ "$__solbuild_attempt" -gt 1 ]; then
+            echo "$__solbuild_attempt" >> "%[3]s"
+        fi
+        break
+    fi
+    if [ "$__solbuild_attempt" -ge %[2]d ]; then
+        exit "$__solbuild_rc"
+    fi
+    __solbuild_attempt=$((__solbuild_attempt + 1))
+    echo "Check failed with status ${__solbuild_rc}, retrying"
+done`, logPath, attempts, markerPath), "\n")...)
+
+	// Only the wrapper needs indenting, the original lines already are
+	for i, line := range out {
+		if i > 0 && i <= len(lines) {
+			continue
+		}
+		out[i] = indent + line
+	}
+	return out
+}
+
+// applyCheckRetries will rewrite the check stage of the recipe within the
+// work directory to retry failures.
+func (p *Package) applyCheckRetries(overlay *Overlay) error {
+	if CheckRetries < 2 || p.Type != PackageTypeYpkg {
+		return nil
+	}
+	path := filepath.Join(p.GetWorkDir(overlay), filepath.Base(p.Path))
+	doc, err := ParseYmlDocumentFile(path)
+	if err != nil {
+		return err
+	}
+	entry := doc.Lookup("check")
+	if entry == nil {
+		return nil
+	}
+	lines := entry.Children
+	if entry.Value != "|" && entry.Value != ">" {
+		lines = []string{"    " + entry.Scalar()}
+	}
+	log.Debugf("Allowing %d attempts of the check stage\n", CheckRetries)
+	entry.Value = "|"
+	entry.Quote = YmlQuotePlain
+	entry.Children = wrapCheckScript(lines, CheckRetries, p.GetWorkDirInternal())
+	return doc.WriteFile(path)
+}
+
+// collectCheckAttempts will copy the logs of each check attempt into the
+// current directory when the check stage needed retrying, and annotate a
+// check that only passed after a retry as flaky.
+func (p *Package) collectCheckAttempts(overlay *Overlay, usr *UserInfo) {
+	if CheckRetries < 2 || p.Type != PackageTypeYpkg {
+		return
+	}
+	workDir := p.GetWorkDir(overlay)
+	logs, _ := filepath.Glob(filepath.Join(workDir, checkAttemptLog+"*.log"))
+	if len(logs) < 2 {
+		return
+	}
+
+	base := fmt.Sprintf("%s-%s-%d", p.Name, p.Version, p.Release)
+	var collected []string
+	for _, path := range logs {
+		attempt := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), checkAttemptLog), ".log")
+		tgt := fmt.Sprintf("%s.check-%s.log", base, attempt)
+		// The logs bypass the redaction of the build output
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = ioutil.WriteFile(tgt, []byte(Redact(string(b))), 00644)
+		}
+		if err != nil {
+			log.Warnf("Failed to collect check log %s, reason: %s\n", filepath.Base(path), err)
+			continue
+		}
+		collected = append(collected, tgt)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(workDir, checkFlakyMarker)); err == nil {
+		attempts := strings.Fields(string(b))
+		log.Warnf("Check stage is flaky, it passed on attempt %s of %d\n", strings.Join(attempts, ", "), CheckRetries)
+		annotation := fmt.Sprintf("check: flaky, passed on attempt %s of %d\n", strings.Join(attempts, ", "), CheckRetries)
+		tgt := base + ".flaky"
+		if err := ioutil.WriteFile(tgt, []byte(annotation), 00644); err != nil {
+			log.Warnf("Failed to write flaky annotation, reason: %s\n", err)
+		} else {
+			collected = append(collected, tgt)
+		}
+	}
+
+	for _, tgt := range collected {
+		if err := os.Chown(tgt, usr.UID, usr.GID); err != nil {
+			log.Errorf("Error in restoring file ownership %s, reason: %s\n", tgt, err)
+		}
+	}
+}
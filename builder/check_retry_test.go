@@ -0,0 +1,55 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrapCheckScript(t *testing.T) {
+	lines := []string{
+		"    %make check",
+		"    cat > expected <<EOF",
+		"    ok",
+		"    EOF",
+	}
+	wrapped := wrapCheckScript(lines, 3, "/home/build/work")
+	if wrapped[0] != "    __solbuild_check() {" {
+		t.Fatalf("Unexpected first line: %q", wrapped[0])
+	}
+	for i, line := range lines {
+		if wrapped[i+1] != line {
+			t.Fatalf("Original line %d was modified: %q", i, wrapped[i+1])
+		}
+	}
+	for _, line := range wrapped[len(lines)+1:] {
+		if !strings.HasPrefix(line, "    ") {
+			t.Fatalf("Wrapper line is not indented: %q", line)
+		}
+	}
+	script := strings.Join(wrapped, "\n")
+	for _, want := range []string{
+		`__solbuild_log="/home/build/work/check.attempt-${__solbuild_attempt}.log"`,
+		`if [ "$__solbuild_attempt" -ge 3 ]; then`,
+		`echo "$__solbuild_attempt" >> "/home/build/work/check.flaky"`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("Wrapped script is missing %q:\n%s", want, script)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder/source"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// SourceCheck is the health of a single source of a recipe
+type SourceCheck struct {
+	Recipe  string `json:"recipe"`
+	Package string `json:"package"`
+	source.Health
+}
+
+// SourceReport collects the health of every source within a tree
+type SourceReport struct {
+	Checks []*SourceCheck `json:"checks"`
+}
+
+// CheckTreeSources will check the health of every source of every recipe
+// found beneath dir, using up to jobs concurrent checks.
+func CheckTreeSources(dir string, full bool, jobs int) (*SourceReport, error) {
+	recipes, err := findRecipes(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &SourceReport{}
+	var pending []*SourceCheck
+	var sources []source.Source
+	for _, path := range recipes {
+		pkg, err := NewPackage(path)
+		if err != nil {
+			log.Warnf("Skipping %s, reason: %s\n", path, err)
+			continue
+		}
+		for _, s := range pkg.Sources {
+			pending = append(pending, &SourceCheck{Recipe: path, Package: pkg.Name})
+			sources = append(sources, s)
+		}
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range queue {
+				pending[n].Health = *source.CheckHealth(sources[n], full)
+				log.Debugf("Checked %s: %s\n", pending[n].URI, pending[n].Status)
+			}
+		}()
+	}
+	for n := range pending {
+		queue <- n
+	}
+	close(queue)
+	wg.Wait()
+	report.Checks = pending
+	sort.SliceStable(report.Checks, func(i, j int) bool {
+		return report.Checks[i].Recipe < report.Checks[j].Recipe
+	})
+	return report, nil
+}
+
+// Count will return the number of sources with the given status
+func (r *SourceReport) Count(status string) int {
+	count := 0
+	for _, check := range r.Checks {
+		if check.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// IsHealthy will return true if no source is dead or changed
+func (r *SourceReport) IsHealthy() bool {
+	return r.Count(source.HealthDead) == 0 && r.Count(source.HealthChanged) == 0
+}
+
+// Write will print the dead and changed sources, grouped by status, followed
+// by a summary of the whole tree.
+func (r *SourceReport) Write(w io.Writer) {
+	for _, status := range []string{source.HealthDead, source.HealthChanged} {
+		for _, check := range r.Checks {
+			if check.Status != status {
+				continue
+			}
+			fmt.Fprintf(w, "%-8s %s (%s)\n", status, check.Package, check.Recipe)
+			fmt.Fprintf(w, "         %s\n", check.URI)
+			if check.Detail != "" {
+				fmt.Fprintf(w, "         %s\n", check.Detail)
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d sources: %d ok, %d dead, %d changed, %d skipped\n", len(r.Checks),
+		r.Count(source.HealthOK), r.Count(source.HealthDead), r.Count(source.HealthChanged),
+		r.Count(source.HealthSkipped))
+}
+
+// WriteJSON will store the full report at the given path
+func (r *SourceReport) WriteJSON(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
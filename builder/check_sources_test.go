@@ -0,0 +1,92 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"github.com/getsolus/solbuild/builder/source"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// helloSHA256 is the digest of "hello"
+const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestCheckTreeSources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hello.tar.gz":
+			fmt.Fprint(w, "hello")
+		case "/nohead.tar.gz":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Range", "bytes 0-0/5")
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprint(w, "h")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "hello", "package.yml"), fmt.Sprintf(`name: hello
+version: 1.0
+release: 1
+source:
+    - %s/hello.tar.gz : %s
+    - %s/nohead.tar.gz : %s
+`, server.URL, helloSHA256, server.URL, helloSHA256))
+	writeTestFile(t, filepath.Join(dir, "gone", "package.yml"), fmt.Sprintf(`name: gone
+version: 1.0
+release: 1
+source:
+    - %s/gone.tar.gz : %s
+`, server.URL, helloSHA256))
+
+	report, err := CheckTreeSources(dir, false, 2)
+	if err != nil {
+		t.Fatalf("Failed to check sources: %s", err)
+	}
+	if len(report.Checks) != 3 {
+		t.Fatalf("Expected 3 checks, found %d", len(report.Checks))
+	}
+	if report.Count(source.HealthOK) != 2 || report.Count(source.HealthDead) != 1 {
+		t.Fatalf("Unexpected report: %+v", report.Checks)
+	}
+	if report.Checks[0].Package != "gone" || report.IsHealthy() {
+		t.Fatalf("Expected gone to be dead, found %+v", report.Checks[0])
+	}
+
+	writeTestFile(t, filepath.Join(dir, "hello", "package.yml"), fmt.Sprintf(`name: hello
+version: 1.0
+release: 1
+source:
+    - %s/hello.tar.gz : %s
+`, server.URL, "0000000000000000000000000000000000000000000000000000000000000000"))
+	report, err = CheckTreeSources(filepath.Join(dir, "hello"), true, 1)
+	if err != nil {
+		t.Fatalf("Failed to check sources: %s", err)
+	}
+	if check := report.Checks[0]; check.Status != source.HealthChanged || !check.Verified {
+		t.Fatalf("Expected a changed digest, found %+v", check)
+	}
+}
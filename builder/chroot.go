@@ -17,12 +17,141 @@
 package builder
 
 import (
+	"errors"
 	"fmt"
 	log "github.com/DataDrake/waterlog"
 	"github.com/getsolus/libosdev/commands"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+const (
+	// ChrootRCFile holds the PATH and startup commands of the chroot shell,
+	// written to the home directory of the user within the chroot
+	ChrootRCFile = ".solbuild_chrootrc"
+)
+
+var (
+	// ErrInvalidChrootShell is returned for a chroot shell without an absolute path
+	ErrInvalidChrootShell = errors.New("The chroot shell must be an absolute path")
+
+	// ErrInvalidChrootPath is returned for PATH additions which aren't absolute
+	// directories
+	ErrInvalidChrootPath = errors.New("Entries of chroot_path must be absolute paths without ':'")
+)
+
+// A ChrootShell is the interactive shell spawned within the build root, set
+// up by the profile to match the environment of its builds
+type ChrootShell struct {
+	Shell string   // Shell run within the chroot
+	Path  []string // Directories prepended to the PATH
+	RC    string   // Commands run as the shell starts
+	Exec  []string // Command run instead of an interactive shell, if any
+	NoTTY bool     // Run the command without a terminal
+}
+
+// NewChrootShell will validate the chroot shell settings of the profile
+func NewChrootShell(profile *Profile) (*ChrootShell, error) {
+	shell := &ChrootShell{
+		Shell: profile.ChrootShell,
+		Path:  profile.ChrootPath,
+		RC:    profile.ChrootRC,
+	}
+	if shell.Shell == "" {
+		shell.Shell = BuildUserShell
+	}
+	if !filepath.IsAbs(shell.Shell) {
+		return nil, ErrInvalidChrootShell
+	}
+	for _, dir := range shell.Path {
+		if !filepath.IsAbs(dir) || strings.ContainsAny(dir, ":'") {
+			return nil, ErrInvalidChrootPath
+		}
+	}
+	return shell, nil
+}
+
+// Script returns the contents of the rc file sourced by the shell
+func (c *ChrootShell) Script() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by solbuild from the chroot settings of the profile\n")
+	if filepath.Base(c.Shell) == "bash" {
+		// --rcfile replaces the usual ~/.bashrc
+		fmt.Fprintf(&b, "[ -f ~/.bashrc ] && . ~/.bashrc\n")
+	}
+	if len(c.Path) > 0 {
+		fmt.Fprintf(&b, "export PATH='%s':\"$PATH\"\n", strings.Join(c.Path, ":"))
+	}
+	if c.RC != "" {
+		fmt.Fprintf(&b, "%s\n", strings.TrimRight(c.RC, "\n"))
+	}
+	return b.String()
+}
+
+// Command returns the command spawning the shell as the given user. Bash
+// reads the rc file with --rcfile, while other shells are pointed at it
+// with $ENV, which is honoured by POSIX shells.
+func (c *ChrootShell) Command(user, home string) string {
+	if len(c.Exec) > 0 {
+		return c.execCommand(user, home)
+	}
+	if !c.customised() {
+		return fmt.Sprintf("/bin/su - %s -s %s", user, c.Shell)
+	}
+	rc := filepath.Join(home, ChrootRCFile)
+	shell := fmt.Sprintf("ENV=%s exec %s -i", rc, c.Shell)
+	if filepath.Base(c.Shell) == "bash" {
+		shell = fmt.Sprintf("exec %s --rcfile %s -i", c.Shell, rc)
+	}
+	return fmt.Sprintf("/bin/su - %s -s %s -c '%s'", user, c.Shell, shell)
+}
+
+// execCommand returns the command running Exec as the given user, after
+// reading the rc file so that it sees the same PATH as the shell would
+func (c *ChrootShell) execCommand(user, home string) string {
+	quoted := make([]string, len(c.Exec))
+	for i, arg := range c.Exec {
+		quoted[i] = shellQuote(arg)
+	}
+	command := strings.Join(quoted, " ")
+	if c.customised() {
+		command = fmt.Sprintf(". %s; %s", filepath.Join(home, ChrootRCFile), command)
+	}
+	return fmt.Sprintf("/bin/su - %s -s %s -c %s", user, c.Shell, shellQuote(command))
+}
+
+// shellQuote quotes s as a single word for /bin/sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// customised returns true if the shell has an rc file to read
+func (c *ChrootShell) customised() bool {
+	return len(c.Path) > 0 || c.RC != ""
+}
+
+// install will write the rc file into the home directory of the user within
+// the build root, after checking the shell is available there.
+func (c *ChrootShell) install(root, home string, uid, gid int) error {
+	if !PathExists(filepath.Join(root, c.Shell)) {
+		return fmt.Errorf("The chroot shell %s is not installed in the build root\n", c.Shell)
+	}
+	if !c.customised() {
+		return nil
+	}
+	dir := filepath.Join(root, home)
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		return fmt.Errorf("Failed to create home directory, reason: %s\n", err)
+	}
+	rc := filepath.Join(dir, ChrootRCFile)
+	if err := ioutil.WriteFile(rc, []byte(c.Script()), 00644); err != nil {
+		return fmt.Errorf("Failed to write chroot rc file, reason: %s\n", err)
+	}
+	return os.Chown(rc, uid, gid)
+}
+
 // Chroot will attempt to spawn a chroot in the overlayfs system
 func (p *Package) Chroot(notif PidNotifier, pman *EopkgManager, overlay *Overlay) error {
 	log.Debugf("Beginning chroot: profile='%s' version='%s' package='%s' type='%s' release='%d'\n", overlay.Back.Name, p.Version, p.Name, p.Type, p.Release)
@@ -41,32 +170,40 @@ func (p *Package) Chroot(notif PidNotifier, pman *EopkgManager, overlay *Overlay
 
 	// Now kill networking
 	if p.Type == PackageTypeYpkg {
-		if !p.CanNetwork {
-			if err := DropNetworking(); err != nil {
-				return err
-			}
-
-			// Ensure the overlay can network on localhost only
-			if err := overlay.ConfigureNetworking(); err != nil {
-				return err
-			}
-		} else {
-			log.Warnln("Package has explicitly requested networking, sandboxing disabled")
+		proxy, err := p.isolateNetwork(overlay)
+		if err != nil {
+			return err
+		}
+		if proxy != nil {
+			defer proxy.Close()
 		}
 	}
 
-	log.Debugln("Spawning login shell")
 	// Allow bash to work
 	commands.SetStdin(os.Stdin)
 
 	// Legacy package format requires root, stay as root.
-	user := BuildUser
+	user, home, uid, gid := BuildUser, BuildUserHome, BuildUserID, BuildUserGID
 	if p.Type == PackageTypeXML {
-		user = "root"
+		user, home, uid, gid = "root", "/root", 0, 0
 	}
 
-	loginCommand := fmt.Sprintf("/bin/su - %s -s %s", user, BuildUserShell)
-	err := ChrootExecStdin(notif, overlay.MountPoint, loginCommand)
+	shell := p.Shell
+	if shell == nil {
+		shell = &ChrootShell{Shell: BuildUserShell}
+	}
+	if err := shell.install(overlay.MountPoint, home, uid, gid); err != nil {
+		return err
+	}
+	loginCommand := shell.Command(user, home)
+	var err error
+	if len(shell.Exec) > 0 && shell.NoTTY {
+		log.Debugf("Running command without a terminal: %s\n", loginCommand)
+		err = ChrootExecPiped(notif, overlay.MountPoint, loginCommand)
+	} else {
+		log.Debugf("Spawning login shell: %s\n", loginCommand)
+		err = ChrootExecStdin(notif, overlay.MountPoint, loginCommand)
+	}
 	commands.SetStdin(nil)
 	notif.SetActivePID(0)
 	return err
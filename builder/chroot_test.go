@@ -0,0 +1,75 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestChrootShell(t *testing.T) {
+	shell, err := NewChrootShell(&Profile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd := shell.Command(BuildUser, BuildUserHome); cmd != "/bin/su - build -s /bin/bash" {
+		t.Fatalf("An unset profile should keep the plain login shell, got %s", cmd)
+	}
+	shell, err = NewChrootShell(&Profile{
+		ChrootPath: []string{"/usr/lib64/ccache/bin", "/opt/llvm/bin"},
+		ChrootRC:   "cd ~/work\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := shell.Script()
+	if !strings.Contains(script, "export PATH='/usr/lib64/ccache/bin:/opt/llvm/bin':\"$PATH\"\n") || !strings.HasSuffix(script, "cd ~/work\n") {
+		t.Fatalf("Unexpected rc file:\n%s", script)
+	}
+	if cmd := shell.Command(BuildUser, BuildUserHome); !strings.Contains(cmd, "--rcfile /home/build/"+ChrootRCFile) {
+		t.Fatalf("Bash should read the rc file, got %s", cmd)
+	}
+	shell.Shell = "/bin/zsh"
+	if cmd := shell.Command("root", "/root"); !strings.Contains(cmd, "ENV=/root/"+ChrootRCFile+" exec /bin/zsh -i") {
+		t.Fatalf("Other shells should be given the rc file with $ENV, got %s", cmd)
+	}
+	if _, err = NewChrootShell(&Profile{ChrootShell: "zsh"}); err != ErrInvalidChrootShell {
+		t.Fatalf("Relative shells should be refused")
+	}
+	if _, err = NewChrootShell(&Profile{ChrootPath: []string{"/opt/a:/opt/b"}}); err != ErrInvalidChrootPath {
+		t.Fatalf("PATH additions containing ':' should be refused")
+	}
+}
+
+func TestChrootShellExec(t *testing.T) {
+	shell := &ChrootShell{Shell: "/bin/sh", Exec: []string{"printf", "%s|", "it's", "a b"}}
+	cmd := shell.Command(BuildUser, BuildUserHome)
+	prefix := "/bin/su - build -s /bin/sh -c "
+	if !strings.HasPrefix(cmd, prefix) {
+		t.Fatalf("Unexpected command: %s", cmd)
+	}
+	// Run it as su would, with the quoting unwrapped by both shells
+	out, err := exec.Command("/bin/sh", "-c", "/bin/sh -c "+strings.TrimPrefix(cmd, prefix)).Output()
+	if err != nil || string(out) != "it's|a b|" {
+		t.Fatalf("Arguments were not preserved, got %q %v", out, err)
+	}
+	shell.Path = []string{"/opt/bin"}
+	if cmd := shell.Command("root", "/root"); !strings.Contains(cmd, ". /root/"+ChrootRCFile+"; ") {
+		t.Fatalf("The command should read the rc file, got %s", cmd)
+	}
+}
@@ -0,0 +1,133 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	log "github.com/DataDrake/waterlog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrNoCleanPolicy is returned when neither a number of builds to keep nor
+// a minimum age is given, which would remove the artifacts of every build.
+var ErrNoCleanPolicy = errors.New("Refusing to clean every build without a policy")
+
+// An ArtifactPolicy decides which past builds have their artifacts removed
+// from an output directory.
+type ArtifactPolicy struct {
+	Keep      int           // Newest builds of each package to keep
+	OlderThan time.Duration // Only builds older than this are removed
+	All       bool          // Remove every build matching OlderThan
+}
+
+// stampedBuild is a past build found in an output directory by its stamp
+type stampedBuild struct {
+	path    string
+	stamp   *BuildStamp
+	modTime time.Time
+}
+
+// loadStampedBuilds will read every build stamp in dir, grouped by package
+// and ordered from the newest build.
+func loadStampedBuilds(dir string) (map[string][]*stampedBuild, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+BuildStampSuffix))
+	if err != nil {
+		return nil, err
+	}
+	builds := make(map[string][]*stampedBuild)
+	for _, path := range paths {
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamp, err := LoadBuildStamp(path)
+		if err != nil || stamp.Name == "" {
+			log.Warnf("Ignoring unreadable build stamp %s\n", path)
+			continue
+		}
+		builds[stamp.Name] = append(builds[stamp.Name], &stampedBuild{path: path, stamp: stamp, modTime: st.ModTime()})
+	}
+	for _, stamped := range builds {
+		sort.Slice(stamped, func(i, j int) bool {
+			if stamped[i].stamp.Release != stamped[j].stamp.Release {
+				return stamped[i].stamp.Release > stamped[j].stamp.Release
+			}
+			return stamped[i].modTime.After(stamped[j].modTime)
+		})
+	}
+	return builds, nil
+}
+
+// Plan will find the artifacts in dir recorded by the stamps of past builds
+// that the policy doesn't keep. Files that aren't listed by a stamp are never
+// touched, nor are those also listed by the stamp of a build being kept, such
+// as the abi_* files each build replaces.
+func (p *ArtifactPolicy) Plan(dir string) (*RetentionReport, error) {
+	if !p.All && p.Keep < 1 && p.OlderThan <= 0 {
+		return nil, ErrNoCleanPolicy
+	}
+	builds, err := loadStampedBuilds(dir)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-p.OlderThan)
+	var removed []*stampedBuild
+	kept := make(map[string]bool)
+	for _, stamped := range builds {
+		for i, build := range stamped {
+			if (!p.All && i < p.Keep) || build.modTime.After(cutoff) {
+				for _, file := range build.stamp.Files {
+					kept[file] = true
+				}
+				continue
+			}
+			removed = append(removed, build)
+		}
+	}
+
+	report := &RetentionReport{Dir: dir}
+	seen := make(map[string]bool)
+	for _, build := range removed {
+		files := append([]string{filepath.Base(build.path)}, build.stamp.Files...)
+		for _, file := range files {
+			file = filepath.Base(file)
+			if kept[file] || seen[file] {
+				continue
+			}
+			seen[file] = true
+			path := filepath.Join(dir, file)
+			st, err := os.Lstat(path)
+			if err != nil || !st.Mode().IsRegular() {
+				continue
+			}
+			report.Removed = append(report.Removed, &RetainedFile{
+				Path:    path,
+				Name:    build.stamp.Name,
+				Release: build.stamp.Release,
+				Size:    st.Size(),
+				ModTime: st.ModTime(),
+			})
+		}
+	}
+	sort.Slice(report.Removed, func(i, j int) bool {
+		return report.Removed[i].Path < report.Removed[j].Path
+	})
+	return report, nil
+}
@@ -0,0 +1,82 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeStampedBuild(t *testing.T, dir string, release int, age time.Duration, files ...string) {
+	pkg := &Package{Name: "nano", Version: "5.0", Release: release}
+	stamp := &BuildStamp{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release, Files: files}
+	for _, file := range files {
+		writeTestFile(t, filepath.Join(dir, file), file)
+	}
+	path := GetBuildStampPath(pkg, dir)
+	if err := stamp.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArtifactPolicy(t *testing.T) {
+	dir := t.TempDir()
+	writeStampedBuild(t, dir, 1, 72*time.Hour, "nano-5.0-1-1-x86_64.eopkg", "abi_symbols", "nano-5.0-1.pkgdiff")
+	writeStampedBuild(t, dir, 2, 48*time.Hour, "nano-5.0-2-1-x86_64.eopkg", "abi_symbols")
+	writeStampedBuild(t, dir, 3, time.Hour, "nano-5.0-3-1-x86_64.eopkg", "abi_symbols")
+	writeTestFile(t, filepath.Join(dir, "package.yml"), "name: nano\n")
+
+	if _, err := (&ArtifactPolicy{}).Plan(dir); err != ErrNoCleanPolicy {
+		t.Fatalf("Empty policy should be refused, got %v", err)
+	}
+
+	report, err := (&ArtifactPolicy{Keep: 1, OlderThan: 60 * time.Hour}).Plan(dir)
+	if err != nil {
+		t.Fatalf("Failed to plan: %s", err)
+	}
+	expected := []string{"nano-5.0-1-1-x86_64.eopkg", "nano-5.0-1.pkgdiff", "nano-5.0-1.stamp"}
+	if len(report.Removed) != len(expected) {
+		t.Fatalf("Expected %v to be removed, got %d files", expected, len(report.Removed))
+	}
+	for i, f := range report.Removed {
+		if filepath.Base(f.Path) != expected[i] {
+			t.Fatalf("Expected %s to be removed, got %s", expected[i], f.Path)
+		}
+	}
+
+	report, err = (&ArtifactPolicy{All: true}).Plan(dir)
+	if err != nil {
+		t.Fatalf("Failed to plan: %s", err)
+	}
+	if err := report.Apply(); err != nil {
+		t.Fatalf("Failed to clean: %s", err)
+	}
+	for _, file := range []string{"abi_symbols", "nano-5.0-3-1-x86_64.eopkg", "nano-5.0-3.stamp"} {
+		if PathExists(filepath.Join(dir, file)) {
+			t.Fatalf("%s should have been removed", file)
+		}
+	}
+	if !PathExists(filepath.Join(dir, "package.yml")) {
+		t.Fatalf("Files not listed by a stamp should never be removed")
+	}
+}
@@ -0,0 +1,148 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ErrNothingToCommit is returned when the package has no changes to commit
+var ErrNothingToCommit = errors.New("No changes to commit")
+
+// commitTemplateFooter reminds the maintainer of the conventions that the
+// history.xml generation relies upon.
+const commitTemplateFooter = `
+# Mention each security fix by its ID so it is flagged as a security update,
+# e.g. "Fixes CVE-2021-12345". Uncomment any trailers that apply:
+#
+# Fixes: #
+# Update-Type: security
+# Requires-Reboot: yes
+#
+# The summary and test plan become the changelog entry for users.
+# Lines starting with '#' will be ignored, and an unchanged template
+# aborts the commit.
+`
+
+// NewCommitTemplate will return a commit message template summarising the
+// change from the previous version of the package, which may be nil for a
+// newly added package.
+func NewCommitTemplate(previous, current *Package) string {
+	var subject string
+	switch {
+	case previous == nil:
+		subject = fmt.Sprintf("Initial inclusion of %s %s", current.Name, current.Version)
+	case previous.Version != current.Version:
+		subject = fmt.Sprintf("Update to v%s", current.Version)
+	case previous.Release != current.Release:
+		subject = "Rebuild for "
+	default:
+		subject = ""
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: %s\n\n", current.Name, subject)
+	buf.WriteString("**Summary**\n\n- \n\n**Test Plan**\n\n- \n")
+	buf.WriteString(commitTemplateFooter)
+	if previous != nil {
+		fmt.Fprintf(&buf, "#\n# %s: %s-%d -> %s-%d\n", current.Name,
+			previous.Version, previous.Release, current.Version, current.Release)
+	}
+	return buf.String()
+}
+
+// committedPackage will return the package recipe as it was in HEAD, or nil
+// if it hasn't been committed yet.
+func committedPackage(pkgfile string) *Package {
+	c := exec.Command("git", "show", "HEAD:./"+filepath.Base(pkgfile))
+	c.Dir = filepath.Dir(pkgfile)
+	out, err := c.Output()
+	if err != nil {
+		return nil
+	}
+	pkg, err := NewYmlPackageFromBytes(out)
+	if err != nil {
+		log.Warnf("Failed to parse the committed recipe, reason: %s\n", err)
+		return nil
+	}
+	return pkg
+}
+
+// CommitTemplate will return the commit template for the uncommitted
+// changes to the package recipe.
+func CommitTemplate(pkgfile string) (string, error) {
+	current, err := NewYmlPackage(pkgfile)
+	if err != nil {
+		return "", err
+	}
+	return NewCommitTemplate(committedPackage(pkgfile), current), nil
+}
+
+// CommitRecipe will stage all changes within the package directory and run
+// git commit with a pre-filled template, letting git open the editor.
+func CommitRecipe(pkgfile string) error {
+	template, err := CommitTemplate(pkgfile)
+	if err != nil {
+		return err
+	}
+	repoDir := filepath.Dir(pkgfile)
+
+	add := exec.Command("git", "add", "-A", ".")
+	add.Dir = repoDir
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		return fmt.Errorf("Failed to stage recipe changes, reason: %s\n", err)
+	}
+	if !hasStagedChanges(repoDir) {
+		return ErrNothingToCommit
+	}
+
+	tmp, err := ioutil.TempFile("", "solbuild-commit-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(template); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	c := exec.Command("git", "commit", "--template", tmp.Name())
+	c.Dir = repoDir
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("git commit failed, reason: %s\n", err)
+	}
+	return nil
+}
+
+// hasStagedChanges determines if anything is staged for commit
+func hasStagedChanges(repoDir string) bool {
+	c := exec.Command("git", "diff", "--cached", "--quiet")
+	c.Dir = repoDir
+	return c.Run() != nil
+}
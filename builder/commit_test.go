@@ -0,0 +1,37 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewCommitTemplate(t *testing.T) {
+	current := &Package{Name: "nano", Version: "7.2", Release: 160}
+	subjects := map[*Package]string{
+		nil: "nano: Initial inclusion of nano 7.2\n",
+		{Name: "nano", Version: "7.1", Release: 159}: "nano: Update to v7.2\n",
+		{Name: "nano", Version: "7.2", Release: 159}: "nano: Rebuild for \n",
+	}
+	for previous, want := range subjects {
+		template := NewCommitTemplate(previous, current)
+		if !strings.HasPrefix(template, want) {
+			t.Fatalf("Wrong subject, expected %q in:\n%s", want, template)
+		}
+	}
+}
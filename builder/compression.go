@@ -0,0 +1,97 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"strconv"
+)
+
+const (
+	// MaxCompressionLevel is the highest xz preset eopkg can compress with
+	MaxCompressionLevel = 9
+)
+
+var (
+	// ErrInvalidCompression is returned for compression levels or thread
+	// counts that xz doesn't accept
+	ErrInvalidCompression = fmt.Errorf("Compression level must be between 1 and %d, and threads can't be negative", MaxCompressionLevel)
+)
+
+// A Compression controls how the xz payload of each built package is
+// compressed. Zero values leave the defaults of eopkg in place.
+type Compression struct {
+	Level   int // xz preset, from 1 (fastest) to 9 (smallest)
+	Threads int // Threads used by xz, with 0 leaving xz single threaded
+}
+
+// PackageCompression is set when the built packages aren't compressed with
+// the defaults of eopkg
+var PackageCompression *Compression
+
+// NewCompression will validate the compression settings, returning nil when
+// the defaults are to be used.
+func NewCompression(level, threads int) (*Compression, error) {
+	if level < 0 || level > MaxCompressionLevel || threads < 0 {
+		return nil, ErrInvalidCompression
+	}
+	if level == 0 && threads == 0 {
+		return nil, nil
+	}
+	return &Compression{Level: level, Threads: threads}, nil
+}
+
+// String describes the compression as the equivalent xz options
+func (c *Compression) String() string {
+	if c == nil {
+		return "default"
+	}
+	s := "xz"
+	if c.Level > 0 {
+		s += " -" + strconv.Itoa(c.Level)
+	}
+	if c.Threads > 0 {
+		s += " -T" + strconv.Itoa(c.Threads)
+	}
+	return s
+}
+
+// environment returns the chroot environment that makes xz use the threads,
+// as eopkg runs xz itself to compress the payload.
+func (c *Compression) environment() []string {
+	if c == nil || c.Threads == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("XZ_DEFAULTS=-T%d", c.Threads)}
+}
+
+// applyCompression will configure eopkg within the root to compress the
+// packages at the requested level, if any.
+func (p *Package) applyCompression(pman *EopkgManager) error {
+	if PackageCompression == nil {
+		return nil
+	}
+	log.Infof("Compressing packages with %s\n", PackageCompression)
+	if PackageCompression.Level == 0 {
+		return nil
+	}
+	if err := pman.setBuildOption("compressionlevel", strconv.Itoa(PackageCompression.Level)); err != nil {
+		return fmt.Errorf("Failed to set compression level, reason: %s\n", err)
+	}
+	return nil
+}
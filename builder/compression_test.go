@@ -0,0 +1,45 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestNewCompression(t *testing.T) {
+	if c, err := NewCompression(0, 0); err != nil || c != nil {
+		t.Fatalf("Defaults should not need a compression, got %v %v", c, err)
+	}
+	for _, invalid := range [][2]int{{10, 0}, {-1, 0}, {6, -2}} {
+		if _, err := NewCompression(invalid[0], invalid[1]); err != ErrInvalidCompression {
+			t.Fatalf("Level %d with %d threads should be invalid", invalid[0], invalid[1])
+		}
+	}
+	c, err := NewCompression(1, 4)
+	if err != nil {
+		t.Fatalf("Failed to create compression: %s", err)
+	}
+	if s := c.String(); s != "xz -1 -T4" {
+		t.Fatalf("Unexpected description: %s", s)
+	}
+	if env := c.environment(); len(env) != 1 || env[0] != "XZ_DEFAULTS=-T4" {
+		t.Fatalf("Unexpected environment: %v", env)
+	}
+	if env := (&Compression{Level: 9}).environment(); env != nil {
+		t.Fatalf("Single threaded compression needs no environment, got %v", env)
+	}
+}
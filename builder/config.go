@@ -26,10 +26,68 @@ import (
 
 // Config defines the global defaults for solbuild
 type Config struct {
-	DefaultProfile string `toml:"default_profile"`  // Name of the default profile to use
-	EnableTmpfs    bool   `toml:"enable_tmpfs"`     // Whether to enable tmpfs builds or
-	OverlayRootDir string `toml:"overlay_root_dir"` // Custom Overlay Root Dir
-	TmpfsSize      string `toml:"tmpfs_size"`       // Bounding size on the tmpfs
+	AdaptiveJobs        bool                    `toml:"adaptive_jobs"`         // Compute the job count from available memory
+	AppStreamReleases   bool                    `toml:"appstream_releases"`    // Replace the releases of shipped AppStream metainfo with the history
+	ArtifactCollision   string                  `toml:"artifact_collision"`    // Whether to overwrite, refuse or rename existing packages
+	ArtifactName        string                  `toml:"artifact_name"`         // Template the collected packages are named with
+	Backend             string                  `toml:"backend"`               // How commands are run in the build root
+	BuildIONice         string                  `toml:"build_ionice"`          // I/O priority of the build stage
+	BuildNice           int                     `toml:"build_nice"`            // Niceness of the build stage
+	BuildTimeout        string                  `toml:"build_timeout"`         // How long the build phase may run for
+	BuildTmpSize        string                  `toml:"build_tmp_size"`        // Size of the tmpfs given to each build as its TMPDIR
+	CargoTargetCache    bool                    `toml:"cargo_target_cache"`    // Keep the cargo target directory of each package between builds
+	CcacheSeedKey       string                  `toml:"ccache_seed_key"`       // Fingerprint of the GPG key ccache seeds are signed with
+	CcacheSeedURL       string                  `toml:"ccache_seed_url"`       // Template of the URL ccache seeds are fetched from
+	ClampMtimes         bool                    `toml:"clamp_mtimes"`          // Clamp artifact mtimes to SOURCE_DATE_EPOCH
+	CompressionLevel    int                     `toml:"compression_level"`     // xz preset for the built packages, 0 for the default
+	CompressionThreads  int                     `toml:"compression_threads"`   // Threads xz compresses the packages with
+	CrashArtifactsLimit int64                   `toml:"crash_artifacts_limit"` // Maximum MiB of crash artifacts to collect
+	CVEDatabase         string                  `toml:"cve_database"`          // Directory of OSV entries for CVE enrichment
+	CVEFetch            bool                    `toml:"cve_fetch"`             // Fetch missing CVEs from OSV into the database
+	DefaultProfile      string                  `toml:"default_profile"`       // Name of the default profile to use
+	EnableTmpfs         bool                    `toml:"enable_tmpfs"`          // Whether to enable tmpfs builds or
+	ExtractCache        bool                    `toml:"extract_cache"`         // Keep the source trees extracted by patch checks between builds
+	ExtractThreads      int                     `toml:"extract_threads"`       // Threads source archives are decompressed with on the host and by xz
+	FetchBandwidth      string                  `toml:"fetch_bandwidth"`       // Download rate each source is limited to
+	FetchIONice         string                  `toml:"fetch_ionice"`          // I/O priority of the fetch stage
+	FetchNice           int                     `toml:"fetch_nice"`            // Niceness of the fetch stage
+	FetchTimeout        string                  `toml:"fetch_timeout"`         // How long the fetch phase may run for
+	GBPerJob            float64                 `toml:"gb_per_job"`            // Memory required per job for C builds
+	GBPerJobCxx         float64                 `toml:"gb_per_job_cxx"`        // Memory required per job for C++ builds
+	HistoryDepth        int                     `toml:"history_depth"`         // Maximum changelog entries, -1 for unlimited
+	HistoryFormats      []string                `toml:"history_formats"`       // Additional history formats written alongside the packages
+	HistoryTagPatterns  []string                `toml:"history_tag_patterns"`  // Regexes of tag names considered for the history
+	Hooks               []*Hook                 `toml:"hooks"`                 // Commands run at points of each build
+	ImageFormat         string                  `toml:"image_format"`          // Whether images are kept as ext4 or squashfs
+	ImageGenerations    int                     `toml:"image_generations"`     // Previous generations of each image kept by updates
+	InstallTest         bool                    `toml:"install_test"`          // Install the built packages and run the test script of the recipe
+	KeepRoot            string                  `toml:"keep_root"`             // How long build roots are kept for rebuilds
+	LanguageCacheSize   string                  `toml:"language_cache_size"`   // Size each language cache is emptied beyond
+	LanguageCaches      []string                `toml:"language_caches"`       // Language dependency caches given to builds, i.e. go or npm
+	MountSources        []string                `toml:"mount_sources"`         // Host directories solbuild.yml may mount besides the recipe directory
+	OverlayRootDir      string                  `toml:"overlay_root_dir"`      // Custom Overlay Root Dir
+	PatchCheck          string                  `toml:"patch_check"`           // Strictness of the pre-build patch checks, if any
+	PatchFuzz           int                     `toml:"patch_fuzz"`            // Fuzz factor patches may need before being reported
+	Prune               map[string]*PruneConfig `toml:"prune"`                 // Retention policy of each cache, applied by solbuild prune
+	RedactPatterns      []string                `toml:"redact_patterns"`       // Regular expressions to redact from all output
+	RequireSigned       bool                    `toml:"require_signed"`        // Require a trusted signed recipe commit for publishing
+	RetainReleases      int                     `toml:"retain_releases"`       // Releases of each package kept by prune-packages
+	RetainSize          string                  `toml:"retain_size"`           // Size each package directory is pruned to
+	SBOMFormat          string                  `toml:"sbom_format"`           // Format of the SBOM written after builds, if any
+	SccacheRemote       string                  `toml:"sccache_remote"`        // Remote storage shared by sccache, i.e. s3://bucket/prefix
+	SetupTimeout        string                  `toml:"setup_timeout"`         // How long the setup phase may run for
+	SignPackages        bool                    `toml:"sign_packages"`         // Sign every built package with the signing key
+	SigningKey          string                  `toml:"signing_key"`           // GPG key used to sign indexes and packages
+	SizeCheck           string                  `toml:"size_check"`            // Strictness of the package size growth checks, if any
+	SizeGrowthLimit     int                     `toml:"size_growth_limit"`     // Percentage packages may grow by between builds
+	SizeGrowthMinimum   string                  `toml:"size_growth_minimum"`   // Growth in bytes below which packages are never reported
+	StackPromotion      string                  `toml:"stack_promotion"`       // Whether stacks build against their own packages
+	Timeout             string                  `toml:"timeout"`               // How long the whole build may run for
+	TmpfsSize           string                  `toml:"tmpfs_size"`            // Bounding size on the tmpfs
+	WebhookSecret       string                  `toml:"webhook_secret"`        // Key the build events sent to webhooks are signed with
+	Webhooks            []string                `toml:"webhooks"`              // Endpoints build events are posted to
+	WorkerToken         string                  `toml:"worker_token"`          // Shared secret between a coordinator and its workers
+	ZramSwapSize        string                  `toml:"zram_swap_size"`        // Size of temporary zram swap for builds
 }
 
 var (
@@ -41,6 +99,11 @@ var (
 
 	// ConfigSuffix is the suffix a file must have to be glob loaded by solbuild
 	ConfigSuffix = ".conf"
+
+	// DefaultRedactPatterns will hide the credentials of any URL in output
+	DefaultRedactPatterns = []string{
+		`[a-zA-Z][a-zA-Z0-9+.-]*://([^/\s:@]+:[^/\s@]+)@`,
+	}
 )
 
 // NewConfig will read all the system config files and then the vendor config files
@@ -48,10 +111,17 @@ var (
 func NewConfig() (*Config, error) {
 	// Set up some sane defaults just in case someone mangles the configs
 	config := &Config{
-		DefaultProfile: "main-x86_64",
-		EnableTmpfs:    false,
-		OverlayRootDir: "/var/cache/solbuild",
-		TmpfsSize:      "",
+		BuildIONice:         "best-effort:7",
+		BuildNice:           10,
+		CrashArtifactsLimit: 1024,
+		DefaultProfile:      "main-x86_64",
+		EnableTmpfs:         false,
+		FetchIONice:         "idle",
+		GBPerJob:            1.0,
+		GBPerJobCxx:         2.5,
+		OverlayRootDir:      "/var/cache/solbuild",
+		RedactPatterns:      DefaultRedactPatterns,
+		TmpfsSize:           "",
 	}
 
 	// Reverse because /etc takes precedence in stateless
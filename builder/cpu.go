@@ -0,0 +1,202 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// CPUInfoPath is where the features of the host CPU are read from
+var CPUInfoPath = "/proc/cpuinfo"
+
+var (
+	// BuildCPU is the effective CPU baseline of the build, when the profile
+	// sets one
+	BuildCPU *CPUBaseline
+
+	// ErrUnknownCPUBaseline is returned for a cpu_baseline that isn't one of
+	// the x86-64 microarchitecture levels
+	ErrUnknownCPUBaseline = errors.New("Unknown cpu_baseline, expected x86-64, x86-64-v2, x86-64-v3 or x86-64-v4")
+
+	// ErrNativeTuning is returned when the recipe tunes for the host CPU,
+	// while the profile expects a baseline
+	ErrNativeTuning = errors.New("Recipe tunes for the host CPU with -march=native, which ignores the cpu_baseline")
+
+	// nativeTuningPattern matches compiler flags tuning for the host CPU
+	nativeTuningPattern = regexp.MustCompile(`-m(arch|tune|cpu)=native\b`)
+)
+
+// A cpuLevel is an x86-64 microarchitecture level, and the features it adds
+// to the level below it, named as in /proc/cpuinfo.
+type cpuLevel struct {
+	Name     string
+	Features []string
+}
+
+// cpuLevels are the x86-64 microarchitecture levels, from the oldest
+var cpuLevels = []cpuLevel{
+	{"x86-64", []string{"cmov", "cx8", "fpu", "fxsr", "mmx", "sse", "sse2"}},
+	{"x86-64-v2", []string{"cx16", "lahf_lm", "popcnt", "sse4_1", "sse4_2", "ssse3"}},
+	{"x86-64-v3", []string{"abm", "avx", "avx2", "bmi1", "bmi2", "f16c", "fma", "movbe", "xsave"}},
+	{"x86-64-v4", []string{"avx512bw", "avx512cd", "avx512dq", "avx512f", "avx512vl"}},
+}
+
+// glibcFeatures are the names glibc knows the features by, to mask them in
+// glibc.cpu.hwcaps
+var glibcFeatures = map[string]string{
+	"cx16":     "CMPXCHG16B",
+	"lahf_lm":  "LAHF64_SAHF64",
+	"popcnt":   "POPCNT",
+	"sse4_1":   "SSE4_1",
+	"sse4_2":   "SSE4_2",
+	"ssse3":    "SSSE3",
+	"abm":      "LZCNT",
+	"avx":      "AVX",
+	"avx2":     "AVX2",
+	"bmi1":     "BMI1",
+	"bmi2":     "BMI2",
+	"f16c":     "F16C",
+	"fma":      "FMA",
+	"movbe":    "MOVBE",
+	"xsave":    "XSAVE",
+	"avx512bw": "AVX512BW",
+	"avx512cd": "AVX512CD",
+	"avx512dq": "AVX512DQ",
+	"avx512f":  "AVX512F",
+	"avx512vl": "AVX512VL",
+}
+
+// A CPUBaseline is the CPU the build environment is normalised to
+type CPUBaseline struct {
+	Baseline string   // Level the image expects, i.e. x86-64-v2
+	Host     string   // Highest level the host supports
+	Masked   []string // Host features above the baseline hidden from glibc
+}
+
+// ValidCPUBaseline determines whether the baseline is a known level
+func ValidCPUBaseline(baseline string) bool {
+	if baseline == "" {
+		return true
+	}
+	for _, level := range cpuLevels {
+		if level.Name == baseline {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadCPUFeatures will read the feature flags of the first CPU
+func ReadCPUFeatures(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	features := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) != "flags" {
+			continue
+		}
+		for _, flag := range strings.Fields(fields[1]) {
+			features[flag] = true
+		}
+		break
+	}
+	return features, scanner.Err()
+}
+
+// NewCPUBaseline will compare the host features with the baseline level,
+// failing when the host lacks any of its features. Features of the host
+// above the baseline are masked from glibc for the build.
+func NewCPUBaseline(baseline string, features map[string]bool) (*CPUBaseline, error) {
+	if baseline == "" || !ValidCPUBaseline(baseline) {
+		return nil, ErrUnknownCPUBaseline
+	}
+	cpu := &CPUBaseline{Baseline: baseline, Host: "unknown"}
+	var missing []string
+	above, host := false, true
+	for _, level := range cpuLevels {
+		for _, feature := range level.Features {
+			switch {
+			case !features[feature]:
+				host = false
+				if !above {
+					missing = append(missing, feature)
+				}
+			case above:
+				cpu.Masked = append(cpu.Masked, feature)
+			}
+		}
+		if host {
+			cpu.Host = level.Name
+		}
+		above = above || level.Name == baseline
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Host CPU (%s) lacks the features of the %s baseline: %s", cpu.Host, baseline, strings.Join(missing, ", "))
+	}
+	return cpu, nil
+}
+
+// String describes the effective baseline, i.e. x86-64-v2 on x86-64-v4
+func (c *CPUBaseline) String() string {
+	return fmt.Sprintf("%s on %s", c.Baseline, c.Host)
+}
+
+// environment returns the chroot environment hiding the features above the
+// baseline from glibc, so that its optimised routines and hwcaps libraries
+// behave as they would on a baseline CPU.
+func (c *CPUBaseline) environment() []string {
+	if c == nil || len(c.Masked) == 0 {
+		return nil
+	}
+	var masks []string
+	for _, feature := range c.Masked {
+		if name, ok := glibcFeatures[feature]; ok {
+			masks = append(masks, "-"+name)
+		}
+	}
+	return []string{"GLIBC_TUNABLES=glibc.cpu.hwcaps=" + strings.Join(masks, ",")}
+}
+
+// checkNativeTuning will look for compiler flags tuning the recipe for the
+// host CPU, which would leak its features into the packages.
+func (p *Package) checkNativeTuning() error {
+	b, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return err
+	}
+	if !nativeTuningPattern.Match(b) {
+		return nil
+	}
+	if BuildCPU != nil {
+		return ErrNativeTuning
+	}
+	log.Warnln("Recipe tunes for the host CPU with -march=native, the packages may not run on other machines")
+	return nil
+}
@@ -0,0 +1,83 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testCPUInfo = `processor	: 0
+vendor_id	: GenuineIntel
+flags		: fpu cx8 cmov mmx fxsr sse sse2 ssse3 cx16 sse4_1 sse4_2 popcnt lahf_lm abm avx avx2 bmi1 bmi2 f16c fma movbe xsave
+
+processor	: 1
+flags		: fpu
+`
+
+func TestCPUBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpuinfo")
+	writeTestFile(t, path, testCPUInfo)
+	features, err := ReadCPUFeatures(path)
+	if err != nil {
+		t.Fatalf("Failed to read features: %s", err)
+	}
+
+	cpu, err := NewCPUBaseline("x86-64-v2", features)
+	if err != nil {
+		t.Fatalf("Host should support x86-64-v2: %s", err)
+	}
+	if cpu.Host != "x86-64-v3" {
+		t.Fatalf("Expected an x86-64-v3 host, got %s", cpu.Host)
+	}
+	env := cpu.environment()
+	if len(env) != 1 || !strings.HasPrefix(env[0], "GLIBC_TUNABLES=glibc.cpu.hwcaps=-LZCNT,-AVX,-AVX2,") {
+		t.Fatalf("Unexpected environment %v", env)
+	}
+
+	if _, err := NewCPUBaseline("x86-64-v4", features); err == nil || !strings.Contains(err.Error(), "avx512bw") {
+		t.Fatalf("Host should lack x86-64-v4, got %v", err)
+	}
+	if _, err := NewCPUBaseline("armv8", features); err != ErrUnknownCPUBaseline {
+		t.Fatalf("Unknown baseline should be refused, got %v", err)
+	}
+	if cpu, _ := NewCPUBaseline("x86-64-v3", features); !reflect.DeepEqual(cpu.environment(), []string(nil)) {
+		t.Fatalf("Nothing should be masked at the host level, got %v", cpu.environment())
+	}
+}
+
+func TestCheckNativeTuning(t *testing.T) {
+	dir := t.TempDir()
+	pkg := &Package{Path: filepath.Join(dir, "package.yml")}
+	writeTestFile(t, pkg.Path, "setup: |\n    export CFLAGS=\"$CFLAGS -march=native\"\n")
+	defer func() { BuildCPU = nil }()
+
+	BuildCPU = nil
+	if err := pkg.checkNativeTuning(); err != nil {
+		t.Fatalf("Native tuning without a baseline should only warn: %s", err)
+	}
+	BuildCPU = &CPUBaseline{Baseline: "x86-64-v2"}
+	if err := pkg.checkNativeTuning(); err != ErrNativeTuning {
+		t.Fatalf("Native tuning with a baseline should be refused, got %v", err)
+	}
+	writeTestFile(t, pkg.Path, "setup: |\n    %configure --with-arch=x86-64-v2\n")
+	if err := pkg.checkNativeTuning(); err != nil {
+		t.Fatalf("Recipe without native tuning should be accepted: %s", err)
+	}
+}
@@ -0,0 +1,268 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// CorePatternFile is where the kernel reads the core file naming from
+	CorePatternFile = "/proc/sys/kernel/core_pattern"
+
+	// ntFile is the ELF note type listing files mapped by a crashed process
+	ntFile = 0x46494c45
+)
+
+// CrashArtifactsLimit bounds the total size, in MiB, of crash artifacts
+// collected from a failed build. A limit of 0 disables collection.
+var CrashArtifactsLimit int64
+
+// GetFailureDir will return the directory failure artifacts are stored in,
+// relative to the users current directory.
+func (p *Package) GetFailureDir() string {
+	return fmt.Sprintf("%s-%s-%d.failure", p.Name, p.Version, p.Release)
+}
+
+// coreLimitCommand will return the shell prefix needed to allow the build
+// to dump cores within our size limit.
+func coreLimitCommand() string {
+	if CrashArtifactsLimit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("ulimit -c %d; ", CrashArtifactsLimit*1024)
+}
+
+// coreSearchPaths will return the chroot-internal directories to look for
+// core files in, based on the kernel core pattern.
+func (p *Package) coreSearchPaths() []string {
+	pattern, err := ioutil.ReadFile(CorePatternFile)
+	if err != nil {
+		log.Warnf("Unable to read core pattern, reason: %s\n", err)
+		return nil
+	}
+	pat := strings.TrimSpace(string(pattern))
+	switch {
+	case strings.HasPrefix(pat, "|"):
+		log.Warnf("Core dumps are piped to %s, unable to collect them\n", strings.Fields(pat[1:])[0])
+		return nil
+	case strings.HasPrefix(pat, "/"):
+		return []string{filepath.Dir(pat)}
+	default:
+		// Relative to the working directory of the crashed process
+		return []string{BuildUserHome}
+	}
+}
+
+// findCores will return the paths of all core files within the overlay
+func (p *Package) findCores(overlay *Overlay) []string {
+	skip := map[string]bool{
+		p.GetSourceDir(overlay):  true,
+		p.GetCcacheDir(overlay):  true,
+		p.GetSccacheDir(overlay): true,
+	}
+	for _, dir := range p.cargoMounts() {
+		skip[filepath.Join(overlay.MountPoint, dir[1:])] = true
+	}
+	for _, name := range LanguageCaches {
+		skip[filepath.Join(overlay.MountPoint, p.GetLanguageCacheDirInternal(name)[1:])] = true
+	}
+	var cores []string
+	for _, dir := range p.coreSearchPaths() {
+		root := filepath.Join(overlay.MountPoint, dir)
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				if skip[path] {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() || !strings.HasPrefix(info.Name(), "core") {
+				return nil
+			}
+			if f, err := elf.Open(path); err == nil {
+				if f.Type == elf.ET_CORE {
+					cores = append(cores, path)
+				}
+				f.Close()
+			}
+			return nil
+		})
+	}
+	return cores
+}
+
+// coreMappedFiles will return the files mapped by the crashed process, the
+// first of which is the executable itself.
+func coreMappedFiles(core string) ([]string, error) {
+	f, err := elf.Open(core)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	wordSize := 8
+	if f.Class == elf.ELFCLASS32 {
+		wordSize = 4
+	}
+	word := func(b []byte) uint64 {
+		if wordSize == 4 {
+			return uint64(f.ByteOrder.Uint32(b))
+		}
+		return f.ByteOrder.Uint64(b)
+	}
+	align := func(n uint32) int {
+		return int((n + 3) &^ 3)
+	}
+
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_NOTE {
+			continue
+		}
+		data, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return nil, err
+		}
+		for len(data) >= 12 {
+			nameSize := f.ByteOrder.Uint32(data[0:4])
+			descSize := f.ByteOrder.Uint32(data[4:8])
+			noteType := f.ByteOrder.Uint32(data[8:12])
+			data = data[12:]
+			if len(data) < align(nameSize)+align(descSize) {
+				break
+			}
+			desc := data[align(nameSize) : align(nameSize)+int(descSize)]
+			data = data[align(nameSize)+align(descSize):]
+			if noteType != ntFile || len(desc) < 2*wordSize {
+				continue
+			}
+			// count, page size, count * (start, end, offset), file names
+			count := int(word(desc))
+			names := 2*wordSize + count*3*wordSize
+			if names > len(desc) {
+				break
+			}
+			var files []string
+			seen := make(map[string]bool)
+			for _, name := range bytes.Split(desc[names:], []byte{0}) {
+				if n := string(name); n != "" && !seen[n] {
+					seen[n] = true
+					files = append(files, n)
+				}
+			}
+			return files, nil
+		}
+	}
+	return nil, nil
+}
+
+// gdbBacktrace will use the host gdb to generate a backtrace of the core,
+// resolving all binaries from within the overlay root.
+func gdbBacktrace(root, exe, core, out string) error {
+	gdb, err := exec.LookPath("gdb")
+	if err != nil {
+		return err
+	}
+	fi, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	c := exec.Command(gdb, "-batch", "-nx",
+		"-ex", fmt.Sprintf("set sysroot %s", root),
+		"-ex", "thread apply all bt full",
+		filepath.Join(root, exe), core)
+	c.Stdout = fi
+	c.Stderr = fi
+	return c.Run()
+}
+
+// CollectCrashArtifacts will copy any core dumps from a failed build into
+// the failure directory, along with the binaries needed to inspect them and
+// a backtrace, without exceeding the CrashArtifactsLimit.
+func (p *Package) CollectCrashArtifacts(overlay *Overlay, usr *UserInfo) error {
+	if CrashArtifactsLimit <= 0 {
+		return nil
+	}
+	cores := p.findCores(overlay)
+	if len(cores) == 0 {
+		return nil
+	}
+	budget := CrashArtifactsLimit * 1024 * 1024
+	failDir := p.GetFailureDir()
+
+	// copyBounded will copy the file if it fits in the remaining budget
+	copyBounded := func(src, dest string) bool {
+		st, err := os.Stat(src)
+		if err != nil || st.Size() > budget {
+			return false
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 00755); err != nil {
+			return false
+		}
+		if err := disk.CopyFile(src, dest); err != nil {
+			log.Warnf("Failed to collect crash artifact %s, reason: %s\n", src, err)
+			return false
+		}
+		budget -= st.Size()
+		return true
+	}
+
+	for i, core := range cores {
+		log.Warnf("Build produced core dump %s\n", strings.TrimPrefix(core, overlay.MountPoint))
+		coreDir := filepath.Join(failDir, fmt.Sprintf("crash-%d", i))
+		if !copyBounded(core, filepath.Join(coreDir, filepath.Base(core))) {
+			log.Warnf("Core dump %s exceeds the crash artifacts limit\n", filepath.Base(core))
+			continue
+		}
+		files, err := coreMappedFiles(core)
+		if err != nil || len(files) == 0 {
+			log.Warnf("Unable to determine binaries for core %s\n", filepath.Base(core))
+			continue
+		}
+		if err := gdbBacktrace(overlay.MountPoint, files[0], core, filepath.Join(coreDir, "backtrace.txt")); err != nil {
+			log.Warnf("Unable to generate backtrace for core %s, reason: %s\n", filepath.Base(core), err)
+		}
+		// Executable first, then the libraries while we still have room
+		for _, file := range files {
+			src := filepath.Join(overlay.MountPoint, file)
+			if !copyBounded(src, filepath.Join(coreDir, "files", file)) {
+				log.Debugf("Skipping crash artifact %s\n", file)
+			}
+		}
+	}
+
+	log.Warnf("Crash artifacts collected in %s\n", failDir)
+	return filepath.Walk(failDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chown(path, usr.UID, usr.GID)
+	})
+}
@@ -0,0 +1,294 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder/source"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// OSVQueryURI is used to look up vulnerabilities missing from the local
+	// database, when fetching is enabled
+	OSVQueryURI = "https://api.osv.dev/v1/vulns/"
+)
+
+var (
+	// severityRanks orders the severities, so the most severe can be chosen
+	severityRanks = map[string]int{
+		"NONE":     0,
+		"LOW":      1,
+		"MEDIUM":   2,
+		"HIGH":     3,
+		"CRITICAL": 4,
+	}
+)
+
+// CVEInfo is the enriched information for a single CVE
+type CVEInfo struct {
+	ID       string   `json:"id"`
+	Severity string   `json:"severity,omitempty"`
+	Score    float64  `json:"score,omitempty"`
+	Affected []string `json:"affected,omitempty"`
+}
+
+// A CVEDatabase is a directory of OSV formatted vulnerabilities, named by
+// their ID, i.e. CVE-2021-1234.json
+type CVEDatabase struct {
+	Dir   string // Where the OSV entries are kept
+	Fetch bool   // Fetch and cache missing entries from OSV
+}
+
+// osvEntry is the subset of the OSV schema we need
+type osvEntry struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases"`
+	Severity []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	Affected []struct {
+		Package struct {
+			Name string `json:"name"`
+		} `json:"package"`
+		Versions []string `json:"versions"`
+		Ranges   []struct {
+			Events []map[string]string `json:"events"`
+		} `json:"ranges"`
+	} `json:"affected"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+}
+
+// NewCVEDatabase will return a database for the given directory
+func NewCVEDatabase(dir string, fetch bool) *CVEDatabase {
+	return &CVEDatabase{Dir: dir, Fetch: fetch}
+}
+
+// load will read the entry from disk, fetching it first if permitted
+func (d *CVEDatabase) load(id string) (*osvEntry, error) {
+	path := filepath.Join(d.Dir, id+".json")
+	if !PathExists(path) {
+		if !d.Fetch {
+			return nil, nil
+		}
+		if err := d.fetch(id, path); err != nil {
+			return nil, err
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := &osvEntry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, fmt.Errorf("Invalid OSV entry %s, reason: %s", path, err)
+	}
+	return entry, nil
+}
+
+// fetch will cache the OSV entry for id at path
+func (d *CVEDatabase) fetch(id, path string) error {
+	log.Debugf("Fetching vulnerability %s\n", id)
+	resp, err := source.HTTPClient().Get(OSVQueryURI + id)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected status %s for %s", resp.Status, id)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.Dir, 00755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 00644)
+}
+
+// Lookup will return the enriched information for the CVE. Unknown CVEs
+// are returned with only their ID set.
+func (d *CVEDatabase) Lookup(id string) CVEInfo {
+	info := CVEInfo{ID: id}
+	entry, err := d.load(id)
+	if err != nil {
+		log.Warnf("Unable to look up %s, reason: %s\n", id, err)
+		return info
+	}
+	if entry == nil {
+		return info
+	}
+	for _, severity := range entry.Severity {
+		if severity.Type != "CVSS_V3" {
+			continue
+		}
+		if score, err := CVSS3BaseScore(severity.Score); err == nil {
+			info.Score = score
+			info.Severity = CVSSSeverity(score)
+		}
+	}
+	if info.Severity == "" && entry.DatabaseSpecific.Severity != "" {
+		info.Severity = strings.ToUpper(entry.DatabaseSpecific.Severity)
+	}
+	for _, affected := range entry.Affected {
+		info.Affected = append(info.Affected, affected.Versions...)
+		for _, r := range affected.Ranges {
+			var bounds []string
+			for _, event := range r.Events {
+				if v, ok := event["introduced"]; ok && v != "0" {
+					bounds = append(bounds, ">="+v)
+				}
+				if v, ok := event["fixed"]; ok {
+					bounds = append(bounds, "<"+v)
+				}
+				if v, ok := event["last_affected"]; ok {
+					bounds = append(bounds, "<="+v)
+				}
+			}
+			if len(bounds) > 0 {
+				info.Affected = append(info.Affected, strings.Join(bounds, " "))
+			}
+		}
+	}
+	return info
+}
+
+// EnrichCVEs will look up every CVE referenced by each update
+func (p *PackageHistory) EnrichCVEs(db *CVEDatabase) {
+	for _, update := range p.Updates {
+		seen := make(map[string]bool)
+		for _, id := range CveRegex.FindAllString(update.Body, -1) {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			update.CVEs = append(update.CVEs, db.Lookup(id))
+		}
+	}
+}
+
+// Severity will return the highest severity of all CVEs fixed by the update
+func (u *PackageUpdate) Severity() string {
+	ret := ""
+	for _, cve := range u.CVEs {
+		if severityRanks[cve.Severity] > severityRanks[ret] || ret == "" {
+			ret = cve.Severity
+		}
+	}
+	return ret
+}
+
+// cvssWeights are the CVSS v3 base metric weights
+var cvssWeights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// cvssRoundUp rounds up to one decimal place, as defined by CVSS v3.1
+func cvssRoundUp(x float64) float64 {
+	i := int64(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return (math.Floor(float64(i)/10000) + 1) / 10
+}
+
+// CVSS3BaseScore will compute the base score of a CVSS v3 vector string
+func CVSS3BaseScore(vector string) (float64, error) {
+	metrics := make(map[string]string)
+	for _, part := range strings.Split(vector, "/") {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) == 2 {
+			metrics[kv[0]] = kv[1]
+		}
+	}
+	if !strings.HasPrefix(metrics["CVSS"], "3") {
+		return 0, fmt.Errorf("Not a CVSS v3 vector: %s", vector)
+	}
+	values := make(map[string]float64)
+	for metric, weights := range cvssWeights {
+		w, ok := weights[metrics[metric]]
+		if !ok {
+			return 0, fmt.Errorf("Invalid %s metric in vector: %s", metric, vector)
+		}
+		values[metric] = w
+	}
+	changed := metrics["S"] == "C"
+	if !changed && metrics["S"] != "U" {
+		return 0, fmt.Errorf("Invalid S metric in vector: %s", vector)
+	}
+	switch metrics["PR"] {
+	case "N":
+		values["PR"] = 0.85
+	case "L":
+		values["PR"] = 0.62
+		if changed {
+			values["PR"] = 0.68
+		}
+	case "H":
+		values["PR"] = 0.27
+		if changed {
+			values["PR"] = 0.5
+		}
+	default:
+		return 0, fmt.Errorf("Invalid PR metric in vector: %s", vector)
+	}
+
+	iss := 1 - (1-values["C"])*(1-values["I"])*(1-values["A"])
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, nil
+	}
+	exploitability := 8.22 * values["AV"] * values["AC"] * values["PR"] * values["UI"]
+	if changed {
+		return cvssRoundUp(math.Min(1.08*(impact+exploitability), 10)), nil
+	}
+	return cvssRoundUp(math.Min(impact+exploitability, 10)), nil
+}
+
+// CVSSSeverity will return the qualitative severity rating of a score
+func CVSSSeverity(score float64) string {
+	switch {
+	case score >= 9.0:
+		return "CRITICAL"
+	case score >= 7.0:
+		return "HIGH"
+	case score >= 4.0:
+		return "MEDIUM"
+	case score > 0:
+		return "LOW"
+	default:
+		return "NONE"
+	}
+}
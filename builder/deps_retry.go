@@ -0,0 +1,62 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"regexp"
+)
+
+// indexRacePattern matches the failures of eopkg when the repository index
+// changed while dependencies were installed, i.e. a package was replaced or
+// removed from the mirror after we fetched the index.
+var indexRacePattern = regexp.MustCompile(`(?i)(hash mismatch|hash of .* (does not match|mismatch)|corrupt(ed)? (package|index)|HTTP Error 404|404:? Not Found)`)
+
+// isIndexRace determines whether the output of a failed dependency install
+// shows a race against an update of the repository index.
+func isIndexRace(output []byte) bool {
+	return indexRacePattern.Match(output)
+}
+
+// UpdateRepos will refresh the indexes of every repository in the chroot
+func (e *EopkgManager) UpdateRepos() error {
+	err := ChrootExec(e.notif, e.root, eopkgCommand("eopkg update-repo"))
+	e.notif.SetActivePID(0)
+	return err
+}
+
+// installDeps will install the build dependencies of a package.yml. When it
+// fails because the repository index changed underneath us, the index is
+// refreshed and the install attempted once more, as this race is common
+// with nightly builds against a busy repository.
+func (p *Package) installDeps(notif PidNotifier, pman *EopkgManager, overlay *Overlay) error {
+	var output bytes.Buffer
+	err := chrootExecWrapped(notif, nil, overlay.MountPoint, p.installDepsCommand(), &output)
+	notif.SetActivePID(0)
+	if err == nil || !isIndexRace(output.Bytes()) {
+		return err
+	}
+	log.Warnf("Repository index changed while installing build dependencies of %s, refreshing and retrying\n", p.Name)
+	if uerr := pman.UpdateRepos(); uerr != nil {
+		return fmt.Errorf("%s, and the index could not be refreshed: %s", err, uerr)
+	}
+	err = ChrootExec(notif, overlay.MountPoint, p.installDepsCommand())
+	notif.SetActivePID(0)
+	return err
+}
@@ -0,0 +1,44 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestIsIndexRace(t *testing.T) {
+	races := []string{
+		"Fetch error: HTTP Error 404: Not Found\n",
+		"Program terminated.\nhash mismatch for nano-5.0-1-1-x86_64.eopkg\n",
+		"Error: Hash of the file nano.eopkg does not match\n",
+		"Error: Corrupted package nano.eopkg\n",
+	}
+	for _, output := range races {
+		if !isIndexRace([]byte(output)) {
+			t.Errorf("Expected an index race in: %q", output)
+		}
+	}
+	failures := []string{
+		"Error: Package nano-devel not found in any repository\n",
+		"Error: Conflicting packages: nano, nano-tiny\n",
+	}
+	for _, output := range failures {
+		if isIndexRace([]byte(output)) {
+			t.Errorf("Unexpected index race in: %q", output)
+		}
+	}
+}
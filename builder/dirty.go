@@ -0,0 +1,109 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// TaintSuffix is the extension of the marker written next to packages
+	// built from uncommitted changes.
+	TaintSuffix = ".tainted"
+
+	// DirtyHistoryTag is the tag given to the placeholder history entry
+	// of a build from uncommitted changes.
+	DirtyHistoryTag = "dirty"
+)
+
+var (
+	// AllowDirty will permit building uncommitted changes to the recipe,
+	// tainting the resulting packages.
+	AllowDirty bool
+
+	// ErrTaintedManifest is returned when a transit manifest is requested
+	// for a build of uncommitted changes.
+	ErrTaintedManifest = errors.New("Refusing to write a transit manifest for uncommitted changes")
+
+	// ErrDirtyRecipe is returned when building a recipe with uncommitted
+	// changes without AllowDirty.
+	ErrDirtyRecipe = errors.New("Refusing to build uncommitted changes without --allow-dirty")
+)
+
+// recipeChanges returns the uncommitted changes within the directory of the
+// recipe, as reported by `git status`. Recipes outside of a git checkout
+// have no changes.
+func recipeChanges(pkgfile string) []string {
+	out, err := gitCommand(filepath.Dir(pkgfile), "status", "--porcelain", "--untracked-files=all", "--", ".").Output()
+	if err != nil {
+		return nil
+	}
+	var changes []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if len(line) > 3 {
+			changes = append(changes, strings.TrimSpace(line))
+		}
+	}
+	return changes
+}
+
+// IsTainted will determine whether the package is being built from
+// uncommitted changes, or from a commit that isn't trusted for publishing.
+func (p *Package) IsTainted() bool {
+	return len(p.Changes) > 0 || p.Untrusted != ""
+}
+
+// AddDirtyUpdate will add a placeholder entry for the uncommitted changes of
+// the package to the top of the history, replacing the committed entry of the
+// same release if there is one.
+func (p *PackageHistory) AddDirtyUpdate(pkg *Package) error {
+	update, err := workingCopyUpdate(pkg.Path, pkg)
+	if err != nil {
+		return err
+	}
+	update.Tag = DirtyHistoryTag
+	update.Body = fmt.Sprintf("Uncommitted changes to %s %s, not for official repositories", pkg.Name, pkg.Version)
+	if len(p.Updates) > 0 && p.Updates[0].Package.Release == pkg.Release {
+		p.Updates[0] = update
+		return nil
+	}
+	p.Updates = append([]*PackageUpdate{update}, p.Updates...)
+	return nil
+}
+
+// writeTaint will record why the build is tainted beside the packages, so
+// that they can be refused by the repositories.
+func (p *Package) writeTaint(dir string) (string, error) {
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s-%d%s", p.Name, p.Version, p.Release, TaintSuffix))
+	var contents string
+	if len(p.Changes) > 0 {
+		contents += "Built from uncommitted changes:\n" + strings.Join(p.Changes, "\n") + "\n"
+	}
+	if p.Untrusted != "" {
+		contents += "Recipe commit is not trusted: " + p.Untrusted + "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 00644); err != nil {
+		return "", fmt.Errorf("Failed to write taint marker, reason: %s\n", err)
+	}
+	log.Warnf("Packages are not publishable, see %s\n", filepath.Base(path))
+	return path, nil
+}
@@ -0,0 +1,96 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAddDirtyUpdate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "package.yml")
+	if err := ioutil.WriteFile(path, []byte("name: nano\nversion: 2.7.5\nrelease: 69\n"), 00644); err != nil {
+		t.Fatalf("Failed to write recipe: %s", err)
+	}
+	committed := func(release int) *PackageUpdate {
+		return &PackageUpdate{Tag: "committed", Package: &Package{Name: "nano", Version: "2.7.5", Release: release}}
+	}
+	pkg := &Package{Name: "nano", Version: "2.7.5", Release: 69, Path: path}
+
+	history := &PackageHistory{Updates: []*PackageUpdate{committed(68)}, pkgfile: path}
+	if err := history.AddDirtyUpdate(pkg); err != nil {
+		t.Fatalf("Failed to add dirty update: %s", err)
+	}
+	if len(history.Updates) != 2 || history.Updates[0].Tag != DirtyHistoryTag {
+		t.Fatalf("Dirty update should be prepended to the history")
+	}
+	if !strings.Contains(history.Updates[0].Body, "not for official repositories") {
+		t.Fatalf("Dirty update isn't marked: %s", history.Updates[0].Body)
+	}
+
+	history = &PackageHistory{Updates: []*PackageUpdate{committed(69), committed(68)}, pkgfile: path}
+	if err := history.AddDirtyUpdate(pkg); err != nil {
+		t.Fatalf("Failed to add dirty update: %s", err)
+	}
+	if len(history.Updates) != 2 || history.Updates[0].Tag != DirtyHistoryTag {
+		t.Fatalf("Dirty update should replace the committed entry of the same release")
+	}
+}
+
+func TestRefuseDirty(t *testing.T) {
+	m := &Manager{pkg: &Package{Name: "nano"}, lock: &sync.Mutex{}}
+	if err := m.allowDirty(m.pkg, []string{"M package.yml"}); err != nil {
+		t.Fatalf("Uncommitted changes should only be refused by the build: %s", err)
+	}
+	if err := m.Build(); err != ErrDirtyRecipe {
+		t.Fatalf("Expected the build of uncommitted changes to be refused, got %v", err)
+	}
+}
+
+func TestUntrustedCommit(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) {
+		c := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		c.Dir = dir
+		if out, err := c.CombinedOutput(); err != nil {
+			t.Skipf("git is unusable: %s", out)
+		}
+	}
+	git("init", "-q")
+	git("commit", "-q", "--allow-empty", "-m", "Unsigned")
+	if err := VerifyCommit(dir, "HEAD"); err != ErrNotSigned {
+		t.Fatalf("Unsigned commit should fail with ErrNotSigned, got: %v", err)
+	}
+
+	pkg := &Package{Name: "nano", Version: "5.7", Release: 69, Untrusted: ErrNotSigned.Error()}
+	if !pkg.IsTainted() {
+		t.Fatalf("Package from an untrusted commit should be tainted")
+	}
+	path, err := pkg.writeTaint(dir)
+	if err != nil {
+		t.Fatalf("Failed to write taint: %s", err)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(b), "Recipe commit is not trusted: "+ErrNotSigned.Error()) {
+		t.Fatalf("Taint doesn't record the untrusted commit: %s", b)
+	}
+}
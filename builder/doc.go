@@ -0,0 +1,46 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package builder provides all the solbuild specific functionality.
+//
+// Builds are driven by a Manager, which must be set up in order:
+//
+//	manager, err := builder.NewManager()
+//	err = manager.SetProfile("main-x86_64")
+//	pkg, err := builder.NewPackage("package.yml")
+//	err = manager.SetPackage(pkg)
+//	err = manager.Build()
+//
+// A Manager owns a single build. Profiles select the backing image and
+// repositories, and an Overlay provides the copy-on-write root that each
+// build takes place in. Programs that handle signals themselves should
+// call Manager.SetSignalHandling(false), then SetCancelled and Cleanup on
+// shutdown. Errors are always returned rather than exiting the process.
+//
+// The configuration of a build is applied to package level settings by
+// Manager.Build, such as SizeCheck, PatchCheck and ActiveHooks, so only one
+// Manager may build at a time within a process. Programs running builds
+// concurrently should run each in its own solbuild process.
+//
+// Changelogs are generated by LoadPackageHistory, and rendered with
+// PackageHistory.Emit in any format registered as an Emitter.
+//
+// Harness runs end-to-end builds of fixture packages, allowing embedding
+// programs to test their integration.
+//
+// Fetching of package sources is implemented by the Source interface in
+// the source subpackage.
+package builder
@@ -0,0 +1,159 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrInvalidAssignment is returned when a --set expression isn't of the
+	// form key=value
+	ErrInvalidAssignment = errors.New("Assignment must be of the form key=value")
+
+	// ErrInvalidReplacement is returned when a --replace expression isn't of
+	// the form s/pattern/replacement/
+	ErrInvalidReplacement = errors.New("Replacement must be of the form s/pattern/replacement/")
+)
+
+// A RecipeAssignment sets a top level key within a package.yml to a new
+// scalar value.
+type RecipeAssignment struct {
+	Key   string
+	Value string
+}
+
+// A RecipeReplacement is a regex based substitution applied to the raw
+// text of a package.yml
+type RecipeReplacement struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// A RecipeEdit is a batch of changes to apply to one or more recipes.
+type RecipeEdit struct {
+	Assignments  []RecipeAssignment
+	Replacements []RecipeReplacement
+}
+
+// ParseRecipeAssignments will parse a ';' separated set of key=value pairs
+func ParseRecipeAssignments(expr string) ([]RecipeAssignment, error) {
+	var ret []RecipeAssignment
+	for _, part := range strings.Split(expr, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		splits := strings.SplitN(part, "=", 2)
+		if len(splits) != 2 || strings.TrimSpace(splits[0]) == "" {
+			return nil, ErrInvalidAssignment
+		}
+		ret = append(ret, RecipeAssignment{
+			Key:   strings.TrimSpace(splits[0]),
+			Value: strings.TrimSpace(splits[1]),
+		})
+	}
+	return ret, nil
+}
+
+// ParseRecipeReplacement will parse a sed style s/pattern/replacement/
+// expression. Any character following the 's' may be used as the delimiter.
+func ParseRecipeReplacement(expr string) (*RecipeReplacement, error) {
+	if len(expr) < 4 || expr[0] != 's' {
+		return nil, ErrInvalidReplacement
+	}
+	delim := string(expr[1])
+	splits := strings.Split(expr[2:], delim)
+	if len(splits) != 3 || splits[2] != "" {
+		return nil, ErrInvalidReplacement
+	}
+	re, err := regexp.Compile(splits[0])
+	if err != nil {
+		return nil, err
+	}
+	return &RecipeReplacement{Pattern: re, Replacement: splits[1]}, nil
+}
+
+// FindRecipe will return the package.yml for the given path, which may be
+// either the recipe itself or the directory containing it.
+func FindRecipe(path string) (string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !st.IsDir() {
+		return path, nil
+	}
+	recipe := filepath.Join(path, "package.yml")
+	if !PathExists(recipe) {
+		return "", fmt.Errorf("No package.yml found in %s", path)
+	}
+	return recipe, nil
+}
+
+// Apply will apply the edit to the recipe contents, returning the new
+// contents. Assignments are applied before replacements, and the layout
+// of the recipe is otherwise preserved.
+func (e *RecipeEdit) Apply(data []byte) ([]byte, error) {
+	doc, err := ParseYmlDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range e.Assignments {
+		doc.Set(a.Key, a.Value)
+	}
+	ret := doc.Bytes()
+	for _, r := range e.Replacements {
+		ret = r.Pattern.ReplaceAll(ret, []byte(r.Replacement))
+	}
+	return ret, nil
+}
+
+// ApplyToFile will apply the edit to the recipe on disk, returning whether
+// the file was changed. The result must still be a valid package.yml or it
+// will not be written.
+func (e *RecipeEdit) ApplyToFile(path string, dryRun bool) (bool, error) {
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	edited, err := e.Apply(orig)
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse recipe %s, reason: %s", path, err)
+	}
+	if bytes.Equal(orig, edited) {
+		return false, nil
+	}
+	if _, err := NewYmlPackageFromBytes(edited); err != nil {
+		return false, fmt.Errorf("Edit would produce an invalid recipe %s, reason: %s", path, err)
+	}
+	if dryRun {
+		return true, nil
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(path, edited, st.Mode())
+}
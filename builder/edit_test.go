@@ -0,0 +1,81 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+const (
+	editTestRecipe = `# Test recipe
+name       : nano
+version    : 2.9.8
+release    : 1
+source     :
+    - https://www.nano-editor.org/dist/v2.9/nano-2.9.8.tar.xz : c2deac31ba4d3fd27a42fafcc47ccf499296cc69a422bbecab63f2933ea85488
+summary    : Small, friendly text editor
+setup      : |
+    %configure
+`
+)
+
+func TestRecipeEdit(t *testing.T) {
+	if _, err := ParseRecipeAssignments("component"); err == nil {
+		t.Fatal("Parsed an assignment without a value")
+	}
+	if _, err := ParseRecipeReplacement("s/missing"); err == nil {
+		t.Fatal("Parsed an unterminated replacement")
+	}
+
+	e := &RecipeEdit{}
+	var err error
+	if e.Assignments, err = ParseRecipeAssignments("release=2; component=editor"); err != nil {
+		t.Fatalf("Failed to parse assignments: %v", err)
+	}
+	r, err := ParseRecipeReplacement("s|%configure|%configure --enable-utf8|")
+	if err != nil {
+		t.Fatalf("Failed to parse replacement: %v", err)
+	}
+	e.Replacements = append(e.Replacements, *r)
+
+	b, err := e.Apply([]byte(editTestRecipe))
+	if err != nil {
+		t.Fatalf("Failed to apply edit: %v", err)
+	}
+	out := string(b)
+	want := `# Test recipe
+name       : nano
+version    : 2.9.8
+release    : 2
+component  : editor
+source     :
+    - https://www.nano-editor.org/dist/v2.9/nano-2.9.8.tar.xz : c2deac31ba4d3fd27a42fafcc47ccf499296cc69a422bbecab63f2933ea85488
+summary    : Small, friendly text editor
+setup      : |
+    %configure --enable-utf8
+`
+	if out != want {
+		t.Fatalf("Unexpected edit result:\n%s", out)
+	}
+	pkg, err := NewYmlPackageFromBytes([]byte(out))
+	if err != nil {
+		t.Fatalf("Edited recipe no longer parses: %v", err)
+	}
+	if pkg.Release != 2 {
+		t.Fatalf("Wrong release after edit: %d", pkg.Release)
+	}
+}
@@ -0,0 +1,285 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder/source"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// EnvironmentLockFile is the name of the lockfile written alongside the
+	// build artifacts, and expected next to the recipe for locked builds.
+	EnvironmentLockFile = "solbuild.lock"
+
+	// EnvironmentLockVersion is the current format version of the lockfile
+	EnvironmentLockVersion = "1.0"
+
+	// ImageDigestSuffix is the suffix of the cached digest of an image
+	ImageDigestSuffix = ".sha256"
+)
+
+var (
+	// ErrEnvironmentChanged is returned when a locked build would take place
+	// in a different environment to the one recorded.
+	ErrEnvironmentChanged = errors.New("Build environment differs from the lockfile")
+)
+
+// EnvironmentLockHeader identifies the base of the build environment
+type EnvironmentLockHeader struct {
+	Version     string `toml:"version"`      // Format version
+	Profile     string `toml:"profile"`      // Name of the profile used
+	Image       string `toml:"image"`        // Name of the backing image
+	ImageSha256 string `toml:"image_sha256"` // Digest of the backing image
+	Recipe      string `toml:"recipe"`       // name-version-release of the recipe built
+	Commit      string `toml:"commit"`       // Git commit of the recipe, if any
+}
+
+// EnvironmentLockSource records the digest of a single source
+type EnvironmentLockSource struct {
+	URI    string `toml:"uri"`
+	Digest string `toml:"digest"`
+}
+
+// EnvironmentLockPackage records an exact package installed in the root
+type EnvironmentLockPackage struct {
+	Name    string `toml:"name"`
+	Version string `toml:"version"`
+	Release string `toml:"release"`
+}
+
+// An EnvironmentLock captures everything that went into a build root so
+// that the build can later be verified as having been performed in an
+// identical environment.
+type EnvironmentLock struct {
+	Lock    EnvironmentLockHeader    `toml:"lock"`
+	Source  []EnvironmentLockSource  `toml:"source"`
+	Package []EnvironmentLockPackage `toml:"package"`
+
+	expected *EnvironmentLock // Set when enforcing a previous lock
+}
+
+// NewEnvironmentLock will record the image and sources for the given build.
+// Packages are recorded later with ScanPackages once the root is populated.
+func NewEnvironmentLock(profile *Profile, image *BackingImage, pkg *Package) (*EnvironmentLock, error) {
+	hash, err := imageDigest(image.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	lock := &EnvironmentLock{
+		Lock: EnvironmentLockHeader{
+			Version:     EnvironmentLockVersion,
+			Profile:     profile.Name,
+			Image:       image.Name,
+			ImageSha256: hash,
+			Recipe:      fmt.Sprintf("%s-%s-%d", pkg.Name, pkg.Version, pkg.Release),
+			Commit:      recipeCommit(pkg),
+		},
+	}
+	for _, s := range pkg.Sources {
+		lock.Source = append(lock.Source, EnvironmentLockSource{
+			URI:    s.GetIdentifier(),
+			Digest: source.Digest(s),
+		})
+	}
+	return lock, nil
+}
+
+// imageDigest returns the sha256sum of the backing image. Hashing the whole
+// image for every build is slow, so the digest is cached alongside it, along
+// with the stamp of the image it was computed from.
+func imageDigest(path string) (string, error) {
+	stamp, err := imageStamp(path)
+	if err != nil {
+		return "", err
+	}
+	cachePath := path + ImageDigestSuffix
+	if b, err := ioutil.ReadFile(cachePath); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) == 3 && fields[0]+" "+fields[1] == stamp {
+			return fields[2], nil
+		}
+	}
+	log.Debugf("Computing digest of backing image %s\n", path)
+	hash, err := FileSha256sum(path)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(cachePath, []byte(stamp+" "+hash+"\n"), 00644); err != nil {
+		log.Warnf("Failed to cache digest of backing image %s, reason: %s\n", path, err)
+	}
+	return hash, nil
+}
+
+// LoadEnvironmentLock will load a previously written lockfile
+func LoadEnvironmentLock(path string) (*EnvironmentLock, error) {
+	lock := &EnvironmentLock{}
+	if _, err := toml.DecodeFile(path, lock); err != nil {
+		return nil, err
+	}
+	if lock.Lock.Version != EnvironmentLockVersion {
+		return nil, fmt.Errorf("Unsupported lockfile version: %s", lock.Lock.Version)
+	}
+	return lock, nil
+}
+
+// ScanPackages will record every package installed into the given root,
+// using the eopkg package database directly.
+func (l *EnvironmentLock) ScanPackages(root string) error {
+	pkgs, err := installedPackages(root)
+	if err != nil {
+		return err
+	}
+	l.Package = pkgs
+	return nil
+}
+
+// installedPackages will list every package installed into the given root,
+// sorted by name.
+func installedPackages(root string) ([]EnvironmentLockPackage, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(root, "var", "lib", "eopkg", "package"))
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []EnvironmentLockPackage
+	for _, d := range dirs {
+		// name-version-release, where name may itself contain dashes
+		splits := strings.Split(d.Name(), "-")
+		if !d.IsDir() || len(splits) < 3 {
+			continue
+		}
+		pkgs = append(pkgs, EnvironmentLockPackage{
+			Name:    strings.Join(splits[:len(splits)-2], "-"),
+			Version: splits[len(splits)-2],
+			Release: splits[len(splits)-1],
+		})
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].Name < pkgs[j].Name
+	})
+	return pkgs, nil
+}
+
+// Expect will cause Verify to enforce the given lock
+func (l *EnvironmentLock) Expect(expected *EnvironmentLock) {
+	l.expected = expected
+}
+
+// diffBase will describe differences in the image and sources
+func (l *EnvironmentLock) diffBase(other *EnvironmentLock) []string {
+	var diffs []string
+	if l.Lock.Image != other.Lock.Image || l.Lock.ImageSha256 != other.Lock.ImageSha256 {
+		diffs = append(diffs, fmt.Sprintf("image: %s (%s) != %s (%s)", l.Lock.Image, l.Lock.ImageSha256, other.Lock.Image, other.Lock.ImageSha256))
+	}
+	if len(l.Source) != len(other.Source) {
+		diffs = append(diffs, fmt.Sprintf("sources: %d != %d", len(l.Source), len(other.Source)))
+		return diffs
+	}
+	for i := range l.Source {
+		if l.Source[i] != other.Source[i] {
+			diffs = append(diffs, fmt.Sprintf("source: %s (%s) != %s (%s)", l.Source[i].URI, l.Source[i].Digest, other.Source[i].URI, other.Source[i].Digest))
+		}
+	}
+	return diffs
+}
+
+// diffPackages will describe differences in the installed packages
+func (l *EnvironmentLock) diffPackages(other *EnvironmentLock) []string {
+	var diffs []string
+	ours := make(map[string]EnvironmentLockPackage)
+	for _, p := range l.Package {
+		ours[p.Name] = p
+	}
+	for _, p := range other.Package {
+		o, ok := ours[p.Name]
+		delete(ours, p.Name)
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("package: %s-%s-%s is not installed", p.Name, p.Version, p.Release))
+		} else if o != p {
+			diffs = append(diffs, fmt.Sprintf("package: %s-%s-%s != %s-%s", p.Name, o.Version, o.Release, p.Version, p.Release))
+		}
+	}
+	for _, p := range ours {
+		diffs = append(diffs, fmt.Sprintf("package: %s-%s-%s was not locked", p.Name, p.Version, p.Release))
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// verifyLock will report all differences and return ErrEnvironmentChanged
+// if there were any.
+func verifyLock(diffs []string) error {
+	if len(diffs) == 0 {
+		return nil
+	}
+	for _, d := range diffs {
+		log.Errorf("Locked environment mismatch: %s\n", d)
+	}
+	return ErrEnvironmentChanged
+}
+
+// VerifyBase will ensure the image and sources match the expected lock
+func (l *EnvironmentLock) VerifyBase() error {
+	if l.expected == nil {
+		return nil
+	}
+	return verifyLock(l.diffBase(l.expected))
+}
+
+// VerifyPackages will ensure the installed packages match the expected lock
+func (l *EnvironmentLock) VerifyPackages() error {
+	if l.expected == nil {
+		return nil
+	}
+	return verifyLock(l.diffPackages(l.expected))
+}
+
+// Write will dump the lockfile to the given path
+func (l *EnvironmentLock) Write(path string) error {
+	blob := bytes.Buffer{}
+	tmenc := toml.NewEncoder(&blob)
+	tmenc.Indent = ""
+	if err := tmenc.Encode(l); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, blob.Bytes(), 00644)
+}
+
+// recipeCommit returns the git commit the recipe was built from, suffixed
+// with "-dirty" when uncommitted changes were included.
+func recipeCommit(pkg *Package) string {
+	commit, err := gitOutput(filepath.Dir(pkg.Path), "rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	if len(pkg.Changes) > 0 {
+		commit += "-dirty"
+	}
+	return commit
+}
+
+// GetEnvironmentLockPath returns the path of the lockfile for the recipe
+func GetEnvironmentLockPath(pkg *Package) string {
+	return filepath.Join(filepath.Dir(pkg.Path), EnvironmentLockFile)
+}
@@ -0,0 +1,56 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageDigestCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main-x86_64"+ImageSuffix)
+	writeTestFile(t, path, "image")
+	want, err := FileSha256sum(path)
+	if err != nil {
+		t.Fatalf("Failed to hash image: %s", err)
+	}
+	hash, err := imageDigest(path)
+	if err != nil || hash != want {
+		t.Fatalf("Expected digest %s, got %s (%v)", want, hash, err)
+	}
+
+	// The cached digest is used while the image is unchanged
+	stamp, err := imageStamp(path)
+	if err != nil {
+		t.Fatalf("Failed to stamp image: %s", err)
+	}
+	writeTestFile(t, path+ImageDigestSuffix, stamp+" cached\n")
+	if hash, _ := imageDigest(path); hash != "cached" {
+		t.Fatalf("Expected the cached digest, got %s", hash)
+	}
+
+	// Changing the image invalidates it
+	writeTestFile(t, path, "updated image")
+	want, _ = FileSha256sum(path)
+	if hash, _ := imageDigest(path); hash != want {
+		t.Fatalf("Expected digest %s of the changed image, got %s", want, hash)
+	}
+	if b, _ := ioutil.ReadFile(path + ImageDigestSuffix); len(b) == 0 {
+		t.Fatalf("Digest of the changed image wasn't cached")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -193,6 +194,35 @@ func (e *EopkgManager) Upgrade() error {
 	return err
 }
 
+// InstallLocal will install the given package files within the root
+func (e *EopkgManager) InstallLocal(packages []string) error {
+	err := ChrootExec(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg install -y %s", strings.Join(packages, " "))))
+	e.notif.SetActivePID(0)
+	return err
+}
+
+// ListUpgrades will refresh the repository indexes and return the names of
+// the packages that an upgrade would change.
+func (e *EopkgManager) ListUpgrades() ([]string, error) {
+	if err := ChrootExec(e.notif, e.root, eopkgCommand("eopkg update-repo")); err != nil {
+		return nil, err
+	}
+	e.notif.SetActivePID(0)
+	out, err := ChrootExecOutput(e.notif, e.root, eopkgCommand("eopkg list-upgrades"))
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 1 || strings.HasPrefix(line, "No packages") {
+			continue
+		}
+		pkgs = append(pkgs, fields[0])
+	}
+	return pkgs, nil
+}
+
 // InstallComponent will install the named component inside the chroot
 func (e *EopkgManager) InstallComponent(comp string) error {
 	err := ChrootExec(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg install -c %v -y", comp)))
@@ -302,3 +332,61 @@ func (e *EopkgManager) RemoveRepo(id string) error {
 	e.notif.SetActivePID(0)
 	return ChrootExec(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg remove-repo '%s'", id)))
 }
+
+var (
+	// eopkgOwnerRegex extracts the owning package from search-file output
+	eopkgOwnerRegex = regexp.MustCompile(`Package (\S+) has file`)
+)
+
+// SearchFile will return the name of the package owning the given path
+// within the root, or an empty string if nothing owns it.
+func (e *EopkgManager) SearchFile(path string) (string, error) {
+	out, err := ChrootExecOutput(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg search-file '%s'", path)))
+	if err != nil {
+		return "", err
+	}
+	match := eopkgOwnerRegex.FindStringSubmatch(out)
+	if match == nil {
+		return "", nil
+	}
+	return match[1], nil
+}
+
+// ListFiles will return the absolute paths of all files in the given
+// installed package.
+func (e *EopkgManager) ListFiles(pkg string) ([]string, error) {
+	out, err := ChrootExecOutput(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg list-files '%s'", pkg)))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Files in package") {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			line = "/" + line
+		}
+		files = append(files, line)
+	}
+	return files, nil
+}
+
+// ListInstalledComponent will return the names of all installed packages
+// belonging to the given component.
+func (e *EopkgManager) ListInstalledComponent(comp string) ([]string, error) {
+	out, err := ChrootExecOutput(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg list-installed -c '%s'", comp)))
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		pkgs = append(pkgs, fields[0])
+	}
+	return pkgs, nil
+}
@@ -0,0 +1,266 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrNothingToExplain is returned when a build log holds no failure
+	ErrNothingToExplain = errors.New("No failure found in the build log")
+
+	// ansiEscape matches the colour codes of a terminal log
+	ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+	// genericFailure matches any line reporting an otherwise unknown error
+	genericFailure = regexp.MustCompile(`(?i)\berror\b|\bfailed\b|reason:`)
+)
+
+// A Diagnosis is the human readable explanation of a failed build
+type Diagnosis struct {
+	Class       string // Kind of failure, i.e. "fetch" or "oom"
+	Stage       string // Stage of the build which failed
+	Cause       string // Log line the failure was recognised from
+	Line        int    // Number of that line in the log
+	Explanation string // Most likely cause of the failure
+	Next        string // Suggested command to continue with
+}
+
+// An explainRule recognises one class of failure from the messages that
+// solbuild and the tools it runs leave in the build log
+type explainRule struct {
+	class       string
+	stage       string
+	pattern     *regexp.Regexp
+	explanation string
+	next        string
+}
+
+// explainRules are in order of precedence, as a root cause such as running
+// out of memory is usually followed by the generic failure of the build.
+var explainRules = []explainRule{
+	{
+		class:       "interrupted",
+		pattern:     regexp.MustCompile(`Exiting due to interruption|cancelled by the user`),
+		explanation: "The build was interrupted before it could finish.",
+		next:        "solbuild build",
+	},
+	{
+		class:       "busy",
+		stage:       "setup",
+		pattern:     regexp.MustCompile(`Failed to lock root - another process`),
+		explanation: "Another solbuild process is using the same build root.",
+		next:        "Wait for the other build to finish, or run solbuild teardown",
+	},
+	{
+		class:       "timeout",
+		pattern:     regexp.MustCompile(`The build timed out after`),
+		explanation: "A phase of the build exceeded its time limit.",
+		next:        "solbuild build --timeout <duration>",
+	},
+	{
+		class:       "oom",
+		stage:       "build",
+		pattern:     regexp.MustCompile(`exceeding its memory limit|ran out of memory|Out of memory killed process`),
+		explanation: "The build was killed for using too much memory.",
+		next:        "solbuild build --memory-max <size>",
+	},
+	{
+		class:       "disk",
+		pattern:     regexp.MustCompile(`No space left on device`),
+		explanation: "The disk holding the build root or the caches is full.",
+		next:        "solbuild prune",
+	},
+	{
+		class:       "lock",
+		stage:       "setup",
+		pattern:     regexp.MustCompile(`Build environment differs from the lockfile|Locked environment mismatch`),
+		explanation: "The packages in the build root no longer match the environment lock.",
+		next:        "solbuild build without --locked to refresh solbuild.lock",
+	},
+	{
+		class:       "fetch",
+		stage:       "fetch",
+		pattern:     regexp.MustCompile(`Hash mismatch`),
+		explanation: "A source was downloaded but doesn't match the hash in the recipe.",
+		next:        "solbuild check-sources",
+	},
+	{
+		class:       "network",
+		pattern:     regexp.MustCompile(`Could not resolve host|Network is unreachable|Connection timed out`),
+		explanation: "A host could not be reached over the network.",
+		next:        "Check the network connection and proxy settings, then solbuild build",
+	},
+	{
+		class:       "fetch",
+		stage:       "fetch",
+		pattern:     regexp.MustCompile(`Failed to fetch source`),
+		explanation: "A source of the recipe could not be downloaded.",
+		next:        "solbuild check-sources",
+	},
+	{
+		class:       "patch",
+		stage:       "patch check",
+		pattern:     regexp.MustCompile(`does not apply with fuzz|Recipe failed the patch checks`),
+		explanation: "A patch no longer applies cleanly to the sources.",
+		next:        "Rebase the patch, then solbuild build --check-patches",
+	},
+	{
+		class:       "dependencies",
+		stage:       "setup",
+		pattern:     regexp.MustCompile(`Failed to install build dependencies`),
+		explanation: "The build dependencies of the recipe could not be installed.",
+		next:        "solbuild update, then check the builddeps of the recipe",
+	},
+	{
+		class:       "promotion",
+		stage:       "setup",
+		pattern:     regexp.MustCompile(`Packages built earlier in the stack weren't installed`),
+		explanation: "Packages built earlier in the stack were not the ones installed.",
+		next:        "solbuild build --promote strict-local",
+	},
+	{
+		class:       "install test",
+		stage:       "install test",
+		pattern:     regexp.MustCompile(`Test script of the built packages failed|Built packages failed to install`),
+		explanation: "The built packages failed to install or their test script failed.",
+		next:        "solbuild build --keep-root 1h, then solbuild chroot",
+	},
+	{
+		class:       "abi",
+		stage:       "abi check",
+		pattern:     regexp.MustCompile(`Package breaks the ABI`),
+		explanation: "The package removed symbols or libraries of the previous release.",
+		next:        "Bump the soname or rebuild the reverse dependencies",
+	},
+	{
+		class:       "size",
+		stage:       "size check",
+		pattern:     regexp.MustCompile(`Packages grew beyond the size growth limit`),
+		explanation: "The built packages grew beyond the configured size growth limit.",
+		next:        "solbuild pkgdiff",
+	},
+	{
+		class:       "build",
+		stage:       "build",
+		pattern:     regexp.MustCompile(`Failed to start build of package`),
+		explanation: "The build of the recipe itself failed, see the lines above the cause.",
+		next:        "solbuild build --keep-root 1h, then solbuild chroot",
+	},
+}
+
+// explainStages are the log messages marking the start of a stage
+var explainStages = []struct {
+	pattern *regexp.Regexp
+	stage   string
+}{
+	{regexp.MustCompile(`Failed to fetch source|Hash mismatch`), "fetch"},
+	{regexp.MustCompile(`Now starting build of package`), "build"},
+}
+
+// ExplainLog reads a build log and diagnoses why the build failed
+func ExplainLog(r io.Reader) (*Diagnosis, error) {
+	var (
+		best     = len(explainRules)
+		found    *Diagnosis
+		fallback *Diagnosis
+		stage    = "setup"
+		number   = 0
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(ansiEscape.ReplaceAllString(scanner.Text(), ""))
+		// Logs written with --log-format=json carry the phase themselves
+		var event LogEvent
+		if strings.HasPrefix(line, "{") && json.Unmarshal([]byte(line), &event) == nil {
+			line = event.Message
+			if event.Phase != "" {
+				stage = event.Phase
+			}
+		}
+		for _, marker := range explainStages {
+			if marker.pattern.MatchString(line) {
+				stage = marker.stage
+			}
+		}
+		for i := 0; i < best; i++ {
+			rule := explainRules[i]
+			if !rule.pattern.MatchString(line) {
+				continue
+			}
+			found = &Diagnosis{
+				Class:       rule.class,
+				Stage:       rule.stage,
+				Cause:       line,
+				Line:        number,
+				Explanation: rule.explanation,
+				Next:        rule.next,
+			}
+			if found.Stage == "" {
+				found.Stage = stage
+			}
+			best = i
+			break
+		}
+		if genericFailure.MatchString(line) {
+			fallback = &Diagnosis{
+				Class:       "unknown",
+				Stage:       stage,
+				Cause:       line,
+				Line:        number,
+				Explanation: "The failure wasn't recognised, the last error is shown.",
+				Next:        "solbuild build --debug",
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read the build log, reason: %s\n", err)
+	}
+	if found != nil {
+		return found, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, ErrNothingToExplain
+}
+
+// FindBuildLog resolves the log of a build, given either the path to a log
+// or the ID of a build carried out by the worker
+func FindBuildLog(arg, workerDir string) (string, error) {
+	if PathExists(arg) {
+		return arg, nil
+	}
+	if !strings.ContainsRune(arg, os.PathSeparator) {
+		path := filepath.Join(workerDir, arg, "build.log")
+		if PathExists(path) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("No build log found for %s", arg)
+}
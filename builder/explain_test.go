@@ -0,0 +1,75 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExplainLog(t *testing.T) {
+	oom := strings.Join([]string{
+		"[i] Now starting build of package nano",
+		"\x1b[31m[✗] Build was killed after exceeding its memory limit of 4096 MiB\x1b[0m",
+		"[✗] Failed to start build of package.",
+	}, "\n")
+	d, err := ExplainLog(strings.NewReader(oom))
+	if err != nil {
+		t.Fatalf("Failed to explain the log: %s", err)
+	}
+	if d.Class != "oom" || d.Stage != "build" || d.Line != 2 {
+		t.Errorf("Expected the memory limit to be the cause, got %+v", d)
+	}
+	if strings.Contains(d.Cause, "\x1b") {
+		t.Errorf("Expected colour codes to be stripped, got %q", d.Cause)
+	}
+
+	d, err = ExplainLog(strings.NewReader("[✗] Failed to fetch source foo.tar.xz, reason: Hash mismatch for foo.tar.xz"))
+	if err != nil || d.Class != "fetch" || d.Stage != "fetch" {
+		t.Errorf("Expected a fetch failure, got %+v %v", d, err)
+	}
+
+	d, err = ExplainLog(strings.NewReader("[i] Now starting build of package nano\n[✗] something failed\n"))
+	if err != nil || d.Class != "unknown" || d.Stage != "build" {
+		t.Errorf("Expected an unknown failure during the build, got %+v %v", d, err)
+	}
+
+	d, err = ExplainLog(strings.NewReader(`{"severity":"error","phase":"setup","message":"Failed to install build dependencies nano"}`))
+	if err != nil || d.Class != "dependencies" || d.Cause != "Failed to install build dependencies nano" {
+		t.Errorf("Expected a JSON log to be explained, got %+v %v", d, err)
+	}
+
+	if _, err := ExplainLog(strings.NewReader("[✓] Building succeeded\n")); err != ErrNothingToExplain {
+		t.Errorf("Expected nothing to explain, got %v", err)
+	}
+}
+
+func TestFindBuildLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1234", "build.log")
+	writeTestFile(t, path, "")
+	if found, err := FindBuildLog("1234", dir); err != nil || found != path {
+		t.Errorf("Expected %s, got %s %v", path, found, err)
+	}
+	if found, err := FindBuildLog(path, ""); err != nil || found != path {
+		t.Errorf("Expected the path itself, got %s %v", found, err)
+	}
+	if _, err := FindBuildLog("missing", dir); err == nil {
+		t.Errorf("Expected a missing build to fail")
+	}
+}
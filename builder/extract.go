@@ -0,0 +1,201 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder/source"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExtractedSourceDir holds the extracted trees of source archives, named by
+// the digest of the archive
+const ExtractedSourceDir = "/var/lib/solbuild/sources/extracted"
+
+var (
+	// ExtractThreads is the number of threads source archives are
+	// decompressed with, with 0 leaving the decompressors single threaded
+	ExtractThreads int
+
+	// ExtractCache keeps the trees of the source archives unpacked on the
+	// host by patch checks, so that later checks needn't extract them again.
+	// ypkg still extracts the sources within the build root.
+	ExtractCache bool
+
+	// ErrInvalidExtractThreads is returned for a negative thread count
+	ErrInvalidExtractThreads = errors.New("Extraction threads can't be negative")
+)
+
+// hasSuffix determines whether the name ends with any of the suffixes
+func hasSuffix(name string, suffixes ...string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressCommand returns the command decompressing the archive from stdin
+// to stdout with the threads, preferring the parallel decompressors found on
+// the host. It returns nil when tar should decompress the archive itself.
+func decompressCommand(archive string, threads int) []string {
+	if threads < 1 {
+		return nil
+	}
+	n := strconv.Itoa(threads)
+	var candidates [][]string
+	switch name := strings.ToLower(archive); {
+	case hasSuffix(name, ".tar.xz", ".txz"):
+		candidates = [][]string{{"pixz", "-d", "-p", n}, {"xz", "-d", "-c", "-T" + n}}
+	case hasSuffix(name, ".tar.zst", ".tzst"):
+		candidates = [][]string{{"zstd", "-d", "-c", "-T" + n}}
+	case hasSuffix(name, ".tar.gz", ".tgz"):
+		candidates = [][]string{{"pigz", "-d", "-c", "-p", n}, {"gzip", "-d", "-c"}}
+	case hasSuffix(name, ".tar.bz2", ".tbz2"):
+		candidates = [][]string{{"lbzip2", "-d", "-c", "-n", n}, {"pbzip2", "-d", "-c", "-p" + n}, {"bzip2", "-d", "-c"}}
+	}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate[0]); err == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// extractArchive will extract the archive into dir, piping it through
+// a parallel decompressor when ExtractThreads is set. The contents of the
+// archive are untrusted, so only the build user unpacks them.
+func extractArchive(archive, dir string) error {
+	name := filepath.Base(archive)
+	if err := chownBuildUser(dir); err != nil {
+		return err
+	}
+	in, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	argv := decompressCommand(archive, ExtractThreads)
+	if argv == nil {
+		// The archive is given as a file so that tar detects the compression
+		tar := buildUserCommand("tar", "-xf", "/dev/stdin", "-C", dir)
+		tar.Stdin = in
+		if out, err := tar.CombinedOutput(); err != nil {
+			return fmt.Errorf("Failed to unpack %s, reason: %s", name, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	log.Debugf("Decompressing %s with %s\n", name, strings.Join(argv, " "))
+	var decErr, tarErr bytes.Buffer
+	dec := buildUserCommand(argv[0], argv[1:]...)
+	dec.Stdin = in
+	dec.Stderr = &decErr
+	tar := buildUserCommand("tar", "-xf", "-", "-C", dir)
+	tar.Stderr = &tarErr
+	if tar.Stdin, err = dec.StdoutPipe(); err != nil {
+		return err
+	}
+	if err := dec.Start(); err != nil {
+		return fmt.Errorf("Failed to run %s, reason: %s", argv[0], err)
+	}
+	if err := tar.Run(); err != nil {
+		dec.Process.Kill()
+		dec.Wait()
+		return fmt.Errorf("Failed to unpack %s, reason: %s", name, strings.TrimSpace(tarErr.String()))
+	}
+	if err := dec.Wait(); err != nil {
+		return fmt.Errorf("Failed to decompress %s, reason: %s", name, strings.TrimSpace(decErr.String()))
+	}
+	return nil
+}
+
+// extractedTree returns where the extracted tree of the source is cached,
+// or an empty string for sources without a digest of their contents.
+func extractedTree(src source.Source) string {
+	switch alg, digest := source.ResolvedDigest(src); alg {
+	case "sha256", "sha1":
+		return filepath.Join(ExtractedSourceDir, digest)
+	}
+	return ""
+}
+
+// unpackSource will extract the source archive into dir, reporting how long
+// it took. With ExtractCache, the tree is extracted once into
+// ExtractedSourceDir and copied from there by later builds.
+func unpackSource(src source.Source, dir string) error {
+	origin := src.GetBindConfiguration("").BindSource
+	name := filepath.Base(origin)
+	cached := ""
+	if ExtractCache {
+		cached = extractedTree(src)
+	}
+	if cached != "" && PathExists(cached) {
+		log.Debugf("Using the extracted tree of %s\n", name)
+		return copyTree(cached, dir)
+	}
+
+	start := time.Now()
+	target := dir
+	if cached != "" {
+		target = cached + ".partial"
+		os.RemoveAll(target)
+		if err := os.MkdirAll(target, 00755); err != nil {
+			return err
+		}
+		defer os.RemoveAll(target)
+	}
+	if err := extractArchive(origin, target); err != nil {
+		return err
+	}
+	log.Infof("Extracted %s in %s\n", name, time.Since(start).Round(time.Millisecond))
+	if cached == "" {
+		return nil
+	}
+	if err := os.Rename(target, cached); err != nil {
+		return fmt.Errorf("Failed to cache the extracted tree of %s, reason: %s", name, err)
+	}
+	return copyTree(cached, dir)
+}
+
+// copyTree will copy the contents of the directory src into dst, sharing
+// the extents of the files where the filesystem allows it
+func copyTree(src, dst string) error {
+	c := buildUserCommand("cp", "-a", "--reflink=auto", src+"/.", dst)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to copy %s, reason: %s", src, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// extractEnvironment returns the chroot environment that lets xz decompress
+// the sources extracted by ypkg with the threads. The threads packages are
+// compressed with take precedence, as xz takes both from XZ_DEFAULTS.
+func extractEnvironment() []string {
+	if ExtractThreads < 1 || (PackageCompression != nil && PackageCompression.Threads > 0) {
+		return nil
+	}
+	return []string{fmt.Sprintf("XZ_DEFAULTS=-T%d", ExtractThreads)}
+}
@@ -0,0 +1,85 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractArchive(t *testing.T) {
+	// The build user unpacks the archive, so must reach the output
+	dir := t.TempDir()
+	if err := os.Chmod(filepath.Dir(dir), 00755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "nano-7.2.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	content := []byte("int main() {}\n")
+	tw.WriteHeader(&tar.Header{Name: "nano-7.2/main.c", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write(content)
+	tw.Close()
+	zw.Close()
+	f.Close()
+
+	defer func() { ExtractThreads = 0 }()
+	for _, threads := range []int{0, 2} {
+		ExtractThreads = threads
+		out := filepath.Join(dir, fmt.Sprintf("out-%d", threads))
+		if err := os.MkdirAll(out, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := extractArchive(archive, out); err != nil {
+			t.Fatalf("Failed to extract with %d threads: %v", threads, err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(out, "nano-7.2", "main.c")); err != nil || string(b) != string(content) {
+			t.Errorf("Unexpected extraction with %d threads: %q %v", threads, b, err)
+		}
+	}
+
+	if argv := decompressCommand("nano-7.2.tar.gz", 1); len(argv) == 0 {
+		t.Error("Expected gzip archives to be decompressed separately")
+	}
+	if argv := decompressCommand("nano-7.2.zip", 4); argv != nil {
+		t.Errorf("Expected tar to handle unknown archives, got %v", argv)
+	}
+	if argv := decompressCommand("nano-7.2.tar.gz", 0); argv != nil {
+		t.Errorf("Expected no decompressor without threads, got %v", argv)
+	}
+}
+
+func TestExtractEnvironment(t *testing.T) {
+	defer func() { ExtractThreads, PackageCompression = 0, nil }()
+	ExtractThreads = 4
+	if env := extractEnvironment(); len(env) != 1 || env[0] != "XZ_DEFAULTS=-T4" {
+		t.Errorf("Unexpected environment %v", env)
+	}
+	PackageCompression = &Compression{Threads: 2}
+	if env := extractEnvironment(); env != nil {
+		t.Errorf("Expected the compression threads to take precedence, got %v", env)
+	}
+}
@@ -0,0 +1,135 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// ImageGenerationSuffix is the suffix of the generation record of an image
+	ImageGenerationSuffix = ".generation"
+)
+
+// An ImageGeneration records the state of a backing image after an update
+// changed it, and the packages that update changed.
+type ImageGeneration struct {
+	Generation int       `json:"generation"`         // Increased by every update that changes the image
+	Updated    time.Time `json:"updated"`            // When the update took place
+	Packages   int       `json:"packages"`           // Number of packages installed
+	Digest     string    `json:"digest"`             // Digest of the installed name-version-release list
+	Added      []string  `json:"added,omitempty"`    // Packages installed by the update
+	Upgraded   []string  `json:"upgraded,omitempty"` // Packages changing version or release
+	Removed    []string  `json:"removed,omitempty"`  // Packages removed by the update
+}
+
+// GenerationPath returns the path of the generation record of the image
+func (b *BackingImage) GenerationPath() string {
+	return filepath.Join(ImagesDir, b.Name+ImageGenerationSuffix)
+}
+
+// LoadImageGeneration will load the generation record of the image, which is
+// nil for images never updated since it was recorded.
+func LoadImageGeneration(b *BackingImage) (*ImageGeneration, error) {
+	g, err := loadGeneration(b.GenerationPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return g, err
+}
+
+// NewImageGeneration will record the generation following the previous one,
+// which may be nil, from the packages installed before and after the update.
+func NewImageGeneration(previous *ImageGeneration, before, after []EnvironmentLockPackage) *ImageGeneration {
+	g := &ImageGeneration{
+		Generation: 1,
+		Updated:    time.Now().UTC(),
+		Packages:   len(after),
+		Digest:     packagesDigest(after),
+	}
+	if previous != nil {
+		g.Generation = previous.Generation + 1
+	}
+	old := make(map[string]EnvironmentLockPackage)
+	for _, pkg := range before {
+		old[pkg.Name] = pkg
+	}
+	for _, pkg := range after {
+		prev, ok := old[pkg.Name]
+		switch {
+		case !ok:
+			g.Added = append(g.Added, packageID(pkg))
+		case prev != pkg:
+			g.Upgraded = append(g.Upgraded, fmt.Sprintf("%s -> %s-%s", packageID(prev), pkg.Version, pkg.Release))
+		}
+		delete(old, pkg.Name)
+	}
+	for _, pkg := range old {
+		g.Removed = append(g.Removed, packageID(pkg))
+	}
+	sort.Strings(g.Removed)
+	return g
+}
+
+// Save will write the generation record of the image
+func (g *ImageGeneration) Save(b *BackingImage) error {
+	return g.save(b.GenerationPath())
+}
+
+// save will write the generation record to the given path
+func (g *ImageGeneration) save(path string) error {
+	data, err := json.MarshalIndent(g, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 00644)
+}
+
+// loadGeneration will load the generation record at the given path
+func loadGeneration(path string) (*ImageGeneration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &ImageGeneration{}
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, reason: %s", path, err)
+	}
+	return g, nil
+}
+
+// packageID returns the name-version-release of the package
+func packageID(pkg EnvironmentLockPackage) string {
+	return fmt.Sprintf("%s-%s-%s", pkg.Name, pkg.Version, pkg.Release)
+}
+
+// packagesDigest identifies the set of installed packages
+func packagesDigest(pkgs []EnvironmentLockPackage) string {
+	h := sha256.New()
+	for _, pkg := range pkgs {
+		fmt.Fprintln(h, packageID(pkg))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,56 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewImageGeneration(t *testing.T) {
+	before := []EnvironmentLockPackage{
+		{Name: "bash", Version: "5.1", Release: "10"},
+		{Name: "nano", Version: "5.7", Release: "1"},
+		{Name: "python", Version: "2.7.18", Release: "5"},
+	}
+	after := []EnvironmentLockPackage{
+		{Name: "bash", Version: "5.1", Release: "10"},
+		{Name: "nano", Version: "5.8", Release: "2"},
+		{Name: "zstd", Version: "1.5.0", Release: "3"},
+	}
+	g := NewImageGeneration(nil, before, after)
+	if g.Generation != 1 || g.Packages != 3 {
+		t.Fatalf("Expected generation 1 with 3 packages, got: %+v", g)
+	}
+	if !reflect.DeepEqual(g.Added, []string{"zstd-1.5.0-3"}) {
+		t.Errorf("Incorrect added packages: %v", g.Added)
+	}
+	if !reflect.DeepEqual(g.Upgraded, []string{"nano-5.7-1 -> 5.8-2"}) {
+		t.Errorf("Incorrect upgraded packages: %v", g.Upgraded)
+	}
+	if !reflect.DeepEqual(g.Removed, []string{"python-2.7.18-5"}) {
+		t.Errorf("Incorrect removed packages: %v", g.Removed)
+	}
+
+	next := NewImageGeneration(g, after, after)
+	if next.Generation != 2 || len(next.Added)+len(next.Upgraded)+len(next.Removed) != 0 {
+		t.Fatalf("Expected generation 2 without changes, got: %+v", next)
+	}
+	if next.Digest != g.Digest || next.Digest == packagesDigest(before) {
+		t.Fatalf("Digest should only depend on the installed packages")
+	}
+}
@@ -0,0 +1,295 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// HarnessProfile is the name of the profile generated by the Harness
+	HarnessProfile = "solbuild-selftest"
+
+	// HarnessRepo is the name of the local repository used by the Harness
+	HarnessRepo = "SelfTest"
+
+	// harnessSourceName is the name of the fixture source archive
+	harnessSourceName = "solbuild-selftest-1.0"
+)
+
+// A HarnessFixture is a package recipe built by the Harness. The recipe is
+// a format string, receiving the URI and sha256sum of the fixture sources.
+type HarnessFixture struct {
+	Name   string
+	Recipe string
+}
+
+// HarnessFixtures are the stock fixtures used by `solbuild selftest`. The
+// second fixture depends on the first, exercising the local repository.
+var HarnessFixtures = []HarnessFixture{
+	{
+		Name: "solbuild-selftest-hello",
+		Recipe: `name       : solbuild-selftest-hello
+version    : 1.0
+release    : 1
+source     :
+    - %s : %s
+license    : Apache-2.0
+component  : programming
+summary    : solbuild self test fixture
+description: |
+    A trivial package built by solbuild selftest.
+install    : |
+    install -Dm00755 hello $installdir/usr/bin/solbuild-selftest-hello
+`,
+	},
+	{
+		Name: "solbuild-selftest-greeting",
+		Recipe: `name       : solbuild-selftest-greeting
+version    : 1.0
+release    : 1
+source     :
+    - %s : %s
+license    : Apache-2.0
+component  : programming
+summary    : solbuild self test fixture
+description: |
+    A package built by solbuild selftest using a dependency from the local repository.
+builddeps  :
+    - solbuild-selftest-hello
+install    : |
+    solbuild-selftest-hello > greeting
+    install -Dm00644 greeting $installdir/usr/share/solbuild-selftest/greeting
+`,
+	},
+}
+
+// harnessScript is the program shipped in the fixture sources
+const harnessScript = "#!/bin/sh\necho 'Hello from solbuild'\n"
+
+// A Harness runs end-to-end builds of fixture packages with a generated
+// profile and an empty local repository, isolated within a scratch
+// directory. It allows distributions embedding the builder package to test
+// their integrations. Building requires root and an installed base image,
+// which is only ever mounted read-only beneath the build overlay.
+type Harness struct {
+	Dir       string // Scratch directory for all harness state
+	Image     string // Installed base image to build against
+	RepoDir   string // Local repository that built packages are added to
+	OutputDir string // Where each build collects its packages
+
+	sourceURI  string
+	sourceHash string
+	configDir  string
+	oldPaths   []string
+}
+
+// NewHarness will prepare a new harness in a scratch directory, building
+// against the named base image.
+func NewHarness(image string) (*Harness, error) {
+	if !IsValidImage(image) {
+		return nil, ErrInvalidImage
+	}
+	if !NewBackingImage(image).IsInstalled() {
+		return nil, ErrProfileNotInstalled
+	}
+	dir, err := ioutil.TempDir("", "solbuild-selftest-")
+	if err != nil {
+		return nil, err
+	}
+	h := &Harness{
+		Dir:       dir,
+		Image:     image,
+		RepoDir:   filepath.Join(dir, "repo"),
+		OutputDir: filepath.Join(dir, "output"),
+		configDir: filepath.Join(dir, "config"),
+	}
+	for _, d := range []string{h.RepoDir, h.OutputDir, h.configDir} {
+		if err := os.MkdirAll(d, 00755); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+	if err := h.writeProfile(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if err := h.writeSources(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	// Make our profile visible ahead of the system ones
+	h.oldPaths = ConfigPaths
+	ConfigPaths = append([]string{h.configDir}, ConfigPaths...)
+	return h, nil
+}
+
+// writeProfile will generate the harness profile
+func (h *Harness) writeProfile() error {
+	profile := fmt.Sprintf(`image = %q
+add_repos = [%q]
+
+[repo.%s]
+uri = %q
+local = true
+autoindex = true
+`, h.Image, HarnessRepo, HarnessRepo, h.RepoDir)
+	return ioutil.WriteFile(filepath.Join(h.configDir, HarnessProfile+ProfileSuffix), []byte(profile), 00644)
+}
+
+// writeSources will create the source archive shared by the fixtures
+func (h *Harness) writeSources() error {
+	path := filepath.Join(h.Dir, harnessSourceName+".tar.gz")
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(fi)
+	tw := tar.NewWriter(gz)
+	hdr := &tar.Header{
+		Name:    harnessSourceName + "/hello",
+		Mode:    00755,
+		Size:    int64(len(harnessScript)),
+		ModTime: time.Unix(0, 0),
+	}
+	err = tw.WriteHeader(hdr)
+	if err == nil {
+		_, err = tw.Write([]byte(harnessScript))
+	}
+	for _, closer := range []interface{ Close() error }{tw, gz, fi} {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if h.sourceHash, err = FileSha256sum(path); err != nil {
+		return err
+	}
+	h.sourceURI = "file://" + path
+	return nil
+}
+
+// AddFixture will write the fixture recipe into the scratch directory and
+// return the path of its package.yml
+func (h *Harness) AddFixture(fixture HarnessFixture) (string, error) {
+	dir := filepath.Join(h.Dir, "fixtures", fixture.Name)
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "package.yml")
+	recipe := fmt.Sprintf(fixture.Recipe, h.sourceURI, h.sourceHash)
+	return path, ioutil.WriteFile(path, []byte(recipe), 00644)
+}
+
+// Build will build the package recipe with the harness profile, returning
+// the resulting packages. These are also added to the local repository so
+// that later builds may depend upon them.
+func (h *Harness) Build(pkgfile string) ([]string, error) {
+	outDir := filepath.Join(h.OutputDir, filepath.Base(filepath.Dir(pkgfile)))
+	if err := os.MkdirAll(outDir, 00755); err != nil {
+		return nil, err
+	}
+
+	manager, err := NewManager()
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.SetProfile(HarnessProfile); err != nil {
+		return nil, err
+	}
+	pkg, err := NewPackage(pkgfile)
+	if err != nil {
+		return nil, err
+	}
+	if err := manager.SetPackage(pkg); err != nil {
+		return nil, err
+	}
+
+	// Assets are always collected into the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chdir(outDir); err != nil {
+		return nil, err
+	}
+	err = manager.Build()
+	if cerr := os.Chdir(wd); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	packages, _ := filepath.Glob(filepath.Join(outDir, "*.eopkg"))
+	if len(packages) < 1 {
+		return nil, errors.New("Build completed without producing packages")
+	}
+	for _, p := range packages {
+		if err := disk.CopyFile(p, filepath.Join(h.RepoDir, filepath.Base(p))); err != nil {
+			return nil, err
+		}
+	}
+	return packages, nil
+}
+
+// Run will build each of the fixtures in order, stopping at the first
+// failure.
+func (h *Harness) Run(fixtures []HarnessFixture) error {
+	for _, fixture := range fixtures {
+		pkgfile, err := h.AddFixture(fixture)
+		if err != nil {
+			return err
+		}
+		log.Infof("Building fixture %s\n", fixture.Name)
+		packages, err := h.Build(pkgfile)
+		if err != nil {
+			return fmt.Errorf("Fixture %s failed, reason: %s\n", fixture.Name, err)
+		}
+		for _, p := range packages {
+			log.Infof("Built %s\n", filepath.Base(p))
+		}
+	}
+	return nil
+}
+
+// Close will restore the configuration paths and remove the scratch
+// directory.
+func (h *Harness) Close() error {
+	h.Release()
+	return os.RemoveAll(h.Dir)
+}
+
+// Release will restore the configuration paths, leaving the scratch
+// directory in place for inspection.
+func (h *Harness) Release() {
+	if h.oldPaths != nil {
+		ConfigPaths = h.oldPaths
+		h.oldPaths = nil
+	}
+}
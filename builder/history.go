@@ -19,20 +19,24 @@ package builder
 import (
 	"encoding/xml"
 	"errors"
-	"fmt"
+	log "github.com/DataDrake/waterlog"
 	git "github.com/libgit2/git2go/v34"
-	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
 	"time"
 )
 
 const (
-	// MaxChangelogEntries is the absolute maximum number of entries we'll
+	// MaxChangelogEntries is the default maximum number of entries we'll
 	// parse and provide changelog entries for.
 	MaxChangelogEntries = 10
 
+	// UnlimitedChangelogEntries will include the entire history of the
+	// package in the changelog.
+	UnlimitedChangelogEntries = -1
+
 	// UpdateDateFormat is the time format we emit in the history.xml, i.e.
 	// 2016-09-24
 	UpdateDateFormat = "2006-01-02"
@@ -42,10 +46,31 @@ var (
 	// CveRegex is used to identify security updates which mention a specific
 	// CVE ID.
 	CveRegex *regexp.Regexp
+
+	// TrailerRegex is used to identify a single git trailer line, i.e.
+	// `Update-Type: security`
+	TrailerRegex *regexp.Regexp
+
+	// UpdateTypes are the update types which may be set with the
+	// Update-Type trailer
+	UpdateTypes = map[string]bool{
+		"security":    true,
+		"recommended": true,
+		"enhancement": true,
+	}
+)
+
+const (
+	// UpdateTypeTrailer explicitly sets the type of the update
+	UpdateTypeTrailer = "update-type"
+
+	// RequiresRebootTrailer marks the update as requiring a reboot
+	RequiresRebootTrailer = "requires-reboot"
 )
 
 func init() {
 	CveRegex = regexp.MustCompile(`(CVE\-[0-9]+\-[0-9]+)`)
+	TrailerRegex = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*):\s*(.*)$`)
 }
 
 // PackageHistory is an automatic changelog generated from the changes to
@@ -72,14 +97,21 @@ type PackageHistory struct {
 // A PackageUpdate is a point in history in the git changes, which is parsed
 // from a git.Commit
 type PackageUpdate struct {
-	Tag         string    // The associated git tag
-	Author      string    // The author name of the change
-	AuthorEmail string    // The author email of the change
-	Body        string    // The associated message of the commit
-	Time        time.Time // When the update took place
-	ObjectID    string    // OID stored in string form
-	Package     *Package  // Associated parsed package
-	IsSecurity  bool      // Whether this is a security update
+	Tag            string    // The associated git tag
+	Author         string    // The author name of the change
+	AuthorEmail    string    // The author email of the change
+	Body           string    // The associated message of the commit
+	Time           time.Time // When the update took place
+	ObjectID       string    // OID stored in string form
+	Package        *Package  // Associated parsed package
+	IsSecurity     bool      // Whether this is a security update
+	Type           string    // Explicit update type, if any
+	RequiresReboot bool      // Whether the user must reboot after updating
+	Signed         bool      // Whether the tag carries a signature
+	Verified       bool      // Whether the signature is good and from a trusted key
+	CVEs           []CVEInfo // Enriched CVE information, if looked up
+
+	unusable bool // package.yml at this tag couldn't be parsed
 }
 
 // NewPackageUpdate will attempt to parse the given commit and provide a usable
@@ -102,9 +134,44 @@ func NewPackageUpdate(tag string, commit *git.Commit, objectID string) *PackageU
 		update.IsSecurity = true
 	}
 
+	// Trailers take precedence, giving the maintainer the final say
+	trailers := ParseTrailers(update.Body)
+	if updateType, ok := trailers[UpdateTypeTrailer]; ok {
+		updateType = strings.ToLower(updateType)
+		if UpdateTypes[updateType] {
+			update.Type = updateType
+			update.IsSecurity = updateType == "security"
+		} else {
+			log.Warnf("Ignoring unknown update type '%s' in %s\n", updateType, tag)
+		}
+	}
+	switch strings.ToLower(trailers[RequiresRebootTrailer]) {
+	case "yes", "true":
+		update.RequiresReboot = true
+	}
+
 	return update
 }
 
+// ParseTrailers will return the git trailers from the final paragraph of the
+// commit message, keyed by their lower case name.
+func ParseTrailers(message string) map[string]string {
+	trailers := make(map[string]string)
+	paragraphs := strings.Split(strings.TrimSpace(message), "\n\n")
+	if len(paragraphs) < 2 {
+		return trailers
+	}
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		match := TrailerRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			// Not a trailer block at all
+			return make(map[string]string)
+		}
+		trailers[strings.ToLower(match[1])] = strings.TrimSpace(match[2])
+	}
+	return trailers
+}
+
 // CatGitBlob will return the contents of the given entry
 func CatGitBlob(repo *git.Repository, entry *git.TreeEntry) ([]byte, error) {
 	obj, err := repo.Lookup(entry.Id)
@@ -149,76 +216,71 @@ func GetFileContents(repo *git.Repository, tag, path string) ([]byte, error) {
 // repository path, and return a usable instance of PackageHistory for writing
 // to the container history.xml file.
 //
-// The repository path will be taken as the directory name of the pkgfile that
-// is given to this function.
-func NewPackageHistory(pkgfile string) (*PackageHistory, error) {
+// The repository is discovered from the directory of the pkgfile, which may
+// be the root of a repository for the package, or a directory within a
+// monorepo. At most depth entries are kept, where a depth of
+// UnlimitedChangelogEntries will keep the full history.
+func NewPackageHistory(pkgfile string, depth int) (*PackageHistory, error) {
+	history, err := loadScannedHistory(pkgfile)
+	if err != nil {
+		return nil, err
+	}
+	return history.truncate(depth), nil
+}
+
+// scanPackageHistory will collect every usable update of the package from
+// the tags of its repository.
+func scanPackageHistory(pkgfile string) (*PackageHistory, error) {
 	// Repodir
 	path := filepath.Dir(pkgfile)
 
-	repo, err := git.OpenRepository(path)
+	repo, err := openHistoryRepo(path)
 	if err != nil {
 		return nil, err
 	}
-	// Get all the tags
-	var tags []string
-	tags, err = repo.Tags.List()
+	recipe, err := repo.relPath(pkgfile)
+	if err != nil {
+		return nil, err
+	}
+	repoTags, err := repo.scanTags()
 	if err != nil {
 		return nil, err
 	}
+	// Filled with the usable tags as we walk them
+	var tags []string
 
 	updates := make(map[string]*PackageUpdate)
+	cache := loadHistoryCache(path)
+	cached := 0
 
-	// Iterate all of the tags
-	err = repo.Tags.Foreach(func(name string, id *git.Oid) error {
-		if name == "" || id == nil {
-			return nil
-		}
-
-		var commit *git.Commit
-
-		obj, err := repo.Lookup(id)
-		if err != nil {
-			return err
+	for _, tag := range repoTags {
+		if !isHistoryTag(tag.Name) {
+			continue
 		}
+		tags = append(tags, tag.Name)
 
-		switch obj.Type() {
-		// Unannotated tag
-		case git.ObjectCommit:
-			commit, err = obj.AsCommit()
-			if err != nil {
-				return err
-			}
-			tags = append(tags, name)
-		// Annotated tag with commit target
-		case git.ObjectTag:
-			tag, err := obj.AsTag()
-			if err != nil {
-				return err
-			}
-			commit, err = repo.LookupCommit(tag.TargetId())
-			if err != nil {
-				return err
-			}
-			tags = append(tags, name)
-		default:
-			return fmt.Errorf("Internal git error, found %s", obj.Type().String())
+		// Tags that haven't moved don't need to be parsed again
+		if update := cache.lookup(tag.Name, tag.ObjectID); update != nil {
+			updates[tag.Name] = update
+			cached++
+			continue
 		}
-		if commit == nil {
-			return nil
+		parsed, err := repo.tagUpdate(tag)
+		if err != nil {
+			return nil, err
 		}
-		commitObj := NewPackageUpdate(name, commit, id.String())
-		updates[name] = commitObj
-		return nil
-	})
-	// Foreach went bork
-	if err != nil {
-		return nil, err
+		update := *parsed
+		updates[tag.Name] = &update
 	}
-	// Sort the tags by -refname
-	sort.Sort(sort.Reverse(sort.StringSlice(tags)))
+	// Newest tags first
+	sortTagsByVersion(tags)
 
 	ret := &PackageHistory{pkgfile: pkgfile}
-	ret.scanUpdates(repo, updates, tags)
+	ret.scanUpdates(repo, recipe, updates, tags)
+	if cached != len(updates) || repo.head != cache.Head {
+		cache.save(repo.head, updates)
+	}
+	log.Debugf("Reused %d of %d cached history entries\n", cached, len(updates))
 	updates = nil
 
 	if len(ret.Updates) < 1 {
@@ -241,42 +303,74 @@ func (a SortUpdatesByRelease) Swap(i, j int) {
 }
 
 func (a SortUpdatesByRelease) Less(i, j int) bool {
-	return a[i].Package.Release < a[j].Package.Release
+	if a[i].Package.Release != a[j].Package.Release {
+		return a[i].Package.Release < a[j].Package.Release
+	}
+	return CompareVersions(a[i].Tag, a[j].Tag) < 0
 }
 
 // scanUpdates will go back through the collected, "ok" tags, and analyze
-// them to be more useful.
-func (p *PackageHistory) scanUpdates(repo *git.Repository, updates map[string]*PackageUpdate, tags []string) {
-	// basename of file
-	fname := filepath.Base(p.pkgfile)
-
+// them to be more useful. Tags of a monorepo which didn't touch the recipe
+// repeat its release, so only the oldest tag of each release is kept.
+func (p *PackageHistory) scanUpdates(repo *historyRepo, recipe string, updates map[string]*PackageUpdate, tags []string) {
 	var updateSet []*PackageUpdate
 	// Iterate the commit set in order
 	for _, tagID := range tags {
 		update := updates[tagID]
-		if update == nil {
+		if update == nil || update.unusable {
+			continue
+		}
+		// Already known from the history cache
+		if update.Package != nil {
+			updateSet = append(updateSet, update)
 			continue
 		}
-		b, err := GetFileContents(repo, update.ObjectID, fname)
+		b, err := repo.fileContents(update.ObjectID, recipe)
 		if err != nil {
+			update.unusable = true
 			continue
 		}
 
 		var pkg *Package
 		// Shouldn't *actually* bail here. Malformed packages do happen
 		if pkg, err = NewYmlPackageFromBytes(b); err != nil {
+			update.unusable = true
 			continue
 		}
 		update.Package = pkg
 		updateSet = append(updateSet, update)
 	}
 	sort.Sort(sort.Reverse(SortUpdatesByRelease(updateSet)))
-	if len(updateSet) >= MaxChangelogEntries {
-		p.Updates = updateSet[:MaxChangelogEntries]
-	} else {
-		p.Updates = updateSet
+	for _, update := range updateSet {
+		last := len(p.Updates) - 1
+		if last >= 0 && p.Updates[last].Package.Release == update.Package.Release {
+			p.Updates[last] = update
+			continue
+		}
+		p.Updates = append(p.Updates, update)
 	}
+}
 
+// truncate will return a copy of the history with at most depth entries,
+// verifying the signatures of the entries kept.
+func (p *PackageHistory) truncate(depth int) *PackageHistory {
+	ret := &PackageHistory{pkgfile: p.pkgfile}
+	for _, update := range p.Updates {
+		if depth > 0 && len(ret.Updates) >= depth {
+			break
+		}
+		copied := *update
+		ret.Updates = append(ret.Updates, &copied)
+	}
+
+	// Only verify the signatures we'll actually emit
+	repoDir := filepath.Dir(p.pkgfile)
+	for _, update := range ret.Updates {
+		if update.Signed {
+			update.Verified = VerifyTag(repoDir, update.Tag)
+		}
+	}
+	return ret
 }
 
 // YPKG provides ypkg-gen-history history.xml compatibility
@@ -286,54 +380,72 @@ type YPKG struct {
 
 // YPKGUpdate represents an update in the package history
 type YPKGUpdate struct {
-	Release int    `xml:"release,attr"`
-	Type    string `xml:"type,attr,omitempty"`
-	Date    string
-	Version string
-	Comment struct {
+	Release  int    `xml:"release,attr"`
+	Type     string `xml:"type,attr,omitempty"`
+	Signed   bool   `xml:"signed,attr,omitempty"`
+	Verified bool   `xml:"verified,attr,omitempty"`
+	Severity string `xml:"severity,attr,omitempty"`
+	Date     string
+	Version  string
+	Comment  struct {
 		Value string `xml:",cdata"`
 	}
 	Name struct {
 		Value string `xml:",cdata"`
 	}
-	Email string
+	Email    string
+	Requires *YPKGRequires `xml:",omitempty"`
+}
+
+// YPKGRequires lists the actions required after installing an update
+type YPKGRequires struct {
+	Action []string
 }
 
 // WriteXML will attempt to dump the update history to an XML file
 // in order for ypkg to merge it into the package build.
 func (p *PackageHistory) WriteXML(path string) error {
-	var ypkgUpdates []*YPKGUpdate
+	return p.Write(path, "xml")
+}
 
-	fi, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer fi.Close()
+// XML will render the update history in the ypkg history.xml format
+func (p *PackageHistory) XML() ([]byte, error) {
+	var ypkgUpdates []*YPKGUpdate
 
 	for _, update := range p.Updates {
 		yUpdate := &YPKGUpdate{
-			Release: update.Package.Release,
-			Version: update.Package.Version,
-			Email:   update.AuthorEmail,
-			Date:    update.Time.Format(UpdateDateFormat),
+			Release:  update.Package.Release,
+			Version:  update.Package.Version,
+			Email:    update.AuthorEmail,
+			Date:     update.Time.Format(UpdateDateFormat),
+			Signed:   update.Signed,
+			Verified: update.Verified,
+			Severity: strings.ToLower(update.Severity()),
 		}
 		yUpdate.Comment.Value = update.Body
 		yUpdate.Name.Value = update.Author
-		if update.IsSecurity {
+		if update.Type != "" {
+			yUpdate.Type = update.Type
+		} else if update.IsSecurity {
 			yUpdate.Type = "security"
 		}
+		if update.RequiresReboot {
+			yUpdate.Requires = &YPKGRequires{Action: []string{"systemRestart"}}
+		}
 		ypkgUpdates = append(ypkgUpdates, yUpdate)
 	}
 
 	ypkg := &YPKG{History: ypkgUpdates}
-	bytes, err := xml.MarshalIndent(ypkg, "", "    ")
-	if err != nil {
-		return err
-	}
+	return xml.MarshalIndent(ypkg, "", "    ")
+}
 
-	// Dump it to the file
-	_, err = fi.WriteString(string(bytes))
-	return err
+// SourceDateEpoch returns the timestamp to export as SOURCE_DATE_EPOCH, or 0
+// when there is no usable history.
+func (p *PackageHistory) SourceDateEpoch() int64 {
+	if p == nil || len(p.Updates) < 1 {
+		return 0
+	}
+	return p.GetLastVersionTimestamp()
 }
 
 // GetLastVersionTimestamp will return a timestamp appropriate for us within
@@ -0,0 +1,111 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// appstreamReleases is the <releases> element of an AppStream metainfo.xml
+type appstreamReleases struct {
+	XMLName  xml.Name            `xml:"releases"`
+	Releases []*appstreamRelease `xml:"release"`
+}
+
+// An appstreamRelease describes a single version of the software
+type appstreamRelease struct {
+	Version     string `xml:"version,attr"`
+	Date        string `xml:"date,attr"`
+	Urgency     string `xml:"urgency,attr,omitempty"`
+	Description struct {
+		Paragraphs []string `xml:"p"`
+	} `xml:"description"`
+	Issues *appstreamIssues `xml:"issues,omitempty"`
+}
+
+// appstreamIssues lists the issues resolved by a release
+type appstreamIssues struct {
+	Issues []appstreamIssue `xml:"issue"`
+}
+
+// An appstreamIssue is a single resolved issue, i.e. a CVE
+type appstreamIssue struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+// appstreamUrgency returns the AppStream urgency of an update, which is
+// only given for security updates.
+func appstreamUrgency(update *PackageUpdate) string {
+	if !update.IsSecurity && update.Type != "security" {
+		return ""
+	}
+	switch severity := strings.ToLower(update.Severity()); severity {
+	case "low", "medium", "high", "critical":
+		return severity
+	default:
+		return "high"
+	}
+}
+
+// AppStream will render the update history as the releases of an AppStream
+// metainfo.xml, for the Software Center.
+func (p *PackageHistory) AppStream() ([]byte, error) {
+	return xml.MarshalIndent(p.appstreamReleases(), "", "    ")
+}
+
+// appstreamReleases converts the update history to AppStream releases.
+// Releases of the same version are merged, as AppStream only describes
+// upstream versions.
+func (p *PackageHistory) appstreamReleases() *appstreamReleases {
+	releases := &appstreamReleases{}
+	byVersion := make(map[string]*appstreamRelease)
+	seen := make(map[string]bool)
+	for _, update := range p.Updates {
+		release, ok := byVersion[update.Package.Version]
+		if !ok {
+			release = &appstreamRelease{
+				Version: update.Package.Version,
+				Date:    update.Time.Format("2006-01-02"),
+			}
+			byVersion[release.Version] = release
+			releases.Releases = append(releases.Releases, release)
+		}
+		// The most urgent update decides the urgency of the release
+		urgency := appstreamUrgency(update)
+		if severityRanks[strings.ToUpper(urgency)] > severityRanks[strings.ToUpper(release.Urgency)] {
+			release.Urgency = urgency
+		}
+		for _, para := range strings.Split(strings.TrimSpace(update.Body), "\n\n") {
+			if para = strings.Join(strings.Fields(para), " "); para != "" {
+				release.Description.Paragraphs = append(release.Description.Paragraphs, para)
+			}
+		}
+		for _, cve := range update.CVEs {
+			if seen[release.Version+cve.ID] {
+				continue
+			}
+			seen[release.Version+cve.ID] = true
+			if release.Issues == nil {
+				release.Issues = &appstreamIssues{}
+			}
+			release.Issues.Issues = append(release.Issues.Issues, appstreamIssue{Type: "cve", Value: cve.ID})
+		}
+	}
+	return releases
+}
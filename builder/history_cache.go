@@ -0,0 +1,180 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/DataDrake/waterlog"
+	git "github.com/libgit2/git2go/v34"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// historyCacheVersion is bumped whenever the cached format changes, so that
+// stale caches are discarded rather than misread.
+const historyCacheVersion = 1
+
+// historyCache persists the parsed tags of a package repository, so that
+// only new or moved tags need their package.yml parsed again.
+type historyCache struct {
+	Version int                          `json:"version"`
+	Head    string                       `json:"head"`
+	Tags    map[string]*historyCacheItem `json:"tags"`
+
+	path string
+}
+
+// historyCacheItem is a single parsed tag within the cache
+type historyCacheItem struct {
+	ObjectID       string    `json:"object_id"`
+	Author         string    `json:"author"`
+	AuthorEmail    string    `json:"author_email"`
+	Body           string    `json:"body"`
+	Time           time.Time `json:"time"`
+	IsSecurity     bool      `json:"is_security"`
+	Type           string    `json:"type,omitempty"`
+	RequiresReboot bool      `json:"requires_reboot,omitempty"`
+	Signed         bool      `json:"signed,omitempty"`
+	Usable         bool      `json:"usable"`
+	Name           string    `json:"name,omitempty"`
+	PkgVersion     string    `json:"version,omitempty"`
+	Release        int       `json:"release,omitempty"`
+}
+
+// historyCachePath returns the cache file for the given package directory
+func historyCachePath(repoDir string) string {
+	if abs, err := filepath.Abs(repoDir); err == nil {
+		repoDir = abs
+	}
+	sum := sha256.Sum256([]byte(repoDir))
+	return filepath.Join(HistoryCacheDirectory, hex.EncodeToString(sum[:])+".json")
+}
+
+// repoHead returns the commit hash of HEAD, or an empty string for an
+// unborn or detached repository we can't resolve.
+func repoHead(repo *git.Repository) string {
+	ref, err := repo.Head()
+	if err != nil {
+		return ""
+	}
+	defer ref.Free()
+	if target := ref.Target(); target != nil {
+		return target.String()
+	}
+	return ""
+}
+
+// loadHistoryCache will load the cache for the repository, falling back to
+// an empty cache when it is missing or unreadable.
+func loadHistoryCache(repoDir string) *historyCache {
+	cache := &historyCache{
+		Version: historyCacheVersion,
+		Tags:    make(map[string]*historyCacheItem),
+		path:    historyCachePath(repoDir),
+	}
+	b, err := ioutil.ReadFile(cache.path)
+	if err != nil {
+		return cache
+	}
+	var stored historyCache
+	if err := json.Unmarshal(b, &stored); err != nil || stored.Version != historyCacheVersion || stored.Tags == nil {
+		log.Debugf("Discarding unusable history cache %s\n", cache.path)
+		return cache
+	}
+	stored.path = cache.path
+	return &stored
+}
+
+// lookup returns the cached update for the tag, if the tag still points at
+// the same object.
+func (c *historyCache) lookup(tag, objectID string) *PackageUpdate {
+	item, ok := c.Tags[tag]
+	if !ok || item.ObjectID != objectID {
+		return nil
+	}
+	update := &PackageUpdate{
+		Tag:            tag,
+		Author:         item.Author,
+		AuthorEmail:    item.AuthorEmail,
+		Body:           item.Body,
+		Time:           item.Time,
+		ObjectID:       item.ObjectID,
+		IsSecurity:     item.IsSecurity,
+		Type:           item.Type,
+		RequiresReboot: item.RequiresReboot,
+		Signed:         item.Signed,
+		unusable:       !item.Usable,
+	}
+	if item.Usable {
+		update.Package = &Package{
+			Name:    item.Name,
+			Version: item.PkgVersion,
+			Release: item.Release,
+			Type:    PackageTypeYpkg,
+		}
+	}
+	return update
+}
+
+// save will replace the cached tags with the given updates and write the
+// cache out. Failures aren't fatal, we'll simply parse everything next time.
+func (c *historyCache) save(head string, updates map[string]*PackageUpdate) {
+	c.Head = head
+	c.Tags = make(map[string]*historyCacheItem)
+	for tag, update := range updates {
+		item := &historyCacheItem{
+			ObjectID:       update.ObjectID,
+			Author:         update.Author,
+			AuthorEmail:    update.AuthorEmail,
+			Body:           update.Body,
+			Time:           update.Time,
+			IsSecurity:     update.IsSecurity,
+			Type:           update.Type,
+			RequiresReboot: update.RequiresReboot,
+			Signed:         update.Signed,
+		}
+		if update.Package != nil {
+			item.Usable = true
+			item.Name = update.Package.Name
+			item.PkgVersion = update.Package.Version
+			item.Release = update.Package.Release
+		}
+		c.Tags[tag] = item
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		log.Debugf("Failed to encode history cache, reason: %s\n", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 00755); err != nil {
+		log.Debugf("Failed to create history cache directory, reason: %s\n", err)
+		return
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 00644); err != nil {
+		log.Debugf("Failed to write history cache, reason: %s\n", err)
+		return
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		log.Debugf("Failed to store history cache, reason: %s\n", err)
+	}
+}
@@ -0,0 +1,226 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// HistoryFormats are the additional history formats written alongside
+	// the packages after a successful build, such as release notes.
+	HistoryFormats []string
+)
+
+// An Emitter renders the package history in a given format
+type Emitter interface {
+	Emit(history *PackageHistory) ([]byte, error)
+}
+
+// EmitterFunc allows using a plain function as an Emitter
+type EmitterFunc func(history *PackageHistory) ([]byte, error)
+
+// Emit will call the function to render the history
+func (f EmitterFunc) Emit(history *PackageHistory) ([]byte, error) {
+	return f(history)
+}
+
+// emitters are the known history formats, keyed by name
+var emitters = map[string]Emitter{
+	"appstream": EmitterFunc((*PackageHistory).AppStream),
+	"json":      EmitterFunc((*PackageHistory).JSON),
+	"markdown": EmitterFunc(func(history *PackageHistory) ([]byte, error) {
+		return history.Markdown(), nil
+	}),
+	"xml": EmitterFunc((*PackageHistory).XML),
+}
+
+// emitterSuffixes are the file suffixes of the known history formats, where
+// they differ from the format name.
+var emitterSuffixes = map[string]string{
+	"appstream": ".releases.xml",
+	"json":      ".history.json",
+	"markdown":  ".history.md",
+	"xml":       ".history.xml",
+}
+
+// HistorySuffix returns the file suffix used when writing the named format
+func HistorySuffix(format string) string {
+	if suffix, ok := emitterSuffixes[format]; ok {
+		return suffix
+	}
+	return ".history." + format
+}
+
+// ValidHistoryFormats will ensure every named history format is known
+func ValidHistoryFormats(formats []string) error {
+	for _, format := range formats {
+		if _, ok := emitters[format]; !ok {
+			return fmt.Errorf("Unknown history format '%s', expected one of: %s", format, strings.Join(EmitterNames(), ", "))
+		}
+	}
+	return nil
+}
+
+// RegisterEmitter will make an additional history format available by name,
+// replacing any existing format of the same name.
+func RegisterEmitter(name string, emitter Emitter) {
+	emitters[name] = emitter
+}
+
+// EmitterNames returns the names of all known history formats
+func EmitterNames() []string {
+	var names []string
+	for name := range emitters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Emit will render the update history in the named format
+func (p *PackageHistory) Emit(format string) ([]byte, error) {
+	emitter, ok := emitters[format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown history format '%s', expected one of: %s", format, strings.Join(EmitterNames(), ", "))
+	}
+	return emitter.Emit(p)
+}
+
+// Write will render the update history in the named format to the given path
+func (p *PackageHistory) Write(path, format string) error {
+	b, err := p.Emit(format)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 00644)
+}
+
+// WriteHistory will write the update history in each of the configured
+// HistoryFormats alongside the packages.
+func (p *Package) WriteHistory(overlay *Overlay, history *PackageHistory) error {
+	if history == nil {
+		return nil
+	}
+	for _, format := range HistoryFormats {
+		name := fmt.Sprintf("%s-%s-%d%s", p.Name, p.Version, p.Release, HistorySuffix(format))
+		if err := history.Write(filepath.Join(p.GetWorkDir(overlay), name), format); err != nil {
+			return fmt.Errorf("Failed to write %s history, reason: %s\n", format, err)
+		}
+	}
+	return nil
+}
+
+// A HistoryEntry is the exported form of a PackageUpdate, for consumption
+// by release notes tooling.
+type HistoryEntry struct {
+	Tag            string    `json:"tag"`
+	Version        string    `json:"version"`
+	Release        int       `json:"release"`
+	Date           string    `json:"date"`
+	Author         string    `json:"author"`
+	Email          string    `json:"email"`
+	Type           string    `json:"type,omitempty"`
+	RequiresReboot bool      `json:"requires_reboot,omitempty"`
+	Signed         bool      `json:"signed"`
+	Verified       bool      `json:"verified"`
+	Severity       string    `json:"severity,omitempty"`
+	CVEs           []CVEInfo `json:"cves,omitempty"`
+	Message        string    `json:"message"`
+}
+
+// Entries will return the exported form of each update, newest first
+func (p *PackageHistory) Entries() []HistoryEntry {
+	var entries []HistoryEntry
+	for _, update := range p.Updates {
+		entry := HistoryEntry{
+			Tag:            update.Tag,
+			Version:        update.Package.Version,
+			Release:        update.Package.Release,
+			Date:           update.Time.Format(UpdateDateFormat),
+			Author:         update.Author,
+			Email:          update.AuthorEmail,
+			Type:           update.Type,
+			RequiresReboot: update.RequiresReboot,
+			Signed:         update.Signed,
+			Verified:       update.Verified,
+			Severity:       update.Severity(),
+			CVEs:           update.CVEs,
+			Message:        strings.TrimSpace(update.Body),
+		}
+		if entry.Type == "" && update.IsSecurity {
+			entry.Type = "security"
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// JSON will render the update history as a JSON array
+func (p *PackageHistory) JSON() ([]byte, error) {
+	return json.MarshalIndent(p.Entries(), "", "    ")
+}
+
+// Markdown will render the update history as a Markdown document, with a
+// section for each release.
+func (p *PackageHistory) Markdown() []byte {
+	var b bytes.Buffer
+	for i, entry := range p.Entries() {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "## %s-%d (%s)\n\n", entry.Version, entry.Release, entry.Date)
+		fmt.Fprintf(&b, "*%s <%s>*", entry.Author, entry.Email)
+		if entry.Type != "" {
+			fmt.Fprintf(&b, " - **%s**", entry.Type)
+		}
+		if entry.Severity != "" {
+			fmt.Fprintf(&b, " - severity %s", strings.ToLower(entry.Severity))
+		}
+		if entry.RequiresReboot {
+			b.WriteString(" - **requires reboot**")
+		}
+		if entry.Verified {
+			b.WriteString(" - verified")
+		} else if entry.Signed {
+			b.WriteString(" - signed (unverified)")
+		}
+		b.WriteString("\n\n")
+		b.WriteString(entry.Message)
+		b.WriteString("\n")
+		if len(entry.CVEs) > 0 {
+			b.WriteString("\n")
+		}
+		for _, cve := range entry.CVEs {
+			fmt.Fprintf(&b, " * %s", cve.ID)
+			if cve.Severity != "" {
+				fmt.Fprintf(&b, " (%s %.1f)", cve.Severity, cve.Score)
+			}
+			if len(cve.Affected) > 0 {
+				fmt.Fprintf(&b, ": affects %s", strings.Join(cve.Affected, ", "))
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,231 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/xml"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ChangelogFile is an optional, hand written changelog next to the
+	// package.yml, used when there is no usable git history.
+	ChangelogFile = "changelog.yml"
+
+	// HistoryFile is an optional history.xml next to the package.yml, in the
+	// same format that we generate for ypkg.
+	HistoryFile = "history.xml"
+)
+
+// ChangelogEntry is a single update within a changelog.yml
+type ChangelogEntry struct {
+	Release        int    `yaml:"release"`
+	Version        string `yaml:"version"`
+	Date           string `yaml:"date"`
+	Author         string `yaml:"author"`
+	Email          string `yaml:"email"`
+	Type           string `yaml:"type"`
+	RequiresReboot bool   `yaml:"requires-reboot"`
+	Comment        string `yaml:"comment"`
+}
+
+// LoadPackageHistory will obtain the history of the package from git where
+// possible. Fresh packages and shallow checkouts have no usable tags, so we
+// fall back to a changelog.yml or history.xml next to the package.yml, and
+// finally to a single entry describing the working copy.
+func LoadPackageHistory(pkgfile string, depth int) (*PackageHistory, error) {
+	if _, err := openHistoryRepo(filepath.Dir(pkgfile)); err == nil {
+		history, err := NewPackageHistory(pkgfile, depth)
+		if err == nil {
+			return history, nil
+		}
+		log.Debugf("Falling back from git history, reason: %s\n", err)
+	}
+	return NewFallbackHistory(pkgfile, depth)
+}
+
+// NewFallbackHistory will construct the package history without git
+func NewFallbackHistory(pkgfile string, depth int) (*PackageHistory, error) {
+	pkg, err := NewYmlPackage(pkgfile)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(pkgfile)
+	ret := &PackageHistory{pkgfile: pkgfile}
+
+	switch {
+	case PathExists(filepath.Join(dir, ChangelogFile)):
+		log.Debugf("Using package history from %s\n", ChangelogFile)
+		ret.Updates, err = readChangelogFile(filepath.Join(dir, ChangelogFile))
+	case PathExists(filepath.Join(dir, HistoryFile)):
+		log.Debugf("Using package history from %s\n", HistoryFile)
+		ret.Updates, err = readHistoryFile(filepath.Join(dir, HistoryFile))
+	default:
+		log.Debugln("Synthesizing package history from the working copy")
+		var update *PackageUpdate
+		if update, err = workingCopyUpdate(pkgfile, pkg); err == nil {
+			ret.Updates = []*PackageUpdate{update}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ret.Updates) < 1 {
+		return nil, fmt.Errorf("No usable history found for %s", pkgfile)
+	}
+	for _, update := range ret.Updates {
+		update.Package.Name = pkg.Name
+	}
+
+	sort.SliceStable(ret.Updates, func(i, j int) bool {
+		return ret.Updates[i].Package.Release > ret.Updates[j].Package.Release
+	})
+	if depth > 0 && len(ret.Updates) > depth {
+		ret.Updates = ret.Updates[:depth]
+	}
+	return ret, nil
+}
+
+// newFallbackUpdate will create an update outside of git, determining the
+// update type in the same fashion as commits.
+func newFallbackUpdate(release int, version, date, author, email, comment string) (*PackageUpdate, error) {
+	when, err := time.Parse(UpdateDateFormat, date)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid date for release %d, reason: %s", release, err)
+	}
+	update := &PackageUpdate{
+		Author:      author,
+		AuthorEmail: email,
+		Body:        comment,
+		Time:        when,
+		IsSecurity:  len(CveRegex.FindAllString(comment, 1)) > 0,
+		Package: &Package{
+			Version: version,
+			Release: release,
+			Type:    PackageTypeYpkg,
+		},
+	}
+	return update, nil
+}
+
+// setFallbackType will apply an explicit update type to the update
+func setFallbackType(update *PackageUpdate, updateType string) {
+	updateType = strings.ToLower(strings.TrimSpace(updateType))
+	if updateType == "" {
+		return
+	}
+	if !UpdateTypes[updateType] {
+		log.Warnf("Ignoring unknown update type '%s' in release %d\n", updateType, update.Package.Release)
+		return
+	}
+	update.Type = updateType
+	update.IsSecurity = updateType == "security"
+}
+
+// readChangelogFile will parse the updates from a changelog.yml
+func readChangelogFile(path string) ([]*PackageUpdate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ChangelogEntry
+	if err := yaml.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, reason: %s", path, err)
+	}
+	var updates []*PackageUpdate
+	for _, entry := range entries {
+		update, err := newFallbackUpdate(entry.Release, entry.Version, entry.Date, entry.Author, entry.Email, entry.Comment)
+		if err != nil {
+			return nil, err
+		}
+		setFallbackType(update, entry.Type)
+		update.RequiresReboot = entry.RequiresReboot
+		updates = append(updates, update)
+	}
+	return updates, nil
+}
+
+// readHistoryFile will parse the updates from an existing history.xml
+func readHistoryFile(path string) ([]*PackageUpdate, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var history YPKG
+	if err := xml.Unmarshal(b, &history); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, reason: %s", path, err)
+	}
+	var updates []*PackageUpdate
+	for _, entry := range history.History {
+		update, err := newFallbackUpdate(entry.Release, entry.Version, entry.Date, entry.Name.Value, entry.Email, entry.Comment.Value)
+		if err != nil {
+			return nil, err
+		}
+		setFallbackType(update, entry.Type)
+		if entry.Requires != nil {
+			for _, action := range entry.Requires.Action {
+				if action == "systemRestart" {
+					update.RequiresReboot = true
+				}
+			}
+		}
+		updates = append(updates, update)
+	}
+	return updates, nil
+}
+
+// gitConfig returns the value of a git config key, if set
+func gitConfig(dir, key string) string {
+	c := exec.Command("git", "config", key)
+	c.Dir = dir
+	out, err := c.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// workingCopyUpdate will synthesize a single update for the package.yml as
+// it currently stands, attributed to the configured git user.
+func workingCopyUpdate(pkgfile string, pkg *Package) (*PackageUpdate, error) {
+	st, err := os.Stat(pkgfile)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(pkgfile)
+	author := gitConfig(dir, "user.name")
+	if author == "" {
+		author = "Unknown"
+	}
+	update := &PackageUpdate{
+		Author:      author,
+		AuthorEmail: gitConfig(dir, "user.email"),
+		Body:        fmt.Sprintf("Packaging update for %s %s", pkg.Name, pkg.Version),
+		Time:        st.ModTime().UTC(),
+		Package:     pkg,
+	}
+	return update, nil
+}
@@ -0,0 +1,238 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	git "github.com/libgit2/git2go/v34"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// historyRepo is a git repository shared by the histories of every package
+// within it, so that a monorepo is only opened, and its tags only scanned,
+// once no matter how many packages are built from it.
+type historyRepo struct {
+	root string // Root of the working tree
+	head string // Commit of HEAD when opened
+
+	repo *git.Repository
+	lock sync.Mutex // libgit2 objects can't be used by several threads at once
+
+	scan    sync.Once
+	tags    []*historyTag
+	scanErr error
+}
+
+// historyTag is a tag of the repository. The update parsed from the commit
+// it points at is only resolved when the tag isn't in the history cache, and
+// the package is filled in per package.
+type historyTag struct {
+	Name     string
+	ObjectID string
+	update   *PackageUpdate
+}
+
+// historyScan memoizes the full history of a single package
+type historyScan struct {
+	once    sync.Once
+	history *PackageHistory
+	err     error
+}
+
+var (
+	historyRepos = make(map[string]*historyRepo)
+	historyScans = make(map[string]*historyScan)
+	historyLock  sync.Mutex
+)
+
+// openHistoryRepo will return the shared repository containing dir, opening
+// it on first use.
+func openHistoryRepo(dir string) (*historyRepo, error) {
+	gitDir, err := git.Discover(dir, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	if repo, ok := historyRepos[gitDir]; ok {
+		return repo, nil
+	}
+	repo, err := git.OpenRepository(gitDir)
+	if err != nil {
+		return nil, err
+	}
+	shared := &historyRepo{
+		root: filepath.Clean(repo.Workdir()),
+		head: repoHead(repo),
+		repo: repo,
+	}
+	historyRepos[gitDir] = shared
+	return shared, nil
+}
+
+// relPath returns the path of the file within the working tree, as used in
+// the trees of its commits.
+func (r *historyRepo) relPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	root := r.root
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is outside of the repository %s", path, r.root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// scanTags will list every tag of the repository the first time it's
+// called, returning the same tags for every later call. Listing the tags is
+// cheap, their commits are only looked up by tagUpdate.
+func (r *historyRepo) scanTags() ([]*historyTag, error) {
+	r.scan.Do(func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.scanErr = r.repo.Tags.Foreach(func(name string, id *git.Oid) error {
+			if name == "" || id == nil {
+				return nil
+			}
+			r.tags = append(r.tags, &historyTag{Name: name, ObjectID: id.String()})
+			return nil
+		})
+	})
+	return r.tags, r.scanErr
+}
+
+// tagUpdate will parse the commit the tag points at, once for every package
+// of the repository that needs it.
+func (r *historyRepo) tagUpdate(tag *historyTag) (*PackageUpdate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if tag.update != nil {
+		return tag.update, nil
+	}
+	id, err := git.NewOid(tag.ObjectID)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := r.repo.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	var commit *git.Commit
+	signed := false
+
+	switch obj.Type() {
+	// Unannotated tag
+	case git.ObjectCommit:
+		if commit, err = obj.AsCommit(); err != nil {
+			return nil, err
+		}
+	// Annotated tag with commit target
+	case git.ObjectTag:
+		annotated, err := obj.AsTag()
+		if err != nil {
+			return nil, err
+		}
+		if commit, err = r.repo.LookupCommit(annotated.TargetId()); err != nil {
+			return nil, err
+		}
+		signed = IsSignedTagMessage(annotated.Message())
+	default:
+		return nil, fmt.Errorf("Internal git error, found %s", obj.Type().String())
+	}
+	tag.update = NewPackageUpdate(tag.Name, commit, tag.ObjectID)
+	tag.update.Signed = signed
+	return tag.update, nil
+}
+
+// fileContents will read the file at path from the tagged tree
+func (r *historyRepo) fileContents(objectID, path string) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return GetFileContents(r.repo, objectID, path)
+}
+
+// historyScanKey identifies the history of a package under the current tag
+// patterns, as the patterns may differ between profiles.
+func historyScanKey(pkgfile string) string {
+	if abs, err := filepath.Abs(pkgfile); err == nil {
+		pkgfile = abs
+	}
+	var patterns []string
+	for _, pattern := range HistoryTagPatterns {
+		patterns = append(patterns, pattern.String())
+	}
+	return pkgfile + "\x00" + strings.Join(patterns, "\x00")
+}
+
+// loadScannedHistory will return the full history of the package, scanning
+// the repository only the first time the package is asked for.
+func loadScannedHistory(pkgfile string) (*PackageHistory, error) {
+	key := historyScanKey(pkgfile)
+	historyLock.Lock()
+	scan, ok := historyScans[key]
+	if !ok {
+		scan = &historyScan{}
+		historyScans[key] = scan
+	}
+	historyLock.Unlock()
+	scan.once.Do(func() {
+		scan.history, scan.err = scanPackageHistory(pkgfile)
+	})
+	return scan.history, scan.err
+}
+
+// PrefetchHistories will scan the histories of the package.yml recipes
+// concurrently, sharing the repository between recipes of a monorepo. Later
+// requests for their histories are answered from memory, and the history
+// cache is brought up to date for builds in other processes.
+func PrefetchHistories(pkgfiles []string) {
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pkgfile := range queue {
+				if _, err := openHistoryRepo(filepath.Dir(pkgfile)); err != nil {
+					continue
+				}
+				if _, err := loadScannedHistory(pkgfile); err != nil {
+					log.Debugf("Unable to prefetch history of %s, reason: %s\n", pkgfile, err)
+				}
+			}
+		}()
+	}
+	for _, pkgfile := range pkgfiles {
+		if filepath.Base(pkgfile) == "package.yml" {
+			queue <- pkgfile
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
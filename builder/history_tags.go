@@ -0,0 +1,140 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// HistoryTagPatterns restrict the tags considered for the package history.
+// When empty, every tag is considered.
+var HistoryTagPatterns []*regexp.Regexp
+
+// SetHistoryTagPatterns will compile the tag name patterns used to filter
+// the package history
+func SetHistoryTagPatterns(patterns []string) error {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid tag pattern '%s', reason: %s", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	HistoryTagPatterns = compiled
+	return nil
+}
+
+// isHistoryTag determines if the tag should be considered for the history
+func isHistoryTag(name string) bool {
+	if len(HistoryTagPatterns) == 0 {
+		return true
+	}
+	for _, re := range HistoryTagPatterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// versionChunks splits a version into runs of digits and letters, dropping
+// separators and any prefix before the first digit such as "v".
+func versionChunks(version string) []string {
+	if i := strings.IndexFunc(version, unicode.IsDigit); i > 0 {
+		version = version[i:]
+	}
+	var chunks []string
+	start := -1
+	for i, r := range version + "." {
+		alnum := unicode.IsDigit(r) || unicode.IsLetter(r)
+		if start >= 0 && (!alnum || unicode.IsDigit(r) != unicode.IsDigit(rune(version[start]))) {
+			chunks = append(chunks, version[start:i])
+			start = -1
+		}
+		if alnum && start < 0 {
+			start = i
+		}
+	}
+	return chunks
+}
+
+// compareNumeric compares two runs of digits without overflowing
+func compareNumeric(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// CompareVersions will compare two version strings or tag names, returning
+// -1, 0 or 1. Runs of digits are compared numerically, so that v1.10.0 is
+// newer than v1.9.0, and any prefix before the first digit is ignored so
+// that mixed tag schemes sort together.
+func CompareVersions(a, b string) int {
+	ca, cb := versionChunks(a), versionChunks(b)
+	for i := 0; i < len(ca) && i < len(cb); i++ {
+		var cmp int
+		aNum, bNum := unicode.IsDigit(rune(ca[i][0])), unicode.IsDigit(rune(cb[i][0]))
+		switch {
+		case aNum && bNum:
+			cmp = compareNumeric(ca[i], cb[i])
+		case aNum:
+			// Numbers are newer than suffixes, i.e. 1.0.1 > 1.0rc1
+			cmp = 1
+		case bNum:
+			cmp = -1
+		default:
+			cmp = strings.Compare(ca[i], cb[i])
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	// A trailing number is a newer point release, while trailing letters
+	// mark a pre-release, i.e. 1.0.1 > 1.0 > 1.0rc1
+	switch {
+	case len(ca) < len(cb):
+		if unicode.IsDigit(rune(cb[len(ca)][0])) {
+			return -1
+		}
+		return 1
+	case len(ca) > len(cb):
+		if unicode.IsDigit(rune(ca[len(cb)][0])) {
+			return 1
+		}
+		return -1
+	}
+	// Fall back to the full names for a stable order
+	return strings.Compare(a, b)
+}
+
+// sortTagsByVersion will sort the tags newest first
+func sortTagsByVersion(tags []string) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		return CompareVersions(tags[i], tags[j]) > 0
+	})
+}
@@ -0,0 +1,238 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTrailers(t *testing.T) {
+	msg := `Update to 1.2.3
+
+Fixes a crash on startup.
+
+Update-Type: Security
+Requires-Reboot: yes
+`
+	trailers := ParseTrailers(msg)
+	if trailers[UpdateTypeTrailer] != "Security" {
+		t.Fatalf("Wrong update type: %s", trailers[UpdateTypeTrailer])
+	}
+	if trailers[RequiresRebootTrailer] != "yes" {
+		t.Fatalf("Wrong reboot requirement: %s", trailers[RequiresRebootTrailer])
+	}
+	if len(ParseTrailers("Update-Type: security")) != 0 {
+		t.Fatal("Parsed a subject line as a trailer")
+	}
+	if len(ParseTrailers("Bump release\n\nSee: the notes\nfor details")) != 0 {
+		t.Fatal("Parsed a partial trailer block")
+	}
+}
+
+func TestCVSS3BaseScore(t *testing.T) {
+	vectors := map[string]float64{
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H": 9.8,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N": 6.1,
+		"CVSS:3.0/AV:L/AC:L/PR:L/UI:N/S:U/C:H/I:N/A:N": 5.5,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N": 0,
+	}
+	for vector, want := range vectors {
+		score, err := CVSS3BaseScore(vector)
+		if err != nil {
+			t.Fatalf("Failed to score %s: %v", vector, err)
+		}
+		if score != want {
+			t.Fatalf("Wrong score for %s: %.1f, expected %.1f", vector, score, want)
+		}
+	}
+	if _, err := CVSS3BaseScore("AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"); err == nil {
+		t.Fatal("Scored a vector without a version")
+	}
+	if CVSSSeverity(9.8) != "CRITICAL" || CVSSSeverity(5.5) != "MEDIUM" {
+		t.Fatal("Wrong severity rating")
+	}
+}
+
+func TestHistoryCache(t *testing.T) {
+	cache := &historyCache{path: filepath.Join(t.TempDir(), "history.json")}
+	cache.save("abc", map[string]*PackageUpdate{
+		"v1": {Tag: "v1", ObjectID: "111", Author: "Jane", Package: &Package{Name: "nano", Version: "1.0", Release: 1}},
+		"v0": {Tag: "v0", ObjectID: "000", unusable: true},
+	})
+	b, err := ioutil.ReadFile(cache.path)
+	if err != nil {
+		t.Fatalf("Failed to write the cache: %v", err)
+	}
+	var stored historyCache
+	if err := json.Unmarshal(b, &stored); err != nil {
+		t.Fatalf("Failed to read the cache: %v", err)
+	}
+	if stored.Head != "abc" {
+		t.Fatalf("Wrong head: %s", stored.Head)
+	}
+	update := stored.lookup("v1", "111")
+	if update == nil || update.Package == nil || update.Package.Release != 1 || update.Author != "Jane" {
+		t.Fatal("Failed to restore a cached update")
+	}
+	if stored.lookup("v1", "222") != nil {
+		t.Fatal("Used the cache for a moved tag")
+	}
+	if update := stored.lookup("v0", "000"); update == nil || !update.unusable {
+		t.Fatal("Failed to remember an unusable tag")
+	}
+}
+
+func TestFallbackHistory(t *testing.T) {
+	dir := t.TempDir()
+	recipe := "name: nano\nversion: 7.2\nrelease: 3\n"
+	changelog := `- release: 2
+  version: "7.1"
+  date: 2021-04-01
+  author: Jane
+  comment: Fixes CVE-2021-1234
+- release: 3
+  version: "7.2"
+  date: 2021-05-01
+  author: Jane
+  type: enhancement
+  comment: Update to 7.2
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "package.yml"), []byte(recipe), 00644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ChangelogFile), []byte(changelog), 00644); err != nil {
+		t.Fatal(err)
+	}
+	history, err := NewFallbackHistory(filepath.Join(dir, "package.yml"), MaxChangelogEntries)
+	if err != nil {
+		t.Fatalf("Failed to read changelog: %v", err)
+	}
+	if len(history.Updates) != 2 || history.Updates[0].Package.Release != 3 {
+		t.Fatal("Updates are not ordered by release")
+	}
+	if history.Updates[0].Type != "enhancement" || !history.Updates[1].IsSecurity {
+		t.Fatal("Wrong update types")
+	}
+	if history.Updates[1].Package.Name != "nano" {
+		t.Fatalf("Wrong package name: %s", history.Updates[1].Package.Name)
+	}
+
+	os.Remove(filepath.Join(dir, ChangelogFile))
+	if history, err = NewFallbackHistory(filepath.Join(dir, "package.yml"), MaxChangelogEntries); err != nil {
+		t.Fatalf("Failed to synthesize history: %v", err)
+	}
+	if len(history.Updates) != 1 || history.Updates[0].Package.Version != "7.2" {
+		t.Fatal("Wrong synthesized history")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	newer := [][2]string{
+		{"v1.10.0", "v1.9.0"},
+		{"1.10.0", "v1.9.1"},
+		{"r12", "r9"},
+		{"1.0.1", "1.0rc1"},
+		{"2.0", "2.0-rc1"},
+		{"0010", "9"},
+	}
+	for _, pair := range newer {
+		if CompareVersions(pair[0], pair[1]) <= 0 {
+			t.Fatalf("Expected %s to be newer than %s", pair[0], pair[1])
+		}
+		if CompareVersions(pair[1], pair[0]) >= 0 {
+			t.Fatalf("Expected %s to be older than %s", pair[1], pair[0])
+		}
+	}
+	tags := []string{"v1.9.0", "v1.10.0", "v1.2.0"}
+	sortTagsByVersion(tags)
+	if tags[0] != "v1.10.0" || tags[2] != "v1.2.0" {
+		t.Fatalf("Wrong tag order: %v", tags)
+	}
+}
+
+func TestHistoryEmit(t *testing.T) {
+	history := &PackageHistory{Updates: []*PackageUpdate{
+		{Tag: "r1", Author: "Jane", Package: &Package{Version: "1.0", Release: 1}},
+	}}
+	for _, name := range EmitterNames() {
+		if out, err := history.Emit(name); err != nil || len(out) == 0 {
+			t.Fatalf("Failed to emit %s: %v", name, err)
+		}
+	}
+	if _, err := history.Emit("yaml"); err == nil {
+		t.Fatal("Emitted an unknown format")
+	}
+}
+
+func TestHistoryAppStream(t *testing.T) {
+	history := &PackageHistory{Updates: []*PackageUpdate{
+		{Body: "Fix overflow", Type: "security", Package: &Package{Version: "1.1", Release: 3},
+			CVEs: []CVEInfo{{ID: "CVE-2021-1234", Severity: "MEDIUM"}}},
+		{Body: "Rebuild", Package: &Package{Version: "1.1", Release: 2}},
+		{Body: "Update to 1.1", Package: &Package{Version: "1.1", Release: 1}},
+		{Body: "Initial", Package: &Package{Version: "1.0", Release: 0}},
+	}}
+	out, err := history.AppStream()
+	if err != nil {
+		t.Fatalf("Failed to render AppStream releases: %v", err)
+	}
+	doc := string(out)
+	if strings.Count(doc, "<release ") != 2 {
+		t.Fatalf("Expected one release per version:\n%s", doc)
+	}
+	if !strings.Contains(doc, `version="1.1" date="0001-01-01" urgency="medium"`) {
+		t.Fatalf("Expected the security urgency on the release:\n%s", doc)
+	}
+	if !strings.Contains(doc, `<issue type="cve">CVE-2021-1234</issue>`) {
+		t.Fatalf("Expected the CVE as an issue:\n%s", doc)
+	}
+	if err := ValidHistoryFormats([]string{"appstream", "yaml"}); err == nil {
+		t.Fatal("Accepted an unknown history format")
+	}
+}
+
+func TestHistoryMonorepoReleases(t *testing.T) {
+	updates := make(map[string]*PackageUpdate)
+	var tags []string
+	for i, release := range []int{3, 3, 2, 1, 1} {
+		tag := fmt.Sprintf("v%d", 5-i)
+		tags = append(tags, tag)
+		updates[tag] = &PackageUpdate{Tag: tag, Package: &Package{Name: "nano", Release: release}}
+	}
+	history := &PackageHistory{pkgfile: "nano/package.yml"}
+	history.scanUpdates(nil, "nano/package.yml", updates, tags)
+	if len(history.Updates) != 3 {
+		t.Fatalf("Expected one update per release, found %d", len(history.Updates))
+	}
+	if history.Updates[0].Tag != "v4" || history.Updates[2].Tag != "v1" {
+		t.Fatalf("Expected the oldest tag of each release, found %s and %s", history.Updates[0].Tag, history.Updates[2].Tag)
+	}
+	truncated := history.truncate(2)
+	if len(truncated.Updates) != 2 || len(history.Updates) != 3 {
+		t.Fatalf("Truncating must not change the full history")
+	}
+	truncated.Updates[0].Body = "changed"
+	if history.Updates[0].Body != "" {
+		t.Fatalf("Truncated updates must be copies")
+	}
+}
@@ -0,0 +1,88 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"strings"
+)
+
+var (
+	// ErrNotSigned is returned when verifying an object without a signature
+	ErrNotSigned = errors.New("No signature found")
+
+	// tagSignatureHeaders mark the start of a signature within a tag message
+	tagSignatureHeaders = []string{
+		"-----BEGIN PGP SIGNATURE-----",
+		"-----BEGIN SSH SIGNATURE-----",
+	}
+
+	// trustedStatus are the gpg trust levels for a trusted maintainer key
+	trustedStatus = []string{"TRUST_FULLY", "TRUST_ULTIMATE"}
+)
+
+// IsSignedTagMessage determines if an annotated tag message has a signature
+func IsSignedTagMessage(message string) bool {
+	for _, header := range tagSignatureHeaders {
+		if strings.Contains(message, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyTag will check that the tag has a good signature from a key that is
+// trusted in the local keyring. libgit2 can't verify signatures, so we defer
+// to git itself.
+func VerifyTag(repoDir, tag string) bool {
+	if err := verifyGitObject(repoDir, "verify-tag", tag); err != nil {
+		log.Debugf("Failed to verify tag %s, reason: %s\n", tag, err)
+		return false
+	}
+	return true
+}
+
+// VerifyCommit will check that the commit has a good signature from a key
+// that is trusted in the local keyring, returning why it isn't otherwise.
+func VerifyCommit(repoDir, commit string) error {
+	return verifyGitObject(repoDir, "verify-commit", commit)
+}
+
+// verifyGitObject will run the git verification command for the object and
+// interpret the raw gpg status.
+func verifyGitObject(repoDir, command, object string) error {
+	var status bytes.Buffer
+	c := gitCommand(repoDir, command, "--raw", object)
+	c.Stderr = &status
+	err := c.Run()
+	raw := status.String()
+	switch {
+	case raw == "" && err != nil:
+		return ErrNotSigned
+	case !strings.Contains(raw, "GOODSIG"):
+		return fmt.Errorf("%s has a signature that can't be verified", object)
+	}
+	for _, trust := range trustedStatus {
+		if strings.Contains(raw, trust) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is signed by an untrusted key", object)
+}
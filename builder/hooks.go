@@ -0,0 +1,253 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HookPreFetch runs before the sources of the build are fetched
+	HookPreFetch = "pre-fetch"
+
+	// HookPreBuild runs once the build root is set up, before the build
+	HookPreBuild = "pre-build"
+
+	// HookPostBuild runs after a successful build, before the packages are
+	// collected within the container, and after they are on the host
+	HookPostBuild = "post-build"
+
+	// HookOnFailure runs on the host after a build fails
+	HookOnFailure = "on-failure"
+
+	// HookHost runs the hook on the host
+	HookHost = "host"
+
+	// HookContainer runs the hook within the build root
+	HookContainer = "container"
+
+	// HookContextEnv names the JSON file describing the build to a hook
+	HookContextEnv = "SOLBUILD_HOOK_CONTEXT"
+
+	// hookContextFile is where the context of container hooks is written,
+	// within the build root
+	hookContextFile = "/tmp/solbuild-hook.json"
+)
+
+var (
+	// HookPoints are the points of the build a hook may run at
+	HookPoints = []string{HookPreFetch, HookPreBuild, HookPostBuild, HookOnFailure}
+
+	// ActiveHooks are the hooks of the current build
+	ActiveHooks []*Hook
+
+	// ErrUnknownHook is returned for a hook at an unknown point
+	ErrUnknownHook = errors.New("Unknown hook point, use pre-fetch, pre-build, post-build or on-failure")
+
+	// ErrContainerHook is returned for a container hook at a point without
+	// a build root
+	ErrContainerHook = errors.New("Only pre-build and post-build hooks can run in the container")
+)
+
+// A Hook is a user command run at a point of the build
+type Hook struct {
+	Point    string `toml:"point"`    // When the hook runs
+	Command  string `toml:"command"`  // Shell command of the hook
+	RunIn    string `toml:"run_in"`   // Where the hook runs, host or container
+	Required bool   `toml:"required"` // Fail the build when the hook fails
+}
+
+// A HookContext describes the build to a hook
+type HookContext struct {
+	Hook      string   `json:"hook"`
+	Package   string   `json:"package"`
+	Version   string   `json:"version"`
+	Release   int      `json:"release"`
+	Recipe    string   `json:"recipe"`
+	Profile   string   `json:"profile"`
+	Artifacts []string `json:"artifacts,omitempty"` // Paths of the packages and files built
+	Error     string   `json:"error,omitempty"`     // Why the build failed
+}
+
+// ValidHooks will ensure every hook runs at a known point, in a place it can
+// run at that point.
+func ValidHooks(hooks []*Hook) error {
+	for _, hook := range hooks {
+		known := false
+		for _, point := range HookPoints {
+			known = known || hook.Point == point
+		}
+		if !known {
+			return ErrUnknownHook
+		}
+		if strings.TrimSpace(hook.Command) == "" {
+			return fmt.Errorf("The %s hook has no command", hook.Point)
+		}
+		switch hook.RunIn {
+		case "", HookHost:
+		case HookContainer:
+			if hook.Point != HookPreBuild && hook.Point != HookPostBuild {
+				return ErrContainerHook
+			}
+		default:
+			return fmt.Errorf("Unknown hook location '%s', use host or container", hook.RunIn)
+		}
+	}
+	return nil
+}
+
+// where returns where the hook runs
+func (h *Hook) where() string {
+	if h.RunIn == "" {
+		return HookHost
+	}
+	return h.RunIn
+}
+
+// NewHookContext will describe the build of the package to the hooks at point
+func NewHookContext(point string, pkg *Package, profile string) *HookContext {
+	return &HookContext{
+		Hook:    point,
+		Package: pkg.Name,
+		Version: pkg.Version,
+		Release: pkg.Release,
+		Recipe:  pkg.Path,
+		Profile: profile,
+	}
+}
+
+// Environment returns the context as the variables given to a hook, along
+// with the path of the JSON context.
+func (c *HookContext) Environment(path string) []string {
+	return []string{
+		"SOLBUILD_HOOK=" + c.Hook,
+		"SOLBUILD_PACKAGE=" + c.Package,
+		"SOLBUILD_VERSION=" + c.Version,
+		"SOLBUILD_RELEASE=" + strconv.Itoa(c.Release),
+		"SOLBUILD_RECIPE=" + c.Recipe,
+		"SOLBUILD_PROFILE=" + c.Profile,
+		"SOLBUILD_ARTIFACTS=" + strings.Join(c.Artifacts, " "),
+		"SOLBUILD_ERROR=" + c.Error,
+		HookContextEnv + "=" + path,
+	}
+}
+
+// writeContext will store the context as JSON at path
+func (c *HookContext) writeContext(path string) error {
+	b, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 00644)
+}
+
+// RunHooks will run the active hooks of the context on the host. A failing
+// hook only fails the build when it is required.
+func RunHooks(ctx *HookContext) error {
+	var path string
+	for _, hook := range ActiveHooks {
+		if hook.Point != ctx.Hook || hook.where() != HookHost {
+			continue
+		}
+		if path == "" {
+			f, err := ioutil.TempFile("", "solbuild-hook-*.json")
+			if err != nil {
+				return err
+			}
+			f.Close()
+			path = f.Name()
+			defer os.Remove(path)
+			if err := ctx.writeContext(path); err != nil {
+				return err
+			}
+		}
+		log.Infof("Running %s hook: %s\n", ctx.Hook, hook.Command)
+		c := exec.Command("/bin/sh", "-c", hook.Command)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		c.Env = append(os.Environ(), ctx.Environment(path)...)
+		if err := hookFailed(hook, c.Run()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runContainerHooks will run the active hooks of the context within the
+// build root, as root.
+func (p *Package) runContainerHooks(notif PidNotifier, overlay *Overlay, ctx *HookContext) error {
+	written := false
+	for _, hook := range ActiveHooks {
+		if hook.Point != ctx.Hook || hook.where() != HookContainer {
+			continue
+		}
+		if !written {
+			path := filepath.Join(overlay.MountPoint, hookContextFile[1:])
+			if err := os.MkdirAll(filepath.Dir(path), 01777); err != nil {
+				return err
+			}
+			if err := ctx.writeContext(path); err != nil {
+				return err
+			}
+			defer os.Remove(path)
+			written = true
+		}
+		log.Infof("Running %s hook in the container: %s\n", ctx.Hook, hook.Command)
+		env := ChrootEnvironment
+		ChrootEnvironment = append(append([]string{}, env...), ctx.Environment(hookContextFile)...)
+		err := ChrootExec(notif, overlay.MountPoint, hook.Command)
+		notif.SetActivePID(0)
+		ChrootEnvironment = env
+		if err := hookFailed(hook, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookFailed will report the failure of a hook, returning it when the hook
+// is required.
+func hookFailed(hook *Hook, err error) error {
+	if err == nil {
+		return nil
+	}
+	if hook.Required {
+		return fmt.Errorf("The %s hook failed, reason: %s\n", hook.Point, err)
+	}
+	log.Warnf("The %s hook failed, reason: %s\n", hook.Point, err)
+	return nil
+}
+
+// builtArtifacts returns the paths of the packages built within the root,
+// as seen from within it.
+func (p *Package) builtArtifacts(overlay *Overlay) []string {
+	var artifacts []string
+	built, _ := filepath.Glob(filepath.Join(p.GetWorkDir(overlay), "*.eopkg"))
+	for _, path := range built {
+		artifacts = append(artifacts, filepath.Join(p.GetWorkDirInternal(), filepath.Base(path)))
+	}
+	return artifacts
+}
@@ -0,0 +1,83 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidHooks(t *testing.T) {
+	valid := []*Hook{
+		{Point: HookPreFetch, Command: "true"},
+		{Point: HookPreBuild, Command: "true", RunIn: HookContainer},
+		{Point: HookOnFailure, Command: "true", RunIn: HookHost},
+	}
+	if err := ValidHooks(valid); err != nil {
+		t.Errorf("Expected valid hooks, got %v", err)
+	}
+	for _, invalid := range []*Hook{
+		{Point: "post-upload", Command: "true"},
+		{Point: HookPostBuild, Command: " "},
+		{Point: HookOnFailure, Command: "true", RunIn: HookContainer},
+		{Point: HookPreBuild, Command: "true", RunIn: "vm"},
+	} {
+		if err := ValidHooks([]*Hook{invalid}); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	ActiveHooks = []*Hook{
+		{Point: HookPostBuild, Command: `cp "$SOLBUILD_HOOK_CONTEXT" ` + out + `.json && echo "$SOLBUILD_PACKAGE $SOLBUILD_ARTIFACTS" > ` + out},
+		{Point: HookPreFetch, Command: "exit 1"},
+		{Point: HookPostBuild, Command: "exit 1", RunIn: HookContainer, Required: true},
+	}
+	defer func() { ActiveHooks = nil }()
+
+	ctx := NewHookContext(HookPostBuild, &Package{Name: "nano", Version: "7.2", Release: 3}, "main-x86_64")
+	ctx.Artifacts = []string{"/out/nano-7.2-3-1-x86_64.eopkg"}
+	if err := RunHooks(ctx); err != nil {
+		t.Fatalf("Failed to run hooks: %v", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil || strings.TrimSpace(string(b)) != "nano /out/nano-7.2-3-1-x86_64.eopkg" {
+		t.Errorf("Unexpected hook environment %q: %v", b, err)
+	}
+	var written HookContext
+	if b, err = ioutil.ReadFile(out + ".json"); err != nil || json.Unmarshal(b, &written) != nil {
+		t.Fatalf("Failed to read the hook context: %v", err)
+	}
+	if written.Release != 3 || written.Profile != "main-x86_64" || len(written.Artifacts) != 1 {
+		t.Errorf("Unexpected hook context %+v", written)
+	}
+
+	// Optional hooks only warn when they fail
+	if err := RunHooks(NewHookContext(HookPreFetch, &Package{Name: "nano"}, "")); err != nil {
+		t.Errorf("Expected an optional hook failure to be ignored, got %v", err)
+	}
+	ActiveHooks[1].Required = true
+	if err := RunHooks(NewHookContext(HookPreFetch, &Package{Name: "nano"}, "")); err == nil {
+		t.Error("Expected a required hook failure to fail")
+	}
+}
@@ -0,0 +1,325 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SkipIdenticalRebuilds will skip collecting the build results when every
+// package has the same payload as the version already in the repository.
+var SkipIdenticalRebuilds bool
+
+const (
+	// previousPackagesDir is where the repository versions of the packages are
+	// fetched to within the chroot, for comparison.
+	previousPackagesDir = "/tmp/solbuild-previous"
+
+	// repoIndexDir is where eopkg keeps the index of each repository within
+	// the chroot.
+	repoIndexDir = "/var/lib/eopkg/index"
+)
+
+// eopkgFile is a single entry from the files.xml of an eopkg
+type eopkgFile struct {
+	Path string
+	Type string
+	Size int64
+	UID  string `xml:"Uid"`
+	GID  string `xml:"Gid"`
+	Mode string
+	Hash string
+}
+
+// eopkgPayload describes the installable payload of an eopkg, omitting
+// the metadata that changes with each build such as the release.
+type eopkgPayload struct {
+	Name         string
+	Version      string
+	Release      string
+	Dependencies []string
+	Files        []eopkgFile
+	Metadata     []metadataField // Descriptive metadata, for reviewing changes
+	path         string          // Path of the eopkg
+}
+
+// metadataField is a descriptive field of the metadata.xml of an eopkg
+type metadataField struct {
+	Name  string
+	Value string
+}
+
+// readZipEntry will return the contents of the named file in the archive
+func readZipEntry(archive *zip.ReadCloser, name string) ([]byte, error) {
+	for _, f := range archive.File {
+		if f.Name != name {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("%s is missing", name)
+}
+
+// readEopkgPayload will parse the package name and file list of an eopkg
+func readEopkgPayload(path string) (*eopkgPayload, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	b, err := readZipEntry(archive, "metadata.xml")
+	if err != nil {
+		return nil, err
+	}
+	var metadata struct {
+		Package struct {
+			Name                string
+			Summary             []string
+			Description         []string
+			License             []string
+			PartOf              string
+			Architecture        string
+			Distribution        string
+			DistributionRelease string
+			Source              struct {
+				Name string
+			}
+			RuntimeDependencies struct {
+				Dependency []string
+			}
+			History struct {
+				Update []struct {
+					Release string `xml:"release,attr"`
+					Version string
+				}
+			}
+		}
+	}
+	if err := xml.Unmarshal(b, &metadata); err != nil {
+		return nil, err
+	}
+	pkg := metadata.Package
+	payload := &eopkgPayload{
+		Name:         pkg.Name,
+		Dependencies: pkg.RuntimeDependencies.Dependency,
+		Metadata: []metadataField{
+			{"summary", firstOf(pkg.Summary)},
+			{"description", strings.TrimSpace(firstOf(pkg.Description))},
+			{"license", strings.Join(pkg.License, ", ")},
+			{"component", pkg.PartOf},
+			{"source", pkg.Source.Name},
+			{"architecture", pkg.Architecture},
+			{"distribution", strings.TrimSpace(pkg.Distribution + " " + pkg.DistributionRelease)},
+		},
+		path: path,
+	}
+	if updates := pkg.History.Update; len(updates) > 0 {
+		payload.Version = updates[0].Version
+		payload.Release = updates[0].Release
+	}
+	sort.Strings(payload.Dependencies)
+
+	if b, err = readZipEntry(archive, "files.xml"); err != nil {
+		return nil, err
+	}
+	var files struct {
+		File []eopkgFile
+	}
+	if err := xml.Unmarshal(b, &files); err != nil {
+		return nil, err
+	}
+	sort.Slice(files.File, func(i, j int) bool {
+		return files.File[i].Path < files.File[j].Path
+	})
+	payload.Files = files.File
+	return payload, nil
+}
+
+// firstOf returns the first of the values, i.e. the untranslated summary
+func firstOf(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Equal determines if both payloads install exactly the same files
+func (e *eopkgPayload) Equal(other *eopkgPayload) bool {
+	if e.Name != other.Name || len(e.Files) != len(other.Files) {
+		return false
+	}
+	for i := range e.Files {
+		if e.Files[i] != other.Files[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// IdenticalToRepo will compare the built packages with the repository
+// versions fetched before the build, and determine whether the rebuild
+// changed any of their payloads. Any package that is new to the repository
+// makes the rebuild non-identical.
+func (p *Package) IdenticalToRepo(overlay *Overlay) (bool, error) {
+	built, _ := filepath.Glob(filepath.Join(p.GetWorkDir(overlay), "*.eopkg"))
+	if len(built) < 1 {
+		return false, nil
+	}
+
+	payloads := make(map[string]*eopkgPayload)
+	for _, path := range built {
+		payload, err := readEopkgPayload(path)
+		if err != nil {
+			return false, fmt.Errorf("Failed to read %s, reason: %s\n", filepath.Base(path), err)
+		}
+		payloads[payload.Name] = payload
+	}
+
+	if p.previousErr != nil {
+		return false, p.previousErr
+	}
+
+	matched := 0
+	for _, path := range p.previous {
+		payload, err := readEopkgPayload(path)
+		if err != nil {
+			return false, fmt.Errorf("Failed to read %s, reason: %s\n", filepath.Base(path), err)
+		}
+		current, ok := payloads[payload.Name]
+		if !ok {
+			continue
+		}
+		if !current.Equal(payload) {
+			log.Infof("Payload of %s differs from the repository\n", payload.Name)
+			return false, nil
+		}
+		matched++
+	}
+	return matched == len(payloads), nil
+}
+
+// repoPackageNames will find the packages built from the named source in
+// the repository indexes of the chroot.
+func repoPackageNames(root, source string) ([]string, error) {
+	indexes, _ := filepath.Glob(filepath.Join(root, repoIndexDir[1:], "*", "eopkg-index.xml"))
+	if len(indexes) < 1 {
+		return nil, errors.New("No repository index found")
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, index := range indexes {
+		f, err := os.Open(index)
+		if err != nil {
+			return nil, err
+		}
+		dec := xml.NewDecoder(f)
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Failed to read %s, reason: %s", index, err)
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok || start.Name.Local != "Package" {
+				continue
+			}
+			var pkg struct {
+				Name   string
+				Source struct {
+					Name string
+				}
+			}
+			if err := dec.DecodeElement(&pkg, &start); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Failed to read %s, reason: %s", index, err)
+			}
+			if pkg.Source.Name == source && pkg.Name != "" && !seen[pkg.Name] {
+				seen[pkg.Name] = true
+				names = append(names, pkg.Name)
+			}
+		}
+		f.Close()
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// FetchRepoVersions will download the repository versions of every package
+// built from the same source into the chroot, for the comparisons made after
+// the build. This must happen before the network is taken away, and any
+// failure is kept to be reported by those comparisons.
+func (p *Package) FetchRepoVersions(notif PidNotifier, overlay *Overlay) {
+	if !SkipIdenticalRebuilds && !ReportPackageDiff {
+		return
+	}
+	p.previous, p.previousErr = p.fetchRepoVersions(notif, overlay)
+	if p.previousErr != nil {
+		log.Warnf("Unable to fetch the repository versions of the packages, reason: %s\n", p.previousErr)
+	}
+}
+
+// fetchRepoVersions will download the repository versions of the packages
+// into the chroot, returning their paths. A source new to the repository
+// has none.
+func (p *Package) fetchRepoVersions(notif PidNotifier, overlay *Overlay) ([]string, error) {
+	previousDir := filepath.Join(overlay.MountPoint, previousPackagesDir[1:])
+	if err := os.RemoveAll(previousDir); err != nil {
+		return nil, err
+	}
+	names, err := repoPackageNames(overlay.MountPoint, p.Name)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	if err := os.MkdirAll(previousDir, 00755); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Fetching repository versions of %s\n", strings.Join(names, ", "))
+	cmd := eopkgCommand(fmt.Sprintf("eopkg fetch -o %s %s", previousPackagesDir, strings.Join(names, " ")))
+	if err := ChrootExec(notif, overlay.MountPoint, cmd); err != nil {
+		return nil, fmt.Errorf("Failed to fetch %s, reason: %s", strings.Join(names, ", "), err)
+	}
+	notif.SetActivePID(0)
+
+	previous, _ := filepath.Glob(filepath.Join(previousDir, "*.eopkg"))
+	return previous, nil
+}
+
+// RemoveRepoVersions will remove the fetched repository versions again
+func (p *Package) RemoveRepoVersions(overlay *Overlay) {
+	if p.previous != nil {
+		os.RemoveAll(filepath.Join(overlay.MountPoint, previousPackagesDir[1:]))
+	}
+}
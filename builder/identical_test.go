@@ -0,0 +1,63 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRepoPackageNames(t *testing.T) {
+	root := t.TempDir()
+	if _, err := repoPackageNames(root, "nano"); err == nil {
+		t.Fatalf("Expected an error without a repository index")
+	}
+	writeTestFile(t, filepath.Join(root, "var/lib/eopkg/index/Solus/eopkg-index.xml"), `<PISI>
+    <Distribution>
+        <SourceName>Solus</SourceName>
+        <Obsoletes>
+            <Package>nano-legacy</Package>
+        </Obsoletes>
+    </Distribution>
+    <Package>
+        <Name>nano</Name>
+        <Source><Name>nano</Name></Source>
+    </Package>
+    <Package>
+        <Name>vim</Name>
+        <Source><Name>vim</Name></Source>
+    </Package>
+    <Package>
+        <Name>nano-dbginfo</Name>
+        <Source><Name>nano</Name></Source>
+    </Package>
+</PISI>`)
+	writeTestFile(t, filepath.Join(root, "var/lib/eopkg/index/Local/eopkg-index.xml"), `<PISI>
+    <Package>
+        <Name>nano</Name>
+        <Source><Name>nano</Name></Source>
+    </Package>
+</PISI>`)
+	names, err := repoPackageNames(root, "nano")
+	if err != nil {
+		t.Fatalf("Failed to read the repository indexes: %v", err)
+	}
+	if expected := []string{"nano", "nano-dbginfo"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,287 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"github.com/getsolus/libosdev/disk"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultImageSize is the size of the filesystem of a created ext4 image
+	DefaultImageSize = "10G"
+
+	// postInstallPath is where the post-install script is run from
+	postInstallPath = "/tmp/solbuild-post-install"
+)
+
+var (
+	// ErrImageExists is returned when creating an image that is installed
+	ErrImageExists = errors.New("The image already exists, use --force to replace it")
+)
+
+// An ImageManifest describes a custom backing image for solbuild to create
+type ImageManifest struct {
+	Components  []string         `toml:"components"`   // Components to install, i.e. system.base
+	Name        string           `toml:"name"`         // Name of the image, used as the image of a profile
+	Packages    []string         `toml:"packages"`     // Packages to install
+	PostInstall string           `toml:"post_install"` // Script run in the image once installed
+	Repos       map[string]*Repo `toml:"repo"`         // Repos to install from, kept in the image
+	Size        string           `toml:"size"`         // Size of an ext4 image, i.e. 10G
+
+	dir string // Directory of the manifest, for relative paths
+}
+
+// NewImageManifest will load the image manifest from the given file
+func NewImageManifest(path string) (*ImageManifest, error) {
+	manifest := &ImageManifest{dir: filepath.Dir(path)}
+	if _, err := toml.DecodeFile(path, manifest); err != nil {
+		return nil, err
+	}
+	for name, repo := range manifest.Repos {
+		repo.Name = name
+	}
+	if manifest.Size == "" {
+		manifest.Size = DefaultImageSize
+	}
+	if manifest.PostInstall != "" && !filepath.IsAbs(manifest.PostInstall) {
+		manifest.PostInstall = filepath.Join(manifest.dir, manifest.PostInstall)
+	}
+	return manifest, manifest.Validate()
+}
+
+// Validate will ensure the manifest describes an image that can be created
+func (i *ImageManifest) Validate() error {
+	if i.Name == "" || strings.ContainsAny(i.Name, "/ ") || strings.HasPrefix(i.Name, ".") {
+		return fmt.Errorf("Invalid image name '%s'", i.Name)
+	}
+	if len(i.Repos) == 0 {
+		return errors.New("No repo to install the image from")
+	}
+	for name, repo := range i.Repos {
+		if repo.URI == "" {
+			return fmt.Errorf("The repo %s has no uri", name)
+		}
+		if repo.Local {
+			return fmt.Errorf("The repo %s cannot be local, images keep their repos", name)
+		}
+	}
+	if len(i.Components) == 0 && len(i.Packages) == 0 {
+		return errors.New("No components or packages to install")
+	}
+	if i.PostInstall != "" && !PathExists(i.PostInstall) {
+		return fmt.Errorf("The post_install script %s does not exist", i.PostInstall)
+	}
+	return nil
+}
+
+// repos returns the repos of the manifest in the order they are added
+func (i *ImageManifest) repos() []*Repo {
+	return (&Profile{Repos: i.Repos}).reposToAdd()
+}
+
+// bootstrap will install the packages of the manifest into the root with
+// the host eopkg, as the root has no package manager of its own yet.
+func (i *ImageManifest) bootstrap(root string) error {
+	for _, repo := range i.repos() {
+		log.Infof("Adding repo %s (%s)\n", repo.Name, repo.URI)
+		if err := commands.ExecStdoutArgs("eopkg", []string{"add-repo", "-y", "-D", root, repo.Name, repo.URI}); err != nil {
+			return fmt.Errorf("Failed to add repo %s, reason: %s\n", repo.Name, err)
+		}
+	}
+	args := []string{"install", "-y", "-D", root, "--ignore-comar"}
+	for _, comp := range i.Components {
+		args = append(args, "-c", comp)
+	}
+	args = append(args, i.Packages...)
+	log.Infof("Installing %d component(s) and %d package(s)\n", len(i.Components), len(i.Packages))
+	if err := commands.ExecStdoutArgs("eopkg", args); err != nil {
+		return fmt.Errorf("Failed to install packages, reason: %s\n", err)
+	}
+	return nil
+}
+
+// createRoot will prepare the root the image is installed into. An ext4
+// image is created as a new file mounted there, whereas a squashfs is
+// packed from a plain directory once complete.
+func (b *BackingImage) createRoot(format, size string) error {
+	if err := os.MkdirAll(b.RootDir, 00755); err != nil {
+		return fmt.Errorf("Failed to create required directories, reason: %s\n", err)
+	}
+	// Anything left behind may still be mounted, so is never removed here
+	if entries, err := ioutil.ReadDir(b.RootDir); err != nil || len(entries) > 0 {
+		return fmt.Errorf("%s is not empty, remove it first", b.RootDir)
+	}
+	if format == ImageFormatSquashfs {
+		return nil
+	}
+	tmp := b.ImagePathExt4 + ".new"
+	os.Remove(tmp)
+	if err := commands.ExecStdoutArgs("truncate", []string{"-s", size, tmp}); err != nil {
+		return fmt.Errorf("Failed to allocate image %s, reason: %s\n", tmp, err)
+	}
+	if err := commands.ExecStdoutArgs("mkfs.ext4", []string{"-q", "-F", tmp}); err != nil {
+		return fmt.Errorf("Failed to format image %s, reason: %s\n", tmp, err)
+	}
+	return disk.GetMountManager().Mount(tmp, b.RootDir, "auto", "loop")
+}
+
+// installImage will replace any existing image with the completed root
+func (b *BackingImage) installImage(format string) error {
+	if format == ImageFormatSquashfs {
+		log.Infof("Packing squashfs image %s\n", b.ImagePathSquashfs)
+		if err := b.mksquashfs(b.RootDir); err != nil {
+			return err
+		}
+		os.Remove(b.ImagePathExt4)
+		return os.RemoveAll(b.RootDir)
+	}
+	if err := disk.GetMountManager().Unmount(b.RootDir); err != nil {
+		return err
+	}
+	if err := os.Rename(b.ImagePathExt4+".new", b.ImagePathExt4); err != nil {
+		return err
+	}
+	// A squashfs would otherwise be used in its place
+	os.Remove(b.ImagePathSquashfs)
+	return nil
+}
+
+// CreateImage will create a new backing image from the manifest, in the
+// image format of the config, to be used by any profile naming it.
+func (m *Manager) CreateImage(manifest *ImageManifest, force bool) error {
+	if m.IsCancelled() {
+		return ErrInterrupted
+	}
+	format := m.Config.ImageFormat
+	if format == "" {
+		format = ImageFormatExt4
+	}
+	if err := ValidImageFormat(format); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.image = NewBackingImage(manifest.Name)
+	if m.image.IsInstalled() && !force {
+		m.lock.Unlock()
+		return ErrImageExists
+	}
+	m.updateMode = true
+	m.pkgManager = NewEopkgManager(m, m.image.RootDir)
+	m.lock.Unlock()
+
+	// Only discard an incomplete image once it has been unmounted, and
+	// never that of another process creating it
+	locked := false
+	defer func() {
+		if !locked {
+			return
+		}
+		os.Remove(m.image.ImagePathExt4 + ".new")
+		if format == ImageFormatSquashfs {
+			os.RemoveAll(m.image.RootDir)
+		}
+	}()
+	defer m.Cleanup()
+	m.SigIntCleanup()
+
+	if err := m.doLock(m.image.LockPath, "creating"); err != nil {
+		return err
+	}
+	locked = true
+	if err := os.MkdirAll(ImagesDir, 00755); err != nil {
+		return fmt.Errorf("Failed to create images directory %s, reason: %s\n", ImagesDir, err)
+	}
+	log.Infof("Creating %s image %s\n", format, manifest.Name)
+	if err := m.image.createRoot(format, manifest.Size); err != nil {
+		return fmt.Errorf("Failed to create rootfs %s, reason: %s\n", m.image.RootDir, err)
+	}
+	if err := m.image.populate(m, m.pkgManager, manifest); err != nil {
+		return err
+	}
+	m.pkgManager.Cleanup()
+	if err := disk.GetMountManager().Unmount(filepath.Join(m.image.RootDir, "proc")); err != nil {
+		return err
+	}
+	if err := m.image.installImage(format); err != nil {
+		return fmt.Errorf("Failed to install image %s, reason: %s\n", manifest.Name, err)
+	}
+	log.Goodf("Created image %s\n", manifest.Name)
+	return nil
+}
+
+// populate will install the manifest into the root of the image, then
+// configure it for builds and record its first generation.
+func (b *BackingImage) populate(notif PidNotifier, pkgManager *EopkgManager, manifest *ImageManifest) error {
+	if err := EnsureEopkgLayout(b.RootDir); err != nil {
+		return fmt.Errorf("Failed to fix filesystem layout %s, reason: %s\n", b.RootDir, err)
+	}
+	if err := pkgManager.Init(); err != nil {
+		return fmt.Errorf("Failed to initialise package manager, reason: %s\n", err)
+	}
+	if err := manifest.bootstrap(b.RootDir); err != nil {
+		return err
+	}
+
+	log.Debugln("Mounting vfs /proc")
+	if err := disk.GetMountManager().Mount("proc", filepath.Join(b.RootDir, "proc"), "proc", "nosuid", "noexec"); err != nil {
+		return fmt.Errorf("Failed to mount /proc, reason: %s\n", err)
+	}
+	log.Debugln("Starting D-BUS")
+	if err := pkgManager.StartDBUS(); err != nil {
+		return fmt.Errorf("Failed to start d-bus, reason: %s\n", err)
+	}
+	log.Infoln("Configuring installed packages")
+	if err := ChrootExec(notif, b.RootDir, eopkgCommand("eopkg configure-pending")); err != nil {
+		return fmt.Errorf("Failed to configure packages, reason: %s\n", err)
+	}
+	notif.SetActivePID(0)
+	if manifest.PostInstall != "" {
+		log.Infof("Running post-install script %s\n", manifest.PostInstall)
+		script := filepath.Join(b.RootDir, postInstallPath)
+		if err := disk.CopyFile(manifest.PostInstall, script); err != nil {
+			return fmt.Errorf("Failed to copy post-install script, reason: %s\n", err)
+		}
+		err := ChrootExec(notif, b.RootDir, "/bin/sh "+postInstallPath)
+		notif.SetActivePID(0)
+		os.Remove(script)
+		if err != nil {
+			return fmt.Errorf("Post-install script failed, reason: %s\n", err)
+		}
+	}
+	log.Debugln("Stopping D-BUS")
+	if err := pkgManager.StopDBUS(); err != nil {
+		return fmt.Errorf("Failed to stop d-bus, reason: %s\n", err)
+	}
+
+	if err := AddBuildUser(b.RootDir); err != nil {
+		return err
+	}
+	installed, err := installedPackages(b.RootDir)
+	if err != nil {
+		return err
+	}
+	return NewImageGeneration(nil, nil, installed).Save(b)
+}
@@ -0,0 +1,67 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNewImageManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "post-install.sh"), "#!/bin/sh\n")
+	path := filepath.Join(dir, "custom.toml")
+	writeTestFile(t, path, `name = "custom-x86_64"
+components = ["system.base"]
+post_install = "post-install.sh"
+
+[repo.Solus]
+uri = "https://cdn.getsol.us/repo/shannon/eopkg-index.xml.xz"
+
+[repo.Custom]
+uri = "https://example.com/eopkg-index.xml.xz"
+priority = 10
+`)
+	manifest, err := NewImageManifest(path)
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %s", err)
+	}
+	if manifest.Size != DefaultImageSize {
+		t.Errorf("Expected the default size, got %s", manifest.Size)
+	}
+	if want := filepath.Join(dir, "post-install.sh"); manifest.PostInstall != want {
+		t.Errorf("Expected post_install %s, got %s", want, manifest.PostInstall)
+	}
+	if repos := manifest.repos(); len(repos) != 2 || repos[0].Name != "Custom" {
+		t.Errorf("Expected the Custom repo first, got %v", repos)
+	}
+}
+
+func TestImageManifestValidate(t *testing.T) {
+	repos := map[string]*Repo{"Solus": {URI: "https://example.com/eopkg-index.xml.xz"}}
+	for name, manifest := range map[string]*ImageManifest{
+		"no name":     {Repos: repos, Components: []string{"system.base"}},
+		"nested name": {Name: "../custom", Repos: repos, Components: []string{"system.base"}},
+		"no repos":    {Name: "custom", Components: []string{"system.base"}},
+		"no packages": {Name: "custom", Repos: repos},
+		"local repo":  {Name: "custom", Repos: map[string]*Repo{"Local": {URI: "/var/lib/repo", Local: true}}, Packages: []string{"nano"}},
+	} {
+		if err := manifest.Validate(); err == nil {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ImageGenerationsSuffix is the suffix of the directory keeping the
+	// previous generations of an image
+	ImageGenerationsSuffix = ".generations"
+
+	// imageVersionDate is the layout of an image version given as a date
+	imageVersionDate = "2006-01-02"
+)
+
+var (
+	// ErrUnknownImageVersion is returned when no generation of the image
+	// matches the requested version
+	ErrUnknownImageVersion = errors.New("No generation of the image matches the version")
+)
+
+// A KeptGeneration is a generation of an image that can be built against
+type KeptGeneration struct {
+	*ImageGeneration
+	ImagePath string // Path of the image at this generation
+}
+
+// GenerationsDir returns the directory the previous generations of the
+// image are kept in
+func (b *BackingImage) GenerationsDir() string {
+	return filepath.Join(ImagesDir, b.Name+ImageGenerationsSuffix)
+}
+
+// ListImageGenerations will return every generation of the image that can
+// be built against, oldest first, ending with the image as it is now.
+func ListImageGenerations(b *BackingImage) ([]*KeptGeneration, error) {
+	var kept []*KeptGeneration
+	records, _ := filepath.Glob(filepath.Join(b.GenerationsDir(), "*"+ImageGenerationSuffix))
+	for _, record := range records {
+		g, err := loadGeneration(record)
+		if err != nil {
+			return nil, err
+		}
+		base := strings.TrimSuffix(record, ImageGenerationSuffix)
+		for _, suffix := range []string{ImageSquashfsSuffix, ImageSuffix} {
+			if PathExists(base + suffix) {
+				kept = append(kept, &KeptGeneration{ImageGeneration: g, ImagePath: base + suffix})
+				break
+			}
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Generation < kept[j].Generation
+	})
+	current, err := LoadImageGeneration(b)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		kept = append(kept, &KeptGeneration{ImageGeneration: current, ImagePath: b.ImagePath})
+	}
+	return kept, nil
+}
+
+// findImageVersion returns the generation matching the version, either the
+// generation number or a date picking the last generation updated by the
+// end of that day.
+func findImageVersion(generations []*KeptGeneration, version string) (*KeptGeneration, error) {
+	if n, err := strconv.Atoi(version); err == nil {
+		for _, g := range generations {
+			if g.Generation == n {
+				return g, nil
+			}
+		}
+		return nil, ErrUnknownImageVersion
+	}
+	day, err := time.Parse(imageVersionDate, version)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid image version %s, use a generation or a date such as %s", version, imageVersionDate)
+	}
+	var found *KeptGeneration
+	for _, g := range generations {
+		if g.Updated.Before(day.AddDate(0, 0, 1)) {
+			found = g
+		}
+	}
+	if found == nil {
+		return nil, ErrUnknownImageVersion
+	}
+	return found, nil
+}
+
+// PinnedTo returns the image at the given version, a generation number or a
+// date, which must have been kept by earlier updates.
+func (b *BackingImage) PinnedTo(version string) (*BackingImage, error) {
+	generations, err := ListImageGenerations(b)
+	if err != nil {
+		return nil, err
+	}
+	g, err := findImageVersion(generations, version)
+	if err != nil {
+		var versions []string
+		for _, g := range generations {
+			versions = append(versions, fmt.Sprintf("%d (%s)", g.Generation, g.Updated.Format(imageVersionDate)))
+		}
+		if len(versions) == 0 {
+			versions = append(versions, "none")
+		}
+		return nil, fmt.Errorf("%s, available generations of %s: %s", err, b.Name, strings.Join(versions, ", "))
+	}
+	pinned := *b
+	pinned.ImagePath = g.ImagePath
+	pinned.Squashfs = strings.HasSuffix(g.ImagePath, ImageSquashfsSuffix)
+	pinned.pinned = g.ImageGeneration
+	return &pinned, nil
+}
+
+// keepGeneration will keep the image as it is before an update, so that
+// builds may still be pinned to it, returning the path it was kept at.
+func (b *BackingImage) keepGeneration() (string, error) {
+	g, err := LoadImageGeneration(b)
+	if err != nil {
+		return "", err
+	}
+	if g == nil {
+		st, err := os.Stat(b.ImagePath)
+		if err != nil {
+			return "", err
+		}
+		g = &ImageGeneration{Updated: st.ModTime().UTC()}
+	}
+	dir := b.GenerationsDir()
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		return "", err
+	}
+	suffix := ImageSuffix
+	if b.Squashfs {
+		suffix = ImageSquashfsSuffix
+	}
+	base := filepath.Join(dir, strconv.Itoa(g.Generation))
+	path := base + suffix
+	os.Remove(path)
+	log.Debugf("Keeping generation %d of %s as %s\n", g.Generation, b.Name, path)
+	// A squashfs is only ever replaced, so the old one can be linked
+	if !b.Squashfs || os.Link(b.ImagePath, path) != nil {
+		if err := commands.ExecStdoutArgs("cp", []string{"--reflink=auto", "--sparse=always", b.ImagePath, path}); err != nil {
+			return "", fmt.Errorf("Failed to copy %s, reason: %s\n", b.ImagePath, err)
+		}
+	}
+	if err := g.save(base + ImageGenerationSuffix); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// discardGeneration will remove a kept generation, as the update left the
+// image unchanged.
+func discardGeneration(path string) {
+	base := strings.TrimSuffix(strings.TrimSuffix(path, ImageSuffix), ImageSquashfsSuffix)
+	os.Remove(path)
+	os.Remove(path + ImageDigestSuffix)
+	os.Remove(base + ImageGenerationSuffix)
+}
+
+// pruneGenerations will remove the oldest kept generations of the image
+// until only keep remain.
+func (b *BackingImage) pruneGenerations(keep int) error {
+	generations, err := ListImageGenerations(b)
+	if err != nil {
+		return err
+	}
+	// The last generation listed is the image itself
+	if len(generations) > 0 && generations[len(generations)-1].ImagePath == b.ImagePath {
+		generations = generations[:len(generations)-1]
+	}
+	for len(generations) > keep {
+		log.Debugf("Removing generation %d of %s\n", generations[0].Generation, b.Name)
+		discardGeneration(generations[0].ImagePath)
+		generations = generations[1:]
+	}
+	return nil
+}
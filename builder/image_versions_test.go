@@ -0,0 +1,55 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindImageVersion(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse(time.RFC3339, s)
+		return d
+	}
+	generations := []*KeptGeneration{
+		{ImageGeneration: &ImageGeneration{Generation: 3, Updated: day("2024-05-20T10:00:00Z")}, ImagePath: "3.img"},
+		{ImageGeneration: &ImageGeneration{Generation: 4, Updated: day("2024-06-01T23:00:00Z")}, ImagePath: "4.img"},
+		{ImageGeneration: &ImageGeneration{Generation: 5, Updated: day("2024-06-08T09:00:00Z")}, ImagePath: "current.img"},
+	}
+	for version, want := range map[string]string{
+		"3":          "3.img",
+		"5":          "current.img",
+		"2024-06-01": "4.img",
+		"2024-06-07": "4.img",
+		"2025-01-01": "current.img",
+	} {
+		g, err := findImageVersion(generations, version)
+		if err != nil {
+			t.Errorf("Failed to find %s: %s", version, err)
+			continue
+		}
+		if g.ImagePath != want {
+			t.Errorf("Expected %s for %s, got %s", want, version, g.ImagePath)
+		}
+	}
+	for _, version := range []string{"2", "2024-05-19", "last week"} {
+		if _, err := findImageVersion(generations, version); err == nil {
+			t.Errorf("Expected no generation for %s", version)
+		}
+	}
+}
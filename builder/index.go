@@ -79,5 +79,12 @@ func (p *Package) Index(notif PidNotifier, dir string, overlay *Overlay) error {
 		log.Errorf("Indexing failed: dir='%s', reason: %s\n", dir, err)
 		return err
 	}
+	if SigningKey == "" {
+		return nil
+	}
+	if err := SignIndex(SigningKey, dir); err != nil {
+		log.Errorf("Signing failed: dir='%s', reason: %s", dir, err)
+		return err
+	}
 	return nil
 }
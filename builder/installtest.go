@@ -0,0 +1,87 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"path/filepath"
+)
+
+// InstallTestScript is the name of the optional script beside package.yml
+// that is run once the built packages are installed
+const InstallTestScript = "solbuild-test.sh"
+
+var (
+	// InstallTest installs the built packages into the build root, and runs
+	// the test script of the recipe, before they are collected
+	InstallTest bool
+
+	// ErrNothingToTest is returned when the build left no packages to install
+	ErrNothingToTest = errors.New("The build produced no packages to install and test")
+)
+
+// installTestCommand returns the command running the test script as the
+// build user, from the work directory
+func (p *Package) installTestCommand() string {
+	wdir := p.GetWorkDirInternal()
+	return fmt.Sprintf("cd %s && /bin/su %s -- %s", wdir, BuildUser, filepath.Join(wdir, InstallTestScript))
+}
+
+// RunInstallTest will install the freshly built packages into the still
+// live build root, and run the test script of the recipe, if any, failing
+// the build when either fails.
+func (p *Package) RunInstallTest(notif PidNotifier, pman *EopkgManager, overlay *Overlay) error {
+	if !InstallTest {
+		return nil
+	}
+	packages := p.builtArtifacts(overlay)
+	if len(packages) == 0 {
+		return ErrNothingToTest
+	}
+	// The root no longer matches the build dependencies alone
+	p.tested = true
+
+	// The runtime dependencies come from the repositories, so the install
+	// alone has the network the build was denied
+	log.Infof("Installing %d built package(s) to test them\n", len(packages))
+	err := WithHostNetwork(func() error {
+		return pman.InstallLocal(packages)
+	})
+	if err != nil {
+		return fmt.Errorf("Built packages failed to install, reason: %s\n", err)
+	}
+
+	script := filepath.Join(filepath.Dir(p.Path), InstallTestScript)
+	if !PathExists(script) {
+		log.Goodln("Built packages installed successfully")
+		return nil
+	}
+	if err := disk.CopyFile(script, filepath.Join(p.GetWorkDir(overlay), InstallTestScript)); err != nil {
+		return fmt.Errorf("Failed to copy the test script, reason: %s\n", err)
+	}
+	log.Infof("Running %s\n", InstallTestScript)
+	err = ChrootExec(notif, overlay.MountPoint, p.installTestCommand())
+	notif.SetActivePID(0)
+	if err != nil {
+		return fmt.Errorf("Test script of the built packages failed, reason: %s\n", err)
+	}
+	log.Goodln("Built packages passed their tests")
+	return nil
+}
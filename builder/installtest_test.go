@@ -0,0 +1,34 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestInstallTestCommand(t *testing.T) {
+	pkg := &Package{Name: "nano", Path: "/recipes/nano/package.yml"}
+	expected := "cd " + pkg.GetWorkDirInternal() + " && /bin/su " + BuildUser + " -- " + pkg.GetWorkDirInternal() + "/" + InstallTestScript
+	if cmd := pkg.installTestCommand(); cmd != expected {
+		t.Errorf("Expected %q, got %q", expected, cmd)
+	}
+
+	// Nothing happens unless the test is enabled
+	if err := pkg.RunInstallTest(nil, nil, nil); err != nil || pkg.tested {
+		t.Errorf("Expected the install test to be skipped, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"gopkg.in/ini.v1"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MemInfoFile is where we read the available host memory from
+	MemInfoFile = "/proc/meminfo"
+)
+
+var (
+	// CxxHints are builddeps fragments that indicate a C++ build, which needs
+	// considerably more memory per job than a C build.
+	CxxHints = []string{"c++", "cxx", "boost", "llvm", "qt5", "qt6", "kf5", "kf6", "gtkmm", "webkit"}
+)
+
+// A JobPolicy determines how many parallel jobs a build may use, based on
+// the memory available to it.
+type JobPolicy struct {
+	GBPerJob    float64 // Memory needed per job for C builds
+	GBPerJobCxx float64 // Memory needed per job for C++ builds
+}
+
+// AdaptiveJobs is set when the job count should be computed from the
+// available memory, rather than the host eopkg.conf
+var AdaptiveJobs *JobPolicy
+
+// availableMemory will return the memory available to the build in bytes,
+// bounded by our cgroup memory limit and that of the build, if set.
+func availableMemory() int64 {
+	avail := readCounter(MemInfoFile, "MemAvailable:") * 1024
+	if c := ActiveBuildCgroup; c != nil && c.Limits.MemoryMax > 0 && c.Limits.MemoryMax < avail {
+		avail = c.Limits.MemoryMax
+	}
+	events := cgroupMemoryEvents()
+	if events == "" {
+		return avail
+	}
+	// memory.max is either a byte count, or "max" when unbounded
+	b, err := ioutil.ReadFile(filepath.Join(filepath.Dir(events), "memory.max"))
+	if err != nil {
+		return avail
+	}
+	if max, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && max < avail {
+		avail = max
+	}
+	return avail
+}
+
+// isCxx will guess whether the package is a C++ build from its builddeps
+func (p *Package) isCxx() bool {
+	if p.Type != PackageTypeYpkg {
+		return false
+	}
+	doc, err := ParseYmlDocumentFile(p.Path)
+	if err != nil {
+		return false
+	}
+	for _, dep := range doc.GetList("builddeps") {
+		dep = strings.ToLower(dep)
+		for _, hint := range CxxHints {
+			if strings.Contains(dep, hint) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Jobs will return the number of jobs the package may build with, never
+// exceeding the number of CPUs or going below a single job.
+func (j *JobPolicy) Jobs(p *Package) int {
+	perJob := j.GBPerJob
+	if p.isCxx() {
+		perJob = j.GBPerJobCxx
+	}
+	cpus := runtime.NumCPU()
+	if perJob <= 0 {
+		return cpus
+	}
+	jobs := int(math.Floor(float64(availableMemory()) / (perJob * 1024 * 1024 * 1024)))
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > cpus {
+		jobs = cpus
+	}
+	return jobs
+}
+
+// SetJobs will set the number of jobs used by ypkg and eopkg for builds
+// within the root.
+func (e *EopkgManager) SetJobs(jobs int) error {
+	return e.setBuildOption("jobs", fmt.Sprintf("-j%d", jobs))
+}
+
+// setBuildOption will set a key of the [build] section of eopkg.conf within
+// the root.
+func (e *EopkgManager) setBuildOption(key, value string) error {
+	confPath := filepath.Join(e.root, "etc/eopkg/eopkg.conf")
+	cfg := ini.Empty()
+	if PathExists(confPath) {
+		var err error
+		if cfg, err = ini.Load(confPath); err != nil {
+			return err
+		}
+	}
+	cfg.Section("build").Key(key).SetValue(value)
+	return cfg.SaveTo(confPath)
+}
+
+// applyAdaptiveJobs will configure the job count for the build, if enabled
+func (p *Package) applyAdaptiveJobs(pman *EopkgManager) error {
+	if AdaptiveJobs == nil {
+		return nil
+	}
+	jobs := AdaptiveJobs.Jobs(p)
+	log.Infof("Using %d parallel jobs based on available memory\n", jobs)
+	if err := pman.SetJobs(jobs); err != nil {
+		return fmt.Errorf("Failed to set job count, reason: %s\n", err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// KeptRootSuffix is appended to the base directory of an overlay to name the
+// state file of a kept build root
+const KeptRootSuffix = ".kept"
+
+var (
+	// KeepRoot is how long a build root is kept after the build, so that
+	// rebuilding the same package skips setting up the root. Zero disables it.
+	KeepRoot time.Duration
+
+	// ErrInvalidKeepRoot is returned when the keep_root window can't be parsed
+	ErrInvalidKeepRoot = errors.New("Invalid keep_root window, expected a duration such as 10m")
+)
+
+// janitorRecheck is how long the janitor waits before looking at a kept
+// root again, when a build is still using it.
+const janitorRecheck = time.Minute
+
+// ParseKeepRoot will convert the keep_root window into a duration, with an
+// empty window disabling kept roots.
+func ParseKeepRoot(window string) (time.Duration, error) {
+	if window == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d < 0 {
+		return 0, ErrInvalidKeepRoot
+	}
+	return d, nil
+}
+
+// keptRoot records which build root state may be reused, and until when
+type keptRoot struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// readKeptRoot will load the state file of a kept root
+func readKeptRoot(path string) (*keptRoot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kept := &keptRoot{}
+	if err := json.Unmarshal(b, kept); err != nil {
+		return nil, err
+	}
+	return kept, nil
+}
+
+// keptPath returns the location of the kept state of the overlay
+func (o *Overlay) keptPath() string {
+	return o.BaseDir + KeptRootSuffix
+}
+
+// rootKey identifies what the build root was set up from: the backing image
+// and the build dependencies of the recipe. An empty key is never reused.
+func (p *Package) rootKey(o *Overlay) string {
+	st, err := os.Stat(o.Back.ImagePath)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%s\n", o.Back.ImagePath, st.ModTime().UnixNano(), p.Type)
+	if o.RootfsBackend == RootfsBtrfs {
+		fmt.Fprintln(h, RootfsBtrfs)
+	}
+	if p.Type == PackageTypeYpkg {
+		recipe, err := NewStackRecipe(p.Path)
+		if err != nil {
+			return ""
+		}
+		deps := append([]string{}, recipe.BuildDeps...)
+		sort.Strings(deps)
+		fmt.Fprintln(h, strings.Join(deps, "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// keptRootUsable determines whether the package has a kept root within its
+// window, set up from the same image and build dependencies.
+func (p *Package) keptRootUsable(o *Overlay) bool {
+	kept, err := readKeptRoot(o.keptPath())
+	switch {
+	case err != nil:
+		return false
+	case time.Now().After(kept.Expires):
+		log.Debugln("Kept build root has expired")
+		return false
+	case kept.Key == "" || kept.Key != p.rootKey(o):
+		log.Infoln("Image or build dependencies changed, not reusing the kept build root")
+		return false
+	}
+	return PathExists(o.UpperDir)
+}
+
+// reuseRoot determines whether the kept root of the package can be reused.
+// The kept state is consumed either way, so that an interrupted build never
+// leaves a half finished root behind for reuse.
+func (p *Package) reuseRoot(o *Overlay) bool {
+	if !PathExists(o.keptPath()) {
+		return false
+	}
+	reuse := KeepRoot > 0 && !o.EnableTmpfs && p.keptRootUsable(o)
+	os.Remove(o.keptPath())
+	return reuse
+}
+
+// keepRoot will record the build root of the package as reusable for the
+// KeepRoot window, and start the janitor to tear it down afterwards.
+func (p *Package) keepRoot(o *Overlay) error {
+	kept := &keptRoot{
+		Key:     p.rootKey(o),
+		Expires: time.Now().Add(KeepRoot),
+	}
+	if kept.Key == "" {
+		return errors.New("Unable to identify the build root")
+	}
+	b, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(o.keptPath(), b, 00644); err != nil {
+		return err
+	}
+	log.Infof("Keeping the build root until %s\n", kept.Expires.Format("15:04:05"))
+	return StartJanitor()
+}
+
+// StartJanitor will start "solbuild teardown --wait" in the background, which
+// tears down kept build roots as their windows pass. Only one janitor runs
+// at a time, any other exits straight away.
+func StartJanitor() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "teardown", "--wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start the janitor, reason: %s", err)
+	}
+	return cmd.Process.Release()
+}
+
+// TearDownKeptRoots will remove every kept build root beneath the overlay
+// root whose window has passed, or all of them. Roots in use by a build are
+// skipped. The time the next kept root expires is returned, if any remain.
+func TearDownKeptRoots(overlayRoot string, all bool) (next time.Time, err error) {
+	paths, err := filepath.Glob(filepath.Join(overlayRoot, "*", "*"+KeptRootSuffix))
+	if err != nil {
+		return next, err
+	}
+	now := time.Now()
+	pending := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	for _, path := range paths {
+		dir := strings.TrimSuffix(path, KeptRootSuffix)
+		lock, err := NewLockFile(dir + ".lock")
+		if err != nil {
+			return next, err
+		}
+		if err := lock.Lock(); err != nil {
+			log.Debugf("Kept build root %s is in use\n", dir)
+			pending(now.Add(janitorRecheck))
+			continue
+		}
+		// The state may have been consumed or refreshed since listing
+		if kept, err := readKeptRoot(path); err == nil && !all && now.Before(kept.Expires) {
+			pending(kept.Expires)
+		} else {
+			log.Infof("Tearing down kept build root %s\n", dir)
+			if err := removeBuildRoot(dir); err != nil {
+				log.Errorf("Failed to remove kept build root %s, reason: %s\n", dir, err)
+			}
+			os.Remove(path)
+		}
+		lock.Unlock()
+		lock.Clean()
+	}
+	return next, nil
+}
+
+// RunJanitor will tear down the kept build roots beneath the overlay root as
+// their windows pass, returning once none are left.
+func RunJanitor(overlayRoot string) error {
+	lock, err := NewLockFile(filepath.Join(overlayRoot, "janitor.lock"))
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		log.Debugln("Janitor is already running")
+		return nil
+	}
+	defer func() {
+		lock.Unlock()
+		lock.Clean()
+	}()
+	for {
+		next, err := TearDownKeptRoots(overlayRoot, false)
+		if err != nil || next.IsZero() {
+			return err
+		}
+		time.Sleep(time.Until(next))
+	}
+}
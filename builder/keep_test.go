@@ -0,0 +1,77 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeKeptRoot(t *testing.T, dir string, expires time.Time) {
+	writeTestFile(t, filepath.Join(dir, "tmp", "usr", "bin", "gcc"), "")
+	b, err := json.Marshal(&keptRoot{Key: "key", Expires: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+KeptRootSuffix, b, 00644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseKeepRoot(t *testing.T) {
+	if d, err := ParseKeepRoot(""); err != nil || d != 0 {
+		t.Fatalf("Empty window should disable kept roots, got %s %v", d, err)
+	}
+	if d, err := ParseKeepRoot("10m"); err != nil || d != 10*time.Minute {
+		t.Fatalf("Expected 10m, got %s %v", d, err)
+	}
+	for _, window := range []string{"10", "-5m", "soon"} {
+		if _, err := ParseKeepRoot(window); err != ErrInvalidKeepRoot {
+			t.Fatalf("Window %s should be invalid", window)
+		}
+	}
+}
+
+func TestTearDownKeptRoots(t *testing.T) {
+	root := t.TempDir()
+	expired := filepath.Join(root, "main-x86_64", "nano")
+	kept := filepath.Join(root, "main-x86_64", "zlib")
+	expires := time.Now().Add(time.Hour)
+	writeKeptRoot(t, expired, time.Now().Add(-time.Minute))
+	writeKeptRoot(t, kept, expires)
+
+	next, err := TearDownKeptRoots(root, false)
+	if err != nil {
+		t.Fatalf("Failed to tear down kept roots: %s", err)
+	}
+	if PathExists(expired) || PathExists(expired+KeptRootSuffix) {
+		t.Fatalf("Expired root should have been torn down")
+	}
+	if !PathExists(kept) || !next.Equal(expires) {
+		t.Fatalf("Root within its window should be kept until %s, got %s", expires, next)
+	}
+
+	if next, err = TearDownKeptRoots(root, true); err != nil {
+		t.Fatalf("Failed to tear down kept roots: %s", err)
+	}
+	if PathExists(kept) || !next.IsZero() {
+		t.Fatalf("Every root should have been torn down")
+	}
+}
@@ -0,0 +1,146 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// LanguageCaches are the language dependency caches given to builds
+	LanguageCaches []string
+
+	// LanguageCacheSize is the size each language cache may grow to, or 0
+	// for no limit
+	LanguageCacheSize int64
+
+	// ErrUnknownLanguageCache is returned for a language cache we can't provide
+	ErrUnknownLanguageCache = errors.New("Unknown language cache, use go, maven, npm or pip")
+
+	// languageCaches map each language cache to the environment pointing its
+	// tools at the cache directory
+	languageCaches = map[string]func(dir string) []string{
+		"go": func(dir string) []string {
+			// Modules are read-only by default, which would stop us pruning
+			return []string{"GOMODCACHE=" + filepath.Join(dir, "mod"), "GOFLAGS=-modcacherw"}
+		},
+		"maven": func(dir string) []string {
+			return []string{"MAVEN_OPTS=-Dmaven.repo.local=" + filepath.Join(dir, "repository")}
+		},
+		"npm": func(dir string) []string {
+			return []string{"npm_config_cache=" + filepath.Join(dir, "npm"), "YARN_CACHE_FOLDER=" + filepath.Join(dir, "yarn")}
+		},
+		"pip": func(dir string) []string {
+			return []string{"PIP_CACHE_DIR=" + dir}
+		},
+	}
+)
+
+// ValidLanguageCaches will ensure we know every language cache named
+func ValidLanguageCaches(names []string) error {
+	for _, name := range names {
+		if _, ok := languageCaches[name]; !ok {
+			return fmt.Errorf("%s: %s", ErrUnknownLanguageCache, name)
+		}
+	}
+	return nil
+}
+
+// GetLanguageCacheDirInternal returns the chroot-internal directory of the
+// language cache
+func (p *Package) GetLanguageCacheDirInternal(name string) string {
+	return filepath.Join(BuildUserHome, ".cache", "solbuild", name)
+}
+
+// languageCacheEnvironment returns the environment of the build for the
+// enabled language caches
+func (p *Package) languageCacheEnvironment() []string {
+	if p.Type != PackageTypeYpkg {
+		return nil
+	}
+	var env []string
+	for _, name := range LanguageCaches {
+		env = append(env, languageCaches[name](p.GetLanguageCacheDirInternal(name))...)
+	}
+	return env
+}
+
+// BindLanguageCaches will make the enabled language caches available to the
+// build, each kept in its own directory on the host.
+func (p *Package) BindLanguageCaches(o *Overlay) error {
+	if p.Type != PackageTypeYpkg {
+		return nil
+	}
+	for _, name := range LanguageCaches {
+		source := filepath.Join(LanguageCacheDirectory, name)
+		if err := bindUserCache(o, source, p.GetLanguageCacheDirInternal(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheUsage returns the size of the files within the directory
+func cacheUsage(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// PruneLanguageCache will empty the cache once it has grown beyond the
+// limit. Partially removing a module or package would leave it broken
+// within the cache, so the cache is instead rebuilt by the next builds
+// from what they still use.
+func PruneLanguageCache(dir string, limit int64) error {
+	if limit <= 0 {
+		return nil
+	}
+	size := cacheUsage(dir)
+	if size <= limit {
+		return nil
+	}
+	log.Infof("Emptying %s, %.1f GiB exceeds the limit of %.1f GiB\n", dir, float64(size)/(1<<30), float64(limit)/(1<<30))
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneLanguageCaches will keep the enabled language caches within their limit
+func pruneLanguageCaches() {
+	for _, name := range LanguageCaches {
+		if err := PruneLanguageCache(filepath.Join(LanguageCacheDirectory, name), LanguageCacheSize); err != nil {
+			log.Warnf("Unable to prune the %s cache, reason: %s\n", name, err)
+		}
+	}
+}
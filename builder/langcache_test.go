@@ -0,0 +1,58 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLanguageCacheEnvironment(t *testing.T) {
+	if err := ValidLanguageCaches([]string{"go", "cobol"}); err == nil {
+		t.Fatalf("Unknown language caches should be refused")
+	}
+	LanguageCaches = []string{"go", "pip"}
+	defer func() { LanguageCaches = nil }()
+	pkg := &Package{Name: "hugo", Type: PackageTypeYpkg}
+	env := strings.Join(pkg.languageCacheEnvironment(), " ")
+	if env != "GOMODCACHE=/home/build/.cache/solbuild/go/mod GOFLAGS=-modcacherw PIP_CACHE_DIR=/home/build/.cache/solbuild/pip" {
+		t.Fatalf("Unexpected environment %s", env)
+	}
+	pkg.Type = PackageTypeXML
+	if env := pkg.languageCacheEnvironment(); len(env) != 0 {
+		t.Fatalf("Legacy builds should have no language caches, got %v", env)
+	}
+}
+
+func TestPruneLanguageCache(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "mod", "example.com", "a@v1", "a.go"), strings.Repeat("a", 600))
+	writeTestFile(t, filepath.Join(dir, "mod", "example.com", "b@v1", "b.go"), strings.Repeat("b", 600))
+	if err := PruneLanguageCache(dir, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if cacheUsage(dir) != 1200 {
+		t.Fatalf("A cache within its limit should be kept")
+	}
+	if err := PruneLanguageCache(dir, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if cacheUsage(dir) != 0 || !PathExists(dir) {
+		t.Fatalf("A cache beyond its limit should be emptied")
+	}
+}
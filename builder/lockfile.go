@@ -19,10 +19,12 @@ package builder
 import (
 	"errors"
 	"fmt"
+	log "github.com/DataDrake/waterlog"
 	"os"
 	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var (
@@ -127,6 +129,19 @@ func (l *LockFile) Lock() error {
 	return l.writePID()
 }
 
+// Wait will block until the file can be locked, trying again each interval
+// while another process holds it.
+func (l *LockFile) Wait(interval time.Duration) error {
+	for {
+		err := l.Lock()
+		if err != ErrOwnedLockFile && err != syscall.EWOULDBLOCK {
+			return err
+		}
+		log.Debugf("Waiting for %s, locked by %s\n", l.path, l.GetOwnerProcess())
+		time.Sleep(interval)
+	}
+}
+
 // Unlock will attempt to unlock the file, or return an error if this fails
 func (l *LockFile) Unlock() error {
 	if l.fd == nil || !l.owner {
@@ -0,0 +1,252 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// LogFormatText is the usual human readable log output
+	LogFormatText = "text"
+
+	// LogFormatJSON emits every log message, and every line of output from
+	// the container, as a JSON object on a line of its own
+	LogFormatJSON = "json"
+
+	// PhaseTest runs the install test of the built packages, and is only
+	// used to label log events as it shares the timeout of the build
+	PhaseTest = "test"
+
+	// PhaseCollect checks and collects the built packages, and is only used
+	// to label log events as it shares the timeout of the build
+	PhaseCollect = "collect"
+)
+
+var (
+	// ErrUnknownLogFormat is returned for an unsupported log format
+	ErrUnknownLogFormat = errors.New("Log format must be \"text\" or \"json\"")
+
+	// Stdout is the standard output of solbuild. With the JSON log format it
+	// carries the events alone, while os.Stdout is pointed at stderr so that
+	// nothing else written to it, by ourselves or by the tools we run on the
+	// host, can corrupt them.
+	Stdout = os.Stdout
+
+	// logEvents is set when log messages are emitted as JSON events
+	logEvents bool
+
+	// logEventLock keeps events from the log and the container whole
+	logEventLock sync.Mutex
+
+	// logContext is the package and phase events are labelled with
+	logContext struct {
+		sync.Mutex
+		phase string
+		pkg   string
+	}
+
+	// waterlogRecord matches a message written by waterlog in the
+	// uncoloured format without timestamps, capturing the level and message
+	// from between the symbol and powerline separators
+	waterlogRecord = regexp.MustCompile(`(?s)^ \S+ .*?\b(DEBUG|ERROR|FATAL|GOOD|INFO|PANIC|WARNING) +(?:\x{e0b2} )?(.*)$`)
+)
+
+// A LogEvent is a single message of the JSON log
+type LogEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Severity  string    `json:"severity"`          // Level of the message, or "output" from the container
+	Phase     string    `json:"phase,omitempty"`   // Phase of the build, if started
+	Package   string    `json:"package,omitempty"` // Package being built, if any
+	Stream    string    `json:"stream,omitempty"`  // "stdout" or "stderr" for output from the container
+	Message   string    `json:"message"`
+}
+
+// SetLogFormat will switch the log output to the given format, which must
+// happen before the manager is created so that redaction still applies.
+func SetLogFormat(name string) error {
+	switch name {
+	case "", LogFormatText:
+		return nil
+	case LogFormatJSON:
+	default:
+		return ErrUnknownLogFormat
+	}
+	if logEvents {
+		return nil
+	}
+	if err := separateEvents(); err != nil {
+		return err
+	}
+	logEvents = true
+	DisableColors = true
+	// Timestamps are added by the events themselves
+	log.SetFormat(format.Un)
+	log.SetFlags(0)
+	SetLogOutput(Stdout)
+	return nil
+}
+
+// separateEvents will keep the standard output for the events, by moving it
+// to a new descriptor and pointing the original at stderr instead. Every
+// process we spawn inherits the latter, so the output of git, eopkg, hooks
+// and the like ends up on stderr without each of them being wrapped.
+func separateEvents() error {
+	fd, err := syscall.Dup(int(os.Stdout.Fd()))
+	if err != nil {
+		return err
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.Dup3(int(os.Stderr.Fd()), int(os.Stdout.Fd()), 0); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	Stdout = os.NewFile(uintptr(fd), "/dev/stdout")
+	return nil
+}
+
+// SetLogOutput will send our own log messages to the writer, as events if
+// the JSON log format is in use
+func SetLogOutput(w io.Writer) {
+	if logEvents {
+		w = logEventWriter{w}
+	}
+	LogOutput = w
+	log.SetOutput(w)
+}
+
+// setLogPackage labels the following events with the package
+func setLogPackage(name string) {
+	logContext.Lock()
+	logContext.pkg = name
+	logContext.Unlock()
+}
+
+// setLogPhase labels the following events with the phase of the build
+func setLogPhase(phase string) {
+	logContext.Lock()
+	logContext.phase = phase
+	logContext.Unlock()
+}
+
+// emitLogEvent writes the event to w as a line of JSON
+func emitLogEvent(w io.Writer, severity, stream, message string) error {
+	logContext.Lock()
+	event := LogEvent{
+		Timestamp: time.Now().UTC(),
+		Severity:  severity,
+		Phase:     logContext.phase,
+		Package:   logContext.pkg,
+		Stream:    stream,
+		Message:   message,
+	}
+	logContext.Unlock()
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	logEventLock.Lock()
+	defer logEventLock.Unlock()
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// logEventWriter turns each message written by waterlog into an event
+type logEventWriter struct {
+	w io.Writer
+}
+
+// Write will emit the message as an event
+func (l logEventWriter) Write(p []byte) (int, error) {
+	severity, message := "info", string(p)
+	if match := waterlogRecord.FindStringSubmatch(message); match != nil {
+		severity, message = strings.ToLower(match[1]), match[2]
+	}
+	if err := emitLogEvent(l.w, severity, "", strings.TrimRight(message, "\r\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// An OutputEventWriter frames the output of the container as events, one
+// for each line of output
+type OutputEventWriter struct {
+	w      io.Writer
+	stream string
+	buf    bytes.Buffer
+	mut    sync.Mutex
+}
+
+// NewOutputEventWriter will wrap the given writer for the named stream
+func NewOutputEventWriter(w io.Writer, stream string) *OutputEventWriter {
+	return &OutputEventWriter{w: w, stream: stream}
+}
+
+// Write will buffer the data, emitting any complete lines
+func (o *OutputEventWriter) Write(p []byte) (int, error) {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	o.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(o.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(o.buf.Next(idx + 1))
+		if err := emitLogEvent(o.w, "output", o.stream, strings.TrimRight(line, "\r\n")); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush will emit any remaining partial line
+func (o *OutputEventWriter) Flush() error {
+	o.mut.Lock()
+	defer o.mut.Unlock()
+	if o.buf.Len() == 0 {
+		return nil
+	}
+	err := emitLogEvent(o.w, "output", o.stream, strings.TrimRight(o.buf.String(), "\r"))
+	o.buf.Reset()
+	return err
+}
+
+// containerOutput returns the writers for the output of the container,
+// which must be flushed once the command is done
+func containerOutput() (stdout, stderr io.Writer, flush func()) {
+	if !logEvents {
+		return os.Stdout, os.Stderr, func() {}
+	}
+	out := NewOutputEventWriter(Stdout, "stdout")
+	errs := NewOutputEventWriter(Stdout, "stderr")
+	return out, errs, func() {
+		out.Flush()
+		errs.Flush()
+	}
+}
@@ -0,0 +1,81 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"strings"
+	"testing"
+)
+
+func decodeLogEvents(t *testing.T, data string) []LogEvent {
+	var events []LogEvent
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		var event LogEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Invalid event %q: %s", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestLogEventWriter(t *testing.T) {
+	defer setLogPackage("")
+	defer setLogPhase("")
+	setLogPackage("nano")
+	setLogPhase(PhaseBuild)
+
+	var buf bytes.Buffer
+	l := waterlog.New(logEventWriter{&buf}, "", 0)
+	l.SetFormat(format.Un)
+	l.SetLevel(level.Debug)
+	l.Warnf("Disk is %s\n", "nearly full")
+	l.Errorln("Build failed, badly")
+	events := decodeLogEvents(t, buf.String())
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if e := events[0]; e.Severity != "warning" || e.Message != "Disk is nearly full" || e.Package != "nano" || e.Phase != PhaseBuild {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	if e := events[1]; e.Severity != "error" || e.Message != "Build failed, badly" || e.Timestamp.IsZero() {
+		t.Errorf("Unexpected event %+v", e)
+	}
+}
+
+func TestOutputEventWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewOutputEventWriter(&buf, "stderr")
+	w.Write([]byte("checking for gcc... "))
+	w.Write([]byte("yes\r\nmake: all\npartial"))
+	w.Flush()
+	events := decodeLogEvents(t, buf.String())
+	want := []string{"checking for gcc... yes", "make: all", "partial"}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %d", len(want), len(events))
+	}
+	for i, e := range events {
+		if e.Message != want[i] || e.Stream != "stderr" || e.Severity != "output" {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	}
+}
@@ -14,13 +14,13 @@
 // limitations under the License.
 //
 
-// Package builder provides all the solbuild specific functionality
 package builder
 
 import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // DisableColors controls whether or not to use colours in the display.
@@ -30,6 +30,14 @@ var DisableColors bool
 // Controls whether or not we generate an ABI report.
 var DisableABIReport bool
 
+// Controls whether the ABI report is compared against that of the previous
+// release, failing the build if anything was removed.
+var CheckABIBreaks bool
+
+// Controls whether the collected artifacts have their modification times
+// clamped to SOURCE_DATE_EPOCH.
+var ClampMtimes bool
+
 const (
 	// ImagesDir is where we keep the rootfs images for build profiles
 	ImagesDir = "/var/lib/solbuild/images"
@@ -40,6 +48,9 @@ const (
 	// ImageCompressedSuffix is the common suffix for a fetched evobuild image
 	ImageCompressedSuffix = ".img.xz"
 
+	// ImageSquashfsSuffix is the suffix of images kept as a compressed squashfs
+	ImageSquashfsSuffix = ".sqfs"
+
 	// ImageBaseURI is the storage area for base images
 	ImageBaseURI = "https://solbuild.getsol.us"
 
@@ -51,6 +62,9 @@ const (
 	// PackageCacheDirectory is where we share packages between all builders
 	PackageCacheDirectory = "/var/lib/solbuild/packages"
 
+	// HistoryCacheDirectory is where parsed package git histories are cached
+	HistoryCacheDirectory = "/var/lib/solbuild/history"
+
 	// CcacheDirectory is the system wide ccache directory
 	CcacheDirectory = "/var/lib/solbuild/ccache/ypkg"
 
@@ -62,6 +76,22 @@ const (
 
 	// LegacySccacheDirectory is the root owned ccache directory for pspec.xml
 	LegacySccacheDirectory = "/var/lib/solbuild/sccache/legacy"
+
+	// CargoDirectory holds the cargo registry, git checkouts and target
+	// directories shared between package.yml builds
+	CargoDirectory = "/var/lib/solbuild/cargo"
+
+	// LanguageCacheDirectory holds a directory for each language dependency
+	// cache, i.e. go or npm
+	LanguageCacheDirectory = "/var/lib/solbuild/langcache"
+
+	// StatisticsDirectory holds the statistics recorded of every package
+	// built, i.e. its sizes
+	StatisticsDirectory = "/var/lib/solbuild/statistics"
+
+	// RecipeDirectory holds the clones of remote packaging repositories, and
+	// a checkout of each revision built from them
+	RecipeDirectory = "/var/lib/solbuild/recipes"
 )
 
 const (
@@ -100,14 +130,15 @@ func PathExists(path string) bool {
 	return false
 }
 
-// IsValidImage will check if the specified profile is a valid one.
+// IsValidImage will check if the specified profile is a valid one, being
+// either a published image or one created locally with "image create".
 func IsValidImage(profile string) bool {
 	for _, p := range ValidImages {
 		if p == profile {
 			return true
 		}
 	}
-	return false
+	return profile != "" && !strings.Contains(profile, "/") && NewBackingImage(profile).IsInstalled()
 }
 
 // EmitImageError emits the stock response to requesting an invalid image
@@ -141,12 +172,19 @@ func EmitProfileError(p string) {
 
 // A BackingImage is the core of any given profile
 type BackingImage struct {
-	Name        string // Name of the profile
-	ImagePath   string // Absolute path to the .img file
-	ImagePathXZ string // Absolute path to the .img.xz file
-	ImageURI    string // URI of the image origin
-	RootDir     string // Where to mount the backing image for updates
-	LockPath    string // Our lock path for update operations
+	Name              string // Name of the profile
+	ImagePath         string // Absolute path to the image in use, .img or .sqfs
+	ImagePathExt4     string // Absolute path to the .img file
+	ImagePathXZ       string // Absolute path to the .img.xz file
+	ImagePathSquashfs string // Absolute path to the .sqfs file
+	ImageURI          string // URI of the image origin
+	ImageURISquashfs  string // URI of the squashfs image, should the origin publish one
+	RootDir           string // Where to mount the backing image for updates
+	LockPath          string // Our lock path for update operations
+	Squashfs          bool   // Whether the image is kept as a read-only squashfs
+
+	updated bool             // Whether the last update changed the image
+	pinned  *ImageGeneration // Previous generation the image is pinned to, if any
 }
 
 // IsInstalled will determine whether the given backing image has been installed
@@ -163,12 +201,19 @@ func (b *BackingImage) IsFetched() bool {
 // NewBackingImage will return a correctly configured backing image for
 // usage.
 func NewBackingImage(name string) *BackingImage {
-	return &BackingImage{
-		Name:        name,
-		ImagePath:   filepath.Join(ImagesDir, name+ImageSuffix),
-		ImagePathXZ: filepath.Join(ImagesDir, name+ImageCompressedSuffix),
-		ImageURI:    fmt.Sprintf("%s/%s%s", ImageBaseURI, name, ImageCompressedSuffix),
-		LockPath:    filepath.Join(ImagesDir, name+".lock"),
-		RootDir:     filepath.Join(ImageRootsDir, name),
+	b := &BackingImage{
+		Name:              name,
+		ImagePathExt4:     filepath.Join(ImagesDir, name+ImageSuffix),
+		ImagePathXZ:       filepath.Join(ImagesDir, name+ImageCompressedSuffix),
+		ImagePathSquashfs: filepath.Join(ImagesDir, name+ImageSquashfsSuffix),
+		ImageURI:          fmt.Sprintf("%s/%s%s", ImageBaseURI, name, ImageCompressedSuffix),
+		ImageURISquashfs:  fmt.Sprintf("%s/%s%s", ImageBaseURI, name, ImageSquashfsSuffix),
+		LockPath:          filepath.Join(ImagesDir, name+".lock"),
+		RootDir:           filepath.Join(ImageRootsDir, name),
+	}
+	b.ImagePath = b.ImagePathExt4
+	if PathExists(b.ImagePathSquashfs) {
+		b.useSquashfs()
 	}
+	return b
 }
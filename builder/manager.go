@@ -18,8 +18,10 @@ package builder
 
 import (
 	"errors"
+	"fmt"
 	log "github.com/DataDrake/waterlog"
 	"github.com/getsolus/libosdev/disk"
+	"github.com/getsolus/solbuild/builder/source"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -51,6 +53,9 @@ var (
 
 	// ErrInterrupted is returned when the build is interrupted
 	ErrInterrupted = errors.New("The operation was cancelled by the user")
+
+	// ErrInvalidMemSize is returned when the tmpfs size is malformed
+	ErrInvalidMemSize = errors.New("Invalid memory size specified")
 )
 
 // A Manager is responsible for cleanly managing the entire session within solbuild,
@@ -68,15 +73,29 @@ type Manager struct {
 	lock       *sync.Mutex   // Lock on all operations to prevent.. damage.
 	profile    *Profile      // The profile we've been requested to use
 
-	lockfile *LockFile // We track the global lock for each operation
-	didStart bool      // Whether we got anything done.
+	lockfile    *LockFile // We track the global lock for each operation
+	sourcesLock *os.File  // Shared lock on the sources while building
+	didStart    bool      // Whether we got anything done.
 
 	cancelled  bool // Whether or not we've been cancelled
 	updateMode bool // Whether we're just updating an image
 
 	history *PackageHistory // Given package history, if any
+	zram    *ZramSwap       // Temporary swap for the build, if any
+	cgroup  *BuildCgroup    // Resource limits of the build, if any
+
+	watchdog *BuildWatchdog // Timeouts of the build, if any
 
 	manifestTarget string // Generate manifest if set
+	locked         bool   // Enforce the environment lockfile
+	historyDepth   int    // Override the changelog depth if set
+	imageVersion   string // Generation of the image to build against, if pinned
+	noSignals      bool   // Leave signal handling to the embedding program
+
+	chrootCommand []string // Command to run instead of the chroot shell, if any
+	chrootNoTTY   bool     // Run the chroot command without a terminal
+
+	dirty []string // Uncommitted changes of the recipe, refused by Build
 
 	activePID int // Active PID
 }
@@ -103,6 +122,18 @@ func NewManager() (*Manager, error) {
 		return nil, err
 	}
 
+	if Rootless {
+		if err := PrepareRootless(man.Config); err != nil {
+			log.Errorf("Failed to prepare rootless build %s\n", err)
+			return nil, err
+		}
+	}
+
+	if err := ConfigureRedaction(man.Config); err != nil {
+		log.Errorf("Failed to configure redaction %s\n", err)
+		return nil, err
+	}
+
 	man.lock = new(sync.Mutex)
 	return man, nil
 }
@@ -122,6 +153,48 @@ func (m *Manager) SetManifestTarget(target string) {
 	m.manifestTarget = strings.TrimSpace(target)
 }
 
+// SetLocked will require that builds take place in the exact environment
+// recorded by the lockfile next to the package recipe.
+func (m *Manager) SetLocked(locked bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.locked = locked
+}
+
+// SetHistoryDepth will override the maximum number of changelog entries
+// provided to the build. This must be called prior to SetPackage.
+func (m *Manager) SetHistoryDepth(depth int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.historyDepth = depth
+}
+
+// SetChrootCommand will run the given command within the build root, rather
+// than an interactive shell, when Chroot is called. Without a terminal the
+// command may be driven entirely through its stdin and stdout.
+func (m *Manager) SetChrootCommand(command []string, noTTY bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.chrootCommand = command
+	m.chrootNoTTY = noTTY
+}
+
+// getHistoryDepth will return the changelog depth to use for the package,
+// preferring the command line, then solbuild.yml, then the profile, and
+// finally the config.
+func (m *Manager) getHistoryDepth(pkg *Package) int {
+	var override int
+	if pkg.Overrides != nil {
+		override = pkg.Overrides.HistoryDepth
+	}
+	for _, depth := range []int{m.historyDepth, override, m.profile.HistoryDepth, m.Config.HistoryDepth} {
+		if depth != 0 {
+			return depth
+		}
+	}
+	return MaxChangelogEntries
+}
+
 // SetProfile will attempt to initialise the manager with a given profile
 // Currently this is locked to a backing image specification, but in future
 // will be expanded to support profiles *based* on backing images.
@@ -146,12 +219,26 @@ func (m *Manager) SetProfile(profile string) error {
 		return ErrInvalidImage
 	}
 
+	if err := source.ValidIPFamily(prof.IPFamily); err != nil {
+		log.Errorf("Invalid profile %s, reason: %s\n", profile, err)
+		return err
+	}
+
+	if err := ValidRootfsBackend(prof.RootfsBackend); err != nil {
+		log.Errorf("Invalid profile %s, reason: %s\n", profile, err)
+		return err
+	}
+
 	if m.image != nil {
 		return ErrManagerInitialised
 	}
 
 	m.profile = prof
 	m.image = NewBackingImage(m.profile.Image)
+	if prof.Backend != "" {
+		m.Config.Backend = prof.Backend
+	}
+	source.SubmoduleRewrites = prof.SubmoduleRewrites
 	return nil
 }
 
@@ -177,24 +264,116 @@ func (m *Manager) SetPackage(pkg *Package) error {
 	}
 
 	// Obtain package history for git builds
+	patterns := m.Config.HistoryTagPatterns
+	if len(m.profile.HistoryTagPatterns) > 0 {
+		patterns = m.profile.HistoryTagPatterns
+	}
+	if err := SetHistoryTagPatterns(patterns); err != nil {
+		log.Errorf("Failed to configure history, reason: %s\n", err)
+		return err
+	}
+
 	if pkg.Type == PackageTypeYpkg {
-		repoDir := filepath.Dir(pkg.Path)
-		if PathExists(filepath.Join(repoDir, ".git")) {
-			if history, err := NewPackageHistory(pkg.Path); err == nil {
-				log.Debugln("Obtained package history")
-				m.history = history
-			} else {
-				log.Warnf("Failed to obtain package git history %s\n", err)
+		if history, err := LoadPackageHistory(pkg.Path, m.getHistoryDepth(pkg)); err == nil {
+			log.Debugln("Obtained package history")
+			if m.Config.CVEDatabase != "" {
+				history.EnrichCVEs(NewCVEDatabase(m.Config.CVEDatabase, m.Config.CVEFetch))
 			}
+			m.history = history
+		} else {
+			log.Warnf("Failed to obtain package history %s\n", err)
 		}
 	}
 
+	if changes := recipeChanges(pkg.Path); len(changes) > 0 {
+		if err := m.allowDirty(pkg, changes); err != nil {
+			return err
+		}
+	}
+
+	if m.Config.RequireSigned && m.manifestTarget != "" {
+		m.checkCommitTrust(pkg)
+	}
+
+	m.configureConsensus(pkg)
+	m.configureCheckRetries(pkg)
+	if err := m.pinImage(pkg); err != nil {
+		return err
+	}
+
 	m.pkg = pkg
+	setLogPackage(pkg.Name)
 	m.overlay = NewOverlay(m.Config, m.profile, m.image, m.pkg)
 	m.pkgManager = NewEopkgManager(m, m.overlay.MountPoint)
 	return nil
 }
 
+// allowDirty will taint the package with the uncommitted changes to its
+// recipe if permitted, otherwise remember them for Build to refuse.
+func (m *Manager) allowDirty(pkg *Package, changes []string) error {
+	if !AllowDirty {
+		m.dirty = changes
+		return nil
+	}
+	if m.manifestTarget != "" {
+		log.Errorln("Transit manifests cannot be written for uncommitted changes")
+		return ErrTaintedManifest
+	}
+	pkg.Changes = changes
+	if m.history != nil {
+		if err := m.history.AddDirtyUpdate(pkg); err != nil {
+			return fmt.Errorf("Failed to add history for uncommitted changes, reason: %s\n", err)
+		}
+	}
+	log.Warnf("Building %d uncommitted change(s), packages will be tainted\n", len(changes))
+	return nil
+}
+
+// checkCommitTrust will mark the package as not publishable unless the HEAD
+// commit of its recipe is signed by a trusted key.
+func (m *Manager) checkCommitTrust(pkg *Package) {
+	if err := VerifyCommit(filepath.Dir(pkg.Path), "HEAD"); err != nil {
+		pkg.Untrusted = err.Error()
+		log.Warnf("Recipe commit is not trusted, packages won't be publishable: %s\n", err)
+		return
+	}
+	log.Debugln("Recipe commit is signed by a trusted key")
+}
+
+// configureConsensus will require mirror consensus on the sources of the
+// package if the profile marks it as high value.
+func (m *Manager) configureConsensus(pkg *Package) {
+	source.SourceMirrors = m.profile.SourceMirrors
+	source.ConsensusRequired = 0
+	for _, name := range m.profile.ConsensusPackages {
+		if name != "*" && name != pkg.Name {
+			continue
+		}
+		source.ConsensusRequired = m.profile.Consensus
+		if source.ConsensusRequired < 2 {
+			source.ConsensusRequired = 2
+		}
+		log.Debugf("Requiring %d-way mirror consensus for sources\n", source.ConsensusRequired)
+		return
+	}
+}
+
+// configureCheckRetries will allow the check stage of the package to be
+// retried if the profile marks it as flaky.
+func (m *Manager) configureCheckRetries(pkg *Package) {
+	CheckRetries = 0
+	for _, name := range m.profile.CheckRetryPackages {
+		if name != "*" && name != pkg.Name {
+			continue
+		}
+		CheckRetries = m.profile.CheckRetries
+		if CheckRetries < 2 {
+			CheckRetries = 2
+		}
+		return
+	}
+}
+
 // IsCancelled will determine if the build has been cancelled, this will result
 // in a lot of locking between all operations
 func (m *Manager) IsCancelled() bool {
@@ -266,7 +445,29 @@ func (m *Manager) Cleanup() {
 	// Unmount anything we may have mounted
 	disk.GetMountManager().UnmountAll()
 
+	if m.zram != nil {
+		if err := m.zram.Remove(); err != nil {
+			log.Errorf("Failure in removing zram swap %s\n", err)
+		}
+		m.zram = nil
+	}
+
+	if m.watchdog != nil {
+		m.watchdog.Stop()
+	}
+
+	if m.cgroup != nil {
+		if err := m.cgroup.Remove(); err != nil {
+			log.Errorf("Failure in removing build cgroup %s\n", err)
+		}
+		m.cgroup = nil
+	}
+
 	// Finally clean out the lock files
+	if m.sourcesLock != nil {
+		m.sourcesLock.Close()
+		m.sourcesLock = nil
+	}
 	if m.lockfile != nil {
 		if err := m.lockfile.Unlock(); err != nil {
 			log.Errorf("Failure in unlocking root %s\n", err)
@@ -299,8 +500,24 @@ func (m *Manager) doLock(path, opType string) error {
 	return nil
 }
 
+// SetSignalHandling controls whether the Manager installs a handler for
+// SIGINT and SIGTERM that cleans up and exits the process. Programs that
+// embed the builder should disable this, and call SetCancelled and Cleanup
+// themselves.
+func (m *Manager) SetSignalHandling(enabled bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.noSignals = !enabled
+}
+
 // SigIntCleanup will take care of cleaning up the build process.
 func (m *Manager) SigIntCleanup() {
+	m.lock.Lock()
+	noSignals := m.noSignals
+	m.lock.Unlock()
+	if noSignals {
+		return
+	}
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -315,7 +532,7 @@ func (m *Manager) SigIntCleanup() {
 
 // Build will attempt to build the package associated with this manager,
 // automatically handling any required cleanups.
-func (m *Manager) Build() error {
+func (m *Manager) Build() (err error) {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
@@ -327,22 +544,486 @@ func (m *Manager) Build() error {
 	}
 	m.lock.Unlock()
 
+	if len(m.dirty) > 0 {
+		log.Errorf("Recipe has %d uncommitted change(s), commit them or use --allow-dirty to build them\n", len(m.dirty))
+		return ErrDirtyRecipe
+	}
+
 	// Now get on with the real work!
 	defer m.Cleanup()
 	m.SigIntCleanup()
 
 	// Now set our options according to the config
-	m.overlay.EnableTmpfs = m.Config.EnableTmpfs
-	m.overlay.TmpfsSize = m.Config.TmpfsSize
-	if ValidMemSize(m.overlay.TmpfsSize) != true && m.overlay.EnableTmpfs == true {
-		log.Fatalf("Invalid memory size specified: %s\n", m.overlay.TmpfsSize)
+	if err := m.setTmpfs(); err != nil {
+		return err
+	}
+	m.setRootfsBackend()
+	CrashArtifactsLimit = m.Config.CrashArtifactsLimit
+	ClampMtimes = m.Config.ClampMtimes
+	if !ValidSBOMFormat(m.Config.SBOMFormat) {
+		log.Errorf("Invalid SBOM format specified: %s\n", m.Config.SBOMFormat)
+		return ErrUnknownSBOMFormat
+	}
+	SBOMFormat = m.Config.SBOMFormat
+	if err := ValidHistoryFormats(m.Config.HistoryFormats); err != nil {
+		log.Errorf("%s\n", err)
+		return err
+	}
+	HistoryFormats = m.Config.HistoryFormats
+	SyncAppStreamReleases = m.Config.AppStreamReleases
+	if TraceBuild {
+		if err := CheckTracer(); err != nil {
+			return err
+		}
+	}
+	if err := m.setBackend(); err != nil {
+		return err
+	}
+	if err := m.setStageLimits(); err != nil {
+		return err
+	}
+	if !ValidPatchCheck(m.Config.PatchCheck) {
+		log.Errorf("Invalid patch check specified: %s\n", m.Config.PatchCheck)
+		return ErrUnknownPatchCheck
+	}
+	PatchCheck = m.Config.PatchCheck
+	PatchFuzz = m.Config.PatchFuzz
+	if PatchCheck != "" {
+		if err := CheckPatchTool(); err != nil {
+			return err
+		}
+	}
+	if !ValidSizeCheck(m.Config.SizeCheck) {
+		log.Errorf("Invalid size check specified: %s\n", m.Config.SizeCheck)
+		return ErrUnknownSizeCheck
+	}
+	SizeCheck = m.Config.SizeCheck
+	tmpSize, err := buildTmpSize(m.Config)
+	if err != nil {
+		log.Errorf("Invalid build TMPDIR size specified: %s\n", m.Config.BuildTmpSize)
+		return err
+	}
+	BuildTmpSize = tmpSize
+	SizeGrowthLimit = sizeGrowthLimit(m.Config)
+	minimum, err := sizeGrowthMinimum(m.Config)
+	if err != nil {
+		log.Errorf("Invalid size growth minimum specified: %s\n", err)
+		return err
+	}
+	SizeGrowthMinimum = minimum
+	SigningKey = ""
+	if m.Config.SignPackages {
+		if err := CheckSigningKey(m.Config.SigningKey); err != nil {
+			log.Errorf("Cannot sign packages, reason: %s\n", err)
+			return err
+		}
+		SigningKey = m.Config.SigningKey
+	}
+	keep, err := ParseKeepRoot(m.Config.KeepRoot)
+	if err != nil {
+		log.Errorf("Invalid keep_root window specified: %s\n", m.Config.KeepRoot)
+		return err
+	}
+	KeepRoot = keep
+	if KeepRoot > 0 && m.overlay.EnableTmpfs {
+		log.Warnln("Build roots in a tmpfs can't be kept after the build")
+		KeepRoot = 0
+	}
+	compression, err := NewCompression(m.Config.CompressionLevel, m.Config.CompressionThreads)
+	if err != nil {
+		log.Errorf("Invalid package compression specified: %s\n", err)
+		return err
+	}
+	PackageCompression = compression
+	if m.Config.InstallTest {
+		InstallTest = true
+	}
+	if err := ValidHooks(m.Config.Hooks); err != nil {
+		log.Errorf("Invalid hook specified: %s\n", err)
+		return err
+	}
+	ActiveHooks = m.Config.Hooks
+	MountSources = m.Config.MountSources
+	if m.Config.ExtractThreads < 0 {
+		log.Errorf("Invalid extraction threads specified: %d\n", m.Config.ExtractThreads)
+		return ErrInvalidExtractThreads
+	}
+	ExtractThreads = m.Config.ExtractThreads
+	ExtractCache = m.Config.ExtractCache
+	if err := ValidArtifactName(m.Config.ArtifactName); err != nil {
+		log.Errorf("Invalid artifact name specified: %s\n", err)
+		return err
+	}
+	ArtifactName = m.Config.ArtifactName
+	if !ValidCollision(m.Config.ArtifactCollision) {
+		log.Errorf("Invalid artifact collision policy specified: %s\n", m.Config.ArtifactCollision)
+		return ErrUnknownCollision
+	}
+	ArtifactCollision = CollisionOverwrite
+	if m.Config.ArtifactCollision != "" {
+		ArtifactCollision = m.Config.ArtifactCollision
+	}
+	if err := ValidCcacheSeedURL(m.Config.CcacheSeedURL); err != nil {
+		log.Errorf("Invalid ccache seed URL specified: %s\n", err)
+		return err
+	}
+	if m.Config.CcacheSeedURL != "" && m.Config.CcacheSeedKey == "" {
+		log.Errorln(ErrNoCcacheSeedKey)
+		return ErrNoCcacheSeedKey
+	}
+	CcacheSeedURL = m.Config.CcacheSeedURL
+	CcacheSeedKey = m.Config.CcacheSeedKey
+	if _, err := SccacheRemoteEnvironment(m.Config.SccacheRemote); err != nil {
+		log.Errorf("Invalid sccache remote specified: %s\n", err)
+		return err
+	}
+	SccacheRemote = m.Config.SccacheRemote
+	CargoTargetCache = m.Config.CargoTargetCache
+	if err := ValidLanguageCaches(m.Config.LanguageCaches); err != nil {
+		log.Errorf("Invalid language cache specified: %s\n", err)
+		return err
+	}
+	LanguageCaches = m.Config.LanguageCaches
+	if LanguageCacheSize, err = ParseSize(m.Config.LanguageCacheSize); err != nil {
+		log.Errorf("Invalid language cache size specified: %s\n", err)
+		return err
+	}
+	if err := m.setCPUBaseline(); err != nil {
+		return err
+	}
+	if _, err := ParseSize(m.profile.CcacheMaxSize); err != nil {
+		log.Errorf("Invalid ccache size in profile %s, reason: %s\n", m.profile.Name, err)
+		return err
+	}
+	CcacheMaxSize = m.profile.CcacheMaxSize
+	if m.Config.AdaptiveJobs {
+		AdaptiveJobs = &JobPolicy{GBPerJob: m.Config.GBPerJob, GBPerJobCxx: m.Config.GBPerJobCxx}
+	}
+	timeouts, err := NewBuildTimeouts(m.Config.Timeout, m.Config.FetchTimeout, m.Config.SetupTimeout, m.Config.BuildTimeout)
+	if err != nil {
+		log.Errorf("Invalid timeout specified: %s\n", err)
+		return err
+	}
+	webhooks, err := NewWebhooks(m.Config)
+	if err != nil {
+		log.Errorf("Invalid webhook specified: %s\n", err)
+		return err
+	}
+	if webhooks != nil {
+		webhooks.profile = m.profile.Name
+		ActiveWebhooks = webhooks
+		defer func() {
+			ActiveWebhooks = nil
+			webhooks.Close()
+		}()
+	}
+
+	network, err := NewNetworkPolicy(m.profile, m.pkg, m.manifestTarget != "")
+	if err != nil {
+		log.Errorf("Invalid network policy in profile %s, reason: %s\n", m.profile.Name, err)
+		return err
+	}
+	m.pkg.Network = network
+
+	environment, err := NewBuildEnvironment(m.profile, m.pkg)
+	if err != nil {
+		log.Errorf("Invalid environment in profile %s, reason: %s\n", m.profile.Name, err)
+		return err
+	}
+	m.pkg.Environment = environment
+
+	if Rootless && m.pkg.Type != PackageTypeYpkg {
+		log.Errorf("Cannot build %s without root\n", m.pkg.Name)
+		return ErrRootlessLegacy
+	}
+
+	stamp, err := NewBuildStamp(m.profile, m.image, m.pkg)
+	if err != nil {
+		log.Warnf("Unable to stamp the build, reason: %s\n", err)
+	} else if IfChanged {
+		outDir := CollisionDir
+		if outDir == "" {
+			outDir = "."
+		}
+		if stamp.upToDate(m.pkg, outDir) {
+			log.Goodf("Not building %s, nothing changed since it was built\n", m.pkg.Name)
+			return ErrUpToDate
+		}
 	}
 
 	if err := m.doLock(m.overlay.LockPath, "building"); err != nil {
 		return err
 	}
+	if m.sourcesLock, err = lockSources(false); err != nil {
+		log.Warnf("Unable to lock the sources against pruning, reason: %s\n", err)
+	}
+
+	started := time.Now()
+	webhooks.Emit(NewBuildEvent(EventStarted, m.pkg, m.profile.Name))
+	defer func() {
+		event := NewBuildEvent(EventFinished, m.pkg, m.profile.Name)
+		event.Success = err == nil
+		if err != nil {
+			event.Error = err.Error()
+		}
+		event.Duration = time.Since(started).Seconds()
+		webhooks.Emit(event)
+	}()
+
+	watchdog := m.startWatchdog(timeouts)
+
+	if m.Config.ZramSwapSize != "" && Rootless {
+		log.Warnln("Not enabling zram swap for a rootless build")
+	} else if m.Config.ZramSwapSize != "" {
+		m.enableZramSwap(m.Config.ZramSwapSize)
+	}
+
+	if err := m.enableBuildCgroup(); err != nil {
+		return err
+	}
+
+	envLock, err := m.newEnvironmentLock()
+	if err != nil {
+		return err
+	}
+
+	secrets, err := LoadSecrets(m.profile)
+	if err != nil {
+		return err
+	}
+
+	ccache := ReadCcacheStats(m.pkg.CcacheSource())
+	err = m.pkg.Build(m, m.history, m.GetProfile(), m.pkgManager, m.overlay, m.manifestTarget, envLock, secrets)
+	if err != nil && m.retryOnDisk() {
+		err = m.pkg.Build(m, m.history, m.GetProfile(), m.pkgManager, m.overlay, m.manifestTarget, envLock, secrets)
+	}
+	m.pkg.reportCcache(ccache)
+	pruneLanguageCaches()
+	if err != nil && !m.IsCancelled() {
+		failure := NewHookContext(HookOnFailure, m.pkg, m.profile.Name)
+		failure.Error = strings.TrimSpace(err.Error())
+		if herr := RunHooks(failure); herr != nil {
+			log.Warnln(herr.Error())
+		}
+	}
+	if terr := watchdog.Err(); terr != nil {
+		log.Errorln(terr.Error())
+		return terr
+	}
+	if err == nil {
+		m.recordBuildSize(m.overlay.usage())
+	}
+	if err == nil && stamp != nil {
+		if serr := stamp.record(m.pkg, GetUserInfo()); serr != nil {
+			log.Warnf("Unable to write the build stamp, reason: %s\n", serr)
+		}
+	}
+	if KeepRoot > 0 && m.pkg.tested {
+		log.Infoln("Not keeping the build root, the built packages were installed into it")
+	} else if KeepRoot > 0 && m.overlay.prepared && !m.IsCancelled() {
+		if kerr := m.pkg.keepRoot(m.overlay); kerr != nil {
+			log.Warnf("Unable to keep the build root, reason: %s\n", kerr)
+		}
+	}
+	return err
+}
+
+// startWatchdog will enforce the timeouts of the build, if any
+func (m *Manager) startWatchdog(timeouts *BuildTimeouts) *BuildWatchdog {
+	if timeouts.IsEmpty() {
+		return nil
+	}
+	watchdog := NewBuildWatchdog(timeouts, m.timedOut)
+	m.lock.Lock()
+	m.watchdog = watchdog
+	m.lock.Unlock()
+	return watchdog
+}
+
+// timedOut will tear down a build which ran over a timeout, exiting as an
+// interrupted build would. When signals are left to the embedding program,
+// the running command is killed instead, and Build returns the timeout.
+func (m *Manager) timedOut(err *TimeoutError) {
+	log.Errorf("%s, cleaning up\n", err)
+	m.SetCancelled()
+	m.lock.Lock()
+	noSignals := m.noSignals
+	pid := m.activePID
+	m.lock.Unlock()
+	if noSignals {
+		if pid > 0 {
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+		return
+	}
+	m.Cleanup()
+	log.Errorln("Exiting due to timeout")
+	os.Exit(TimeoutExitStatus)
+}
+
+// setCPUBaseline will enforce the CPU baseline of the profile, if any, and
+// refuse recipes tuning for the host CPU instead.
+func (m *Manager) setCPUBaseline() error {
+	BuildCPU = nil
+	if m.profile.CPUBaseline != "" {
+		features, err := ReadCPUFeatures(CPUInfoPath)
+		if err != nil {
+			log.Errorf("Unable to read the features of the host CPU, reason: %s\n", err)
+			return err
+		}
+		cpu, err := NewCPUBaseline(m.profile.CPUBaseline, features)
+		if err != nil {
+			log.Errorf("Cannot build with the %s profile, reason: %s\n", m.profile.Name, err)
+			return err
+		}
+		log.Infof("Building for the CPU baseline %s\n", cpu)
+		BuildCPU = cpu
+	}
+	if err := m.pkg.checkNativeTuning(); err != nil {
+		log.Errorf("Cannot build %s, reason: %s\n", m.pkg.Name, err)
+		return err
+	}
+	return nil
+}
+
+// Warm will populate the caches required to build the package associated
+// with this manager. The throwaway root is removed afterwards.
+func (m *Manager) Warm() error {
+	if m.IsCancelled() {
+		return ErrInterrupted
+	}
+
+	m.lock.Lock()
+	if m.pkg == nil {
+		m.lock.Unlock()
+		return ErrNoPackage
+	}
+	m.lock.Unlock()
+
+	// Now get on with the real work!
+	defer m.overlay.CleanExisting()
+	defer m.Cleanup()
+	m.SigIntCleanup()
+
+	if err := m.doLock(m.overlay.LockPath, "warming"); err != nil {
+		return err
+	}
 
-	return m.pkg.Build(m, m.history, m.GetProfile(), m.pkgManager, m.overlay, m.manifestTarget)
+	return m.pkg.Warm(m, m.history, m.GetProfile(), m.pkgManager, m.overlay)
+}
+
+// setStageLimits will lower the priorities of the fetch and build stages,
+// unless building in the foreground.
+func (m *Manager) setStageLimits() error {
+	FetchLimits, BuildLimits = nil, nil
+	source.MaxDownloadRate = 0
+	if Foreground {
+		return nil
+	}
+	fetch, err := NewStageLimits(m.Config.FetchNice, m.Config.FetchIONice)
+	if err != nil {
+		log.Errorf("Invalid fetch priorities specified: %s\n", err)
+		return err
+	}
+	build, err := NewStageLimits(m.Config.BuildNice, m.Config.BuildIONice)
+	if err != nil {
+		log.Errorf("Invalid build priorities specified: %s\n", err)
+		return err
+	}
+	rate, err := ParseSize(m.Config.FetchBandwidth)
+	if err != nil {
+		log.Errorf("Invalid fetch bandwidth specified: %s\n", err)
+		return err
+	}
+	FetchLimits, BuildLimits = fetch, build
+	source.MaxDownloadRate = rate
+	return nil
+}
+
+// setBackend will choose how commands are run within the build root
+func (m *Manager) setBackend() error {
+	if !ValidBackend(m.Config.Backend) {
+		log.Errorf("Invalid execution backend specified: %s\n", m.Config.Backend)
+		return ErrUnknownBackend
+	}
+	if err := CheckBackend(m.Config.Backend); err != nil {
+		log.Errorf("Cannot use the %s backend, reason: %s\n", m.Config.Backend, err)
+		return err
+	}
+	ExecBackend = BackendChroot
+	if m.Config.Backend != "" {
+		ExecBackend = m.Config.Backend
+	}
+	return nil
+}
+
+// enableZramSwap will provision temporary zram swap for the build. Failure
+// is not fatal, as the build may well succeed without it.
+func (m *Manager) enableZramSwap(size string) {
+	if !ValidMemSize(size) {
+		log.Warnf("Not enabling zram swap of invalid size %s\n", size)
+		return
+	}
+	zram, err := NewZramSwap(size)
+	if err != nil {
+		log.Warnf("Unable to enable zram swap, reason: %s\n", err)
+		return
+	}
+	m.lock.Lock()
+	m.zram = zram
+	m.lock.Unlock()
+}
+
+// enableBuildCgroup will constrain the build to the resource limits of the
+// profile, if any. Unlike zram swap, failing to apply them fails the build.
+func (m *Manager) enableBuildCgroup() error {
+	limits, err := NewResourceLimits(m.profile.CPUQuota, m.profile.MemoryMax, m.profile.IOWeight)
+	if err != nil {
+		log.Errorf("Invalid resource limits in profile %s, reason: %s\n", m.profile.Name, err)
+		return err
+	}
+	if limits.IsEmpty() {
+		return nil
+	}
+	cgroup, err := NewBuildCgroup(m.pkg.Name, limits)
+	if err != nil {
+		log.Errorf("Unable to limit the resources of the build, reason: %s\n", err)
+		return err
+	}
+	m.lock.Lock()
+	m.cgroup = cgroup
+	m.lock.Unlock()
+	return nil
+}
+
+// newEnvironmentLock will record the environment for ypkg builds, loading
+// the expected environment when the build is locked.
+func (m *Manager) newEnvironmentLock() (*EnvironmentLock, error) {
+	if m.pkg.Type != PackageTypeYpkg {
+		if m.locked {
+			return nil, fmt.Errorf("Locked builds are only supported for package.yml")
+		}
+		return nil, nil
+	}
+	envLock, err := NewEnvironmentLock(m.profile, m.image, m.pkg)
+	if err != nil {
+		log.Errorf("Failed to record build environment, reason: %s\n", err)
+		return nil, err
+	}
+	if !m.locked {
+		return envLock, nil
+	}
+	lockPath := GetEnvironmentLockPath(m.pkg)
+	expected, err := LoadEnvironmentLock(lockPath)
+	if err != nil {
+		log.Errorf("Failed to load lockfile %s, reason: %s\n", lockPath, err)
+		return nil, err
+	}
+	envLock.Expect(expected)
+	if err := envLock.VerifyBase(); err != nil {
+		return nil, err
+	}
+	return envLock, nil
 }
 
 // Chroot will enter the build environment to allow users to introspect it
@@ -362,6 +1043,27 @@ func (m *Manager) Chroot() error {
 	defer m.Cleanup()
 	m.SigIntCleanup()
 
+	if err := m.setBackend(); err != nil {
+		return err
+	}
+	m.setRootfsBackend()
+
+	network, err := NewNetworkPolicy(m.profile, m.pkg, false)
+	if err != nil {
+		log.Errorf("Invalid network policy in profile %s, reason: %s\n", m.profile.Name, err)
+		return err
+	}
+	m.pkg.Network = network
+
+	shell, err := NewChrootShell(m.profile)
+	if err != nil {
+		log.Errorf("Invalid chroot shell in profile %s, reason: %s\n", m.profile.Name, err)
+		return err
+	}
+	shell.Exec = m.chrootCommand
+	shell.NoTTY = m.chrootNoTTY
+	m.pkg.Shell = shell
+
 	if err := m.doLock(m.overlay.LockPath, "chroot"); err != nil {
 		return err
 	}
@@ -369,6 +1071,31 @@ func (m *Manager) Chroot() error {
 	return m.pkg.Chroot(m, m.pkgManager, m.overlay)
 }
 
+// AdviseDeps will inspect the previous build of the package and compare its
+// linkage against the declared build dependencies.
+func (m *Manager) AdviseDeps() (*DepAdvice, error) {
+	if m.IsCancelled() {
+		return nil, ErrInterrupted
+	}
+
+	m.lock.Lock()
+	if m.pkg == nil {
+		m.lock.Unlock()
+		return nil, ErrNoPackage
+	}
+	m.lock.Unlock()
+
+	// Now get on with the real work!
+	defer m.Cleanup()
+	m.SigIntCleanup()
+
+	if err := m.doLock(m.overlay.LockPath, "advising"); err != nil {
+		return nil, err
+	}
+
+	return m.pkg.AdviseDeps(m, m.pkgManager, m.overlay)
+}
+
 // Update will attempt to update the base image
 func (m *Manager) Update() error {
 	if m.IsCancelled() {
@@ -379,6 +1106,8 @@ func (m *Manager) Update() error {
 		m.lock.Unlock()
 		return ErrInvalidProfile
 	}
+	// The image may have been initialised, or converted, since
+	m.image = NewBackingImage(m.image.Name)
 	if !m.image.IsInstalled() {
 		m.lock.Unlock()
 		return ErrProfileNotInstalled
@@ -387,14 +1116,77 @@ func (m *Manager) Update() error {
 	m.pkgManager = NewEopkgManager(m, m.image.RootDir)
 	m.lock.Unlock()
 
-	defer m.Cleanup()
+	defer func() {
+		m.Cleanup()
+		// Only now that Cleanup has unmounted the overlay
+		if m.image.Squashfs {
+			m.image.CleanLayers()
+		}
+	}()
 	m.SigIntCleanup()
 
 	if err := m.doLock(m.image.LockPath, "updating"); err != nil {
 		return err
 	}
 
-	return m.image.Update(m, m.pkgManager)
+	kept := m.keepGeneration()
+	err := m.image.Update(m, m.pkgManager)
+	if err == nil && m.image.Squashfs && m.image.updated {
+		m.pkgManager.Cleanup()
+		err = m.image.Repack()
+	}
+	if kept == "" {
+		return err
+	}
+	if err != nil || !m.image.updated {
+		discardGeneration(kept)
+	} else if perr := m.image.pruneGenerations(m.Config.ImageGenerations); perr != nil {
+		log.Warnf("Failed to remove old generations of %s, reason: %s\n", m.image.Name, perr)
+	}
+	return err
+}
+
+// keepGeneration will keep the image as it is before the update when the
+// config keeps previous generations, returning where it was kept.
+func (m *Manager) keepGeneration() string {
+	if m.Config.ImageGenerations < 1 {
+		return ""
+	}
+	kept, err := m.image.keepGeneration()
+	if err != nil {
+		log.Warnf("Unable to keep the current generation of %s, reason: %s\n", m.image.Name, err)
+		return ""
+	}
+	return kept
+}
+
+// SetImageVersion will build against a previous generation of the image,
+// given by its number or a date, overriding any pin of the profile. This
+// must be called prior to SetPackage.
+func (m *Manager) SetImageVersion(version string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.imageVersion = strings.TrimSpace(version)
+}
+
+// pinImage will switch to the generation of the image the package is
+// pinned to, if any.
+func (m *Manager) pinImage(pkg *Package) error {
+	version := m.imageVersion
+	if version == "" {
+		version = m.profile.ImagePins[pkg.Name]
+	}
+	if version == "" {
+		return nil
+	}
+	pinned, err := m.image.PinnedTo(version)
+	if err != nil {
+		log.Errorf("Cannot pin image %s to %s, reason: %s\n", m.image.Name, version, err)
+		return err
+	}
+	log.Infof("Building against generation %d of %s, updated %s\n", pinned.pinned.Generation, m.image.Name, pinned.pinned.Updated.Format(time.RFC3339))
+	m.image = pinned
+	return nil
 }
 
 // Index will attempt to index the given directory for eopkgs
@@ -415,10 +1207,16 @@ func (m *Manager) Index(dir string) error {
 	m.SigIntCleanup()
 
 	// Now set our options according to the config
-	m.overlay.EnableTmpfs = m.Config.EnableTmpfs
-	m.overlay.TmpfsSize = m.Config.TmpfsSize
-	if ValidMemSize(m.overlay.TmpfsSize) != true && m.overlay.EnableTmpfs == true {
-		log.Fatalf("Invalid memory size specified: %s\n", m.overlay.TmpfsSize)
+	if err := m.setTmpfs(); err != nil {
+		return err
+	}
+
+	SigningKey = m.Config.SigningKey
+	if SigningKey != "" {
+		if err := CheckSigningKey(SigningKey); err != nil {
+			log.Errorf("Cannot sign the index, reason: %s\n", err)
+			return err
+		}
 	}
 
 	if err := m.doLock(m.overlay.LockPath, "indexing"); err != nil {
@@ -0,0 +1,84 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// MatrixReportSuffix is the suffix of the report comparing the builds of a
+// recipe against several profiles.
+const MatrixReportSuffix = ".matrix"
+
+// A MatrixResult is the outcome of building a recipe with one profile
+type MatrixResult struct {
+	Profile  string
+	Err      error
+	Duration time.Duration
+	Packages []string // Paths of the packages built
+}
+
+// WriteMatrixReport will write the outcome of the build with each profile,
+// followed by how the packages of every other profile differ from those of
+// the first profile to succeed.
+func WriteMatrixReport(w io.Writer, results []*MatrixResult) error {
+	width := 0
+	for _, r := range results {
+		if len(r.Profile) > width {
+			width = len(r.Profile)
+		}
+	}
+	fmt.Fprintln(w, "Results:")
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "  %-*s  failed after %s: %s\n", width, r.Profile, r.Duration.Round(time.Second), strings.TrimSpace(r.Err.Error()))
+			continue
+		}
+		fmt.Fprintf(w, "  %-*s  built %d package(s) in %s\n", width, r.Profile, len(r.Packages), r.Duration.Round(time.Second))
+	}
+
+	var base *MatrixResult
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		if base == nil {
+			base = r
+			continue
+		}
+		diffs, err := DiffPackages(base.Packages, r.Packages)
+		if err != nil {
+			return err
+		}
+		var changed []*PackageDiff
+		for _, d := range diffs {
+			if !d.IsEmpty() || d.OldVersion != d.NewVersion {
+				changed = append(changed, d)
+			}
+		}
+		fmt.Fprintf(w, "\n%s -> %s:\n", base.Profile, r.Profile)
+		if len(changed) == 0 {
+			fmt.Fprintln(w, "No differences in the packages")
+			continue
+		}
+		WritePackageDiffs(w, changed)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMatrixReport(t *testing.T) {
+	results := []*MatrixResult{
+		{Profile: "main-x86_64", Err: errors.New("exit status 1\n"), Duration: 90 * time.Second},
+		{Profile: "unstable-x86_64", Duration: 2 * time.Minute},
+		{Profile: "local-x86_64", Duration: time.Minute},
+	}
+	var buf bytes.Buffer
+	if err := WriteMatrixReport(&buf, results); err != nil {
+		t.Fatalf("Failed to write report: %s", err)
+	}
+	report := buf.String()
+	for _, want := range []string{
+		"  main-x86_64      failed after 1m30s: exit status 1\n",
+		"  unstable-x86_64  built 0 package(s) in 2m0s\n",
+		"unstable-x86_64 -> local-x86_64:\nNo differences in the packages\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Report is missing %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "main-x86_64 ->") {
+		t.Errorf("Failed builds should not be compared:\n%s", report)
+	}
+}
@@ -0,0 +1,317 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+const (
+	// appstreamRequest is the FIFO within the work directory the install
+	// stage writes to once done, handing the install tree over to solbuild
+	appstreamRequest = "appstream.request"
+
+	// appstreamReply is the FIFO the install stage reads the outcome from
+	appstreamReply = "appstream.reply"
+)
+
+var (
+	// SyncAppStreamReleases will replace the releases of the AppStream
+	// metainfo shipped by the packages with the update history.
+	SyncAppStreamReleases bool
+
+	// metainfoDirs are where AppStream metainfo files are installed
+	metainfoDirs = []string{"usr/share/metainfo/", "usr/share/appdata/"}
+
+	// releasesElement matches the releases of a metainfo file, along with the
+	// indentation of its line
+	releasesElement = regexp.MustCompile(`(?s)([ \t]*)<releases(\s[^>]*)?(/>|>(.*?)</releases>)`)
+
+	// releaseElement matches a single release within the releases
+	releaseElement = regexp.MustCompile(`(?s)<release\b[^>]*?(/>|>.*?</release>)`)
+
+	// versionAttribute matches the version of a release
+	versionAttribute = regexp.MustCompile(`\bversion\s*=\s*["']([^"']*)["']`)
+)
+
+// lineIndent returns the whitespace starting the line at offset
+func lineIndent(doc string, offset int) string {
+	line := doc[strings.LastIndex(doc[:offset], "\n")+1:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// syncReleases will replace the releases of the metainfo document with the
+// update history, keeping upstream releases of versions the history doesn't
+// cover. Metainfo without a releases element gains one at the end of the
+// component. Documents pointing at external release files are left alone.
+func syncReleases(doc string, releases *appstreamReleases) (string, bool, error) {
+	if len(releases.Releases) == 0 {
+		return doc, false, nil
+	}
+	start, end := -1, -1
+	var kept []string
+	indent := ""
+	if match := releasesElement.FindStringSubmatchIndex(doc); match != nil {
+		if match[4] >= 0 && strings.Contains(doc[match[4]:match[5]], "external") {
+			return doc, false, nil
+		}
+		start, end, indent = match[0], match[1], doc[match[2]:match[3]]
+		ours := make(map[string]bool)
+		for _, release := range releases.Releases {
+			ours[release.Version] = true
+		}
+		if match[8] >= 0 {
+			for _, release := range releaseElement.FindAllString(doc[match[8]:match[9]], -1) {
+				version := versionAttribute.FindStringSubmatch(release)
+				if version == nil || !ours[version[1]] {
+					kept = append(kept, release)
+				}
+			}
+		}
+	} else {
+		close := strings.LastIndex(doc, "</component>")
+		if close < 0 {
+			return doc, false, nil
+		}
+		// Children of the component share the indentation of its first child
+		indent = "  "
+		if open := strings.Index(doc, "<component"); open >= 0 && open < close {
+			if child := strings.Index(doc[open:close], "\n"); child >= 0 {
+				rest := doc[open+child+1 : close]
+				indent = rest[:len(rest)-len(strings.TrimLeft(rest, " \t"))]
+			}
+		}
+		start = strings.LastIndex(doc[:close], "\n") + 1
+		if strings.TrimSpace(doc[start:close]) != "" {
+			start = close
+		}
+		end = start
+	}
+	step := indent
+	if step == "" {
+		step = "  "
+	}
+	b, err := xml.MarshalIndent(releases, indent, step)
+	if err != nil {
+		return doc, false, err
+	}
+	rendered := string(b)
+	if len(kept) > 0 {
+		closing := strings.LastIndex(rendered, "\n")
+		var older strings.Builder
+		for _, release := range kept {
+			older.WriteString("\n" + indent + step + release)
+		}
+		rendered = rendered[:closing] + older.String() + rendered[closing:]
+	}
+	if start == end {
+		rendered = indent + strings.TrimLeft(rendered, " \t") + "\n"
+		if start > 0 && doc[start-1] != '\n' {
+			rendered = "\n" + rendered
+		}
+		return doc[:start] + rendered + doc[start:], true, nil
+	}
+	return doc[:start] + rendered + doc[end:], true, nil
+}
+
+// wrapInstallScript will append the handover of the install tree to the lines
+// of an install script, so the releases are synchronised before ypkg packages
+// the tree. The stage fails when synchronising does.
+func wrapInstallScript(lines []string, workDir string) []string {
+	indent := "    "
+	for _, line := range lines {
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed != "" {
+			indent = line[:len(line)-len(trimmed)]
+			break
+		}
+	}
+	out := append([]string{}, lines...)
+	for _, line := range strings.Split(fmt.Sprintf(`echo sync > "%s"
+read -r __solbuild_synced < "%s"
+[ "$__solbuild_synced" = "ok" ]`, filepath.Join(workDir, appstreamRequest), filepath.Join(workDir, appstreamReply)), "\n") {
+		out = append(out, indent+line)
+	}
+	return out
+}
+
+// plainDir determines whether the directory within root exists without any
+// symlinks along the way, which the build could point outside of the root.
+func plainDir(root, dir string) bool {
+	path := root
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		path = filepath.Join(path, part)
+		st, err := os.Lstat(path)
+		if err != nil || !st.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// syncInstallReleases will replace the releases of the AppStream metainfo
+// installed within the directory of the root.
+func syncInstallReleases(root, installDir string, releases *appstreamReleases) error {
+	for _, dir := range metainfoDirs {
+		dir = filepath.Join(installDir, dir)
+		if !plainDir(root, dir) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !file.Mode().IsRegular() || !strings.HasSuffix(file.Name(), ".xml") {
+				continue
+			}
+			path := filepath.Join(root, dir, file.Name())
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			synced, changed, err := syncReleases(string(content), releases)
+			if err != nil {
+				return err
+			}
+			if !changed || synced == string(content) {
+				continue
+			}
+			if err := ioutil.WriteFile(path, []byte(synced), file.Mode().Perm()); err != nil {
+				return err
+			}
+			log.Infof("Synchronised AppStream releases of %s\n", file.Name())
+		}
+	}
+	return nil
+}
+
+// An appstreamSync synchronises the releases of the metainfo in the install
+// tree each time the install stage hands it over
+type appstreamSync struct {
+	root       string // Mount point of the build root
+	installDir string // Install tree of ypkg within the root
+	releases   *appstreamReleases
+	paths      []string // Paths of the FIFOs on the host
+	request    *os.File
+	reply      *os.File
+	done       chan struct{}
+}
+
+// startAppStreamSync will rewrite the install stage of the recipe within the
+// work directory to hand the install tree over, and serve it until stopped.
+// Nothing is done unless the releases are synchronised and there's history.
+func (p *Package) startAppStreamSync(overlay *Overlay, history *PackageHistory) (*appstreamSync, error) {
+	if !SyncAppStreamReleases || p.Type != PackageTypeYpkg || history == nil || len(history.Updates) == 0 {
+		return nil, nil
+	}
+	path := filepath.Join(p.GetWorkDir(overlay), filepath.Base(p.Path))
+	doc, err := ParseYmlDocumentFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entry := doc.Lookup("install")
+	if entry == nil {
+		return nil, nil
+	}
+
+	s := &appstreamSync{
+		root:       overlay.MountPoint,
+		installDir: filepath.Join(BuildUserHome, "YPKG", "root", p.Name, "install"),
+		releases:   history.appstreamReleases(),
+		done:       make(chan struct{}),
+	}
+	// Opened for reading and writing, so neither side blocks on opening them
+	var fifos []*os.File
+	for _, name := range []string{appstreamRequest, appstreamReply} {
+		fp := filepath.Join(p.GetWorkDir(overlay), name)
+		os.Remove(fp)
+		if err := syscall.Mkfifo(fp, 00600); err != nil {
+			s.close(fifos)
+			return nil, err
+		}
+		s.paths = append(s.paths, fp)
+		if err := os.Chown(fp, BuildUserID, BuildUserGID); err != nil {
+			s.close(fifos)
+			return nil, err
+		}
+		f, err := os.OpenFile(fp, os.O_RDWR, 0)
+		if err != nil {
+			s.close(fifos)
+			return nil, err
+		}
+		fifos = append(fifos, f)
+	}
+	s.request, s.reply = fifos[0], fifos[1]
+
+	lines := entry.Children
+	if entry.Value != "|" && entry.Value != ">" {
+		lines = []string{"    " + entry.Scalar()}
+	}
+	entry.Value = "|"
+	entry.Quote = YmlQuotePlain
+	entry.Children = wrapInstallScript(lines, p.GetWorkDirInternal())
+	if err := doc.WriteFile(path); err != nil {
+		s.close(fifos)
+		return nil, err
+	}
+	go s.serve()
+	return s, nil
+}
+
+// serve answers each handover of the install tree until stopped
+func (s *appstreamSync) serve() {
+	defer close(s.done)
+	r := bufio.NewReader(s.request)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != "sync" {
+			return
+		}
+		status := "ok"
+		if err := syncInstallReleases(s.root, s.installDir, s.releases); err != nil {
+			log.Errorf("Failed to synchronise AppStream releases, reason: %s\n", err)
+			status = "failed"
+		}
+		fmt.Fprintln(s.reply, status)
+	}
+}
+
+// Stop will stop serving once the build is done, removing the FIFOs
+func (s *appstreamSync) Stop() {
+	fmt.Fprintln(s.request, "stop")
+	<-s.done
+	s.close([]*os.File{s.request, s.reply})
+}
+
+// close will close the files and remove the FIFOs
+func (s *appstreamSync) close(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+	for _, path := range s.paths {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,108 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSyncReleases(t *testing.T) {
+	history := &PackageHistory{Updates: []*PackageUpdate{
+		{Body: "Update to 1.1", Package: &Package{Version: "1.1", Release: 2}},
+		{Body: "Initial", Package: &Package{Version: "1.0", Release: 1}},
+	}}
+	releases := history.appstreamReleases()
+
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<component type="desktop-application">
+  <id>org.example.App</id>
+  <releases>
+    <release version="1.1" date="2021-02-01"/>
+    <release version="0.9" date="2020-01-01">
+      <description><p>Upstream</p></description>
+    </release>
+  </releases>
+</component>
+`
+	synced, changed, err := syncReleases(doc, releases)
+	if err != nil || !changed {
+		t.Fatalf("Failed to synchronise releases: %v", err)
+	}
+	if strings.Count(synced, "<release ") != 3 || !strings.Contains(synced, "<p>Update to 1.1</p>") {
+		t.Fatalf("Expected the history followed by older upstream releases:\n%s", synced)
+	}
+	if !strings.Contains(synced, "\n  <releases>\n    <release version=\"1.1\"") {
+		t.Fatalf("Expected the indentation of the document:\n%s", synced)
+	}
+	if strings.Index(synced, `version="1.0"`) > strings.Index(synced, `version="0.9"`) {
+		t.Fatalf("Expected the upstream release after the history:\n%s", synced)
+	}
+
+	bare := "<component>\n  <id>org.example.App</id>\n</component>\n"
+	if synced, changed, _ = syncReleases(bare, releases); !changed || !strings.Contains(synced, "  </releases>\n</component>") {
+		t.Fatalf("Expected releases added to the component:\n%s", synced)
+	}
+
+	external := `<component><releases type="external"/></component>`
+	if _, changed, _ = syncReleases(external, releases); changed {
+		t.Fatal("Replaced external releases")
+	}
+}
+
+func TestSyncInstallReleases(t *testing.T) {
+	history := &PackageHistory{Updates: []*PackageUpdate{
+		{Body: "Update to 1.1", Package: &Package{Version: "1.1", Release: 2}},
+	}}
+	root := t.TempDir()
+	doc := "<component>\n  <id>org.example.App</id>\n</component>\n"
+	writeTestFile(t, filepath.Join(root, "install", "usr", "share", "metainfo", "app.metainfo.xml"), doc)
+	writeTestFile(t, filepath.Join(root, "install", "usr", "share", "metainfo", "notes.txt"), doc)
+	if err := os.MkdirAll(filepath.Join(root, "install", "usr", "share", "elsewhere"), 00755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "install", "usr", "share", "elsewhere", "app.metainfo.xml"), doc)
+	if err := os.Symlink("elsewhere", filepath.Join(root, "install", "usr", "share", "appdata")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syncInstallReleases(root, "/install", history.appstreamReleases()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(root, "install", "usr", "share", "metainfo", "app.metainfo.xml"))
+	if err != nil || !strings.Contains(string(b), "<p>Update to 1.1</p>") {
+		t.Fatalf("Expected the releases in the installed metainfo:\n%s", b)
+	}
+	for _, path := range []string{"metainfo/notes.txt", "elsewhere/app.metainfo.xml"} {
+		if b, _ := ioutil.ReadFile(filepath.Join(root, "install", "usr", "share", path)); string(b) != doc {
+			t.Errorf("Changed %s, outside of the metainfo directories:\n%s", path, b)
+		}
+	}
+}
+
+func TestWrapInstallScript(t *testing.T) {
+	lines := wrapInstallScript([]string{"    %make_install"}, "/home/build/YPKG")
+	if len(lines) != 4 || lines[0] != "    %make_install" {
+		t.Fatalf("Expected the install script followed by the handover: %q", lines)
+	}
+	if lines[1] != `    echo sync > "/home/build/YPKG/appstream.request"` {
+		t.Errorf("Unexpected handover: %q", lines[1])
+	}
+}
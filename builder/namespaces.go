@@ -19,6 +19,8 @@ package builder
 import (
 	"fmt"
 	log "github.com/DataDrake/waterlog"
+	"os"
+	"runtime"
 	"syscall"
 )
 
@@ -31,11 +33,66 @@ func ConfigureNamespace() error {
 	return nil
 }
 
-// DropNetworking will unshare() the context networking capabilities
+// sysSetns is the number of setns(2) on x86_64, which syscall doesn't define
+const sysSetns = 308
+
+// hostNetwork is the network namespace of the host, kept by DropNetworking
+// so that the steps after the build needing the network can rejoin it.
+var hostNetwork *os.File
+
+// threadNetwork will open the network namespace of the calling thread
+func threadNetwork() (*os.File, error) {
+	return os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+}
+
+// setNetwork will move the calling thread into the network namespace
+func setNetwork(ns *os.File) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, ns.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// DropNetworking will unshare() the context networking capabilities.
+//
+// The new namespace belongs to the calling thread alone, so the calling
+// goroutine stays locked to it for good, ensuring everything it goes on to
+// spawn, or listen on, is within the namespace.
 func DropNetworking() error {
 	log.Debugln("Dropping container networking")
+	runtime.LockOSThread()
+	if hostNetwork == nil {
+		ns, err := threadNetwork()
+		if err != nil {
+			return fmt.Errorf("Failed to open the host network namespace, reason: %s\n", err)
+		}
+		hostNetwork = ns
+	}
 	if err := syscall.Unshare(syscall.CLONE_NEWNET | syscall.CLONE_NEWUTS); err != nil {
 		return fmt.Errorf("Failed to drop networking capabilities, reason: %s\n", err)
 	}
 	return nil
 }
+
+// WithHostNetwork will run fn with the networking of the host, if it was
+// dropped, and then drop it again. The calling goroutine must be the one that
+// dropped the networking, as only its thread rejoins the host namespace.
+func WithHostNetwork(fn func() error) error {
+	if hostNetwork == nil {
+		return fn()
+	}
+	isolated, err := threadNetwork()
+	if err != nil {
+		return fmt.Errorf("Failed to open the build network namespace, reason: %s\n", err)
+	}
+	defer isolated.Close()
+	log.Debugln("Rejoining the host network")
+	if err := setNetwork(hostNetwork); err != nil {
+		return fmt.Errorf("Failed to rejoin the host network, reason: %s\n", err)
+	}
+	fnErr := fn()
+	if err := setNetwork(isolated); err != nil {
+		return fmt.Errorf("Failed to drop networking again, reason: %s\n", err)
+	}
+	return fnErr
+}
@@ -0,0 +1,64 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestWithHostNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Dropping networking requires root")
+	}
+	defer func(ns *os.File) { hostNetwork = ns }(hostNetwork)
+	hostNetwork = nil
+
+	current := func() string {
+		link, _ := os.Readlink("/proc/thread-self/ns/net")
+		return link
+	}
+	done := make(chan struct{})
+	go func() {
+		// The thread is left in the namespace, so it exits with the goroutine
+		defer close(done)
+		runtime.LockOSThread()
+		host := current()
+		if err := DropNetworking(); err != nil {
+			t.Errorf("Failed to drop networking: %s", err)
+			return
+		}
+		isolated := current()
+		if isolated == host {
+			t.Errorf("Networking was not dropped")
+		}
+		err := WithHostNetwork(func() error {
+			if ns := current(); ns != host {
+				t.Errorf("Expected the host network %s, got %s", host, ns)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Failed to rejoin the host network: %s", err)
+		}
+		if ns := current(); ns != isolated {
+			t.Errorf("Expected networking to be dropped again, got %s", ns)
+		}
+	}()
+	<-done
+}
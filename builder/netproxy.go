@@ -0,0 +1,183 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyDialTimeout bounds how long connecting to an allowed host may take
+	proxyDialTimeout = 30 * time.Second
+)
+
+// A NetworkProxy is a local HTTP proxy giving a build without networking
+// access to the allowed hosts alone. It listens within the network namespace
+// of the build, and connects out from that of the host.
+type NetworkProxy struct {
+	Allow []string // Hosts which may be reached, *.example.com for subdomains
+	Addr  string   // Address the build reaches the proxy on
+
+	server    *http.Server
+	transport *http.Transport
+	lock      sync.Mutex
+	blocked   map[string]bool
+}
+
+// StartNetworkProxy will serve a proxy for the allowed hosts on loopback.
+// It must be called from the goroutine which dropped networking, so that
+// it listens within the namespace of the build.
+func StartNetworkProxy(allow []string) (*NetworkProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &NetworkProxy{
+		Allow:     allow,
+		Addr:      listener.Addr().String(),
+		transport: &http.Transport{DialContext: (&net.Dialer{Timeout: proxyDialTimeout}).DialContext},
+		blocked:   make(map[string]bool),
+	}
+	p.server = &http.Server{Handler: p}
+	go p.server.Serve(listener)
+	log.Debugf("Serving the network proxy on %s\n", p.Addr)
+	return p, nil
+}
+
+// Environment returns the variables pointing the build at the proxy
+func (p *NetworkProxy) Environment() []string {
+	uri := "http://" + p.Addr
+	var env []string
+	for _, key := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+		env = append(env, key+"="+uri)
+	}
+	return append(env, "no_proxy=localhost,127.0.0.1", "NO_PROXY=localhost,127.0.0.1")
+}
+
+// hostAllowed determines whether the host matches any of the allowed hosts
+func hostAllowed(allow []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range allow {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP tunnels CONNECT requests, and forwards plain HTTP requests, to
+// allowed hosts. Everything else is refused.
+func (p *NetworkProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Hostname()
+	if !hostAllowed(p.Allow, host) {
+		p.lock.Lock()
+		if !p.blocked[host] {
+			log.Warnf("Blocked network access to %s\n", host)
+		}
+		p.blocked[host] = true
+		p.lock.Unlock()
+		http.Error(w, fmt.Sprintf("%s is not allowed by the network policy of the build", host), http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	p.forward(w, r)
+}
+
+// tunnel will connect the client to the host of a CONNECT request
+func (p *NetworkProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.DialTimeout("tcp", r.URL.Host, proxyDialTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "Tunnelling is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	upstream.Close()
+}
+
+// forward will pass a plain HTTP request on to its host
+func (p *NetworkProxy) forward(w http.ResponseWriter, r *http.Request) {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Close will stop the proxy, summarising the hosts it refused
+func (p *NetworkProxy) Close() error {
+	err := p.server.Close()
+	p.transport.CloseIdleConnections()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.blocked) > 0 {
+		log.Warnf("The build was refused access to %s, add them to network_allow if needed\n", strings.Join(sortedKeys(p.blocked), ", "))
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"strings"
+)
+
+const (
+	// NetworkNone leaves the build with loopback networking only
+	NetworkNone = "none"
+
+	// NetworkAllowlist leaves the build with loopback networking only, and
+	// a local proxy reaching the allowed hosts
+	NetworkAllowlist = "allowlist"
+
+	// NetworkOpen gives the build the networking of the host
+	NetworkOpen = "open"
+)
+
+var (
+	// ErrUnknownNetworkPolicy is returned for an unsupported network policy
+	ErrUnknownNetworkPolicy = errors.New("Unknown network policy, use none, allowlist or open")
+
+	// ErrEmptyAllowlist is returned for an allowlist without any hosts
+	ErrEmptyAllowlist = errors.New("The allowlist network policy requires network_allow hosts")
+)
+
+// A PackageNetwork overrides the network policy of a profile for a single
+// package
+type PackageNetwork struct {
+	Policy string   `toml:"policy" yaml:"policy"` // Network policy of the package
+	Allow  []string `toml:"allow" yaml:"allow"`   // Hosts allowed in addition to those of the profile
+}
+
+// A NetworkPolicy decides what network access a build has
+type NetworkPolicy struct {
+	Mode  string   // One of none, allowlist or open
+	Allow []string // Hosts reachable through the proxy of an allowlist
+}
+
+// NewNetworkPolicy will decide the network policy of the package from the
+// profile and the overrides of the package, with the network_packages of the
+// profile having the last word. Without a policy in either, release builds
+// have no network, and others keep the networking requested by package.yml.
+func NewNetworkPolicy(profile *Profile, pkg *Package, release bool) (*NetworkPolicy, error) {
+	policy := &NetworkPolicy{Mode: profile.Network}
+	policy.Allow = append(policy.Allow, profile.NetworkAllow...)
+	overrides := []*PackageNetwork{profile.NetworkPackages[pkg.Name]}
+	if pkg.Overrides != nil {
+		overrides = []*PackageNetwork{pkg.Overrides.Network, overrides[0]}
+	}
+	for _, override := range overrides {
+		if override == nil {
+			continue
+		}
+		if override.Policy != "" {
+			policy.Mode = override.Policy
+		}
+		policy.Allow = append(policy.Allow, override.Allow...)
+	}
+	switch policy.Mode {
+	case "":
+		policy.Mode = NetworkNone
+		if pkg.CanNetwork && !release {
+			policy.Mode = NetworkOpen
+		}
+	case NetworkNone, NetworkOpen:
+	case NetworkAllowlist:
+		if len(policy.Allow) == 0 {
+			return nil, ErrEmptyAllowlist
+		}
+	default:
+		return nil, ErrUnknownNetworkPolicy
+	}
+	if pkg.CanNetwork && policy.Mode != NetworkOpen {
+		log.Warnf("Package has requested networking, but the network policy is %s\n", policy)
+	}
+	return policy, nil
+}
+
+// String describes the policy, e.g. "allowlist (github.com)"
+func (n *NetworkPolicy) String() string {
+	if n.Mode != NetworkAllowlist {
+		return n.Mode
+	}
+	return fmt.Sprintf("%s (%s)", n.Mode, strings.Join(n.Allow, ", "))
+}
+
+// network returns the network policy of the package, falling back to the
+// networking requested by package.yml when the manager hasn't set one.
+func (p *Package) network() *NetworkPolicy {
+	if p.Network != nil {
+		return p.Network
+	}
+	if p.CanNetwork {
+		return &NetworkPolicy{Mode: NetworkOpen}
+	}
+	return &NetworkPolicy{Mode: NetworkNone}
+}
+
+// isolateNetwork will enforce the network policy of the package, returning
+// the proxy of an allowlist, which must be closed once the build is done.
+func (p *Package) isolateNetwork(overlay *Overlay) (*NetworkProxy, error) {
+	policy := p.network()
+	if policy.Mode == NetworkOpen {
+		log.Warnln("Networking is allowed for this package, sandboxing disabled")
+		return nil, nil
+	}
+	if err := DropNetworking(); err != nil {
+		return nil, err
+	}
+
+	// Ensure the overlay can network on localhost only
+	if err := overlay.ConfigureNetworking(); err != nil {
+		return nil, err
+	}
+	if policy.Mode != NetworkAllowlist {
+		return nil, nil
+	}
+	proxy, err := StartNetworkProxy(policy.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start the network proxy, reason: %s\n", err)
+	}
+	ChrootEnvironment = append(ChrootEnvironment, proxy.Environment()...)
+	log.Infof("Networking restricted to %s through a local proxy\n", strings.Join(policy.Allow, ", "))
+	return proxy, nil
+}
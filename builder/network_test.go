@@ -0,0 +1,106 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNetworkPolicy(t *testing.T) {
+	profile := &Profile{
+		NetworkAllow: []string{"*.github.com"},
+		NetworkPackages: map[string]*PackageNetwork{
+			"rust": {Policy: NetworkAllowlist, Allow: []string{"static.crates.io"}},
+		},
+	}
+	pkg := &Package{Name: "nano", CanNetwork: true}
+	tests := []struct {
+		release bool
+		mode    string
+	}{
+		{false, NetworkOpen},
+		{true, NetworkNone},
+	}
+	for _, test := range tests {
+		policy, err := NewNetworkPolicy(profile, pkg, test.release)
+		if err != nil {
+			t.Fatalf("Failed to decide network policy: %s", err)
+		}
+		if policy.Mode != test.mode {
+			t.Fatalf("Expected %s for release=%v, found %s", test.mode, test.release, policy.Mode)
+		}
+	}
+
+	policy, err := NewNetworkPolicy(profile, &Package{Name: "rust"}, true)
+	if err != nil {
+		t.Fatalf("Failed to decide network policy: %s", err)
+	}
+	if s := policy.String(); s != "allowlist (*.github.com, static.crates.io)" {
+		t.Fatalf("Unexpected policy: %s", s)
+	}
+
+	profile.Network = NetworkAllowlist
+	profile.NetworkAllow = nil
+	if _, err := NewNetworkPolicy(profile, pkg, false); err != ErrEmptyAllowlist {
+		t.Fatalf("Expected an empty allowlist to be refused, got %v", err)
+	}
+	profile.Network = "firewalled"
+	if _, err := NewNetworkPolicy(profile, pkg, false); err != ErrUnknownNetworkPolicy {
+		t.Fatalf("Expected an unknown policy to be refused, got %v", err)
+	}
+}
+
+func TestNetworkProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("allowed"))
+	}))
+	defer upstream.Close()
+
+	proxy, err := StartNetworkProxy([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %s", err)
+	}
+	defer proxy.Close()
+	proxyURL, _ := url.Parse("http://" + proxy.Addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("Failed to fetch through the proxy: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "allowed" {
+		t.Fatalf("Unexpected response %d: %s", resp.StatusCode, body)
+	}
+
+	resp, err = client.Get("http://example.com/")
+	if err != nil {
+		t.Fatalf("Failed to reach the proxy: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected example.com to be refused, got %d", resp.StatusCode)
+	}
+	if !hostAllowed([]string{"*.crates.io"}, "static.crates.io") || hostAllowed([]string{"*.crates.io"}, "crates.io") {
+		t.Fatalf("Unexpected wildcard matching")
+	}
+}
@@ -0,0 +1,167 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// VMStatFile exposes the global count of OOM kills
+	VMStatFile = "/proc/vmstat"
+
+	// CgroupRoot is where the unified cgroup hierarchy is mounted
+	CgroupRoot = "/sys/fs/cgroup"
+)
+
+var (
+	// oomKilledRegex matches the kernel log entry for an OOM killed process
+	oomKilledRegex = regexp.MustCompile(`Killed process (\d+) \(([^)]+)\)`)
+)
+
+// An OOMMonitor records the OOM kill counters prior to a build, so that we
+// can determine if the build failed due to an out of memory condition.
+type OOMMonitor struct {
+	kills       int64 // System wide OOM kills
+	cgroupKills int64 // OOM kills within our own memory cgroup
+	buildKills  int64 // OOM kills within the cgroup of the build
+	kernelLog   int   // Number of OOM kill entries in the kernel log
+}
+
+// An OOMReport describes the processes killed during the build
+type OOMReport struct {
+	Cgroup    bool     // Whether a cgroup memory limit was hit
+	Build     bool     // Whether the memory limit of the build was hit
+	Processes []string // Processes known to have been killed
+}
+
+// readCounter will find the named counter in a file of "key value" lines
+func readCounter(path, key string) int64 {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.ParseInt(fields[1], 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// cgroupMemoryEvents will return the path of memory.events for our cgroup
+func cgroupMemoryEvents() string {
+	b, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		// cgroup v2 entries are of the form 0::/path
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(CgroupRoot, strings.TrimPrefix(line, "0::"), "memory.events")
+		}
+	}
+	return ""
+}
+
+// kernelOOMKills will return the processes the kernel has reported killing
+func kernelOOMKills() []string {
+	out, err := exec.Command("dmesg").Output()
+	if err != nil {
+		return nil
+	}
+	var procs []string
+	for _, match := range oomKilledRegex.FindAllStringSubmatch(string(out), -1) {
+		procs = append(procs, match[2]+" (pid "+match[1]+")")
+	}
+	return procs
+}
+
+// NewOOMMonitor will snapshot the current OOM counters
+func NewOOMMonitor() *OOMMonitor {
+	return &OOMMonitor{
+		kills:       readCounter(VMStatFile, "oom_kill"),
+		cgroupKills: readCounter(cgroupMemoryEvents(), "oom_kill"),
+		buildKills:  ActiveBuildCgroup.OOMKills(),
+		kernelLog:   len(kernelOOMKills()),
+	}
+}
+
+// Check will return a report if any process was OOM killed since the
+// monitor was created, or nil otherwise.
+func (o *OOMMonitor) Check() *OOMReport {
+	kills := readCounter(VMStatFile, "oom_kill")
+	cgroupKills := readCounter(cgroupMemoryEvents(), "oom_kill")
+	buildKills := ActiveBuildCgroup.OOMKills()
+	if kills <= o.kills && cgroupKills <= o.cgroupKills && buildKills <= o.buildKills {
+		return nil
+	}
+	report := &OOMReport{Cgroup: cgroupKills > o.cgroupKills, Build: buildKills > o.buildKills}
+	if procs := kernelOOMKills(); len(procs) > o.kernelLog {
+		report.Processes = procs[o.kernelLog:]
+	}
+	return report
+}
+
+// Emit will explain the out of memory condition to the user, along with
+// the steps that may be taken to avoid it.
+func (r *OOMReport) Emit(overlay *Overlay) {
+	if r.Build && ActiveBuildCgroup != nil {
+		log.Errorf("Build was killed after exceeding its memory limit of %d MiB\n", ActiveBuildCgroup.Limits.MemoryMax>>20)
+	} else if r.Cgroup {
+		log.Errorln("Build was killed after exceeding the cgroup memory limit")
+	} else {
+		log.Errorln("Build was killed by the kernel as the system ran out of memory")
+	}
+	for _, proc := range r.Processes {
+		log.Errorf("Out of memory killed process: %s\n", proc)
+	}
+	log.Infoln("To avoid running out of memory you may:")
+	log.Infoln(" * Reduce the number of parallel jobs used by the build, or enable adaptive_jobs")
+	if r.Build {
+		log.Infoln(" * Raise the memory_max of the profile, or pass a larger --memory-max")
+	}
+	if r.Cgroup {
+		log.Infoln(" * Raise the memory limit of the cgroup solbuild is running in")
+	}
+	if overlay.EnableTmpfs {
+		log.Infoln(" * Disable tmpfs builds, or reduce the tmpfs size, to free up memory")
+	}
+	if ActiveZramSwap != nil {
+		log.Infof(" * Increase zram_swap_size beyond the current %s\n", ActiveZramSwap.Size)
+	} else {
+		log.Infoln(" * Enable swap on the build host, or set zram_swap_size")
+	}
+}
+
+// reportOOM will explain a failed build if it was caused by an OOM kill
+func reportOOM(monitor *OOMMonitor, overlay *Overlay) {
+	if report := monitor.Check(); report != nil {
+		report.Emit(overlay)
+	}
+}
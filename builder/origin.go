@@ -0,0 +1,244 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoPackageElement is returned when the metadata.xml of an eopkg has no
+// Package element to embed the origin of the recipe into.
+var ErrNoPackageElement = errors.New("metadata.xml has no Package element")
+
+// A RecipeOrigin identifies the exact revision of the recipe that a package
+// was built from. It is embedded into the metadata.xml of every package, which
+// eopkg keeps for installed packages, so they can be traced back to it.
+type RecipeOrigin struct {
+	Repository string // URL of the packaging repository
+	Recipe     string // Path of the recipe within the repository
+	Commit     string // Commit of the recipe, suffixed with "-dirty" for uncommitted changes
+}
+
+// NewRecipeOrigin will determine the origin of the recipe from its git
+// checkout, returning nil when the recipe isn't within one.
+func NewRecipeOrigin(pkg *Package) *RecipeOrigin {
+	dir := filepath.Dir(pkg.Path)
+	prefix, err := gitOutput(dir, "rev-parse", "--show-prefix")
+	if err != nil {
+		return nil
+	}
+	origin := &RecipeOrigin{
+		Recipe: prefix + filepath.Base(pkg.Path),
+		Commit: recipeCommit(pkg),
+	}
+	if remote, err := gitOutput(dir, "remote", "get-url", "origin"); err == nil {
+		origin.Repository = stripCredentials(remote)
+	}
+	return origin
+}
+
+// gitOutput will run git within dir, returning the trimmed output
+func gitOutput(dir string, args ...string) (string, error) {
+	out, err := gitCommand(dir, args...).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitCommand will prepare git to run within dir. solbuild runs as root while
+// the recipe checkout belongs to the invoking user, which git refuses to read
+// unless the checkout is marked as a safe directory.
+func gitCommand(dir string, args ...string) *exec.Cmd {
+	if top := gitTopLevel(dir); top != "" {
+		args = append([]string{"-c", "safe.directory=" + top}, args...)
+	}
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	return c
+}
+
+// gitTopLevel will find the top of the git checkout containing dir, as git
+// itself can't be asked for it before the checkout is considered safe.
+func gitTopLevel(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	for {
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// stripCredentials will remove any password or token from the URL, as the
+// package metadata is public.
+func stripCredentials(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil {
+		return remote
+	}
+	u.User = nil
+	return u.String()
+}
+
+// element renders the origin as a Provenance element of the metadata.xml
+func (o *RecipeOrigin) element(indent string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s    <Provenance>\n", indent)
+	for _, field := range []struct{ name, value string }{
+		{"Repository", o.Repository},
+		{"Recipe", o.Recipe},
+		{"Commit", o.Commit},
+	} {
+		if field.value == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "%s        <%s>", indent, field.name)
+		xml.EscapeText(&buf, []byte(field.value))
+		fmt.Fprintf(&buf, "</%s>\n", field.name)
+	}
+	fmt.Fprintf(&buf, "%s    </Provenance>\n", indent)
+	return buf.String()
+}
+
+// embedMetadata will insert the origin at the end of the Package element,
+// matching the indentation of the document.
+func (o *RecipeOrigin) embedMetadata(metadata []byte) ([]byte, error) {
+	doc := string(metadata)
+	end := strings.LastIndex(doc, "</Package>")
+	if end < 0 {
+		return nil, ErrNoPackageElement
+	}
+	line := strings.LastIndex(doc[:end], "\n") + 1
+	indent := doc[line:end]
+	if strings.TrimSpace(indent) != "" {
+		line, indent = end, ""
+	}
+	return []byte(doc[:line] + o.element(indent) + doc[line:]), nil
+}
+
+// Embed will rewrite the eopkg with the origin added to its metadata.xml,
+// leaving every other entry untouched.
+func (o *RecipeOrigin) Embed(path string) error {
+	return rewriteEopkg(path, func(name string, r io.Reader, w io.Writer) (bool, error) {
+		if name != "metadata.xml" {
+			return false, nil
+		}
+		metadata, err := ioutil.ReadAll(r)
+		if err != nil {
+			return true, err
+		}
+		if metadata, err = o.embedMetadata(metadata); err != nil {
+			return true, err
+		}
+		_, err = w.Write(metadata)
+		return true, err
+	})
+}
+
+// rewriteEopkg will replace the eopkg with a copy, in which the rewrite
+// function may replace the contents of any entry. Entries it doesn't handle
+// are copied untouched.
+func rewriteEopkg(path string, rewrite func(name string, r io.Reader, w io.Writer) (bool, error)) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".rewrite-*.eopkg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	out := zip.NewWriter(tmp)
+	for _, f := range archive.File {
+		header := f.FileHeader
+		w, err := out.CreateHeader(&header)
+		if err != nil {
+			return err
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		var handled bool
+		if handled, err = rewrite(f.Name, r, w); err == nil && !handled {
+			_, err = io.Copy(w, r)
+		}
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), st.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// EmbedOrigin will embed the origin of the recipe into every package built,
+// before anything records their digests.
+func (p *Package) EmbedOrigin(overlay *Overlay) error {
+	origin := NewRecipeOrigin(p)
+	if origin == nil {
+		log.Debugln("Recipe is not within a git repository, not embedding its origin")
+		return nil
+	}
+	built, _ := filepath.Glob(filepath.Join(p.GetWorkDir(overlay), "*.eopkg"))
+	for _, path := range built {
+		log.Debugf("Embedding recipe origin into %s\n", filepath.Base(path))
+		if err := origin.Embed(path); err != nil {
+			return fmt.Errorf("Failed to embed recipe origin into %s, reason: %s\n", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
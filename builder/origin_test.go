@@ -0,0 +1,59 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecipeOriginForeignOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Requires root to hand the checkout to another user")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		c := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		c.Dir = dir
+		if out, err := c.CombinedOutput(); err != nil {
+			t.Skipf("git is unusable: %s", out)
+		}
+	}
+	recipe := filepath.Join(dir, "nano", "package.yml")
+	writeTestFile(t, recipe, "name: nano\n")
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "Add nano")
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, 65534, 65534)
+	}); err != nil {
+		t.Fatalf("Failed to hand over the checkout: %s", err)
+	}
+
+	origin := NewRecipeOrigin(&Package{Path: recipe})
+	if origin == nil {
+		t.Fatalf("Origin of a checkout owned by another user should be found")
+	}
+	if origin.Recipe != "nano/package.yml" || len(origin.Commit) != 40 {
+		t.Fatalf("Unexpected origin: %+v", origin)
+	}
+}
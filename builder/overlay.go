@@ -42,12 +42,18 @@ type Overlay struct {
 	EnableTmpfs bool   // Whether to use tmpfs for the upperdir or not
 	TmpfsSize   string // Size of the tmpfs to pass to mount, string form
 
+	RootfsBackend string // How the root is formed, overlay or btrfs
+	SubvolumeDir  string // Base subvolume that btrfs roots are snapshot from
+
 	ExtraMounts []string // Any extra mounts to take care of when cleaning up
 
 	mountedImg     bool // Whether we mounted the image or not
 	mountedOverlay bool // Whether we mounted the overlay or not
 	mountedVFS     bool // Whether we mounted vfs or not
 	mountedTmpfs   bool // Whether we mounted tmpfs or not
+	prepared       bool // Whether the root was fully set up for the build
+
+	rootlessMounts []string // Mounts made for a rootless build, in order
 }
 
 // NewOverlay creates a new Overlay for us in builds, etc.
@@ -57,6 +63,9 @@ type Overlay struct {
 func NewOverlay(config *Config, profile *Profile, back *BackingImage, pkg *Package) *Overlay {
 	// Ideally we could make this better..
 	dirname := pkg.Name
+	if BuildVariant > 0 {
+		dirname = fmt.Sprintf("%s.variant-%d", dirname, BuildVariant)
+	}
 	// i.e. /var/cache/solbuild/unstable-x86_64/nano
 	basedir := filepath.Join(config.OverlayRootDir, profile.Name, dirname)
 	return &Overlay{
@@ -68,6 +77,8 @@ func NewOverlay(config *Config, profile *Profile, back *BackingImage, pkg *Packa
 		ImgDir:         filepath.Join(basedir, "img"),
 		MountPoint:     filepath.Join(basedir, "union"),
 		LockPath:       fmt.Sprintf("%s.lock", basedir),
+		RootfsBackend:  RootfsOverlay,
+		SubvolumeDir:   GetSubvolumePath(config, back),
 		mountedImg:     false,
 		mountedOverlay: false,
 		mountedVFS:     false,
@@ -106,7 +117,7 @@ func (o *Overlay) CleanExisting() error {
 		return nil
 	}
 	log.Debugf("Removing stale workspace: %s\n", o.BaseDir)
-	if err := os.RemoveAll(o.BaseDir); err != nil {
+	if err := removeBuildRoot(o.BaseDir); err != nil {
 		return fmt.Errorf("Failed to remove stale workspace: dir='%s', reason: %s\n", o.BaseDir, err)
 	}
 	return nil
@@ -138,6 +149,7 @@ func (o *Overlay) Mount() error {
 		if err := mountMan.Mount("tmpfs-root", o.BaseDir, "tmpfs", tmpfsOptions...); err != nil {
 			return fmt.Errorf("Failed to mount root tmpfs: point='%s' size='%s', reason: %s\n", o.BaseDir, o.TmpfsSize, err)
 		}
+		o.mountedTmpfs = true
 	}
 
 	// Set up environment
@@ -145,6 +157,17 @@ func (o *Overlay) Mount() error {
 		return err
 	}
 
+	if Rootless {
+		if err := o.mountRootless(); err != nil {
+			return err
+		}
+		return EnsureEopkgLayout(o.MountPoint)
+	}
+
+	if o.RootfsBackend == RootfsBtrfs {
+		return o.mountSnapshot()
+	}
+
 	// First up, mount the backing image
 	log.Debugf("Mounting backing image: point='%s'\n", o.Back.ImagePath)
 	if err := mountMan.Mount(o.Back.ImagePath, o.ImgDir, "auto", "ro", "loop"); err != nil {
@@ -161,9 +184,8 @@ func (o *Overlay) Mount() error {
 		fmt.Sprintf("upperdir=%s", o.UpperDir),
 		fmt.Sprintf("workdir=%s", o.WorkDir))
 
-	// Check non-fatal..
 	if err != nil {
-		log.Fatalf("Failed to mount overlayfs: point='%s', reason: %s\n", o.MountPoint, err)
+		return fmt.Errorf("Failed to mount overlayfs: point='%s', reason: %s\n", o.MountPoint, err)
 	}
 	o.mountedOverlay = true
 
@@ -180,6 +202,10 @@ func (o *Overlay) Unmount() error {
 	}
 	o.ExtraMounts = nil
 
+	if err := o.unmountRootless(); err != nil {
+		return err
+	}
+
 	vfsPoints := []string{
 		filepath.Join(o.MountPoint, "dev/pts"),
 		filepath.Join(o.MountPoint, "dev/shm"),
@@ -207,7 +233,7 @@ func (o *Overlay) Unmount() error {
 		o.mountedOverlay = false
 	}
 	if o.mountedTmpfs {
-		if err := mountMan.Unmount(o.UpperDir); err != nil {
+		if err := mountMan.Unmount(o.BaseDir); err != nil {
 			return err
 		}
 		o.mountedTmpfs = false
@@ -239,6 +265,10 @@ func (o *Overlay) MountVFS() error {
 		}
 	}
 
+	if Rootless {
+		return o.mountVFSRootless()
+	}
+
 	// Bring up dev
 	log.Debugln("Mounting vfs /dev")
 	if err := mountMan.Mount("devtmpfs", vfsPoints[0], "devtmpfs", "nosuid", "mode=755"); err != nil {
@@ -0,0 +1,199 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PackageOverridesFile is the name of the optional file beside package.yml
+// declaring the build overrides of the package
+const PackageOverridesFile = "solbuild.yml"
+
+var (
+	// MountSources are the host directories, besides the directory
+	// of the recipe itself, that solbuild.yml may mount into the build.
+	MountSources []string
+
+	// ErrInvalidOverrideMount is returned for a mount without an absolute target
+	ErrInvalidOverrideMount = errors.New("Override mounts need a source and an absolute target other than /")
+)
+
+// An OverrideMount is a host directory made available to the build of
+// a single package.
+type OverrideMount struct {
+	Source   string `yaml:"source"`             // Host path, relative to the recipe unless absolute
+	Target   string `yaml:"target"`             // Absolute path within the build root
+	Writable bool   `yaml:"writable,omitempty"` // Mount read-write, only for allowed sources
+}
+
+// PackageOverrides are the build settings a maintainer overrides for a
+// single package in solbuild.yml, taking precedence over the config and the
+// profile, but not over the command line.
+type PackageOverrides struct {
+	Mounts       []*OverrideMount  `yaml:"mounts"`        // Extra bind mounts of the build
+	Environment  map[string]string `yaml:"environment"`   // Extra environment of the build
+	Tmpfs        string            `yaml:"tmpfs"`         // Tmpfs size, or "no" to build on disk
+	Network      *PackageNetwork   `yaml:"network"`       // Network policy of the package
+	HistoryDepth int               `yaml:"history_depth"` // Number of changelog entries to keep
+}
+
+// LoadPackageOverrides will read and validate the overrides beside the
+// recipe at pkgPath, returning nil when the package has none.
+func LoadPackageOverrides(pkgPath string) (*PackageOverrides, error) {
+	path := filepath.Join(filepath.Dir(pkgPath), PackageOverridesFile)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	overrides := &PackageOverrides{}
+	if err := yaml.UnmarshalStrict(b, overrides); err != nil {
+		return nil, fmt.Errorf("Invalid build overrides %s, reason: %s", path, err)
+	}
+	if err := overrides.validate(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("Invalid build overrides %s, reason: %s", path, err)
+	}
+	return overrides, nil
+}
+
+// validate checks the overrides, resolving the mount sources against base
+func (o *PackageOverrides) validate(base string) error {
+	if err := checkEnvironment(o.Environment); err != nil {
+		return err
+	}
+	switch tmpfs := strings.TrimSpace(o.Tmpfs); strings.ToLower(tmpfs) {
+	case "", "no", "false", "off", TmpfsSizeAuto:
+	default:
+		if !ValidMemSize(tmpfs) {
+			return ErrInvalidMemSize
+		}
+	}
+	if o.Network != nil {
+		switch o.Network.Policy {
+		case "", NetworkNone, NetworkAllowlist, NetworkOpen:
+		default:
+			return ErrUnknownNetworkPolicy
+		}
+	}
+	if o.HistoryDepth < 0 {
+		return fmt.Errorf("Invalid history depth: %d", o.HistoryDepth)
+	}
+	for _, mount := range o.Mounts {
+		target := filepath.Clean(mount.Target)
+		if mount.Source == "" || !filepath.IsAbs(target) || target == "/" {
+			return ErrInvalidOverrideMount
+		}
+		mount.Target = target
+		if !filepath.IsAbs(mount.Source) {
+			mount.Source = filepath.Join(base, mount.Source)
+		}
+	}
+	return nil
+}
+
+// overrideMountSource resolves the source of the mount, which must lie within
+// the recipe directory or one of MountSources. As solbuild.yml ships with the
+// recipe, only the host configuration may expose anything else, and only the
+// sources it allows may be writable.
+func (p *Package) overrideMountSource(mount *OverrideMount) (string, error) {
+	source, err := filepath.EvalSymlinks(mount.Source)
+	if err != nil {
+		return "", fmt.Errorf("Failed to find override mount %s, reason: %s\n", mount.Source, err)
+	}
+	for _, allowed := range MountSources {
+		if dir, err := filepath.EvalSymlinks(allowed); err == nil && pathWithin(dir, source) {
+			return source, nil
+		}
+	}
+	if recipeDir, err := filepath.EvalSymlinks(filepath.Dir(p.Path)); err == nil && pathWithin(recipeDir, source) {
+		if mount.Writable {
+			return "", fmt.Errorf("Override mount %s may only be writable when listed in mount_sources", mount.Source)
+		}
+		return source, nil
+	}
+	return "", fmt.Errorf("Override mount %s is outside of the recipe directory and mount_sources", mount.Source)
+}
+
+// pathWithin returns true if path is dir or lies beneath it
+func pathWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// BindOverrideMounts will expose the extra mounts of solbuild.yml to the
+// build, read-only unless marked writable.
+func (p *Package) BindOverrideMounts(o *Overlay) error {
+	if p.Overrides == nil {
+		return nil
+	}
+	mountMan := disk.GetMountManager()
+	for _, mount := range p.Overrides.Mounts {
+		source, err := p.overrideMountSource(mount)
+		if err != nil {
+			return err
+		}
+		st, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("Failed to find override mount %s, reason: %s\n", mount.Source, err)
+		}
+		// Symlinks within the root must not lead the mount out of it
+		target, err := secureJoin(o.MountPoint, mount.Target)
+		if err != nil {
+			return fmt.Errorf("Invalid override mount target %s, reason: %s\n", mount.Target, err)
+		}
+		if err := createMountTarget(target, st.IsDir()); err != nil {
+			return fmt.Errorf("Failed to create mount target %s, reason: %s\n", target, err)
+		}
+		var options []string
+		if !mount.Writable {
+			options = append(options, "ro")
+		}
+		log.Debugf("Exposing %s to build at %s\n", source, mount.Target)
+		if err := mountMan.BindMount(source, target, options...); err != nil {
+			return fmt.Errorf("Failed to bind mount %s, reason: %s\n", target, err)
+		}
+		o.ExtraMounts = append(o.ExtraMounts, target)
+	}
+	return nil
+}
+
+// createMountTarget will create the directory, or empty file, that a bind
+// mount is placed over
+func createMountTarget(target string, dir bool) error {
+	if dir {
+		return os.MkdirAll(target, 00755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 00755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 00644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
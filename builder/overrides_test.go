@@ -0,0 +1,155 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackageOverrides(t *testing.T) {
+	dir := t.TempDir()
+	recipe := filepath.Join(dir, "package.yml")
+	if overrides, err := LoadPackageOverrides(recipe); err != nil || overrides != nil {
+		t.Fatalf("Expected no overrides without solbuild.yml, got %v: %v", overrides, err)
+	}
+
+	writeTestFile(t, filepath.Join(dir, PackageOverridesFile), `mounts:
+    - source: testdata
+      target: /opt/testdata/
+    - source: /srv/mirror
+      target: /srv/mirror
+      writable: true
+environment:
+    ZED: last
+    GOFLAGS: -mod=vendor
+tmpfs: 8G
+network:
+    policy: allowlist
+    allow: [proxy.golang.org]
+history_depth: 3
+`)
+	overrides, err := LoadPackageOverrides(recipe)
+	if err != nil {
+		t.Fatalf("Failed to load overrides: %v", err)
+	}
+	if m := overrides.Mounts[0]; m.Source != filepath.Join(dir, "testdata") || m.Target != "/opt/testdata" || m.Writable {
+		t.Errorf("Unexpected relative mount %+v", m)
+	}
+	if m := overrides.Mounts[1]; m.Source != "/srv/mirror" || !m.Writable {
+		t.Errorf("Unexpected absolute mount %+v", m)
+	}
+	if len(overrides.Environment) != 2 || overrides.Environment["GOFLAGS"] != "-mod=vendor" {
+		t.Errorf("Unexpected environment %v", overrides.Environment)
+	}
+	if overrides.Tmpfs != "8G" || overrides.HistoryDepth != 3 {
+		t.Errorf("Unexpected overrides %+v", overrides)
+	}
+
+	// The network_packages of the profile still have the last word
+	pkg := &Package{Name: "nano", Overrides: overrides}
+	policy, err := NewNetworkPolicy(&Profile{}, pkg, true)
+	if err != nil || policy.Mode != NetworkAllowlist || len(policy.Allow) != 1 {
+		t.Errorf("Unexpected network policy %v: %v", policy, err)
+	}
+	profile := &Profile{NetworkPackages: map[string]*PackageNetwork{"nano": {Policy: NetworkNone}}}
+	if policy, err = NewNetworkPolicy(profile, pkg, true); err != nil || policy.Mode != NetworkNone {
+		t.Errorf("Expected the profile to override the package, got %v: %v", policy, err)
+	}
+
+	for _, invalid := range []string{
+		"unknown: true\n",
+		"environment:\n    BAD-NAME: x\n",
+		"tmpfs: lots\n",
+		"network:\n    policy: sometimes\n",
+		"mounts:\n    - source: testdata\n      target: relative\n",
+		"mounts:\n    - source: testdata\n      target: /\n",
+	} {
+		writeTestFile(t, filepath.Join(dir, PackageOverridesFile), invalid)
+		if _, err := LoadPackageOverrides(recipe); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestOverrideMountSource(t *testing.T) {
+	dir := t.TempDir()
+	recipeDir := filepath.Join(dir, "recipe")
+	shared := filepath.Join(dir, "shared")
+	for _, d := range []string{filepath.Join(recipeDir, "files"), shared, filepath.Join(dir, "secret")} {
+		if err := os.MkdirAll(d, 00755); err != nil {
+			t.Fatalf("Failed to create %s: %v", d, err)
+		}
+	}
+	if err := os.Symlink("../secret", filepath.Join(recipeDir, "escape")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	p := &Package{Path: filepath.Join(recipeDir, "package.yml")}
+	defer func(sources []string) { MountSources = sources }(MountSources)
+	MountSources = []string{shared}
+
+	tests := []struct {
+		mount OverrideMount
+		valid bool
+	}{
+		{OverrideMount{Source: filepath.Join(recipeDir, "files")}, true},
+		{OverrideMount{Source: filepath.Join(recipeDir, "files"), Writable: true}, false},
+		{OverrideMount{Source: filepath.Join(recipeDir, "escape")}, false},
+		{OverrideMount{Source: filepath.Join(dir, "secret")}, false},
+		{OverrideMount{Source: shared, Writable: true}, true},
+	}
+	for _, test := range tests {
+		if _, err := p.overrideMountSource(&test.mount); (err == nil) != test.valid {
+			t.Errorf("Expected %+v valid to be %v, got %v", test.mount, test.valid, err)
+		}
+	}
+}
+
+func TestSecureJoin(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "usr/share"), 00755); err != nil {
+		t.Fatalf("Failed to create root: %v", err)
+	}
+	for link, dest := range map[string]string{
+		"host":     "/",
+		"up":       "../../..",
+		"usr/data": "share",
+		"loop":     "loop",
+	} {
+		if err := os.Symlink(dest, filepath.Join(root, link)); err != nil {
+			t.Fatalf("Failed to create symlink: %v", err)
+		}
+	}
+
+	tests := map[string]string{
+		"/opt/testdata":     "opt/testdata",
+		"/host/etc":         "etc",
+		"/up/etc/shadow":    "etc/shadow",
+		"/usr/data/x":       "usr/share/x",
+		"/opt/../../../etc": "etc",
+	}
+	for path, expected := range tests {
+		joined, err := secureJoin(root, path)
+		if err != nil || joined != filepath.Join(root, expected) {
+			t.Errorf("Expected %s to join as %s, got %s: %v", path, expected, joined, err)
+		}
+	}
+	if _, err := secureJoin(root, "/loop/x"); err == nil {
+		t.Errorf("Expected a symlink loop to fail")
+	}
+}
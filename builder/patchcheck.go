@@ -0,0 +1,298 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PatchCheckWarn will report patch drift and unreferenced sources
+	PatchCheckWarn = "warn"
+
+	// PatchCheckStrict will refuse to build when patches drift or sources
+	// are unreferenced
+	PatchCheckStrict = "strict"
+)
+
+var (
+	// PatchCheck is the strictness of the pre-build patch checks, which
+	// are skipped when empty.
+	PatchCheck string
+
+	// PatchFuzz is the fuzz factor a patch may need before it's reported
+	PatchFuzz int
+
+	// ErrUnknownPatchCheck is returned for an unsupported strictness
+	ErrUnknownPatchCheck = errors.New("Patch check must be \"warn\" or \"strict\"")
+
+	// ErrPatchCheck is returned when a strict patch check finds problems
+	ErrPatchCheck = errors.New("Recipe failed the patch checks")
+
+	// ErrNoPatch is returned when the host lacks the patch tool
+	ErrNoPatch = errors.New("Patch checks require patch to be installed on the host")
+
+	// ypkgSteps are the scripts of a package.yml, in the order they run
+	ypkgSteps = []string{"setup", "build", "profile", "install", "check"}
+
+	// patchLineRegex matches a line of a step applying a patch
+	patchLineRegex = regexp.MustCompile(`^\s*(%patch|patch)\s+(.*)$`)
+
+	// patchFuzzRegex matches a hunk that needed fuzz to apply
+	patchFuzzRegex = regexp.MustCompile(`Hunk #\d+ succeeded at \d+ with fuzz (\d+)`)
+)
+
+// ValidPatchCheck will determine whether the strictness is supported
+func ValidPatchCheck(mode string) bool {
+	switch mode {
+	case "", PatchCheckWarn, PatchCheckStrict:
+		return true
+	default:
+		return false
+	}
+}
+
+// CheckPatchTool will ensure that patches can be checked on this host
+func CheckPatchTool() error {
+	if _, err := exec.LookPath("patch"); err != nil {
+		return ErrNoPatch
+	}
+	return nil
+}
+
+// A PatchRef is a patch applied by one of the steps of the recipe
+type PatchRef struct {
+	Step  string // Step of the recipe applying the patch
+	Path  string // Location of the patch on the host
+	Strip int    // Number of leading path components to strip
+}
+
+// readSteps will return the scripts of each step of the package.yml
+func readSteps(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	steps := make(map[string]string)
+	for _, step := range append(ypkgSteps, "environment") {
+		if script, ok := doc[step].(string); ok {
+			steps[step] = script
+		}
+	}
+	return steps, nil
+}
+
+// parsePatchLine will find the patch applied by a line of a step, with
+// $pkgfiles resolved to filesDir. Lines using any other variable, such as
+// loops over a series, can't be resolved and are ignored.
+func parsePatchLine(line, filesDir string) (path string, strip int, ok bool) {
+	match := patchLineRegex.FindStringSubmatch(line)
+	if match == nil {
+		return "", 0, false
+	}
+	fields := strings.Fields(match[2])
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "<" || field == "-i" || field == "--input":
+			if i+1 < len(fields) {
+				i++
+				path = fields[i]
+			}
+		case strings.HasPrefix(field, "<"):
+			path = field[1:]
+		case strings.HasPrefix(field, "--input="):
+			path = strings.TrimPrefix(field, "--input=")
+		case field == "-p" && i+1 < len(fields):
+			i++
+			strip, _ = strconv.Atoi(fields[i])
+		case strings.HasPrefix(field, "-p"):
+			strip, _ = strconv.Atoi(field[2:])
+		case strings.HasPrefix(field, "--strip="):
+			strip, _ = strconv.Atoi(strings.TrimPrefix(field, "--strip="))
+		}
+	}
+	path = strings.Trim(path, `"'`)
+	for _, variable := range []string{"${pkgfiles}", "$pkgfiles"} {
+		path = strings.Replace(path, variable, filesDir, 1)
+	}
+	if path == "" || strings.ContainsAny(path, "$%*") {
+		return "", 0, false
+	}
+	return path, strip, true
+}
+
+// findPatches will return the patches applied by the steps, in order
+func findPatches(steps map[string]string, filesDir string) []PatchRef {
+	var patches []PatchRef
+	for _, step := range ypkgSteps {
+		for _, line := range strings.Split(steps[step], "\n") {
+			if path, strip, ok := parsePatchLine(line, filesDir); ok {
+				patches = append(patches, PatchRef{Step: step, Path: path, Strip: strip})
+			}
+		}
+	}
+	return patches
+}
+
+// unreferencedSources will return the sources, other than the main source
+// which ypkg extracts itself, that no step of the recipe refers to.
+func (p *Package) unreferencedSources(steps map[string]string) []string {
+	var scripts []string
+	for _, script := range steps {
+		scripts = append(scripts, script)
+	}
+	all := strings.Join(scripts, "\n")
+	var unused []string
+	for i, s := range p.Sources {
+		if i == 0 {
+			continue
+		}
+		name := filepath.Base(s.GetBindConfiguration("").BindTarget)
+		if !strings.Contains(all, name) {
+			unused = append(unused, name)
+		}
+	}
+	return unused
+}
+
+// unpackMainSource will extract the main source into dir as the build user,
+// returning the directory ypkg would run the steps in.
+func (p *Package) unpackMainSource(dir string) (string, error) {
+	if len(p.Sources) < 1 {
+		return "", errors.New("Package has no sources to patch")
+	}
+	if err := chownBuildUser(dir); err != nil {
+		return "", err
+	}
+	origin := p.Sources[0].GetBindConfiguration("").BindSource
+	if st, err := os.Stat(origin); err != nil {
+		return "", err
+	} else if st.IsDir() {
+		if out, err := buildUserCommand("cp", "-a", origin, dir).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("Failed to unpack %s, reason: %s", filepath.Base(origin), strings.TrimSpace(string(out)))
+		}
+	} else if err := unpackSource(p.Sources[0], dir); err != nil {
+		return "", err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		return filepath.Join(dir, entries[0].Name()), nil
+	}
+	return dir, nil
+}
+
+// applyPatch will apply the patch to the tree with the given fuzz factor,
+// returning the fuzz the worst hunk needed. The patch is applied by the
+// build user, as it may write anywhere the tree leads it.
+func applyPatch(dir string, patch PatchRef, fuzz int) (int, error) {
+	in, err := os.Open(patch.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	c := buildUserCommand("patch", "-t", "-N", "--no-backup-if-mismatch",
+		fmt.Sprintf("-p%d", patch.Strip), fmt.Sprintf("-F%d", fuzz))
+	c.Dir = dir
+	c.Stdin = in
+	out, err := c.CombinedOutput()
+	worst := 0
+	for _, match := range patchFuzzRegex.FindAllStringSubmatch(string(out), -1) {
+		if n, _ := strconv.Atoi(match[1]); n > worst {
+			worst = n
+		}
+	}
+	if err != nil {
+		return worst, fmt.Errorf("does not apply with fuzz %d:\n%s", fuzz, strings.TrimSpace(string(out)))
+	}
+	return worst, nil
+}
+
+// CheckPatches will ensure that every patch applied by the recipe applies
+// cleanly to the main source, and that every other source is referenced by
+// the recipe, before any time is spent building.
+func (p *Package) CheckPatches() error {
+	if PatchCheck == "" || p.Type != PackageTypeYpkg {
+		return nil
+	}
+	steps, err := readSteps(p.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to read the recipe steps, reason: %s\n", err)
+	}
+	var problems []string
+	for _, name := range p.unreferencedSources(steps) {
+		problems = append(problems, fmt.Sprintf("Source %s is never referenced by the recipe", name))
+	}
+
+	patches := findPatches(steps, filepath.Join(filepath.Dir(p.Path), "files"))
+	if len(patches) > 0 {
+		tmp, err := ioutil.TempDir("", "solbuild-patches-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		tree, err := p.unpackMainSource(tmp)
+		if err != nil {
+			return err
+		}
+		for _, patch := range patches {
+			name := filepath.Base(patch.Path)
+			fuzz, err := applyPatch(tree, patch, PatchFuzz)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Patch %s in %s %s", name, patch.Step, err))
+				continue
+			}
+			if fuzz > 0 {
+				log.Warnf("Patch %s needed fuzz %d to apply\n", name, fuzz)
+			}
+			log.Debugf("Patch %s applies cleanly\n", name)
+		}
+	}
+
+	if len(problems) == 0 {
+		log.Infof("Checked %d patch(es) and %d source(s)\n", len(patches), len(p.Sources))
+		return nil
+	}
+	for _, problem := range problems {
+		if PatchCheck == PatchCheckStrict {
+			log.Errorln(problem)
+		} else {
+			log.Warnln(problem)
+		}
+	}
+	if PatchCheck == PatchCheckStrict {
+		return ErrPatchCheck
+	}
+	return nil
+}
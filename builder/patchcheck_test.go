@@ -0,0 +1,105 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParsePatchLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		path  string
+		strip int
+		ok    bool
+	}{
+		{"%patch -p1 < $pkgfiles/fix-build.patch", "/r/files/fix-build.patch", 1, true},
+		{"    %patch -p0 -i ${pkgfiles}/security/CVE-2021-1234.patch", "/r/files/security/CVE-2021-1234.patch", 0, true},
+		{"patch --strip=2 --input=$pkgfiles/a.diff", "/r/files/a.diff", 2, true},
+		{"%patch -p 1 <\"$pkgfiles/quoted.patch\"", "/r/files/quoted.patch", 1, true},
+		{"for p in $pkgfiles/*.patch; do %patch -p1 < $p; done", "", 0, false},
+		{"%patch -p1 < $patch", "", 0, false},
+		{"%configure --enable-patch", "", 0, false},
+	}
+	for _, test := range tests {
+		path, strip, ok := parsePatchLine(test.line, "/r/files")
+		if path != test.path || strip != test.strip || ok != test.ok {
+			t.Errorf("parsePatchLine(%q) = %q, %d, %v, expected %q, %d, %v", test.line, path, strip, ok, test.path, test.strip, test.ok)
+		}
+	}
+}
+
+func TestFindPatchesInOrder(t *testing.T) {
+	steps := map[string]string{
+		"install": "%make_install\n%patch -p1 < $pkgfiles/late.patch\n",
+		"setup":   "%patch -p1 < $pkgfiles/first.patch\n%patch -p1 < $pkgfiles/second.patch\n%configure\n",
+	}
+	patches := findPatches(steps, "/r/files")
+	if len(patches) != 3 {
+		t.Fatalf("Expected 3 patches, found %d", len(patches))
+	}
+	for i, name := range []string{"/r/files/first.patch", "/r/files/second.patch", "/r/files/late.patch"} {
+		if patches[i].Path != name {
+			t.Fatalf("Patch %d should be %s, found %s", i, name, patches[i].Path)
+		}
+	}
+	if patches[2].Step != "install" {
+		t.Fatalf("Patch step should be install, found %s", patches[2].Step)
+	}
+}
+
+func TestApplyPatchAsBuildUser(t *testing.T) {
+	if err := CheckPatchTool(); err != nil {
+		t.Skip(err)
+	}
+	// The build user applies the patch, so must reach the tree, but not the
+	// recipe holding the patch
+	dir := t.TempDir()
+	if err := os.Chmod(filepath.Dir(dir), 00755); err != nil {
+		t.Fatal(err)
+	}
+	tree := filepath.Join(dir, "tree")
+	writeTestFile(t, filepath.Join(tree, "main.c"), "int main() {}\n")
+	if err := chownBuildUser(tree); err != nil {
+		t.Fatal(err)
+	}
+	recipe := filepath.Join(dir, "recipe")
+	patch := filepath.Join(recipe, "files", "fix.patch")
+	writeTestFile(t, patch, "--- a/main.c\n+++ b/main.c\n@@ -1 +1 @@\n-int main() {}\n+int main() { return 0; }\n")
+	if err := os.Chmod(recipe, 00700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := applyPatch(tree, PatchRef{Path: patch, Strip: 1}, 0); err != nil {
+		t.Fatalf("Failed to apply patch: %s", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(tree, "main.c"))
+	if err != nil || string(b) != "int main() { return 0; }\n" {
+		t.Fatalf("Patch wasn't applied: %q %v", b, err)
+	}
+	st, err := os.Stat(filepath.Join(tree, "main.c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 && st.Sys().(*syscall.Stat_t).Uid != uint32(BuildUserID) {
+		t.Fatalf("Patch should be applied by the build user")
+	}
+}
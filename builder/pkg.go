@@ -24,6 +24,7 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -55,13 +56,27 @@ var (
 
 // Package is the main item we deal with, avoiding the internals
 type Package struct {
-	Name       string          // Name of the package
-	Version    string          // Version of this package
-	Release    int             // Solus upgrades are based entirely on relno
-	Type       PackageType     // ypkg or pspec.xml legacy
-	Path       string          // Path to the build spec
-	Sources    []source.Source // Each package has 0 or more sources that we fetch
-	CanNetwork bool            // Only applicable to ypkg builds
+	Name        string            // Name of the package
+	Version     string            // Version of this package
+	Release     int               // Solus upgrades are based entirely on relno
+	Type        PackageType       // ypkg or pspec.xml legacy
+	Path        string            // Path to the build spec
+	Sources     []source.Source   // Each package has 0 or more sources that we fetch
+	CanNetwork  bool              // Only applicable to ypkg builds
+	Network     *NetworkPolicy    // Network access of the build, if decided
+	Shell       *ChrootShell      // Interactive shell of the chroot, if decided
+	Changes     []string          // Uncommitted changes included in the build
+	Untrusted   string            // Why the recipe commit isn't trusted for publishing, if it isn't
+	Tmpfs       string            // Tmpfs override of the recipe, i.e. "no" or a size
+	Overrides   *PackageOverrides // Build overrides of solbuild.yml, if any
+	Environment []string          // Extra environment of the build, if decided
+
+	collected   []string                 // Names of the packages collected by the build
+	previous    []string                 // Repository versions of the packages, fetched before the build
+	previousErr error                    // Why the repository versions couldn't be fetched, if they couldn't
+	tested      bool                     // Whether the built packages were installed into the root
+	outputs     []string                 // Names of every file collected by the build
+	promoted    []EnvironmentLockPackage // Packages built earlier in the stack and installed for the build
 }
 
 // YmlPackage is a parsed ypkg build file
@@ -69,7 +84,8 @@ type YmlPackage struct {
 	Name       string
 	Version    string
 	Release    int
-	Networking bool // If set to false (default) we disable networking in the build
+	Networking bool   // If set to false (default) we disable networking in the build
+	Tmpfs      string // Overrides the tmpfs size, or disables the tmpfs with "no"
 	Source     []map[string]string
 }
 
@@ -188,6 +204,18 @@ func NewYmlPackage(path string) (*Package, error) {
 		return nil, err
 	}
 	ret.Path = path
+	for _, src := range ret.Sources {
+		// Fetch scripts are found beside the recipe
+		if script, ok := src.(*source.ScriptSource); ok {
+			script.Dir = filepath.Dir(path)
+		}
+	}
+	if ret.Overrides, err = LoadPackageOverrides(path); err != nil {
+		return nil, err
+	}
+	if ret.Overrides != nil && ret.Overrides.Tmpfs != "" {
+		ret.Tmpfs = ret.Overrides.Tmpfs
+	}
 	return ret, nil
 }
 
@@ -206,6 +234,7 @@ func NewYmlPackageFromBytes(by []byte) (*Package, error) {
 		Release:    ypkg.Release,
 		Type:       PackageTypeYpkg,
 		CanNetwork: ypkg.Networking,
+		Tmpfs:      ypkg.Tmpfs,
 	}
 
 	for _, row := range ypkg.Source {
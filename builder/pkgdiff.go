@@ -0,0 +1,314 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReportPackageDiff will compare the built packages against the versions in
+// the repository, writing a report alongside them.
+var ReportPackageDiff bool
+
+// PackageDiffSuffix is the suffix of the report written by ReportPackageDiff
+const PackageDiffSuffix = ".pkgdiff"
+
+// A FileChange describes how a file differs between two packages
+type FileChange struct {
+	Path     string
+	OldSize  int64
+	NewSize  int64
+	OldMode  string
+	NewMode  string
+	OldOwner string
+	NewOwner string
+	Content  bool   // Whether the contents changed
+	Diff     string // Unified diff of changed text contents, when loaded
+}
+
+// A MetadataChange describes a descriptive field of the package metadata
+// that differs between two packages
+type MetadataChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// A PackageDiff describes the changes between two builds of a package. When
+// either side is missing, the package was added or removed entirely.
+type PackageDiff struct {
+	Name        string
+	OldVersion  string // version-release of the previous package
+	NewVersion  string // version-release of the new package
+	Added       []string
+	Removed     []string
+	Changed     []FileChange
+	OldSize     int64
+	NewSize     int64
+	AddedDeps   []string
+	RemovedDeps []string
+	Metadata    []MetadataChange
+
+	oldPath string // Path of the previous eopkg, if any
+	newPath string // Path of the new eopkg, if any
+}
+
+// IsEmpty determines whether the payload and dependencies are unchanged
+func (d *PackageDiff) IsEmpty() bool {
+	return d.OldVersion != "" && d.NewVersion != "" && len(d.Added) == 0 && len(d.Removed) == 0 &&
+		len(d.Changed) == 0 && len(d.AddedDeps) == 0 && len(d.RemovedDeps) == 0 && len(d.Metadata) == 0
+}
+
+// payloadVersion returns version-release for the payload, if any
+func payloadVersion(e *eopkgPayload) string {
+	if e == nil {
+		return ""
+	}
+	return e.Version + "-" + e.Release
+}
+
+// payloadSize returns the installed size of the payload
+func payloadSize(e *eopkgPayload) int64 {
+	var size int64
+	if e != nil {
+		for _, f := range e.Files {
+			size += f.Size
+		}
+	}
+	return size
+}
+
+// diffPayloads compares two payloads, either of which may be nil
+func diffPayloads(previous, current *eopkgPayload) *PackageDiff {
+	d := &PackageDiff{
+		OldVersion: payloadVersion(previous),
+		NewVersion: payloadVersion(current),
+		OldSize:    payloadSize(previous),
+		NewSize:    payloadSize(current),
+	}
+	oldFiles := make(map[string]eopkgFile)
+	oldDeps := make(map[string]bool)
+	if previous != nil {
+		d.Name = previous.Name
+		d.oldPath = previous.path
+		for _, f := range previous.Files {
+			oldFiles[f.Path] = f
+		}
+		for _, dep := range previous.Dependencies {
+			oldDeps[dep] = true
+		}
+	}
+	newDeps := make(map[string]bool)
+	if current != nil {
+		d.Name = current.Name
+		d.newPath = current.path
+		for _, f := range current.Files {
+			old, ok := oldFiles[f.Path]
+			if !ok {
+				d.Added = append(d.Added, f.Path)
+				continue
+			}
+			delete(oldFiles, f.Path)
+			if old == f {
+				continue
+			}
+			d.Changed = append(d.Changed, FileChange{
+				Path:     f.Path,
+				OldSize:  old.Size,
+				NewSize:  f.Size,
+				OldMode:  old.Mode,
+				NewMode:  f.Mode,
+				OldOwner: old.UID + ":" + old.GID,
+				NewOwner: f.UID + ":" + f.GID,
+				Content:  old.Hash != f.Hash || old.Type != f.Type,
+			})
+		}
+		for _, dep := range current.Dependencies {
+			newDeps[dep] = true
+		}
+	}
+	for path := range oldFiles {
+		d.Removed = append(d.Removed, path)
+	}
+	sort.Strings(d.Removed)
+	d.AddedDeps = setDifference(newDeps, oldDeps)
+	d.RemovedDeps = setDifference(oldDeps, newDeps)
+	if previous != nil && current != nil {
+		d.Metadata = diffMetadata(previous.Metadata, current.Metadata)
+	}
+	return d
+}
+
+// diffMetadata compares the descriptive metadata of two packages
+func diffMetadata(previous, current []metadataField) []MetadataChange {
+	old := make(map[string]string)
+	for _, f := range previous {
+		old[f.Name] = f.Value
+	}
+	var changes []MetadataChange
+	for _, f := range current {
+		if old[f.Name] != f.Value {
+			changes = append(changes, MetadataChange{Field: f.Name, Old: old[f.Name], New: f.Value})
+		}
+	}
+	return changes
+}
+
+// DiffPackages will compare two sets of eopkg files, matching them by the
+// package name. Packages present in only one set are reported as added or
+// removed.
+func DiffPackages(previous, current []string) ([]*PackageDiff, error) {
+	read := func(paths []string) (map[string]*eopkgPayload, error) {
+		payloads := make(map[string]*eopkgPayload)
+		for _, path := range paths {
+			payload, err := readEopkgPayload(path)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read %s, reason: %s\n", filepath.Base(path), err)
+			}
+			payloads[payload.Name] = payload
+		}
+		return payloads, nil
+	}
+	oldPayloads, err := read(previous)
+	if err != nil {
+		return nil, err
+	}
+	newPayloads, err := read(current)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for name := range oldPayloads {
+		names[name] = true
+	}
+	for name := range newPayloads {
+		names[name] = true
+	}
+	var diffs []*PackageDiff
+	for _, name := range sortedKeys(names) {
+		diffs = append(diffs, diffPayloads(oldPayloads[name], newPayloads[name]))
+	}
+	return diffs, nil
+}
+
+// formatSizeDelta returns a signed, human readable size change
+func formatSizeDelta(old, new int64) string {
+	delta := new - old
+	sign := "+"
+	if delta < 0 {
+		sign = "-"
+		delta = -delta
+	}
+	return fmt.Sprintf("%s%d bytes", sign, delta)
+}
+
+// WritePackageDiffs will write a human readable report of the changes
+func WritePackageDiffs(w io.Writer, diffs []*PackageDiff) {
+	for i, d := range diffs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		switch {
+		case d.OldVersion == "":
+			fmt.Fprintf(w, "%s: new package %s\n", d.Name, d.NewVersion)
+		case d.NewVersion == "":
+			fmt.Fprintf(w, "%s: package removed, was %s\n", d.Name, d.OldVersion)
+		default:
+			fmt.Fprintf(w, "%s: %s -> %s\n", d.Name, d.OldVersion, d.NewVersion)
+		}
+		fmt.Fprintf(w, "  Installed size: %d -> %d (%s)\n", d.OldSize, d.NewSize, formatSizeDelta(d.OldSize, d.NewSize))
+		if d.IsEmpty() {
+			fmt.Fprintln(w, "  No changes to files or dependencies")
+			continue
+		}
+		for _, m := range d.Metadata {
+			fmt.Fprintf(w, "  ~ %s: %q -> %q\n", m.Field, m.Old, m.New)
+		}
+		for _, dep := range d.AddedDeps {
+			fmt.Fprintf(w, "  + dependency %s\n", dep)
+		}
+		for _, dep := range d.RemovedDeps {
+			fmt.Fprintf(w, "  - dependency %s\n", dep)
+		}
+		// Only detail the files of packages present on both sides
+		if d.OldVersion == "" || d.NewVersion == "" {
+			continue
+		}
+		for _, path := range d.Added {
+			fmt.Fprintf(w, "  + /%s\n", path)
+		}
+		for _, path := range d.Removed {
+			fmt.Fprintf(w, "  - /%s\n", path)
+		}
+		for _, c := range d.Changed {
+			var changes []string
+			if c.Content {
+				changes = append(changes, fmt.Sprintf("content %s", formatSizeDelta(c.OldSize, c.NewSize)))
+			}
+			if c.OldMode != c.NewMode {
+				changes = append(changes, fmt.Sprintf("mode %s -> %s", c.OldMode, c.NewMode))
+			}
+			if c.OldOwner != c.NewOwner {
+				changes = append(changes, fmt.Sprintf("owner %s -> %s", c.OldOwner, c.NewOwner))
+			}
+			fmt.Fprintf(w, "  ~ /%s (%s)\n", c.Path, strings.Join(changes, ", "))
+			if c.Diff != "" {
+				for _, line := range strings.Split(strings.TrimSuffix(c.Diff, "\n"), "\n") {
+					fmt.Fprintf(w, "      %s\n", line)
+				}
+			}
+		}
+	}
+}
+
+// DiffAgainstRepo will compare the built packages with the repository versions
+// fetched before the build, and write a report of the changes into the work
+// directory.
+func (p *Package) DiffAgainstRepo(overlay *Overlay) error {
+	built, _ := filepath.Glob(filepath.Join(p.GetWorkDir(overlay), "*.eopkg"))
+	if len(built) < 1 {
+		return nil
+	}
+	if p.previousErr != nil {
+		return p.previousErr
+	}
+	if len(p.previous) == 0 {
+		log.Infoln("No repository versions of the packages to compare against")
+	}
+
+	diffs, err := DiffPackages(p.previous, built)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	WritePackageDiffs(&buf, diffs)
+	log.Infof("Changes against the repository:\n%s", buf.String())
+
+	path := filepath.Join(p.GetWorkDir(overlay), fmt.Sprintf("%s-%s-%d%s", p.Name, p.Version, p.Release, PackageDiffSuffix))
+	if err := ioutil.WriteFile(path, buf.Bytes(), 00644); err != nil {
+		return fmt.Errorf("Failed to write package diff, reason: %s\n", err)
+	}
+	return nil
+}
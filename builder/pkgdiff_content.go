@@ -0,0 +1,164 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// maxContentDiffSize is the largest file whose contents are diffed
+	maxContentDiffSize = 1 << 20
+
+	// payloadArchive is the archive of the installed files within an eopkg
+	payloadArchive = "install.tar.xz"
+)
+
+// isText determines whether the contents look like text, using the same
+// heuristic as git and diff: a NUL within the first 8000 bytes is binary.
+func isText(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return !bytes.Contains(content, []byte{0})
+}
+
+// readPayloadFiles will read the wanted regular files from the payload of
+// an eopkg, omitting those too large to diff. xz is run on the host, as
+// Go has no decompressor for it.
+func readPayloadFiles(path string, wanted map[string]bool) (map[string][]byte, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	b, err := readZipEntry(archive, payloadArchive)
+	if err != nil {
+		return nil, err
+	}
+	c := exec.Command("xz", "--decompress", "--stdout")
+	c.Stdin = bytes.NewReader(b)
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to run xz, reason: %s", err)
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.Wait()
+			return nil, err
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if !wanted[name] || hdr.Typeflag != tar.TypeReg || hdr.Size > maxContentDiffSize {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			c.Wait()
+			return nil, err
+		}
+		files[name] = content
+	}
+	io.Copy(ioutil.Discard, out)
+	if err := c.Wait(); err != nil {
+		return nil, fmt.Errorf("Failed to decompress %s, reason: %s", payloadArchive, err)
+	}
+	return files, nil
+}
+
+// unifiedDiff returns the unified diff of two versions of a file, using
+// diff on the host.
+func unifiedDiff(path string, old, new []byte) (string, error) {
+	dir, err := ioutil.TempDir("", "solbuild-pkgdiff-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	oldPath, newPath := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	if err := ioutil.WriteFile(oldPath, old, 00644); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(newPath, new, 00644); err != nil {
+		return "", err
+	}
+	out, err := exec.Command("diff", "-u", "--label", "a/"+path, "--label", "b/"+path, oldPath, newPath).Output()
+	// diff exits with 1 when the files differ
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		err = nil
+	}
+	return string(out), err
+}
+
+// LoadContentDiffs will fill in the unified diffs of every changed text file
+// within packages present on both sides. Binary files and files larger than
+// 1MiB are only reported as changed.
+func LoadContentDiffs(diffs []*PackageDiff) error {
+	for _, d := range diffs {
+		if d.oldPath == "" || d.newPath == "" {
+			continue
+		}
+		wanted := make(map[string]bool)
+		for _, c := range d.Changed {
+			if c.Content {
+				wanted[c.Path] = true
+			}
+		}
+		if len(wanted) == 0 {
+			continue
+		}
+		previous, err := readPayloadFiles(d.oldPath, wanted)
+		if err != nil {
+			return fmt.Errorf("Failed to read the payload of %s, reason: %s\n", filepath.Base(d.oldPath), err)
+		}
+		current, err := readPayloadFiles(d.newPath, wanted)
+		if err != nil {
+			return fmt.Errorf("Failed to read the payload of %s, reason: %s\n", filepath.Base(d.newPath), err)
+		}
+		for i := range d.Changed {
+			c := &d.Changed[i]
+			old, ok := previous[c.Path]
+			if !ok {
+				continue
+			}
+			new, ok := current[c.Path]
+			if !ok || !isText(old) || !isText(new) {
+				continue
+			}
+			if c.Diff, err = unifiedDiff(c.Path, old, new); err != nil {
+				return fmt.Errorf("Failed to diff /%s, reason: %s\n", c.Path, err)
+			}
+		}
+	}
+	return nil
+}
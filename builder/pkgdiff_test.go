@@ -0,0 +1,102 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeDiffEopkg will create an eopkg with the given release, dependencies
+// and files.xml entries
+func writeDiffEopkg(t *testing.T, path, release string, deps []string, files string) {
+	var depXML string
+	for _, dep := range deps {
+		depXML += "<Dependency>" + dep + "</Dependency>"
+	}
+	writeTestEopkg(t, path, map[string]string{
+		"metadata.xml": fmt.Sprintf(`<PISI><Package><Name>nano</Name><RuntimeDependencies>%s</RuntimeDependencies>
+<History><Update release="%s"><Version>7.2</Version></Update><Update release="1"><Version>1.0</Version></Update></History></Package></PISI>`, depXML, release),
+		"files.xml": "<Files>" + files + "</Files>",
+	})
+}
+
+func diffTestFile(path, mode, hash string, size int) string {
+	return fmt.Sprintf("<File><Path>%s</Path><Type>data</Type><Size>%d</Size><Uid>0</Uid><Gid>0</Gid><Mode>%s</Mode><Hash>%s</Hash></File>", path, size, mode, hash)
+}
+
+func TestDiffPackages(t *testing.T) {
+	dir := t.TempDir()
+	previous := filepath.Join(dir, "nano-7.2-160-1-x86_64.eopkg")
+	current := filepath.Join(dir, "nano-7.2-161-1-x86_64.eopkg")
+	writeDiffEopkg(t, previous, "160", []string{"glibc", "ncurses"},
+		diffTestFile("usr/bin/nano", "0755", "aaaa", 100)+
+			diffTestFile("usr/bin/rnano", "0755", "bbbb", 10)+
+			diffTestFile("usr/share/nano/c.nanorc", "0644", "cccc", 5))
+	writeDiffEopkg(t, current, "161", []string{"file", "glibc"},
+		diffTestFile("usr/bin/nano", "0755", "dddd", 120)+
+			diffTestFile("usr/share/nano/c.nanorc", "0600", "cccc", 5)+
+			diffTestFile("usr/share/nano/go.nanorc", "0644", "eeee", 7))
+
+	diffs, err := DiffPackages([]string{previous}, []string{current})
+	if err != nil {
+		t.Fatalf("Failed to diff packages: %s", err)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("Expected a single package diff, got %d", len(diffs))
+	}
+	d := diffs[0]
+	if d.OldVersion != "7.2-160" || d.NewVersion != "7.2-161" {
+		t.Fatalf("Unexpected versions %s -> %s", d.OldVersion, d.NewVersion)
+	}
+	if !reflect.DeepEqual(d.Added, []string{"usr/share/nano/go.nanorc"}) || !reflect.DeepEqual(d.Removed, []string{"usr/bin/rnano"}) {
+		t.Fatalf("Unexpected file changes: +%v -%v", d.Added, d.Removed)
+	}
+	if len(d.Changed) != 2 || !d.Changed[0].Content || d.Changed[1].Content || d.Changed[1].NewMode != "0600" {
+		t.Fatalf("Unexpected modified files: %+v", d.Changed)
+	}
+	if !reflect.DeepEqual(d.AddedDeps, []string{"file"}) || !reflect.DeepEqual(d.RemovedDeps, []string{"ncurses"}) {
+		t.Fatalf("Unexpected dependency changes: +%v -%v", d.AddedDeps, d.RemovedDeps)
+	}
+	if d.OldSize != 115 || d.NewSize != 132 {
+		t.Fatalf("Unexpected sizes %d -> %d", d.OldSize, d.NewSize)
+	}
+
+	var buf bytes.Buffer
+	WritePackageDiffs(&buf, diffs)
+	for _, want := range []string{"nano: 7.2-160 -> 7.2-161", "(+17 bytes)", "- /usr/bin/rnano", "mode 0644 -> 0600", "+ dependency file"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("Report is missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestDiffMetadata(t *testing.T) {
+	previous := []metadataField{{"summary", "Text editor"}, {"license", "GPL-3.0-or-later"}, {"component", "editor"}}
+	current := []metadataField{{"summary", "Small text editor"}, {"license", "GPL-3.0-or-later"}, {"component", "editor"}}
+	want := []MetadataChange{{Field: "summary", Old: "Text editor", New: "Small text editor"}}
+	if got := diffMetadata(previous, current); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected metadata changes: %+v", got)
+	}
+	if !isText([]byte("#!/bin/sh\necho nano\n")) || isText([]byte("\x7fELF\x02\x01\x01\x00")) {
+		t.Fatalf("Failed to tell text from binary contents")
+	}
+}
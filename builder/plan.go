@@ -0,0 +1,364 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"github.com/getsolus/solbuild/builder/source"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A BuildPlan describes every step that a build would take, so that it can
+// be reviewed on sensitive build hosts before anything is performed.
+type BuildPlan struct {
+	Sections []*PlanSection
+}
+
+// A PlanSection is a titled group of steps within a BuildPlan
+type PlanSection struct {
+	Title string
+	Steps []string
+}
+
+// section will begin a new section of the plan
+func (b *BuildPlan) section(title string) *PlanSection {
+	s := &PlanSection{Title: title}
+	b.Sections = append(b.Sections, s)
+	return s
+}
+
+// add will append a formatted step to the section
+func (s *PlanSection) add(format string, v ...interface{}) {
+	s.Steps = append(s.Steps, fmt.Sprintf(format, v...))
+}
+
+// Write will print the plan in a human readable form
+func (b *BuildPlan) Write(w io.Writer) error {
+	for i, section := range b.Sections {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s:\n", section.Title); err != nil {
+			return err
+		}
+		for _, step := range section.Steps {
+			if _, err := fmt.Fprintf(w, "  - %s\n", step); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Plan will describe the build of the package without performing any of
+// it. Nothing is mounted, fetched or executed.
+func (m *Manager) Plan() (*BuildPlan, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.pkg == nil {
+		return nil, ErrNoPackage
+	}
+	pkg := m.pkg
+	o := m.overlay
+	plan := &BuildPlan{}
+
+	s := plan.section("Environment")
+	s.add("Build %s %s-%d (%s) with profile %s", pkg.Name, pkg.Version, pkg.Release, pkg.Type, m.profile.Name)
+	if g := m.image.pinned; g != nil {
+		s.add("Use image %s from %s, pinned to generation %d updated %s", m.image.Name, m.image.ImagePath, g.Generation, g.Updated.Format(time.RFC3339))
+	} else if g, _ := LoadImageGeneration(m.image); g != nil {
+		s.add("Use image %s from %s, at generation %d updated %s", m.image.Name, m.image.ImagePath, g.Generation, g.Updated.Format(time.RFC3339))
+	} else {
+		s.add("Use image %s from %s", m.image.Name, m.image.ImagePath)
+	}
+	if m.profile.CPUBaseline != "" {
+		s.add("Require the host CPU to support %s, and hide newer features from glibc", m.profile.CPUBaseline)
+	}
+	if IfChanged {
+		s.add("Skip the build if %s shows nothing changed", GetBuildStampPath(pkg, "."))
+	}
+	s.add("Take lock %s", o.LockPath)
+	if timeouts, err := NewBuildTimeouts(m.Config.Timeout, m.Config.FetchTimeout, m.Config.SetupTimeout, m.Config.BuildTimeout); err == nil && !timeouts.IsEmpty() {
+		s.add("Tear down the build if it runs over %s", timeouts)
+	}
+	if m.Config.ZramSwapSize != "" {
+		s.add("Provision %s of zram swap", m.Config.ZramSwapSize)
+	}
+	if m.profile.SecretsFile != "" || len(m.profile.SecretEnv) > 0 {
+		s.add("Decrypt build secrets for the build step only")
+	}
+	if m.locked {
+		s.add("Verify the environment against %s", GetEnvironmentLockPath(pkg))
+	}
+
+	tmpfs, err := m.tmpfsPlan()
+	if err != nil {
+		return nil, err
+	}
+	backend, fallback := rootfsBackend(m.profile, tmpfs.Enable, m.Config.OverlayRootDir)
+	o.RootfsBackend = backend
+	keep, _ := ParseKeepRoot(m.Config.KeepRoot)
+	reuse := keep > 0 && !tmpfs.Enable && pkg.keptRootUsable(o)
+
+	s = plan.section("Mounts")
+	if reuse {
+		s.add("Reuse kept build root %s", o.BaseDir)
+	} else {
+		s.add("Remove stale workspace %s", o.BaseDir)
+	}
+	if tmpfs.Enable {
+		s.add("Mount %s at %s, retrying on disk if it fills up", tmpfs, o.BaseDir)
+	} else if tmpfs.Reason != "" {
+		s.add("Build on %s", tmpfs)
+	}
+	if backend == RootfsBtrfs {
+		s.add("Populate base subvolume %s from %s if the image changed", o.SubvolumeDir, m.image.ImagePath)
+		s.add("Snapshot %s at %s", o.SubvolumeDir, o.MountPoint)
+	} else {
+		if fallback != "" {
+			s.add("Use overlayfs, btrfs snapshots are unavailable for %s", fallback)
+		}
+		s.add("Mount %s read-only at %s", m.image.ImagePath, o.ImgDir)
+		s.add("Mount overlayfs at %s (lower=%s upper=%s work=%s)", o.MountPoint, o.ImgDir, o.UpperDir, o.WorkDir)
+	}
+	if _, ok := backendTools[m.Config.Backend]; ok {
+		s.add("Run every command in a %s container over %s", m.Config.Backend, o.MountPoint)
+	} else {
+		for _, vfs := range []string{"dev", "dev/pts", "proc", "sys", "dev/shm"} {
+			s.add("Mount %s at %s", vfs, filepath.Join(o.MountPoint, vfs))
+		}
+	}
+
+	s = plan.section("Assets")
+	s.add("Copy %s and its files into %s", pkg.Path, pkg.GetWorkDir(o))
+	if m.history != nil {
+		s.add("Write history.xml with %d entries", len(m.history.Updates))
+	}
+
+	s = plan.section("Sources")
+	if len(pkg.Sources) == 0 {
+		s.add("None")
+	}
+	for _, src := range pkg.Sources {
+		state := "fetch"
+		if src.IsFetched() {
+			state = "cached"
+		}
+		s.add("%s: %s", state, source.Describe(src))
+	}
+	if limits, err := NewStageLimits(m.Config.FetchNice, m.Config.FetchIONice); err == nil && !Foreground && !limits.IsEmpty() {
+		s.add("Fetch with %s", limits)
+	}
+	if m.Config.FetchBandwidth != "" && !Foreground {
+		s.add("Limit each download to %s/s", m.Config.FetchBandwidth)
+	}
+
+	if m.Config.CcacheSeedURL != "" && pkg.Type == PackageTypeYpkg {
+		s.add("Seed ccache from %s, unless unchanged", pkg.ccacheSeedURL(m.Config.CcacheSeedURL))
+	}
+	if m.Config.PatchCheck != "" && pkg.Type == PackageTypeYpkg {
+		s.add("Check patches apply to the main source with fuzz %d, and every source is referenced (%s)", m.Config.PatchFuzz, m.Config.PatchCheck)
+		if m.Config.ExtractCache && len(pkg.Sources) > 0 && extractedTree(pkg.Sources[0]) != "" {
+			s.add("Extract the main source for the check once into %s", extractedTree(pkg.Sources[0]))
+		}
+	}
+	if m.Config.ExtractThreads > 0 {
+		s.add("Decompress source archives with %d threads, on the host and with xz in the root", m.Config.ExtractThreads)
+	}
+
+	s = plan.section("Repositories")
+	switch {
+	case len(m.profile.RemoveRepos) == 1 && m.profile.RemoveRepos[0] == "*":
+		s.add("Remove all repositories of the image")
+	case len(m.profile.RemoveRepos) > 0:
+		s.add("Remove %s", strings.Join(m.profile.RemoveRepos, ", "))
+	}
+	for _, repo := range m.profile.reposToAdd() {
+		if repo.Local {
+			s.add("Bind mount %s at %s and add it as %s", repo.URI, filepath.Join(BindRepoDir, repo.Name), repo.Name)
+			if repo.AutoIndex {
+				s.add("Reindex %s", repo.Name)
+			}
+		} else {
+			s.add("Add %s from %s", repo.Name, repo.URI)
+		}
+	}
+	if len(s.Steps) == 0 {
+		s.add("Use the repositories of the image")
+	}
+
+	s = plan.section("Commands in the container")
+	if !reuse {
+		s.add(eopkgCommand("eopkg upgrade -y"))
+		s.add(eopkgCommand("eopkg install -c system.devel -y"))
+	}
+	if pkg.Type == PackageTypeYpkg {
+		s.add(pkg.installDepsCommand())
+		if ActivePromotion != nil && ActivePromotion.Feeds() {
+			s.add("Compare the installed packages with the %d built earlier in the stack (%s)", len(ActivePromotion.Packages), ActivePromotion.Policy)
+		}
+		s.add(chownHomeCommand())
+		network, err := NewNetworkPolicy(m.profile, pkg, m.manifestTarget != "")
+		if err != nil {
+			return nil, err
+		}
+		switch network.Mode {
+		case NetworkOpen:
+			s.add("Keep networking, as allowed by the network policy")
+		case NetworkAllowlist:
+			s.add("Drop networking, leaving only loopback and a proxy to %s", strings.Join(network.Allow, ", "))
+		default:
+			s.add("Drop networking, leaving only loopback")
+		}
+	}
+	s.add("Bind mount sources into %s", pkg.GetSourceDirInternal())
+	s.add("Bind mount ccache and sccache into %s and %s", pkg.GetCcacheDirInternal(), pkg.GetSccacheDirInternal())
+	if m.Config.SccacheRemote != "" {
+		s.add("Share the sccache with %s", Redact(m.Config.SccacheRemote))
+	}
+	if pkg.Type == PackageTypeYpkg {
+		s.add("Bind mount the cargo registry and git checkouts into %s", pkg.GetCargoDirInternal())
+		if m.Config.CargoTargetCache {
+			s.add("Bind mount the cargo target directory of %s into %s", pkg.Name, pkg.GetCargoTargetDirInternal())
+		}
+		for _, name := range m.Config.LanguageCaches {
+			s.add("Bind mount the %s cache into %s", name, pkg.GetLanguageCacheDirInternal(name))
+		}
+		if pkg.Overrides != nil {
+			for _, mount := range pkg.Overrides.Mounts {
+				mode := "read-only"
+				if mount.Writable {
+					mode = "writable"
+				}
+				s.add("Bind mount %s into %s, %s (%s)", mount.Source, mount.Target, mode, PackageOverridesFile)
+			}
+		}
+	}
+	if size, err := buildTmpSize(m.Config); err == nil {
+		s.add("Mount a %s tmpfs as the TMPDIR of the build, %s", size, BuildTmpDir)
+	} else {
+		s.add("Create %s as the TMPDIR of the build, of an invalid size", BuildTmpDir)
+	}
+	if m.Config.AdaptiveJobs {
+		s.add("Set the job count from available memory")
+	}
+	if compression, err := NewCompression(m.Config.CompressionLevel, m.Config.CompressionThreads); err == nil && compression != nil {
+		s.add("Compress packages with %s", compression)
+	}
+	if limits, err := NewStageLimits(m.Config.BuildNice, m.Config.BuildIONice); err == nil && !Foreground && !limits.IsEmpty() {
+		s.add("Build with %s", limits)
+	}
+	if limits, err := NewResourceLimits(m.profile.CPUQuota, m.profile.MemoryMax, m.profile.IOWeight); err == nil && !limits.IsEmpty() {
+		s.add("Limit the build to %s in a cgroup", limits)
+	}
+	if pkg.Type == PackageTypeYpkg {
+		if epoch := m.history.SourceDateEpoch(); epoch > 0 {
+			s.add("Export SOURCE_DATE_EPOCH=%d", epoch)
+		}
+		if env, err := NewBuildEnvironment(m.profile, pkg); err == nil && len(env) > 0 {
+			s.add("Export %s", strings.Join(env, " "))
+		}
+		if CheckRetries > 1 {
+			s.add("Retry the check stage up to %d times", CheckRetries)
+		}
+		if TraceBuild {
+			s.add("Trace the commands executed by the build into %s", pkg.GetTracePath())
+		}
+		s.add(pkg.ypkgBuildCommand(m.history))
+		if !DisableABIReport {
+			s.add("Generate the ABI report")
+		}
+		if CheckABIBreaks {
+			s.add("Compare the ABI report with the previous release, failing on breaks")
+		}
+	} else {
+		if TraceBuild {
+			s.add("Trace the commands executed by the build into %s", pkg.GetTracePath())
+		}
+		s.add(pkg.xmlBuildCommand())
+	}
+
+	if len(m.Config.Hooks) > 0 {
+		s = plan.section("Hooks")
+		for _, hook := range m.Config.Hooks {
+			required := ""
+			if hook.Required {
+				required = ", failing the build if it fails"
+			}
+			s.add("Run %s on the %s at %s%s", hook.Command, hook.where(), hook.Point, required)
+		}
+	}
+
+	s = plan.section("Results")
+	if InstallTest || m.Config.InstallTest {
+		test := "Install the built packages into the root"
+		if PathExists(filepath.Join(filepath.Dir(pkg.Path), InstallTestScript)) {
+			test += fmt.Sprintf(" and run %s as %s", InstallTestScript, BuildUser)
+		}
+		s.add(test)
+	}
+	s.add("Report the peak usage of %s, and large files left in other temporary directories", BuildTmpDir)
+	if SkipIdenticalRebuilds {
+		s.add("Compare the packages with the repository and skip identical results")
+	}
+	if ReportPackageDiff {
+		s.add("Report the changes against the repository versions of the packages")
+	}
+	if m.history != nil && m.Config.AppStreamReleases {
+		s.add("Replace the releases of the installed AppStream metainfo with the history, before packaging")
+	}
+	if m.Config.SizeCheck != "" {
+		s.add("Compare the package sizes with the last build, allowing %d%% growth (%s)", sizeGrowthLimit(m.Config), m.Config.SizeCheck)
+		if AcceptSizeGrowth {
+			s.add("Record the package sizes despite any growth")
+		}
+	}
+	if m.history != nil && len(m.Config.HistoryFormats) > 0 {
+		s.add("Write the history as %s", strings.Join(m.Config.HistoryFormats, ", "))
+	}
+	if m.Config.SignPackages {
+		s.add("Sign the packages with %s", m.Config.SigningKey)
+	}
+	if len(pkg.Changes) > 0 {
+		s.add("Taint the packages with %d uncommitted change(s)", len(pkg.Changes))
+	}
+	switch {
+	case pkg.Untrusted != "":
+		s.add("Mark the packages as not publishable, the recipe commit is not trusted: %s", pkg.Untrusted)
+	case m.manifestTarget != "":
+		s.add("Write a transit manifest for %s", m.manifestTarget)
+	}
+	if m.Config.ArtifactName != "" {
+		s.add("Name packages %s.eopkg", m.Config.ArtifactName)
+	}
+	collision := m.Config.ArtifactCollision
+	if collision == "" {
+		collision = CollisionOverwrite
+	}
+	s.add("Collect packages into the current directory, and %s on collision", collision)
+	s.add("Write the build stamp %s", GetBuildStampPath(pkg, "."))
+	s.add("Unmount and clean up %s", o.BaseDir)
+	if keep > 0 && !tmpfs.Enable {
+		s.add("Keep the build root for %s, then tear it down", keep)
+	}
+	return plan, nil
+}
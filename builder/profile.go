@@ -19,6 +19,7 @@ package builder
 import (
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/getsolus/solbuild/builder/source"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -32,16 +33,46 @@ type Repo struct {
 	URI       string `toml:"uri"`       // URI of the repository
 	Local     bool   `toml:"local"`     // Local repository for bindmounting
 	AutoIndex bool   `toml:"autoindex"` // Enable automatic indexing of the repo
+	Priority  int    `toml:"priority"`  // Higher priority repos are added first, taking precedence
 }
 
 // A Profile is a configuration defining what backing image to use, what repos
 // to add, etc.
 type Profile struct {
-	AddRepos    []string         `toml:"add_repos"`    // Allow locking to a single set of repos
-	Image       string           `toml:"image"`        // The backing image for this profile
-	Name        string           `toml:"-"`            // Name of this profile, set by file name not toml
-	RemoveRepos []string         `toml:"remove_repos"` // A set of repos to remove. ["*"] is valid here.
-	Repos       map[string]*Repo `toml:"repo"`         // Allow defining custom repos
+	AddRepos           []string                   `toml:"add_repos"`            // Allow locking to a single set of repos
+	Backend            string                     `toml:"backend"`              // How commands are run in the build root, overriding the config
+	CheckRetries       int                        `toml:"check_retries"`        // Attempts given to the check stage of flaky packages
+	CheckRetryPackages []string                   `toml:"check_retry_packages"` // Packages with a flaky check stage, ["*"] is valid here.
+	ChrootPath         []string                   `toml:"chroot_path"`          // Directories prepended to the PATH of the chroot shell
+	ChrootRC           string                     `toml:"chroot_rc"`            // Commands run as the chroot shell starts
+	ChrootShell        string                     `toml:"chroot_shell"`         // Shell spawned by the chroot command
+	Consensus          int                        `toml:"consensus"`            // Fetches that must agree on a source digest
+	ConsensusPackages  []string                   `toml:"consensus_packages"`   // Packages requiring mirror consensus, ["*"] is valid here.
+	CPUBaseline        string                     `toml:"cpu_baseline"`         // x86-64 level the image expects of the host CPU
+	CcacheMaxSize      string                     `toml:"ccache_max_size"`      // Size the ccache is trimmed to as builds add to it, i.e. 20G
+	CPUQuota           string                     `toml:"cpu_quota"`            // CPUs the build command may use, i.e. 2 or 250%
+	Environment        map[string]string          `toml:"environment"`          // Variables exported to the build
+	Extends            string                     `toml:"extends"`              // Profile whose settings this one overrides
+	HistoryDepth       int                        `toml:"history_depth"`        // Maximum changelog entries, -1 for unlimited
+	HistoryTagPatterns []string                   `toml:"history_tag_patterns"` // Override the tag patterns from the config
+	Image              string                     `toml:"image"`                // The backing image for this profile
+	ImagePins          map[string]string          `toml:"image_pins"`           // Generations of the image packages are built against
+	IOWeight           int                        `toml:"io_weight"`            // I/O weight of the build command, from 1 to 10000
+	IPFamily           string                     `toml:"ip_family"`            // Restrict fetches to "ipv4" or "ipv6"
+	MemoryMax          string                     `toml:"memory_max"`           // Memory the build command may use, i.e. 8G
+	Name               string                     `toml:"-"`                    // Name of this profile, set by file name not toml
+	Network            string                     `toml:"network"`              // Network policy of builds: none, allowlist or open
+	NetworkAllow       []string                   `toml:"network_allow"`        // Hosts reachable by builds with the allowlist policy
+	NetworkPackages    map[string]*PackageNetwork `toml:"network_packages"`     // Network policies of individual packages
+	PreferIPv4         bool                       `toml:"prefer_ipv4"`          // Try IPv4 first on dual-stack hosts
+	RemoveRepos        []string                   `toml:"remove_repos"`         // A set of repos to remove. ["*"] is valid here.
+	Repos              map[string]*Repo           `toml:"repo"`                 // Allow defining custom repos
+	RootfsBackend      string                     `toml:"rootfs_backend"`       // How the build root is formed: overlay or btrfs
+	SecretEnv          []string                   `toml:"secret_env"`           // Host environment variables passed to the build as secrets
+	SecretsFile        string                     `toml:"secrets_file"`         // age or GPG encrypted file of KEY=VALUE secrets
+	SecretsIdentity    string                     `toml:"secrets_identity"`     // age identity used to decrypt the secrets file
+	SourceMirrors      map[string][]string        `toml:"source_mirrors"`       // Independent mirrors for source URL prefixes
+	SubmoduleRewrites  map[string]string          `toml:"submodule_rewrite"`    // Replacement URL prefixes for git submodules
 }
 
 var (
@@ -83,6 +114,12 @@ func GetAllProfiles() (map[string]*Profile, error) {
 
 // NewProfileFromPath will attempt to load a profile from the given file name
 func NewProfileFromPath(path string) (*Profile, error) {
+	return loadProfile(path, nil)
+}
+
+// loadProfile will load the profile at path on top of the profile it extends,
+// if any. The chain holds the profiles already being loaded, to catch cycles.
+func loadProfile(path string, chain []string) (*Profile, error) {
 	basename := filepath.Base(path)
 	if !strings.HasSuffix(basename, ProfileSuffix) {
 		return nil, fmt.Errorf("Not a .profile file: %v", path)
@@ -97,16 +134,43 @@ func NewProfileFromPath(path string) (*Profile, error) {
 	profileName := basename[:len(basename)-len(ProfileSuffix)]
 
 	var b []byte
-	profile := &Profile{Name: profileName}
 
 	// Read the config file
 	if b, err = ioutil.ReadAll(fi); err != nil {
 		return nil, err
 	}
 
+	// Find out what we extend before decoding the rest
+	var header struct {
+		Extends string `toml:"extends"`
+	}
+	if _, err = toml.Decode(string(b), &header); err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{}
+	if header.Extends != "" {
+		abs, _ := filepath.Abs(path)
+		for _, seen := range chain {
+			if seen == abs {
+				return nil, fmt.Errorf("Profile %s extends itself through %s", profileName, strings.Join(chain, " -> "))
+			}
+		}
+		parentPath := findParentProfile(header.Extends, path)
+		if parentPath == "" {
+			return nil, fmt.Errorf("Profile %s extends unknown profile %s", profileName, header.Extends)
+		}
+		if profile, err = loadProfile(parentPath, append(chain, abs)); err != nil {
+			return nil, fmt.Errorf("Failed to load profile %s extended by %s, reason: %s", header.Extends, profileName, err)
+		}
+	}
+	profile.Name = profileName
+
+	// Settings of the file override those of the parent, repos are merged
 	if _, err = toml.Decode(string(b), profile); err != nil {
 		return nil, err
 	}
+	profile.Extends = header.Extends
 
 	// Ensure all repos have a valid name
 	for name, repo := range profile.Repos {
@@ -127,3 +191,26 @@ func NewProfileFromPath(path string) (*Profile, error) {
 
 	return profile, nil
 }
+
+// findParentProfile will locate the named profile extended by the profile at
+// path, looking beside it first and then in the system paths. The profile
+// itself is skipped, so a profile in /etc may extend the vendor profile of
+// the same name.
+func findParentProfile(name, path string) string {
+	self, _ := filepath.Abs(path)
+	dirs := append([]string{filepath.Dir(path)}, ConfigPaths...)
+	for _, dir := range dirs {
+		fp := filepath.Join(dir, name+ProfileSuffix)
+		if abs, _ := filepath.Abs(fp); abs == self || !PathExists(fp) {
+			continue
+		}
+		return fp
+	}
+	return ""
+}
+
+// FetchNetwork will return the address family settings sources of this
+// profile are fetched with.
+func (p *Profile) FetchNetwork() source.Network {
+	return source.Network{Family: p.IPFamily, PreferIPv4: p.PreferIPv4}
+}
@@ -17,6 +17,8 @@
 package builder
 
 import (
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -62,3 +64,93 @@ func TestLoadProfile(t *testing.T) {
 		t.Fatalf("Invalid AddRepos: %s", profile.AddRepos[0])
 	}
 }
+
+func TestReposToAddPriority(t *testing.T) {
+	profile := &Profile{
+		Repos: map[string]*Repo{
+			"Solus":     {Name: "Solus"},
+			"Staging":   {Name: "Staging", Local: true, Priority: 10},
+			"Overrides": {Name: "Overrides", Local: true, Priority: 20},
+			"Extra":     {Name: "Extra", Local: true, Priority: 10},
+		},
+	}
+	expect := func(order ...string) {
+		repos := profile.reposToAdd()
+		if len(repos) != len(order) {
+			t.Fatalf("Expected %d repos, found %d", len(order), len(repos))
+		}
+		for i, name := range order {
+			if repos[i].Name != name {
+				t.Fatalf("Repo %d should be %s, found %s", i, name, repos[i].Name)
+			}
+		}
+	}
+	expect("Overrides", "Extra", "Staging", "Solus")
+
+	profile.AddRepos = []string{"Solus", "Staging", "Extra", "Overrides"}
+	expect("Overrides", "Staging", "Extra", "Solus")
+}
+
+func TestProfileExtends(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "base.profile"), `image = "unstable-x86_64"
+add_repos = ["Solus"]
+history_depth = 5
+
+[repo.Solus]
+uri = "https://example.com/eopkg-index.xml.xz"
+`)
+	writeTestFile(t, filepath.Join(dir, "mine.profile"), `extends = "base"
+history_depth = 20
+add_repos = ["Local", "Solus"]
+
+[repo.Local]
+uri = "/var/lib/myrepo"
+local = true
+`)
+	profile, err := NewProfileFromPath(filepath.Join(dir, "mine.profile"))
+	if err != nil {
+		t.Fatalf("Failed to load extending profile: %v", err)
+	}
+	if profile.Name != "mine" || profile.Extends != "base" {
+		t.Fatalf("Wrong name or parent: %s extends %s", profile.Name, profile.Extends)
+	}
+	if profile.Image != "unstable-x86_64" || profile.HistoryDepth != 20 {
+		t.Fatalf("Expected the image inherited and the depth overridden, found %s and %d", profile.Image, profile.HistoryDepth)
+	}
+	if len(profile.Repos) != 2 || profile.Repos["Local"].Name != "Local" || len(profile.AddRepos) != 2 {
+		t.Fatalf("Expected the repos merged: %v", profile.Repos)
+	}
+
+	writeTestFile(t, filepath.Join(dir, "base.profile"), `extends = "mine"`)
+	if _, err := NewProfileFromPath(filepath.Join(dir, "mine.profile")); err == nil {
+		t.Fatal("Loaded profiles extending each other")
+	}
+	writeTestFile(t, filepath.Join(dir, "orphan.profile"), `extends = "missing"`)
+	if _, err := NewProfileFromPath(filepath.Join(dir, "orphan.profile")); err == nil {
+		t.Fatal("Loaded a profile extending an unknown profile")
+	}
+}
+
+func TestSetProfileInitialised(t *testing.T) {
+	dir := t.TempDir()
+	defer func(paths []string) { ConfigPaths = paths }(ConfigPaths)
+	ConfigPaths = []string{dir}
+	writeTestFile(t, filepath.Join(dir, "v4.profile"), `image = "unstable-x86_64"
+ip_family = "ipv4"
+`)
+	writeTestFile(t, filepath.Join(dir, "v6.profile"), `image = "unstable-x86_64"
+ip_family = "ipv6"
+prefer_ipv4 = true
+`)
+	m := &Manager{Config: &Config{}, lock: new(sync.Mutex)}
+	if err := m.SetProfile("v4"); err != nil {
+		t.Fatalf("Failed to set profile: %v", err)
+	}
+	if err := m.SetProfile("v6"); err != ErrManagerInitialised {
+		t.Fatalf("Expected the second profile rejected, got %v", err)
+	}
+	if network := m.GetProfile().FetchNetwork(); network.Family != "ipv4" || network.PreferIPv4 {
+		t.Fatalf("Rejected profile changed the fetch settings: %+v", network)
+	}
+}
@@ -0,0 +1,180 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"strings"
+	"sync"
+)
+
+const (
+	// PromoteStrictLocal feeds the packages of a stack to the recipes after
+	// them, failing any build that installs another version of them.
+	PromoteStrictLocal = "strict-local"
+
+	// PromotePreferLocal feeds the packages of a stack to the recipes after
+	// them, which install them when eopkg prefers them. This is the default.
+	PromotePreferLocal = "prefer-local"
+
+	// PromoteRepoOnly never feeds the packages of a stack to the recipes
+	// after them, which build against the repository versions instead.
+	PromoteRepoOnly = "repo-only"
+
+	// StackPromotionEnv passes the promotion policy, and the packages built
+	// so far, to the builds of a stack running in their own process.
+	StackPromotionEnv = "SOLBUILD_STACK_PROMOTION"
+)
+
+var (
+	// ErrUnknownPromotion is returned for an unsupported promotion policy
+	ErrUnknownPromotion = errors.New("Unknown promotion policy, expected strict-local, prefer-local or repo-only")
+
+	// ActivePromotion is set when building a recipe of a stack
+	ActivePromotion *StackPromotion
+)
+
+// ValidPromotion will determine whether the promotion policy is supported.
+// The empty policy is valid, and selects prefer-local.
+func ValidPromotion(policy string) bool {
+	switch policy {
+	case "", PromoteStrictLocal, PromotePreferLocal, PromoteRepoOnly:
+		return true
+	}
+	return false
+}
+
+// A StackPromotion decides whether the recipes of a stack consume the
+// packages built before them, or the repository versions.
+type StackPromotion struct {
+	Policy   string                   `json:"policy"`
+	Packages []EnvironmentLockPackage `json:"packages,omitempty"` // Packages fed into the local repo so far
+
+	lock sync.Mutex
+}
+
+// NewStackPromotion will create the promotion for a stack with the policy
+func NewStackPromotion(policy string) (*StackPromotion, error) {
+	if !ValidPromotion(policy) {
+		return nil, ErrUnknownPromotion
+	}
+	if policy == "" {
+		policy = PromotePreferLocal
+	}
+	return &StackPromotion{Policy: policy}, nil
+}
+
+// LoadStackPromotion will read the promotion passed down by a stack, if any
+func LoadStackPromotion(encoded string) (*StackPromotion, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	s := &StackPromotion{}
+	if err := json.Unmarshal([]byte(encoded), s); err != nil {
+		return nil, err
+	}
+	if !ValidPromotion(s.Policy) {
+		return nil, ErrUnknownPromotion
+	}
+	return s, nil
+}
+
+// Feeds determines whether the packages of the stack are fed to later recipes
+func (s *StackPromotion) Feeds() bool {
+	return s.Policy != PromoteRepoOnly
+}
+
+// Add will record the packages fed into the local repo for later recipes
+func (s *StackPromotion) Add(packages []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, path := range packages {
+		payload, err := readEopkgPayload(path)
+		if err != nil {
+			return fmt.Errorf("Failed to read %s, reason: %s", path, err)
+		}
+		s.Packages = append(s.Packages, EnvironmentLockPackage{
+			Name:    payload.Name,
+			Version: payload.Version,
+			Release: payload.Release,
+		})
+	}
+	return nil
+}
+
+// Encode will serialise the promotion for a build running in another process
+func (s *StackPromotion) Encode() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// Check will compare the packages installed for a build with those built
+// earlier in the stack, returning the ones it consumes. Under strict-local,
+// installing any other version of them is an error.
+func (s *StackPromotion) Check(installed []EnvironmentLockPackage) ([]EnvironmentLockPackage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	built := make(map[string]EnvironmentLockPackage)
+	for _, pkg := range s.Packages {
+		built[pkg.Name] = pkg
+	}
+	var consumed []EnvironmentLockPackage
+	var mismatched []string
+	for _, pkg := range installed {
+		local, ok := built[pkg.Name]
+		switch {
+		case !ok:
+			continue
+		case pkg.Version == local.Version && pkg.Release == local.Release:
+			consumed = append(consumed, pkg)
+		default:
+			mismatched = append(mismatched, fmt.Sprintf("%s %s-%s instead of %s-%s", pkg.Name, pkg.Version, pkg.Release, local.Version, local.Release))
+		}
+	}
+	if len(mismatched) > 0 && s.Policy == PromoteStrictLocal {
+		return consumed, fmt.Errorf("Packages built earlier in the stack weren't installed: %s", strings.Join(mismatched, ", "))
+	}
+	for _, mismatch := range mismatched {
+		log.Warnf("Installed %s built earlier in the stack\n", mismatch)
+	}
+	return consumed, nil
+}
+
+// checkPromotion will record which packages built earlier in the stack were
+// installed into the root, enforcing the promotion policy.
+func (p *Package) checkPromotion(overlay *Overlay) error {
+	p.promoted = nil
+	if ActivePromotion == nil || !ActivePromotion.Feeds() {
+		return nil
+	}
+	installed, err := installedPackages(overlay.MountPoint)
+	if err != nil {
+		return fmt.Errorf("Failed to read installed packages, reason: %s\n", err)
+	}
+	if p.promoted, err = ActivePromotion.Check(installed); err != nil {
+		return err
+	}
+	for _, pkg := range p.promoted {
+		log.Infof("Using %s-%s-%s built earlier in the stack\n", pkg.Name, pkg.Version, pkg.Release)
+	}
+	return nil
+}
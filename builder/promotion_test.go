@@ -0,0 +1,57 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStackPromotion(t *testing.T) {
+	if _, err := NewStackPromotion("local-first"); err == nil {
+		t.Fatal("Accepted an unknown promotion policy")
+	}
+	promotion, err := NewStackPromotion("")
+	if err != nil || promotion.Policy != PromotePreferLocal || !promotion.Feeds() {
+		t.Fatalf("Expected prefer-local by default: %v", err)
+	}
+	promotion.Policy = PromoteStrictLocal
+	path := filepath.Join(t.TempDir(), "nano-7.2-3-1-x86_64.eopkg")
+	writeDiffEopkg(t, path, "3", nil, "")
+	if err := promotion.Add([]string{path}); err != nil {
+		t.Fatalf("Failed to record the package: %v", err)
+	}
+
+	loaded, err := LoadStackPromotion(promotion.Encode())
+	if err != nil || loaded.Policy != PromoteStrictLocal || len(loaded.Packages) != 1 {
+		t.Fatalf("Failed to pass the promotion on: %v", err)
+	}
+	consumed, err := loaded.Check([]EnvironmentLockPackage{
+		{Name: "glibc", Version: "2.38", Release: "100"},
+		{Name: "nano", Version: "7.2", Release: "3"},
+	})
+	if err != nil || len(consumed) != 1 || consumed[0].Name != "nano" {
+		t.Fatalf("Expected nano to be consumed: %v %v", consumed, err)
+	}
+	if _, err := loaded.Check([]EnvironmentLockPackage{{Name: "nano", Version: "7.2", Release: "2"}}); err == nil {
+		t.Fatal("strict-local allowed the repository version")
+	}
+	loaded.Policy = PromotePreferLocal
+	if _, err := loaded.Check([]EnvironmentLockPackage{{Name: "nano", Version: "7.2", Release: "2"}}); err != nil {
+		t.Fatalf("prefer-local refused the repository version: %v", err)
+	}
+}
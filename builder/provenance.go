@@ -0,0 +1,257 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// eopkgMetadata is the subset of an eopkg metadata.xml describing who and
+// where a package was built.
+type eopkgMetadata struct {
+	Source struct {
+		Name     string
+		Packager struct {
+			Name  string
+			Email string
+		}
+	}
+	Package struct {
+		Name    string
+		History struct {
+			Update []struct {
+				Release string `xml:"release,attr"`
+				Date    string
+				Version string
+				Name    string
+				Email   string
+			}
+		}
+		Provenance          RecipeOrigin
+		BuildHost           string
+		Distribution        string
+		DistributionRelease string
+		Architecture        string
+	}
+}
+
+// A Provenance collects what is known about the origin of a built package,
+// from its own metadata and the artifacts solbuild writes beside it.
+type Provenance struct {
+	Path         string // Location of the package
+	Sha256       string // Digest of the package
+	Name         string // Name of the package
+	Source       string // Name of the recipe the package was built from
+	Version      string
+	Release      string
+	Date         string // Date of the release in the package history
+	Packager     string // Maintainer of the recipe
+	Updater      string // Author of the release in the package history
+	BuildHost    string
+	Distribution string
+	Origin       *RecipeOrigin // Recipe revision embedded into the metadata, if any
+
+	Lock      *EnvironmentLock // Build environment, if the lock matches the recipe
+	Manifest  string           // Transit manifest listing the package, if any
+	Tampered  bool             // Whether the manifest digest disagrees with the package
+	SBOMs     []string         // Bills of materials listing the package
+	Signature *SignatureStatus // Result of verifying the signature, if any
+	Taint     string           // Marker of a build from uncommitted changes, if any
+}
+
+// NewProvenance will read the metadata of the package, and find and verify
+// the provenance written alongside it.
+func NewProvenance(path string) (*Provenance, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readZipEntry(archive, "metadata.xml")
+	archive.Close()
+	if err != nil {
+		return nil, err
+	}
+	var m eopkgMetadata
+	if err := xml.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("Failed to parse metadata, reason: %s", err)
+	}
+	hash, err := FileSha256sum(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provenance{
+		Path:         path,
+		Sha256:       hash,
+		Name:         m.Package.Name,
+		Source:       m.Source.Name,
+		Packager:     formatPerson(m.Source.Packager.Name, m.Source.Packager.Email),
+		BuildHost:    m.Package.BuildHost,
+		Distribution: strings.TrimSpace(m.Package.Distribution + " " + m.Package.DistributionRelease),
+	}
+	if updates := m.Package.History.Update; len(updates) > 0 {
+		p.Version = updates[0].Version
+		p.Release = updates[0].Release
+		p.Date = updates[0].Date
+		p.Updater = formatPerson(updates[0].Name, updates[0].Email)
+	}
+	if origin := m.Package.Provenance; origin.Recipe != "" {
+		p.Origin = &origin
+	}
+	p.findArtifacts()
+	return p, nil
+}
+
+// formatPerson will render a name and email in the usual fashion
+func formatPerson(name, email string) string {
+	if email == "" {
+		return name
+	}
+	return fmt.Sprintf("%s <%s>", name, email)
+}
+
+// recipe returns the name-version-release of the recipe built
+func (p *Provenance) recipe() string {
+	return fmt.Sprintf("%s-%s-%s", p.Source, p.Version, p.Release)
+}
+
+// findArtifacts will look for the lock, manifests, SBOMs, signature and
+// taint written beside the package.
+func (p *Provenance) findArtifacts() {
+	dir := filepath.Dir(p.Path)
+	base := filepath.Base(p.Path)
+
+	lockPath := filepath.Join(dir, EnvironmentLockFile)
+	if lock, err := LoadEnvironmentLock(lockPath); err == nil && lock.Lock.Recipe == p.recipe() {
+		p.Lock = lock
+	}
+
+	trams, _ := filepath.Glob(filepath.Join(dir, "*"+TransitManifestSuffix))
+	for _, tramPath := range trams {
+		var tram TransitManifest
+		if _, err := toml.DecodeFile(tramPath, &tram); err != nil {
+			continue
+		}
+		for _, f := range tram.File {
+			if f.Path == base {
+				p.Manifest = tramPath
+				p.Tampered = f.Sha256 != p.Sha256
+			}
+		}
+	}
+
+	for _, suffix := range []string{SBOMSuffixSPDX, SBOMSuffixCycloneDX} {
+		sbomPath := filepath.Join(dir, p.recipe()+suffix)
+		if b, err := ioutil.ReadFile(sbomPath); err == nil && strings.Contains(string(b), p.Sha256) {
+			p.SBOMs = append(p.SBOMs, sbomPath)
+		}
+	}
+
+	if sig := p.Path + SignatureSuffix; PathExists(sig) {
+		p.Signature = VerifySignature(sig, p.Path)
+	}
+
+	if taint := filepath.Join(dir, p.recipe()+TaintSuffix); PathExists(taint) {
+		p.Taint = taint
+	}
+}
+
+// IsVerified determines whether everything found beside the package agrees
+// with it, and nothing marks it as unfit for the repositories.
+func (p *Provenance) IsVerified() bool {
+	if p.Tampered || p.Taint != "" {
+		return false
+	}
+	return p.Signature == nil || p.Signature.Good
+}
+
+// Write will print the provenance in a human readable form
+func (p *Provenance) Write(w io.Writer) {
+	fmt.Fprintf(w, "%s %s-%s\n", p.Name, p.Version, p.Release)
+	fmt.Fprintf(w, "  SHA256:       %s\n", p.Sha256)
+	fmt.Fprintf(w, "  Recipe:       %s\n", p.Source)
+	fmt.Fprintf(w, "  Maintainer:   %s\n", p.Packager)
+	fmt.Fprintf(w, "  Released by:  %s on %s\n", p.Updater, p.Date)
+	fmt.Fprintf(w, "  Build host:   %s\n", p.BuildHost)
+	if p.Distribution != "" {
+		fmt.Fprintf(w, "  Distribution: %s\n", p.Distribution)
+	}
+
+	if p.Origin != nil {
+		if p.Origin.Repository != "" {
+			fmt.Fprintf(w, "  Repository:   %s\n", p.Origin.Repository)
+		}
+		fmt.Fprintf(w, "  Recipe path:  %s\n", p.Origin.Recipe)
+	}
+
+	if p.Lock != nil {
+		commit := p.Lock.Lock.Commit
+		if commit == "" && p.Origin != nil {
+			commit = p.Origin.Commit
+		}
+		if commit == "" {
+			commit = "unknown"
+		}
+		fmt.Fprintf(w, "  Commit:       %s\n", commit)
+		fmt.Fprintf(w, "  Profile:      %s\n", p.Lock.Lock.Profile)
+		fmt.Fprintf(w, "  Image:        %s (sha256 %s)\n", p.Lock.Lock.Image, p.Lock.Lock.ImageSha256)
+		for _, s := range p.Lock.Source {
+			fmt.Fprintf(w, "  Source:       %s (%s)\n", s.URI, s.Digest)
+		}
+		fmt.Fprintf(w, "  Build root:   %d packages\n", len(p.Lock.Package))
+	} else {
+		if p.Origin != nil && p.Origin.Commit != "" {
+			fmt.Fprintf(w, "  Commit:       %s\n", p.Origin.Commit)
+		}
+		fmt.Fprintf(w, "  Environment:  no %s for %s\n", EnvironmentLockFile, p.recipe())
+	}
+
+	switch {
+	case p.Manifest == "":
+		fmt.Fprintln(w, "  Manifest:     none")
+	case p.Tampered:
+		fmt.Fprintf(w, "  Manifest:     %s, DIGEST MISMATCH\n", filepath.Base(p.Manifest))
+	default:
+		fmt.Fprintf(w, "  Manifest:     %s, digest matches\n", filepath.Base(p.Manifest))
+	}
+	for _, sbom := range p.SBOMs {
+		fmt.Fprintf(w, "  SBOM:         %s\n", filepath.Base(sbom))
+	}
+
+	switch {
+	case p.Signature == nil:
+		fmt.Fprintln(w, "  Signature:    none")
+	case p.Signature.Good:
+		trust := "untrusted key"
+		if p.Signature.Trusted {
+			trust = "trusted key"
+		}
+		fmt.Fprintf(w, "  Signature:    good, by %s (%s, %s)\n", p.Signature.Signer, p.Signature.Key, trust)
+	default:
+		fmt.Fprintf(w, "  Signature:    BAD, %s (%s)\n", p.Signature.Problem, p.Signature.Key)
+	}
+	if p.Taint != "" {
+		fmt.Fprintf(w, "  Tainted:      built from uncommitted changes, see %s\n", filepath.Base(p.Taint))
+	}
+}
@@ -0,0 +1,513 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder/source"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// PruneImages are the backing images of the profiles
+	PruneImages = "images"
+
+	// PruneSources are the fetched tarballs, their extracted trees and git clones
+	PruneSources = "sources"
+
+	// PruneCcache are the objects of the ccache
+	PruneCcache = "ccache"
+
+	// PruneSnapshots are the build roots kept after builds for rebuilds
+	PruneSnapshots = "snapshots"
+
+	// PruneLogs are the logs and results of builds run by a worker
+	PruneLogs = "logs"
+)
+
+var (
+	// SourcesLockPath is locked shared by each build, as it fetches, extracts
+	// and mounts the sources, and exclusively while the sources are pruned
+	SourcesLockPath = filepath.Join(source.SourceDir, "sources.lock")
+
+	// PruneTargetNames are the caches a prune policy may apply to, in the
+	// order they are pruned
+	PruneTargetNames = []string{PruneImages, PruneSources, PruneCcache, PruneSnapshots, PruneLogs}
+
+	// ErrUnknownPruneTarget is returned for a cache we don't know how to prune
+	ErrUnknownPruneTarget = errors.New("Unknown cache, use images, sources, ccache, snapshots or logs")
+)
+
+// PruneConfig is the retention policy of a single cache in the config
+type PruneConfig struct {
+	MaxSize  string `toml:"max_size"`  // Size the cache is pruned to
+	MaxAge   string `toml:"max_age"`   // Age beyond which entries are removed, i.e. 30d
+	KeepLast int    `toml:"keep_last"` // Entries kept of each package
+}
+
+// A PrunePolicy limits the size of a cache, the age of its entries, and how
+// many entries of each package it keeps. The newest entry of each package
+// is only ever removed for exceeding keep_last.
+type PrunePolicy struct {
+	MaxSize  int64         // Bytes the cache may use, unlimited when 0
+	MaxAge   time.Duration // Age of the oldest entry kept, unlimited when 0
+	KeepLast int           // Entries kept of each package, unlimited when 0
+}
+
+// A PruneEntry is a single removable item of a cache
+type PruneEntry struct {
+	Path    string
+	Package string // Package the entry belongs to, if known
+	Size    int64
+	ModTime time.Time
+}
+
+// A PruneReport describes what a policy keeps and removes in a cache
+type PruneReport struct {
+	Target  string
+	Kept    []*PruneEntry
+	Removed []*PruneEntry
+	OverBy  int64 // Bytes still above the size limit, when it can't be met
+}
+
+// A PruneTarget is a cache which can be listed and pruned
+type PruneTarget struct {
+	Name   string
+	list   func() ([]*PruneEntry, error)
+	remove func(*PruneEntry) error
+	lock   func() (*os.File, error) // Guards the entries from use while removed, if set
+}
+
+// ParseAge will parse an age such as 30d, or any duration such as 12h
+func ParseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("Invalid age: %s", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid age: %s", s)
+	}
+	return d, nil
+}
+
+// NewPrunePolicy will parse the retention policy of a cache
+func NewPrunePolicy(config *PruneConfig) (*PrunePolicy, error) {
+	if config.KeepLast < 0 {
+		return nil, fmt.Errorf("Invalid number of entries to keep: %d", config.KeepLast)
+	}
+	size, err := ParseSize(config.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	age, err := ParseAge(config.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return &PrunePolicy{MaxSize: size, MaxAge: age, KeepLast: config.KeepLast}, nil
+}
+
+// IsEmpty determines whether the policy would keep everything
+func (p *PrunePolicy) IsEmpty() bool {
+	return p.MaxSize == 0 && p.MaxAge == 0 && p.KeepLast == 0
+}
+
+// Plan will determine which entries the policy removes, without removing
+// anything. Entries without a package are never protected.
+func (p *PrunePolicy) Plan(target string, entries []*PruneEntry, now time.Time) *PruneReport {
+	report := &PruneReport{Target: target}
+	sorted := append([]*PruneEntry{}, entries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ModTime.After(sorted[j].ModTime)
+	})
+	seen := make(map[string]int)
+	latest := make(map[*PruneEntry]bool)
+	var candidates []*PruneEntry
+	for _, entry := range sorted {
+		if entry.Package != "" {
+			seen[entry.Package]++
+			if p.KeepLast > 0 && seen[entry.Package] > p.KeepLast {
+				report.Removed = append(report.Removed, entry)
+				continue
+			}
+			latest[entry] = seen[entry.Package] == 1
+		}
+		if p.MaxAge > 0 && now.Sub(entry.ModTime) > p.MaxAge && !latest[entry] {
+			report.Removed = append(report.Removed, entry)
+			continue
+		}
+		candidates = append(candidates, entry)
+	}
+
+	// Evict the oldest entries until the size limit is met
+	var total int64
+	for _, entry := range candidates {
+		total += entry.Size
+	}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		entry := candidates[i]
+		if p.MaxSize > 0 && total > p.MaxSize && !latest[entry] {
+			report.Removed = append(report.Removed, entry)
+			total -= entry.Size
+			continue
+		}
+		report.Kept = append(report.Kept, entry)
+	}
+	if p.MaxSize > 0 && total > p.MaxSize {
+		report.OverBy = total - p.MaxSize
+	}
+	sort.Slice(report.Removed, func(i, j int) bool {
+		return report.Removed[i].Path < report.Removed[j].Path
+	})
+	return report
+}
+
+// Reclaimed returns the number of bytes freed by removing the entries
+func (r *PruneReport) Reclaimed() int64 {
+	var size int64
+	for _, entry := range r.Removed {
+		size += entry.Size
+	}
+	return size
+}
+
+// Prune will remove the entries of the cache the policy doesn't keep, or
+// only report them when dryRun is set.
+func (t *PruneTarget) Prune(policy *PrunePolicy, dryRun bool) (*PruneReport, error) {
+	entries, err := t.list()
+	if err != nil {
+		return nil, err
+	}
+	report := policy.Plan(t.Name, entries, time.Now())
+	if dryRun {
+		return report, nil
+	}
+	if t.lock != nil && len(report.Removed) > 0 {
+		lock, err := t.lock()
+		if err != nil {
+			log.Warnf("Not pruning %s while in use by a build, reason: %s\n", t.Name, err)
+			report.Kept = append(report.Kept, report.Removed...)
+			report.Removed = nil
+			return report, nil
+		}
+		defer lock.Close()
+	}
+	var removed []*PruneEntry
+	for _, entry := range report.Removed {
+		if err := t.remove(entry); err != nil {
+			log.Warnf("Unable to remove %s, reason: %s\n", entry.Path, err)
+			report.Kept = append(report.Kept, entry)
+			continue
+		}
+		removed = append(removed, entry)
+	}
+	report.Removed = removed
+	return report, nil
+}
+
+// NewPrunePolicies will parse the retention policy of each cache in the config
+func NewPrunePolicies(config *Config) (map[string]*PrunePolicy, error) {
+	policies := make(map[string]*PrunePolicy)
+	for name, prune := range config.Prune {
+		if _, err := NewPruneTarget(name, config); err != nil {
+			return nil, fmt.Errorf("%s: %s", err, name)
+		}
+		policy, err := NewPrunePolicy(prune)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid policy for %s, %s", name, err)
+		}
+		policies[name] = policy
+	}
+	return policies, nil
+}
+
+// NewPruneTarget returns the named cache of the host
+func NewPruneTarget(name string, config *Config) (*PruneTarget, error) {
+	switch name {
+	case PruneImages:
+		return &PruneTarget{
+			Name:   name,
+			list:   func() ([]*PruneEntry, error) { return listImages(ImagesDir) },
+			remove: removeImage,
+		}, nil
+	case PruneSources:
+		return &PruneTarget{
+			Name:   name,
+			list:   listSources,
+			remove: removeSource,
+			lock:   func() (*os.File, error) { return lockSources(true) },
+		}, nil
+	case PruneCcache:
+		return &PruneTarget{Name: name, list: listCcache, remove: removeEntry}, nil
+	case PruneSnapshots:
+		return &PruneTarget{
+			Name:   name,
+			list:   func() ([]*PruneEntry, error) { return listSnapshots(config.OverlayRootDir) },
+			remove: removeSnapshot,
+		}, nil
+	case PruneLogs:
+		return &PruneTarget{
+			Name:   name,
+			list:   func() ([]*PruneEntry, error) { return listWorkerBuilds(filepath.Join(config.OverlayRootDir, "worker")) },
+			remove: removeEntry,
+		}, nil
+	}
+	return nil, ErrUnknownPruneTarget
+}
+
+// treeEntry returns an entry for the file or directory, sized by the files
+// within it and dated by the newest of them.
+func treeEntry(path, pkg string) *PruneEntry {
+	entry := &PruneEntry{Path: path, Package: pkg}
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			entry.Size += info.Size()
+		}
+		if info.ModTime().After(entry.ModTime) {
+			entry.ModTime = info.ModTime()
+		}
+		return nil
+	})
+	return entry
+}
+
+// removeEntry will remove the file or directory of the entry
+func removeEntry(entry *PruneEntry) error {
+	return os.RemoveAll(entry.Path)
+}
+
+// listImages returns each image, along with its compressed download. Images
+// belong to the name of their profile, so the newest of each is kept.
+func listImages(dir string) ([]*PruneEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+ImageSuffix))
+	if err != nil {
+		return nil, err
+	}
+	squashfs, _ := filepath.Glob(filepath.Join(dir, "*"+ImageSquashfsSuffix))
+	var entries []*PruneEntry
+	for _, path := range append(paths, squashfs...) {
+		entry := treeEntry(path, filepath.Base(imageBase(path)))
+		if st, err := os.Stat(imageBase(path) + ImageCompressedSuffix); err == nil {
+			entry.Size += st.Size()
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// imageBase returns the path of the image without its suffix
+func imageBase(path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(path, ImageSuffix), ImageSquashfsSuffix)
+}
+
+// removeImage will remove the image and its download, unless it is being
+// updated
+func removeImage(entry *PruneEntry) error {
+	base := imageBase(entry.Path)
+	lock, err := NewLockFile(base + ".lock")
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer func() {
+		lock.Unlock()
+		lock.Clean()
+	}()
+	os.Remove(base + ImageCompressedSuffix)
+	os.Remove(base + ImageGenerationSuffix)
+	os.RemoveAll(base + ImageGenerationsSuffix)
+	os.Remove(entry.Path + ImageDigestSuffix)
+	return os.Remove(entry.Path)
+}
+
+// listSources returns each fetched tarball and git clone
+func listSources() ([]*PruneEntry, error) {
+	var entries []*PruneEntry
+	dirs, err := ioutil.ReadDir(source.SourceDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, dir := range dirs {
+		// Tarballs are stored by their sha256sum, with sha1sum symlinks
+		if dir.IsDir() && len(dir.Name()) == 64 {
+			entries = append(entries, treeEntry(filepath.Join(source.SourceDir, dir.Name()), ""))
+		}
+	}
+	trees, _ := ioutil.ReadDir(ExtractedSourceDir)
+	for _, tree := range trees {
+		if tree.IsDir() && !strings.HasSuffix(tree.Name(), ".partial") {
+			entries = append(entries, treeEntry(filepath.Join(ExtractedSourceDir, tree.Name()), ""))
+		}
+	}
+	filepath.Walk(source.GitSourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if PathExists(filepath.Join(path, ".git")) || PathExists(filepath.Join(path, "HEAD")) {
+			entries = append(entries, treeEntry(path, ""))
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return entries, nil
+}
+
+// lockSources will take the lock of the sources, shared by builds and held
+// exclusively while pruning. The exclusive lock fails rather than waiting for
+// the builds to finish, and is released by closing the file.
+func lockSources(exclusive bool) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(SourcesLockPath), 00755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(SourcesLockPath, os.O_RDWR|os.O_CREATE, 00644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX | syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// removeSource will remove the source, along with any symlinks to it
+func removeSource(entry *PruneEntry) error {
+	if err := os.RemoveAll(entry.Path); err != nil {
+		return err
+	}
+	links, _ := filepath.Glob(filepath.Join(source.SourceDir, "*"))
+	for _, link := range links {
+		if target, err := os.Readlink(link); err == nil && target == filepath.Base(entry.Path) {
+			os.Remove(link)
+		}
+	}
+	return nil
+}
+
+// listCcache returns the objects of both ccaches. ccache tolerates objects
+// disappearing, and refreshes their times as they're used.
+func listCcache() ([]*PruneEntry, error) {
+	var entries []*PruneEntry
+	for _, dir := range []string{CcacheDirectory, LegacyCcacheDirectory} {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			if name := info.Name(); name == CcacheConfigFile || name == "stats" || strings.HasSuffix(name, ".lock") {
+				return nil
+			}
+			entries = append(entries, &PruneEntry{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+			return nil
+		})
+	}
+	return entries, nil
+}
+
+// listSnapshots returns each kept build root, belonging to its package
+func listSnapshots(overlayRoot string) ([]*PruneEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(overlayRoot, "*", "*"+KeptRootSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*PruneEntry
+	for _, path := range paths {
+		dir := strings.TrimSuffix(path, KeptRootSuffix)
+		entry := treeEntry(dir, filepath.Base(dir))
+		if st, err := os.Stat(path); err == nil {
+			entry.ModTime = st.ModTime()
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// removeSnapshot will tear down the kept build root, unless a build is using it
+func removeSnapshot(entry *PruneEntry) error {
+	lock, err := NewLockFile(entry.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer func() {
+		lock.Unlock()
+		lock.Clean()
+	}()
+	if err := removeBuildRoot(entry.Path); err != nil {
+		return err
+	}
+	return os.Remove(entry.Path + KeptRootSuffix)
+}
+
+// listWorkerBuilds returns the directory of each finished build run by a
+// worker, holding its recipe, log and packages. Builds still queued or
+// running are left alone.
+func listWorkerBuilds(dir string) ([]*PruneEntry, error) {
+	builds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []*PruneEntry
+	for _, build := range builds {
+		if !build.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, build.Name())
+		state, err := LoadRemoteBuild(path)
+		if err != nil || !state.IsFinished() {
+			continue
+		}
+		pkg := ""
+		if recipe, err := NewPackage(filepath.Join(path, "recipe", state.Recipe)); err == nil {
+			pkg = recipe.Name
+		}
+		entries = append(entries, treeEntry(path, pkg))
+	}
+	return entries, nil
+}
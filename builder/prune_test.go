@@ -0,0 +1,165 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	for age, expected := range map[string]time.Duration{
+		"":    0,
+		"30d": 30 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+	} {
+		if d, err := ParseAge(age); err != nil || d != expected {
+			t.Fatalf("Unexpected age %s for %s (%v)", d, age, err)
+		}
+	}
+	if _, err := ParseAge("soon"); err == nil {
+		t.Fatalf("Invalid ages should be refused")
+	}
+}
+
+func TestPrunePolicy(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	entry := func(path, pkg string, size int64, age time.Duration) *PruneEntry {
+		return &PruneEntry{Path: path, Package: pkg, Size: size, ModTime: now.Add(-age)}
+	}
+	entries := []*PruneEntry{
+		entry("nano-1", "nano", 10, 3*day),
+		entry("nano-2", "nano", 10, 2*day),
+		entry("nano-3", "nano", 10, day),
+		entry("vim-1", "vim", 10, 40*day),
+		entry("tarball", "", 10, 40*day),
+		entry("clone", "", 10, 5*day),
+	}
+	report := (&PrunePolicy{KeepLast: 2, MaxAge: 30 * day}).Plan("logs", entries, now)
+	if removed := prunePaths(report.Removed); removed != "nano-1 tarball" {
+		t.Fatalf("Unexpected removals %s", removed)
+	}
+	report = (&PrunePolicy{MaxSize: 25}).Plan("logs", entries, now)
+	if removed := prunePaths(report.Removed); removed != "clone nano-1 nano-2 tarball" {
+		t.Fatalf("Unexpected removals %s", removed)
+	}
+	if report.OverBy != 0 || report.Reclaimed() != 40 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	report = (&PrunePolicy{MaxSize: 5}).Plan("logs", entries, now)
+	if report.OverBy != 15 {
+		t.Fatalf("The newest entry of each package should be kept, over by %d", report.OverBy)
+	}
+}
+
+// prunePaths joins the paths of the entries
+func prunePaths(entries []*PruneEntry) string {
+	var paths string
+	for i, entry := range entries {
+		if i > 0 {
+			paths += " "
+		}
+		paths += entry.Path
+	}
+	return paths
+}
+
+func TestListWorkerBuilds(t *testing.T) {
+	dir := t.TempDir()
+	recipe := "name: nano\nversion: 7.2\nrelease: 1\n"
+	for id, state := range map[string]string{"0011": RemoteSucceeded, "0022": RemoteFailed, "0033": RemoteBuilding} {
+		build := &RemoteBuild{ID: id, Recipe: "package.yml", State: state, dir: filepath.Join(dir, id)}
+		writeTestFile(t, filepath.Join(build.dir, "recipe", "package.yml"), recipe)
+		if err := build.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(filepath.Join(dir, "0022", "recipe", "package.yml"))
+	writeTestFile(t, filepath.Join(dir, "0044", "recipe", "package.yml"), recipe)
+
+	entries, err := listWorkerBuilds(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected only the finished builds, got %d", len(entries))
+	}
+	if entries[0].Path != filepath.Join(dir, "0011") || entries[0].Package != "nano" || entries[1].Package != "" {
+		t.Fatalf("Unexpected entries %+v %+v", entries[0], entries[1])
+	}
+	if _, err := NewPruneTarget("packages", &Config{}); err != ErrUnknownPruneTarget {
+		t.Fatalf("Unknown caches should be refused")
+	}
+}
+
+func TestPruneSourcesInUse(t *testing.T) {
+	saved := SourcesLockPath
+	defer func() { SourcesLockPath = saved }()
+	SourcesLockPath = filepath.Join(t.TempDir(), "sources.lock")
+
+	entries := []*PruneEntry{{Path: "old", Size: 1, ModTime: time.Now().Add(-48 * time.Hour)}}
+	removed := 0
+	target := &PruneTarget{
+		Name:   PruneSources,
+		list:   func() ([]*PruneEntry, error) { return entries, nil },
+		remove: func(*PruneEntry) error { removed++; return nil },
+		lock:   func() (*os.File, error) { return lockSources(true) },
+	}
+	policy := &PrunePolicy{MaxAge: time.Hour}
+
+	build, err := lockSources(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := target.Prune(policy, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 || len(report.Removed) != 0 || len(report.Kept) != 1 {
+		t.Fatalf("Sources were pruned during a build: %+v", report)
+	}
+
+	build.Close()
+	if report, err = target.Prune(policy, false); err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || len(report.Removed) != 1 {
+		t.Fatalf("Sources weren't pruned once the build finished: %+v", report)
+	}
+}
+
+func TestListImages(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "main-x86_64"+ImageSuffix), "image")
+	writeTestFile(t, filepath.Join(dir, "unstable-x86_64"+ImageSquashfsSuffix), "image")
+
+	entries, err := listImages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Package != "main-x86_64" || entries[1].Package != "unstable-x86_64" {
+		t.Fatalf("Expected the images by name, got %+v", entries)
+	}
+	// The only image of each profile survives any age or size limit
+	report := (&PrunePolicy{MaxAge: time.Nanosecond, MaxSize: 1}).Plan(PruneImages, entries, time.Now().Add(time.Hour))
+	if len(report.Removed) != 0 {
+		t.Fatalf("Removed the only image of a profile: %+v", report.Removed)
+	}
+}
@@ -0,0 +1,206 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// RedactedText replaces any redacted value in output
+	RedactedText = "********"
+)
+
+var (
+	// LogOutput receives our own log messages once redaction is configured,
+	// and may be pointed at stderr to keep stdout for the container
+	LogOutput io.Writer = os.Stdout
+
+	redactions        []string
+	redactionPatterns []*regexp.Regexp
+	redactionsLock    sync.RWMutex
+
+	// userRedactions is set once anything beyond the default patterns is
+	// to be redacted
+	userRedactions bool
+)
+
+// AddRedaction will ensure the given value never appears in any output
+// produced by processes within the container.
+func AddRedaction(value string) {
+	if value == "" {
+		return
+	}
+	redactionsLock.Lock()
+	defer redactionsLock.Unlock()
+	redactions = append(redactions, value)
+	userRedactions = true
+	// Longest first so that overlapping values are fully redacted
+	sort.Slice(redactions, func(i, j int) bool {
+		return len(redactions[i]) > len(redactions[j])
+	})
+}
+
+// AddRedactionPattern will redact any match of the given regular expression
+// from all output. If the expression contains capture groups, only the
+// captured text is redacted, allowing the surrounding context to be kept.
+func AddRedactionPattern(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	redactionsLock.Lock()
+	defer redactionsLock.Unlock()
+	redactionPatterns = append(redactionPatterns, re)
+	userRedactions = userRedactions || !isDefaultRedactPattern(expr)
+	return nil
+}
+
+// isDefaultRedactPattern determines whether expr is one of the patterns
+// redacted by default
+func isDefaultRedactPattern(expr string) bool {
+	for _, def := range DefaultRedactPatterns {
+		if expr == def {
+			return true
+		}
+	}
+	return false
+}
+
+// redactPattern will replace all matches, or matched groups, of re in s
+func redactPattern(re *regexp.Regexp, s string) string {
+	var b strings.Builder
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(s, -1) {
+		spans := match[:2]
+		if len(match) > 2 {
+			spans = match[2:]
+		}
+		for i := 0; i < len(spans); i += 2 {
+			// Skip unmatched or nested groups
+			if spans[i] < last {
+				continue
+			}
+			b.WriteString(s[last:spans[i]])
+			b.WriteString(RedactedText)
+			last = spans[i+1]
+		}
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Redact will return the string with all known sensitive values replaced
+func Redact(s string) string {
+	redactionsLock.RLock()
+	defer redactionsLock.RUnlock()
+	for _, r := range redactions {
+		s = strings.Replace(s, r, RedactedText, -1)
+	}
+	for _, re := range redactionPatterns {
+		s = redactPattern(re, s)
+	}
+	return s
+}
+
+// hasRedactions determines whether the output of the container must be
+// redacted. Buffering every line of the build isn't worth it for the default
+// patterns alone, so only secrets and patterns of the user count.
+func hasRedactions() bool {
+	redactionsLock.RLock()
+	defer redactionsLock.RUnlock()
+	return userRedactions
+}
+
+// A logRedactor redacts each message written by the logger. Unlike the
+// RedactingWriter no buffering is needed, as every message is written in
+// a single call.
+type logRedactor struct {
+	w io.Writer
+}
+
+// Write will redact and pass on the message
+func (l logRedactor) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(l.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ConfigureRedaction will load the configured redaction patterns, and ensure
+// they're applied to our own log output as well as that of the container.
+func ConfigureRedaction(config *Config) error {
+	for _, expr := range config.RedactPatterns {
+		if err := AddRedactionPattern(expr); err != nil {
+			return fmt.Errorf("Invalid redaction pattern '%s', reason: %s", expr, err)
+		}
+	}
+	log.SetOutput(logRedactor{LogOutput})
+	return nil
+}
+
+// A RedactingWriter buffers output line by line, so that sensitive values
+// can't be split across writes, and redacts each line before passing it on.
+type RedactingWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+	mut sync.Mutex
+}
+
+// NewRedactingWriter will wrap the given writer
+func NewRedactingWriter(w io.Writer) *RedactingWriter {
+	return &RedactingWriter{w: w}
+}
+
+// Write will buffer the data, emitting any complete lines
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.buf.Write(p)
+	for {
+		data := r.buf.Bytes()
+		idx := bytes.IndexAny(data, "\r\n")
+		if idx < 0 {
+			break
+		}
+		line := string(r.buf.Next(idx + 1))
+		if _, err := io.WriteString(r.w, Redact(line)); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush will emit any remaining partial line
+func (r *RedactingWriter) Flush() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.buf.Len() == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, Redact(r.buf.String()))
+	r.buf.Reset()
+	return err
+}
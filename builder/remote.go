@@ -0,0 +1,618 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultWorkerPort is the port a worker listens on unless another is
+	// requested.
+	DefaultWorkerPort = 8081
+
+	// RemoteQueued is the state of a remote build waiting for a free slot
+	RemoteQueued = "queued"
+
+	// RemoteBuilding is the state of a remote build in progress
+	RemoteBuilding = "building"
+
+	// RemoteSucceeded is the state of a remote build that succeeded
+	RemoteSucceeded = "succeeded"
+
+	// RemoteFailed is the state of a remote build that failed
+	RemoteFailed = "failed"
+
+	// RemoteBuildFile records the state of a remote build in its directory,
+	// so the builds can be pruned once finished
+	RemoteBuildFile = "build.json"
+)
+
+var (
+	// RemotePollInterval is how often the coordinator asks a worker for the
+	// state of a build
+	RemotePollInterval = 5 * time.Second
+
+	// MaxRecipeTarball is the largest compressed recipe tree a worker accepts
+	MaxRecipeTarball int64 = 64 << 20
+
+	// ErrNoWorkerToken is returned when no worker_token is configured, as
+	// workers never accept unauthenticated builds
+	ErrNoWorkerToken = errors.New("No worker_token configured, workers require authentication")
+
+	// ErrUnknownRemoteBuild is returned by a worker for builds it doesn't have
+	ErrUnknownRemoteBuild = errors.New("Unknown build")
+)
+
+// A RemoteBuild is a build dispatched to a worker
+type RemoteBuild struct {
+	ID       string    `json:"id"`
+	Recipe   string    `json:"recipe"`
+	Profile  string    `json:"profile,omitempty"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+
+	dir string
+}
+
+// IsFinished determines whether the remote build has succeeded or failed
+func (b *RemoteBuild) IsFinished() bool {
+	return b.State == RemoteSucceeded || b.State == RemoteFailed
+}
+
+// save will record the state of the build in its directory
+func (b *RemoteBuild) save() error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.dir, RemoteBuildFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 00644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadRemoteBuild will read the recorded state of the build in dir
+func LoadRemoteBuild(dir string) (*RemoteBuild, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, RemoteBuildFile))
+	if err != nil {
+		return nil, err
+	}
+	build := &RemoteBuild{dir: dir}
+	if err := json.Unmarshal(data, build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// packTree will write the regular files beneath dir as a compressed tar,
+// skipping hidden files and adding the extra files given. An extra file
+// without content leaves out the file of that name.
+func packTree(w io.Writer, dir string, extra map[string][]byte) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := extra[rel]; ok || !info.Mode().IsRegular() {
+			return nil
+		}
+		hdr := &tar.Header{Name: filepath.ToSlash(rel), Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for name, content := range extra {
+		if content == nil {
+			continue
+		}
+		hdr := &tar.Header{Name: name, Mode: 00644, Size: int64(len(content)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// unpackTree will extract the regular files of a compressed tar into dir,
+// refusing any that would land outside of it.
+func unpackTree(r io.Reader, dir string) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	var files []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("Refusing to unpack %s outside of %s", hdr.Name, dir)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 00755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, path)
+	}
+}
+
+// A Worker accepts builds from a coordinator over an authenticated API, and
+// builds them with solbuild, up to a number of builds at once.
+type Worker struct {
+	Token    string    // Shared secret the coordinator authenticates with
+	Dir      string    // Where recipes, logs and packages of each build are kept
+	Profile  string    // Profile of builds that don't request one
+	Webhooks *Webhooks // Endpoints notified as builds are queued, if any
+
+	builds map[string]*RemoteBuild
+	slots  chan struct{}
+	lock   sync.Mutex
+}
+
+// NewWorker will create a worker keeping its builds in dir
+func NewWorker(token, dir string, slots int) (*Worker, error) {
+	if token == "" {
+		return nil, ErrNoWorkerToken
+	}
+	if slots < 1 {
+		slots = 1
+	}
+	if err := os.MkdirAll(dir, 00700); err != nil {
+		return nil, err
+	}
+	return &Worker{
+		Token:  token,
+		Dir:    dir,
+		builds: make(map[string]*RemoteBuild),
+		slots:  make(chan struct{}, slots),
+	}, nil
+}
+
+// authorized determines whether the request carries the worker token
+func (w *Worker) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.Token)) == 1
+}
+
+// ServeHTTP will handle the API of the worker:
+//
+//	POST   /builds?recipe=package.yml&profile=...  submit a recipe tarball
+//	GET    /builds/$id                             state of the build
+//	GET    /builds/$id/log                         output of the build
+//	GET    /builds/$id/artifacts                   tarball of the results
+//	DELETE /builds/$id                             forget the build
+func (w *Worker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+	defer func() {
+		log.Infof("%s %s %s %d\n", r.RemoteAddr, r.Method, r.URL.Path, rec.status)
+	}()
+	if !w.authorized(r) {
+		http.Error(rec, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "builds" || len(parts) > 3 {
+		http.NotFound(rec, r)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodPost {
+			http.Error(rec, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.submit(rec, r)
+		return
+	}
+
+	w.lock.Lock()
+	build, ok := w.builds[parts[1]]
+	var state RemoteBuild
+	if ok {
+		state = *build
+	}
+	// Finished builds may have been pruned from the disk since
+	if ok && state.dir != "" && !PathExists(state.dir) {
+		delete(w.builds, state.ID)
+		ok = false
+	}
+	w.lock.Unlock()
+	if !ok {
+		http.Error(rec, ErrUnknownRemoteBuild.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		rec.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rec).Encode(&state)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		if !state.IsFinished() {
+			http.Error(rec, "Build is still running", http.StatusConflict)
+			return
+		}
+		w.lock.Lock()
+		delete(w.builds, state.ID)
+		w.lock.Unlock()
+		os.RemoveAll(state.dir)
+	case len(parts) == 2:
+		http.Error(rec, "Method not allowed", http.StatusMethodNotAllowed)
+	case parts[2] != "log" && parts[2] != "artifacts":
+		http.NotFound(rec, r)
+	case r.Method != http.MethodGet:
+		http.Error(rec, "Method not allowed", http.StatusMethodNotAllowed)
+	case parts[2] == "log":
+		http.ServeFile(rec, r, filepath.Join(state.dir, "build.log"))
+	default:
+		if state.State != RemoteSucceeded {
+			http.Error(rec, "Build has no artifacts", http.StatusConflict)
+			return
+		}
+		rec.Header().Set("Content-Type", "application/gzip")
+		if err := packTree(rec, filepath.Join(state.dir, "out"), nil); err != nil {
+			log.Errorf("Failed to send artifacts of %s, reason: %s\n", state.ID, err)
+		}
+	}
+}
+
+// submit will unpack the recipe of a new build and queue it
+func (w *Worker) submit(rw http.ResponseWriter, r *http.Request) {
+	recipe := filepath.Clean(r.URL.Query().Get("recipe"))
+	if recipe == "." || filepath.IsAbs(recipe) || strings.HasPrefix(recipe, "..") {
+		http.Error(rw, "Invalid recipe", http.StatusBadRequest)
+		return
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	build := &RemoteBuild{
+		ID:      hex.EncodeToString(id),
+		Recipe:  recipe,
+		Profile: r.URL.Query().Get("profile"),
+		State:   RemoteQueued,
+	}
+	if build.Profile == "" {
+		build.Profile = w.Profile
+	}
+	build.dir = filepath.Join(w.Dir, build.ID)
+	body := http.MaxBytesReader(rw, r.Body, MaxRecipeTarball)
+	if _, err := unpackTree(body, filepath.Join(build.dir, "recipe")); err != nil {
+		os.RemoveAll(build.dir)
+		http.Error(rw, fmt.Sprintf("Invalid recipe tarball: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := os.MkdirAll(filepath.Join(build.dir, "out"), 00755); err != nil {
+		os.RemoveAll(build.dir)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := build.save(); err != nil {
+		os.RemoveAll(build.dir)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.lock.Lock()
+	w.builds[build.ID] = build
+	state := *build
+	w.lock.Unlock()
+	event := NewBuildEvent(EventQueued, nil, build.Profile)
+	event.Recipe = build.Recipe
+	w.Webhooks.Emit(event)
+	go w.run(build)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(rw).Encode(&state)
+}
+
+// setState will record a change of state of the build
+func (w *Worker) setState(build *RemoteBuild, state string, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	build.State = state
+	switch state {
+	case RemoteBuilding:
+		build.Started = time.Now().UTC()
+	case RemoteSucceeded, RemoteFailed:
+		build.Finished = time.Now().UTC()
+	}
+	if err != nil {
+		build.Error = err.Error()
+	}
+	if err := build.save(); err != nil {
+		log.Warnf("Failed to record the state of build %s, reason: %s\n", build.ID, err)
+	}
+}
+
+// run will build the recipe with solbuild once a slot is free
+func (w *Worker) run(build *RemoteBuild) {
+	w.slots <- struct{}{}
+	defer func() { <-w.slots }()
+	w.setState(build, RemoteBuilding, nil)
+	log.Infof("Building %s for build %s\n", build.Recipe, build.ID)
+
+	err := func() error {
+		self, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		logFile, err := os.Create(filepath.Join(build.dir, "build.log"))
+		if err != nil {
+			return err
+		}
+		defer logFile.Close()
+		args := []string{"-n", "build", filepath.Join(build.dir, "recipe", build.Recipe)}
+		if build.Profile != "" {
+			args = append([]string{"-p", build.Profile}, args...)
+		}
+		c := exec.Command(self, args...)
+		c.Dir = filepath.Join(build.dir, "out")
+		c.Stdout = logFile
+		c.Stderr = logFile
+		return c.Run()
+	}()
+	if err != nil {
+		log.Errorf("Build %s of %s failed, reason: %s\n", build.ID, build.Recipe, err)
+		w.setState(build, RemoteFailed, err)
+		return
+	}
+	log.Goodf("Build %s of %s succeeded\n", build.ID, build.Recipe)
+	w.setState(build, RemoteSucceeded, nil)
+}
+
+// Serve will accept builds on the given address until interrupted, using
+// TLS when a certificate and key are given.
+func (w *Worker) Serve(addr, cert, key string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s, reason: %s\n", addr, err)
+	}
+	server := &http.Server{Handler: w}
+
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(ch)
+	go func() {
+		<-ch
+		log.Infoln("Shutting down the worker")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	if cert != "" {
+		log.Infof("Accepting builds on https://%s\n", listener.Addr())
+		err = server.ServeTLS(listener, cert, key)
+	} else {
+		log.Infof("Accepting builds on http://%s\n", listener.Addr())
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// A WorkerClient dispatches builds to a worker on behalf of a coordinator
+type WorkerClient struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// NewWorkerClient will create a client for the worker at the URL
+func NewWorkerClient(workerURL, token string) *WorkerClient {
+	return &WorkerClient{
+		URL:    strings.TrimSuffix(workerURL, "/"),
+		Token:  token,
+		Client: &http.Client{},
+	}
+}
+
+// do will send an authenticated request to the worker, failing for any
+// response other than a success.
+func (c *WorkerClient) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, c.URL+path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// decodeRemoteBuild will read the remote build from the response
+func decodeRemoteBuild(resp *http.Response) (*RemoteBuild, error) {
+	defer resp.Body.Close()
+	build := &RemoteBuild{}
+	if err := json.NewDecoder(resp.Body).Decode(build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// Submit will send the recipe, and the files beside it, to the worker. The
+// package history is sent along as history.xml, as git isn't.
+func (c *WorkerClient) Submit(recipe, profile string) (*RemoteBuild, error) {
+	extra := make(map[string][]byte)
+	if filepath.Base(recipe) == "package.yml" {
+		history, err := LoadPackageHistory(recipe, -1)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load history of %s, reason: %s", recipe, err)
+		}
+		if extra[HistoryFile], err = history.XML(); err != nil {
+			return nil, err
+		}
+		// Never let the worker prefer a changelog over the history sent
+		extra[ChangelogFile] = nil
+	}
+	var body bytes.Buffer
+	if err := packTree(&body, filepath.Dir(recipe), extra); err != nil {
+		return nil, fmt.Errorf("Failed to pack %s, reason: %s", recipe, err)
+	}
+	query := url.Values{"recipe": {filepath.Base(recipe)}}
+	if profile != "" {
+		query.Set("profile", profile)
+	}
+	resp, err := c.do(http.MethodPost, "/builds?"+query.Encode(), &body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRemoteBuild(resp)
+}
+
+// Status will fetch the current state of the remote build
+func (c *WorkerClient) Status(id string) (*RemoteBuild, error) {
+	resp, err := c.do(http.MethodGet, "/builds/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRemoteBuild(resp)
+}
+
+// Forget will have the worker remove the build along with its results
+func (c *WorkerClient) Forget(id string) error {
+	resp, err := c.do(http.MethodDelete, "/builds/"+id, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Build will build the recipe on the worker, waiting for it to finish. The
+// log is written to logw, and the results are unpacked into outDir.
+func (c *WorkerClient) Build(recipe, profile, outDir string, logw io.Writer) ([]string, error) {
+	build, err := c.Submit(recipe, profile)
+	if err != nil {
+		return nil, err
+	}
+	defer func(id string) {
+		if err := c.Forget(id); err != nil {
+			log.Warnf("Failed to remove build %s from %s, reason: %s\n", id, c.URL, err)
+		}
+	}(build.ID)
+	for !build.IsFinished() {
+		time.Sleep(RemotePollInterval)
+		if build, err = c.Status(build.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.do(http.MethodGet, "/builds/"+build.ID+"/log", nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(logw, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if build.State == RemoteFailed {
+		return nil, fmt.Errorf("Build failed on %s: %s", c.URL, build.Error)
+	}
+
+	if resp, err = c.do(http.MethodGet, "/builds/"+build.ID+"/artifacts", nil); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return unpackTree(resp.Body, outDir)
+}
@@ -0,0 +1,175 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidRecipeURL is returned for a malformed remote recipe
+	ErrInvalidRecipeURL = errors.New("Invalid recipe URL, expected REPOSITORY#PATH@REF")
+
+	// ErrUnknownRecipeRef is returned when the ref isn't in the repository
+	ErrUnknownRecipeRef = errors.New("Unknown branch, tag or commit")
+
+	// recipeRecheck is the wait between checks of a locked recipe clone
+	recipeRecheck = 2 * time.Second
+)
+
+// A RemoteRecipe identifies a recipe within a remote packaging repository,
+// i.e. https://github.com/getsolus/packages.git#packages/n/nano@v1.0
+type RemoteRecipe struct {
+	Repository string // URL of the packaging repository
+	Path       string // Path of the recipe, or its directory, within the repository
+	Ref        string // Branch, tag or commit to build, the default branch if empty
+}
+
+// IsRemoteRecipe will determine whether the build argument is the URL of a
+// recipe rather than a local path.
+func IsRemoteRecipe(arg string) bool {
+	return strings.Contains(arg, "://") && !PathExists(arg)
+}
+
+// ParseRemoteRecipe will parse the URL of a remote recipe
+func ParseRemoteRecipe(arg string) (*RemoteRecipe, error) {
+	recipe := &RemoteRecipe{Repository: arg}
+	if i := strings.Index(arg, "#"); i >= 0 {
+		recipe.Repository, recipe.Path = arg[:i], arg[i+1:]
+		if j := strings.LastIndex(recipe.Path, "@"); j >= 0 {
+			recipe.Path, recipe.Ref = recipe.Path[:j], recipe.Path[j+1:]
+		}
+	}
+	u, err := url.Parse(recipe.Repository)
+	if err != nil || u.Scheme == "" || (u.Host == "" && u.Scheme != "file") || strings.Trim(u.Path, "/") == "" {
+		return nil, ErrInvalidRecipeURL
+	}
+	if strings.HasPrefix(recipe.Ref, "-") {
+		return nil, ErrInvalidRecipeURL
+	}
+	// Never allow the path to escape the checkout
+	recipe.Path = strings.TrimPrefix(filepath.Clean("/"+recipe.Path), "/")
+	return recipe, nil
+}
+
+// String will return the URL of the recipe, without any credentials
+func (r *RemoteRecipe) String() string {
+	s := stripCredentials(r.Repository)
+	if r.Path != "" || r.Ref != "" {
+		s += "#" + r.Path
+	}
+	if r.Ref != "" {
+		s += "@" + r.Ref
+	}
+	return s
+}
+
+// cacheDir returns where the repository is kept within the recipe cache
+func (r *RemoteRecipe) cacheDir(root string) string {
+	u, _ := url.Parse(r.Repository)
+	return filepath.Join(root, u.Host, strings.TrimSuffix(filepath.Clean("/"+u.Path), ".git"))
+}
+
+// resolve will find the commit of the ref within the clone, preferring the
+// remote branches over the stale local ones.
+func (r *RemoteRecipe) resolve(clone string) (string, error) {
+	candidates := []string{"origin/HEAD"}
+	if r.Ref != "" {
+		candidates = []string{"origin/" + r.Ref, r.Ref}
+	}
+	for _, ref := range candidates {
+		if commit, err := gitOutput(clone, "rev-parse", "--verify", "--quiet", ref+"^{commit}"); err == nil {
+			return commit, nil
+		}
+	}
+	return "", ErrUnknownRecipeRef
+}
+
+// FetchRemoteRecipe will clone or update the packaging repository in the
+// recipe cache, check out the ref, and return the local path of the recipe.
+func FetchRemoteRecipe(recipe *RemoteRecipe) (string, error) {
+	return recipe.fetch(RecipeDirectory)
+}
+
+// fetch will bring the recipe into the cache beneath root. Each commit is
+// checked out into a worktree of its own, so builds of different revisions
+// from the same repository never disturb each other.
+func (r *RemoteRecipe) fetch(root string) (string, error) {
+	dir := r.cacheDir(root)
+	clone := filepath.Join(dir, "repo")
+
+	lock, err := NewLockFile(dir + ".lock")
+	if err != nil {
+		return "", err
+	}
+	if err := lock.Wait(recipeRecheck); err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	if PathExists(clone) {
+		log.Infof("Updating packaging repository %s\n", stripCredentials(r.Repository))
+		err = commands.ExecStdoutArgsDir(clone, "git", []string{"fetch", "--force", "--tags", "--prune", "origin"})
+	} else {
+		log.Infof("Cloning packaging repository %s\n", stripCredentials(r.Repository))
+		err = commands.ExecStdoutArgs("git", []string{"clone", "--no-checkout", r.Repository, clone})
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to fetch %s, reason: %s\n", stripCredentials(r.Repository), err)
+	}
+
+	commit, err := r.resolve(clone)
+	if err != nil {
+		return "", fmt.Errorf("Failed to find %s in %s, reason: %s\n", r.Ref, stripCredentials(r.Repository), err)
+	}
+	worktree := filepath.Join(dir, commit)
+	if !PathExists(worktree) {
+		// Forget worktrees removed by hand before adding another
+		commands.ExecStdoutArgsDir(clone, "git", []string{"worktree", "prune"})
+		if err := commands.ExecStdoutArgsDir(clone, "git", []string{"worktree", "add", "--detach", worktree, commit}); err != nil {
+			return "", fmt.Errorf("Failed to check out %s, reason: %s\n", commit, err)
+		}
+	}
+	log.Infof("Building %s at commit %s\n", r, commit)
+	return findRecipe(filepath.Join(worktree, r.Path))
+}
+
+// findRecipe will return the recipe within the directory, or the directory
+// itself when it holds a tree of recipes to build as a stack.
+func findRecipe(path string) (string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !st.IsDir() {
+		return path, nil
+	}
+	for _, name := range []string{"package.yml", "pspec.xml"} {
+		if recipe := filepath.Join(path, name); PathExists(recipe) {
+			return recipe, nil
+		}
+	}
+	return path, nil
+}
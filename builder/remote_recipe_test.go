@@ -0,0 +1,106 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseRemoteRecipe(t *testing.T) {
+	recipe, err := ParseRemoteRecipe("https://token@github.com/getsolus/packages.git#packages/n/nano@v1.0")
+	if err != nil {
+		t.Fatalf("Failed to parse recipe URL: %s", err)
+	}
+	if recipe.Repository != "https://token@github.com/getsolus/packages.git" || recipe.Path != "packages/n/nano" || recipe.Ref != "v1.0" {
+		t.Fatalf("Incorrectly parsed recipe URL: %+v", recipe)
+	}
+	if s := recipe.String(); s != "https://github.com/getsolus/packages.git#packages/n/nano@v1.0" {
+		t.Fatalf("Credentials should be stripped from the recipe URL, got: %s", s)
+	}
+	if recipe, err = ParseRemoteRecipe("https://github.com/getsolus/nano.git"); err != nil || recipe.Path != "" || recipe.Ref != "" {
+		t.Fatalf("Recipe URL without a fragment should build the default branch, got: %+v %v", recipe, err)
+	}
+	if recipe, err = ParseRemoteRecipe("https://example.com/packages.git#../../etc@main"); err != nil || recipe.Path != "etc" {
+		t.Fatalf("Recipe path should stay within the checkout, got: %+v %v", recipe, err)
+	}
+	for _, bad := range []string{"packages/n/nano", "https://example.com#nano", "https://example.com/p.git#nano@-x"} {
+		if _, err := ParseRemoteRecipe(bad); err != ErrInvalidRecipeURL {
+			t.Errorf("Expected ErrInvalidRecipeURL for %s, got: %v", bad, err)
+		}
+	}
+}
+
+// readTestFile returns the contents of the file, failing the test otherwise
+func readTestFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", path, err)
+	}
+	return string(b)
+}
+
+func TestFetchRemoteRecipe(t *testing.T) {
+	upstream := t.TempDir()
+	git := func(args ...string) {
+		c := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		c.Dir = upstream
+		if out, err := c.CombinedOutput(); err != nil {
+			t.Skipf("git is unusable: %s", out)
+		}
+	}
+	git("init", "-q")
+	writeTestFile(t, filepath.Join(upstream, "n", "nano", "package.yml"), "name: nano\nrelease: 1\n")
+	git("add", "-A")
+	git("commit", "-q", "-m", "First")
+	git("tag", "v1")
+	writeTestFile(t, filepath.Join(upstream, "n", "nano", "package.yml"), "name: nano\nrelease: 2\n")
+	git("commit", "-q", "-am", "Second")
+
+	root := t.TempDir()
+	recipe, err := ParseRemoteRecipe("file://" + upstream + "#n/nano@v1")
+	if err != nil {
+		t.Fatalf("Failed to parse recipe URL: %s", err)
+	}
+	tagged, err := recipe.fetch(root)
+	if err != nil {
+		t.Fatalf("Failed to fetch recipe: %s", err)
+	}
+	if filepath.Base(tagged) != "package.yml" || !strings.Contains(readTestFile(t, tagged), "release: 1") {
+		t.Fatalf("Expected the recipe of v1, got: %s", tagged)
+	}
+
+	recipe.Ref = ""
+	latest, err := recipe.fetch(root)
+	if err != nil {
+		t.Fatalf("Failed to fetch recipe: %s", err)
+	}
+	if latest == tagged || !strings.Contains(readTestFile(t, latest), "release: 2") {
+		t.Fatalf("Expected the recipe of the default branch in its own checkout, got: %s", latest)
+	}
+	if !strings.Contains(readTestFile(t, tagged), "release: 1") {
+		t.Fatalf("Checkout of v1 should be left intact")
+	}
+
+	recipe.Ref = "missing"
+	if _, err := recipe.fetch(root); err == nil {
+		t.Fatalf("Fetching an unknown ref should fail")
+	}
+}
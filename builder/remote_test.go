@@ -0,0 +1,174 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWorkerAuth(t *testing.T) {
+	if _, err := NewWorker("", t.TempDir(), 1); err != ErrNoWorkerToken {
+		t.Fatalf("Worker without a token should be refused, got %v", err)
+	}
+	worker, err := NewWorker("secret", t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("Failed to create worker: %s", err)
+	}
+	server := httptest.NewServer(worker)
+	defer server.Close()
+
+	if _, err := NewWorkerClient(server.URL, "wrong").Status("missing"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Wrong token should be unauthorized, got %v", err)
+	}
+	if _, err := NewWorkerClient(server.URL, "secret").Status("missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Unknown build should not be found, got %v", err)
+	}
+}
+
+func TestWorkerRoutes(t *testing.T) {
+	worker, err := NewWorker("secret", t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("Failed to create worker: %s", err)
+	}
+	worker.builds["abc"] = &RemoteBuild{ID: "abc", State: RemoteQueued}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/builds/abc", http.StatusOK},
+		{http.MethodPost, "/builds/abc", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/builds/abc", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/builds/abc/log", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/builds/abc/other", http.StatusNotFound},
+		{http.MethodGet, "/builds/abc/artifacts", http.StatusConflict},
+		{http.MethodGet, "/other", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		worker.ServeHTTP(rec, r)
+		if rec.Code != test.status {
+			t.Errorf("Expected %d for %s %s, got %d", test.status, test.method, test.path, rec.Code)
+		}
+	}
+}
+
+func TestPackTree(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"package.yml":       "name: test\n",
+		"files/fix.patch":   "patch\n",
+		".git/config":       "hidden\n",
+		"abi_symbols":       "symbols\n",
+		"files/.hidden.txt": "hidden\n",
+		ChangelogFile:       "- version: 1\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		os.MkdirAll(filepath.Dir(path), 00755)
+		if err := ioutil.WriteFile(path, []byte(content), 00644); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := packTree(&buf, src, map[string][]byte{HistoryFile: []byte("<History/>"), ChangelogFile: nil}); err != nil {
+		t.Fatalf("Failed to pack: %s", err)
+	}
+	dst := t.TempDir()
+	unpacked, err := unpackTree(&buf, dst)
+	if err != nil {
+		t.Fatalf("Failed to unpack: %s", err)
+	}
+	if len(unpacked) != 4 {
+		t.Fatalf("Expected 4 files, got %v", unpacked)
+	}
+	for _, name := range []string{"package.yml", "files/fix.patch", "abi_symbols", HistoryFile} {
+		if !PathExists(filepath.Join(dst, name)) {
+			t.Fatalf("%s was not unpacked", name)
+		}
+	}
+	if PathExists(filepath.Join(dst, ".git")) {
+		t.Fatalf("Hidden files should not be packed")
+	}
+	if PathExists(filepath.Join(dst, ChangelogFile)) {
+		t.Fatalf("Files without content should be left out")
+	}
+}
+
+func TestUnpackTreeTraversal(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 00644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("x"))
+	tw.Close()
+	gz.Close()
+
+	dir := filepath.Join(t.TempDir(), "recipe")
+	if _, err := unpackTree(&buf, dir); err == nil {
+		t.Fatalf("Files outside of the directory should be refused")
+	}
+	if PathExists(filepath.Join(filepath.Dir(dir), "escape")) {
+		t.Fatalf("File was written outside of the directory")
+	}
+}
+
+func TestWorkerRecipeLimit(t *testing.T) {
+	saved := MaxRecipeTarball
+	defer func() { MaxRecipeTarball = saved }()
+	MaxRecipeTarball = 1024
+
+	dir := t.TempDir()
+	worker, err := NewWorker("secret", dir, 1)
+	if err != nil {
+		t.Fatalf("Failed to create worker: %s", err)
+	}
+	// Random contents don't compress below the limit
+	src := t.TempDir()
+	noise := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(noise)
+	writeTestFile(t, filepath.Join(src, "package.yml"), string(noise))
+	var body bytes.Buffer
+	if err := packTree(&body, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/builds?recipe=package.yml", &body)
+	r.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	worker.ServeHTTP(rec, r)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "too large") {
+		t.Fatalf("Expected an oversized recipe to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+	if builds, _ := ioutil.ReadDir(dir); len(builds) != 0 {
+		t.Fatalf("Refused build was kept: %d entries", len(builds))
+	}
+}
@@ -22,6 +22,8 @@ import (
 	"github.com/getsolus/libosdev/disk"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 )
 
 const (
@@ -66,6 +68,8 @@ func (p *Package) addLocalRepo(notif PidNotifier, o *Overlay, pkgManager *EopkgM
 		tgtIndex := filepath.Join(tgt, "eopkg-index.xml.xz")
 		if !PathExists(tgtIndex) {
 			log.Warnf("Repository index doesn't exist. Please index it to use it. %s\n", repo.Name)
+		} else if isIndexStale(repo.URI) {
+			log.Warnf("Repository index is older than its packages, reindex it or enable autoindex. %s\n", repo.Name)
 		}
 	}
 
@@ -134,17 +138,53 @@ func (p *Package) ConfigureRepos(notif PidNotifier, o *Overlay, pkgManager *Eopk
 		return err
 	}
 
+	return p.addRepos(notif, o, pkgManager, profile.reposToAdd())
+}
+
+// reposToAdd returns the repos of the profile to add to the build, in order.
+//
+// eopkg takes a package from the first repository providing it, so repos
+// are ordered by descending priority. Repos of equal priority keep the order
+// of add_repos, or are sorted by name when all repos are enabled.
+func (p *Profile) reposToAdd() []*Repo {
 	var addRepos []*Repo
 
-	if (len(profile.AddRepos) == 1 && profile.AddRepos[0] == "*") || len(profile.AddRepos) == 0 {
-		for _, repo := range profile.Repos {
+	if (len(p.AddRepos) == 1 && p.AddRepos[0] == "*") || len(p.AddRepos) == 0 {
+		for _, repo := range p.Repos {
 			addRepos = append(addRepos, repo)
 		}
+		sort.Slice(addRepos, func(i, j int) bool {
+			return addRepos[i].Name < addRepos[j].Name
+		})
 	} else {
-		for _, id := range profile.AddRepos {
-			addRepos = append(addRepos, profile.Repos[id])
+		for _, id := range p.AddRepos {
+			addRepos = append(addRepos, p.Repos[id])
 		}
 	}
+	sort.SliceStable(addRepos, func(i, j int) bool {
+		return addRepos[i].Priority > addRepos[j].Priority
+	})
+	return addRepos
+}
 
-	return p.addRepos(notif, o, pkgManager, addRepos)
+// isIndexStale determines whether any package in the local repository is
+// newer than its index, or packages were added or removed since indexing.
+func isIndexStale(dir string) bool {
+	indexes, _ := filepath.Glob(filepath.Join(dir, "eopkg-index.xml*"))
+	var indexed time.Time
+	for _, index := range indexes {
+		if st, err := os.Stat(index); err == nil && st.ModTime().After(indexed) {
+			indexed = st.ModTime()
+		}
+	}
+	if st, err := os.Stat(dir); err != nil || st.ModTime().After(indexed) {
+		return true
+	}
+	packages, _ := filepath.Glob(filepath.Join(dir, "*.eopkg"))
+	for _, pkg := range packages {
+		if st, err := os.Stat(pkg); err != nil || st.ModTime().After(indexed) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,143 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// BuildVariant perturbs the build environment, so that two builds may be
+// compared to find non-deterministic output. Variant 0 is the normal
+// environment, while any other variant uses a different overlay path,
+// timezone and umask.
+var BuildVariant int
+
+// variantEnvironment returns the extra environment for the build variant
+func variantEnvironment() []string {
+	if BuildVariant == 0 {
+		return nil
+	}
+	return []string{"TZ=Etc/GMT-14"}
+}
+
+// variantCommand returns the command prefix for the build variant
+func variantCommand() string {
+	if BuildVariant == 0 {
+		return ""
+	}
+	return "umask 0002; "
+}
+
+// A ReproducibilityIssue is a single difference between two builds
+type ReproducibilityIssue struct {
+	Package string // Name of the eopkg file
+	Path    string // Path of the file within the package, if any
+	Reason  string // Description of the difference
+}
+
+// A ReproducibilityReport lists the differences between two builds
+type ReproducibilityReport struct {
+	Packages int // Number of packages compared
+	Issues   []ReproducibilityIssue
+}
+
+// Reproducible determines if both builds installed identical files
+func (r *ReproducibilityReport) Reproducible() bool {
+	return len(r.Issues) == 0
+}
+
+// add will record a difference
+func (r *ReproducibilityReport) add(pkg, path, format string, v ...interface{}) {
+	r.Issues = append(r.Issues, ReproducibilityIssue{Package: pkg, Path: path, Reason: fmt.Sprintf(format, v...)})
+}
+
+// CompareBuildOutputs will compare the packages collected by two builds of
+// the same recipe, file by file. The package metadata is ignored, as it
+// records details such as the build host.
+func CompareBuildOutputs(first, second string) (*ReproducibilityReport, error) {
+	firstPkgs, _ := filepath.Glob(filepath.Join(first, "*.eopkg"))
+	secondPkgs, _ := filepath.Glob(filepath.Join(second, "*.eopkg"))
+	if len(firstPkgs) == 0 || len(secondPkgs) == 0 {
+		return nil, fmt.Errorf("No packages to compare")
+	}
+
+	report := &ReproducibilityReport{}
+	seen := make(map[string]bool)
+	for _, path := range firstPkgs {
+		name := filepath.Base(path)
+		seen[name] = true
+		other := filepath.Join(second, name)
+		if !PathExists(other) {
+			report.add(name, "", "only produced by the first build")
+			continue
+		}
+		report.Packages++
+		if err := comparePackages(report, name, path, other); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range secondPkgs {
+		if name := filepath.Base(path); !seen[name] {
+			report.add(name, "", "only produced by the second build")
+		}
+	}
+	return report, nil
+}
+
+// comparePackages will record the differences between the payloads of two
+// builds of the same package
+func comparePackages(report *ReproducibilityReport, name, first, second string) error {
+	a, err := readEopkgPayload(first)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s, reason: %s", first, err)
+	}
+	b, err := readEopkgPayload(second)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s, reason: %s", second, err)
+	}
+
+	files := make(map[string]eopkgFile)
+	for _, f := range b.Files {
+		files[f.Path] = f
+	}
+	for _, f := range a.Files {
+		other, ok := files[f.Path]
+		delete(files, f.Path)
+		switch {
+		case !ok:
+			report.add(name, f.Path, "only in the first build")
+		case f.Hash != other.Hash:
+			report.add(name, f.Path, "content differs (%s vs %s)", f.Hash, other.Hash)
+		case f.Mode != other.Mode || f.UID != other.UID || f.GID != other.GID:
+			report.add(name, f.Path, "permissions differ (%s %s:%s vs %s %s:%s)",
+				f.Mode, f.UID, f.GID, other.Mode, other.UID, other.GID)
+		case f != other:
+			report.add(name, f.Path, "metadata differs")
+		}
+	}
+	var remaining []string
+	for path := range files {
+		remaining = append(remaining, path)
+	}
+	sort.Strings(remaining)
+	for _, path := range remaining {
+		report.add(name, path, "only in the second build")
+	}
+	return nil
+}
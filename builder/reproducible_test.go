@@ -0,0 +1,86 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// writeTestEopkg will create an eopkg holding the given files
+func writeTestEopkg(t *testing.T, path string, entries map[string]string) {
+	fi, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fi.Close()
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	zw := zip.NewWriter(fi)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entries[name]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// outputEntries returns the files of a built nano eopkg, with the given hash
+// of its executable
+func outputEntries(hash string) map[string]string {
+	return map[string]string{
+		"metadata.xml": "<PISI><Package><Name>nano</Name></Package></PISI>",
+		"files.xml": fmt.Sprintf(`<Files>
+<File><Path>usr/bin/nano</Path><Type>executable</Type><Size>10</Size><Uid>0</Uid><Gid>0</Gid><Mode>0755</Mode><Hash>%s</Hash></File>
+<File><Path>usr/share/doc/nano</Path><Type>doc</Type><Size>4</Size><Uid>0</Uid><Gid>0</Gid><Mode>0644</Mode><Hash>abcd</Hash></File>
+</Files>`, hash),
+	}
+}
+
+func TestCompareBuildOutputs(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	name := "nano-7.2-160-1-x86_64.eopkg"
+	writeTestEopkg(t, filepath.Join(first, name), outputEntries("1111"))
+	writeTestEopkg(t, filepath.Join(second, name), outputEntries("1111"))
+
+	report, err := CompareBuildOutputs(first, second)
+	if err != nil {
+		t.Fatalf("Failed to compare builds: %v", err)
+	}
+	if !report.Reproducible() || report.Packages != 1 {
+		t.Fatalf("Identical builds reported as different: %v", report.Issues)
+	}
+
+	writeTestEopkg(t, filepath.Join(second, name), outputEntries("2222"))
+	if report, err = CompareBuildOutputs(first, second); err != nil {
+		t.Fatalf("Failed to compare builds: %v", err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Path != "usr/bin/nano" {
+		t.Fatalf("Wrong differences reported: %v", report.Issues)
+	}
+}
@@ -0,0 +1,233 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A RetentionPolicy limits how many superseded packages are kept in a local
+// repository or package cache.
+type RetentionPolicy struct {
+	Releases int   // Releases kept of each package, unlimited when 0
+	MaxSize  int64 // Bytes the packages may use, unlimited when 0
+}
+
+// A RetainedFile is a single package considered by a RetentionPolicy
+type RetainedFile struct {
+	Path    string
+	Name    string // Name of the package
+	Release int    // Release of the package, or the target of a delta
+	Size    int64
+	ModTime time.Time
+
+	latest bool // Whether this is the newest release of the package
+}
+
+// A RetentionReport describes which packages a policy keeps and removes in a
+// single directory.
+type RetentionReport struct {
+	Dir     string
+	Kept    []*RetainedFile
+	Removed []*RetainedFile
+	OverBy  int64 // Bytes still above the size limit, when it can't be met
+}
+
+// ParseSize will parse a size such as 512M or 20G into bytes, using binary
+// units. A plain number is taken as bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	number := s
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		number = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size: %s", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// NewRetentionPolicy will create a policy keeping the given number of
+// releases within the given size, either of which may be unlimited.
+func NewRetentionPolicy(releases int, size string) (*RetentionPolicy, error) {
+	if releases < 0 {
+		return nil, fmt.Errorf("Invalid number of releases to keep: %d", releases)
+	}
+	maxSize, err := ParseSize(size)
+	if err != nil {
+		return nil, err
+	}
+	return &RetentionPolicy{Releases: releases, MaxSize: maxSize}, nil
+}
+
+// IsEmpty determines whether the policy would keep everything
+func (p *RetentionPolicy) IsEmpty() bool {
+	return p.Releases == 0 && p.MaxSize == 0
+}
+
+// parsePackageFile will determine the name and release of a package from its
+// file name, i.e. nano-5.7-69-1-x86_64.eopkg, or nano-68-69-1-x86_64.delta.eopkg
+// for a delta to release 69.
+func parsePackageFile(file string) (string, int, bool) {
+	base := strings.TrimSuffix(strings.TrimSuffix(file, ".eopkg"), ".delta")
+	fields := strings.Split(base, "-")
+	if len(fields) < 5 {
+		return "", 0, false
+	}
+	release, err := strconv.Atoi(fields[len(fields)-3])
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.Join(fields[:len(fields)-4], "-"), release, true
+}
+
+// Plan will determine which packages in the directory the policy removes,
+// without removing anything.
+func (p *RetentionPolicy) Plan(dir string) (*RetentionReport, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	packages := make(map[string][]*RetainedFile)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".eopkg") {
+			continue
+		}
+		name, release, ok := parsePackageFile(entry.Name())
+		if !ok {
+			log.Debugf("Ignoring unrecognised package %s\n", entry.Name())
+			continue
+		}
+		packages[name] = append(packages[name], &RetainedFile{
+			Path:    filepath.Join(dir, entry.Name()),
+			Name:    name,
+			Release: release,
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
+		})
+	}
+
+	report := &RetentionReport{Dir: dir}
+	var total int64
+	for _, files := range packages {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Release > files[j].Release
+		})
+		releases := 0
+		for i, f := range files {
+			if i == 0 || f.Release != files[i-1].Release {
+				releases++
+			}
+			f.latest = f.Release == files[0].Release
+			if p.Releases > 0 && releases > p.Releases {
+				report.Removed = append(report.Removed, f)
+				continue
+			}
+			report.Kept = append(report.Kept, f)
+			total += f.Size
+		}
+	}
+
+	// Evict the oldest superseded releases until the size limit is met
+	if p.MaxSize > 0 && total > p.MaxSize {
+		sort.SliceStable(report.Kept, func(i, j int) bool {
+			return report.Kept[i].ModTime.Before(report.Kept[j].ModTime)
+		})
+		var kept []*RetainedFile
+		for _, f := range report.Kept {
+			if total > p.MaxSize && !f.latest {
+				report.Removed = append(report.Removed, f)
+				total -= f.Size
+				continue
+			}
+			kept = append(kept, f)
+		}
+		report.Kept = kept
+		if total > p.MaxSize {
+			report.OverBy = total - p.MaxSize
+		}
+	}
+	sort.Slice(report.Removed, func(i, j int) bool {
+		return report.Removed[i].Path < report.Removed[j].Path
+	})
+	return report, nil
+}
+
+// Reclaimed returns the number of bytes freed by removing the packages
+func (r *RetentionReport) Reclaimed() int64 {
+	var size int64
+	for _, f := range r.Removed {
+		size += f.Size
+	}
+	return size
+}
+
+// Apply will remove the packages the policy doesn't keep
+func (r *RetentionReport) Apply() error {
+	for _, f := range r.Removed {
+		if err := os.Remove(f.Path); err != nil {
+			return fmt.Errorf("Failed to remove %s, reason: %s\n", f.Path, err)
+		}
+	}
+	return nil
+}
+
+// RetentionDirs returns the package cache along with every local repository
+// defined by the installed profiles.
+func RetentionDirs() []string {
+	dirs := []string{PackageCacheDirectory}
+	profiles, err := GetAllProfiles()
+	if err != nil {
+		log.Warnf("Unable to find local repositories, reason: %s\n", err)
+		return dirs
+	}
+	seen := map[string]bool{PackageCacheDirectory: true}
+	var repos []string
+	for _, profile := range profiles {
+		for _, repo := range profile.Repos {
+			if repo.Local && !seen[repo.URI] {
+				seen[repo.URI] = true
+				repos = append(repos, repo.URI)
+			}
+		}
+	}
+	sort.Strings(repos)
+	return append(dirs, repos...)
+}
@@ -0,0 +1,96 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParsePackageFile(t *testing.T) {
+	tests := []struct {
+		file    string
+		name    string
+		release int
+	}{
+		{"nano-5.7-69-1-x86_64.eopkg", "nano", 69},
+		{"libreoffice-common-7.1.3.2-120-1-x86_64.eopkg", "libreoffice-common", 120},
+		{"nano-68-69-1-x86_64.delta.eopkg", "nano", 69},
+	}
+	for _, test := range tests {
+		name, release, ok := parsePackageFile(test.file)
+		if !ok || name != test.name || release != test.release {
+			t.Errorf("parsePackageFile(%s) = %s, %d, %v", test.file, name, release, ok)
+		}
+	}
+	if _, _, ok := parsePackageFile("eopkg-index.xml.eopkg"); ok {
+		t.Fatalf("Parsed an invalid package name")
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i, file := range []string{
+		"nano-5.5-67-1-x86_64.eopkg",
+		"nano-5.6-68-1-x86_64.eopkg",
+		"nano-5.7-69-1-x86_64.eopkg",
+		"nano-68-69-1-x86_64.delta.eopkg",
+		"vim-8.2-10-1-x86_64.eopkg",
+	} {
+		path := filepath.Join(dir, file)
+		if err := ioutil.WriteFile(path, make([]byte, 1024), 00644); err != nil {
+			t.Fatalf("Failed to write package: %s", err)
+		}
+		mtime := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	policy, _ := NewRetentionPolicy(2, "")
+	report, err := policy.Plan(dir)
+	if err != nil {
+		t.Fatalf("Failed to plan retention: %s", err)
+	}
+	if len(report.Removed) != 1 || filepath.Base(report.Removed[0].Path) != "nano-5.5-67-1-x86_64.eopkg" {
+		t.Fatalf("Only the oldest nano release should be removed: %v", report.Removed)
+	}
+
+	policy, _ = NewRetentionPolicy(0, "3K")
+	if report, err = policy.Plan(dir); err != nil {
+		t.Fatalf("Failed to plan retention: %s", err)
+	}
+	if len(report.Removed) != 2 || report.OverBy != 0 || report.Reclaimed() != 2048 {
+		t.Fatalf("The two superseded nano releases should be removed: %v", report.Removed)
+	}
+	if err := report.Apply(); err != nil {
+		t.Fatalf("Failed to apply retention: %s", err)
+	}
+	if PathExists(filepath.Join(dir, "nano-5.6-68-1-x86_64.eopkg")) || !PathExists(filepath.Join(dir, "nano-68-69-1-x86_64.delta.eopkg")) {
+		t.Fatalf("Wrong packages were removed")
+	}
+
+	policy, _ = NewRetentionPolicy(0, "1K")
+	if report, err = policy.Plan(dir); err != nil {
+		t.Fatalf("Failed to plan retention: %s", err)
+	}
+	if len(report.Removed) != 0 || report.OverBy != 2048 {
+		t.Fatalf("The newest releases should never be removed: %v", report.Removed)
+	}
+}
@@ -0,0 +1,351 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// rootlessEnv marks the stages of a rootless build: "waiting" while the
+	// user namespace is mapped, then "mapped" once we're root within it
+	rootlessEnv = "SOLBUILD_ROOTLESS"
+
+	// rootlessIDs is the least number of subordinate IDs a rootless build
+	// needs, so that the build user and nobody can be mapped
+	rootlessIDs = 65536
+)
+
+var (
+	// Rootless is set when building without root, as root within a user
+	// namespace mapped to the invoking user and their subordinate IDs
+	Rootless bool
+
+	// RootlessTools are needed on the host for rootless builds
+	RootlessTools = []string{"newuidmap", "newgidmap", "fuse2fs", "fuse-overlayfs"}
+
+	// ErrRootlessLegacy is returned for pspec.xml builds without root
+	ErrRootlessLegacy = errors.New("Rootless builds only support package.yml")
+
+	// rootlessDevices are bound from the host into the /dev of a rootless
+	// build root, as devtmpfs can't be mounted within a user namespace
+	rootlessDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+)
+
+// subordinateRange will find the subordinate IDs of the user in the subuid
+// or subgid file at path, by name or ID.
+func subordinateRange(path, name string, id int) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("Malformed entry for %s in %s", name, path)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, fmt.Errorf("Malformed entry for %s in %s", name, path)
+		}
+		if count < rootlessIDs {
+			return 0, 0, fmt.Errorf("%s only grants %s %d IDs, at least %d are needed", path, name, count, rootlessIDs)
+		}
+		return start, count, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("No subordinate IDs for %s in %s", name, path)
+}
+
+// CheckRootless will ensure the host can perform rootless builds for the
+// current user.
+func CheckRootless() error {
+	for _, tool := range RootlessTools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s is required for rootless builds", tool)
+		}
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return err
+	}
+	if _, _, err := subordinateRange("/etc/subuid", usr.Username, os.Getuid()); err != nil {
+		return err
+	}
+	_, _, err = subordinateRange("/etc/subgid", usr.Username, os.Getuid())
+	return err
+}
+
+// EnterRootless will run the build as root within a user namespace when
+// invoked without root. Our own process only waits for the build, so when
+// exited is set the build has already run, and the caller should exit with
+// its status. Otherwise we're within the namespace, or already root.
+func EnterRootless() (exited bool, status int, err error) {
+	switch os.Getenv(rootlessEnv) {
+	case "mapped":
+		Rootless = true
+		return false, 0, nil
+	case "waiting":
+		return false, 0, waitForMapping()
+	}
+	if os.Geteuid() == 0 {
+		return false, 0, nil
+	}
+	if err := CheckRootless(); err != nil {
+		return false, 0, err
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return false, 0, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return false, 0, err
+	}
+	ready, mapped, err := os.Pipe()
+	if err != nil {
+		return false, 0, err
+	}
+	c := exec.Command(self, os.Args[1:]...)
+	c.Env = append(os.Environ(), rootlessEnv+"=waiting")
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, Stdout, os.Stderr
+	c.ExtraFiles = []*os.File{ready}
+	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS}
+	// The build handles interrupts itself, and we must outlive it
+	signal.Ignore(os.Interrupt, syscall.SIGTERM)
+	if err := c.Start(); err != nil {
+		return false, 0, fmt.Errorf("Failed to create a user namespace, reason: %s", err)
+	}
+	ready.Close()
+	err = mapRootless(c.Process.Pid, usr)
+	mapped.Close()
+	if err != nil {
+		c.Process.Kill()
+		c.Wait()
+		return false, 0, err
+	}
+	log.Debugf("Building rootless as %s\n", usr.Username)
+	if err := c.Wait(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return true, exit.ExitCode(), nil
+		}
+		return false, 0, err
+	}
+	return true, 0, nil
+}
+
+// mapRootless will map root within the namespace of pid to the user, and
+// the IDs above it to their subordinate IDs.
+func mapRootless(pid int, usr *user.User) error {
+	maps := []struct {
+		tool, file, id string
+	}{
+		{"newuidmap", "/etc/subuid", usr.Uid},
+		{"newgidmap", "/etc/subgid", usr.Gid},
+	}
+	for _, m := range maps {
+		id, _ := strconv.Atoi(m.id)
+		start, count, err := subordinateRange(m.file, usr.Username, os.Getuid())
+		if err != nil {
+			return err
+		}
+		args := []string{strconv.Itoa(pid), "0", strconv.Itoa(id), "1", "1", strconv.Itoa(start), strconv.Itoa(count)}
+		if out, err := exec.Command(m.tool, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("Failed to map the user namespace with %s, reason: %s: %s", m.tool, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// waitForMapping will wait for the user namespace to be mapped, then run
+// ourselves again so that we're root within it with every capability.
+func waitForMapping() error {
+	ready := os.NewFile(3, "rootless")
+	ioutil.ReadAll(ready)
+	ready.Close()
+	if os.Geteuid() != 0 {
+		return errors.New("User namespace was not mapped")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), rootlessEnv+"=mapped")
+	return syscall.Exec(self, os.Args, env)
+}
+
+// RootlessCacheDir returns where rootless builds keep their caches and
+// overlays, as the system directories belong to root.
+func RootlessCacheDir() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "solbuild")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".cache", "solbuild")
+}
+
+// sameDir determines whether both paths are the same directory
+func sameDir(a, b string) bool {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(b)
+	return err == nil && os.SameFile(sa, sb)
+}
+
+// PrepareRootless will replace the system directories with those of the
+// user within our mount namespace. The images stay shared with the system,
+// read-only, while the package, source and compiler caches are the user's.
+func PrepareRootless(config *Config) error {
+	cache := RootlessCacheDir()
+	lib := filepath.Join(cache, "lib")
+	config.OverlayRootDir = filepath.Join(cache, "overlay")
+	if sameDir(lib, "/var/lib/solbuild") {
+		return nil
+	}
+	if !PathExists(ImagesDir) {
+		return fmt.Errorf("No images in %s, they must be initialised with root first", ImagesDir)
+	}
+	images := filepath.Join(lib, "images")
+	for _, dir := range []string{images, config.OverlayRootDir} {
+		if err := os.MkdirAll(dir, 00755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount(ImagesDir, images, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("Failed to bind %s, reason: %s", ImagesDir, err)
+	}
+	if err := syscall.Mount(lib, "/var/lib/solbuild", "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("Failed to bind %s over /var/lib/solbuild, reason: %s", lib, err)
+	}
+	log.Debugf("Building rootless with the caches in %s\n", cache)
+	return nil
+}
+
+// rootlessMount will mount and record it for unmounting in reverse
+func (o *Overlay) rootlessMount(source, target, fstype string, flags uintptr, data string) error {
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("Failed to mount %s, reason: %s\n", target, err)
+	}
+	o.rootlessMounts = append(o.rootlessMounts, target)
+	return nil
+}
+
+// rootlessFuse will run a FUSE filesystem and record it for unmounting
+func (o *Overlay) rootlessFuse(target string, command string, args ...string) error {
+	if out, err := exec.Command(command, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to mount %s with %s, reason: %s: %s\n", target, command, err, strings.TrimSpace(string(out)))
+	}
+	o.rootlessMounts = append(o.rootlessMounts, target)
+	return nil
+}
+
+// mountRootless will mount the image with fuse2fs, as loop devices aren't
+// available within a user namespace, and the overlay over it. The kernel
+// overlayfs is used where it supports user namespaces, and fuse-overlayfs
+// otherwise.
+func (o *Overlay) mountRootless() error {
+	if o.Back.Squashfs {
+		log.Debugf("Mounting backing image with squashfuse: point='%s'\n", o.Back.ImagePath)
+		if err := o.rootlessFuse(o.ImgDir, "squashfuse", "-o", "allow_other", o.Back.ImagePath, o.ImgDir); err != nil {
+			return err
+		}
+	} else {
+		log.Debugf("Mounting backing image with fuse2fs: point='%s'\n", o.Back.ImagePath)
+		if err := o.rootlessFuse(o.ImgDir, "fuse2fs", "-o", "ro,allow_other", o.Back.ImagePath, o.ImgDir); err != nil {
+			return err
+		}
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", o.ImgDir, o.UpperDir, o.WorkDir)
+	if err := o.rootlessMount("overlay", o.MountPoint, "overlay", 0, options+",userxattr"); err == nil {
+		return nil
+	}
+	log.Debugln("Kernel overlayfs unavailable to the user namespace, using fuse-overlayfs")
+	return o.rootlessFuse(o.MountPoint, "fuse-overlayfs", "-o", options+",allow_other", o.MountPoint)
+}
+
+// mountVFSRootless will bring up the virtual filesystems that a user
+// namespace may mount, binding those of the host that it may not.
+func (o *Overlay) mountVFSRootless() error {
+	dev := filepath.Join(o.MountPoint, "dev")
+	if err := o.rootlessMount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID, "mode=755"); err != nil {
+		return err
+	}
+	for _, node := range rootlessDevices {
+		target := filepath.Join(dev, node)
+		if err := ioutil.WriteFile(target, nil, 00666); err != nil {
+			return err
+		}
+		if err := o.rootlessMount(filepath.Join("/dev", node), target, "", syscall.MS_BIND, ""); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []string{"pts", "shm"} {
+		if err := os.MkdirAll(filepath.Join(dev, dir), 00755); err != nil {
+			return err
+		}
+	}
+	if err := o.rootlessMount("devpts", filepath.Join(dev, "pts"), "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=620"); err != nil {
+		return err
+	}
+	if err := os.Symlink("pts/ptmx", filepath.Join(dev, "ptmx")); err != nil {
+		return err
+	}
+	if err := o.rootlessMount("tmpfs", filepath.Join(dev, "shm"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return err
+	}
+	// proc and sysfs belong to the namespaces of the host, so bind them
+	for _, vfs := range []string{"proc", "sys"} {
+		if err := o.rootlessMount("/"+vfs, filepath.Join(o.MountPoint, vfs), "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmountRootless will lazily unmount everything mounted for a rootless
+// build, in reverse, which also stops the FUSE filesystems.
+func (o *Overlay) unmountRootless() error {
+	var err error
+	for i := len(o.rootlessMounts) - 1; i >= 0; i-- {
+		if uerr := syscall.Unmount(o.rootlessMounts[i], syscall.MNT_DETACH); uerr != nil && err == nil {
+			err = fmt.Errorf("Failed to unmount %s, reason: %s\n", o.rootlessMounts[i], uerr)
+		}
+	}
+	o.rootlessMounts = nil
+	return err
+}
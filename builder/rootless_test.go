@@ -0,0 +1,56 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSubordinateRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subuid")
+	writeTestFile(t, path, "root:100000:65536\njoe:165536:65536\n1001:231072:65536\nsam:296608:1000\nbad:x:65536\n")
+
+	tests := []struct {
+		name  string
+		id    int
+		start int
+		fail  bool
+	}{
+		{"joe", 1000, 165536, false},
+		{"ann", 1001, 231072, false},
+		{"sam", 1002, 0, true},
+		{"bad", 1003, 0, true},
+		{"bob", 1004, 0, true},
+	}
+	for _, test := range tests {
+		start, count, err := subordinateRange(path, test.name, test.id)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Expected %s to have no usable range", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to find the range of %s: %s", test.name, err)
+			continue
+		}
+		if start != test.start || count != rootlessIDs {
+			t.Errorf("Wrong range for %s: %d:%d", test.name, start, count)
+		}
+	}
+}
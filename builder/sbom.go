@@ -0,0 +1,494 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/getsolus/solbuild/builder/source"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// SBOMFormatSPDX selects an SPDX 2.3 JSON document
+	SBOMFormatSPDX = "spdx"
+
+	// SBOMFormatCycloneDX selects a CycloneDX 1.4 JSON document
+	SBOMFormatCycloneDX = "cyclonedx"
+
+	// SBOMSuffixSPDX is the suffix of SPDX documents written alongside the packages
+	SBOMSuffixSPDX = ".spdx.json"
+
+	// SBOMSuffixCycloneDX is the suffix of CycloneDX documents written alongside the packages
+	SBOMSuffixCycloneDX = ".cdx.json"
+)
+
+var (
+	// SBOMFormat selects the software bill of materials written alongside
+	// the packages after a successful build. No SBOM is written when empty.
+	SBOMFormat string
+
+	// ErrUnknownSBOMFormat is returned when an unsupported SBOM format is requested
+	ErrUnknownSBOMFormat = errors.New("Unknown SBOM format, expected spdx or cyclonedx")
+
+	// spdxInvalidID matches the characters not permitted in an SPDX identifier
+	spdxInvalidID = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+)
+
+// ValidSBOMFormat will determine whether the SBOM format is supported. The
+// empty format is valid, and disables SBOM generation.
+func ValidSBOMFormat(format string) bool {
+	switch format {
+	case "", SBOMFormatSPDX, SBOMFormatCycloneDX:
+		return true
+	}
+	return false
+}
+
+// An SBOMComponent is a single source, build dependency or package within
+// a software bill of materials.
+type SBOMComponent struct {
+	Name      string // Name of the component
+	Version   string // Version, including the release for eopkgs
+	Location  string // Where a source was fetched from
+	Algorithm string // One of sha1, sha256, commit or ref
+	Digest    string // Value identifying the exact component
+}
+
+// An SBOM is a software bill of materials for a single build, covering the
+// declared sources, the packages installed into the build root and the
+// packages produced by the build.
+type SBOM struct {
+	Name      string
+	Version   string
+	Release   int
+	Created   time.Time
+	Sources   []SBOMComponent
+	BuildDeps []SBOMComponent
+	Packages  []SBOMComponent
+}
+
+// NewSBOM will create a bill of materials for the package, using the build
+// root to find the installed packages and the given list of built eopkgs.
+func NewSBOM(p *Package, root string, packages []string, created time.Time) (*SBOM, error) {
+	sbom := &SBOM{
+		Name:    p.Name,
+		Version: p.Version,
+		Release: p.Release,
+		Created: created.UTC(),
+	}
+
+	for _, s := range p.Sources {
+		location := s.GetIdentifier()
+		if g, ok := s.(*source.GitSource); ok {
+			location = g.URI
+		}
+		alg, digest := source.ResolvedDigest(s)
+		sbom.Sources = append(sbom.Sources, SBOMComponent{
+			Name:      path.Base(location),
+			Location:  location,
+			Algorithm: alg,
+			Digest:    digest,
+		})
+	}
+
+	installed, err := installedPackages(root)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list installed packages, reason: %s\n", err)
+	}
+	for _, pkg := range installed {
+		sbom.BuildDeps = append(sbom.BuildDeps, SBOMComponent{
+			Name:    pkg.Name,
+			Version: pkg.Version + "-" + pkg.Release,
+		})
+	}
+
+	for _, pkg := range packages {
+		hash, err := FileSha256sum(pkg)
+		if err != nil {
+			return nil, err
+		}
+		// name-version-release-distrelease-arch.eopkg
+		base := filepath.Base(pkg)
+		name, version := strings.TrimSuffix(base, ".eopkg"), ""
+		if splits := strings.Split(name, "-"); len(splits) >= 5 {
+			name = strings.Join(splits[:len(splits)-4], "-")
+			version = splits[len(splits)-4] + "-" + splits[len(splits)-3]
+		}
+		sbom.Packages = append(sbom.Packages, SBOMComponent{
+			Name:      name,
+			Version:   version,
+			Location:  base,
+			Algorithm: "sha256",
+			Digest:    hash,
+		})
+	}
+	return sbom, nil
+}
+
+// fingerprint returns a digest unique to the produced packages, used to
+// derive stable document identifiers.
+func (s *SBOM) fingerprint() []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s-%s-%d\n", s.Name, s.Version, s.Release)
+	for _, p := range s.Packages {
+		fmt.Fprintf(h, "%s %s\n", p.Location, p.Digest)
+	}
+	return h.Sum(nil)
+}
+
+// FileName returns the name of the SBOM file in the given format
+func (s *SBOM) FileName(format string) string {
+	suffix := SBOMSuffixSPDX
+	if format == SBOMFormatCycloneDX {
+		suffix = SBOMSuffixCycloneDX
+	}
+	return fmt.Sprintf("%s-%s-%d%s", s.Name, s.Version, s.Release, suffix)
+}
+
+// Marshal will encode the SBOM as JSON in the given format
+func (s *SBOM) Marshal(format string) ([]byte, error) {
+	var doc interface{}
+	switch format {
+	case SBOMFormatSPDX:
+		doc = s.spdx()
+	case SBOMFormatCycloneDX:
+		doc = s.cycloneDX()
+	default:
+		return nil, ErrUnknownSBOMFormat
+	}
+	b, err := json.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Write will store the SBOM in the given format within the directory,
+// returning the path of the new file.
+func (s *SBOM) Write(dir, format string) (string, error) {
+	b, err := s.Marshal(format)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, s.FileName(format))
+	if err := ioutil.WriteFile(path, b, 00644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+type spdxChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+type spdxPackage struct {
+	ID               string         `json:"SPDXID"`
+	Name             string         `json:"name"`
+	Version          string         `json:"versionInfo,omitempty"`
+	FileName         string         `json:"packageFileName,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum `json:"checksums,omitempty"`
+	Comment          string         `json:"comment,omitempty"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxDocument struct {
+	Version       string             `json:"spdxVersion"`
+	DataLicense   string             `json:"dataLicense"`
+	ID            string             `json:"SPDXID"`
+	Name          string             `json:"name"`
+	Namespace     string             `json:"documentNamespace"`
+	CreationInfo  spdxCreationInfo   `json:"creationInfo"`
+	Packages      []spdxPackage      `json:"packages"`
+	Relationships []spdxRelationship `json:"relationships"`
+}
+
+// spdxID returns a valid SPDX identifier for the component
+func spdxID(kind, name string) string {
+	return "SPDXRef-" + kind + "-" + spdxInvalidID.ReplaceAllString(name, "-")
+}
+
+// spdxChecksums converts the component digest into SPDX checksums
+func spdxChecksums(c SBOMComponent) []spdxChecksum {
+	switch c.Algorithm {
+	case "sha1":
+		return []spdxChecksum{{Algorithm: "SHA1", Value: c.Digest}}
+	case "sha256":
+		return []spdxChecksum{{Algorithm: "SHA256", Value: c.Digest}}
+	}
+	return nil
+}
+
+// spdx will convert the SBOM into an SPDX document
+func (s *SBOM) spdx() *spdxDocument {
+	doc := &spdxDocument{
+		Version:     "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		ID:          "SPDXRef-DOCUMENT",
+		Name:        fmt.Sprintf("%s-%s-%d", s.Name, s.Version, s.Release),
+		Namespace:   fmt.Sprintf("https://getsol.us/spdx/%s-%s-%d-%s", s.Name, s.Version, s.Release, hex.EncodeToString(s.fingerprint())),
+		CreationInfo: spdxCreationInfo{
+			Created:  s.Created.Format(time.RFC3339),
+			Creators: []string{"Tool: solbuild"},
+		},
+		Packages:      []spdxPackage{},
+		Relationships: []spdxRelationship{},
+	}
+
+	var built []string
+	for _, p := range s.Packages {
+		id := spdxID("Package", p.Name)
+		built = append(built, id)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			ID:               id,
+			Name:             p.Name,
+			Version:          p.Version,
+			FileName:         p.Location,
+			DownloadLocation: "NOASSERTION",
+			Checksums:        spdxChecksums(p),
+		})
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			Element: doc.ID,
+			Type:    "DESCRIBES",
+			Related: id,
+		})
+	}
+
+	for i, src := range s.Sources {
+		id := spdxID(fmt.Sprintf("Source%d", i), src.Name)
+		pkg := spdxPackage{
+			ID:               id,
+			Name:             src.Name,
+			DownloadLocation: src.Location,
+			Checksums:        spdxChecksums(src),
+		}
+		switch src.Algorithm {
+		case "commit", "ref":
+			pkg.DownloadLocation = fmt.Sprintf("git+%s@%s", src.Location, src.Digest)
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		for _, b := range built {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				Element: b,
+				Type:    "GENERATED_FROM",
+				Related: id,
+			})
+		}
+	}
+
+	for _, dep := range s.BuildDeps {
+		id := spdxID("BuildDep", dep.Name)
+		doc.Packages = append(doc.Packages, spdxPackage{
+			ID:               id,
+			Name:             dep.Name,
+			Version:          dep.Version,
+			DownloadLocation: "NOASSERTION",
+		})
+		for _, b := range built {
+			doc.Relationships = append(doc.Relationships, spdxRelationship{
+				Element: id,
+				Type:    "BUILD_DEPENDENCY_OF",
+				Related: b,
+			})
+		}
+	}
+	return doc
+}
+
+type cdxHash struct {
+	Algorithm string `json:"alg"`
+	Content   string `json:"content"`
+}
+
+type cdxReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxCommit struct {
+	UID string `json:"uid"`
+	URL string `json:"url,omitempty"`
+}
+
+type cdxPedigree struct {
+	Commits []cdxCommit `json:"commits"`
+}
+
+type cdxComponent struct {
+	Type       string         `json:"type"`
+	Ref        string         `json:"bom-ref,omitempty"`
+	Name       string         `json:"name"`
+	Version    string         `json:"version,omitempty"`
+	Scope      string         `json:"scope,omitempty"`
+	Hashes     []cdxHash      `json:"hashes,omitempty"`
+	References []cdxReference `json:"externalReferences,omitempty"`
+	Pedigree   *cdxPedigree   `json:"pedigree,omitempty"`
+	Properties []cdxProperty  `json:"properties,omitempty"`
+}
+
+type cdxTool struct {
+	Vendor string `json:"vendor"`
+	Name   string `json:"name"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxDocument struct {
+	Format       string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+// cdxHashes converts the component digest into CycloneDX hashes
+func cdxHashes(c SBOMComponent) []cdxHash {
+	switch c.Algorithm {
+	case "sha1":
+		return []cdxHash{{Algorithm: "SHA-1", Content: c.Digest}}
+	case "sha256":
+		return []cdxHash{{Algorithm: "SHA-256", Content: c.Digest}}
+	}
+	return nil
+}
+
+// cdxRole records how the component relates to the build
+func cdxRole(role string) []cdxProperty {
+	return []cdxProperty{{Name: "solbuild:role", Value: role}}
+}
+
+// cycloneDX will convert the SBOM into a CycloneDX document
+func (s *SBOM) cycloneDX() *cdxDocument {
+	// Derive a stable, name based UUID from the packages
+	id := s.fingerprint()[:16]
+	id[6] = (id[6] & 0x0f) | 0x50
+	id[8] = (id[8] & 0x3f) | 0x80
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+
+	doc := &cdxDocument{
+		Format:       "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + uuid,
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: s.Created.Format(time.RFC3339),
+			Tools:     []cdxTool{{Vendor: "Solus", Name: "solbuild"}},
+			Component: cdxComponent{
+				Type:    "application",
+				Ref:     "recipe:" + s.Name,
+				Name:    s.Name,
+				Version: fmt.Sprintf("%s-%d", s.Version, s.Release),
+			},
+		},
+		Components: []cdxComponent{},
+	}
+
+	for _, p := range s.Packages {
+		doc.Components = append(doc.Components, cdxComponent{
+			Type:       "application",
+			Ref:        "package:" + p.Location,
+			Name:       p.Name,
+			Version:    p.Version,
+			Hashes:     cdxHashes(p),
+			Properties: cdxRole("package"),
+		})
+	}
+
+	for i, src := range s.Sources {
+		c := cdxComponent{
+			Type:       "file",
+			Ref:        fmt.Sprintf("source:%d:%s", i, src.Name),
+			Name:       src.Name,
+			Hashes:     cdxHashes(src),
+			References: []cdxReference{{Type: "distribution", URL: src.Location}},
+			Properties: cdxRole("source"),
+		}
+		switch src.Algorithm {
+		case "commit", "ref":
+			c.Version = src.Digest
+			c.References = []cdxReference{{Type: "vcs", URL: src.Location}}
+			if src.Algorithm == "commit" {
+				c.Pedigree = &cdxPedigree{Commits: []cdxCommit{{UID: src.Digest, URL: src.Location}}}
+			}
+		}
+		doc.Components = append(doc.Components, c)
+	}
+
+	for _, dep := range s.BuildDeps {
+		doc.Components = append(doc.Components, cdxComponent{
+			Type:       "library",
+			Ref:        "builddep:" + dep.Name,
+			Name:       dep.Name,
+			Version:    dep.Version,
+			Scope:      "excluded",
+			Properties: cdxRole("build-dependency"),
+		})
+	}
+	return doc
+}
+
+// WriteSBOM will write the bill of materials for a completed build into
+// the work directory, so that it is collected along with the packages.
+func (p *Package) WriteSBOM(overlay *Overlay, history *PackageHistory) error {
+	workDir := p.GetWorkDir(overlay)
+	packages, _ := filepath.Glob(filepath.Join(workDir, "*.eopkg"))
+
+	created := time.Now()
+	if epoch := history.SourceDateEpoch(); epoch > 0 {
+		created = time.Unix(epoch, 0)
+	}
+
+	sbom, err := NewSBOM(p, overlay.MountPoint, packages, created)
+	if err != nil {
+		return err
+	}
+	if _, err := sbom.Write(workDir, SBOMFormat); err != nil {
+		return fmt.Errorf("Failed to write SBOM, reason: %s\n", err)
+	}
+	return nil
+}
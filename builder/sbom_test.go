@@ -0,0 +1,101 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSBOM() *SBOM {
+	return &SBOM{
+		Name:    "nano",
+		Version: "5.8",
+		Release: 147,
+		Created: time.Unix(1620000000, 0).UTC(),
+		Sources: []SBOMComponent{
+			{Name: "nano-5.8.tar.xz", Location: "https://www.nano-editor.org/dist/v5/nano-5.8.tar.xz", Algorithm: "sha256", Digest: "e43b63db2f78336e2aa123e8d015dbabc1720a15361714bfd4b1bb4e5e87768c"},
+			{Name: "nanorc", Location: "https://github.com/scopatz/nanorc.git", Algorithm: "commit", Digest: "6b2b56b2ea9b4e5d6d4bd5b1c8d1eae9c1e7ec70"},
+		},
+		BuildDeps: []SBOMComponent{
+			{Name: "ncurses-devel", Version: "6.2.20200212-24"},
+		},
+		Packages: []SBOMComponent{
+			{Name: "nano", Version: "5.8-147", Location: "nano-5.8-147-1-x86_64.eopkg", Algorithm: "sha256", Digest: "00ff"},
+		},
+	}
+}
+
+func TestSBOMSPDX(t *testing.T) {
+	b, err := testSBOM().Marshal(SBOMFormatSPDX)
+	if err != nil {
+		t.Fatalf("Failed to marshal SPDX: %s", err)
+	}
+	var doc spdxDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("Invalid SPDX JSON: %s", err)
+	}
+	if doc.Version != "SPDX-2.3" || doc.CreationInfo.Created != "2021-05-03T00:00:00Z" {
+		t.Fatalf("Unexpected SPDX header: %+v", doc)
+	}
+	if len(doc.Packages) != 4 {
+		t.Fatalf("Expected 4 SPDX packages, got %d", len(doc.Packages))
+	}
+	if loc := doc.Packages[2].DownloadLocation; loc != "git+https://github.com/scopatz/nanorc.git@6b2b56b2ea9b4e5d6d4bd5b1c8d1eae9c1e7ec70" {
+		t.Fatalf("Unexpected git download location: %s", loc)
+	}
+	counts := make(map[string]int)
+	for _, r := range doc.Relationships {
+		counts[r.Type]++
+	}
+	if counts["DESCRIBES"] != 1 || counts["GENERATED_FROM"] != 2 || counts["BUILD_DEPENDENCY_OF"] != 1 {
+		t.Fatalf("Unexpected SPDX relationships: %v", counts)
+	}
+}
+
+func TestSBOMCycloneDX(t *testing.T) {
+	sbom := testSBOM()
+	b, err := sbom.Marshal(SBOMFormatCycloneDX)
+	if err != nil {
+		t.Fatalf("Failed to marshal CycloneDX: %s", err)
+	}
+	var doc cdxDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("Invalid CycloneDX JSON: %s", err)
+	}
+	if !strings.HasPrefix(doc.SerialNumber, "urn:uuid:") || len(doc.SerialNumber) != 45 {
+		t.Fatalf("Invalid serial number: %s", doc.SerialNumber)
+	}
+	if len(doc.Components) != 4 {
+		t.Fatalf("Expected 4 CycloneDX components, got %d", len(doc.Components))
+	}
+	if doc.Components[3].Scope != "excluded" {
+		t.Fatalf("Build dependency should be excluded from runtime scope")
+	}
+	again, _ := testSBOM().Marshal(SBOMFormatCycloneDX)
+	if string(again) != string(b) {
+		t.Fatalf("CycloneDX output is not stable")
+	}
+	if name := sbom.FileName(SBOMFormatCycloneDX); name != "nano-5.8-147.cdx.json" {
+		t.Fatalf("Unexpected file name: %s", name)
+	}
+	if _, err := sbom.Marshal("swid"); err != ErrUnknownSBOMFormat {
+		t.Fatalf("Expected unknown format error, got %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// SccacheRemote is the remote storage shared by the sccache of builds, if any
+	SccacheRemote string
+
+	// CargoTargetCache enables the persistent cargo target directory of each
+	// package
+	CargoTargetCache bool
+
+	// ErrUnknownSccacheRemote is returned for remote storage sccache can't use
+	ErrUnknownSccacheRemote = errors.New("Unknown sccache remote, use s3://, gcs://, redis://, memcached:// or webdav+https://")
+
+	// sccacheCredentials are passed from the host to the build when set, so
+	// they needn't be written to the config
+	sccacheCredentials = []string{
+		"AWS_ACCESS_KEY_ID",
+		"AWS_SECRET_ACCESS_KEY",
+		"AWS_SESSION_TOKEN",
+		"SCCACHE_GCS_OAUTH_URL",
+		"SCCACHE_REDIS_PASSWORD",
+		"SCCACHE_WEBDAV_USERNAME",
+		"SCCACHE_WEBDAV_PASSWORD",
+		"SCCACHE_WEBDAV_TOKEN",
+	}
+)
+
+// SccacheRemoteEnvironment returns the environment pointing sccache at the
+// remote storage, i.e. s3://bucket/prefix?region=eu-west-1
+func SccacheRemoteEnvironment(remote string) ([]string, error) {
+	if remote == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(remote)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	var env []string
+	switch u.Scheme {
+	case "s3":
+		env = append(env, "SCCACHE_BUCKET="+u.Host)
+		if prefix != "" {
+			env = append(env, "SCCACHE_S3_KEY_PREFIX="+prefix)
+		}
+		if region := u.Query().Get("region"); region != "" {
+			env = append(env, "SCCACHE_REGION="+region)
+		}
+		if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+			env = append(env, "SCCACHE_ENDPOINT="+endpoint)
+		}
+	case "gcs":
+		env = append(env, "SCCACHE_GCS_BUCKET="+u.Host, "SCCACHE_GCS_RW_MODE=READ_WRITE")
+		if prefix != "" {
+			env = append(env, "SCCACHE_GCS_KEY_PREFIX="+prefix)
+		}
+	case "redis", "rediss":
+		env = append(env, "SCCACHE_REDIS="+remote)
+	case "memcached":
+		env = append(env, "SCCACHE_MEMCACHED=tcp://"+u.Host)
+	case "webdav+http", "webdav+https":
+		env = append(env, "SCCACHE_WEBDAV_ENDPOINT="+strings.TrimPrefix(remote, "webdav+"))
+	default:
+		return nil, ErrUnknownSccacheRemote
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("No host or bucket in sccache remote %s", Redact(remote))
+	}
+	return env, nil
+}
+
+// sccacheRemoteHost returns the host the build reaches the remote storage
+// at over HTTP, or an empty string for storage that doesn't use HTTP.
+func sccacheRemoteHost(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return ""
+	}
+	switch u.Scheme {
+	case "s3":
+		if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+			if e, err := url.Parse(endpoint); err == nil && e.Host != "" {
+				return e.Hostname()
+			}
+			return strings.Split(endpoint, ":")[0]
+		}
+		if region := u.Query().Get("region"); region != "" {
+			return fmt.Sprintf("%s.s3.%s.amazonaws.com", u.Host, region)
+		}
+		return u.Host + ".s3.amazonaws.com"
+	case "gcs":
+		return "storage.googleapis.com"
+	case "webdav+http", "webdav+https":
+		return u.Hostname()
+	}
+	return ""
+}
+
+// sccacheRemoteReachable determines whether the network policy of the build
+// lets it reach the remote storage. Only then are the remote, and the
+// credentials of the host, given to the build.
+func (p *Package) sccacheRemoteReachable(remote string) bool {
+	policy := p.network()
+	switch policy.Mode {
+	case NetworkOpen:
+		return true
+	case NetworkAllowlist:
+		host := sccacheRemoteHost(remote)
+		return host != "" && hostAllowed(policy.Allow, host)
+	}
+	return false
+}
+
+// cacheEnvironment returns the environment of the build for sccache, cargo
+// and the language caches, with any credentials of the sccache remote taken
+// from the host when the build may reach it.
+func (p *Package) cacheEnvironment() []string {
+	env, err := SccacheRemoteEnvironment(SccacheRemote)
+	if err != nil {
+		// Validated with the config, so unreachable in practice
+		log.Warnf("Not using the sccache remote, reason: %s\n", err)
+		env = nil
+	}
+	if len(env) > 0 && !p.sccacheRemoteReachable(SccacheRemote) {
+		log.Infof("Not using the sccache remote, unreachable with the network policy %s\n", p.network())
+		env = nil
+	}
+	if len(env) > 0 {
+		for _, name := range sccacheCredentials {
+			if value := os.Getenv(name); value != "" {
+				AddRedaction(value)
+				env = append(env, name+"="+value)
+			}
+		}
+	}
+	if CargoTargetCache && p.Type == PackageTypeYpkg {
+		env = append(env, "CARGO_TARGET_DIR="+p.GetCargoTargetDirInternal())
+	}
+	return append(env, p.languageCacheEnvironment()...)
+}
+
+// GetCargoDirInternal returns the chroot-internal cargo home of the build user
+func (p *Package) GetCargoDirInternal() string {
+	return filepath.Join(BuildUserHome, ".cargo")
+}
+
+// GetCargoTargetDirInternal returns the chroot-internal cargo target
+// directory used when the target cache is enabled
+func (p *Package) GetCargoTargetDirInternal() string {
+	return filepath.Join(BuildUserHome, ".cache", "cargo-target")
+}
+
+// cargoMounts returns the host directories of the cargo caches, mapped to
+// their chroot-internal paths. The registry and git checkouts are shared by
+// every package, while target directories are kept per package.
+func (p *Package) cargoMounts() map[string]string {
+	mounts := map[string]string{
+		filepath.Join(CargoDirectory, "registry"): filepath.Join(p.GetCargoDirInternal(), "registry"),
+		filepath.Join(CargoDirectory, "git"):      filepath.Join(p.GetCargoDirInternal(), "git"),
+	}
+	if CargoTargetCache {
+		mounts[filepath.Join(CargoDirectory, "target", p.Name)] = p.GetCargoTargetDirInternal()
+	}
+	return mounts
+}
+
+// BindCargo will make the cargo caches available to the build
+func (p *Package) BindCargo(o *Overlay) error {
+	if p.Type != PackageTypeYpkg {
+		return nil
+	}
+	for source, internal := range p.cargoMounts() {
+		if err := bindUserCache(o, source, internal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindUserCache will bind mount the host cache directory at the
+// chroot-internal path beneath the home of the build user, creating both.
+func bindUserCache(o *Overlay, source, internal string) error {
+	target := filepath.Join(o.MountPoint, internal[1:])
+	if err := os.MkdirAll(source, 00755); err != nil {
+		return fmt.Errorf("Failed to create cache directory %s, reason: %s\n", source, err)
+	}
+	if err := os.MkdirAll(target, 00755); err != nil {
+		return fmt.Errorf("Failed to create cache directory %s, reason: %s\n", target, err)
+	}
+	// Tools write their locks beside the caches, so the whole path
+	// within the home directory must belong to the build user
+	dirs := []string{source}
+	for dir := internal; dir != BuildUserHome; dir = filepath.Dir(dir) {
+		dirs = append(dirs, filepath.Join(o.MountPoint, dir[1:]))
+	}
+	for _, dir := range dirs {
+		if err := os.Chown(dir, BuildUserID, BuildUserGID); err != nil {
+			return fmt.Errorf("Failed to chown cache directory %s, reason: %s\n", dir, err)
+		}
+	}
+	log.Debugf("Exposing cache to build %s\n", internal)
+	if err := disk.GetMountManager().BindMount(source, target); err != nil {
+		return fmt.Errorf("Failed to bind mount cache %s, reason: %s\n", target, err)
+	}
+	o.ExtraMounts = append(o.ExtraMounts, target)
+	return nil
+}
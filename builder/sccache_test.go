@@ -0,0 +1,88 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSccacheRemoteEnvironment(t *testing.T) {
+	tests := map[string][]string{
+		"": nil,
+		"s3://cache/rust?region=eu-west-1": {
+			"SCCACHE_BUCKET=cache", "SCCACHE_S3_KEY_PREFIX=rust", "SCCACHE_REGION=eu-west-1",
+		},
+		"gcs://cache":                 {"SCCACHE_GCS_BUCKET=cache", "SCCACHE_GCS_RW_MODE=READ_WRITE"},
+		"redis://cache.example.com":   {"SCCACHE_REDIS=redis://cache.example.com"},
+		"memcached://localhost:11211": {"SCCACHE_MEMCACHED=tcp://localhost:11211"},
+		"webdav+https://dav.example.com/sccache": {
+			"SCCACHE_WEBDAV_ENDPOINT=https://dav.example.com/sccache",
+		},
+	}
+	for remote, expected := range tests {
+		env, err := SccacheRemoteEnvironment(remote)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", remote, err)
+		}
+		if !reflect.DeepEqual(env, expected) {
+			t.Fatalf("Unexpected environment for %s: %q", remote, env)
+		}
+	}
+	if _, err := SccacheRemoteEnvironment("ftp://cache"); err != ErrUnknownSccacheRemote {
+		t.Fatalf("Unknown remotes should be refused")
+	}
+	if _, err := SccacheRemoteEnvironment("s3:///rust"); err == nil {
+		t.Fatalf("Remotes without a bucket should be refused")
+	}
+}
+
+func TestCargoMounts(t *testing.T) {
+	pkg := &Package{Name: "ripgrep", Type: PackageTypeYpkg}
+	CargoTargetCache = false
+	if mounts := pkg.cargoMounts(); len(mounts) != 2 {
+		t.Fatalf("Only the registry and git checkouts should be shared, got %v", mounts)
+	}
+	CargoTargetCache = true
+	defer func() { CargoTargetCache = false }()
+	if target := pkg.cargoMounts()["/var/lib/solbuild/cargo/target/ripgrep"]; target != "/home/build/.cache/cargo-target" {
+		t.Fatalf("Unexpected target directory %s", target)
+	}
+}
+
+func TestSccacheRemoteReachable(t *testing.T) {
+	allowlist := &NetworkPolicy{Mode: NetworkAllowlist, Allow: []string{"*.amazonaws.com", "dav.example.com"}}
+	tests := []struct {
+		remote    string
+		policy    *NetworkPolicy
+		reachable bool
+	}{
+		{"s3://cache/rust", &NetworkPolicy{Mode: NetworkNone}, false},
+		{"s3://cache/rust", &NetworkPolicy{Mode: NetworkOpen}, true},
+		{"s3://cache/rust?region=eu-west-1", allowlist, true},
+		{"s3://cache/rust?endpoint=https://minio.example.com:9000", allowlist, false},
+		{"gcs://cache", allowlist, false},
+		{"webdav+https://dav.example.com/sccache", allowlist, true},
+		{"redis://dav.example.com", allowlist, false},
+	}
+	for _, test := range tests {
+		p := &Package{Network: test.policy}
+		if reachable := p.sccacheRemoteReachable(test.remote); reachable != test.reachable {
+			t.Errorf("Expected reachability of %s with %s to be %v", test.remote, test.policy, test.reachable)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// secretScanChunk is how much of a file is read at a time when scanning it
+// for secrets
+const secretScanChunk = 64 << 10
+
+var (
+	// ErrSecretLeaked is returned when a secret is found in the build output
+	ErrSecretLeaked = errors.New("Build secrets were found in the build output")
+)
+
+// Secrets are sensitive values made available to the build, such as
+// license keys or access tokens. They are exposed as environment variables
+// to the build step only, and are redacted from all container output.
+type Secrets struct {
+	values map[string]string
+}
+
+// LoadSecrets will load all secrets configured by the profile, decrypting
+// the secrets file if one is set.
+func LoadSecrets(profile *Profile) (*Secrets, error) {
+	s := &Secrets{values: make(map[string]string)}
+
+	if profile.SecretsFile != "" {
+		if err := s.loadFile(profile.SecretsFile, profile.SecretsIdentity); err != nil {
+			return nil, fmt.Errorf("Failed to load secrets file %s, reason: %s", profile.SecretsFile, err)
+		}
+	}
+	for _, key := range profile.SecretEnv {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			return nil, fmt.Errorf("Secret environment variable %s is not set", key)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("Secret environment variable %s is empty", key)
+		}
+		s.values[key] = value
+	}
+	for _, value := range s.values {
+		AddRedaction(value)
+	}
+	if len(s.values) > 0 {
+		log.Debugf("Loaded %d build secret(s)\n", len(s.values))
+	}
+	return s, nil
+}
+
+// decrypt will use the host age or gpg tooling to decrypt the file
+func decrypt(path, identity string) ([]byte, error) {
+	var c *exec.Cmd
+	switch filepath.Ext(path) {
+	case ".age":
+		if identity == "" {
+			return nil, errors.New("age encrypted secrets require secrets_identity")
+		}
+		c = exec.Command("age", "--decrypt", "-i", identity, path)
+	case ".gpg", ".asc":
+		c = exec.Command("gpg", "--batch", "--quiet", "--decrypt", path)
+	default:
+		return nil, errors.New("Secrets file must be .age, .gpg or .asc encrypted")
+	}
+	c.Stderr = os.Stderr
+	return c.Output()
+}
+
+// loadFile will decrypt and parse a file of KEY=VALUE lines
+func (s *Secrets) loadFile(path, identity string) error {
+	b, err := decrypt(path, identity)
+	if err != nil {
+		return err
+	}
+	return s.parse(b)
+}
+
+// parse will read the KEY=VALUE lines of a decrypted secrets file. Empty
+// values are refused, as they can't be redacted or scanned for.
+func (s *Secrets) parse(b []byte) error {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		splits := strings.SplitN(line, "=", 2)
+		if len(splits) != 2 {
+			return errors.New("Secrets must be of the form KEY=VALUE")
+		}
+		key, value := strings.TrimSpace(splits[0]), strings.TrimSpace(splits[1])
+		if value == "" {
+			return fmt.Errorf("Secret %s is empty", key)
+		}
+		s.values[key] = value
+	}
+	return sc.Err()
+}
+
+// IsEmpty will determine if there are any secrets at all
+func (s *Secrets) IsEmpty() bool {
+	return s == nil || len(s.values) == 0
+}
+
+// Environment will return the secrets in KEY=VALUE environment form
+func (s *Secrets) Environment() []string {
+	var env []string
+	for key, value := range s.values {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(env)
+	return env
+}
+
+// ScanPaths will ensure no secret value is contained in any file under the
+// given paths, logging each offending file.
+func (s *Secrets) ScanPaths(paths ...string) error {
+	if s.IsEmpty() {
+		return nil
+	}
+	leaked := false
+	for _, root := range paths {
+		if !PathExists(root) {
+			continue
+		}
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			found, err := s.scanFile(path)
+			if err != nil {
+				return err
+			}
+			for _, key := range found {
+				log.Errorf("Secret %s found in build output %s\n", key, path)
+				leaked = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if leaked {
+		return ErrSecretLeaked
+	}
+	return nil
+}
+
+// scanFile will return the keys of the secrets contained in the file. It's
+// read a chunk at a time, carrying enough of the previous chunk over to find
+// secrets spanning the two.
+func (s *Secrets) scanFile(path string) ([]string, error) {
+	overlap := 0
+	for _, value := range s.values {
+		if len(value) > overlap+1 {
+			overlap = len(value) - 1
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	found := make(map[string]bool)
+	chunk := make([]byte, secretScanChunk)
+	var carry []byte
+	for {
+		n, err := f.Read(chunk)
+		if n > 0 {
+			window := append(carry, chunk[:n]...)
+			for key, value := range s.values {
+				if value != "" && bytes.Contains(window, []byte(value)) {
+					found[key] = true
+				}
+			}
+			if len(window) > overlap {
+				window = window[len(window)-overlap:]
+			}
+			carry = append([]byte{}, window...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var keys []string
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
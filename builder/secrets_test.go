@@ -0,0 +1,67 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSecretsParse(t *testing.T) {
+	s := &Secrets{values: make(map[string]string)}
+	if err := s.parse([]byte("# Tokens\nTOKEN = abc123\n\nKEY=x=y\n")); err != nil {
+		t.Fatal(err)
+	}
+	if s.values["TOKEN"] != "abc123" || s.values["KEY"] != "x=y" {
+		t.Fatalf("Unexpected secrets %v", s.values)
+	}
+	if err := s.parse([]byte("FOO=\n")); err == nil {
+		t.Fatal("Accepted an empty secret")
+	}
+
+	os.Setenv("SOLBUILD_TEST_EMPTY_SECRET", "")
+	defer os.Unsetenv("SOLBUILD_TEST_EMPTY_SECRET")
+	if _, err := LoadSecrets(&Profile{SecretEnv: []string{"SOLBUILD_TEST_EMPTY_SECRET"}}); err == nil {
+		t.Fatal("Accepted an empty secret environment variable")
+	}
+}
+
+func TestSecretsScanPaths(t *testing.T) {
+	dir := t.TempDir()
+	s := &Secrets{values: map[string]string{"TOKEN": "abc123", "EMPTY": ""}}
+	writeTestFile(t, filepath.Join(dir, "clean"), "nothing to see\n")
+	if err := s.ScanPaths(dir); err != nil {
+		t.Fatalf("Empty secret matched a clean file: %s", err)
+	}
+
+	// The secret straddles the boundary between two chunks
+	spanning := filepath.Join(dir, "spanning")
+	writeTestFile(t, spanning, strings.Repeat("x", secretScanChunk-3)+"abc123")
+	found, err := s.scanFile(spanning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []string{"TOKEN"}) {
+		t.Fatalf("Expected the secret spanning two chunks, got %v", found)
+	}
+	if err := s.ScanPaths(dir); err != ErrSecretLeaked {
+		t.Fatalf("Expected the leak to be reported, got %v", err)
+	}
+}
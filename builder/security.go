@@ -0,0 +1,383 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SecurityFixed is a recipe already at or beyond the fixed version
+	SecurityFixed = "fixed"
+
+	// SecurityUpdate is a recipe updated to the fixed version
+	SecurityUpdate = "update"
+
+	// SecurityPatch is a recipe patched with the backported fixes
+	SecurityPatch = "patch"
+
+	// SecurityRebuild is a recipe rebuilt against a fixed dependency
+	SecurityRebuild = "rebuild"
+
+	// SecurityManual is a recipe the advisory gives no fix for, which must
+	// be updated by hand
+	SecurityManual = "manual"
+
+	// securityPatchDir is where backported patches are kept, within the
+	// files directory of the recipe
+	securityPatchDir = "security"
+)
+
+// ErrEmptyAdvisory is returned for an advisory without any affected packages
+var ErrEmptyAdvisory = errors.New("Advisory lists no affected packages")
+
+// An AdvisoryPackage is a single package affected by an Advisory, along with
+// however it may be fixed.
+type AdvisoryPackage struct {
+	Name    string   `yaml:"name"`    // Name of the affected package
+	Fixed   string   `yaml:"fixed"`   // First version without the vulnerability
+	Source  string   `yaml:"source"`  // Source archive of the fixed version
+	SHA256  string   `yaml:"sha256"`  // Checksum of the source archive
+	Patches []string `yaml:"patches"` // Backported fixes, relative to the advisory
+	Rebuild bool     `yaml:"rebuild"` // Only needs a rebuild against a fixed dependency
+}
+
+// An Advisory is a security advisory listing the packages affected by one
+// or more CVEs. It is either written by hand as YAML, or read from a single
+// OSV formatted CVE feed entry.
+type Advisory struct {
+	ID       string             `yaml:"id"`
+	CVEs     []string           `yaml:"cves"`
+	Packages []*AdvisoryPackage `yaml:"packages"`
+
+	dir string // Directory patches are relative to
+}
+
+// LoadAdvisory will read and validate the advisory at path. Files ending in
+// .json are read as OSV entries.
+func LoadAdvisory(path string) (*Advisory, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	advisory := &Advisory{}
+	if filepath.Ext(path) == ".json" {
+		entry := &osvEntry{}
+		if err := json.Unmarshal(b, entry); err != nil {
+			return nil, fmt.Errorf("Invalid OSV entry %s, reason: %s", path, err)
+		}
+		advisory = newOSVAdvisory(entry)
+	} else if err := yaml.UnmarshalStrict(b, advisory); err != nil {
+		return nil, fmt.Errorf("Invalid advisory %s, reason: %s", path, err)
+	}
+	if advisory.ID == "" {
+		return nil, fmt.Errorf("Advisory %s has no id", path)
+	}
+	if len(advisory.Packages) == 0 {
+		return nil, ErrEmptyAdvisory
+	}
+	advisory.dir = filepath.Dir(path)
+	for i, pkg := range advisory.Packages {
+		switch {
+		case pkg.Name == "":
+			return nil, fmt.Errorf("Package %d of %s has no name", i+1, path)
+		case pkg.Source != "" && (pkg.Fixed == "" || pkg.SHA256 == ""):
+			return nil, fmt.Errorf("Package %s of %s needs both fixed and sha256 for its source", pkg.Name, path)
+		}
+	}
+	return advisory, nil
+}
+
+// newOSVAdvisory will list the affected packages of the OSV entry, with the
+// last fixed version of each. The entry ID and any CVE aliases are recorded
+// as the CVEs.
+func newOSVAdvisory(entry *osvEntry) *Advisory {
+	advisory := &Advisory{ID: entry.ID}
+	for _, id := range append([]string{entry.ID}, entry.Aliases...) {
+		if CveRegex.MatchString(id) {
+			advisory.CVEs = append(advisory.CVEs, id)
+		}
+	}
+	for _, affected := range entry.Affected {
+		if affected.Package.Name == "" {
+			continue
+		}
+		pkg := &AdvisoryPackage{Name: affected.Package.Name}
+		for _, r := range affected.Ranges {
+			for _, event := range r.Events {
+				if fixed, ok := event["fixed"]; ok {
+					pkg.Fixed = fixed
+				}
+			}
+		}
+		advisory.Packages = append(advisory.Packages, pkg)
+	}
+	return advisory
+}
+
+// A SecurityFix is a recipe matching an affected package of an Advisory,
+// and how it is to be fixed.
+type SecurityFix struct {
+	Recipe  string           // Location of the package.yml
+	Name    string           // Name of the source package
+	Version string           // Current version of the recipe
+	Release int              // Current release of the recipe
+	Action  string           // One of the Security* actions
+	Package *AdvisoryPackage // The affected package which matched
+}
+
+// action determines how a recipe at the given version is fixed
+func (p *AdvisoryPackage) action(version string) string {
+	switch {
+	case p.Fixed != "" && CompareVersions(version, p.Fixed) >= 0:
+		return SecurityFixed
+	case p.Source != "":
+		return SecurityUpdate
+	case len(p.Patches) > 0:
+		return SecurityPatch
+	case p.Rebuild:
+		return SecurityRebuild
+	}
+	return SecurityManual
+}
+
+// Match will find the recipes beneath tree producing any of the affected
+// packages, whether as the source package or one of its subpackages.
+func (a *Advisory) Match(tree string) ([]*SecurityFix, error) {
+	recipes, err := findRecipes(tree)
+	if err != nil {
+		return nil, err
+	}
+	var fixes []*SecurityFix
+	for _, path := range recipes {
+		recipe, err := NewStackRecipe(path)
+		if err != nil {
+			log.Warnf("Skipping %s, reason: %s\n", path, err)
+			continue
+		}
+		affected := a.affects(recipe)
+		if affected == nil {
+			continue
+		}
+		pkg, err := NewPackage(path)
+		if err != nil {
+			log.Warnf("Skipping %s, reason: %s\n", path, err)
+			continue
+		}
+		fixes = append(fixes, &SecurityFix{
+			Recipe:  path,
+			Name:    pkg.Name,
+			Version: pkg.Version,
+			Release: pkg.Release,
+			Action:  affected.action(pkg.Version),
+			Package: affected,
+		})
+	}
+	return fixes, nil
+}
+
+// affects returns the first affected package the recipe produces, if any
+func (a *Advisory) affects(recipe *StackRecipe) *AdvisoryPackage {
+	for _, pkg := range a.Packages {
+		for _, name := range recipe.Provides {
+			if name == pkg.Name {
+				return pkg
+			}
+		}
+	}
+	return nil
+}
+
+// Apply will update the recipe to the fixed version, or add the backported
+// patches to its setup, and bump the release.
+func (a *Advisory) Apply(fix *SecurityFix) error {
+	doc, err := ParseYmlDocumentFile(fix.Recipe)
+	if err != nil {
+		return err
+	}
+	switch fix.Action {
+	case SecurityUpdate:
+		doc.Set("version", fix.Package.Fixed)
+		sources := doc.GetList("source")
+		if len(sources) == 0 {
+			sources = []string{""}
+		}
+		sources[0] = fix.Package.Source + " : " + fix.Package.SHA256
+		doc.SetList("source", sources)
+	case SecurityPatch:
+		if err := a.addPatches(doc, fix); err != nil {
+			return err
+		}
+	case SecurityRebuild:
+	default:
+		return fmt.Errorf("Unable to apply a %s fix to %s", fix.Action, fix.Recipe)
+	}
+	doc.Set("release", strconv.Itoa(fix.Release+1))
+	return doc.WriteFile(fix.Recipe)
+}
+
+// addPatches will copy the patches into the files directory of the recipe,
+// and apply them in setup after any existing patches.
+func (a *Advisory) addPatches(doc *YmlDocument, fix *SecurityFix) error {
+	filesDir := filepath.Join(filepath.Dir(fix.Recipe), "files")
+	patchDir := filepath.Join(filesDir, securityPatchDir)
+	if err := os.MkdirAll(patchDir, 00755); err != nil {
+		return err
+	}
+	var lines []string
+	for _, patch := range fix.Package.Patches {
+		if !filepath.IsAbs(patch) {
+			patch = filepath.Join(a.dir, patch)
+		}
+		b, err := ioutil.ReadFile(patch)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(patch)
+		if err := ioutil.WriteFile(filepath.Join(patchDir, name), b, 00644); err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%%patch -p1 < $pkgfiles/%s/%s", securityPatchDir, name))
+	}
+
+	setup := setupEntry(doc)
+	if setup.Value != "|" && setup.Value != ">" {
+		// Turn a single line setup into a block
+		setup.Children = nil
+		if script := setup.Scalar(); script != "" {
+			setup.Children = []string{"    " + script}
+		}
+		setup.Value = "|"
+		setup.Quote = YmlQuotePlain
+	}
+	indent := ""
+	insertAt := 0
+	for i, line := range setup.Children {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if indent == "" {
+			indent = line[:len(line)-len(trimmed)]
+		}
+		if _, _, ok := parsePatchLine(line, filesDir); ok {
+			insertAt = i + 1
+		}
+	}
+	if indent == "" {
+		indent = "    "
+	}
+	for i := range lines {
+		lines[i] = indent + lines[i]
+	}
+	children := append([]string{}, setup.Children[:insertAt]...)
+	children = append(children, lines...)
+	setup.Children = append(children, setup.Children[insertAt:]...)
+	return nil
+}
+
+// setupEntry returns the setup step of the recipe, adding an empty one
+// before the first later step if the recipe has none.
+func setupEntry(doc *YmlDocument) *YmlEntry {
+	if setup := doc.Lookup("setup"); setup != nil {
+		return setup
+	}
+	setup := &YmlEntry{Key: "setup", keyText: "setup", valueLead: " "}
+	insertAt := len(doc.Entries)
+	for i, e := range doc.Entries {
+		if e.Key == "build" || e.Key == "install" || e.Key == "check" {
+			if len(e.keyText) > len(setup.Key) {
+				setup.keyText = setup.Key + strings.Repeat(" ", len(e.keyText)-len(setup.Key))
+			}
+			insertAt = i
+			break
+		}
+	}
+	doc.Entries = append(doc.Entries, nil)
+	copy(doc.Entries[insertAt+1:], doc.Entries[insertAt:])
+	doc.Entries[insertAt] = setup
+	return setup
+}
+
+// CommitMessage returns the message committing the fix, mentioning each CVE
+// and flagging the update as a security update in the history.
+func (a *Advisory) CommitMessage(fix *SecurityFix) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s: Security update for %s\n\n", fix.Name, a.ID)
+	switch fix.Action {
+	case SecurityUpdate:
+		fmt.Fprintf(&buf, "Update to v%s", fix.Package.Fixed)
+	case SecurityPatch:
+		buf.WriteString("Backport the fixes")
+	default:
+		fmt.Fprintf(&buf, "Rebuild against the fixed %s", fix.Package.Name)
+	}
+	if len(a.CVEs) > 0 {
+		fmt.Fprintf(&buf, " for %s", strings.Join(a.CVEs, ", "))
+	}
+	buf.WriteString(".\n\nUpdate-Type: security\n")
+	return buf.String()
+}
+
+// Commit will stage all changes within the package directory and commit
+// them as a security update.
+func (a *Advisory) Commit(fix *SecurityFix) error {
+	repoDir := filepath.Dir(fix.Recipe)
+	add := exec.Command("git", "add", "-A", ".")
+	add.Dir = repoDir
+	add.Stderr = os.Stderr
+	if err := add.Run(); err != nil {
+		return fmt.Errorf("Failed to stage recipe changes, reason: %s\n", err)
+	}
+	if !hasStagedChanges(repoDir) {
+		return ErrNothingToCommit
+	}
+	c := exec.Command("git", "commit", "-q", "-m", a.CommitMessage(fix))
+	c.Dir = repoDir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("git commit failed, reason: %s\n", err)
+	}
+	return nil
+}
+
+// Manifest will return the build manifest for the applied fixes, collecting
+// the packages of each into its own directory beneath output.
+func (a *Advisory) Manifest(fixes []*SecurityFix, output string) *BatchManifest {
+	manifest := &BatchManifest{}
+	for _, fix := range fixes {
+		switch fix.Action {
+		case SecurityUpdate, SecurityPatch, SecurityRebuild:
+			manifest.Builds = append(manifest.Builds, &BatchEntry{
+				Recipe: fix.Recipe,
+				Output: filepath.Join(output, fix.Name),
+			})
+		}
+	}
+	return manifest
+}
@@ -0,0 +1,118 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const securityOSVEntry = `{
+    "id": "GHSA-xxxx-yyyy-zzzz",
+    "aliases": ["CVE-2021-3999"],
+    "affected": [{
+        "package": {"name": "glibc"},
+        "ranges": [{"events": [{"introduced": "0"}, {"fixed": "2.35"}]}]
+    }]
+}`
+
+func TestSecurityOSVMatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "advisory.json"), securityOSVEntry)
+	writeTestFile(t, filepath.Join(dir, "tree", "glibc", "package.yml"), "name: glibc\nversion: 2.34\nrelease: 3\n")
+	writeTestFile(t, filepath.Join(dir, "tree", "zlib", "package.yml"), "name: zlib\nversion: 1.2.11\nrelease: 1\n")
+
+	advisory, err := LoadAdvisory(filepath.Join(dir, "advisory.json"))
+	if err != nil {
+		t.Fatalf("Failed to load advisory: %s", err)
+	}
+	if len(advisory.CVEs) != 1 || advisory.CVEs[0] != "CVE-2021-3999" {
+		t.Fatalf("Unexpected CVEs: %v", advisory.CVEs)
+	}
+	fixes, err := advisory.Match(filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatalf("Failed to match recipes: %s", err)
+	}
+	if len(fixes) != 1 || fixes[0].Name != "glibc" || fixes[0].Action != SecurityManual {
+		t.Fatalf("Unexpected fixes: %+v", fixes)
+	}
+	advisory.Packages[0].Fixed = "2.34"
+	if fixes, _ = advisory.Match(filepath.Join(dir, "tree")); fixes[0].Action != SecurityFixed {
+		t.Fatalf("Expected glibc to be fixed, found %s", fixes[0].Action)
+	}
+}
+
+func TestSecurityApplyPatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "advisory.yml"), `id: SA-2021-01
+cves: [CVE-2021-1234]
+packages:
+  - name: libfoo-devel
+    patches: [CVE-2021-1234.patch]
+`)
+	writeTestFile(t, filepath.Join(dir, "CVE-2021-1234.patch"), "--- a/foo.c\n+++ b/foo.c\n")
+	recipe := filepath.Join(dir, "tree", "libfoo", "package.yml")
+	writeTestFile(t, recipe, `name       : libfoo
+version    : 1.0
+release    : 4
+setup      : |
+    %patch -p1 < $pkgfiles/fix-build.patch
+    %configure
+build      : |
+    %make
+`)
+
+	advisory, err := LoadAdvisory(filepath.Join(dir, "advisory.yml"))
+	if err != nil {
+		t.Fatalf("Failed to load advisory: %s", err)
+	}
+	fixes, err := advisory.Match(filepath.Join(dir, "tree"))
+	if err != nil {
+		t.Fatalf("Failed to match recipes: %s", err)
+	}
+	if len(fixes) != 1 || fixes[0].Action != SecurityPatch {
+		t.Fatalf("Unexpected fixes: %+v", fixes)
+	}
+	if err := advisory.Apply(fixes[0]); err != nil {
+		t.Fatalf("Failed to apply fix: %s", err)
+	}
+	b, err := ioutil.ReadFile(recipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `name       : libfoo
+version    : 1.0
+release    : 5
+setup      : |
+    %patch -p1 < $pkgfiles/fix-build.patch
+    %patch -p1 < $pkgfiles/security/CVE-2021-1234.patch
+    %configure
+build      : |
+    %make
+`
+	if string(b) != expected {
+		t.Fatalf("Unexpected recipe:\n%s", b)
+	}
+	if !PathExists(filepath.Join(dir, "tree", "libfoo", "files", "security", "CVE-2021-1234.patch")) {
+		t.Fatalf("Patch was not copied into the recipe")
+	}
+	if msg := advisory.CommitMessage(fixes[0]); !strings.Contains(msg, "CVE-2021-1234") || !strings.HasSuffix(msg, "Update-Type: security\n") {
+		t.Fatalf("Unexpected commit message:\n%s", msg)
+	}
+}
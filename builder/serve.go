@@ -0,0 +1,172 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultServePort is the port the local repository is served on unless
+	// another is requested.
+	DefaultServePort = 8080
+
+	// IndexFile is the compressed index that eopkg fetches from a repository
+	IndexFile = "eopkg-index.xml.xz"
+)
+
+// statusRecorder remembers the status of a response for logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status before passing it on
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// repositoryDir serves the files of the repository, hiding dotfiles and
+// symlinks so that nothing beyond the packages and index can be reached.
+type repositoryDir struct {
+	dir string
+}
+
+// Open will open the named file, unless any part of its path is hidden or a
+// symlink.
+func (r repositoryDir) Open(name string) (http.File, error) {
+	path := r.dir
+	for _, part := range strings.Split(strings.Trim(filepath.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+		path = filepath.Join(path, part)
+		st, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+		if st.Mode()&os.ModeSymlink != 0 {
+			return nil, os.ErrNotExist
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return repositoryFile{f}, nil
+}
+
+// repositoryFile is a file of the repository, listing only what Open serves.
+// The file isn't embedded, so that no other way of listing is exposed.
+type repositoryFile struct {
+	file *os.File
+}
+
+// Read reads from the file
+func (f repositoryFile) Read(p []byte) (int, error) {
+	return f.file.Read(p)
+}
+
+// Seek sets the offset of the next Read
+func (f repositoryFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+// Stat returns the FileInfo of the file
+func (f repositoryFile) Stat() (os.FileInfo, error) {
+	return f.file.Stat()
+}
+
+// Close closes the file
+func (f repositoryFile) Close() error {
+	return f.file.Close()
+}
+
+// Readdir will list the directory without dotfiles and symlinks
+func (f repositoryFile) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := f.file.Readdir(count)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") && entry.Mode()&os.ModeSymlink == 0 {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
+
+// NewRepositoryHandler will return a handler serving the files of the local
+// repository, logging each request.
+func NewRepositoryHandler(dir string) http.Handler {
+	files := http.FileServer(repositoryDir{dir})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		files.ServeHTTP(rec, r)
+		log.Infof("%s %s %s %d\n", r.RemoteAddr, r.Method, r.URL.Path, rec.status)
+	})
+}
+
+// ServeRepository will serve the local repository in dir on the given address
+// until interrupted.
+func ServeRepository(dir, addr string) error {
+	if !PathExists(dir) {
+		return fmt.Errorf("Directory does not exist dir='%s'\n", dir)
+	}
+	if !PathExists(filepath.Join(dir, IndexFile)) {
+		log.Warnf("No %s found in %s, clients won't be able to use it as a repository\n", IndexFile, dir)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on %s, reason: %s\n", addr, err)
+	}
+	server := &http.Server{Handler: NewRepositoryHandler(dir)}
+
+	// Any handler left by the indexer would exit the process, so replace it
+	// with a clean shutdown of the server.
+	signal.Reset(os.Interrupt, syscall.SIGTERM)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(ch)
+	go func() {
+		<-ch
+		log.Infoln("Shutting down the repository server")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Infof("Serving %s on http://%s\n", dir, listener.Addr())
+	log.Infof("Add it to a client with: eopkg add-repo Local http://<host>:%d/%s\n", listener.Addr().(*net.TCPAddr).Port, IndexFile)
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepositoryHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, IndexFile), []byte("index"), 00644); err != nil {
+		t.Fatalf("Failed to write index: %s", err)
+	}
+	server := httptest.NewServer(NewRepositoryHandler(dir))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/" + IndexFile)
+	if err != nil {
+		t.Fatalf("Failed to fetch index: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "index" {
+		t.Fatalf("Unexpected response %d: %s", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(server.URL + "/missing.eopkg")
+	if err != nil {
+		t.Fatalf("Failed to fetch package: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Missing package should not be found, got %d", resp.StatusCode)
+	}
+}
+
+func TestRepositoryHandlerHidden(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(t.TempDir(), "secret")
+	writeTestFile(t, secret, "secret")
+	writeTestFile(t, filepath.Join(dir, "nano-2.7.5-69-1-x86_64.eopkg"), "package")
+	writeTestFile(t, filepath.Join(dir, ".git", "config"), "secret")
+	if err := os.Symlink(secret, filepath.Join(dir, "link.eopkg")); err != nil {
+		t.Fatalf("Failed to create symlink: %s", err)
+	}
+	if err := os.Symlink(filepath.Dir(secret), filepath.Join(dir, "linked")); err != nil {
+		t.Fatalf("Failed to create symlink: %s", err)
+	}
+	server := httptest.NewServer(NewRepositoryHandler(dir))
+	defer server.Close()
+
+	for _, path := range []string{"/.git/config", "/link.eopkg", "/linked/secret"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to fetch %s: %s", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s should not be served, got %d", path, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to list repository: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "nano-2.7.5-69-1-x86_64.eopkg") || strings.Contains(string(body), "link") || strings.Contains(string(body), ".git") {
+		t.Errorf("Listing should only show the package, got %s", body)
+	}
+}
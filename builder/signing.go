@@ -0,0 +1,176 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SignatureSuffix is appended to a file to name its detached signature,
+	// which is where eopkg looks for the signature of the index.
+	SignatureSuffix = ".sig"
+)
+
+var (
+	// SigningKey is the GPG key used to sign the repository index and, when
+	// enabled, every built package.
+	SigningKey string
+
+	// IndexFiles are the files of the eopkg index that clients may verify
+	IndexFiles = []string{
+		"eopkg-index.xml",
+		"eopkg-index.xml.xz",
+	}
+
+	// ErrNoSigningKey is returned when signing is requested without a key
+	ErrNoSigningKey = errors.New("Signing requires a signing_key to be configured")
+)
+
+// CheckSigningKey will ensure the secret half of the key is available to
+// gpg, before any time is spent building or indexing.
+func CheckSigningKey(key string) error {
+	if key == "" {
+		return ErrNoSigningKey
+	}
+	c := exec.Command("gpg", "--batch", "--list-secret-keys", key)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("Signing key %s is not usable, reason: %s", key, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// SignFile will write a detached GPG signature of the file to the path with
+// the SignatureSuffix appended, returning the signature path.
+func SignFile(key, path string) (string, error) {
+	sig := path + SignatureSuffix
+	c := exec.Command("gpg", "--batch", "--yes", "--local-user", key, "--detach-sign", "--output", sig, path)
+	if out, err := c.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("Failed to sign %s, reason: %s\n", filepath.Base(path), strings.TrimSpace(string(out)))
+	}
+	log.Debugf("Signed %s with %s\n", filepath.Base(path), key)
+	return sig, nil
+}
+
+// SignIndex will sign every index file present in the repository directory
+func SignIndex(key, dir string) error {
+	signed := 0
+	for _, name := range IndexFiles {
+		path := filepath.Join(dir, name)
+		if !PathExists(path) {
+			continue
+		}
+		if _, err := SignFile(key, path); err != nil {
+			return err
+		}
+		signed++
+	}
+	if signed == 0 {
+		return fmt.Errorf("No index files found in %s to sign\n", dir)
+	}
+	log.Infof("Signed the repository index with %s\n", key)
+	return nil
+}
+
+// signPackages will sign each of the built packages, returning the paths of
+// their signatures.
+func signPackages(key string, packages []string) ([]string, error) {
+	var sigs []string
+	for _, pkg := range packages {
+		sig, err := SignFile(key, pkg)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	log.Infof("Signed %d package(s) with %s\n", len(packages), key)
+	return sigs, nil
+}
+
+// A SignatureStatus is the result of verifying a detached signature
+type SignatureStatus struct {
+	Good    bool   // Whether the signature is good
+	Trusted bool   // Whether the key is trusted in the local keyring
+	Signer  string // User ID of the signing key
+	Key     string // Fingerprint, or ID, of the signing key
+	Problem string // Why the signature couldn't be verified, if it wasn't
+}
+
+// VerifySignature will check the detached signature of the file using the
+// local keyring.
+func VerifySignature(sig, path string) *SignatureStatus {
+	c := exec.Command("gpg", "--batch", "--status-fd", "1", "--verify", sig, path)
+	out, _ := c.Output()
+	return parseSignatureStatus(string(out))
+}
+
+// signedBy will ensure the signature is good and made by the key, given as
+// a fingerprint or the long key ID it ends with.
+func (s *SignatureStatus) signedBy(key string) error {
+	if !s.Good {
+		return errors.New(s.Problem)
+	}
+	key = strings.ToUpper(strings.ReplaceAll(key, " ", ""))
+	if len(key) < 16 || !strings.HasSuffix(strings.ToUpper(s.Key), key) {
+		return fmt.Errorf("Signed by %s rather than %s", s.Key, key)
+	}
+	return nil
+}
+
+// parseSignatureStatus will interpret the machine readable gpg status lines
+func parseSignatureStatus(raw string) *SignatureStatus {
+	status := &SignatureStatus{}
+	for _, line := range strings.Split(raw, "\n") {
+		fields := strings.Fields(strings.TrimPrefix(line, "[GNUPG:] "))
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "GOODSIG":
+			status.Good = true
+			status.Key = fields[1]
+			status.Signer = strings.Join(fields[2:], " ")
+		case "VALIDSIG":
+			status.Key = fields[1]
+		case "BADSIG":
+			status.Key = fields[1]
+			status.Signer = strings.Join(fields[2:], " ")
+			status.Problem = "Signature does not match the file"
+		case "EXPKEYSIG", "REVKEYSIG":
+			status.Key = fields[1]
+			status.Signer = strings.Join(fields[2:], " ")
+			status.Problem = "Signing key has expired or been revoked"
+		case "NO_PUBKEY":
+			status.Key = fields[1]
+			status.Problem = "Signing key is not in the local keyring"
+		}
+	}
+	for _, trust := range trustedStatus {
+		if strings.Contains(raw, trust) {
+			status.Trusted = true
+		}
+	}
+	if !status.Good && status.Problem == "" {
+		status.Problem = "Signature could not be verified"
+	}
+	return status
+}
@@ -0,0 +1,30 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestSigningRequiresKey(t *testing.T) {
+	if err := CheckSigningKey(""); err != ErrNoSigningKey {
+		t.Fatalf("Signing without a key should fail with ErrNoSigningKey, got: %v", err)
+	}
+	if err := SignIndex("0xDEADBEEF", t.TempDir()); err == nil {
+		t.Fatalf("Signing a directory without an index should fail")
+	}
+}
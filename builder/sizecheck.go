@@ -0,0 +1,227 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// SizeCheckWarn will report packages growing beyond the limit
+	SizeCheckWarn = "warn"
+
+	// SizeCheckStrict will fail the build when packages grow beyond the limit
+	SizeCheckStrict = "strict"
+
+	// DefaultSizeGrowthLimit is the percentage a package may grow by between
+	// builds, when no limit is configured
+	DefaultSizeGrowthLimit = 20
+
+	// DefaultSizeGrowthMinimum is the growth below which a package is never
+	// reported, when no minimum is configured, as small packages easily grow
+	// beyond the limit
+	DefaultSizeGrowthMinimum = "1M"
+
+	// sizeHistoryLength is how many builds of each package are recorded
+	sizeHistoryLength = 20
+)
+
+var (
+	// SizeCheck is the strictness of the package size checks, which are
+	// skipped when empty.
+	SizeCheck string
+
+	// SizeGrowthLimit is the percentage a package may grow by since it was
+	// last built before it's reported
+	SizeGrowthLimit int
+
+	// SizeGrowthMinimum is the number of bytes a package must grow by
+	// before it's reported, whatever the percentage
+	SizeGrowthMinimum int64
+
+	// AcceptSizeGrowth will record the sizes of the packages despite any
+	// growth beyond the limit, accepting it as the new baseline
+	AcceptSizeGrowth bool
+
+	// ErrUnknownSizeCheck is returned for an unsupported strictness
+	ErrUnknownSizeCheck = errors.New("Size check must be \"warn\" or \"strict\"")
+
+	// ErrSizeGrowth is returned when a strict size check finds a package
+	// grew beyond the limit
+	ErrSizeGrowth = errors.New("Packages grew beyond the size growth limit")
+)
+
+// A PackageSize records the sizes of a package from one build
+type PackageSize struct {
+	Version    string    `json:"version"`
+	Release    string    `json:"release"`
+	Built      time.Time `json:"built"`
+	Installed  int64     `json:"installed"`  // Total size of the files installed
+	Compressed int64     `json:"compressed"` // Size of the .eopkg itself
+}
+
+// ValidSizeCheck will determine whether the strictness is supported
+func ValidSizeCheck(mode string) bool {
+	switch mode {
+	case "", SizeCheckWarn, SizeCheckStrict:
+		return true
+	default:
+		return false
+	}
+}
+
+// sizeGrowthLimit returns the growth limit of the config, or the default
+func sizeGrowthLimit(config *Config) int {
+	if config.SizeGrowthLimit <= 0 {
+		return DefaultSizeGrowthLimit
+	}
+	return config.SizeGrowthLimit
+}
+
+// sizeGrowthMinimum returns the growth minimum of the config, or the default
+func sizeGrowthMinimum(config *Config) (int64, error) {
+	if config.SizeGrowthMinimum == "" {
+		return ParseSize(DefaultSizeGrowthMinimum)
+	}
+	return ParseSize(config.SizeGrowthMinimum)
+}
+
+// sizeHistoryPath returns the path of the recorded sizes of the package
+func sizeHistoryPath(dir, name string) string {
+	return filepath.Join(dir, name+".sizes.json")
+}
+
+// loadSizeHistory will load the recorded sizes of the package, oldest first
+func loadSizeHistory(dir, name string) ([]*PackageSize, error) {
+	data, err := ioutil.ReadFile(sizeHistoryPath(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sizes []*PackageSize
+	if err := json.Unmarshal(data, &sizes); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, reason: %s", sizeHistoryPath(dir, name), err)
+	}
+	return sizes, nil
+}
+
+// saveSizeHistory will record the sizes of the package, keeping only the
+// most recent builds.
+func saveSizeHistory(dir, name string, sizes []*PackageSize) error {
+	if len(sizes) > sizeHistoryLength {
+		sizes = sizes[len(sizes)-sizeHistoryLength:]
+	}
+	if err := os.MkdirAll(dir, 00755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(sizes, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := sizeHistoryPath(dir, name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 00644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sizeGrowth returns the growth of the size as a percentage of the previous
+// size, which is zero when there is no previous size.
+func sizeGrowth(previous, current int64) float64 {
+	if previous <= 0 {
+		return 0
+	}
+	return float64(current-previous) * 100 / float64(previous)
+}
+
+// checkSizeGrowth returns a description of each size of the package that
+// grew beyond the limit since the previous build, by at least minimum bytes.
+func checkSizeGrowth(previous, current *PackageSize, limit int, minimum int64) []string {
+	var problems []string
+	check := func(kind string, old, new int64) {
+		if growth := sizeGrowth(old, new); growth > float64(limit) && new-old >= minimum {
+			problems = append(problems, fmt.Sprintf("%s size grew by %.1f%% since %s-%s, from %d to %d bytes",
+				kind, growth, previous.Version, previous.Release, old, new))
+		}
+	}
+	check("Installed", previous.Installed, current.Installed)
+	check("Compressed", previous.Compressed, current.Compressed)
+	return problems
+}
+
+// CheckSizes will compare the sizes of the built packages with those of the
+// last build of each, then record them. With a strict check, a package
+// growing beyond the limit fails the build and nothing is recorded, unless
+// the growth is accepted with AcceptSizeGrowth.
+func (p *Package) CheckSizes(overlay *Overlay) error {
+	if SizeCheck == "" {
+		return nil
+	}
+	built, _ := filepath.Glob(filepath.Join(p.GetWorkDir(overlay), "*.eopkg"))
+	histories := make(map[string][]*PackageSize)
+	grew := false
+	for _, path := range built {
+		payload, err := readEopkgPayload(path)
+		if err != nil {
+			return fmt.Errorf("Failed to read %s, reason: %s\n", filepath.Base(path), err)
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		size := &PackageSize{
+			Version:    payload.Version,
+			Release:    payload.Release,
+			Built:      time.Now().UTC(),
+			Installed:  payloadSize(payload),
+			Compressed: st.Size(),
+		}
+		history, err := loadSizeHistory(StatisticsDirectory, payload.Name)
+		if err != nil {
+			log.Warnf("Ignoring the recorded sizes of %s, reason: %s\n", payload.Name, err)
+		}
+		if len(history) > 0 {
+			for _, problem := range checkSizeGrowth(history[len(history)-1], size, SizeGrowthLimit, SizeGrowthMinimum) {
+				log.Warnf("%s: %s\n", payload.Name, problem)
+				grew = true
+			}
+		}
+		histories[payload.Name] = append(history, size)
+	}
+	if grew && SizeCheck == SizeCheckStrict {
+		if !AcceptSizeGrowth {
+			return ErrSizeGrowth
+		}
+		log.Infoln("Accepting the growth of the packages, recording their sizes")
+	}
+	for name, history := range histories {
+		if err := saveSizeHistory(StatisticsDirectory, name, history); err != nil {
+			log.Warnf("Failed to record the sizes of %s, reason: %s\n", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSizeGrowth(t *testing.T) {
+	previous := &PackageSize{Version: "1.0", Release: "1", Installed: 1000, Compressed: 400}
+	current := &PackageSize{Version: "1.0", Release: "2", Installed: 1150, Compressed: 600}
+	problems := checkSizeGrowth(previous, current, 20, 0)
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "Compressed size grew by 50.0% since 1.0-1") {
+		t.Errorf("Expected only the compressed size to be reported, got %v", problems)
+	}
+	if problems := checkSizeGrowth(previous, current, 50, 0); len(problems) != 0 {
+		t.Errorf("Expected growth within the limit to pass, got %v", problems)
+	}
+	if problems := checkSizeGrowth(previous, current, 20, 1024); len(problems) != 0 {
+		t.Errorf("Expected growth below the minimum to pass, got %v", problems)
+	}
+	if problems := checkSizeGrowth(&PackageSize{}, current, 0, 0); len(problems) != 0 {
+		t.Errorf("Expected no previous size to pass, got %v", problems)
+	}
+}
+
+func TestSizeHistory(t *testing.T) {
+	dir := t.TempDir()
+	if sizes, err := loadSizeHistory(dir, "nano"); err != nil || sizes != nil {
+		t.Fatalf("Expected no recorded sizes, got %v: %v", sizes, err)
+	}
+	var sizes []*PackageSize
+	for i := 0; i < sizeHistoryLength+5; i++ {
+		sizes = append(sizes, &PackageSize{Installed: int64(i)})
+	}
+	if err := saveSizeHistory(dir, "nano", sizes); err != nil {
+		t.Fatalf("Failed to save sizes: %s", err)
+	}
+	loaded, err := loadSizeHistory(dir, "nano")
+	if err != nil {
+		t.Fatalf("Failed to load sizes: %s", err)
+	}
+	if len(loaded) != sizeHistoryLength || loaded[len(loaded)-1].Installed != int64(sizeHistoryLength+4) {
+		t.Errorf("Expected the last %d builds to be kept, got %d", sizeHistoryLength, len(loaded))
+	}
+}
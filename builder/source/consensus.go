@@ -0,0 +1,126 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// SourceMirrors maps URL prefixes of sources to independent mirrors
+	// that serve the same files.
+	SourceMirrors map[string][]string
+
+	// ConsensusRequired is the number of independent fetches, including the
+	// original, that must agree on the digest of a source. A value below 2
+	// disables mirror consensus.
+	ConsensusRequired int
+
+	// ErrNoConsensus is returned when the mirrors don't agree on a source
+	ErrNoConsensus = errors.New("Mirrors did not agree on the source digest")
+)
+
+// MirrorURIs will return the alternative URIs for the given source URI,
+// using all mirror rules with a matching prefix.
+func MirrorURIs(uri string) []string {
+	var prefixes []string
+	for prefix := range SourceMirrors {
+		if strings.HasPrefix(uri, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	var ret []string
+	for _, prefix := range prefixes {
+		for _, mirror := range SourceMirrors[prefix] {
+			ret = append(ret, mirror+strings.TrimPrefix(uri, prefix))
+		}
+	}
+	return ret
+}
+
+// sha256File will return the sha256sum of the file at path
+func sha256File(path string) (string, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fi); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyConsensus will fetch the source again from independent mirrors
+// until enough of them agree with the hash of the original download. The
+// original must also match the recipe digest, so that a compromised mirror
+// can't be masked by a stale recipe.
+func (s *SimpleSource) verifyConsensus(hash, dest string, network Network) error {
+	if s.legacy {
+		sha, err := s.GetSHA1Sum(dest)
+		if err != nil {
+			return err
+		}
+		if sha != s.validator {
+			return fmt.Errorf("Digest mismatch for %s, expected %s got %s", s.File, s.validator, sha)
+		}
+	} else if hash != s.validator {
+		return fmt.Errorf("Digest mismatch for %s, expected %s got %s", s.File, s.validator, hash)
+	}
+
+	mirrors := MirrorURIs(s.URI)
+	if len(mirrors)+1 < ConsensusRequired {
+		return fmt.Errorf("Source %s has %d mirror(s), but consensus requires %d", s.URI, len(mirrors), ConsensusRequired-1)
+	}
+
+	stagePath := filepath.Join(SourceStagingDir, s.File+".consensus")
+	defer os.Remove(stagePath)
+
+	agreed := 1
+	for _, mirror := range mirrors {
+		log.Infof("Verifying source against mirror %s\n", mirror)
+		if err := downloadURI(mirror, stagePath, network); err != nil {
+			log.Warnf("Failed to fetch from mirror %s, reason: %s\n", mirror, err)
+			continue
+		}
+		mirrorHash, err := sha256File(stagePath)
+		if err != nil {
+			return err
+		}
+		if mirrorHash != hash {
+			log.Errorf("Mirror %s disagrees on digest, expected %s got %s\n", mirror, hash, mirrorHash)
+			continue
+		}
+		if agreed++; agreed >= ConsensusRequired {
+			log.Debugf("Reached consensus for %s with %d fetches\n", s.File, agreed)
+			return nil
+		}
+	}
+	log.Errorf("Only %d of the required %d fetches agreed on %s\n", agreed, ConsensusRequired, s.File)
+	return ErrNoConsensus
+}
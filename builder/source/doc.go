@@ -0,0 +1,24 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package source fetches and caches the sources of packages, and provides
+// the bind mounts that make them visible within a build root.
+//
+// Every kind of source implements the Source interface, and New selects
+// the implementation from the URI: plain downloads, git repositories, IPFS,
+// torrents and fetch scripts shipped with the recipe. Sources are cached
+// beneath SourceDir, so they are shared between all builds on the host.
+package source
@@ -94,10 +94,16 @@ func (g *GitSource) CreateCallbacks() git.RemoteCallbacks {
 
 // Clone will set do a bare mirror clone of the remote repo to the local
 // cache.
-func (g *GitSource) Clone() error {
+func (g *GitSource) Clone(network Network) error {
 	// Attempt cloning
 	log.Debugf("Cloning git source %s\n", g.URI)
 
+	// libgit2 can't be restricted to an address family
+	if family := network.gitFamilyArgs(); family != nil {
+		args := append([]string{"clone"}, family...)
+		return commands.ExecStdoutArgs("git", append(args, g.URI, g.ClonePath))
+	}
+
 	fetchOpts := &git.FetchOptions{
 		RemoteCallbacks: g.CreateCallbacks(),
 	}
@@ -122,8 +128,12 @@ func (g *GitSource) HasTag(repo *git.Repository, tagName string) bool {
 }
 
 // fetch will attempt
-func (g *GitSource) fetch(repo *git.Repository) error {
+func (g *GitSource) fetch(repo *git.Repository, network Network) error {
 	log.Infof("Git fetching existing clone %s\n", g.URI)
+	if family := network.gitFamilyArgs(); family != nil {
+		args := append([]string{"fetch"}, family...)
+		return commands.ExecStdoutArgsDir(g.ClonePath, "git", append(args, "origin"))
+	}
 	remote, err := repo.Remotes.Lookup("origin")
 	if err != nil {
 		log.Errorf("Failed to find git remote %s %s\n", g.URI, err)
@@ -184,6 +194,17 @@ func (g *GitSource) GetCommitID(repo *git.Repository) string {
 	return obj.String()
 }
 
+// CommitID will return the commit that the ref resolves to within the
+// local clone, or an empty string if it cannot be resolved.
+func (g *GitSource) CommitID() string {
+	repo, err := git.OpenRepository(g.ClonePath)
+	if err != nil {
+		return ""
+	}
+	defer repo.Free()
+	return g.GetCommitID(repo)
+}
+
 // GetHead will attempt to gain the OID for head
 func (g *GitSource) GetHead(repo *git.Repository) (string, error) {
 	head, err := repo.Head()
@@ -229,20 +250,27 @@ func (g *GitSource) resetOnto(repo *git.Repository, ref string) error {
 
 // submodules will handle setup of the git submodules after a
 // reset has taken place.
-func (g *GitSource) submodules() error {
+func (g *GitSource) submodules(network Network) error {
+	if err := g.mirrorSubmodules(network); err != nil {
+		return err
+	}
 	// IDK What else to tell ya, git2go submodules is broken
-	cmd := []string{"submodule", "update", "--init", "--recursive"}
-	return commands.ExecStdoutArgsDir(g.ClonePath, "git", cmd)
+	cmd := append(rewriteArgs(), "submodule", "update", "--init", "--recursive")
+	if err := commands.ExecStdoutArgsDir(g.ClonePath, "git", cmd); err != nil {
+		return err
+	}
+	// Never continue with an incomplete tree
+	return g.verifySubmodules()
 }
 
 // Fetch will attempt to download the git tree locally. If it already exists
 // then we'll make an attempt to update it.
-func (g *GitSource) Fetch() error {
+func (g *GitSource) Fetch(network Network) error {
 	hadRepo := true
 
 	// First things first, clone if necessary
 	if !PathExists(g.ClonePath) {
-		if err := g.Clone(); err != nil {
+		if err := g.Clone(network); err != nil {
 			log.Errorf("Failed to clone remote repository %s %s\n", g.URI, err)
 			return err
 		}
@@ -262,7 +290,7 @@ func (g *GitSource) Fetch() error {
 			return fmt.Errorf("Cannot continue with git processing")
 		}
 		// So try to fetch it
-		if err := g.fetch(repo); err != nil {
+		if err := g.fetch(repo, network); err != nil {
 			return err
 		}
 		// Re-establish the wanted commit
@@ -280,7 +308,7 @@ func (g *GitSource) Fetch() error {
 	}
 
 	// Check out submodules
-	return g.submodules()
+	return g.submodules(network)
 }
 
 // IsFetched will check if we have the ref available, if not it will return
@@ -0,0 +1,100 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package source
+
+import (
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"os"
+	"path/filepath"
+)
+
+// A GitMaintenanceResult describes the outcome of maintenance on a single
+// cached git clone.
+type GitMaintenanceResult struct {
+	Path   string // Path of the clone
+	Before int64  // Disk usage prior to maintenance
+	After  int64  // Disk usage after maintenance
+	Err    error  // Set if maintenance failed
+}
+
+// Reclaimed returns the number of bytes freed by maintenance
+func (r *GitMaintenanceResult) Reclaimed() int64 {
+	return r.Before - r.After
+}
+
+// FindGitClones will return the paths of all cached git clones
+func FindGitClones() ([]string, error) {
+	var clones []string
+	if !PathExists(GitSourceDir) {
+		return nil, nil
+	}
+	err := filepath.Walk(GitSourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		// Submodule mirrors are bare clones
+		if PathExists(filepath.Join(path, ".git")) || PathExists(filepath.Join(path, "objects")) {
+			clones = append(clones, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return clones, err
+}
+
+// dirSize returns the apparent size of all files under path
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// MaintainGitClone will prune stale refs and repack the objects of the given
+// clone. When offline is set, remote tracking refs are left untouched as
+// pruning them requires contacting the remote.
+func MaintainGitClone(path string, offline bool) *GitMaintenanceResult {
+	result := &GitMaintenanceResult{Path: path, Before: dirSize(path)}
+
+	var steps [][]string
+	if !offline {
+		steps = append(steps, []string{"remote", "prune", "origin"})
+	}
+	steps = append(steps, [][]string{
+		{"reflog", "expire", "--expire=now", "--all"},
+		{"repack", "-a", "-d", "-q"},
+		{"prune", "--expire=now"},
+	}...)
+
+	for _, args := range steps {
+		log.Debugf("Running git %v in %s\n", args, path)
+		if err := commands.ExecStdoutArgsDir(path, "git", args); err != nil {
+			result.Err = err
+			break
+		}
+	}
+	result.After = dirSize(path)
+	return result
+}
@@ -0,0 +1,270 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package source
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrSubmoduleMismatch is returned when submodules aren't checked out at
+	// the commit recorded by the superproject
+	ErrSubmoduleMismatch = errors.New("Git submodules do not match the pinned commits")
+
+	// SubmoduleMirrorDir is where bare mirrors of git submodules are cached,
+	// so that they can be shared between sources and reused between builds.
+	SubmoduleMirrorDir = filepath.Join(GitSourceDir, "mirrors")
+
+	// SubmoduleRewrites maps URL prefixes of submodules to their replacement,
+	// allowing slow or dead hosts to be swapped for a working mirror.
+	SubmoduleRewrites map[string]string
+)
+
+// A gitSubmodule is a single submodule entry from .gitmodules
+type gitSubmodule struct {
+	Name string
+	Path string
+	URL  string
+}
+
+// RewriteSubmoduleURL will apply the longest matching rewrite rule to the
+// given URL, or return it unchanged if no rule matches.
+func RewriteSubmoduleURL(uri string) string {
+	match := ""
+	for prefix := range SubmoduleRewrites {
+		if strings.HasPrefix(uri, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	if match == "" {
+		return uri
+	}
+	return SubmoduleRewrites[match] + strings.TrimPrefix(uri, match)
+}
+
+// rewriteArgs will return the git config arguments needed to have git apply
+// the rewrite rules itself, i.e. for nested submodules.
+func rewriteArgs() []string {
+	var prefixes []string
+	for prefix := range SubmoduleRewrites {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	var args []string
+	for _, prefix := range prefixes {
+		args = append(args, "-c", fmt.Sprintf("url.%s.insteadOf=%s", SubmoduleRewrites[prefix], prefix))
+	}
+	return args
+}
+
+// gitOutput will run git in the given directory and return its stdout
+func gitOutput(dir string, args ...string) (string, error) {
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	return strings.TrimRight(string(out), "\n"), err
+}
+
+// listSubmodules will parse the top level submodules of the clone
+func (g *GitSource) listSubmodules() ([]gitSubmodule, error) {
+	if !PathExists(filepath.Join(g.ClonePath, ".gitmodules")) {
+		return nil, nil
+	}
+	out, err := gitOutput(g.ClonePath, "config", "-f", ".gitmodules", "--get-regexp", `^submodule\..*\.path$`)
+	if err != nil {
+		return nil, err
+	}
+	var mods []gitSubmodule
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(fields[0], "submodule."), ".path")
+		uri, err := gitOutput(g.ClonePath, "config", "-f", ".gitmodules", fmt.Sprintf("submodule.%s.url", name))
+		if err != nil {
+			return nil, err
+		}
+		mods = append(mods, gitSubmodule{Name: name, Path: fields[1], URL: uri})
+	}
+	return mods, nil
+}
+
+// submoduleMirrorPath will return the local mirror path for the given URL,
+// or an empty string if the URL cannot be mirrored.
+func submoduleMirrorPath(uri string) string {
+	// Relative submodules are resolved against origin by git itself
+	if strings.HasPrefix(uri, "./") || strings.HasPrefix(uri, "../") {
+		return ""
+	}
+	urlObj, err := url.Parse(uri)
+	if err != nil || urlObj.Host == "" {
+		return ""
+	}
+	bs := filepath.Base(urlObj.Path)
+	if !strings.HasSuffix(bs, ".git") {
+		bs += ".git"
+	}
+	return filepath.Join(SubmoduleMirrorDir, urlObj.Host, filepath.Dir(urlObj.Path), bs)
+}
+
+// updateMirror will ensure the mirror contains the given commit, only
+// touching the network when it doesn't already.
+func updateMirror(mirror, uri, commit string, network Network) error {
+	if !PathExists(mirror) {
+		log.Infof("Mirroring git submodule %s\n", uri)
+		if err := os.MkdirAll(filepath.Dir(mirror), 00755); err != nil {
+			return err
+		}
+		args := append([]string{"clone", "--mirror"}, network.gitFamilyArgs()...)
+		return commands.ExecStdoutArgs("git", append(args, uri, mirror))
+	}
+	if _, err := gitOutput(mirror, "cat-file", "-e", commit+"^{commit}"); err == nil {
+		log.Debugf("Reusing git submodule mirror %s\n", mirror)
+		return nil
+	}
+	log.Infof("Updating git submodule mirror %s\n", uri)
+	args := append([]string{"fetch", "--all", "--prune"}, network.gitFamilyArgs()...)
+	return commands.ExecStdoutArgsDir(mirror, "git", args)
+}
+
+// mirrorSubmodules will point each submodule at a local mirror, so that the
+// following submodule update doesn't need to hit the network.
+func (g *GitSource) mirrorSubmodules(network Network) error {
+	mods, err := g.listSubmodules()
+	if err != nil {
+		return fmt.Errorf("Failed to read .gitmodules, reason: %s", err)
+	}
+	if len(mods) == 0 {
+		return nil
+	}
+	if err := commands.ExecStdoutArgsDir(g.ClonePath, "git", []string{"submodule", "init"}); err != nil {
+		return err
+	}
+	for _, mod := range mods {
+		uri := RewriteSubmoduleURL(mod.URL)
+		mirror := submoduleMirrorPath(uri)
+		if mirror == "" {
+			continue
+		}
+		commit, err := gitOutput(g.ClonePath, "rev-parse", "HEAD:"+mod.Path)
+		if err != nil {
+			return fmt.Errorf("Failed to find commit of submodule %s, reason: %s", mod.Name, err)
+		}
+		if err := updateMirror(mirror, uri, commit, network); err != nil {
+			return fmt.Errorf("Failed to mirror submodule %s, reason: %s", uri, err)
+		}
+		args := []string{"config", fmt.Sprintf("submodule.%s.url", mod.Name), mirror}
+		if err := commands.ExecStdoutArgsDir(g.ClonePath, "git", args); err != nil {
+			return err
+		}
+		// Previously cloned submodules must fetch from the mirror too
+		modConfig := filepath.Join(g.ClonePath, ".git", "modules", mod.Name, "config")
+		if PathExists(modConfig) {
+			args = []string{"config", "-f", modConfig, "remote.origin.url", mirror}
+			if err := commands.ExecStdoutArgsDir(g.ClonePath, "git", args); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A submoduleStatus is a single entry from `git submodule status`
+type submoduleStatus struct {
+	State  byte   // ' ' when in sync, '-' if not initialised, '+' if mismatched, 'U' if conflicted
+	Commit string // Commit as checked out, or as recorded when cached
+	Path   string // Path relative to the clone
+}
+
+// submoduleStatuses will return the recursive submodule status, keyed by
+// path. When cached is set, the commits recorded by the superproject are
+// returned rather than those checked out.
+func (g *GitSource) submoduleStatuses(cached bool) (map[string]submoduleStatus, error) {
+	args := append(rewriteArgs(), "submodule", "status", "--recursive")
+	if cached {
+		args = append(args, "--cached")
+	}
+	out, err := gitOutput(g.ClonePath, args...)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]submoduleStatus)
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) < 2 {
+			continue
+		}
+		ret[fields[1]] = submoduleStatus{State: line[0], Commit: fields[0], Path: fields[1]}
+	}
+	return ret, nil
+}
+
+// verifySubmodules will ensure every submodule is checked out at exactly
+// the commit pinned by its superproject, logging each mismatch found.
+func (g *GitSource) verifySubmodules() error {
+	if !PathExists(filepath.Join(g.ClonePath, ".gitmodules")) {
+		return nil
+	}
+	actual, err := g.submoduleStatuses(false)
+	if err != nil {
+		return fmt.Errorf("Failed to read submodule status, reason: %s", err)
+	}
+	pinned, err := g.submoduleStatuses(true)
+	if err != nil {
+		return fmt.Errorf("Failed to read pinned submodules, reason: %s", err)
+	}
+	var paths []string
+	for path := range pinned {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	mismatched := false
+	for _, path := range paths {
+		want := pinned[path].Commit
+		got, ok := actual[path]
+		switch {
+		case !ok || got.State == '-':
+			log.Errorf("Submodule %s is not checked out, expected %s\n", path, want)
+		case got.State == 'U':
+			log.Errorf("Submodule %s has merge conflicts, expected %s\n", path, want)
+		case got.State == '+' || got.Commit != want:
+			log.Errorf("Submodule %s is at %s, expected %s\n", path, got.Commit, want)
+		default:
+			continue
+		}
+		mismatched = true
+	}
+	if mismatched {
+		return ErrSubmoduleMismatch
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package source
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// HealthOK is a source which is still available upstream
+	HealthOK = "ok"
+
+	// HealthDead is a source which can no longer be fetched
+	HealthDead = "dead"
+
+	// HealthChanged is a source whose upstream artifact no longer matches
+	// the recipe
+	HealthChanged = "changed"
+
+	// HealthSkipped is a source which can't be checked without fetching it
+	HealthSkipped = "skipped"
+
+	// healthTimeout bounds each request made without downloading the source
+	healthTimeout = 30 * time.Second
+)
+
+var (
+	// commitRegex matches a full git commit hash
+	commitRegex = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// Health is the outcome of checking that a source is still available
+type Health struct {
+	URI      string `json:"uri"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Verified bool   `json:"verified"` // Whether the digest was checked against a full download
+}
+
+// CheckHealth will determine whether the source is still available upstream
+// without fetching it, using HEAD or single byte range requests. The size
+// reported upstream is compared with any cached copy of the source, while
+// full will download the whole source to compare its digest.
+func CheckHealth(s Source, full bool) *Health {
+	switch v := s.(type) {
+	case *SimpleSource:
+		return v.checkHealth(full)
+	case *IPFSSource:
+		health := v.simple.checkHealth(full)
+		health.URI = v.URI
+		return health
+	case *GitSource:
+		return v.checkHealth()
+	}
+	return &Health{URI: s.GetIdentifier(), Status: HealthSkipped, Detail: "unsupported source type"}
+}
+
+// probe will request the first byte of the URI, unless HEAD is supported,
+// returning the size of the whole file when known.
+func probe(uri string) (int64, error) {
+	client := HTTPClient()
+	client.Timeout = healthTimeout
+	resp, err := client.Head(uri)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 400 {
+			return resp.ContentLength, nil
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err = client.Do(req)
+	if err != nil {
+		return -1, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 400:
+		return -1, fmt.Errorf("HTTP %s", resp.Status)
+	case resp.StatusCode == http.StatusPartialContent:
+		// Content-Range: bytes 0-0/12345
+		var size int64
+		if i := strings.LastIndex(resp.Header.Get("Content-Range"), "/"); i >= 0 {
+			if _, err := fmt.Sscan(resp.Header.Get("Content-Range")[i+1:], &size); err == nil {
+				return size, nil
+			}
+		}
+		return -1, nil
+	}
+	return resp.ContentLength, nil
+}
+
+// checkHealth will probe the source, or download it in full to compare the
+// digest.
+func (s *SimpleSource) checkHealth(full bool) *Health {
+	health := &Health{URI: s.URI, Status: HealthOK}
+	if s.url.Scheme != "http" && s.url.Scheme != "https" {
+		health.Status = HealthSkipped
+		health.Detail = fmt.Sprintf("unsupported scheme %s", s.url.Scheme)
+		return health
+	}
+	if full {
+		sum, err := s.remoteDigest()
+		switch {
+		case err != nil:
+			health.Status = HealthDead
+			health.Detail = err.Error()
+		case sum != s.validator:
+			health.Status = HealthChanged
+			health.Detail = fmt.Sprintf("digest is now %s, expected %s", sum, s.validator)
+		}
+		health.Verified = err == nil
+		return health
+	}
+	size, err := probe(s.URI)
+	if err != nil {
+		health.Status = HealthDead
+		health.Detail = err.Error()
+		return health
+	}
+	if st, err := os.Stat(s.GetPath(s.validator)); err == nil && size >= 0 && size != st.Size() {
+		health.Status = HealthChanged
+		health.Detail = fmt.Sprintf("size is now %d bytes, the cached copy has %d", size, st.Size())
+	}
+	return health
+}
+
+// remoteDigest will download the source without storing it, returning its
+// digest.
+func (s *SimpleSource) remoteDigest() (string, error) {
+	resp, err := HTTPClient().Get(s.URI)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("HTTP %s", resp.Status)
+	}
+	var h hash.Hash = sha256.New()
+	if s.legacy {
+		h = sha1.New()
+	}
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkHealth will list the refs of the remote, ensuring that the ref of the
+// recipe still exists. Commits can't be listed, so only the remote is checked.
+func (g *GitSource) checkHealth() *Health {
+	health := &Health{URI: g.URI, Status: HealthOK}
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, "git", "ls-remote", RewriteSubmoduleURL(g.URI))
+	c.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := c.Output()
+	if err != nil {
+		health.Status = HealthDead
+		health.Detail = fmt.Sprintf("git ls-remote failed, reason: %s", err)
+		return health
+	}
+	if commitRegex.MatchString(g.Ref) {
+		return health
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		switch strings.TrimSuffix(fields[1], "^{}") {
+		case g.Ref, "refs/tags/" + g.Ref, "refs/heads/" + g.Ref:
+			return health
+		}
+	}
+	health.Status = HealthDead
+	health.Detail = fmt.Sprintf("ref %s no longer exists", g.Ref)
+	return health
+}
@@ -0,0 +1,97 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package source
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// IPFSGateway is the HTTP gateway used to resolve ipfs:// sources, as we
+	// don't want to require a running IPFS daemon on every build host.
+	IPFSGateway = "https://ipfs.io"
+)
+
+// An IPFSSource is a file published over IPFS, referenced in the package
+// spec as ipfs://$CID/path/to/file. It is fetched through the configured
+// HTTP gateway and must match the declared sha256sum.
+type IPFSSource struct {
+	URI string
+	CID string
+
+	simple *SimpleSource // Gateway backed download
+}
+
+// NewIPFS will create a new IPFSSource for the given ipfs:// URI
+func NewIPFS(uri, validator string) (*IPFSSource, error) {
+	uriObj, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if uriObj.Host == "" {
+		return nil, fmt.Errorf("Missing CID in IPFS source: %s", uri)
+	}
+	gateway := fmt.Sprintf("%s/ipfs/%s%s", strings.TrimSuffix(IPFSGateway, "/"), uriObj.Host, uriObj.Path)
+	if uriObj.Fragment != "" {
+		gateway += "#" + uriObj.Fragment
+	}
+	simple, err := NewSimple(gateway, validator, false)
+	if err != nil {
+		return nil, err
+	}
+	// A bare CID has no useful basename, so fall back to the CID itself
+	if uriObj.Path == "" && uriObj.Fragment == "" {
+		simple.File = uriObj.Host
+	}
+	return &IPFSSource{
+		URI:    uri,
+		CID:    uriObj.Host,
+		simple: simple,
+	}, nil
+}
+
+// GetIdentifier will return the original ipfs:// URI for this source
+func (s *IPFSSource) GetIdentifier() string {
+	return s.URI
+}
+
+// GetBindConfiguration will return the pair for binding the cached file
+func (s *IPFSSource) GetBindConfiguration(rootfs string) BindConfiguration {
+	return s.simple.GetBindConfiguration(rootfs)
+}
+
+// IsFetched will determine if the source is already present
+func (s *IPFSSource) IsFetched() bool {
+	return s.simple.IsFetched()
+}
+
+// Fetch will download the source through the IPFS gateway, and ensure
+// that the content matches the declared hash.
+func (s *IPFSSource) Fetch(network Network) error {
+	log.Debugf("Fetching IPFS source %s via %s\n", s.URI, IPFSGateway)
+	if err := s.simple.Fetch(network); err != nil {
+		return err
+	}
+	if !s.IsFetched() {
+		return fmt.Errorf("Hash mismatch for IPFS source %s, expected %s", filepath.Base(s.URI), s.simple.validator)
+	}
+	return nil
+}
@@ -17,6 +17,7 @@
 package source
 
 import (
+	"fmt"
 	"os"
 	"strings"
 )
@@ -53,8 +54,9 @@ type Source interface {
 	// whether this source is available for use.
 	IsFetched() bool
 
-	// Fetch will attempt to fetch the this source locally and cache it.
-	Fetch() error
+	// Fetch will attempt to fetch the this source locally and cache it,
+	// using the address family settings of the profile.
+	Fetch(network Network) error
 
 	// GetBindConfiguration should return a valid configuration specifying
 	// the origin on our local filesystem, and the target within the container.
@@ -75,6 +77,10 @@ type Source interface {
 // The legacy argument will determine whether special care should be taken
 // for legacy packages (i.e. sha1sum vs sha256sum).
 //
+// ipfs:// URIs and magnet: links are supported for ypkg only, and are
+// validated against the sha256sum like any other file, as are the files
+// produced by script| fetch scripts.
+//
 // In all cases, New will fallback to the SimpleSource implementation
 func New(uri, validator string, legacy bool) (Source, error) {
 	if legacy {
@@ -84,6 +90,15 @@ func New(uri, validator string, legacy bool) (Source, error) {
 	if strings.HasPrefix(uri, "git|") {
 		return NewGit(uri[len("git|"):], validator)
 	}
+	if strings.HasPrefix(uri, "ipfs://") {
+		return NewIPFS(uri, validator)
+	}
+	if strings.HasPrefix(uri, "magnet:") {
+		return NewTorrent(uri, validator)
+	}
+	if strings.HasPrefix(uri, "script|") {
+		return NewScript(uri[len("script|"):], validator)
+	}
 	return NewSimple(uri, validator, legacy)
 }
 
@@ -94,3 +109,73 @@ func PathExists(path string) bool {
 	}
 	return false
 }
+
+// Digest will return the value that the given source is validated against,
+// i.e. the hash of a file or the ref of a git checkout.
+func Digest(s Source) string {
+	switch v := s.(type) {
+	case *SimpleSource:
+		return v.validator
+	case *GitSource:
+		return v.Ref
+	case *IPFSSource:
+		return v.simple.validator
+	case *TorrentSource:
+		return v.validator
+	case *ScriptSource:
+		return v.validator
+	}
+	return ""
+}
+
+// ResolvedDigest will return the algorithm and value identifying exactly
+// what was fetched for the source. Git refs are resolved to the commit they
+// pointed at, so it should only be used once the source has been fetched.
+func ResolvedDigest(s Source) (string, string) {
+	switch v := s.(type) {
+	case *SimpleSource:
+		if v.legacy {
+			return "sha1", v.validator
+		}
+		return "sha256", v.validator
+	case *GitSource:
+		if commit := v.CommitID(); commit != "" {
+			return "commit", commit
+		}
+		return "ref", v.Ref
+	case *IPFSSource:
+		return "sha256", v.simple.validator
+	case *TorrentSource:
+		return "sha256", v.validator
+	case *ScriptSource:
+		return "sha256", v.validator
+	}
+	return "", ""
+}
+
+// Describe will return a human readable summary of where the source will be
+// fetched from, allowing builds to be reviewed before they are run.
+func Describe(s Source) string {
+	switch v := s.(type) {
+	case *SimpleSource:
+		hash := "sha256"
+		if v.legacy {
+			hash = "sha1"
+		}
+		desc := fmt.Sprintf("%s (%s %s)", v.URI, hash, v.validator)
+		if ConsensusRequired > 1 {
+			desc += fmt.Sprintf(", %d fetches must agree using mirrors: %s",
+				ConsensusRequired, strings.Join(MirrorURIs(v.URI), " "))
+		}
+		return desc
+	case *GitSource:
+		return fmt.Sprintf("git %s at %s", v.URI, v.Ref)
+	case *IPFSSource:
+		return fmt.Sprintf("%s via %s (sha256 %s)", v.URI, v.simple.URI, v.simple.validator)
+	case *TorrentSource:
+		return fmt.Sprintf("torrent %s (sha256 %s)", v.URI, v.validator)
+	case *ScriptSource:
+		return fmt.Sprintf("%s produced by fetch script %s in a sandbox (sha256 %s)", v.File, v.Script, v.validator)
+	}
+	return s.GetIdentifier()
+}
@@ -0,0 +1,207 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/andelf/go-curl"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// FamilyAny will use both IPv4 and IPv6, the default
+	FamilyAny = "any"
+
+	// FamilyIPv4 restricts all fetches to IPv4
+	FamilyIPv4 = "ipv4"
+
+	// FamilyIPv6 restricts all fetches to IPv6
+	FamilyIPv6 = "ipv6"
+
+	// FallbackDelay is how long we wait on the preferred address family
+	// before racing a connection over the other, as per RFC 8305.
+	FallbackDelay = 300 * time.Millisecond
+)
+
+var (
+	// MaxDownloadRate limits the bytes per second of each download, when set
+	MaxDownloadRate int64
+
+	// ErrNoAddresses is returned when a host has no usable address
+	ErrNoAddresses = errors.New("No addresses in the permitted address family")
+)
+
+// Network holds the address family settings used by fetches, as set in
+// the profile. The zero value will use any family, preferring IPv6.
+type Network struct {
+	Family     string // Restrict fetches to FamilyIPv4 or FamilyIPv6
+	PreferIPv4 bool   // Try IPv4 addresses first on dual-stack hosts
+}
+
+// ValidIPFamily will ensure the address family is one we understand
+func ValidIPFamily(family string) error {
+	switch family {
+	case "", FamilyAny, FamilyIPv4, FamilyIPv6:
+		return nil
+	default:
+		return fmt.Errorf("Invalid address family '%s', expected any, ipv4 or ipv6", family)
+	}
+}
+
+// curlIPResolve will return the libcurl resolve option for the family.
+// libcurl itself implements happy eyeballs for dual-stack hosts.
+func (n Network) curlIPResolve() int {
+	switch n.Family {
+	case FamilyIPv4:
+		return curl.IPRESOLVE_V4
+	case FamilyIPv6:
+		return curl.IPRESOLVE_V6
+	default:
+		return curl.IPRESOLVE_WHATEVER
+	}
+}
+
+// gitFamilyArgs will return the git clone/fetch arguments for the family
+func (n Network) gitFamilyArgs() []string {
+	switch n.Family {
+	case FamilyIPv4:
+		return []string{"--ipv4"}
+	case FamilyIPv6:
+		return []string{"--ipv6"}
+	default:
+		return nil
+	}
+}
+
+// dialNetwork will restrict the given network to the permitted family
+func (n Network) dialNetwork(network string) string {
+	switch n.Family {
+	case FamilyIPv4:
+		return network + "4"
+	case FamilyIPv6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// DialContext will connect to the address using happy eyeballs, racing the
+// preferred address family against the other after the FallbackDelay.
+func (n Network) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, FallbackDelay: -1}
+	if restricted := n.dialNetwork(network); restricted != network {
+		return dialer.DialContext(ctx, restricted, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []string
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, net.JoinHostPort(addr.IP.String(), port))
+		} else {
+			v6 = append(v6, net.JoinHostPort(addr.IP.String(), port))
+		}
+	}
+	primary, fallback := v6, v4
+	if n.PreferIPv4 {
+		primary, fallback = v4, v6
+	}
+	if len(primary) == 0 {
+		primary, fallback = fallback, nil
+	}
+	if len(primary) == 0 {
+		return nil, ErrNoAddresses
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	race := func(candidates []string, delay time.Duration) {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			results <- result{err: ctx.Err()}
+			return
+		}
+		var err error
+		for _, candidate := range candidates {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, candidate); err == nil {
+				results <- result{conn: conn}
+				return
+			}
+		}
+		results <- result{err: err}
+	}
+
+	racers := 1
+	go race(primary, 0)
+	if len(fallback) > 0 {
+		racers++
+		go race(fallback, FallbackDelay)
+	}
+	var firstErr error
+	for i := 0; i < racers; i++ {
+		r := <-results
+		if r.err == nil {
+			// Close the loser, should it also connect
+			if i+1 < racers {
+				go func() {
+					if late := <-results; late.conn != nil {
+						late.conn.Close()
+					}
+				}()
+			}
+			return r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+	}
+	return nil, firstErr
+}
+
+// HTTPClient will return a client that respects the address family settings
+func (n Network) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         n.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// HTTPClient will return a client for requests made outside of a build,
+// using any address family.
+func HTTPClient() *http.Client {
+	return Network{}.HTTPClient()
+}
@@ -0,0 +1,240 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// scriptWorkDir is the writable directory of a fetch script, where it
+	// must leave the file it produces
+	scriptWorkDir = "/work"
+
+	// scriptRecipeDir is where the recipe directory is visible, read-only,
+	// to a fetch script
+	scriptRecipeDir = "/recipe"
+)
+
+var (
+	// ErrScriptNoName is returned when a fetch script doesn't declare the
+	// name of the file it produces.
+	ErrScriptNoName = errors.New("Fetch script requires a #filename fragment naming its output")
+
+	// ErrScriptPath is returned for a fetch script outside the recipe directory
+	ErrScriptPath = errors.New("Fetch script must be a relative path within the recipe directory")
+
+	// scriptHostDirs are made available, read-only, to fetch scripts so they
+	// may use the tools of the host
+	scriptHostDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64"}
+
+	// scriptHostConfig is the configuration of the host that fetch scripts
+	// need to resolve names and verify certificates, leaving the rest of
+	// /etc hidden
+	scriptHostConfig = []string{
+		"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf", "/etc/ld.so.cache",
+		"/etc/passwd", "/etc/group", "/etc/ssl", "/etc/ca-certificates",
+	}
+
+	// scriptProxyEnv are the proxy variables of the host kept for fetch scripts
+	scriptProxyEnv = []string{"http_proxy", "https_proxy", "no_proxy"}
+)
+
+// A ScriptSource is a file produced by a script shipped with the recipe,
+// i.e. cloning a repository and generating a tarball from it. It is
+// referenced in the package spec as script|fetch.sh#name-1.0.tar.xz, and the
+// script runs with networking, but can only write to its own empty working
+// directory. The file it leaves there must match the declared sha256sum.
+type ScriptSource struct {
+	Script string // Path of the script, relative to the recipe directory
+	File   string // Basename of the file produced by the script
+	Dir    string // Directory of the recipe, set once the recipe is loaded
+
+	validator string // Expected sha256sum
+}
+
+// NewScript will create a new ScriptSource for the given script and output
+func NewScript(uri, validator string) (*ScriptSource, error) {
+	script, file := uri, ""
+	if i := strings.LastIndex(uri, "#"); i >= 0 {
+		script, file = uri[:i], uri[i+1:]
+	}
+	file = filepath.Base(file)
+	if file == "" || file == "." || file == "/" {
+		return nil, ErrScriptNoName
+	}
+	script = filepath.Clean(script)
+	if filepath.IsAbs(script) || script == "." || strings.HasPrefix(script, "..") {
+		return nil, ErrScriptPath
+	}
+	return &ScriptSource{
+		Script:    script,
+		File:      file,
+		validator: validator,
+	}, nil
+}
+
+// GetIdentifier will return the script and the file it produces
+func (s *ScriptSource) GetIdentifier() string {
+	return fmt.Sprintf("script|%s#%s", s.Script, s.File)
+}
+
+// GetPath gets the path on the filesystem of the source
+func (s *ScriptSource) GetPath(hash string) string {
+	return filepath.Join(SourceDir, hash, s.File)
+}
+
+// GetBindConfiguration will return the pair for binding the produced file
+func (s *ScriptSource) GetBindConfiguration(rootfs string) BindConfiguration {
+	return BindConfiguration{
+		BindSource: s.GetPath(s.validator),
+		BindTarget: filepath.Join(rootfs, s.File),
+	}
+}
+
+// IsFetched will determine if the file has already been produced
+func (s *ScriptSource) IsFetched() bool {
+	return PathExists(s.GetPath(s.validator))
+}
+
+// sandboxArgs returns the bwrap(1) arguments running the script with the
+// network of the host, but only the working directory writable.
+func (s *ScriptSource) sandboxArgs(workDir string) []string {
+	args := []string{
+		"--unshare-all",
+		"--share-net",
+		"--die-with-parent",
+		"--new-session",
+		"--cap-drop", "ALL",
+		"--clearenv",
+	}
+	for _, dir := range scriptHostDirs {
+		if st, err := os.Lstat(dir); err != nil {
+			continue
+		} else if st.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(dir)
+			if err != nil {
+				continue
+			}
+			args = append(args, "--symlink", target, dir)
+		} else {
+			args = append(args, "--ro-bind", dir, dir)
+		}
+	}
+	for _, path := range scriptHostConfig {
+		args = append(args, "--ro-bind-try", path, path)
+	}
+	args = append(args,
+		"--proc", "/proc",
+		"--dev", "/dev",
+		"--tmpfs", "/tmp",
+		"--ro-bind", s.Dir, scriptRecipeDir,
+		"--bind", workDir, scriptWorkDir,
+		"--chdir", scriptWorkDir,
+		"--setenv", "PATH", "/usr/bin:/bin:/usr/sbin:/sbin",
+		"--setenv", "HOME", scriptWorkDir,
+		"--setenv", "TMPDIR", "/tmp",
+		"--setenv", "RECIPE_DIR", scriptRecipeDir,
+		"--setenv", "OUTPUT", filepath.Join(scriptWorkDir, s.File),
+	)
+	for _, name := range scriptProxyEnv {
+		if value := os.Getenv(name); value != "" {
+			args = append(args, "--setenv", name, value)
+		}
+	}
+	return append(args, "/bin/sh", "-e", filepath.Join(scriptRecipeDir, s.Script))
+}
+
+// Fetch will run the script in a sandbox, and then copy the file it
+// produced into the hash based cache once validated.
+func (s *ScriptSource) Fetch(network Network) error {
+	if s.Dir == "" {
+		return fmt.Errorf("Fetch script %s has no recipe directory", s.Script)
+	}
+	if !PathExists(filepath.Join(s.Dir, s.Script)) {
+		return fmt.Errorf("Fetch script %s not found in %s", s.Script, s.Dir)
+	}
+	log.Debugf("Running fetch script %s for %s\n", s.Script, s.File)
+
+	workDir := filepath.Join(SourceStagingDir, "script-"+s.validator)
+	os.RemoveAll(workDir)
+	if err := os.MkdirAll(workDir, 00755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := commands.ExecStdoutArgs("bwrap", s.sandboxArgs(workDir)); err != nil {
+		return fmt.Errorf("Failed to run fetch script %s, reason: %s", s.Script, err)
+	}
+	hash, dest, err := storeScriptOutput(filepath.Join(workDir, s.File), s.File)
+	if err != nil {
+		return fmt.Errorf("Fetch script %s did not produce %s, reason: %s", s.Script, s.File, err)
+	}
+	if hash != s.validator {
+		os.RemoveAll(filepath.Dir(dest))
+		return fmt.Errorf("Hash mismatch for fetch script output %s, expected %s got %s", s.File, s.validator, hash)
+	}
+	return nil
+}
+
+// storeScriptOutput will copy the file produced by a fetch script into the
+// hash based cache. The script controls its working directory, so anything
+// but a plain file of its own, such as a symlink or a hard link to a file of
+// the host, is refused, and the file is copied rather than moved.
+func storeScriptOutput(output, file string) (string, string, error) {
+	in, err := os.OpenFile(output, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return "", "", err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if !st.Mode().IsRegular() {
+		return "", "", fmt.Errorf("%s is not a regular file", file)
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok && sys.Nlink != 1 {
+		return "", "", fmt.Errorf("%s has other links", file)
+	}
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+
+	tgtDir := filepath.Join(SourceDir, hash)
+	if err := os.MkdirAll(tgtDir, 00755); err != nil {
+		return "", "", err
+	}
+	dest := filepath.Join(tgtDir, file)
+	if err := ioutil.WriteFile(dest, b, 00644); err != nil {
+		return "", "", err
+	}
+	return hash, dest, nil
+}
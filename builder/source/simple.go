@@ -113,12 +113,21 @@ func (s *SimpleSource) IsFetched() bool {
 }
 
 // download utilises CURL to do all downloads
-func (s *SimpleSource) download(destination string) error {
+func (s *SimpleSource) download(destination string, network Network) error {
+	return downloadURI(s.URI, destination, network)
+}
+
+// downloadURI will download the given URI to the destination with CURL
+func downloadURI(uri, destination string, network Network) error {
 	hnd := curl.EasyInit()
 	defer hnd.Cleanup()
 
-	hnd.Setopt(curl.OPT_URL, s.URI)
+	hnd.Setopt(curl.OPT_URL, uri)
 	hnd.Setopt(curl.OPT_FOLLOWLOCATION, 1)
+	hnd.Setopt(curl.OPT_IPRESOLVE, network.curlIPResolve())
+	if MaxDownloadRate > 0 {
+		hnd.Setopt(curl.OPT_MAX_RECV_SPEED_LARGE, int(MaxDownloadRate))
+	}
 
 	out, err := os.Create(destination)
 	if err != nil {
@@ -159,7 +168,7 @@ func (s *SimpleSource) download(destination string) error {
 }
 
 // Fetch will download the given source and cache it locally
-func (s *SimpleSource) Fetch() error {
+func (s *SimpleSource) Fetch(network Network) error {
 	// Now go and download it
 	log.Debugf("Downloading source %s\n", s.URI)
 
@@ -173,27 +182,20 @@ func (s *SimpleSource) Fetch() error {
 	}
 
 	// Grab the file
-	if err := s.download(destPath); err != nil {
+	if err := s.download(destPath, network); err != nil {
 		return err
 	}
 
-	hash, err := s.GetSHA256Sum(destPath)
+	hash, dest, err := storeStaged(destPath, s.File)
 	if err != nil {
 		return err
 	}
-
-	// Make the target directory
-	tgtDir := filepath.Join(SourceDir, hash)
-	if !PathExists(tgtDir) {
-		if err := os.MkdirAll(tgtDir, 00755); err != nil {
+	if ConsensusRequired > 1 {
+		if err := s.verifyConsensus(hash, dest, network); err != nil {
+			os.RemoveAll(filepath.Dir(dest))
 			return err
 		}
 	}
-	// Move from staging into hash based directory
-	dest := filepath.Join(tgtDir, s.File)
-	if err := os.Rename(destPath, dest); err != nil {
-		return err
-	}
 	// If the file has a sha1sum set, symlink it to the sha256sum because
 	// it's a legacy archive (pspec.xml)
 	if s.legacy {
@@ -208,3 +210,28 @@ func (s *SimpleSource) Fetch() error {
 	}
 	return nil
 }
+
+// storeStaged will move a fully downloaded file from the staging area into
+// the sha256sum based source directory, returning the hash and final path.
+func storeStaged(stagedPath, file string) (string, string, error) {
+	inp, err := ioutil.ReadFile(stagedPath)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(inp)
+	hash := hex.EncodeToString(sum[:])
+
+	// Make the target directory
+	tgtDir := filepath.Join(SourceDir, hash)
+	if !PathExists(tgtDir) {
+		if err := os.MkdirAll(tgtDir, 00755); err != nil {
+			return "", "", err
+		}
+	}
+	// Move from staging into hash based directory
+	dest := filepath.Join(tgtDir, file)
+	if err := os.Rename(stagedPath, dest); err != nil {
+		return "", "", err
+	}
+	return hash, dest, nil
+}
@@ -0,0 +1,126 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package source
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// ErrTorrentNoName is returned when a magnet link has no way to determine
+	// the name of the file it provides.
+	ErrTorrentNoName = errors.New("Magnet link requires a dn= parameter or #filename fragment")
+)
+
+// A TorrentSource is a file distributed over BitTorrent, referenced in the
+// package spec by a magnet: link. Downloading is delegated to aria2c, and the
+// resulting file must match the declared sha256sum.
+type TorrentSource struct {
+	URI  string
+	File string // Basename of the file
+
+	validator string // Expected sha256sum
+}
+
+// NewTorrent will create a new TorrentSource for the given magnet link
+func NewTorrent(uri, validator string) (*TorrentSource, error) {
+	uriObj, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	fileName := uriObj.Query().Get("dn")
+	// support URI fragments for renaming sources
+	if uriObj.Fragment != "" {
+		fileName = uriObj.Fragment
+		uriObj.Fragment = ""
+	}
+	if fileName == "" {
+		return nil, ErrTorrentNoName
+	}
+	return &TorrentSource{
+		URI:       uriObj.String(),
+		File:      filepath.Base(fileName),
+		validator: validator,
+	}, nil
+}
+
+// GetIdentifier will return the magnet link for this source
+func (t *TorrentSource) GetIdentifier() string {
+	return t.URI
+}
+
+// GetPath gets the path on the filesystem of the source
+func (t *TorrentSource) GetPath(hash string) string {
+	return filepath.Join(SourceDir, hash, t.File)
+}
+
+// GetBindConfiguration will return the pair for binding the cached file
+func (t *TorrentSource) GetBindConfiguration(rootfs string) BindConfiguration {
+	return BindConfiguration{
+		BindSource: t.GetPath(t.validator),
+		BindTarget: filepath.Join(rootfs, t.File),
+	}
+}
+
+// IsFetched will determine if the source is already present
+func (t *TorrentSource) IsFetched() bool {
+	return PathExists(t.GetPath(t.validator))
+}
+
+// Fetch will download the torrent payload into staging, and then move it
+// into the hash based cache once validated.
+func (t *TorrentSource) Fetch(network Network) error {
+	log.Debugf("Downloading torrent source %s\n", t.URI)
+
+	stageDir := filepath.Join(SourceStagingDir, "torrent-"+t.validator)
+	if err := os.MkdirAll(stageDir, 00755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+
+	args := []string{
+		"--seed-time=0",
+		"--follow-torrent=mem",
+		"--bt-save-metadata=false",
+		"--dir=" + stageDir,
+		"--out=" + t.File,
+		t.URI,
+	}
+	// aria2c can only disable IPv6
+	if network.Family == FamilyIPv4 {
+		args = append([]string{"--disable-ipv6=true"}, args...)
+	}
+	if err := commands.ExecStdoutArgs("aria2c", args); err != nil {
+		return fmt.Errorf("Failed to download torrent, reason: %s", err)
+	}
+
+	hash, dest, err := storeStaged(filepath.Join(stageDir, t.File), t.File)
+	if err != nil {
+		return err
+	}
+	if hash != t.validator {
+		os.RemoveAll(filepath.Dir(dest))
+		return fmt.Errorf("Hash mismatch for torrent source %s, expected %s got %s", t.File, t.validator, hash)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"github.com/getsolus/libosdev/disk"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// ImageFormatExt4 keeps images extracted as an ext4 filesystem
+	ImageFormatExt4 = "ext4"
+
+	// ImageFormatSquashfs keeps images as a compressed, read-only squashfs
+	ImageFormatSquashfs = "squashfs"
+)
+
+var (
+	// ErrUnknownImageFormat is returned for an unknown image_format
+	ErrUnknownImageFormat = errors.New("Unknown image format, use ext4 or squashfs")
+)
+
+// ValidImageFormat will determine whether the image format is known
+func ValidImageFormat(format string) error {
+	switch format {
+	case "", ImageFormatExt4, ImageFormatSquashfs:
+		return nil
+	default:
+		return ErrUnknownImageFormat
+	}
+}
+
+// useSquashfs will switch the image over to its squashfs
+func (b *BackingImage) useSquashfs() {
+	b.ImagePath = b.ImagePathSquashfs
+	b.Squashfs = true
+}
+
+// mksquashfs will pack the directory into the squashfs of the image,
+// replacing any existing squashfs only once complete.
+func (b *BackingImage) mksquashfs(dir string) error {
+	tmp := b.ImagePathSquashfs + ".new"
+	log.Debugf("Packing squashfs: source='%s' target='%s'\n", dir, tmp)
+	if err := commands.ExecStdoutArgs("mksquashfs", []string{dir, tmp, "-noappend", "-comp", "zstd", "-quiet"}); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed to pack squashfs %s, reason: %s\n", tmp, err)
+	}
+	return os.Rename(tmp, b.ImagePathSquashfs)
+}
+
+// ConvertSquashfs will repack the extracted image as a squashfs, removing
+// the extracted image once done.
+func (b *BackingImage) ConvertSquashfs() error {
+	dir, err := ioutil.TempDir(ImagesDir, b.Name+".convert")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	mountMan := disk.GetMountManager()
+	if err := mountMan.Mount(b.ImagePathExt4, dir, "auto", "ro", "loop"); err != nil {
+		return fmt.Errorf("Failed to mount image %s, reason: %s\n", b.ImagePathExt4, err)
+	}
+	log.Infof("Converting %s to squashfs\n", b.ImagePathExt4)
+	err = b.mksquashfs(dir)
+	if uerr := mountMan.Unmount(dir); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return err
+	}
+	b.useSquashfs()
+	return os.Remove(b.ImagePathExt4)
+}
+
+// updateLayers returns the directories of the writable layer that updates
+// to a squashfs image are made in.
+func (b *BackingImage) updateLayers() (lower, upper, work string) {
+	return b.RootDir + ".lower", b.RootDir + ".upper", b.RootDir + ".work"
+}
+
+// mountRoot will mount the image at the root directory for updates. As a
+// squashfs can't be written to, it is covered with a writable overlay that
+// is packed into a new squashfs by Repack.
+func (b *BackingImage) mountRoot() error {
+	mountMan := disk.GetMountManager()
+	if !b.Squashfs {
+		return mountMan.Mount(b.ImagePath, b.RootDir, "auto", "loop")
+	}
+	lower, upper, work := b.updateLayers()
+	b.CleanLayers()
+	for _, dir := range []string{lower, upper, work} {
+		if err := os.MkdirAll(dir, 00755); err != nil {
+			return err
+		}
+	}
+	if err := mountMan.Mount(b.ImagePath, lower, "auto", "ro", "loop"); err != nil {
+		return err
+	}
+	return mountMan.Mount("overlay", b.RootDir, "overlay",
+		fmt.Sprintf("lowerdir=%s", lower),
+		fmt.Sprintf("upperdir=%s", upper),
+		fmt.Sprintf("workdir=%s", work))
+}
+
+// Repack will pack the updated root of a squashfs image into its squashfs.
+// The package manager must have been cleaned up beforehand, so that none
+// of its mounts are packed along with it.
+func (b *BackingImage) Repack() error {
+	if err := disk.GetMountManager().Unmount(filepath.Join(b.RootDir, "proc")); err != nil {
+		return err
+	}
+	log.Infof("Repacking squashfs image %s\n", b.ImagePath)
+	return b.mksquashfs(b.RootDir)
+}
+
+// CleanLayers will remove the writable layer of an update to a squashfs
+// image, which is left alone while the overlay is still mounted.
+func (b *BackingImage) CleanLayers() {
+	lower, upper, work := b.updateLayers()
+	for _, point := range []string{b.RootDir, lower} {
+		if isMountPoint(point) {
+			log.Warnf("Not removing the update layers of %s while %s is mounted\n", b.Name, point)
+			return
+		}
+	}
+	os.RemoveAll(upper)
+	os.RemoveAll(work)
+}
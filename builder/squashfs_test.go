@@ -0,0 +1,74 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestValidImageFormat(t *testing.T) {
+	for _, format := range []string{"", ImageFormatExt4, ImageFormatSquashfs} {
+		if err := ValidImageFormat(format); err != nil {
+			t.Errorf("Image format '%s' should be valid, got: %s", format, err)
+		}
+	}
+	if err := ValidImageFormat("erofs"); err != ErrUnknownImageFormat {
+		t.Errorf("Expected ErrUnknownImageFormat, got: %v", err)
+	}
+}
+
+func TestSquashfsImage(t *testing.T) {
+	b := NewBackingImage("nonexistent-x86_64")
+	if b.Squashfs || b.ImagePath != b.ImagePathExt4 {
+		t.Fatalf("Image without a squashfs should use the extracted image, got: %s", b.ImagePath)
+	}
+	b.useSquashfs()
+	if !b.Squashfs || b.ImagePath != ImagesDir+"/nonexistent-x86_64"+ImageSquashfsSuffix {
+		t.Fatalf("Image should use its squashfs, got: %s", b.ImagePath)
+	}
+	for _, path := range []string{b.ImagePathExt4, b.ImagePathSquashfs} {
+		if base := imageBase(path); base != ImagesDir+"/nonexistent-x86_64" {
+			t.Errorf("Incorrect base of %s: %s", path, base)
+		}
+	}
+}
+
+func TestCleanLayersMounted(t *testing.T) {
+	b := &BackingImage{Name: "main-x86_64", RootDir: filepath.Join(t.TempDir(), "main-x86_64")}
+	_, upper, work := b.updateLayers()
+	for _, dir := range []string{b.RootDir, upper, work} {
+		if err := os.MkdirAll(dir, 00755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mount("tmpfs", b.RootDir, "tmpfs", 0, ""); err != nil {
+		t.Skipf("Unable to mount: %s", err)
+	}
+	b.CleanLayers()
+	mounted := PathExists(upper)
+	syscall.Unmount(b.RootDir, 0)
+	if !mounted {
+		t.Fatalf("Layers shouldn't be removed while the overlay is mounted")
+	}
+	b.CleanLayers()
+	if PathExists(upper) || PathExists(work) {
+		t.Fatalf("Layers should be removed once the overlay is unmounted")
+	}
+}
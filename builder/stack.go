@@ -0,0 +1,385 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoRecipes is returned when no recipes are found for a stack
+	ErrNoRecipes = errors.New("No package.yml recipes found")
+
+	// ErrNoFeedRepo is returned when a stack has no local repo to feed
+	ErrNoFeedRepo = errors.New("Building a stack requires a local repo in the profile to feed the results into")
+
+	// stackSubpackages are the subpackages ypkg may emit for any recipe
+	stackSubpackages = []string{"devel", "dbginfo", "docs", "32bit", "32bit-devel", "32bit-dbginfo"}
+)
+
+// A StackRecipe is a single recipe within a BuildStack
+type StackRecipe struct {
+	Path      string   // Location of the recipe
+	Name      string   // Name of the source package
+	Provides  []string // Names of the packages, and pkgconfig(...) names, the recipe may produce
+	BuildDeps []string // Build dependencies, as written in the recipe
+
+	after []*StackRecipe // Recipes which must be built first
+}
+
+// A BuildStack is a set of recipes to be built in dependency order
+type BuildStack struct {
+	Recipes []*StackRecipe
+}
+
+// stackStrings will flatten a yaml list of names, or of single key maps from
+// a subpackage to its names, into the names alone.
+func stackStrings(value interface{}) (names []string, keys []string) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			names = append(names, v)
+		case map[interface{}]interface{}:
+			for key, inner := range v {
+				keys = append(keys, fmt.Sprint(key))
+				switch deps := inner.(type) {
+				case string:
+					names = append(names, deps)
+				case []interface{}:
+					for _, dep := range deps {
+						names = append(names, fmt.Sprint(dep))
+					}
+				}
+			}
+		}
+	}
+	return names, keys
+}
+
+// NewStackRecipe will read the name, dependencies and produced packages of
+// the recipe. Legacy pspec.xml recipes are included without dependencies.
+func NewStackRecipe(path string) (*StackRecipe, error) {
+	pkg, err := NewPackage(path)
+	if err != nil {
+		return nil, err
+	}
+	recipe := &StackRecipe{Path: path, Name: pkg.Name, Provides: []string{pkg.Name}}
+	for _, sub := range stackSubpackages {
+		recipe.Provides = append(recipe.Provides, pkg.Name+"-"+sub)
+	}
+	if pkg.Type != PackageTypeYpkg {
+		log.Debugf("Assuming legacy recipe %s has no dependencies\n", path)
+		return recipe, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	recipe.BuildDeps, _ = stackStrings(doc["builddeps"])
+	if err := recipe.readPspecProvides(); err != nil {
+		return nil, fmt.Errorf("Failed to read the pspec of %s, reason: %s", pkg.Name, err)
+	}
+	_, patterns := stackStrings(doc["patterns"])
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "^") {
+			recipe.Provides = append(recipe.Provides, pattern[1:])
+		} else {
+			recipe.Provides = append(recipe.Provides, pkg.Name+"-"+pattern)
+		}
+	}
+	return recipe, nil
+}
+
+// findRecipes will return every package.yml beneath the directory, skipping
+// hidden directories.
+func findRecipes(dir string) ([]string, error) {
+	var recipes []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && info.Name() == "package.yml" {
+			recipes = append(recipes, path)
+		}
+		return nil
+	})
+	return recipes, err
+}
+
+// NewBuildStack will load the given recipes, and every package.yml found
+// beneath the given directories.
+func NewBuildStack(paths []string) (*BuildStack, error) {
+	stack := &BuildStack{}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		recipes := []string{path}
+		if st, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if st.IsDir() {
+			if recipes, err = findRecipes(path); err != nil {
+				return nil, err
+			}
+		}
+		for _, recipePath := range recipes {
+			abs, err := filepath.Abs(recipePath)
+			if err != nil {
+				return nil, err
+			}
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			recipe, err := NewStackRecipe(abs)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to load %s, reason: %s", recipePath, err)
+			}
+			stack.Recipes = append(stack.Recipes, recipe)
+		}
+	}
+	if len(stack.Recipes) == 0 {
+		return nil, ErrNoRecipes
+	}
+	return stack, nil
+}
+
+// readPspecProvides will add the packages and pkgconfig names recorded in
+// the pspec_x86_64.xml committed beside the recipe by its last build, as
+// pkgconfig names are only known once ypkg has built the recipe. A recipe
+// that was never built provides no pkgconfig names.
+func (r *StackRecipe) readPspecProvides() error {
+	b, err := ioutil.ReadFile(filepath.Join(filepath.Dir(r.Path), "pspec_x86_64.xml"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var pspec struct {
+		Package []struct {
+			Name     string
+			Provides struct {
+				PkgConfig   []string
+				PkgConfig32 []string
+			}
+		}
+	}
+	if err := xml.Unmarshal(b, &pspec); err != nil {
+		return err
+	}
+	for _, pkg := range pspec.Package {
+		if pkg.Name != "" {
+			r.Provides = append(r.Provides, pkg.Name)
+		}
+		for _, name := range pkg.Provides.PkgConfig {
+			r.Provides = append(r.Provides, "pkgconfig("+name+")")
+		}
+		for _, name := range pkg.Provides.PkgConfig32 {
+			r.Provides = append(r.Provides, "pkgconfig32("+name+")")
+		}
+	}
+	return nil
+}
+
+// link will determine which recipes of the stack each recipe depends on.
+// Only build dependencies order the stack, as runtime dependencies needn't
+// be built first.
+func (s *BuildStack) link() {
+	providers := make(map[string]*StackRecipe)
+	for _, recipe := range s.Recipes {
+		for _, name := range recipe.Provides {
+			providers[name] = recipe
+		}
+	}
+	for _, recipe := range s.Recipes {
+		recipe.after = nil
+		added := make(map[*StackRecipe]bool)
+		for _, dep := range recipe.BuildDeps {
+			provider, ok := providers[dep]
+			if !ok || provider == recipe || added[provider] {
+				continue
+			}
+			added[provider] = true
+			recipe.after = append(recipe.after, provider)
+		}
+	}
+}
+
+// Order will return the recipes such that every recipe follows those that
+// provide its dependencies. Independent recipes are ordered by name.
+func (s *BuildStack) Order() ([]*StackRecipe, error) {
+	s.link()
+	pending := make(map[*StackRecipe]int)
+	dependents := make(map[*StackRecipe][]*StackRecipe)
+	for _, recipe := range s.Recipes {
+		pending[recipe] = len(recipe.after)
+		for _, dep := range recipe.after {
+			dependents[dep] = append(dependents[dep], recipe)
+		}
+	}
+
+	var ready, order []*StackRecipe
+	for _, recipe := range s.Recipes {
+		if pending[recipe] == 0 {
+			ready = append(ready, recipe)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			return ready[i].Name < ready[j].Name
+		})
+		next := ready[0]
+		ready = ready[1:]
+		order = append(order, next)
+		for _, dependent := range dependents[next] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(order) != len(s.Recipes) {
+		var cycle []string
+		for _, recipe := range s.Recipes {
+			if pending[recipe] > 0 {
+				cycle = append(cycle, recipe.Name)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("Dependency cycle prevents ordering %s", strings.Join(cycle, ", "))
+	}
+	return order, nil
+}
+
+// FeedRepo will return the local repo of the profile that built packages are
+// fed into, either the one named or the only local repo added to builds.
+func (p *Profile) FeedRepo(name string) (*Repo, error) {
+	var local []*Repo
+	for _, repo := range p.reposToAdd() {
+		if !repo.Local {
+			continue
+		}
+		if repo.Name == name {
+			return repo, nil
+		}
+		local = append(local, repo)
+	}
+	switch {
+	case name != "":
+		return nil, fmt.Errorf("Profile %s doesn't add a local repo named %s", p.Name, name)
+	case len(local) == 1:
+		return local[0], nil
+	case len(local) > 1:
+		return nil, fmt.Errorf("Profile %s adds several local repos, choose one with --repo", p.Name)
+	default:
+		return nil, ErrNoFeedRepo
+	}
+}
+
+// A StackResult is the outcome of building one recipe of a stack
+type StackResult struct {
+	Recipe   *StackRecipe
+	Err      error         // Why the build failed, if it did
+	Skipped  bool          // Whether the build was skipped, as a dependency failed
+	Duration time.Duration // How long the build took
+}
+
+// Build will call build for every recipe of the stack, once each recipe it
+// depends on has been built, running up to jobs builds at once. Recipes that
+// depend on a failed build are skipped, while independent recipes carry on.
+// The results are returned in dependency order.
+func (s *BuildStack) Build(jobs int, build func(*StackRecipe) error) ([]*StackResult, error) {
+	order, err := s.Order()
+	if err != nil {
+		return nil, err
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	started := make(map[*StackRecipe]bool)
+	results := make(map[*StackRecipe]*StackResult)
+	done := make(chan *StackResult)
+	running := 0
+	for len(results) < len(order) {
+		// Start the first recipes in order whose dependencies are built
+		for _, recipe := range order {
+			if running >= jobs {
+				break
+			}
+			if started[recipe] {
+				continue
+			}
+			ready, skip := true, false
+			for _, dep := range recipe.after {
+				result, ok := results[dep]
+				switch {
+				case !ok:
+					ready = false
+				case result.Err != nil || result.Skipped:
+					skip = true
+				}
+			}
+			switch {
+			case skip:
+				started[recipe] = true
+				results[recipe] = &StackResult{Recipe: recipe, Skipped: true}
+			case ready:
+				started[recipe] = true
+				running++
+				go func(recipe *StackRecipe) {
+					start := time.Now()
+					err := build(recipe)
+					done <- &StackResult{Recipe: recipe, Err: err, Duration: time.Since(start)}
+				}(recipe)
+			}
+		}
+		if running == 0 {
+			continue
+		}
+		result := <-done
+		results[result.Recipe] = result
+		running--
+	}
+
+	var ordered []*StackResult
+	for _, recipe := range order {
+		ordered = append(ordered, results[recipe])
+	}
+	return ordered, nil
+}
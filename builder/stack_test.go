@@ -0,0 +1,155 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeStackRecipe(t *testing.T, dir, name, deps string) {
+	recipe := "name: " + name + "\nversion: 1.0\nrelease: 1\n" + deps
+	writeTestFile(t, filepath.Join(dir, name, "package.yml"), recipe)
+}
+
+func writeStackPspec(t *testing.T, dir, name string, pkgconfig ...string) {
+	provides := ""
+	for _, pc := range pkgconfig {
+		provides += "<PkgConfig>" + pc + "</PkgConfig>"
+	}
+	pspec := "<PISI><Package><Name>" + name + "</Name></Package><Package><Name>" + name + "-devel</Name><Provides>" + provides + "</Provides></Package></PISI>"
+	writeTestFile(t, filepath.Join(dir, name, "pspec_x86_64.xml"), pspec)
+}
+
+func stackNames(recipes []*StackRecipe) string {
+	var names []string
+	for _, recipe := range recipes {
+		names = append(names, recipe.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestBuildStackOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeStackRecipe(t, dir, "gtk3", "builddeps:\n  - pkgconfig(gio-2.0)\n  - libepoxy-devel\n")
+	writeStackRecipe(t, dir, "glib2", "")
+	writeStackPspec(t, dir, "glib2", "glib-2.0", "gio-2.0")
+	writeStackRecipe(t, dir, "epoxy", "patterns:\n  - ^libepoxy-devel: [/usr/include]\n")
+	writeStackRecipe(t, dir, "zenity", "rundeps:\n  - aalib\n")
+	writeStackRecipe(t, dir, "aalib", "builddeps:\n  - ncurses-devel\n  - pkgconfig(zenity)\n")
+	writeTestFile(t, filepath.Join(dir, ".git", "package.yml"), "name: hidden\n")
+
+	stack, err := NewBuildStack([]string{dir, filepath.Join(dir, "gtk3", "package.yml")})
+	if err != nil {
+		t.Fatalf("Failed to load stack: %s", err)
+	}
+	if len(stack.Recipes) != 5 {
+		t.Fatalf("Expected 5 recipes, found %d", len(stack.Recipes))
+	}
+	order, err := stack.Order()
+	if err != nil {
+		t.Fatalf("Failed to order stack: %s", err)
+	}
+	// Runtime dependencies, and pkgconfig names no recipe provides, don't
+	// order the stack
+	if names := stackNames(order); names != "aalib epoxy glib2 gtk3 zenity" {
+		t.Fatalf("Unexpected order: %s", names)
+	}
+}
+
+func TestBuildStackCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeStackRecipe(t, dir, "freetype", "builddeps:\n  - harfbuzz-devel\n")
+	writeStackRecipe(t, dir, "harfbuzz", "builddeps:\n  - pkgconfig(freetype2)\n")
+	writeStackPspec(t, dir, "freetype", "freetype2")
+	writeStackRecipe(t, dir, "zlib", "")
+
+	stack, err := NewBuildStack([]string{dir})
+	if err != nil {
+		t.Fatalf("Failed to load stack: %s", err)
+	}
+	if _, err = stack.Order(); err == nil {
+		t.Fatalf("Expected a dependency cycle")
+	} else if !strings.Contains(err.Error(), "freetype, harfbuzz") || strings.Contains(err.Error(), "zlib") {
+		t.Fatalf("Unexpected cycle error: %s", err)
+	}
+}
+
+func TestBuildStackParallel(t *testing.T) {
+	dir := t.TempDir()
+	writeStackRecipe(t, dir, "glibc", "")
+	writeStackRecipe(t, dir, "gcc", "builddeps:\n  - glibc-devel\n")
+	writeStackRecipe(t, dir, "binutils", "builddeps:\n  - glibc-devel\n")
+	writeStackRecipe(t, dir, "gdb", "builddeps:\n  - binutils-devel\n")
+	writeStackRecipe(t, dir, "nano", "")
+
+	stack, err := NewBuildStack([]string{dir})
+	if err != nil {
+		t.Fatalf("Failed to load stack: %s", err)
+	}
+	var lock sync.Mutex
+	running, peak := 0, 0
+	built := make(map[string]bool)
+	results, err := stack.Build(2, func(recipe *StackRecipe) error {
+		lock.Lock()
+		for _, dep := range recipe.after {
+			if !built[dep.Name] {
+				t.Errorf("%s started before %s was built", recipe.Name, dep.Name)
+			}
+		}
+		if running++; running > peak {
+			peak = running
+		}
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		running--
+		built[recipe.Name] = true
+		lock.Unlock()
+		if recipe.Name == "binutils" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to build stack: %s", err)
+	}
+	if peak != 2 {
+		t.Fatalf("Expected 2 builds at once, found %d", peak)
+	}
+	outcome := make(map[string]string)
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			outcome[result.Recipe.Name] = "skipped"
+		case result.Err != nil:
+			outcome[result.Recipe.Name] = "failed"
+		default:
+			outcome[result.Recipe.Name] = "built"
+		}
+	}
+	expected := map[string]string{"glibc": "built", "gcc": "built", "binutils": "failed", "gdb": "skipped", "nano": "built"}
+	for name, state := range expected {
+		if outcome[name] != state {
+			t.Fatalf("Expected %s to be %s, was %s", name, state, outcome[name])
+		}
+	}
+}
@@ -0,0 +1,225 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder/source"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// BuildStampSuffix is the extension of the stamp written beside the packages
+// of every successful build
+const BuildStampSuffix = ".stamp"
+
+var (
+	// IfChanged skips the build when its stamp shows nothing relevant has
+	// changed since the packages were built.
+	IfChanged bool
+
+	// ErrUpToDate is returned instead of building when IfChanged is set and
+	// the packages are already up to date.
+	ErrUpToDate = errors.New("Packages are up to date")
+)
+
+// stampInputs are the parts of a build compared by its stamp, in the order
+// they're reported.
+var stampInputs = []string{"recipe", "files", "sources", "profile", "image"}
+
+// A BuildStamp records the digests of everything a build depends upon, and
+// the files it produced, so unnecessary rebuilds can be skipped and its
+// artifacts cleaned up later.
+type BuildStamp struct {
+	Name     string            `json:"name"`
+	Version  string            `json:"version"`
+	Release  int               `json:"release"`
+	Inputs   map[string]string `json:"inputs"`
+	Packages []string          `json:"packages"`
+	Files    []string          `json:"files"` // Every file collected, packages included
+}
+
+// digestStrings will hash the lines given
+func digestStrings(lines ...string) string {
+	h := sha256.New()
+	for _, line := range lines {
+		fmt.Fprintln(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestRecipeFiles will hash the files the recipe uses beside it, i.e. the
+// patches of files/ and the actions.py of a pspec.xml. Anything else in the
+// recipe directory may well be the output of a previous build.
+func digestRecipeFiles(dir string) (string, error) {
+	h := sha256.New()
+	var paths []string
+	if PathExists(filepath.Join(dir, "actions.py")) {
+		paths = append(paths, filepath.Join(dir, "actions.py"))
+	}
+	err := filepath.Walk(filepath.Join(dir, "files"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		rel, _ := filepath.Rel(dir, path)
+		sum, err := FileSha256sum(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", sum, rel)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// NewBuildStamp will digest the recipe, its files and sources, the profile,
+// and the version of the backing image the package would be built with.
+func NewBuildStamp(profile *Profile, image *BackingImage, pkg *Package) (*BuildStamp, error) {
+	recipe, err := FileSha256sum(pkg.Path)
+	if err != nil {
+		return nil, err
+	}
+	files, err := digestRecipeFiles(filepath.Dir(pkg.Path))
+	if err != nil {
+		return nil, err
+	}
+	var sources []string
+	for _, s := range pkg.Sources {
+		sources = append(sources, s.GetIdentifier()+" "+source.Digest(s))
+	}
+	h := sha256.New()
+	fmt.Fprintln(h, profile.Name)
+	if err := toml.NewEncoder(h).Encode(profile); err != nil {
+		return nil, err
+	}
+	// The image is replaced whenever it is updated, so its modification
+	// time serves as its version without hashing the whole image.
+	st, err := os.Stat(image.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	return &BuildStamp{
+		Name:    pkg.Name,
+		Version: pkg.Version,
+		Release: pkg.Release,
+		Inputs: map[string]string{
+			"recipe":  recipe,
+			"files":   files,
+			"sources": digestStrings(sources...),
+			"profile": hex.EncodeToString(h.Sum(nil)),
+			"image":   digestStrings(image.Name, st.ModTime().UTC().String(), fmt.Sprint(st.Size())),
+		},
+	}, nil
+}
+
+// LoadBuildStamp will read a previously written stamp
+func LoadBuildStamp(path string) (*BuildStamp, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	stamp := &BuildStamp{}
+	if err := json.Unmarshal(b, stamp); err != nil {
+		return nil, err
+	}
+	return stamp, nil
+}
+
+// Write will store the stamp at the given path
+func (s *BuildStamp) Write(path string) error {
+	b, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 00644)
+}
+
+// Changed will list the inputs that differ from the previous stamp
+func (s *BuildStamp) Changed(previous *BuildStamp) []string {
+	var changed []string
+	for _, input := range stampInputs {
+		if s.Inputs[input] != previous.Inputs[input] {
+			changed = append(changed, input)
+		}
+	}
+	return changed
+}
+
+// GetBuildStampPath returns the path of the stamp for the package in dir
+func GetBuildStampPath(pkg *Package, dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s-%d%s", pkg.Name, pkg.Version, pkg.Release, BuildStampSuffix))
+}
+
+// upToDate determines whether the packages in dir were built from the same
+// inputs as the stamp, and are all still present.
+func (s *BuildStamp) upToDate(pkg *Package, dir string) bool {
+	previous, err := LoadBuildStamp(GetBuildStampPath(pkg, dir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Ignoring unreadable build stamp, reason: %s\n", err)
+		}
+		log.Infof("Building %s, it has no build stamp\n", pkg.Name)
+		return false
+	}
+	if changed := s.Changed(previous); len(changed) > 0 {
+		log.Infof("Building %s, changed since the last build: %v\n", pkg.Name, changed)
+		return false
+	}
+	if len(previous.Packages) == 0 {
+		log.Infof("Building %s, its stamp records no packages\n", pkg.Name)
+		return false
+	}
+	for _, name := range previous.Packages {
+		if !PathExists(filepath.Join(dir, name)) {
+			log.Infof("Building %s, %s is missing\n", pkg.Name, name)
+			return false
+		}
+	}
+	return true
+}
+
+// record will write the stamp beside the collected packages
+func (s *BuildStamp) record(pkg *Package, usr *UserInfo) error {
+	s.Packages = pkg.collected
+	s.Files = pkg.outputs
+	path := GetBuildStampPath(pkg, ".")
+	if err := s.Write(path); err != nil {
+		return err
+	}
+	if err := os.Chown(path, usr.UID, usr.GID); err != nil {
+		log.Errorf("Error in restoring file ownership %s, reason: %s\n", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildStamp(t *testing.T) {
+	dir := t.TempDir()
+	recipe := filepath.Join(dir, "nano", "package.yml")
+	writeTestFile(t, recipe, "name: nano\n")
+	writeTestFile(t, filepath.Join(dir, "nano", "files", "fix.patch"), "patch\n")
+	writeTestFile(t, filepath.Join(dir, "nano", "abi_symbols"), "output\n")
+	image := &BackingImage{Name: "main-x86_64", ImagePath: filepath.Join(dir, "main-x86_64.img")}
+	writeTestFile(t, image.ImagePath, "image")
+	profile := &Profile{Name: "main-x86_64", Image: "main-x86_64"}
+	pkg := &Package{Name: "nano", Version: "5.0", Release: 1, Path: recipe}
+
+	stamp, err := NewBuildStamp(profile, image, pkg)
+	if err != nil {
+		t.Fatalf("Failed to stamp the build: %s", err)
+	}
+	out := filepath.Join(dir, "out")
+	writeTestFile(t, filepath.Join(out, "nano-5.0-1-1-x86_64.eopkg"), "package")
+	stamp.Packages = []string{"nano-5.0-1-1-x86_64.eopkg"}
+	if err := stamp.Write(GetBuildStampPath(pkg, out)); err != nil {
+		t.Fatalf("Failed to write the stamp: %s", err)
+	}
+	if !stamp.upToDate(pkg, out) {
+		t.Fatalf("Unchanged build should be up to date")
+	}
+
+	// Outputs of a previous build in the recipe directory don't count
+	writeTestFile(t, filepath.Join(dir, "nano", "abi_symbols"), "changed\n")
+	writeTestFile(t, filepath.Join(dir, "nano", "files", "fix.patch"), "changed\n")
+	profile.Repos = map[string]*Repo{"Local": {URI: "/var/lib/solbuild/local"}}
+	changed, err := NewBuildStamp(profile, image, pkg)
+	if err != nil {
+		t.Fatalf("Failed to stamp the build: %s", err)
+	}
+	if diff := changed.Changed(stamp); !reflect.DeepEqual(diff, []string{"files", "profile"}) {
+		t.Fatalf("Expected files and profile to change, got %v", diff)
+	}
+	if changed.upToDate(pkg, out) {
+		t.Fatalf("Changed build should not be up to date")
+	}
+
+	stamp.Packages = append(stamp.Packages, "nano-devel-5.0-1-1-x86_64.eopkg")
+	stamp.Write(GetBuildStampPath(pkg, out))
+	if stamp.upToDate(pkg, out) {
+		t.Fatalf("Build with missing packages should not be up to date")
+	}
+}
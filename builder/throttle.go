@@ -0,0 +1,193 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// ioprioClassShift positions the class within an I/O priority
+	ioprioClassShift = 13
+
+	// ioprioWhoProcess applies an I/O priority to a single thread
+	ioprioWhoProcess = 1
+)
+
+// ioClasses maps the I/O scheduling classes we permit to their values.
+// The realtime class is deliberately absent, as throttling should never
+// raise the priority of a build.
+var ioClasses = map[string]int{
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// StageLimits are the CPU and I/O priorities of one stage of the build,
+// lowered so that builds in the background leave the host usable.
+type StageLimits struct {
+	Nice    int // Niceness, from 0 for unchanged to 19
+	IOClass int // I/O scheduling class, 0 for unchanged
+	IOLevel int // Level within the best-effort class, from 0 to 7
+}
+
+var (
+	// Foreground disables the stage limits, for builds being waited on
+	Foreground bool
+
+	// FetchLimits apply to solbuild itself while fetching sources
+	FetchLimits *StageLimits
+
+	// BuildLimits apply to the commands of the build within the root
+	BuildLimits *StageLimits
+)
+
+// NewStageLimits will parse the niceness and I/O priority of a stage. The
+// I/O priority is either empty for unchanged, "idle", or "best-effort"
+// with an optional level, i.e. "best-effort:7".
+func NewStageLimits(nice int, ionice string) (*StageLimits, error) {
+	if nice < 0 || nice > 19 {
+		return nil, fmt.Errorf("Invalid niceness %d, expected 0 to 19", nice)
+	}
+	limits := &StageLimits{Nice: nice}
+	if ionice == "" {
+		return limits, nil
+	}
+	fields := strings.SplitN(ionice, ":", 2)
+	class, ok := ioClasses[fields[0]]
+	if !ok {
+		return nil, fmt.Errorf("Invalid I/O priority '%s', expected idle or best-effort", ionice)
+	}
+	limits.IOClass = class
+	if len(fields) == 2 {
+		level, err := strconv.Atoi(fields[1])
+		if err != nil || level < 0 || level > 7 || fields[0] != "best-effort" {
+			return nil, fmt.Errorf("Invalid I/O priority '%s', only best-effort takes a level from 0 to 7", ionice)
+		}
+		limits.IOLevel = level
+	}
+	return limits, nil
+}
+
+// IsEmpty determines whether the limits leave the priorities unchanged
+func (l *StageLimits) IsEmpty() bool {
+	return l == nil || (l.Nice == 0 && l.IOClass == 0)
+}
+
+// String describes the limits for the plan and logs
+func (l *StageLimits) String() string {
+	if l.IsEmpty() {
+		return "unthrottled"
+	}
+	var parts []string
+	if l.Nice > 0 {
+		parts = append(parts, fmt.Sprintf("nice %d", l.Nice))
+	}
+	for name, class := range ioClasses {
+		if class != l.IOClass {
+			continue
+		}
+		if class == ioClasses["best-effort"] {
+			name = fmt.Sprintf("%s:%d", name, l.IOLevel)
+		}
+		parts = append(parts, fmt.Sprintf("I/O %s", name))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// command returns the shell prefix lowering the priorities of the command
+// that follows, and of everything it starts.
+func (l *StageLimits) command() string {
+	if l.IsEmpty() {
+		return ""
+	}
+	var cmd string
+	if l.Nice > 0 {
+		cmd += fmt.Sprintf("renice -n %d -p $$ >/dev/null; ", l.Nice)
+	}
+	if l.IOClass == ioClasses["idle"] {
+		cmd += fmt.Sprintf("ionice -c %d -p $$; ", l.IOClass)
+	} else if l.IOClass != 0 {
+		cmd += fmt.Sprintf("ionice -c %d -n %d -p $$; ", l.IOClass, l.IOLevel)
+	}
+	return cmd
+}
+
+// ioprio returns the I/O priority of the limits, as given to ioprio_set
+func (l *StageLimits) ioprio() int {
+	return l.IOClass<<ioprioClassShift | l.IOLevel
+}
+
+// threads returns the IDs of every thread of solbuild
+func threads() []int {
+	entries, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return []int{syscall.Gettid()}
+	}
+	var tids []int
+	for _, entry := range entries {
+		if tid, err := strconv.Atoi(entry.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids
+}
+
+// setPriorities will apply the niceness and I/O priority to every thread of
+// solbuild. Both are per thread on Linux, and new threads inherit them.
+func setPriorities(nice, ioprio int) {
+	for _, tid := range threads() {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+			log.Debugf("Failed to set the niceness of thread %d, reason: %s\n", tid, err)
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+			log.Debugf("Failed to set the I/O priority of thread %d, reason: %s\n", tid, errno)
+		}
+	}
+}
+
+// throttle will lower the priorities of solbuild itself for the duration of
+// a stage, returning the function restoring them.
+func (l *StageLimits) throttle() func() {
+	if l.IsEmpty() {
+		return func() {}
+	}
+	// The raw syscall returns 20 - nice, so that it's never negative
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		log.Warnf("Unable to throttle, reason: %s\n", err)
+		return func() {}
+	}
+	nice := 20 - prio
+	ioprio, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	if errno != 0 {
+		log.Warnf("Unable to throttle, reason: %s\n", errno)
+		return func() {}
+	}
+	target := l.ioprio()
+	if l.IOClass == 0 {
+		target = int(ioprio)
+	}
+	setPriorities(nice+l.Nice, target)
+	return func() {
+		setPriorities(nice, int(ioprio))
+	}
+}
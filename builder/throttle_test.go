@@ -0,0 +1,61 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestStageLimits(t *testing.T) {
+	tests := []struct {
+		nice    int
+		ionice  string
+		command string
+		fail    bool
+	}{
+		{0, "", "", false},
+		{10, "", "renice -n 10 -p $$ >/dev/null; ", false},
+		{0, "idle", "ionice -c 3 -p $$; ", false},
+		{5, "best-effort:7", "renice -n 5 -p $$ >/dev/null; ionice -c 2 -n 7 -p $$; ", false},
+		{0, "best-effort", "ionice -c 2 -n 0 -p $$; ", false},
+		{20, "", "", true},
+		{-1, "", "", true},
+		{0, "realtime", "", true},
+		{0, "idle:3", "", true},
+		{0, "best-effort:8", "", true},
+	}
+	for _, test := range tests {
+		limits, err := NewStageLimits(test.nice, test.ionice)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Expected nice %d, ionice '%s' to be invalid", test.nice, test.ionice)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to parse nice %d, ionice '%s': %s", test.nice, test.ionice, err)
+			continue
+		}
+		if cmd := limits.command(); cmd != test.command {
+			t.Errorf("Wrong command for nice %d, ionice '%s': %s", test.nice, test.ionice, cmd)
+		}
+	}
+	var none *StageLimits
+	if none.command() != "" || !none.IsEmpty() {
+		t.Errorf("Missing limits should not throttle")
+	}
+}
@@ -0,0 +1,217 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PhaseFetch brings up the build root and fetches the sources
+	PhaseFetch = "fetch"
+
+	// PhaseSetup configures the repositories and installs the build
+	// dependencies
+	PhaseSetup = "setup"
+
+	// PhaseBuild runs the build itself and collects the packages
+	PhaseBuild = "build"
+
+	// TimeoutExitStatus is the exit status of a build which timed out, as
+	// with timeout(1)
+	TimeoutExitStatus = 124
+)
+
+var (
+	// buildPhases are the phases of a build, in order
+	buildPhases = []string{PhaseFetch, PhaseSetup, PhaseBuild}
+
+	// ActiveWatchdog enforces the timeouts of the current build, if any
+	ActiveWatchdog *BuildWatchdog
+)
+
+// BuildTimeouts limit how long a build, and each of its phases, may run for
+type BuildTimeouts struct {
+	Total  time.Duration            // Timeout of the whole build, if any
+	Phases map[string]time.Duration // Timeout of each phase, if any
+}
+
+// parseTimeout will convert a timeout such as 90m, where empty is unlimited
+func parseTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("'%s' is not a positive duration, e.g. 90m or 2h", value)
+	}
+	return d, nil
+}
+
+// NewBuildTimeouts will parse the timeouts of the whole build and of the
+// fetch, setup and build phases.
+func NewBuildTimeouts(total, fetch, setup, build string) (*BuildTimeouts, error) {
+	t := &BuildTimeouts{Phases: make(map[string]time.Duration)}
+	var err error
+	if t.Total, err = parseTimeout(total); err != nil {
+		return nil, err
+	}
+	for i, value := range []string{fetch, setup, build} {
+		d, err := parseTimeout(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s timeout, %s", buildPhases[i], err)
+		}
+		if d > 0 {
+			t.Phases[buildPhases[i]] = d
+		}
+	}
+	return t, nil
+}
+
+// IsEmpty determines whether the build is allowed to run forever
+func (t *BuildTimeouts) IsEmpty() bool {
+	return t.Total == 0 && len(t.Phases) == 0
+}
+
+// String describes the timeouts, e.g. "2h0m0s (build 1h30m0s)"
+func (t *BuildTimeouts) String() string {
+	var phases []string
+	for _, phase := range buildPhases {
+		if d, ok := t.Phases[phase]; ok {
+			phases = append(phases, fmt.Sprintf("%s %s", phase, d))
+		}
+	}
+	switch {
+	case t.Total == 0:
+		return strings.Join(phases, ", ")
+	case len(phases) == 0:
+		return t.Total.String()
+	}
+	return fmt.Sprintf("%s (%s)", t.Total, strings.Join(phases, ", "))
+}
+
+// A TimeoutError is returned for a build which ran over one of its timeouts
+type TimeoutError struct {
+	Phase string        // Phase the build was in
+	Limit time.Duration // Timeout which was exceeded
+	Total bool          // Whether the timeout was that of the whole build
+}
+
+// Error describes which phase timed out
+func (e *TimeoutError) Error() string {
+	if e.Total {
+		return fmt.Sprintf("The build timed out after %s, during the %s phase", e.Limit, e.Phase)
+	}
+	return fmt.Sprintf("The %s phase timed out after %s", e.Phase, e.Limit)
+}
+
+// A BuildWatchdog tracks the phase of the build, and calls expired at most
+// once, when the build or its current phase runs over its timeout.
+type BuildWatchdog struct {
+	Timeouts *BuildTimeouts
+
+	expired func(*TimeoutError)
+	lock    sync.Mutex
+	phase   string
+	total   *time.Timer
+	current *time.Timer
+	err     *TimeoutError
+	stopped bool
+}
+
+// NewBuildWatchdog will start the timeout of the whole build, and make the
+// watchdog active. The build starts in the fetch phase.
+func NewBuildWatchdog(timeouts *BuildTimeouts, expired func(*TimeoutError)) *BuildWatchdog {
+	w := &BuildWatchdog{Timeouts: timeouts, expired: expired}
+	if timeouts.Total > 0 {
+		w.total = time.AfterFunc(timeouts.Total, func() {
+			w.expire(timeouts.Total, true)
+		})
+	}
+	w.enter(PhaseFetch)
+	ActiveWatchdog = w
+	return w
+}
+
+// enter will start the timeout of the phase, replacing that of the previous
+// phase. An error is returned if the build has already timed out, so that
+// work in progress without a child process stops at the next phase.
+func (w *BuildWatchdog) enter(phase string) error {
+	if w == nil {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.current != nil {
+		w.current.Stop()
+		w.current = nil
+	}
+	w.phase = phase
+	if limit, ok := w.Timeouts.Phases[phase]; ok {
+		w.current = time.AfterFunc(limit, func() {
+			w.expire(limit, false)
+		})
+	}
+	return nil
+}
+
+// expire records the timeout, and reports it unless already stopped
+func (w *BuildWatchdog) expire(limit time.Duration, total bool) {
+	w.lock.Lock()
+	if w.stopped || w.err != nil {
+		w.lock.Unlock()
+		return
+	}
+	w.err = &TimeoutError{Phase: w.phase, Limit: limit, Total: total}
+	err := w.err
+	w.lock.Unlock()
+	w.expired(err)
+}
+
+// Err returns the timeout the build ran over, if any
+func (w *BuildWatchdog) Err() error {
+	if w == nil {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err == nil {
+		return nil
+	}
+	return w.err
+}
+
+// Stop will cancel every timeout, and deactivate the watchdog
+func (w *BuildWatchdog) Stop() {
+	w.lock.Lock()
+	w.stopped = true
+	for _, timer := range []*time.Timer{w.total, w.current} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	w.lock.Unlock()
+	if ActiveWatchdog == w {
+		ActiveWatchdog = nil
+	}
+}
@@ -0,0 +1,66 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBuildTimeouts(t *testing.T) {
+	timeouts, err := NewBuildTimeouts("2h", "", "", "90m")
+	if err != nil {
+		t.Fatalf("Failed to parse timeouts: %s", err)
+	}
+	if s := timeouts.String(); s != "2h0m0s (build 1h30m0s)" {
+		t.Fatalf("Unexpected timeouts: %s", s)
+	}
+	if timeouts, _ = NewBuildTimeouts("", "", "", ""); !timeouts.IsEmpty() {
+		t.Fatalf("Expected no timeouts")
+	}
+	for _, invalid := range []string{"90", "-5m", "0s"} {
+		if _, err := NewBuildTimeouts("", invalid, "", ""); err == nil {
+			t.Fatalf("Expected fetch timeout '%s' to be invalid", invalid)
+		}
+	}
+}
+
+func TestBuildWatchdog(t *testing.T) {
+	timeouts := &BuildTimeouts{Phases: map[string]time.Duration{PhaseSetup: 10 * time.Millisecond}}
+	expired := make(chan *TimeoutError, 1)
+	w := NewBuildWatchdog(timeouts, func(err *TimeoutError) {
+		expired <- err
+	})
+	defer w.Stop()
+	if ActiveWatchdog != w {
+		t.Fatalf("Expected the watchdog to be active")
+	}
+	if err := w.enter(PhaseSetup); err != nil {
+		t.Fatalf("Unexpected error entering setup: %s", err)
+	}
+	select {
+	case err := <-expired:
+		if err.Phase != PhaseSetup || err.Total {
+			t.Fatalf("Unexpected timeout: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the setup phase to time out")
+	}
+	if err := w.enter(PhaseBuild); err == nil || err.Error() != "The setup phase timed out after 10ms" {
+		t.Fatalf("Expected the build to have timed out, got %v", err)
+	}
+}
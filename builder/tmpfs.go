@@ -0,0 +1,271 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	log "github.com/DataDrake/waterlog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// TmpfsSizeAuto sizes the tmpfs from the available memory and the size
+	// of the last build of the package
+	TmpfsSizeAuto = "auto"
+
+	// BuildSizesFile records the disk usage of the last build of each package
+	// of a profile, within its overlay directory
+	BuildSizesFile = "build-sizes.toml"
+
+	// tmpfsMemoryShare is the percentage of the available memory an automatic
+	// tmpfs may take
+	tmpfsMemoryShare = 75
+
+	// tmpfsHeadroom is the percentage added to the size of the last build
+	tmpfsHeadroom = 25
+
+	// tmpfsFullShare is the percentage of the tmpfs left free, below which
+	// it's considered to have filled up
+	tmpfsFullShare = 2
+)
+
+// BuildSizes are the number of bytes written to the build root by the last
+// build of each package.
+type BuildSizes struct {
+	Size map[string]int64 `toml:"size"`
+}
+
+// LoadBuildSizes will read the build sizes at path, which may not exist yet
+func LoadBuildSizes(path string) (*BuildSizes, error) {
+	sizes := &BuildSizes{Size: make(map[string]int64)}
+	if !PathExists(path) {
+		return sizes, nil
+	}
+	if _, err := toml.DecodeFile(path, sizes); err != nil {
+		return nil, err
+	}
+	if sizes.Size == nil {
+		sizes.Size = make(map[string]int64)
+	}
+	return sizes, nil
+}
+
+// Write will store the build sizes at path
+func (b *BuildSizes) Write(path string) error {
+	var blob bytes.Buffer
+	if err := toml.NewEncoder(&blob).Encode(b); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, blob.Bytes(), 00644)
+}
+
+// GetBuildSizesPath returns the path of the build sizes for the profile
+func GetBuildSizesPath(config *Config, profile *Profile) string {
+	return filepath.Join(config.OverlayRootDir, profile.Name, BuildSizesFile)
+}
+
+// A TmpfsPlan decides whether a build happens within a tmpfs, and how large
+// that tmpfs is.
+type TmpfsPlan struct {
+	Enable bool   // Whether to build within a tmpfs
+	Size   string // Size of the tmpfs, i.e. 8G
+	Reason string // Why the size or choice was made, when not configured
+}
+
+// NewTmpfsPlan will settle the tmpfs of a build. The override of the recipe
+// may disable the tmpfs, i.e. "no", or replace the configured size. An "auto"
+// size allows 25% more than the last build of the package used, or most of
+// the available memory for a package not built before, and falls back to
+// building on disk when the memory available won't do.
+func NewTmpfsPlan(enable bool, size, override string, used, avail int64) (*TmpfsPlan, error) {
+	plan := &TmpfsPlan{Enable: enable, Size: size}
+	if !enable {
+		return plan, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(override)) {
+	case "":
+	case "no", "false", "off":
+		plan.Enable = false
+		plan.Reason = "disabled by the recipe"
+		return plan, nil
+	default:
+		plan.Size = strings.TrimSpace(override)
+		plan.Reason = "set by the recipe"
+	}
+	if plan.Size != TmpfsSizeAuto {
+		if !ValidMemSize(plan.Size) {
+			return nil, ErrInvalidMemSize
+		}
+		return plan, nil
+	}
+
+	limit := avail * tmpfsMemoryShare / 100
+	if used <= 0 {
+		plan.Size = formatGiB(limit, false)
+		plan.Reason = fmt.Sprintf("%d%% of the available memory, no earlier build to size from", tmpfsMemoryShare)
+		if limit < 1<<30 {
+			plan.Enable = false
+			plan.Reason = "less than 1G of memory available"
+		}
+		return plan, nil
+	}
+	need := used + used*tmpfsHeadroom/100
+	if need > limit {
+		plan.Enable = false
+		plan.Reason = fmt.Sprintf("the last build used %s, more than the %s of memory it may take", formatGiB(used, true), formatGiB(limit, false))
+		return plan, nil
+	}
+	plan.Size = formatGiB(need, true)
+	plan.Reason = fmt.Sprintf("the last build used %s", formatGiB(used, true))
+	return plan, nil
+}
+
+// String describes the tmpfs for the plan and logs
+func (t *TmpfsPlan) String() string {
+	desc := "disk"
+	if t.Enable {
+		desc = "unbounded tmpfs"
+		if t.Size != "" {
+			desc = t.Size + " tmpfs"
+		}
+	}
+	if t.Reason != "" {
+		desc += " (" + t.Reason + ")"
+	}
+	return desc
+}
+
+// formatGiB renders a number of bytes as whole gibibytes, the smallest unit
+// accepted for tmpfs sizes, rounding up or down.
+func formatGiB(size int64, up bool) string {
+	if up {
+		size += 1<<30 - 1
+	}
+	return fmt.Sprintf("%dG", size>>30)
+}
+
+// tmpfsPlan will settle the tmpfs for the package, from the configuration,
+// the recipe, and the size of its last build.
+func (m *Manager) tmpfsPlan() (*TmpfsPlan, error) {
+	var used int64
+	if m.Config.EnableTmpfs {
+		if sizes, err := LoadBuildSizes(GetBuildSizesPath(m.Config, m.profile)); err == nil {
+			used = sizes.Size[m.pkg.Name]
+		}
+	}
+	return NewTmpfsPlan(m.Config.EnableTmpfs, m.Config.TmpfsSize, m.pkg.Tmpfs, used, availableMemory())
+}
+
+// setTmpfs will configure the overlay according to the tmpfs plan
+func (m *Manager) setTmpfs() error {
+	plan, err := m.tmpfsPlan()
+	if err != nil {
+		size := m.Config.TmpfsSize
+		if m.pkg.Tmpfs != "" {
+			size = m.pkg.Tmpfs
+		}
+		log.Errorf("Invalid memory size specified: %s\n", size)
+		return err
+	}
+	if plan.Reason != "" {
+		log.Infof("Building %s on %s\n", m.pkg.Name, plan)
+	}
+	m.overlay.EnableTmpfs = plan.Enable
+	m.overlay.TmpfsSize = plan.Size
+	return nil
+}
+
+// usage will return the number of bytes written to the build root
+func (o *Overlay) usage() int64 {
+	if o.mountedTmpfs {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(o.BaseDir, &st); err != nil {
+			return 0
+		}
+		return int64(st.Blocks-st.Bfree) * int64(st.Bsize)
+	}
+	var size int64
+	for _, dir := range []string{o.UpperDir, o.WorkDir} {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+	return size
+}
+
+// tmpfsFull determines whether the tmpfs of the build ran out of space or
+// inodes, which the build only reports as ENOSPC.
+func (o *Overlay) tmpfsFull() bool {
+	if !o.mountedTmpfs {
+		return false
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(o.BaseDir, &st); err != nil {
+		return false
+	}
+	return st.Bavail < st.Blocks*tmpfsFullShare/100 || (st.Files > 0 && st.Ffree == 0)
+}
+
+// recordBuildSize will remember the size of the build root for sizing the
+// tmpfs of the next build of the package.
+func (m *Manager) recordBuildSize(size int64) {
+	if size <= 0 {
+		return
+	}
+	path := GetBuildSizesPath(m.Config, m.profile)
+	sizes, err := LoadBuildSizes(path)
+	if err != nil {
+		log.Warnf("Unable to read build sizes, reason: %s\n", err)
+		return
+	}
+	sizes.Size[m.pkg.Name] = size
+	if err := sizes.Write(path); err != nil {
+		log.Warnf("Unable to record the build size, reason: %s\n", err)
+	}
+}
+
+// retryOnDisk will tear down a failed build whose tmpfs filled up, so that it
+// may be retried on disk rather than failing with ENOSPC.
+func (m *Manager) retryOnDisk() bool {
+	if m.IsCancelled() || !m.overlay.tmpfsFull() {
+		return false
+	}
+	size := m.overlay.TmpfsSize
+	if size == "" {
+		size = "unbounded"
+	}
+	log.Warnf("The %s tmpfs ran out of space while building %s, retrying on disk\n", size, m.pkg.Name)
+	log.Warnln("Raise tmpfs_size, or set 'tmpfs: no' in the package.yml, to avoid the wasted build")
+	m.recordBuildSize(m.overlay.usage())
+	m.pkgManager.Cleanup()
+	m.pkg.DeactivateRoot(m.overlay)
+	m.SetActivePID(0)
+	m.overlay.mountedTmpfs = false
+	m.overlay.EnableTmpfs = false
+	m.overlay.TmpfsSize = ""
+	m.setRootfsBackend()
+	return true
+}
@@ -0,0 +1,78 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTmpfsPlan(t *testing.T) {
+	const gib = int64(1) << 30
+	tests := []struct {
+		size, override string
+		used, avail    int64
+		enable         bool
+		expected       string
+	}{
+		{"8G", "", 0, 16 * gib, true, "8G"},
+		{"8G", "no", 0, 16 * gib, false, "8G"},
+		{"8G", "24G", 0, 16 * gib, true, "24G"},
+		{"auto", "", 0, 16 * gib, true, "12G"},
+		{"auto", "", 5 * gib, 16 * gib, true, "7G"},
+		{"auto", "", 11 * gib, 16 * gib, false, "auto"},
+		{"8G", "auto", 2 * gib, 16 * gib, true, "3G"},
+	}
+	for _, test := range tests {
+		plan, err := NewTmpfsPlan(true, test.size, test.override, test.used, test.avail)
+		if err != nil {
+			t.Fatalf("Failed to plan %s/%s: %s", test.size, test.override, err)
+		}
+		if plan.Enable != test.enable || plan.Size != test.expected {
+			t.Errorf("Expected %v %s for %+v, found %s", test.enable, test.expected, test, plan)
+		}
+	}
+	if _, err := NewTmpfsPlan(true, "8G", "lots", 0, 16*gib); err != ErrInvalidMemSize {
+		t.Fatalf("Expected an invalid size, found %v", err)
+	}
+	if plan, _ := NewTmpfsPlan(false, "8G", "24G", 0, 16*gib); plan.Enable {
+		t.Fatalf("The recipe must not enable a disabled tmpfs")
+	}
+}
+
+func TestBuildSizes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), BuildSizesFile)
+	sizes, err := LoadBuildSizes(path)
+	if err != nil {
+		t.Fatalf("Failed to load missing build sizes: %s", err)
+	}
+	sizes.Size["nano"] = 1234
+	if err := sizes.Write(path); err != nil {
+		t.Fatalf("Failed to write build sizes: %s", err)
+	}
+	if sizes, err = LoadBuildSizes(path); err != nil || sizes.Size["nano"] != 1234 {
+		t.Fatalf("Unexpected build sizes: %v, %v", sizes, err)
+	}
+
+	pkg, err := NewYmlPackageFromBytes([]byte("name: nano\nversion: 5.7\nrelease: 1\ntmpfs: no\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse recipe: %s", err)
+	}
+	if pkg.Tmpfs != "no" {
+		t.Fatalf("Expected the tmpfs override, found '%s'", pkg.Tmpfs)
+	}
+}
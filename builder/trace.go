@@ -0,0 +1,348 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TraceBuild will record every command executed by the build, with its
+// arguments and duration, into a trace file alongside the packages.
+var TraceBuild bool
+
+// TraceSuffix is the suffix of the trace file written for traced builds
+const TraceSuffix = ".trace.json"
+
+var (
+	// ErrNoTracer is returned when tracing is requested without strace
+	ErrNoTracer = errors.New("Tracing builds requires strace(1) to be installed on the host")
+
+	// traceLine splits a line of strace output into the pid, time and event
+	traceLine = regexp.MustCompile(`^(\d+)\s+(\d+\.\d+)\s+(.*)$`)
+
+	// traceSpawn matches a successful fork, returning the new pid
+	traceSpawn = regexp.MustCompile(`^(?:<\.\.\. )?(?:clone3?|v?fork)\b.*= (\d+)$`)
+
+	// traceExit matches the termination of a process
+	traceExit = regexp.MustCompile(`^\+\+\+ (?:exited with (\d+)|killed by (\w+))`)
+)
+
+// A TracedCommand is a single program executed during the build
+type TracedCommand struct {
+	PID      int      `json:"pid"`
+	PPID     int      `json:"ppid,omitempty"`
+	Argv     []string `json:"argv"`
+	Start    float64  `json:"start"`    // Seconds since the trace began
+	Duration float64  `json:"duration"` // Seconds until the next exec or exit
+	Exit     string   `json:"exit,omitempty"`
+}
+
+// CheckTracer will ensure that builds can be traced on this host
+func CheckTracer() error {
+	if _, err := exec.LookPath("strace"); err != nil {
+		return ErrNoTracer
+	}
+	return nil
+}
+
+// tracerCommand returns the strace invocation recording executed commands
+// into the given file.
+func tracerCommand(output string) ([]string, error) {
+	strace, err := exec.LookPath("strace")
+	if err != nil {
+		return nil, ErrNoTracer
+	}
+	return []string{
+		strace, "-f", "-q", "-ttt", "-s", "4096",
+		"-e", "trace=execve,clone,clone3,fork,vfork",
+		"-e", "signal=none",
+		"-o", output,
+	}, nil
+}
+
+// unquoteTraceString decodes a C style string as printed by strace
+func unquoteTraceString(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			out.WriteByte('\n')
+		case 't':
+			out.WriteByte('\t')
+		case 'r':
+			out.WriteByte('\r')
+		case 'v':
+			out.WriteByte('\v')
+		case 'f':
+			out.WriteByte('\f')
+		case 'x':
+			end := i + 1
+			for end < len(s) && end < i+3 && strings.IndexByte("0123456789abcdefABCDEF", s[end]) >= 0 {
+				end++
+			}
+			v, _ := strconv.ParseUint(s[i+1:end], 16, 8)
+			out.WriteByte(byte(v))
+			i = end - 1
+		default:
+			if c >= '0' && c <= '7' {
+				end := i
+				for end < len(s) && end < i+3 && s[end] >= '0' && s[end] <= '7' {
+					end++
+				}
+				v, _ := strconv.ParseUint(s[i:end], 8, 8)
+				out.WriteByte(byte(v))
+				i = end - 1
+			} else {
+				out.WriteByte(c)
+			}
+		}
+	}
+	return out.String()
+}
+
+// parseTraceArgv will extract the argument vector from an execve event
+func parseTraceArgv(event string) []string {
+	start := strings.Index(event, "[")
+	if start < 0 {
+		return nil
+	}
+	var argv []string
+	for i := start + 1; i < len(event); i++ {
+		switch event[i] {
+		case ']':
+			return argv
+		case '"':
+			end := i + 1
+			for end < len(event) && event[end] != '"' {
+				if event[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(event) {
+				return argv
+			}
+			arg := unquoteTraceString(event[i+1 : end])
+			// Truncated strings are followed by an ellipsis
+			if strings.HasPrefix(event[end+1:], "...") {
+				arg += "..."
+			}
+			argv = append(argv, Redact(arg))
+			i = end
+		}
+	}
+	return argv
+}
+
+// ParseTrace will read the output of strace and return every successfully
+// executed command, ordered by the time it started.
+func ParseTrace(r io.Reader) ([]*TracedCommand, error) {
+	var commands []*TracedCommand
+	parents := make(map[int]int)
+	current := make(map[int]*TracedCommand)
+	pending := make(map[int]*TracedCommand)
+	origin := -1.0
+
+	finish := func(pid int, when float64) {
+		if cmd, ok := current[pid]; ok {
+			cmd.Duration = when - origin - cmd.Start
+			delete(current, pid)
+		}
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for sc.Scan() {
+		m := traceLine.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		pid, _ := strconv.Atoi(m[1])
+		when, _ := strconv.ParseFloat(m[2], 64)
+		event := m[3]
+		if origin < 0 {
+			origin = when
+		}
+
+		switch {
+		case strings.HasPrefix(event, "execve("):
+			cmd := &TracedCommand{PID: pid, PPID: parents[pid], Argv: parseTraceArgv(event), Start: when - origin}
+			if strings.HasSuffix(event, "<unfinished ...>") {
+				pending[pid] = cmd
+				continue
+			}
+			if strings.HasSuffix(event, "= 0") {
+				finish(pid, when)
+				current[pid] = cmd
+				commands = append(commands, cmd)
+			}
+		case strings.HasPrefix(event, "<... execve resumed>"):
+			cmd, ok := pending[pid]
+			delete(pending, pid)
+			if ok && strings.HasSuffix(event, "= 0") {
+				finish(pid, when)
+				current[pid] = cmd
+				commands = append(commands, cmd)
+			}
+		default:
+			if s := traceSpawn.FindStringSubmatch(event); s != nil {
+				child, _ := strconv.Atoi(s[1])
+				parents[child] = pid
+				// The child may be reported before the fork returns
+				for _, cmd := range []*TracedCommand{current[child], pending[child]} {
+					if cmd != nil && cmd.PPID == 0 {
+						cmd.PPID = pid
+					}
+				}
+			} else if s := traceExit.FindStringSubmatch(event); s != nil {
+				if cmd, ok := current[pid]; ok {
+					cmd.Exit = s[1]
+					if s[2] != "" {
+						cmd.Exit = s[2]
+					}
+				}
+				finish(pid, when)
+			}
+		}
+	}
+	sort.SliceStable(commands, func(i, j int) bool {
+		return commands[i].Start < commands[j].Start
+	})
+	return commands, sc.Err()
+}
+
+// traceEvent is a complete event in the Chrome trace event format, which
+// can be loaded into chrome://tracing or Perfetto.
+type traceEvent struct {
+	Name     string         `json:"name"`
+	Phase    string         `json:"ph"`
+	Time     int64          `json:"ts"`
+	Duration int64          `json:"dur"`
+	PID      int            `json:"pid"`
+	TID      int            `json:"tid"`
+	Args     *TracedCommand `json:"args"`
+}
+
+// WriteTrace will store the commands in the Chrome trace event format
+func WriteTrace(path string, commands []*TracedCommand) error {
+	doc := struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}{
+		TraceEvents: []traceEvent{},
+	}
+	for _, cmd := range commands {
+		name := ""
+		if len(cmd.Argv) > 0 {
+			name = cmd.Argv[0]
+		}
+		doc.TraceEvents = append(doc.TraceEvents, traceEvent{
+			Name:     name,
+			Phase:    "X",
+			Time:     int64(cmd.Start * 1e6),
+			Duration: int64(cmd.Duration * 1e6),
+			PID:      1,
+			TID:      cmd.PID,
+			Args:     cmd,
+		})
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 00644)
+}
+
+// GetTracePath returns the name of the trace file for this package
+func (p *Package) GetTracePath() string {
+	return fmt.Sprintf("%s-%s-%d%s", p.Name, p.Version, p.Release, TraceSuffix)
+}
+
+// TracedChrootExec will run the command within the chroot, recording every
+// command it executes into the trace file of the package in the current
+// directory. The trace is written even if the command fails.
+func (p *Package) TracedChrootExec(notif PidNotifier, dir, command string) error {
+	raw, err := ioutil.TempFile("", "solbuild-trace-")
+	if err != nil {
+		return err
+	}
+	raw.Close()
+	defer os.Remove(raw.Name())
+
+	tracer, err := tracerCommand(raw.Name())
+	if err != nil {
+		return err
+	}
+	log.Infof("Tracing executed commands into %s\n", p.GetTracePath())
+	execErr := chrootExecWrapped(notif, append(ActiveBuildCgroup.wrapper(), tracer...), dir, command, nil)
+
+	f, err := os.Open(raw.Name())
+	if err != nil {
+		log.Warnf("Failed to read trace, reason: %s\n", err)
+		return execErr
+	}
+	defer f.Close()
+	commands, err := ParseTrace(f)
+	if err != nil {
+		log.Warnf("Failed to parse trace, reason: %s\n", err)
+	}
+	if err := WriteTrace(p.GetTracePath(), commands); err != nil {
+		log.Warnf("Failed to write trace, reason: %s\n", err)
+		return execErr
+	}
+	usr := GetUserInfo()
+	if err := os.Chown(p.GetTracePath(), usr.UID, usr.GID); err != nil {
+		log.Errorf("Error in restoring file ownership %s, reason: %s\n", p.GetTracePath(), err)
+	}
+	logSlowestCommands(commands, 10)
+	return execErr
+}
+
+// logSlowestCommands will summarise the longest running commands
+func logSlowestCommands(commands []*TracedCommand, limit int) {
+	sorted := append([]*TracedCommand{}, commands...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Duration > sorted[j].Duration
+	})
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	log.Infof("Traced %d commands, the slowest were:\n", len(commands))
+	for _, cmd := range sorted {
+		line := strings.Join(cmd.Argv, " ")
+		if len(line) > 120 {
+			line = line[:117] + "..."
+		}
+		log.Infof("  %8.2fs  %s\n", cmd.Duration, line)
+	}
+}
@@ -0,0 +1,57 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTrace = `100 1620000000.000000 execve("/usr/sbin/chroot", ["chroot", "/root", "/bin/sh", "-c", "ypkg-build"], 0x7ffd /* 12 vars */) = 0
+100 1620000000.100000 execve("/bin/sh", ["/bin/sh", "-c", "ypkg-build"], 0x7ffd /* 12 vars */) = 0
+100 1620000000.200000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD <unfinished ...>
+101 1620000000.300000 execve("/usr/local/bin/gcc", ["gcc", "-c", "a\tb.c"], 0x55 /* 12 vars */) = -1 ENOENT (No such file or directory)
+101 1620000000.300100 execve("/usr/bin/gcc", ["gcc", "-DNAME=\"x\"", "-c", "a\tb.c"], 0x55 /* 12 vars */ <unfinished ...>
+100 1620000000.300200 <... clone resumed>) = 101
+101 1620000000.310000 <... execve resumed>) = 0
+101 1620000002.310000 +++ exited with 1 +++
+100 1620000003.000000 +++ exited with 0 +++
+`
+
+func TestParseTrace(t *testing.T) {
+	commands, err := ParseTrace(strings.NewReader(testTrace))
+	if err != nil {
+		t.Fatalf("Failed to parse trace: %s", err)
+	}
+	if len(commands) != 3 {
+		t.Fatalf("Expected 3 commands, got %d", len(commands))
+	}
+	if d := commands[0].Duration; d < 0.099 || d > 0.101 {
+		t.Fatalf("Exec should end the previous command, got duration %f", d)
+	}
+	gcc := commands[2]
+	if !reflect.DeepEqual(gcc.Argv, []string{"gcc", "-DNAME=\"x\"", "-c", "a\tb.c"}) {
+		t.Fatalf("Unexpected argv: %q", gcc.Argv)
+	}
+	if gcc.PPID != 100 || gcc.Exit != "1" || gcc.Duration < 1.99 || gcc.Duration > 2.01 {
+		t.Fatalf("Unexpected gcc command: %+v", gcc)
+	}
+	if commands[1].Exit != "0" {
+		t.Fatalf("Unexpected shell exit: %+v", commands[1])
+	}
+}
@@ -43,6 +43,15 @@ type TransitManifestHeader struct {
 
 	// The repo that the uploader is intending to upload *to*
 	Target string `toml:"target"`
+
+	// How the packages were compressed, when not with the eopkg defaults
+	Compression string `toml:"compression,omitempty"`
+
+	// The CPU baseline the build was normalised to, and the host it ran on
+	CPUBaseline string `toml:"cpu_baseline,omitempty"`
+
+	// How packages built earlier in a stack were promoted to this build
+	Promotion string `toml:"promotion,omitempty"`
 }
 
 // A TransitManifest is provided by build servers to validate the upload of
@@ -57,6 +66,9 @@ type TransitManifest struct {
 
 	// A list of files that accompanied this .tram upload
 	File []TransitManifestFile `toml:"file"`
+
+	// Packages built earlier in the stack that this build installed
+	Promoted []EnvironmentLockPackage `toml:"promoted,omitempty"`
 }
 
 // TransitManifestFile provides simple verification data for each file in the
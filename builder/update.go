@@ -24,36 +24,54 @@ import (
 	"path/filepath"
 )
 
-func (b *BackingImage) updatePackages(notif PidNotifier, pkgManager *EopkgManager) error {
+// FullUpdate will upgrade the image and assert system.devel even when no
+// package has changed since the last update.
+var FullUpdate bool
+
+// updatePackages will upgrade the image, returning whether anything was
+// done. An incremental update only goes ahead when packages have changed.
+func (b *BackingImage) updatePackages(notif PidNotifier, pkgManager *EopkgManager, incremental bool) (bool, error) {
 	log.Debugln("Initialising package manager")
 
 	if err := pkgManager.Init(); err != nil {
-		return fmt.Errorf("Failed to initialise package manager, reason: %s\n", err)
+		return false, fmt.Errorf("Failed to initialise package manager, reason: %s\n", err)
 	}
 
 	// Bring up dbus to do Things
 	log.Debugln("Starting D-BUS")
 	if err := pkgManager.StartDBUS(); err != nil {
-		return fmt.Errorf("Failed to start d-bus, reason: %s\n", err)
+		return false, fmt.Errorf("Failed to start d-bus, reason: %s\n", err)
+	}
+
+	if incremental {
+		upgrades, err := pkgManager.ListUpgrades()
+		switch {
+		case err != nil:
+			log.Warnf("Unable to list upgrades, performing a full update: %s\n", err)
+		case len(upgrades) == 0:
+			return false, pkgManager.StopDBUS()
+		default:
+			log.Infof("Upgrading %d changed package(s)\n", len(upgrades))
+		}
 	}
 
 	log.Debugln("Upgrading builder image")
 	if err := pkgManager.Upgrade(); err != nil {
-		return fmt.Errorf("Failed to perform upgrade, reason: %s\n", err)
+		return false, fmt.Errorf("Failed to perform upgrade, reason: %s\n", err)
 	}
 
 	log.Debugln("Asserting system.devel component")
 	if err := pkgManager.InstallComponent("system.devel"); err != nil {
-		return fmt.Errorf("Failed to install system.devel, reason: %s\n", err)
+		return false, fmt.Errorf("Failed to install system.devel, reason: %s\n", err)
 	}
 
 	// Cleanup now
 	log.Debugln("Stopping D-BUS")
 	if err := pkgManager.StopDBUS(); err != nil {
-		return fmt.Errorf("Failed to stop d-bus, reason: %s\n", err)
+		return false, fmt.Errorf("Failed to stop d-bus, reason: %s\n", err)
 	}
 
-	return nil
+	return true, nil
 }
 
 // Update will attempt to update the backing image to the latest version
@@ -72,7 +90,7 @@ func (b *BackingImage) Update(notif PidNotifier, pkgManager *EopkgManager) error
 	log.Debugf("Mounting rootfs %s %s\n", b.ImagePath, b.RootDir)
 
 	// Mount the rootfs
-	if err := mountMan.Mount(b.ImagePath, b.RootDir, "auto", "loop"); err != nil {
+	if err := b.mountRoot(); err != nil {
 		return fmt.Errorf("Failed to mount rootfs %s, reason: %s\n", b.ImagePath, err)
 	}
 
@@ -88,17 +106,38 @@ func (b *BackingImage) Update(notif PidNotifier, pkgManager *EopkgManager) error
 		return fmt.Errorf("Failed to mount /proc, reason: %s\n", err)
 	}
 
+	// Only images brought fully up to date before can be updated incrementally
+	previous, err := LoadImageGeneration(b)
+	if err != nil {
+		log.Warnf("Ignoring the generation of the image, reason: %s\n", err)
+	}
+	before, _ := installedPackages(b.RootDir)
+
 	// Hand over to package management to do the updates
-	if err := b.updatePackages(notif, pkgManager); err != nil {
+	b.updated, err = b.updatePackages(notif, pkgManager, previous != nil && !FullUpdate)
+	if err != nil {
 		return err
 	}
+	if !b.updated {
+		log.Infof("Image %s is up to date at generation %d\n", b.Name, previous.Generation)
+		return nil
+	}
 
 	// Lastly, add the user
 	if err := AddBuildUser(b.RootDir); err != nil {
 		return err
 	}
 
-	log.Debugf("Image successfully updated %s\n", b.Name)
+	after, err := installedPackages(b.RootDir)
+	if err != nil {
+		return err
+	}
+	generation := NewImageGeneration(previous, before, after)
+	if err := generation.Save(b); err != nil {
+		return err
+	}
+	log.Infof("Image %s updated to generation %d: %d added, %d upgraded, %d removed\n", b.Name,
+		generation.Generation, len(generation.Added), len(generation.Upgraded), len(generation.Removed))
 
 	return nil
 }
@@ -90,6 +90,20 @@ func (u *UserInfo) SetFromSudo() bool {
 	return true
 }
 
+// SetFromRootless will set our details for a rootless build, where we're
+// root within the user namespace and the invoking user outside of it
+func (u *UserInfo) SetFromRootless() bool {
+	if !Rootless {
+		return false
+	}
+	u.UID = 0
+	u.GID = 0
+	u.HomeDir = os.Getenv("HOME")
+	u.Username = os.Getenv("USER")
+	u.Name = u.Username
+	return true
+}
+
 // SetFromCurrent will set the UserInfo details from the current user
 func (u *UserInfo) SetFromCurrent() {
 	u.UID = os.Getuid()
@@ -193,7 +207,7 @@ func GetUserInfo() *UserInfo {
 	uinfo := &UserInfo{}
 
 	// First up try to set the uid/gid
-	if !uinfo.SetFromSudo() {
+	if !uinfo.SetFromRootless() && !uinfo.SetFromSudo() {
 		uinfo.SetFromCurrent()
 	}
 
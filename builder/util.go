@@ -17,12 +17,14 @@
 package builder
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	log "github.com/DataDrake/waterlog"
 	"github.com/getsolus/libosdev/commands"
 	"github.com/getsolus/libosdev/disk"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -64,12 +66,18 @@ func (p *Package) ActivateRoot(overlay *Overlay) error {
 		}
 	}
 
+	// Containers bring up their own virtual filesystems
+	if containerBackend() {
+		return nil
+	}
+
 	log.Debugln("Bringing up virtual filesystems")
 	return overlay.MountVFS()
 }
 
 // DeactivateRoot will tear down the previously activated root
 func (p *Package) DeactivateRoot(overlay *Overlay) {
+	stopContainers(overlay.MountPoint)
 	MurderDeathKill(overlay.MountPoint)
 	mountMan := disk.GetMountManager()
 	commands.SetStdin(nil)
@@ -178,14 +186,37 @@ func SaneEnvironment(username, home string) []string {
 // ChrootExec is a simple wrapper to return a correctly set up chroot command,
 // so that we can store the PID, for long running tasks
 func ChrootExec(notif PidNotifier, dir, command string) error {
-	args := []string{dir, "/bin/sh", "-c", command}
-	c := exec.Command("chroot", args...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
+	return chrootExecWrapped(notif, nil, dir, command, nil)
+}
+
+// chrootExecWrapped is identical to ChrootExec, except that the chroot
+// is run by the given wrapper command, such as a tracer. When tee is set,
+// the output of the command is also copied into it.
+func chrootExecWrapped(notif PidNotifier, wrapper []string, dir, command string, tee io.Writer) error {
+	args := append(append([]string{}, wrapper...), rootCommand(dir, command, false)...)
+	c := exec.Command(args[0], args[1:]...)
+	stdout, stderr, flush := containerOutput()
+	defer flush()
+	if tee != nil {
+		stdout = io.MultiWriter(stdout, tee)
+		stderr = io.MultiWriter(stderr, tee)
+	}
+	c.Stdout = stdout
+	c.Stderr = stderr
 	c.Stdin = nil
 	c.Env = ChrootEnvironment
 	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 
+	// Keep any sensitive values out of the build log
+	if hasRedactions() {
+		stdout := NewRedactingWriter(stdout)
+		stderr := NewRedactingWriter(stderr)
+		defer stdout.Flush()
+		defer stderr.Flush()
+		c.Stdout = stdout
+		c.Stderr = stderr
+	}
+
 	if err := c.Start(); err != nil {
 		return err
 	}
@@ -193,12 +224,52 @@ func ChrootExec(notif PidNotifier, dir, command string) error {
 	return c.Wait()
 }
 
+// ChrootExecOutput is almost identical to ChrootExec, except that the
+// stdout of the command is captured and returned instead of displayed.
+func ChrootExecOutput(notif PidNotifier, dir, command string) (string, error) {
+	args := rootCommand(dir, command, false)
+	c := exec.Command(args[0], args[1:]...)
+	var out bytes.Buffer
+	_, stderr, flush := containerOutput()
+	defer flush()
+	c.Stdout = &out
+	c.Stderr = stderr
+	c.Stdin = nil
+	c.Env = ChrootEnvironment
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if hasRedactions() {
+		stderr := NewRedactingWriter(stderr)
+		defer stderr.Flush()
+		c.Stderr = stderr
+	}
+
+	if err := c.Start(); err != nil {
+		return "", err
+	}
+	notif.SetActivePID(c.Process.Pid)
+	err := c.Wait()
+	notif.SetActivePID(0)
+	return out.String(), err
+}
+
 // ChrootExecStdin is almost identical to ChrootExec, except it permits a stdin
 // to be associated with the command
 func ChrootExecStdin(notif PidNotifier, dir, command string) error {
-	args := []string{dir, "/bin/sh", "-c", command}
-	c := exec.Command("chroot", args...)
-	c.Stdout = os.Stdout
+	return chrootExecAttached(notif, rootCommand(dir, command, true))
+}
+
+// ChrootExecPiped is identical to ChrootExecStdin, except that no terminal is
+// allocated, so the command can be driven by a script through its stdin and
+// stdout
+func ChrootExecPiped(notif PidNotifier, dir, command string) error {
+	return chrootExecAttached(notif, pipedRootCommand(dir, command))
+}
+
+// chrootExecAttached runs the command line with our stdin, stdout and stderr
+func chrootExecAttached(notif PidNotifier, args []string) error {
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdout = Stdout
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
 	c.Env = ChrootEnvironment
@@ -235,6 +306,96 @@ func AddBuildUser(rootfs string) error {
 	return nil
 }
 
+// buildUserCommand will prepare the command to run with the credentials of
+// the build user when we're root, for commands handling untrusted input on
+// the host.
+func buildUserCommand(name string, args ...string) *exec.Cmd {
+	c := exec.Command(name, args...)
+	if os.Geteuid() == 0 {
+		c.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(BuildUserID), Gid: uint32(BuildUserGID)},
+		}
+	}
+	return c
+}
+
+// chownBuildUser will hand the directory over to the build user when we're
+// root, for commands prepared with buildUserCommand to write into
+func chownBuildUser(dir string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Chown(dir, BuildUserID, BuildUserGID)
+}
+
+// isMountPoint determines whether anything is mounted at the path, as listed
+// in the mountinfo of our mount namespace
+func isMountPoint(path string) bool {
+	b, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	path = filepath.Clean(path)
+	for _, line := range strings.Split(string(b), "\n") {
+		// The mount point is the fifth field, with spaces escaped as \040
+		if fields := strings.Fields(line); len(fields) > 4 && strings.Replace(fields[4], "\\040", " ", -1) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// secureJoin will join path onto root, resolving each symlink along the way
+// as though root were /, so that the result never escapes root. Components
+// that do not exist yet are appended as they are.
+func secureJoin(root, path string) (string, error) {
+	var resolved string
+	missing := false
+	pending := strings.Split(filepath.Clean("/"+path), "/")
+	for links := 0; len(pending) > 0; {
+		component := pending[0]
+		pending = pending[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+		next := filepath.Join(resolved, component)
+		if missing {
+			resolved = next
+			continue
+		}
+		st, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+			missing = true
+		}
+		if missing || st.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 40 {
+			return "", fmt.Errorf("Too many levels of symbolic links: %s", path)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = ""
+		}
+		pending = append(strings.Split(link, "/"), pending...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
 // FileSha256sum is a quick wrapper to grab the sha256sum for the given file
 func FileSha256sum(path string) (string, error) {
 	mfile, err := MapFile(path)
@@ -0,0 +1,464 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/getsolus/solbuild/builder/source"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// syntaxErrorLine matches the line reported by a TOML syntax error
+	syntaxErrorLine = regexp.MustCompile(`^Near line (\d+) \(last key parsed '[^']*'\): `)
+
+	// RepoCheckTimeout is how long a remote repository may take to respond
+	// when validating profiles
+	RepoCheckTimeout = 10 * time.Second
+)
+
+// A ConfigIssue is a problem found while validating a configuration or
+// profile file.
+type ConfigIssue struct {
+	Path    string // File containing the problem
+	Line    int    // Line of the offending key, 0 when unknown
+	Key     string // The offending key, if any
+	Message string // Description of the problem
+	Warning bool   // Whether builds can still go ahead
+}
+
+// String will describe the issue in the file:line form used by compilers
+func (i *ConfigIssue) String() string {
+	pos := i.Path
+	if i.Line > 0 {
+		pos += ":" + strconv.Itoa(i.Line)
+	}
+	if i.Key != "" {
+		return fmt.Sprintf("%s: %s: %s", pos, i.Key, i.Message)
+	}
+	return fmt.Sprintf("%s: %s", pos, i.Message)
+}
+
+// A configFile remembers the line each key of a TOML file is set on
+type configFile struct {
+	path  string
+	lines map[string]int
+}
+
+// splitKey will split a dotted TOML key into its parts, unquoting them
+func splitKey(key string) []string {
+	var parts []string
+	var part strings.Builder
+	quote := rune(0)
+	for _, r := range key {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		case r != ' ' && r != '\t':
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, strings.TrimSpace(part.String()))
+}
+
+// newConfigFile will find the line of every key and table in the document
+func newConfigFile(path, content string) *configFile {
+	f := &configFile{path: path, lines: make(map[string]int)}
+	table := ""
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		key := ""
+		switch {
+		case line == "", strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			end := strings.LastIndex(line, "]")
+			if end < 0 {
+				continue
+			}
+			table = strings.Join(splitKey(strings.Trim(line[:end], "[]")), ".")
+			key = table
+		default:
+			eq := strings.Index(line, "=")
+			if eq <= 0 {
+				continue
+			}
+			key = strings.Join(splitKey(line[:eq]), ".")
+			if table != "" {
+				key = table + "." + key
+			}
+		}
+		if _, ok := f.lines[key]; !ok {
+			f.lines[key] = i + 1
+		}
+	}
+	return f
+}
+
+// line returns the line of the key, or of the closest table containing it
+func (f *configFile) line(key []string) int {
+	for n := len(key); n > 0; n-- {
+		if line, ok := f.lines[strings.Join(key[:n], ".")]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+// issue will create an issue for the key within the file
+func (f *configFile) issue(key, message string, warning bool) *ConfigIssue {
+	i := &ConfigIssue{Path: f.path, Key: key, Message: message, Warning: warning}
+	if key != "" {
+		i.Line = f.line(splitKey(key))
+	}
+	return i
+}
+
+// tomlFields maps the TOML keys of a struct to the index of their field
+func tomlFields(t reflect.Type) map[string]int {
+	fields := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("toml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+// checkSchema will decode the file against the schema, a pointer to the
+// struct it configures, reporting syntax errors, values of the wrong type
+// and unknown keys, which solbuild would otherwise silently ignore.
+func checkSchema(path string, schema interface{}) (*configFile, []*ConfigIssue) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return &configFile{path: path}, []*ConfigIssue{{Path: path, Message: err.Error()}}
+	}
+	f := newConfigFile(path, string(b))
+	var raw map[string]toml.Primitive
+	md, err := toml.Decode(string(b), &raw)
+	if err != nil {
+		issue := &ConfigIssue{Path: path, Message: err.Error()}
+		if match := syntaxErrorLine.FindStringSubmatch(issue.Message); match != nil {
+			issue.Line, _ = strconv.Atoi(match[1])
+			issue.Message = issue.Message[len(match[0]):]
+		}
+		return f, []*ConfigIssue{issue}
+	}
+	var issues []*ConfigIssue
+	value := reflect.New(reflect.TypeOf(schema).Elem()).Elem()
+	fields := tomlFields(value.Type())
+	bad := make(map[string]bool)
+	for key, prim := range raw {
+		field, ok := fields[key]
+		if !ok {
+			issues = append(issues, f.issue(key, "Unknown key", false))
+			bad[key] = true
+			continue
+		}
+		if err := md.PrimitiveDecode(prim, value.Field(field).Addr().Interface()); err != nil {
+			issues = append(issues, f.issue(key, strings.TrimPrefix(err.Error(), "toml: "), false))
+			bad[key] = true
+		}
+	}
+	for _, key := range md.Undecoded() {
+		if len(key) > 1 && !bad[key[0]] {
+			issues = append(issues, &ConfigIssue{Path: path, Line: f.line(key), Key: key.String(), Message: "Unknown key"})
+		}
+	}
+	return f, issues
+}
+
+// A keyProblem is a problem with the value of a single key
+type keyProblem struct {
+	key     string
+	err     error
+	warning bool
+}
+
+// configProblems will check the values of the merged configuration, and
+// options that conflict with each other.
+func configProblems(c *Config) []keyProblem {
+	var problems []keyProblem
+	check := func(key string, err error) {
+		if err != nil {
+			problems = append(problems, keyProblem{key: key, err: err})
+		}
+	}
+	warn := func(key, message string) {
+		problems = append(problems, keyProblem{key: key, err: fmt.Errorf("%s", message), warning: true})
+	}
+	if !ValidSBOMFormat(c.SBOMFormat) {
+		check("sbom_format", ErrUnknownSBOMFormat)
+	}
+	check("history_formats", ValidHistoryFormats(c.HistoryFormats))
+	if !ValidPatchCheck(c.PatchCheck) {
+		check("patch_check", ErrUnknownPatchCheck)
+	}
+	if !ValidSizeCheck(c.SizeCheck) {
+		check("size_check", ErrUnknownSizeCheck)
+	}
+	if !ValidBackend(c.Backend) {
+		check("backend", ErrUnknownBackend)
+	}
+	if !ValidPromotion(c.StackPromotion) {
+		check("stack_promotion", ErrUnknownPromotion)
+	}
+	if !ValidCollision(c.ArtifactCollision) {
+		check("artifact_collision", ErrUnknownCollision)
+	}
+	check("artifact_name", ValidArtifactName(c.ArtifactName))
+	check("ccache_seed_url", ValidCcacheSeedURL(c.CcacheSeedURL))
+	if c.CcacheSeedURL != "" && c.CcacheSeedKey == "" {
+		check("ccache_seed_key", ErrNoCcacheSeedKey)
+	}
+	check("image_format", ValidImageFormat(c.ImageFormat))
+	check("language_caches", ValidLanguageCaches(c.LanguageCaches))
+	for _, dir := range c.MountSources {
+		if !filepath.IsAbs(dir) || filepath.Clean(dir) == "/" {
+			check("mount_sources", fmt.Errorf("Mount sources must be absolute directories other than /, got '%s'", dir))
+		}
+	}
+	_, err := ParseKeepRoot(c.KeepRoot)
+	check("keep_root", err)
+	_, err = NewCompression(c.CompressionLevel, c.CompressionThreads)
+	check("compression_level", err)
+	check("hooks", ValidHooks(c.Hooks))
+	if c.ExtractThreads < 0 {
+		check("extract_threads", ErrInvalidExtractThreads)
+	}
+	_, err = SccacheRemoteEnvironment(c.SccacheRemote)
+	check("sccache_remote", err)
+	_, err = ParseSize(c.LanguageCacheSize)
+	check("language_cache_size", err)
+	_, err = ParseSize(c.SizeGrowthMinimum)
+	check("size_growth_minimum", err)
+	_, err = ParseSize(c.FetchBandwidth)
+	check("fetch_bandwidth", err)
+	_, err = NewStageLimits(c.FetchNice, c.FetchIONice)
+	check("fetch_ionice", err)
+	_, err = NewStageLimits(c.BuildNice, c.BuildIONice)
+	check("build_ionice", err)
+	_, err = NewBuildTimeouts(c.Timeout, c.FetchTimeout, c.SetupTimeout, c.BuildTimeout)
+	check("timeout", err)
+	_, err = NewWebhooks(c)
+	check("webhooks", err)
+	_, err = buildTmpSize(c)
+	check("build_tmp_size", err)
+	for key, size := range map[string]string{"tmpfs_size": c.TmpfsSize, "zram_swap_size": c.ZramSwapSize} {
+		if size != "" && size != "auto" && !ValidMemSize(size) {
+			check(key, fmt.Errorf("Invalid size '%s'", size))
+		}
+	}
+	if c.DefaultProfile != "" {
+		if _, err := NewProfile(c.DefaultProfile); err != nil {
+			check("default_profile", fmt.Errorf("Unknown profile '%s'", c.DefaultProfile))
+		}
+	}
+	if c.SignPackages {
+		check("signing_key", CheckSigningKey(c.SigningKey))
+	}
+	if c.KeepRoot != "" && c.EnableTmpfs {
+		warn("keep_root", "Build roots in a tmpfs can't be kept, enable_tmpfs is set")
+	}
+	if c.SizeGrowthLimit != 0 && c.SizeCheck == "" {
+		warn("size_growth_limit", "Has no effect without size_check")
+	}
+	if c.SizeGrowthMinimum != "" && c.SizeCheck == "" {
+		warn("size_growth_minimum", "Has no effect without size_check")
+	}
+	if c.CompressionThreads > 0 && c.CompressionLevel == 0 {
+		warn("compression_threads", "xz keeps the default level of eopkg without compression_level")
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].key < problems[j].key })
+	return problems
+}
+
+// checkRepo will ensure the repository can be reached, either on disk for
+// local repos or with a HEAD request for remote ones.
+func checkRepo(repo *Repo, offline bool) error {
+	if repo.Local {
+		if st, err := os.Stat(repo.URI); err != nil || !st.IsDir() {
+			return fmt.Errorf("Local repository %s is not a directory", repo.URI)
+		}
+		return nil
+	}
+	if offline || !(strings.HasPrefix(repo.URI, "http://") || strings.HasPrefix(repo.URI, "https://")) {
+		return nil
+	}
+	client := &http.Client{Timeout: RepoCheckTimeout}
+	resp, err := client.Head(repo.URI)
+	if err != nil {
+		return fmt.Errorf("Repository %s is unreachable, reason: %s", Redact(repo.URI), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("Repository %s is unreachable: %s", Redact(repo.URI), resp.Status)
+	}
+	return nil
+}
+
+// profileProblems will check the values of the profile, the reachability of
+// its repositories, and options that conflict with each other.
+func profileProblems(p *Profile, offline bool) []keyProblem {
+	var problems []keyProblem
+	check := func(key string, err error) {
+		if err != nil {
+			problems = append(problems, keyProblem{key: key, err: err})
+		}
+	}
+	warn := func(key, message string) {
+		problems = append(problems, keyProblem{key: key, err: fmt.Errorf("%s", message), warning: true})
+	}
+	if !IsValidImage(p.Image) {
+		check("image", fmt.Errorf("'%s' is not a known image", p.Image))
+	}
+	check("ip_family", source.ValidIPFamily(p.IPFamily))
+	if p.PreferIPv4 && p.IPFamily == source.FamilyIPv6 {
+		warn("prefer_ipv4", "Has no effect with ip_family = \"ipv6\"")
+	}
+	check("rootfs_backend", ValidRootfsBackend(p.RootfsBackend))
+	if !ValidBackend(p.Backend) {
+		check("backend", ErrUnknownBackend)
+	}
+	if p.CPUBaseline != "" && !ValidCPUBaseline(p.CPUBaseline) {
+		check("cpu_baseline", ErrUnknownCPUBaseline)
+	}
+	_, err := NewResourceLimits(p.CPUQuota, p.MemoryMax, p.IOWeight)
+	check("memory_max", err)
+	_, err = ParseSize(p.CcacheMaxSize)
+	check("ccache_max_size", err)
+	_, err = NewChrootShell(p)
+	check("chroot_shell", err)
+	_, err = NewNetworkPolicy(p, &Package{}, false)
+	check("network", err)
+	var names []string
+	for name := range p.NetworkPackages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, err = NewNetworkPolicy(p, &Package{Name: name}, false)
+		check("network_packages."+name, err)
+	}
+	check("environment", checkEnvironment(p.Environment))
+	if len(p.NetworkAllow) > 0 && p.Network != NetworkAllowlist {
+		warn("network_allow", "Has no effect unless network = \"allowlist\"")
+	}
+	for _, pattern := range p.HistoryTagPatterns {
+		_, err = regexp.Compile(pattern)
+		check("history_tag_patterns", err)
+	}
+	if p.SecretsIdentity != "" && p.SecretsFile == "" {
+		warn("secrets_identity", "Has no effect without secrets_file")
+	}
+	names = nil
+	for name := range p.Repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		repo := p.Repos[name]
+		if err := checkRepo(repo, offline); err != nil {
+			problems = append(problems, keyProblem{key: "repo." + name + ".uri", err: err, warning: !repo.Local})
+		}
+	}
+	return problems
+}
+
+// configFiles returns the configuration files in the order they're loaded
+func configFiles() []string {
+	var files []string
+	for i := len(ConfigPaths) - 1; i >= 0; i-- {
+		configs, _ := filepath.Glob(filepath.Join(ConfigPaths[i], "*"+ConfigSuffix))
+		files = append(files, configs...)
+	}
+	return files
+}
+
+// ValidateConfig will check every configuration file and profile, returning
+// all the issues found. Remote repositories aren't contacted when offline.
+func ValidateConfig(offline bool) []*ConfigIssue {
+	var issues []*ConfigIssue
+
+	// Later files override the keys of earlier ones
+	var owners []*configFile
+	schemaOK := true
+	for _, path := range configFiles() {
+		f, found := checkSchema(path, &Config{})
+		owners = append(owners, f)
+		issues = append(issues, found...)
+		schemaOK = schemaOK && len(found) == 0
+	}
+	if schemaOK {
+		config, err := NewConfig()
+		if err != nil {
+			issues = append(issues, &ConfigIssue{Path: "solbuild.conf", Message: err.Error()})
+		} else {
+			for _, problem := range configProblems(config) {
+				owner := &configFile{path: "solbuild.conf"}
+				for _, f := range owners {
+					if f.line(splitKey(problem.key)) > 0 {
+						owner = f
+					}
+				}
+				issues = append(issues, owner.issue(problem.key, problem.err.Error(), problem.warning))
+			}
+		}
+	}
+
+	for _, dir := range ConfigPaths {
+		profiles, _ := filepath.Glob(filepath.Join(dir, "*"+ProfileSuffix))
+		for _, path := range profiles {
+			f, found := checkSchema(path, &Profile{})
+			issues = append(issues, found...)
+			if len(found) > 0 {
+				continue
+			}
+			profile, err := NewProfileFromPath(path)
+			if err != nil {
+				issues = append(issues, &ConfigIssue{Path: path, Message: err.Error()})
+				continue
+			}
+			for _, problem := range profileProblems(profile, offline) {
+				issues = append(issues, f.issue(problem.key, problem.err.Error(), problem.warning))
+			}
+		}
+	}
+	return issues
+}
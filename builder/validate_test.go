@@ -0,0 +1,94 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSchema(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.profile")
+	writeTestFile(t, path, `image = "unstable-x86_64"
+imgae = "typo"
+history_depth = "ten"
+
+[repo.Solus]
+uri = "https://example.com/eopkg-index.xml.xz"
+autoindx = true
+
+[submodule_rewrite]
+"git://git.example.com/" = "https://mirror.example.com/"
+`)
+	_, issues := checkSchema(path, &Profile{})
+	found := make(map[string]*ConfigIssue)
+	for _, issue := range issues {
+		found[issue.Key] = issue
+	}
+	if len(issues) != 3 {
+		t.Fatalf("Expected 3 issues, found: %v", issues)
+	}
+	if issue := found["imgae"]; issue == nil || issue.Line != 2 {
+		t.Fatalf("Expected the unknown key on line 2: %v", issue)
+	}
+	if issue := found["history_depth"]; issue == nil || issue.Line != 3 {
+		t.Fatalf("Expected the type error on line 3: %v", issue)
+	}
+	if issue := found["repo.Solus.autoindx"]; issue == nil || issue.Line != 7 {
+		t.Fatalf("Expected the unknown repo key on line 7: %v", issue)
+	}
+
+	writeTestFile(t, path, "image = \"unstable-x86_64\"\nadd_repos = [\n")
+	if _, issues = checkSchema(path, &Profile{}); len(issues) != 1 || issues[0].Line == 0 {
+		t.Fatalf("Expected a syntax error with its line: %v", issues)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	saved := ConfigPaths
+	ConfigPaths = []string{dir}
+	defer func() { ConfigPaths = saved }()
+
+	writeTestFile(t, filepath.Join(dir, "solbuild.conf"), `default_profile = "local"
+sbom_format = "bom"
+size_growth_limit = 10
+`)
+	writeTestFile(t, filepath.Join(dir, "local.profile"), `image = "unstable-x86_64"
+network_allow = ["example.com"]
+
+[repo.Local]
+uri = "`+filepath.Join(dir, "missing")+`"
+local = true
+`)
+	var errors, warnings []string
+	for _, issue := range ValidateConfig(true) {
+		if issue.Warning {
+			warnings = append(warnings, issue.String())
+		} else {
+			errors = append(errors, issue.String())
+		}
+	}
+	if len(errors) != 2 || !strings.Contains(errors[0], "solbuild.conf:2: sbom_format") || !strings.Contains(errors[1], "local.profile:5: repo.Local.uri") {
+		t.Fatalf("Expected the SBOM format and missing repo as errors: %v", errors)
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("Expected the conflicting options as warnings: %v", warnings)
+	}
+}
@@ -0,0 +1,54 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+)
+
+// Warm will populate the shared caches with everything needed to build the
+// package, without actually building it. The sources are fetched into the
+// source cache, and the build dependencies are downloaded into the package
+// cache by installing them into a throwaway root.
+func (p *Package) Warm(notif PidNotifier, history *PackageHistory, profile *Profile, pman *EopkgManager, overlay *Overlay) error {
+	log.Debugf("Warming caches for package %s %s %d %s %s\n", p.Name, p.Version, p.Release, p.Type, overlay.Back.Name)
+
+	if p.Type == PackageTypeXML {
+		ChrootEnvironment = SaneEnvironment("root", "/root")
+	} else {
+		ChrootEnvironment = SaneEnvironment(BuildUser, BuildUserHome)
+	}
+
+	if err := p.prepareRoot(notif, history, profile, pman, overlay); err != nil {
+		return err
+	}
+
+	// Legacy builds resolve their dependencies within eopkg itself
+	if p.Type == PackageTypeYpkg {
+		log.Debugf("Fetching build dependencies %s\n", p.Path)
+		if err := p.installDeps(notif, pman, overlay); err != nil {
+			return fmt.Errorf("Failed to fetch build dependencies %s, reason: %s\n", p.Path, err)
+		}
+	}
+
+	log.Debugln("Stopping D-BUS")
+	if err := pman.StopDBUS(); err != nil {
+		return fmt.Errorf("Failed to stop d-bus, reason: %s\n", err)
+	}
+	return nil
+}
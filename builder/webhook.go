@@ -0,0 +1,234 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	// EventQueued is sent when a build is waiting for a free worker slot
+	EventQueued = "queued"
+
+	// EventStarted is sent once the build holds the lock of its root
+	EventStarted = "started"
+
+	// EventStageChanged is sent as the build enters each phase
+	EventStageChanged = "stage-changed"
+
+	// EventFinished is sent with the outcome of the build
+	EventFinished = "finished"
+
+	// WebhookSignatureHeader carries the HMAC-SHA256 of the request body,
+	// keyed with the webhook secret
+	WebhookSignatureHeader = "X-Solbuild-Signature"
+
+	// WebhookEventHeader carries the type of the event
+	WebhookEventHeader = "X-Solbuild-Event"
+
+	// webhookAttempts is how many times each event is sent to an endpoint
+	webhookAttempts = 3
+
+	// webhookDrainTimeout is how long pending events are given to be sent
+	// before solbuild exits
+	webhookDrainTimeout = 30 * time.Second
+)
+
+var (
+	// ActiveWebhooks receives the events of the current build, if any
+	ActiveWebhooks *Webhooks
+)
+
+// A BuildEvent describes a change in the lifecycle of a build
+type BuildEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Recipe   string    `json:"recipe,omitempty"`
+	Package  string    `json:"package,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	Release  int       `json:"release,omitempty"`
+	Profile  string    `json:"profile,omitempty"`
+	Stage    string    `json:"stage,omitempty"`
+	Success  bool      `json:"success,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // Seconds since the build started
+}
+
+// NewBuildEvent will create an event for the package, built with the profile
+func NewBuildEvent(event string, pkg *Package, profile string) *BuildEvent {
+	e := &BuildEvent{
+		Event:   event,
+		Time:    time.Now().UTC(),
+		Profile: profile,
+	}
+	e.Host, _ = os.Hostname()
+	if pkg != nil {
+		e.Recipe = pkg.Path
+		e.Package = pkg.Name
+		e.Version = pkg.Version
+		e.Release = pkg.Release
+	}
+	return e
+}
+
+// Webhooks deliver build events as JSON to each endpoint in turn, in the
+// background, so that a slow endpoint never holds up the build.
+type Webhooks struct {
+	Endpoints []string // URLs the events are posted to
+	Secret    string   // Key of the HMAC signature of each event, if any
+
+	profile string // Profile of the build, for events that don't know it
+	client  *http.Client
+	pending chan *BuildEvent
+	done    chan struct{}
+}
+
+// NewWebhooks will start delivering events to the endpoints of the config,
+// returning nil when there are none.
+func NewWebhooks(config *Config) (*Webhooks, error) {
+	if len(config.Webhooks) == 0 {
+		return nil, nil
+	}
+	for _, endpoint := range config.Webhooks {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("Invalid webhook endpoint %s", Redact(endpoint))
+		}
+	}
+	if config.WebhookSecret != "" {
+		AddRedaction(config.WebhookSecret)
+	}
+	w := &Webhooks{
+		Endpoints: config.Webhooks,
+		Secret:    config.WebhookSecret,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		pending:   make(chan *BuildEvent, 64),
+		done:      make(chan struct{}),
+	}
+	go w.deliver()
+	return w, nil
+}
+
+// Sign returns the signature of the body, as sent in WebhookSignatureHeader
+func (w *Webhooks) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Emit will queue the event for delivery, dropping it if the endpoints have
+// fallen too far behind.
+func (w *Webhooks) Emit(event *BuildEvent) {
+	if w == nil {
+		return
+	}
+	if event.Profile == "" {
+		event.Profile = w.profile
+	}
+	select {
+	case w.pending <- event:
+	default:
+		log.Warnf("Dropping %s webhook event, the endpoints are too slow\n", event.Event)
+	}
+}
+
+// Close will wait for the pending events to be delivered, for a while
+func (w *Webhooks) Close() {
+	if w == nil {
+		return
+	}
+	close(w.pending)
+	select {
+	case <-w.done:
+	case <-time.After(webhookDrainTimeout):
+		log.Warnln("Timed out delivering webhook events")
+	}
+}
+
+// deliver sends each event to every endpoint, in order
+func (w *Webhooks) deliver() {
+	defer close(w.done)
+	for event := range w.pending {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Warnf("Unable to encode webhook event, reason: %s\n", err)
+			continue
+		}
+		for _, endpoint := range w.Endpoints {
+			if err := w.post(endpoint, event.Event, body); err != nil {
+				log.Warnf("Unable to deliver %s event to %s, reason: %s\n", event.Event, Redact(endpoint), err)
+			}
+		}
+	}
+}
+
+// post will send the event to the endpoint, retrying failed attempts
+func (w *Webhooks) post(endpoint, event string, body []byte) (err error) {
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "solbuild")
+		req.Header.Set(WebhookEventHeader, event)
+		if w.Secret != "" {
+			req.Header.Set(WebhookSignatureHeader, w.Sign(body))
+		}
+		var resp *http.Response
+		if resp, err = w.client.Do(req); err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("Endpoint responded with %s", resp.Status)
+		// Client errors won't be fixed by trying again
+		if resp.StatusCode < 500 {
+			return err
+		}
+	}
+	return err
+}
+
+// enterPhase moves the build into the phase, starting its timeout and
+// announcing it to any webhooks.
+func (p *Package) enterPhase(phase string) error {
+	if err := ActiveWatchdog.enter(phase); err != nil {
+		return err
+	}
+	setLogPhase(phase)
+	event := NewBuildEvent(EventStageChanged, p, "")
+	event.Stage = phase
+	ActiveWebhooks.Emit(event)
+	return nil
+}
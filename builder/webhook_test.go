@@ -0,0 +1,88 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestWebhooks(t *testing.T) {
+	var lock sync.Mutex
+	var events []string
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		hooks := &Webhooks{Secret: "hunter2"}
+		if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(hooks.Sign(body))) {
+			t.Errorf("Invalid signature %s", r.Header.Get(WebhookSignatureHeader))
+		}
+		var event BuildEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		if event.Event != r.Header.Get(WebhookEventHeader) || event.Package != "nano" || event.Profile != "main-x86_64" {
+			t.Errorf("Unexpected event %+v", event)
+		}
+		events = append(events, event.Event+event.Stage)
+	}))
+	defer server.Close()
+
+	webhooks, err := NewWebhooks(&Config{Webhooks: []string{server.URL}, WebhookSecret: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.profile = "main-x86_64"
+	pkg := &Package{Name: "nano", Version: "5.9", Release: 150}
+	webhooks.Emit(NewBuildEvent(EventStarted, pkg, ""))
+	ActiveWebhooks = webhooks
+	if err := pkg.enterPhase(PhaseSetup); err != nil {
+		t.Fatal(err)
+	}
+	ActiveWebhooks = nil
+	webhooks.Emit(NewBuildEvent(EventFinished, pkg, "main-x86_64"))
+	webhooks.Close()
+
+	expected := []string{EventStarted, EventStageChanged + PhaseSetup, EventFinished}
+	if len(events) != len(expected) {
+		t.Fatalf("Unexpected events %v", events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Unexpected events %v", events)
+		}
+	}
+
+	if _, err := NewWebhooks(&Config{Webhooks: []string{"ftp://example.com"}}); err == nil {
+		t.Fatalf("Endpoints other than http should be refused")
+	}
+	if webhooks, _ := NewWebhooks(&Config{}); webhooks != nil {
+		t.Fatalf("No endpoints should give no webhooks")
+	}
+}
@@ -0,0 +1,370 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A YmlQuoteStyle records how a scalar value was quoted in the original file
+type YmlQuoteStyle int
+
+const (
+	// YmlQuotePlain is an unquoted scalar
+	YmlQuotePlain YmlQuoteStyle = iota
+
+	// YmlQuoteSingle is a 'single quoted' scalar
+	YmlQuoteSingle
+
+	// YmlQuoteDouble is a "double quoted" scalar
+	YmlQuoteDouble
+)
+
+var (
+	// ymlCanonicalInt is an integer read back as the same text, which is left
+	// plain so a release stays an integer
+	ymlCanonicalInt = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`)
+
+	// ymlImplicitTypes are the plain scalars YAML resolves to something other
+	// than a string: integers, floats, timestamps, booleans and null.
+	ymlImplicitTypes = []*regexp.Regexp{
+		regexp.MustCompile(`^[-+]?(0b[01_]+|0x[0-9a-fA-F_]+|0o?[0-7_]+|[0-9][0-9_]*(:[0-5]?[0-9])*)$`),
+		regexp.MustCompile(`^[-+]?([0-9][0-9_]*(:[0-5]?[0-9])*)?\.?[0-9_]*([eE][-+]?[0-9]+)?$`),
+		regexp.MustCompile(`^[-+]?\.(inf|Inf|INF)$|^\.(nan|NaN|NAN)$`),
+		regexp.MustCompile(`^[0-9]{4}-[0-9]{1,2}-[0-9]{1,2}([Tt \t]|$)`),
+		regexp.MustCompile(`^(y|Y|yes|Yes|YES|n|N|no|No|NO|true|True|TRUE|false|False|FALSE|on|On|ON|off|Off|OFF)$`),
+		regexp.MustCompile(`^(~|null|Null|NULL|<<|=)$`),
+	}
+)
+
+// A YmlEntry is a single top level key within a package.yml, along with
+// everything needed to write it back out byte for byte.
+type YmlEntry struct {
+	Comments []string      // Comment and blank lines preceding the key
+	Key      string        // Name of the key
+	Value    string        // Raw value text, including any quotes
+	Quote    YmlQuoteStyle // Quoting style of the value
+	Comment  string        // Trailing inline comment, including leading whitespace
+	Children []string      // Indented lines belonging to this key (lists, blocks)
+
+	keyText   string // Key text including alignment, up to the ':'
+	valueLead string // Whitespace between the ':' and the value
+}
+
+// A YmlDocument is a format preserving representation of a package.yml.
+//
+// Only the top level keys are modelled, which is all that bump, edit and
+// convert style tooling need to touch. Everything else is retained verbatim
+// so that re-emitting an unmodified document is lossless, and modifications
+// produce minimal, reviewable diffs.
+type YmlDocument struct {
+	Entries  []*YmlEntry // Top level keys, in file order
+	Trailing []string    // Comment and blank lines after the last key
+
+	noNewline bool // Whether the file lacked a trailing newline
+}
+
+// ParseYmlDocument will parse the package.yml contents into a YmlDocument
+func ParseYmlDocument(data []byte) (*YmlDocument, error) {
+	// Validate it first, we don't want to round trip garbage
+	if _, err := NewYmlPackageFromBytes(data); err != nil {
+		return nil, err
+	}
+
+	doc := &YmlDocument{}
+	text := string(data)
+	if !strings.HasSuffix(text, "\n") {
+		doc.noNewline = true
+	}
+	text = strings.TrimSuffix(text, "\n")
+
+	var current *YmlEntry
+	var pending []string
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		// Blank & comment lines are attached to whatever follows them
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			pending = append(pending, line)
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '-' || !strings.Contains(line, ":") {
+			if current != nil {
+				current.Children = append(current.Children, pending...)
+				current.Children = append(current.Children, line)
+			} else {
+				doc.Trailing = append(doc.Trailing, pending...)
+				doc.Trailing = append(doc.Trailing, line)
+			}
+			pending = nil
+			continue
+		}
+		current = parseYmlEntry(line)
+		current.Comments = pending
+		pending = nil
+		doc.Entries = append(doc.Entries, current)
+	}
+	doc.Trailing = append(doc.Trailing, pending...)
+	return doc, nil
+}
+
+// ParseYmlDocumentFile will parse the package.yml at the given path
+func ParseYmlDocumentFile(path string) (*YmlDocument, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseYmlDocument(data)
+}
+
+// parseYmlEntry will split a top level "key : value # comment" line
+func parseYmlEntry(line string) *YmlEntry {
+	splits := strings.SplitN(line, ":", 2)
+	entry := &YmlEntry{
+		Key:     strings.TrimSpace(splits[0]),
+		keyText: splits[0],
+	}
+	rest := splits[1]
+	value := strings.TrimLeft(rest, " \t")
+	entry.valueLead = rest[:len(rest)-len(value)]
+
+	// Find the inline comment, being careful not to look inside quotes
+	inSingle, inDouble := false, false
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\'':
+			if !inDouble {
+				inSingle = !inSingle
+			}
+		case '"':
+			if !inSingle {
+				inDouble = !inDouble
+			}
+		case '#':
+			if !inSingle && !inDouble && (i == 0 || value[i-1] == ' ' || value[i-1] == '\t') {
+				stripped := strings.TrimRight(value[:i], " \t")
+				entry.Comment = value[len(stripped):]
+				value = stripped
+				i = len(value)
+			}
+		}
+	}
+	entry.Value = value
+	switch {
+	case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+		entry.Quote = YmlQuoteSingle
+	case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+		entry.Quote = YmlQuoteDouble
+	}
+	return entry
+}
+
+// Scalar will return the unquoted value of this entry
+func (e *YmlEntry) Scalar() string {
+	switch e.Quote {
+	case YmlQuoteSingle:
+		return strings.Replace(e.Value[1:len(e.Value)-1], "''", "'", -1)
+	case YmlQuoteDouble:
+		if s, err := strconv.Unquote(e.Value); err == nil {
+			return s
+		}
+		return e.Value[1 : len(e.Value)-1]
+	}
+	return e.Value
+}
+
+// needsQuoting determines whether a plain scalar would be misinterpreted,
+// either by its syntax or by being read as another type than a string. ypkg
+// reads recipes as YAML 1.1, so version: 1.10 would become 1.1.
+func needsQuoting(value string) bool {
+	if value == "" || strings.Contains(value, ": ") || strings.Contains(value, " #") {
+		return true
+	}
+	if strings.ContainsAny(value[:1], "!&*{}[]|>%@`'\",?:-#") {
+		return true
+	}
+	if ymlCanonicalInt.MatchString(value) {
+		return false
+	}
+	for _, implicit := range ymlImplicitTypes {
+		if implicit.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetScalar will set the entry to the given scalar value, keeping the
+// original quoting style where possible. Any child lines are dropped.
+func (e *YmlEntry) SetScalar(value string) {
+	quote := e.Quote
+	if quote == YmlQuotePlain && needsQuoting(value) {
+		quote = YmlQuoteSingle
+	}
+	switch quote {
+	case YmlQuoteSingle:
+		e.Value = "'" + strings.Replace(value, "'", "''", -1) + "'"
+	case YmlQuoteDouble:
+		e.Value = strconv.Quote(value)
+	default:
+		e.Value = value
+	}
+	e.Quote = quote
+	e.Children = nil
+	if e.valueLead == "" {
+		e.valueLead = " "
+	}
+}
+
+// Keys will return the top level keys in file order
+func (d *YmlDocument) Keys() []string {
+	var ret []string
+	for _, e := range d.Entries {
+		ret = append(ret, e.Key)
+	}
+	return ret
+}
+
+// Lookup will return the entry for the named key, if it exists
+func (d *YmlDocument) Lookup(key string) *YmlEntry {
+	for _, e := range d.Entries {
+		if e.Key == key {
+			return e
+		}
+	}
+	return nil
+}
+
+// Get will return the unquoted scalar value of the named key
+func (d *YmlDocument) Get(key string) (string, bool) {
+	e := d.Lookup(key)
+	if e == nil {
+		return "", false
+	}
+	return e.Scalar(), true
+}
+
+// Set will set the named key to the given scalar value. New keys are
+// inserted at the end of the flat header of the recipe (before the first
+// list or block key), aligned with the preceding key.
+func (d *YmlDocument) Set(key, value string) {
+	if e := d.Lookup(key); e != nil {
+		e.SetScalar(value)
+		return
+	}
+	insertAt := -1
+	for i, e := range d.Entries {
+		if e.Value == "" || e.Value == "|" || e.Value == ">" {
+			break
+		}
+		insertAt = i
+	}
+	entry := &YmlEntry{Key: key, keyText: key}
+	if insertAt >= 0 {
+		prev := d.Entries[insertAt].keyText
+		if len(prev) > len(key) {
+			entry.keyText = key + strings.Repeat(" ", len(prev)-len(key))
+		}
+	}
+	entry.SetScalar(value)
+	d.Entries = append(d.Entries, nil)
+	copy(d.Entries[insertAt+2:], d.Entries[insertAt+1:])
+	d.Entries[insertAt+1] = entry
+}
+
+// GetList will return the items of a top level list, such as builddeps
+func (d *YmlDocument) GetList(key string) []string {
+	e := d.Lookup(key)
+	if e == nil {
+		return nil
+	}
+	var ret []string
+	for _, line := range e.Children {
+		item := strings.TrimSpace(line)
+		if !strings.HasPrefix(item, "- ") {
+			continue
+		}
+		ret = append(ret, strings.TrimSpace(item[2:]))
+	}
+	return ret
+}
+
+// SetList will replace the items of a top level list, keeping the
+// indentation style of the existing items. The key is created if needed.
+func (d *YmlDocument) SetList(key string, items []string) {
+	e := d.Lookup(key)
+	if e == nil {
+		d.Set(key, "")
+		e = d.Lookup(key)
+		e.valueLead = ""
+	}
+	indent := "    "
+	for _, line := range e.Children {
+		if item := strings.TrimLeft(line, " \t"); strings.HasPrefix(item, "- ") {
+			indent = line[:len(line)-len(item)]
+			break
+		}
+	}
+	e.Value = ""
+	e.Quote = YmlQuotePlain
+	e.Children = nil
+	for _, item := range items {
+		e.Children = append(e.Children, indent+"- "+item)
+	}
+}
+
+// Remove will remove the named key, along with its children and preceding
+// comments. It returns false if the key doesn't exist.
+func (d *YmlDocument) Remove(key string) bool {
+	for i, e := range d.Entries {
+		if e.Key == key {
+			d.Entries = append(d.Entries[:i], d.Entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Bytes will re-emit the document. An unmodified document is returned
+// exactly as it was parsed.
+func (d *YmlDocument) Bytes() []byte {
+	var lines []string
+	for _, e := range d.Entries {
+		lines = append(lines, e.Comments...)
+		lines = append(lines, e.keyText+":"+e.valueLead+e.Value+e.Comment)
+		lines = append(lines, e.Children...)
+	}
+	lines = append(lines, d.Trailing...)
+	ret := strings.Join(lines, "\n")
+	if !d.noNewline {
+		ret += "\n"
+	}
+	return []byte(ret)
+}
+
+// WriteFile will write the document to the given path, keeping the
+// permissions of any existing file.
+func (d *YmlDocument) WriteFile(path string) error {
+	mode := os.FileMode(00644)
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode()
+	}
+	return ioutil.WriteFile(path, d.Bytes(), mode)
+}
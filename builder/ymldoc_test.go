@@ -0,0 +1,106 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+const (
+	ymlDocTestRecipe = `# Keep this comment
+name       : 'nano'
+version    : 2.9.8 # upstream stable
+release    : 1
+source     :
+    - https://www.nano-editor.org/dist/v2.9/nano-2.9.8.tar.xz : c2deac31ba4d3fd27a42fafcc47ccf499296cc69a422bbecab63f2933ea85488
+homepage   : "https://www.nano-editor.org/"
+
+summary    : Small, friendly text editor
+setup      : |
+    %configure
+
+    # Not a top level comment
+build      : |
+    %make`
+)
+
+func TestYmlDocumentRoundTrip(t *testing.T) {
+	doc, err := ParseYmlDocument([]byte(ymlDocTestRecipe))
+	if err != nil {
+		t.Fatalf("Failed to parse document: %v", err)
+	}
+	if out := string(doc.Bytes()); out != ymlDocTestRecipe {
+		t.Fatalf("Round trip was not lossless:\n%s", out)
+	}
+	keys := doc.Keys()
+	if len(keys) != 8 || keys[0] != "name" || keys[7] != "build" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+	if name, _ := doc.Get("name"); name != "nano" {
+		t.Fatalf("Wrong unquoted name: %s", name)
+	}
+	if homepage, _ := doc.Get("homepage"); homepage != "https://www.nano-editor.org/" {
+		t.Fatalf("Wrong unquoted homepage: %s", homepage)
+	}
+	if version, _ := doc.Get("version"); version != "2.9.8" {
+		t.Fatalf("Inline comment leaked into value: %s", version)
+	}
+}
+
+func TestYmlDocumentSet(t *testing.T) {
+	doc, err := ParseYmlDocument([]byte(ymlDocTestRecipe))
+	if err != nil {
+		t.Fatalf("Failed to parse document: %v", err)
+	}
+	doc.Set("name", "nano-editor")
+	doc.Set("version", "3.0")
+	doc.Set("license", "GPL-3.0-or-later")
+	if !doc.Remove("homepage") {
+		t.Fatal("Failed to remove existing key")
+	}
+	want := `# Keep this comment
+name       : 'nano-editor'
+version    : '3.0' # upstream stable
+release    : 1
+license    : GPL-3.0-or-later
+source     :
+    - https://www.nano-editor.org/dist/v2.9/nano-2.9.8.tar.xz : c2deac31ba4d3fd27a42fafcc47ccf499296cc69a422bbecab63f2933ea85488
+
+summary    : Small, friendly text editor
+setup      : |
+    %configure
+
+    # Not a top level comment
+build      : |
+    %make`
+	if out := string(doc.Bytes()); out != want {
+		t.Fatalf("Unexpected document after edits:\n%s", out)
+	}
+}
+
+func TestNeedsQuoting(t *testing.T) {
+	for _, value := range []string{"1.10", "3.0", "1e3", ".5", "yes", "on", "Off", "null", "~", "010", "+5", "0x1f", "1_000", "1:30", ".inf", "2021-05-01", "- item", "a: b"} {
+		if !needsQuoting(value) {
+			t.Errorf("%q should be quoted", value)
+		}
+	}
+	for _, value := range []string{"5", "0", "nano", "GPL-3.0-or-later", "2.9.8", "1.10rc1", "v1.10", "yesterday", "https://example.com/a.tar.xz"} {
+		if needsQuoting(value) {
+			t.Errorf("%q should be left plain", value)
+		}
+	}
+}
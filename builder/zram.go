@@ -0,0 +1,80 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/commands"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ActiveZramSwap is the zram swap provisioned for the current build, if any
+var ActiveZramSwap *ZramSwap
+
+// A ZramSwap is a temporary compressed swap device, provisioned for the
+// duration of a build to help memory constrained builders.
+type ZramSwap struct {
+	Device string // Path of the zram device, i.e. /dev/zram0
+	Size   string // Size of the device, i.e. 8G
+}
+
+// NewZramSwap will find a free zram device of the given size, and enable it
+// as a high priority swap device.
+func NewZramSwap(size string) (*ZramSwap, error) {
+	if err := commands.ExecStdoutArgs("modprobe", []string{"zram"}); err != nil {
+		return nil, fmt.Errorf("Failed to load zram module, reason: %s", err)
+	}
+	c := exec.Command("zramctl", "--find", "--size", size)
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find a free zram device, reason: %s", err)
+	}
+	z := &ZramSwap{Device: strings.TrimSpace(string(out)), Size: size}
+
+	if err := commands.ExecStdoutArgs("mkswap", []string{"-q", z.Device}); err != nil {
+		z.reset()
+		return nil, fmt.Errorf("Failed to format zram swap %s, reason: %s", z.Device, err)
+	}
+	if err := commands.ExecStdoutArgs("swapon", []string{"--priority", "32767", z.Device}); err != nil {
+		z.reset()
+		return nil, fmt.Errorf("Failed to enable zram swap %s, reason: %s", z.Device, err)
+	}
+	log.Infof("Enabled %s of zram swap on %s\n", size, z.Device)
+	ActiveZramSwap = z
+	return z, nil
+}
+
+// reset will release the zram device
+func (z *ZramSwap) reset() error {
+	return commands.ExecStdoutArgs("zramctl", []string{"--reset", z.Device})
+}
+
+// Remove will disable the swap and release the zram device
+func (z *ZramSwap) Remove() error {
+	if ActiveZramSwap == z {
+		ActiveZramSwap = nil
+	}
+	log.Debugf("Removing zram swap %s\n", z.Device)
+	if err := commands.ExecStdoutArgs("swapoff", []string{z.Device}); err != nil {
+		return fmt.Errorf("Failed to disable zram swap %s, reason: %s", z.Device, err)
+	}
+	return z.reset()
+}
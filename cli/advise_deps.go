@@ -0,0 +1,129 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"strings"
+)
+
+func init() {
+	register(&AdviseDeps)
+}
+
+// AdviseDeps proposes builddeps changes based on the linkage of the last build
+var AdviseDeps = cmd.Sub{
+	Name:  "advise-deps",
+	Alias: "ad",
+	Short: "Suggest builddeps changes from the linkage of the last build",
+	Flags: &AdviseDepsFlags{},
+	Args:  &AdviseDepsArgs{},
+	Run:   AdviseDepsRun,
+}
+
+// AdviseDepsFlags are flags for the "advise-deps" sub-command
+type AdviseDepsFlags struct {
+	Apply bool `short:"a" long:"apply" desc:"Write the proposed changes to the recipe"`
+}
+
+// AdviseDepsArgs are arguments for the "advise-deps" sub-command
+type AdviseDepsArgs struct {
+	Path []string `zero:"yes" desc:"Location of the package.yml file to analyse."`
+}
+
+// AdviseDepsRun carries out the "advise-deps" sub-command
+func AdviseDepsRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*AdviseDepsFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+		builder.DisableColors = true
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	pkgPath := strings.Join(s.Args.(*AdviseDepsArgs).Path, "")
+	if len(pkgPath) == 0 {
+		pkgPath = FindLikelyArg()
+	}
+	if len(pkgPath) == 0 {
+		log.Fatalln("No package.yml file in current directory and no file provided.")
+	}
+
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to analyse packages")
+	}
+	// Initialise the build manager
+	manager, err := builder.NewManager()
+	if err != nil {
+		os.Exit(1)
+	}
+	// Safety first..
+	if err = manager.SetProfile(rFlags.Profile); err != nil {
+		os.Exit(1)
+	}
+	pkg, err := builder.NewPackage(pkgPath)
+	if err != nil {
+		log.Fatalf("Failed to load package: %s\n", err)
+	}
+	// Set the package
+	if err := manager.SetPackage(pkg); err != nil {
+		if err == builder.ErrProfileNotInstalled {
+			fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
+		}
+		os.Exit(1)
+	}
+	advice, err := manager.AdviseDeps()
+	if err != nil {
+		log.Fatalf("Failed to analyse dependencies, reason: %s\n", err)
+	}
+	if advice.IsEmpty() {
+		log.Infoln("builddeps are already accurate")
+		return
+	}
+	for _, dep := range advice.Add {
+		log.Infof("Missing builddep: %s\n", dep)
+	}
+	for _, dep := range advice.Remove {
+		log.Warnf("Unused library builddep: %s\n", dep)
+	}
+	for old, dep := range advice.Switch {
+		log.Infof("Prefer %s over %s\n", dep, old)
+	}
+	if sFlags.Apply {
+		if err := advice.Apply(pkgPath); err != nil {
+			log.Fatalf("Failed to update recipe, reason: %s\n", err)
+		}
+		log.Infof("Updated builddeps in %s\n", pkgPath)
+		return
+	}
+	patch, err := advice.Patch(pkgPath)
+	if err != nil {
+		log.Fatalf("Failed to generate patch, reason: %s\n", err)
+	}
+	fmt.Print(patch)
+}
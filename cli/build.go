@@ -24,11 +24,11 @@ import (
 	"github.com/DataDrake/waterlog/level"
 	"github.com/getsolus/solbuild/builder"
 	"os"
-	"strings"
+	"strconv"
 )
 
 func init() {
-	cmd.Register(&Build)
+	register(&Build)
 }
 
 // Build package(s) in a chroot and output the archives
@@ -43,14 +43,54 @@ var Build = cmd.Sub{
 // BuildFlags are flags for the "build" sub-command
 type BuildFlags struct {
 	Tmpfs           bool   `short:"t" long:"tmpfs"              desc:"Enable building in a tmpfs"`
-	Memory          string `short:"m" long:"memory"             desc:"Set the tmpfs size to use, e.g. 8G"`
+	Memory          string `short:"m" long:"memory"             desc:"Set the tmpfs size to use, e.g. 8G, or auto"`
 	TransitManifest string `long:"transit-manifest"             desc:"Create transit manifest for the given target"`
 	ABIReport       bool   `short:"r" long:"disable-abi-report" desc:"Don't generate an ABI report of the completed build"`
+	CheckABI        bool   `long:"check-abi"                    desc:"Fail if the ABI report removes anything from the previous release"`
+	Locked          bool   `long:"locked"                       desc:"Refuse to build if the environment differs from solbuild.lock"`
+	AllowDirty      bool   `long:"allow-dirty"                  desc:"Build uncommitted recipe changes, tainting the packages"`
+	HistoryDepth    string `long:"history-depth"                desc:"Maximum number of changelog entries, or \"unlimited\""`
+	Env             string `long:"env"                          desc:"Comma separated KEY=VAL variables exported to the build, overriding the profile"`
+	SkipIdentical   bool   `long:"skip-identical"               desc:"Don't collect packages identical to the repository version"`
+	Diff            bool   `long:"diff"                         desc:"Report changes against the repository version of the packages"`
+	InstallTest     bool   `long:"install-test"                 desc:"Install the built packages and run solbuild-test.sh before collecting them"`
+	Trace           bool   `long:"trace"                        desc:"Record every command executed by the build into a trace file"`
+	CheckRetries    int    `long:"check-retries"                desc:"Attempts given to the check stage before failing the build"`
+	DryRun          bool   `long:"dry-run"                      desc:"Print every step of the build without performing it"`
+	Reproducible    bool   `long:"verify-reproducible"          desc:"Build twice in fresh overlays and report non-deterministic files"`
+	SBOM            string `long:"sbom"                         desc:"Write a software bill of materials, spdx or cyclonedx"`
+	Sign            bool   `long:"sign"                         desc:"Sign each built package with the configured signing_key"`
+	CheckPatches    string `long:"check-patches"                desc:"Check patches and sources before building, warn or strict"`
+	Repo            string `long:"repo"                         desc:"Local repo of the profile to feed stack builds into"`
+	Promote         string `long:"promote"                      desc:"Whether stacks build against their own packages: strict-local, prefer-local or repo-only"`
+	Jobs            int    `short:"j" long:"jobs"               desc:"Build up to this many independent recipes, or profiles, at once"`
+	Profiles        string `long:"profiles"                     desc:"Comma separated profiles to build the recipe against and compare"`
+	Workers         string `long:"workers"                      desc:"Comma separated URLs of solbuild workers to dispatch builds to"`
+	IfChanged       bool   `long:"if-changed"                   desc:"Skip the build if nothing changed since the packages were built"`
+	Manifest        string `long:"manifest"                     desc:"Build every entry of a build manifest, such as builds.yml"`
+	Results         string `long:"results"                      desc:"Where to write the results of a build manifest"`
+	CcacheSeed      string `long:"ccache-seed"                  desc:"URL to seed ccache from before building, e.g. https://host/{name}.tar.zst"`
+	ArtifactName    string `long:"artifact-name"                desc:"Template to name packages with, e.g. {name}-{version}-{release}-{build_id}"`
+	OnCollision     string `long:"on-collision"                 desc:"Overwrite, refuse or rename when a package already exists"`
+	KeepRoot        string `long:"keep-root"                    desc:"Keep the build root for this long to speed up rebuilds, e.g. 10m"`
+	ImageVersion    string `long:"image-version"                desc:"Build against a kept generation of the image, by number or date"`
+	Backend         string `long:"backend"                      desc:"Run the build commands with chroot, podman or nspawn"`
+	Foreground      bool   `long:"foreground"                   desc:"Don't lower the priorities of the fetch and build stages"`
+	CPUQuota        string `long:"cpu-quota"                    desc:"CPUs the build may use, i.e. 2 or 250%"`
+	MemoryMax       string `long:"memory-max"                   desc:"Memory the build may use before being OOM killed, i.e. 8G"`
+	IOWeight        int    `long:"io-weight"                    desc:"I/O weight of the build, from 1 to 10000"`
+	Compression     int    `long:"compression-level"            desc:"xz preset to compress the packages with, from 1 to 9"`
+	Threads         int    `long:"compression-threads"          desc:"Threads used to compress the packages"`
+	Timeout         string `long:"timeout"                      desc:"Tear down the build if it runs for longer, e.g. 2h"`
+	FetchTimeout    string `long:"fetch-timeout"                desc:"Tear down the build if fetching takes longer, e.g. 15m"`
+	SetupTimeout    string `long:"setup-timeout"                desc:"Tear down the build if setting up the root takes longer"`
+	BuildTimeout    string `long:"build-timeout"                desc:"Tear down the build if the build phase takes longer"`
+	AcceptSizes     bool   `long:"accept-size-growth"           desc:"Record the package sizes even if they grew beyond the limit"`
 }
 
 // BuildArgs are arguments for the "build" sub-command
 type BuildArgs struct {
-	Path []string `zero:"yes" desc:"Location of [package.yml|pspec.xml] file to build."`
+	Path []string `zero:"yes" desc:"Location of [package.yml|pspec.xml] file, or URL of a recipe, to build."`
 }
 
 // BuildRun carries out the "build" sub-command
@@ -65,26 +105,142 @@ func BuildRun(r *cmd.Root, s *cmd.Sub) {
 		log.SetFormat(format.Un)
 		builder.DisableColors = true
 	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
 
 	if sFlags.ABIReport {
 		log.Debugln("Not attempting generation of an ABI report")
 		builder.DisableABIReport = true
 	}
 
-	// Allow loading a build recipe from an arbitrary location
-	// (Convert from []string to string to allow usage of cli-ng's zero (optional) property.)
-	pkgPath := strings.Join(s.Args.(*BuildArgs).Path, "")
-	if len(pkgPath) == 0 {
+	if sFlags.CheckABI {
+		builder.CheckABIBreaks = true
+	}
+
+	if sFlags.SkipIdentical {
+		builder.SkipIdenticalRebuilds = true
+	}
+
+	if sFlags.Diff {
+		builder.ReportPackageDiff = true
+	}
+
+	if sFlags.InstallTest {
+		builder.InstallTest = true
+	}
+
+	if sFlags.Trace {
+		builder.TraceBuild = true
+	}
+
+	if sFlags.AllowDirty {
+		builder.AllowDirty = true
+	}
+
+	if sFlags.IfChanged {
+		builder.IfChanged = true
+	}
+
+	if sFlags.Foreground {
+		builder.Foreground = true
+	}
+
+	if sFlags.AcceptSizes {
+		builder.AcceptSizeGrowth = true
+	}
+
+	exited, status, err := builder.EnterRootless()
+	if err != nil {
+		log.Fatalf("You must be root to build packages, or able to build rootless: %s\n", err)
+	}
+	if exited {
+		os.Exit(status)
+	}
+
+	paths := s.Args.(*BuildArgs).Path
+	if sFlags.Manifest != "" {
+		if len(paths) > 0 {
+			log.Fatalln("Recipes cannot be given along with --manifest")
+		}
+		if os.Geteuid() != 0 {
+			log.Fatalln("You must be root to run build packages")
+		}
+		buildBatch(rFlags, sFlags)
+		return
+	}
+	if len(paths) == 0 {
 		// Otherwise look for a suitable file in the current directory
-		pkgPath = FindLikelyArg()
+		if pkgPath := FindLikelyArg(); pkgPath != "" {
+			paths = []string{pkgPath}
+		}
 	}
-	if len(pkgPath) == 0 {
+	if len(paths) == 0 {
 		log.Fatalln("No package.yml or pspec.xml file in current directory and no file provided.")
 	}
 
 	if os.Geteuid() != 0 {
 		log.Fatalln("You must be root to run build packages")
 	}
+	args := append([]string{}, paths...)
+	for i, path := range paths {
+		if !builder.IsRemoteRecipe(path) {
+			continue
+		}
+		recipe, err := builder.ParseRemoteRecipe(path)
+		if err != nil {
+			log.Fatalf("Invalid recipe %s, reason: %s\n", path, err)
+		}
+		if paths[i], err = builder.FetchRemoteRecipe(recipe); err != nil {
+			log.Fatalf("Failed to fetch recipe %s, reason: %s\n", recipe, err)
+		}
+	}
+	setBuildVariant()
+	builder.CollisionDir = os.Getenv(collisionDirEnv)
+	promotion, err := builder.LoadStackPromotion(os.Getenv(builder.StackPromotionEnv))
+	if err != nil {
+		log.Fatalf("Invalid stack promotion, reason: %s\n", err)
+	}
+	builder.ActivePromotion = promotion
+	if sFlags.Profiles != "" {
+		buildMatrix(rFlags, sFlags, args, paths)
+		return
+	}
+	// Several recipes, or a tree of them, are built as a stack, as is any
+	// build dispatched to workers
+	if st, err := os.Stat(paths[0]); len(paths) > 1 || sFlags.Workers != "" || (err == nil && st.IsDir()) {
+		buildStack(rFlags, sFlags, paths)
+		return
+	}
+	pkgPath := paths[0]
+	if sFlags.Reproducible {
+		verifyReproducible(pkgPath)
+		return
+	}
+	manager := newBuildManager(rFlags, sFlags, pkgPath)
+
+	if sFlags.DryRun {
+		plan, err := manager.Plan()
+		if err != nil {
+			log.Fatalf("Failed to plan build, reason: %s\n", err)
+		}
+		plan.Write(os.Stdout)
+		return
+	}
+
+	if err := manager.Build(); err == builder.ErrUpToDate {
+		return
+	} else if _, ok := err.(*builder.TimeoutError); ok {
+		os.Exit(builder.TimeoutExitStatus)
+	} else if err != nil {
+		log.Fatalln("Failed to build packages")
+	}
+	log.Infoln("Building succeeded")
+}
+
+// newBuildManager will create a manager for the recipe, configured by the
+// flags of the "build" sub-command.
+func newBuildManager(rFlags *GlobalFlags, sFlags *BuildFlags, pkgPath string) *builder.Manager {
 	// Initialise the build manager
 	manager, err := builder.NewManager()
 	if err != nil {
@@ -99,6 +255,67 @@ func BuildRun(r *cmd.Root, s *cmd.Sub) {
 		log.Fatalf("Failed to load package: %s\n", err)
 	}
 	manager.SetManifestTarget(sFlags.TransitManifest)
+	if sFlags.SBOM != "" {
+		manager.Config.SBOMFormat = sFlags.SBOM
+	}
+	if sFlags.Sign {
+		manager.Config.SignPackages = true
+	}
+	if sFlags.CheckPatches != "" {
+		manager.Config.PatchCheck = sFlags.CheckPatches
+	}
+	if sFlags.KeepRoot != "" {
+		manager.Config.KeepRoot = sFlags.KeepRoot
+	}
+	if sFlags.Backend != "" {
+		manager.Config.Backend = sFlags.Backend
+	}
+	prof := manager.GetProfile()
+	if sFlags.CPUQuota != "" {
+		prof.CPUQuota = sFlags.CPUQuota
+	}
+	if sFlags.MemoryMax != "" {
+		prof.MemoryMax = sFlags.MemoryMax
+	}
+	if sFlags.IOWeight != 0 {
+		prof.IOWeight = sFlags.IOWeight
+	}
+	if sFlags.CcacheSeed != "" {
+		manager.Config.CcacheSeedURL = sFlags.CcacheSeed
+	}
+	if sFlags.ArtifactName != "" {
+		manager.Config.ArtifactName = sFlags.ArtifactName
+	}
+	if sFlags.OnCollision != "" {
+		manager.Config.ArtifactCollision = sFlags.OnCollision
+	}
+	if sFlags.Compression != 0 {
+		manager.Config.CompressionLevel = sFlags.Compression
+	}
+	if sFlags.Threads != 0 {
+		manager.Config.CompressionThreads = sFlags.Threads
+	}
+	if sFlags.Timeout != "" {
+		manager.Config.Timeout = sFlags.Timeout
+	}
+	if sFlags.FetchTimeout != "" {
+		manager.Config.FetchTimeout = sFlags.FetchTimeout
+	}
+	if sFlags.SetupTimeout != "" {
+		manager.Config.SetupTimeout = sFlags.SetupTimeout
+	}
+	if sFlags.BuildTimeout != "" {
+		manager.Config.BuildTimeout = sFlags.BuildTimeout
+	}
+	manager.SetLocked(sFlags.Locked)
+	manager.SetImageVersion(sFlags.ImageVersion)
+	if sFlags.HistoryDepth != "" {
+		depth, err := parseHistoryDepth(sFlags.HistoryDepth)
+		if err != nil {
+			log.Fatalf("Invalid history depth: %s\n", err)
+		}
+		manager.SetHistoryDepth(depth)
+	}
 	// Set the package
 	if err := manager.SetPackage(pkg); err != nil {
 		if err == builder.ErrProfileNotInstalled {
@@ -107,6 +324,17 @@ func BuildRun(r *cmd.Root, s *cmd.Sub) {
 		os.Exit(1)
 	}
 
+	if sFlags.CheckRetries > 0 {
+		builder.CheckRetries = sFlags.CheckRetries
+	}
+	if sFlags.Env != "" {
+		env, err := builder.ParseEnvironment(sFlags.Env)
+		if err != nil {
+			log.Fatalf("Invalid --env: %s\n", err)
+		}
+		builder.BuildEnvironment = env
+	}
+
 	// Handle tmpfs and memory size options
 	if sFlags.Tmpfs == true {
 		if sFlags.Memory != "" {
@@ -124,9 +352,21 @@ func BuildRun(r *cmd.Root, s *cmd.Sub) {
 			manager.SetTmpfs(manager.Config.EnableTmpfs, sFlags.Memory)
 		}
 	}
+	return manager
+}
 
-	if err := manager.Build(); err != nil {
-		log.Fatalln("Failed to build packages")
+// parseHistoryDepth will convert the --history-depth flag into a depth for
+// the manager.
+func parseHistoryDepth(depth string) (int, error) {
+	if depth == "unlimited" {
+		return builder.UnlimitedChangelogEntries, nil
 	}
-	log.Infoln("Building succeeded")
+	n, err := strconv.Atoi(depth)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("depth must be at least 1, got %d", n)
+	}
+	return n, nil
 }
@@ -0,0 +1,147 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// buildBatch will build every entry of the build manifest in turn, each with
+// its own profile and output directory, then write the results file. Every
+// entry is attempted even when an earlier one fails.
+func buildBatch(rFlags *GlobalFlags, sFlags *BuildFlags) {
+	manifest, err := builder.LoadBatchManifest(sFlags.Manifest)
+	if err != nil {
+		log.Fatalf("Failed to load the build manifest, reason: %s\n", err)
+	}
+	resultsPath := sFlags.Results
+	if resultsPath == "" {
+		resultsPath = strings.TrimSuffix(sFlags.Manifest, filepath.Ext(sFlags.Manifest)) + ".results.json"
+	}
+	if sFlags.DryRun {
+		for i, entry := range manifest.Builds {
+			log.Infof("%3d. %s (profile: %s, output: %s)\n", i+1, entry.Recipe, batchProfile(rFlags, entry), entry.Output)
+		}
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Unable to find solbuild, reason: %s\n", err)
+	}
+
+	// Bring the history caches up to date before each build reads them
+	var pkgfiles []string
+	for _, entry := range manifest.Builds {
+		pkgfiles = append(pkgfiles, entry.Recipe)
+	}
+	builder.PrefetchHistories(pkgfiles)
+
+	// Announce the whole batch, each build reports its own progress
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load the configuration, reason: %s\n", err)
+	}
+	webhooks, err := builder.NewWebhooks(config)
+	if err != nil {
+		log.Fatalf("Invalid webhook specified: %s\n", err)
+	}
+	for _, entry := range manifest.Builds {
+		event := builder.NewBuildEvent(builder.EventQueued, nil, batchProfile(rFlags, entry))
+		event.Recipe = entry.Recipe
+		webhooks.Emit(event)
+	}
+
+	results := &builder.BatchResults{Manifest: sFlags.Manifest}
+	if abs, err := filepath.Abs(sFlags.Manifest); err == nil {
+		results.Manifest = abs
+	}
+	usr := builder.GetUserInfo()
+	for i, entry := range manifest.Builds {
+		log.Infof("Building %s (%d of %d)\n", entry.Recipe, i+1, len(manifest.Builds))
+		started := time.Now()
+		err := func() error {
+			if err := os.MkdirAll(entry.Output, 00755); err != nil {
+				return err
+			}
+			if err := os.Chown(entry.Output, usr.UID, usr.GID); err != nil {
+				log.Errorf("Error in restoring file ownership %s, reason: %s\n", entry.Output, err)
+			}
+			c := exec.Command(self, batchArgs(entry)...)
+			c.Dir = entry.Output
+			c.Stdout = builder.Stdout
+			c.Stderr = os.Stderr
+			return c.Run()
+		}()
+		result := builder.NewBatchResult(entry, time.Since(started), err)
+		results.Add(result)
+		if err != nil {
+			log.Errorf("Failed to build %s, reason: %s\n", entry.Recipe, err)
+		}
+	}
+	webhooks.Close()
+
+	if err := results.Write(resultsPath); err != nil {
+		log.Fatalf("Failed to write the results, reason: %s\n", err)
+	}
+	if err := os.Chown(resultsPath, usr.UID, usr.GID); err != nil {
+		log.Errorf("Error in restoring file ownership %s, reason: %s\n", resultsPath, err)
+	}
+	log.Infof("Wrote the results to %s\n", resultsPath)
+	if results.Failed > 0 {
+		log.Fatalf("Built %d of %d entries, %d failed\n", results.Succeeded, len(results.Results), results.Failed)
+	}
+	log.Infof("Building succeeded for %d entries\n", results.Succeeded)
+}
+
+// batchProfile returns the profile the entry is built with
+func batchProfile(rFlags *GlobalFlags, entry *builder.BatchEntry) string {
+	switch {
+	case entry.Profile != "":
+		return entry.Profile
+	case rFlags.Profile != "":
+		return rFlags.Profile
+	}
+	return "default"
+}
+
+// batchArgs will reuse our own arguments to build the entry, less those of
+// the batch itself, and with the profile of the entry if it has one.
+func batchArgs(entry *builder.BatchEntry) []string {
+	var args []string
+	if entry.Profile != "" {
+		args = append(args, "-p", entry.Profile)
+	}
+	original := os.Args[1:]
+	for i := 0; i < len(original); i++ {
+		arg := original[i]
+		switch {
+		case arg == "--manifest" || arg == "--results":
+			i++
+		case entry.Profile != "" && (arg == "-p" || arg == "--profile"):
+			i++
+		default:
+			args = append(args, arg)
+		}
+	}
+	return append(args, entry.Recipe)
+}
@@ -0,0 +1,229 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"github.com/getsolus/solbuild/builder"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildMatrix will build the recipe against each of the comma separated
+// profiles in its own solbuild process, collecting the results of each into
+// a directory named after the profile and reporting how they compare.
+func buildMatrix(rFlags *GlobalFlags, sFlags *BuildFlags, args, paths []string) {
+	if len(paths) > 1 || sFlags.Workers != "" || sFlags.Reproducible {
+		log.Fatalln("--profiles only supports building a single recipe locally")
+	}
+	if rFlags.Profile != "" {
+		log.Fatalln("--profile cannot be given along with --profiles")
+	}
+	if st, err := os.Stat(paths[0]); err == nil && st.IsDir() {
+		log.Fatalln("--profiles only supports building a single recipe locally")
+	}
+	pkg, err := builder.NewPackage(paths[0])
+	if err != nil {
+		log.Fatalf("Failed to load package: %s\n", err)
+	}
+	var profiles []string
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(sFlags.Profiles, ",") {
+		if p = strings.TrimSpace(p); p == "" || seen[p] {
+			continue
+		}
+		if _, err := builder.NewProfile(p); err != nil {
+			log.Fatalf("Invalid profile %s, reason: %s\n", p, err)
+		}
+		seen[p] = true
+		profiles = append(profiles, p)
+	}
+	if len(profiles) == 0 {
+		log.Fatalln("No profiles given to --profiles")
+	}
+	for i, p := range profiles {
+		log.Infof("%3d. %s\n", i+1, p)
+	}
+	if sFlags.DryRun {
+		return
+	}
+
+	jobs := sFlags.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > 1 {
+		log.Infof("Building against up to %d profiles at once\n", jobs)
+	}
+	m := newMatrixWorker(args, profiles)
+	results := make([]*builder.MatrixResult, len(profiles))
+	slots := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, p := range profiles {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, profile string) {
+			defer wg.Done()
+			results[i] = m.build(profile, paths[0])
+			<-slots
+		}(i, p)
+	}
+	wg.Wait()
+
+	name := fmt.Sprintf("%s-%s-%d%s", pkg.Name, pkg.Version, pkg.Release, builder.MatrixReportSuffix)
+	report, err := os.Create(name)
+	if err != nil {
+		log.Fatalf("Failed to write the matrix report, reason: %s\n", err)
+	}
+	defer report.Close()
+	if err = builder.WriteMatrixReport(io.MultiWriter(os.Stdout, report), results); err != nil {
+		log.Fatalf("Failed to compare the packages, reason: %s\n", err)
+	}
+	usr := builder.GetUserInfo()
+	if err = os.Chown(name, usr.UID, usr.GID); err != nil {
+		log.Errorf("Error in restoring file ownership %s, reason: %s\n", name, err)
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			report.Close()
+			os.Exit(1)
+		}
+	}
+	log.Infof("Building succeeded against %d profiles\n", len(profiles))
+}
+
+// A matrixWorker builds the recipe against each profile in its own solbuild
+// process, so that builds may run at the same time with separate overlays.
+type matrixWorker struct {
+	stack *stackWorker // Borrowed for its prefixed output
+	args  []string     // Our arguments, less those choosing the profiles
+}
+
+// newMatrixWorker will prepare to build against the profiles, reusing our
+// own arguments for each build.
+func newMatrixWorker(args []string, profiles []string) *matrixWorker {
+	m := &matrixWorker{stack: &stackWorker{}}
+	skip := make(map[string]bool)
+	for _, arg := range args {
+		skip[arg] = true
+	}
+	osArgs := os.Args[1:]
+	for i := 0; i < len(osArgs); i++ {
+		switch {
+		case osArgs[i] == "-j" || osArgs[i] == "--jobs" || osArgs[i] == "--profiles" ||
+			osArgs[i] == "-p" || osArgs[i] == "--profile":
+			i++
+		case skip[osArgs[i]]:
+			skip[osArgs[i]] = false
+		default:
+			m.args = append(m.args, osArgs[i])
+		}
+	}
+	for _, p := range profiles {
+		if len(p) > m.stack.width {
+			m.stack.width = len(p)
+		}
+	}
+	return m
+}
+
+// build will build the recipe against the profile in a separate process and
+// directory, then collect its results into a directory named after the
+// profile.
+func (m *matrixWorker) build(profile, pkgPath string) *builder.MatrixResult {
+	result := &builder.MatrixResult{Profile: profile}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+	outDir, err := ioutil.TempDir("", "solbuild-matrix-")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer os.RemoveAll(outDir)
+	self, err := os.Executable()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	absPath, err := filepath.Abs(pkgPath)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	collectDir := filepath.Join(wd, profile)
+
+	pr, pw := io.Pipe()
+	copied := make(chan struct{})
+	go func() {
+		m.stack.prefix(profile, pr)
+		close(copied)
+	}()
+	c := exec.Command(self, append(m.args, "--profile", profile, absPath)...)
+	c.Dir = outDir
+	c.Env = append(os.Environ(), fmt.Sprintf("%s=%s", collisionDirEnv, collectDir))
+	c.Stdout = pw
+	c.Stderr = pw
+	err = c.Run()
+	pw.Close()
+	<-copied
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Packages, result.Err = collectMatrix(outDir, collectDir)
+	return result
+}
+
+// collectMatrix will copy the results of a build into the directory,
+// returning the paths of the collected packages.
+func collectMatrix(outDir, collectDir string) ([]string, error) {
+	usr := builder.GetUserInfo()
+	if err := os.MkdirAll(collectDir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create %s, reason: %s", collectDir, err)
+	}
+	if err := os.Chown(collectDir, usr.UID, usr.GID); err != nil {
+		log.Errorf("Error in restoring file ownership %s, reason: %s\n", collectDir, err)
+	}
+	results, _ := filepath.Glob(filepath.Join(outDir, "*"))
+	var packages []string
+	for _, p := range results {
+		tgt := filepath.Join(collectDir, filepath.Base(p))
+		if err := disk.CopyFile(p, tgt); err != nil {
+			return nil, fmt.Errorf("Unable to collect build file, reason: %s", err)
+		}
+		if err := os.Chown(tgt, usr.UID, usr.GID); err != nil {
+			log.Errorf("Error in restoring file ownership %s, reason: %s\n", tgt, err)
+		}
+		if strings.HasSuffix(tgt, ".eopkg") {
+			packages = append(packages, tgt)
+		}
+	}
+	return packages, nil
+}
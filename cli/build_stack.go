@@ -0,0 +1,378 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"github.com/getsolus/solbuild/builder"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// collisionDirEnv passes the directory the packages of a build are
+	// finally collected into, so collisions are checked against it
+	collisionDirEnv = "SOLBUILD_COLLISION_DIR"
+)
+
+// buildStack will build every recipe found in the paths in dependency order,
+// feeding the packages of each into a local repo for the recipes after it.
+// With more than one job, independent recipes are built at the same time.
+func buildStack(rFlags *GlobalFlags, sFlags *BuildFlags, paths []string) {
+	if sFlags.Reproducible {
+		log.Fatalln("--verify-reproducible only supports a single recipe")
+	}
+	stack, err := builder.NewBuildStack(paths)
+	if err != nil {
+		log.Fatalf("Failed to load recipes, reason: %s\n", err)
+	}
+	recipes, err := stack.Order()
+	if err != nil {
+		log.Fatalf("Failed to order recipes, reason: %s\n", err)
+	}
+	for i, recipe := range recipes {
+		log.Infof("%3d. %s (%s)\n", i+1, recipe.Name, recipe.Path)
+	}
+	if sFlags.DryRun {
+		return
+	}
+
+	// Scan the histories up front, sharing the repository of a monorepo
+	var pkgfiles []string
+	for _, recipe := range recipes {
+		pkgfiles = append(pkgfiles, recipe.Path)
+	}
+	builder.PrefetchHistories(pkgfiles)
+
+	policy := sFlags.Promote
+	if policy == "" {
+		if config, err := builder.NewConfig(); err == nil {
+			policy = config.StackPromotion
+		}
+	}
+	promotion, err := builder.NewStackPromotion(policy)
+	if err != nil {
+		log.Fatalf("Cannot build the stack, reason: %s\n", err)
+	}
+	builder.ActivePromotion = promotion
+
+	var repo *builder.Repo
+	if len(recipes) > 1 && !promotion.Feeds() {
+		log.Infoln("Building every recipe against the repository versions of its dependencies")
+	} else if len(recipes) > 1 {
+		manager, err := builder.NewManager()
+		if err != nil {
+			os.Exit(1)
+		}
+		if err = manager.SetProfile(rFlags.Profile); err != nil {
+			os.Exit(1)
+		}
+		if repo, err = manager.GetProfile().FeedRepo(sFlags.Repo); err != nil {
+			log.Fatalf("Cannot build the stack, reason: %s\n", err)
+		}
+		log.Infof("Feeding packages into the local repo %s (%s)\n", repo.Name, promotion.Policy)
+	}
+
+	var build func(*builder.StackRecipe) error
+	if sFlags.Workers != "" {
+		w := newStackWorker(rFlags, repo, promotion, paths, recipes)
+		if err := w.dispatch(sFlags.Workers); err != nil {
+			log.Fatalf("Cannot use the workers, reason: %s\n", err)
+		}
+		sFlags.Jobs = cap(w.remote)
+		log.Infof("Dispatching up to %d recipes at once to workers\n", sFlags.Jobs)
+		build = w.build
+	} else if sFlags.Jobs > 1 {
+		log.Infof("Building up to %d recipes at once\n", sFlags.Jobs)
+		build = newStackWorker(rFlags, repo, promotion, paths, recipes).build
+	} else {
+		built := 0
+		build = func(recipe *builder.StackRecipe) error {
+			built++
+			log.Infof("Building %s (%d of %d)\n", recipe.Name, built, len(recipes))
+			before := eopkgNames()
+			manager := newBuildManager(rFlags, sFlags, recipe.Path)
+			if err := manager.Build(); err == builder.ErrUpToDate {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if repo == nil {
+				return nil
+			}
+			return feedRepo(rFlags, repo, promotion, newEopkgs(before))
+		}
+	}
+	results, err := stack.Build(sFlags.Jobs, build)
+	if err != nil {
+		log.Fatalf("Failed to build the stack, reason: %s\n", err)
+	}
+	if !summarizeStack(results) {
+		os.Exit(1)
+	}
+}
+
+// summarizeStack will report the outcome of every recipe of the stack,
+// returning whether all of them were built.
+func summarizeStack(results []*builder.StackResult) bool {
+	failed, skipped := 0, 0
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			skipped++
+			log.Warnf("%s: skipped, a dependency failed\n", result.Recipe.Name)
+		case result.Err != nil:
+			failed++
+			log.Errorf("%s: failed after %s, reason: %s\n", result.Recipe.Name, result.Duration.Round(time.Second), strings.TrimSpace(result.Err.Error()))
+		default:
+			log.Goodf("%s: built in %s\n", result.Recipe.Name, result.Duration.Round(time.Second))
+		}
+	}
+	built := len(results) - failed - skipped
+	if failed > 0 || skipped > 0 {
+		log.Errorf("Built %d of %d recipes, %d failed and %d skipped\n", built, len(results), failed, skipped)
+		return false
+	}
+	log.Infof("Building succeeded for %d recipes\n", len(results))
+	return true
+}
+
+// A stackWorker builds each recipe of a stack in its own solbuild process,
+// so that builds may run at the same time with separate overlays, or on
+// remote workers when dispatching.
+type stackWorker struct {
+	rFlags    *GlobalFlags
+	repo      *builder.Repo
+	promotion *builder.StackPromotion
+	args      []string                   // Our arguments, less those of the stack itself
+	width     int                        // Width of the longest recipe name, to align the output
+	remote    chan *builder.WorkerClient // Idle slots of the remote workers, if dispatching
+	output    sync.Mutex
+	feed      sync.Mutex
+}
+
+// newStackWorker will prepare to build the recipes of the stack, reusing
+// our own arguments for each build.
+func newStackWorker(rFlags *GlobalFlags, repo *builder.Repo, promotion *builder.StackPromotion, paths []string, recipes []*builder.StackRecipe) *stackWorker {
+	w := &stackWorker{rFlags: rFlags, repo: repo, promotion: promotion}
+	skip := make(map[string]bool)
+	for _, path := range paths {
+		skip[path] = true
+	}
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-j" || args[i] == "--jobs" || args[i] == "--repo" || args[i] == "--workers" || args[i] == "--promote":
+			i++
+		case skip[args[i]]:
+			skip[args[i]] = false
+		default:
+			w.args = append(w.args, args[i])
+		}
+	}
+	for _, recipe := range recipes {
+		if len(recipe.Name) > w.width {
+			w.width = len(recipe.Name)
+		}
+	}
+	return w
+}
+
+// dispatch will send every build to the comma separated worker URLs instead,
+// each URL taking a single build at a time. Listing a worker several times
+// lets it take as many builds at once.
+func (w *stackWorker) dispatch(workers string) error {
+	config, err := builder.NewConfig()
+	if err != nil {
+		return err
+	}
+	if config.WorkerToken == "" {
+		return builder.ErrNoWorkerToken
+	}
+	urls := strings.Split(workers, ",")
+	w.remote = make(chan *builder.WorkerClient, len(urls))
+	for _, u := range urls {
+		w.remote <- builder.NewWorkerClient(strings.TrimSpace(u), config.WorkerToken)
+	}
+	return nil
+}
+
+// build will build the recipe in a separate process and directory, then
+// collect its results and feed them into the local repo.
+func (w *stackWorker) build(recipe *builder.StackRecipe) error {
+	outDir, err := ioutil.TempDir("", "solbuild-stack-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outDir)
+
+	pr, pw := io.Pipe()
+	copied := make(chan struct{})
+	go func() {
+		w.prefix(recipe.Name, pr)
+		close(copied)
+	}()
+	if w.remote != nil {
+		err = w.buildRemote(recipe, outDir, pw)
+	} else {
+		err = w.buildLocal(recipe, outDir, pw)
+	}
+	pw.Close()
+	<-copied
+	if err != nil {
+		return err
+	}
+	return w.collect(outDir)
+}
+
+// buildLocal will build the recipe with another solbuild process
+func (w *stackWorker) buildLocal(recipe *builder.StackRecipe, outDir string, out io.Writer) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	c := exec.Command(self, append(w.args, recipe.Path)...)
+	c.Dir = outDir
+	c.Env = append(os.Environ(), fmt.Sprintf("%s=%s", builder.StackPromotionEnv, w.promotion.Encode()))
+	if wd, err := os.Getwd(); err == nil {
+		c.Env = append(c.Env, fmt.Sprintf("%s=%s", collisionDirEnv, wd))
+	}
+	c.Stdout = out
+	c.Stderr = out
+	return c.Run()
+}
+
+// buildRemote will build the recipe on the next idle worker, keeping its log
+// as $name.log beside the packages.
+func (w *stackWorker) buildRemote(recipe *builder.StackRecipe, outDir string, out io.Writer) error {
+	client := <-w.remote
+	defer func() { w.remote <- client }()
+	logFile, err := os.Create(filepath.Join(outDir, recipe.Name+".log"))
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	log.Debugf("Dispatching %s to %s\n", recipe.Name, client.URL)
+	_, err = client.Build(recipe.Path, w.rFlags.Profile, outDir, io.MultiWriter(logFile, out))
+	return err
+}
+
+// collect will copy the results of a build into the working directory, and
+// feed its packages into the local repo.
+func (w *stackWorker) collect(outDir string) error {
+	// Dependents must never start before the repo has the results
+	w.feed.Lock()
+	defer w.feed.Unlock()
+	results, _ := filepath.Glob(filepath.Join(outDir, "*"))
+	var packages []string
+	usr := builder.GetUserInfo()
+	for _, p := range results {
+		tgt := filepath.Base(p)
+		if err := disk.CopyFile(p, tgt); err != nil {
+			return fmt.Errorf("Unable to collect build file, reason: %s", err)
+		}
+		if err := os.Chown(tgt, usr.UID, usr.GID); err != nil {
+			log.Errorf("Error in restoring file ownership %s, reason: %s\n", tgt, err)
+		}
+		if strings.HasSuffix(tgt, ".eopkg") {
+			packages = append(packages, tgt)
+		}
+	}
+	if w.repo == nil {
+		return nil
+	}
+	return feedRepo(w.rFlags, w.repo, w.promotion, packages)
+}
+
+// prefix will copy the output of a build line by line, prefixed with the
+// name of its recipe.
+func (w *stackWorker) prefix(name string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		w.output.Lock()
+		fmt.Printf("%-*s | %s\n", w.width, name, scanner.Text())
+		w.output.Unlock()
+	}
+	io.Copy(ioutil.Discard, r)
+}
+
+// eopkgNames will record the name of every eopkg in the working directory,
+// so that those produced by a build can be told apart. Modification times
+// can't be used, as they may be clamped to the source date.
+func eopkgNames() map[string]bool {
+	names := make(map[string]bool)
+	packages, _ := filepath.Glob("*.eopkg")
+	for _, pkg := range packages {
+		names[pkg] = true
+	}
+	return names
+}
+
+// newEopkgs will return the eopkgs in the working directory that weren't
+// there when the names were recorded.
+func newEopkgs(before map[string]bool) []string {
+	var packages []string
+	for pkg := range eopkgNames() {
+		if !before[pkg] {
+			packages = append(packages, pkg)
+		}
+	}
+	sort.Strings(packages)
+	return packages
+}
+
+// feedRepo will copy the packages into the local repo, indexing it when the
+// profile doesn't already do so, and record them for the later recipes.
+func feedRepo(rFlags *GlobalFlags, repo *builder.Repo, promotion *builder.StackPromotion, packages []string) error {
+	if len(packages) == 0 {
+		log.Warnf("No new packages were collected for %s\n", repo.Name)
+		return nil
+	}
+	for _, pkg := range packages {
+		if err := builder.CopyAll(pkg, repo.URI); err != nil {
+			return err
+		}
+	}
+	if err := promotion.Add(packages); err != nil {
+		return err
+	}
+	log.Debugf("Fed %d packages into %s\n", len(packages), repo.URI)
+	if repo.AutoIndex {
+		return nil
+	}
+	manager, err := builder.NewManager()
+	if err != nil {
+		return err
+	}
+	if err = manager.SetProfile(rFlags.Profile); err != nil {
+		return err
+	}
+	if err = manager.SetPackage(&builder.IndexPackage); err != nil {
+		return err
+	}
+	return manager.Index(repo.URI)
+}
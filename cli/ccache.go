@@ -0,0 +1,94 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	register(&Ccache)
+}
+
+// Ccache reports on and cleans the ccache shared between builds
+var Ccache = cmd.Sub{
+	Name:  "ccache",
+	Short: "Show ccache statistics or clean the ccache",
+	Flags: &CcacheFlags{},
+	Args:  &CcacheArgs{},
+	Run:   CcacheRun,
+}
+
+// CcacheFlags are the flags for the "ccache" sub-command
+type CcacheFlags struct {
+	All    bool `short:"a" long:"all"    desc:"Empty the ccache entirely instead of trimming it"`
+	Legacy bool `short:"l" long:"legacy" desc:"Only use the ccache of legacy (pspec.xml) builds"`
+}
+
+// CcacheArgs are the arguments for the "ccache" sub-command
+type CcacheArgs struct {
+	Action string `desc:"Either 'stats' or 'clean'"`
+}
+
+// CcacheRun carries out the "ccache" sub-command
+func CcacheRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*CcacheFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	dirs := []string{builder.CcacheDirectory, builder.LegacyCcacheDirectory}
+	if sFlags.Legacy {
+		dirs = dirs[1:]
+	}
+	switch action := s.Args.(*CcacheArgs).Action; action {
+	case "stats":
+		for _, dir := range dirs {
+			maxSize := builder.GetCcacheMaxSize(dir)
+			if maxSize == "" {
+				maxSize = "ccache default"
+			}
+			log.Infof("%s: %s (max size: %s)\n", dir, builder.ReadCcacheStats(dir), maxSize)
+		}
+	case "clean":
+		if os.Geteuid() != 0 {
+			log.Fatalln("You must be root to clean the ccache")
+		}
+		for _, dir := range dirs {
+			if !builder.PathExists(dir) {
+				continue
+			}
+			log.Infof("Cleaning ccache '%s'\n", dir)
+			if err := builder.CleanCcache(dir, sFlags.All); err != nil {
+				log.Fatalf("Failed to clean the ccache, reason: %s\n", err)
+			}
+		}
+	default:
+		log.Fatalf("Unknown action '%s', expected 'stats' or 'clean'\n", action)
+	}
+}
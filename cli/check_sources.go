@@ -0,0 +1,86 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	register(&CheckSources)
+}
+
+// CheckSources reports the sources of a tree which are dead or have changed upstream
+var CheckSources = cmd.Sub{
+	Name:  "check-sources",
+	Alias: "cs",
+	Short: "Report dead or changed upstream sources across a tree of recipes",
+	Flags: &CheckSourcesFlags{},
+	Args:  &CheckSourcesArgs{},
+	Run:   CheckSourcesRun,
+}
+
+// CheckSourcesFlags are flags for the "check-sources" sub-command
+type CheckSourcesFlags struct {
+	Full bool   `short:"f" long:"full" desc:"Download every source to compare its digest"`
+	Jobs int    `short:"j" long:"jobs" desc:"Number of sources to check at once (default 8)"`
+	JSON string `short:"o" long:"json" desc:"Also write the full report as JSON to this file"`
+}
+
+// CheckSourcesArgs are arguments for the "check-sources" sub-command
+type CheckSourcesArgs struct {
+	Dir string `desc:"Directory containing the recipes to check"`
+}
+
+// CheckSourcesRun carries out the "check-sources" sub-command
+func CheckSourcesRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*CheckSourcesFlags)
+	args := s.Args.(*CheckSourcesArgs)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+		builder.DisableColors = true
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	jobs := sFlags.Jobs
+	if jobs == 0 {
+		jobs = 8
+	}
+	report, err := builder.CheckTreeSources(args.Dir, sFlags.Full, jobs)
+	if err != nil {
+		log.Fatalf("Failed to check sources, reason: %s\n", err)
+	}
+	report.Write(os.Stdout)
+	if sFlags.JSON != "" {
+		if err := report.WriteJSON(sFlags.JSON); err != nil {
+			log.Fatalf("Failed to write report, reason: %s\n", err)
+		}
+	}
+	if !report.IsHealthy() {
+		os.Exit(1)
+	}
+}
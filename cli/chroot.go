@@ -24,29 +24,73 @@ import (
 	"github.com/DataDrake/waterlog/level"
 	"github.com/getsolus/solbuild/builder"
 	"os"
+	"os/exec"
 	"strings"
+	"syscall"
 )
 
+// chrootCommand is the command following "--" to run within the build root
+var chrootCommand []string
+
 func init() {
-	cmd.Register(&Chroot)
+	register(&Chroot)
+	os.Args, chrootCommand = splitChrootCommand(os.Args)
 }
 
 // Chroot opens an interactive shell inside the chroot environment
 var Chroot = cmd.Sub{
 	Name:  "chroot",
-	Short: "Interactively chroot into the package's build environment",
+	Short: "Interactively chroot into the package's build environment, or run a command given after --",
+	Flags: &ChrootFlags{},
 	Args:  &ChrootArgs{},
 	Run:   ChrootRun,
 }
 
+// ChrootFlags are flags for the "chroot" sub-command
+type ChrootFlags struct {
+	NoTTY bool `long:"no-tty" desc:"Run the command without a terminal, for use from scripts"`
+}
+
 // ChrootArgs are arguments for the "chroot" sub-command
 type ChrootArgs struct {
 	Path []string `zero:"yes" desc:"Chroot into the environment for a [package.yml|pspec.xml] receipe."`
 }
 
+// splitChrootCommand removes the command following "--" from the arguments
+// of the "chroot" sub-command, as cli-ng would otherwise parse its options.
+// A command given with nothing after "--" is empty rather than nil.
+func splitChrootCommand(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if arg != "--" {
+			continue
+		}
+		for _, sub := range args[1:i] {
+			if sub == Chroot.Name {
+				return args[:i], append([]string{}, args[i+1:]...)
+			}
+		}
+		break
+	}
+	return args, nil
+}
+
+// chrootExitStatus returns the exit status of a failed chroot command, if
+// the command itself ran
+func chrootExitStatus(err error) (int, bool) {
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+	if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), true
+	}
+	return exit.ExitCode(), true
+}
+
 // ChrootRun carries out the "chroot" sub-command
 func ChrootRun(r *cmd.Root, s *cmd.Sub) {
 	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*ChrootFlags)
 	if rFlags.Debug {
 		log.SetLevel(level.Debug)
 	}
@@ -54,6 +98,18 @@ func ChrootRun(r *cmd.Root, s *cmd.Sub) {
 		log.SetFormat(format.Un)
 		builder.DisableColors = true
 	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if chrootCommand != nil {
+		if len(chrootCommand) == 0 {
+			log.Fatalln("No command given after --")
+		}
+		// Keep stdout for the output of the command
+		builder.SetLogOutput(os.Stderr)
+	} else if sFlags.NoTTY {
+		log.Fatalln("--no-tty requires a command to run, given after --")
+	}
 
 	// Allow chrooting into an environment for a build recipe for a given file
 	// (Convert from []string to string to allow usage of cli-ng's zero (optional) property.)
@@ -90,8 +146,14 @@ func ChrootRun(r *cmd.Root, s *cmd.Sub) {
 		}
 		os.Exit(1)
 	}
+	manager.SetChrootCommand(chrootCommand, sFlags.NoTTY)
 	if err := manager.Chroot(); err != nil {
+		if status, ok := chrootExitStatus(err); ok && chrootCommand != nil {
+			os.Exit(status)
+		}
 		log.Fatalln("Chroot failure")
 	}
-	log.Infoln("Chroot complete")
+	if chrootCommand == nil {
+		log.Infoln("Chroot complete")
+	}
 }
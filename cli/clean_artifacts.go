@@ -0,0 +1,102 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"time"
+)
+
+func init() {
+	register(&CleanArtifacts)
+}
+
+// CleanArtifacts removes the artifacts of past builds from an output directory
+var CleanArtifacts = cmd.Sub{
+	Name:  "clean-artifacts",
+	Alias: "ca",
+	Short: "Remove the files produced by past builds from a directory",
+	Flags: &CleanArtifactsFlags{},
+	Args:  &CleanArtifactsArgs{},
+	Run:   CleanArtifactsRun,
+}
+
+// CleanArtifactsFlags are flags for the "clean-artifacts" sub-command
+type CleanArtifactsFlags struct {
+	DryRun    bool   `long:"dry-run"              desc:"Report what would be removed without removing it"`
+	Keep      int    `short:"k" long:"keep"       desc:"Newest builds of each package to keep, defaults to 1"`
+	OlderThan string `short:"o" long:"older-than" desc:"Only remove builds older than this, e.g. 72h"`
+	All       bool   `short:"a" long:"all"        desc:"Remove the artifacts of every build, even the newest"`
+}
+
+// CleanArtifactsArgs are args for the "clean-artifacts" sub-command
+type CleanArtifactsArgs struct {
+	Dir []string `zero:"yes" desc:"Directory to clean, defaults to the current directory"`
+}
+
+// CleanArtifactsRun carries out the "clean-artifacts" sub-command
+func CleanArtifactsRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*CleanArtifactsFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	dir := "."
+	if args := s.Args.(*CleanArtifactsArgs); len(args.Dir) == 1 {
+		dir = args.Dir[0]
+	} else if len(args.Dir) > 1 {
+		log.Fatalln("Only one directory can be cleaned at a time")
+	}
+
+	policy := &builder.ArtifactPolicy{Keep: 1, All: sFlags.All}
+	if sFlags.Keep > 0 {
+		policy.Keep = sFlags.Keep
+	}
+	if sFlags.OlderThan != "" {
+		age, err := time.ParseDuration(sFlags.OlderThan)
+		if err != nil || age < 0 {
+			log.Fatalf("Invalid age '%s', expected a duration such as 72h\n", sFlags.OlderThan)
+		}
+		policy.OlderThan = age
+	}
+	report, err := policy.Plan(dir)
+	if err != nil {
+		log.Fatalf("Failed to find past builds in '%s', reason: %s\n", dir, err)
+	}
+	for _, f := range report.Removed {
+		fmt.Printf("%s (%s)\n", f.Path, humanReadableFormat(float64(f.Size)))
+	}
+	if sFlags.DryRun {
+		log.Infof("Would reclaim '%s'\n", humanReadableFormat(float64(report.Reclaimed())))
+		return
+	}
+	if err := report.Apply(); err != nil {
+		log.Fatalf("Failed to clean '%s', reason: %s\n", dir, err)
+	}
+	log.Infof("Removed %d files, reclaiming '%s'\n", len(report.Removed), humanReadableFormat(float64(report.Reclaimed())))
+}
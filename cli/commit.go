@@ -0,0 +1,86 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	register(&Commit)
+}
+
+// Commit stages recipe changes and commits them with a changelog template
+var Commit = cmd.Sub{
+	Name:  "commit",
+	Short: "Commit the package changes using a changelog template",
+	Flags: &CommitFlags{},
+	Args:  &CommitArgs{},
+	Run:   CommitRun,
+}
+
+// CommitFlags are flags for the "commit" sub-command
+type CommitFlags struct {
+	Print bool `long:"print" desc:"Print the commit template instead of committing"`
+}
+
+// CommitArgs are arguments for the "commit" sub-command
+type CommitArgs struct {
+	Path []string `zero:"yes" desc:"Location of the package.yml file to commit."`
+}
+
+// CommitRun carries out the "commit" sub-command
+func CommitRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*CommitFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	pkgPath := strings.Join(s.Args.(*CommitArgs).Path, "")
+	if len(pkgPath) == 0 {
+		pkgPath = FindLikelyArg()
+	}
+	if len(pkgPath) == 0 || filepath.Base(pkgPath) != "package.yml" {
+		log.Fatalln("No package.yml file in current directory and no file provided.")
+	}
+
+	if sFlags.Print {
+		template, err := builder.CommitTemplate(pkgPath)
+		if err != nil {
+			log.Fatalf("Failed to generate commit template, reason: %s\n", err)
+		}
+		fmt.Print(template)
+		return
+	}
+	if err := builder.CommitRecipe(pkgPath); err != nil {
+		log.Fatalf("Failed to commit %s, reason: %s\n", pkgPath, err)
+	}
+}
@@ -0,0 +1,84 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	register(&Config)
+}
+
+// Config checks the configuration and profiles of solbuild
+var Config = cmd.Sub{
+	Name:  "config",
+	Short: "Validate the configuration files and profiles",
+	Flags: &ConfigFlags{},
+	Args:  &ConfigArgs{},
+	Run:   ConfigRun,
+}
+
+// ConfigFlags are the flags for the "config" sub-command
+type ConfigFlags struct {
+	Offline bool `short:"o" long:"offline" desc:"Don't contact remote repositories"`
+}
+
+// ConfigArgs are the arguments for the "config" sub-command
+type ConfigArgs struct {
+	Action string `desc:"Only 'validate'"`
+}
+
+// ConfigRun carries out the "config" sub-command
+func ConfigRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*ConfigFlags)
+	args := s.Args.(*ConfigArgs)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+		builder.DisableColors = true
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if args.Action != "validate" {
+		log.Fatalf("Unknown action '%s', expected 'validate'\n", args.Action)
+	}
+	errors, warnings := 0, 0
+	for _, issue := range builder.ValidateConfig(sFlags.Offline) {
+		if issue.Warning {
+			warnings++
+			fmt.Fprintf(os.Stderr, "warning: %s\n", issue)
+		} else {
+			errors++
+			fmt.Fprintf(os.Stderr, "error: %s\n", issue)
+		}
+	}
+	if errors > 0 {
+		log.Fatalf("Found %d error(s) and %d warning(s)\n", errors, warnings)
+	}
+	log.Goodf("Configuration is valid, with %d warning(s)\n", warnings)
+}
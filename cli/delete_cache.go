@@ -30,7 +30,7 @@ import (
 )
 
 func init() {
-	cmd.Register(&DeleteCache)
+	register(&DeleteCache)
 }
 
 // DeleteCache cleans up the solbuild caches to free up disk space
@@ -44,7 +44,7 @@ var DeleteCache = cmd.Sub{
 
 // DeleteCacheFlags are the flags for the "delete-cache" sub-command
 type DeleteCacheFlags struct {
-	All    bool `short:"a" long:"all"    desc:"Additionally delete (s)ccache, packages and sources"`
+	All    bool `short:"a" long:"all"    desc:"Additionally delete compiler and language caches, packages and sources"`
 	Images bool `short:"i" long:"images" desc:"Additionally delete solbuild images"`
 	Sizes  bool `short:"s" long:"sizes"  desc:"Show disk usage of the caches"`
 }
@@ -59,6 +59,9 @@ func DeleteCacheRun(r *cmd.Root, s *cmd.Sub) {
 	if rFlags.NoColor {
 		log.SetFormat(format.Un)
 	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
 	if os.Geteuid() != 0 {
 		log.Fatalln("You must be root to delete caches")
 	}
@@ -75,7 +78,11 @@ func DeleteCacheRun(r *cmd.Root, s *cmd.Sub) {
 			builder.LegacyCcacheDirectory,
 			builder.SccacheDirectory,
 			builder.LegacySccacheDirectory,
+			builder.CargoDirectory,
+			builder.LanguageCacheDirectory,
+			builder.RecipeDirectory,
 			builder.PackageCacheDirectory,
+			builder.HistoryCacheDirectory,
 			source.SourceDir,
 		}
 		var totalSize int64
@@ -101,7 +108,11 @@ func DeleteCacheRun(r *cmd.Root, s *cmd.Sub) {
 			builder.LegacyCcacheDirectory,
 			builder.SccacheDirectory,
 			builder.LegacySccacheDirectory,
+			builder.CargoDirectory,
+			builder.LanguageCacheDirectory,
+			builder.RecipeDirectory,
 			builder.PackageCacheDirectory,
+			builder.HistoryCacheDirectory,
 			source.SourceDir,
 		}...)
 	}
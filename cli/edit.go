@@ -0,0 +1,116 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	register(&Edit)
+}
+
+// Edit applies the same change to a batch of package recipes
+var Edit = cmd.Sub{
+	Name:  "edit",
+	Short: "Batch edit the given package.yml recipes",
+	Flags: &EditFlags{},
+	Args:  &EditArgs{},
+	Run:   EditRun,
+}
+
+// EditFlags are flags for the "edit" sub-command
+type EditFlags struct {
+	Set     string `short:"s" long:"set"     desc:"Set top level keys, e.g. 'component=programming.library;homepage=...'"`
+	Replace string `short:"r" long:"replace" desc:"Apply a regex replacement, e.g. 's/old/new/'"`
+	DryRun  bool   `long:"dry-run"           desc:"Only report which recipes would change"`
+}
+
+// EditArgs are arguments for the "edit" sub-command
+type EditArgs struct {
+	Paths []string `desc:"package.yml files, or directories containing them"`
+}
+
+// EditRun carries out the "edit" sub-command
+func EditRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*EditFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	edit := &builder.RecipeEdit{}
+	if sFlags.Set != "" {
+		assignments, err := builder.ParseRecipeAssignments(sFlags.Set)
+		if err != nil {
+			log.Fatalf("Invalid --set expression '%s', reason: %s\n", sFlags.Set, err)
+		}
+		edit.Assignments = assignments
+	}
+	if sFlags.Replace != "" {
+		replacement, err := builder.ParseRecipeReplacement(sFlags.Replace)
+		if err != nil {
+			log.Fatalf("Invalid --replace expression '%s', reason: %s\n", sFlags.Replace, err)
+		}
+		edit.Replacements = append(edit.Replacements, *replacement)
+	}
+	if len(edit.Assignments) == 0 && len(edit.Replacements) == 0 {
+		log.Fatalln("Nothing to do, pass --set and/or --replace")
+	}
+
+	failed := false
+	changed := 0
+	for _, p := range s.Args.(*EditArgs).Paths {
+		recipe, err := builder.FindRecipe(p)
+		if err != nil {
+			log.Errorf("Skipping %s, reason: %s\n", p, err)
+			failed = true
+			continue
+		}
+		didChange, err := edit.ApplyToFile(recipe, sFlags.DryRun)
+		if err != nil {
+			log.Errorln(err.Error())
+			failed = true
+			continue
+		}
+		if !didChange {
+			log.Debugf("No changes needed for %s\n", recipe)
+			continue
+		}
+		changed++
+		if sFlags.DryRun {
+			log.Infof("Would edit %s\n", recipe)
+		} else {
+			log.Infof("Edited %s\n", recipe)
+		}
+	}
+	log.Infof("%d recipe(s) changed\n", changed)
+	if failed {
+		os.Exit(1)
+	}
+}
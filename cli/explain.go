@@ -0,0 +1,82 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	register(&Explain)
+}
+
+// Explain diagnoses a failed build from its log
+var Explain = cmd.Sub{
+	Name:  "explain",
+	Short: "Explain why a build failed, from its log or worker build ID",
+	Args:  &ExplainArgs{},
+	Run:   ExplainRun,
+}
+
+// ExplainArgs are arguments for the "explain" sub-command
+type ExplainArgs struct {
+	Build string `desc:"Path to the build log, or ID of a worker build"`
+}
+
+// ExplainRun carries out the "explain" sub-command
+func ExplainRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration %s\n", err)
+	}
+	path, err := builder.FindBuildLog(s.Args.(*ExplainArgs).Build, filepath.Join(config.OverlayRootDir, "worker"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open build log %s, reason: %s\n", path, err)
+	}
+	defer f.Close()
+	diagnosis, err := builder.ExplainLog(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("Failure:     %s\n", diagnosis.Class)
+	fmt.Printf("Stage:       %s\n", diagnosis.Stage)
+	fmt.Printf("Cause:       %s (line %d)\n", diagnosis.Cause, diagnosis.Line)
+	fmt.Printf("Explanation: %s\n", diagnosis.Explanation)
+	fmt.Printf("Next:        %s\n", diagnosis.Next)
+}
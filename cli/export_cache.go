@@ -0,0 +1,79 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"strings"
+)
+
+func init() {
+	register(&ExportCache)
+}
+
+// ExportCache stores the solbuild caches in a portable bundle
+var ExportCache = cmd.Sub{
+	Name:  "export-cache",
+	Short: "Export images, sources and compiler caches to a bundle",
+	Flags: &ExportCacheFlags{},
+	Args:  &ExportCacheArgs{},
+	Run:   ExportCacheRun,
+}
+
+// ExportCacheFlags are flags for the "export-cache" sub-command
+type ExportCacheFlags struct {
+	Sections string `short:"s" long:"sections" desc:"Comma separated caches to export, defaults to all"`
+}
+
+// ExportCacheArgs are args for the "export-cache" sub-command
+type ExportCacheArgs struct {
+	Path string `desc:"Bundle to create, compressed if ending in .gz or .tgz"`
+}
+
+// ExportCacheRun carries out the "export-cache" sub-command
+func ExportCacheRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*ExportCacheFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to export caches")
+	}
+
+	var sections []string
+	if sFlags.Sections != "" {
+		sections = strings.Split(sFlags.Sections, ",")
+	}
+	path := s.Args.(*ExportCacheArgs).Path
+	manifest, err := builder.ExportBundle(path, sections)
+	if err != nil {
+		log.Fatalf("Failed to export caches, reason: %s\n", err)
+	}
+	log.Infof("Exported %d files of '%s' to %s\n", len(manifest.Files), humanReadableFormat(float64(manifest.TotalSize())), path)
+}
@@ -0,0 +1,113 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"strings"
+)
+
+func init() {
+	register(&History)
+}
+
+// History renders the changelog generated for a package
+var History = cmd.Sub{
+	Name:  "history",
+	Short: "Show the changelog generated from the git history of a package",
+	Flags: &HistoryFlags{},
+	Args:  &HistoryArgs{},
+	Run:   HistoryRun,
+}
+
+// HistoryFlags are flags for the "history" sub-command
+type HistoryFlags struct {
+	Format       string `short:"f" long:"format" desc:"Output format, one of appstream, json, markdown or xml (default)"`
+	HistoryDepth string `long:"history-depth"    desc:"Maximum number of changelog entries, or \"unlimited\""`
+}
+
+// HistoryArgs are arguments for the "history" sub-command
+type HistoryArgs struct {
+	Path []string `zero:"yes" desc:"Location of the package.yml file"`
+}
+
+// HistoryRun carries out the "history" sub-command
+func HistoryRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*HistoryFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	pkgPath := strings.Join(s.Args.(*HistoryArgs).Path, "")
+	if len(pkgPath) == 0 {
+		pkgPath = FindLikelyArg()
+	}
+	if len(pkgPath) == 0 {
+		log.Fatalln("No package.yml file in current directory and no file provided.")
+	}
+
+	depth := builder.MaxChangelogEntries
+	if sFlags.HistoryDepth != "" {
+		var err error
+		if depth, err = parseHistoryDepth(sFlags.HistoryDepth); err != nil {
+			log.Fatalf("Invalid history depth: %s\n", err)
+		}
+	}
+
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration %s\n", err)
+	}
+	if err := builder.SetHistoryTagPatterns(config.HistoryTagPatterns); err != nil {
+		log.Fatalf("Failed to configure history, reason: %s\n", err)
+	}
+	history, err := builder.LoadPackageHistory(pkgPath, depth)
+	if err != nil {
+		log.Fatalf("Failed to obtain package history, reason: %s\n", err)
+	}
+	if config.CVEDatabase != "" {
+		history.EnrichCVEs(builder.NewCVEDatabase(config.CVEDatabase, config.CVEFetch))
+	}
+
+	outFormat := sFlags.Format
+	switch outFormat {
+	case "":
+		outFormat = "xml"
+	case "md":
+		outFormat = "markdown"
+	}
+	out, err := history.Emit(outFormat)
+	if err != nil {
+		log.Fatalf("Failed to render history, reason: %s\n", err)
+	}
+	os.Stdout.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		os.Stdout.Write([]byte("\n"))
+	}
+}
@@ -0,0 +1,85 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	register(&Image)
+}
+
+// Image creates custom backing images
+var Image = cmd.Sub{
+	Name:  "image",
+	Short: "Create a custom backing image from a manifest",
+	Flags: &ImageFlags{},
+	Args:  &ImageArgs{},
+	Run:   ImageRun,
+}
+
+// ImageFlags are the flags for the "image" sub-command
+type ImageFlags struct {
+	Force bool `short:"f" long:"force" desc:"Replace the image if it already exists"`
+}
+
+// ImageArgs are the arguments for the "image" sub-command
+type ImageArgs struct {
+	Action   string `desc:"Only 'create'"`
+	Manifest string `desc:"Image manifest describing the repos and packages of the image"`
+}
+
+// ImageRun carries out the "image" sub-command
+func ImageRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*ImageFlags)
+	args := s.Args.(*ImageArgs)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+		builder.DisableColors = true
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if args.Action != "create" {
+		log.Fatalf("Unknown action '%s', expected 'create'\n", args.Action)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to create images")
+	}
+	manifest, err := builder.NewImageManifest(args.Manifest)
+	if err != nil {
+		log.Fatalf("Invalid image manifest %s, reason: %s\n", args.Manifest, err)
+	}
+	manager, err := builder.NewManager()
+	if err != nil {
+		os.Exit(1)
+	}
+	if err := manager.CreateImage(manifest, sFlags.Force); err != nil {
+		log.Fatalf("Failed to create image %s, reason: %s\n", manifest.Name, err)
+	}
+	log.Infof("Set 'image = \"%s\"' in a profile to build with it\n", manifest.Name)
+}
@@ -0,0 +1,69 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"strings"
+)
+
+func init() {
+	register(&ImportCache)
+}
+
+// ImportCache merges a bundle created by export-cache into the local caches
+var ImportCache = cmd.Sub{
+	Name:  "import-cache",
+	Short: "Verify and import a bundle created by export-cache",
+	Args:  &ImportCacheArgs{},
+	Run:   ImportCacheRun,
+}
+
+// ImportCacheArgs are args for the "import-cache" sub-command
+type ImportCacheArgs struct {
+	Path string `desc:"Bundle to import"`
+}
+
+// ImportCacheRun carries out the "import-cache" sub-command
+func ImportCacheRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to import caches")
+	}
+
+	path := s.Args.(*ImportCacheArgs).Path
+	manifest, err := builder.ImportBundle(path)
+	if err != nil {
+		log.Fatalf("Failed to import caches, reason: %s\n", err)
+	}
+	log.Infof("Imported %s from %s, '%s' in %d files\n", strings.Join(manifest.Sections, ", "), path,
+		humanReadableFormat(float64(manifest.TotalSize())), len(manifest.Files))
+}
@@ -27,7 +27,7 @@ import (
 )
 
 func init() {
-	cmd.Register(&Index)
+	register(&Index)
 }
 
 // Index generates index files for a local repository
@@ -43,6 +43,7 @@ var Index = cmd.Sub{
 type IndexFlags struct {
 	Tmpfs  bool   `short:"t" long:"tmpfs"  desc:"Enable building in a tmpfs"`
 	Memory string `short:"m" long:"memory" desc:"Set the tmpfs size to use"`
+	Key    string `short:"k" long:"key"    desc:"Sign the index with this GPG key"`
 }
 
 // IndexArgs are args for the "index" sub-command
@@ -60,6 +61,9 @@ func IndexRun(r *cmd.Root, s *cmd.Sub) {
 	if rFlags.NoColor {
 		log.SetFormat(format.Un)
 	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
 	if os.Geteuid() != 0 {
 		log.Fatalln("You must be root to use index")
 	}
@@ -80,6 +84,9 @@ func IndexRun(r *cmd.Root, s *cmd.Sub) {
 		os.Exit(1)
 	}
 	manager.SetTmpfs(sFlags.Tmpfs, sFlags.Memory)
+	if sFlags.Key != "" {
+		manager.Config.SigningKey = sFlags.Key
+	}
 	args := s.Args.(*IndexArgs)
 	if err := manager.Index(args.Dir); err != nil {
 		log.Fatalln("Index failure")
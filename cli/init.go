@@ -25,14 +25,15 @@ import (
 	"github.com/cheggaaa/pb/v3"
 	"github.com/getsolus/libosdev/commands"
 	"github.com/getsolus/solbuild/builder"
+	"github.com/getsolus/solbuild/builder/source"
 	"io"
 	"net/http"
 	"os"
 )
 
 func init() {
-	cmd.Register(&Init)
-	cmd.Register(&cmd.Help)
+	register(&Init)
+	register(&cmd.Help)
 }
 
 // Init downloads a solbuid image and initializes the profile
@@ -57,6 +58,9 @@ func InitRun(r *cmd.Root, s *cmd.Sub) {
 	if rFlags.NoColor {
 		log.SetFormat(format.Un)
 	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
 	if os.Geteuid() != 0 {
 		log.Fatalln("You must be root to run init profiles")
 	}
@@ -91,37 +95,62 @@ func doInit(manager *builder.Manager) {
 		}
 		log.Debugf("Created images directory '%s'\n", imgDir)
 	}
+	format := manager.Config.ImageFormat
+	if err := builder.ValidImageFormat(format); err != nil {
+		log.Fatalf("Invalid image format '%s', reason: %s\n", format, err)
+	}
+	// Use a squashfs published alongside the image, which needs no unpacking
+	if format == builder.ImageFormatSquashfs {
+		tmp := bk.ImagePathSquashfs + ".part"
+		if err := downloadImage(bk.ImageURISquashfs, tmp, prof.FetchNetwork()); err == nil {
+			if err := os.Rename(tmp, bk.ImagePathSquashfs); err != nil {
+				log.Fatalf("Failed to install image '%s', reason: %s\n", bk.ImagePathSquashfs, err)
+			}
+			log.Infoln("Profile successfully initialised")
+			return
+		}
+		log.Infoln("No squashfs image available, converting the image instead")
+	}
 	// Now ensure we actually have said image
 	if !bk.IsFetched() {
-		if err := downloadImage(bk); err != nil {
+		if err := downloadImage(bk.ImageURI, bk.ImagePathXZ, prof.FetchNetwork()); err != nil {
 			log.Fatalln(err.Error())
 		}
 	}
 	// Decompress the image
-	log.Debugf("Decompressing backing image, source: '%s' target: '%s'\n", bk.ImagePathXZ, bk.ImagePath)
+	log.Debugf("Decompressing backing image, source: '%s' target: '%s'\n", bk.ImagePathXZ, bk.ImagePathExt4)
 	if err := commands.ExecStdoutArgsDir(builder.ImagesDir, "unxz", []string{bk.ImagePathXZ}); err != nil {
 		log.Fatalf("Failed to decompress image '%s', reason: %s\n", bk.ImagePathXZ, err)
 	}
+	if format == builder.ImageFormatSquashfs {
+		if err := bk.ConvertSquashfs(); err != nil {
+			log.Fatalf("Failed to convert image '%s', reason: %s\n", bk.ImagePathExt4, err)
+		}
+	}
 	log.Infoln("Profile successfully initialised")
 }
 
-// Downloads an image using net/http.
-func downloadImage(bk *builder.BackingImage) (err error) {
-	file, err := os.Create(bk.ImagePathXZ)
+// Downloads an image using net/http, with the address family settings of
+// the profile.
+func downloadImage(uri, path string, network source.Network) (err error) {
+	file, err := os.Create(path)
 	if err != nil {
-		return fmt.Errorf("failed to create file '%s', reason: '%s'", bk.ImagePathXZ, err)
+		return fmt.Errorf("failed to create file '%s', reason: '%s'", path, err)
 	}
 	defer func() {
 		if err != nil {
-			os.Remove(bk.ImagePathXZ)
+			os.Remove(path)
 		}
 	}()
 	defer file.Close()
-	resp, err := http.Get(bk.ImageURI)
+	resp, err := network.HTTPClient().Get(uri)
 	if err != nil {
-		return fmt.Errorf("failed to fetch image '%s', reason: '%s'", bk.ImageURI, err)
+		return fmt.Errorf("failed to fetch image '%s', reason: '%s'", uri, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch image '%s', reason: '%s'", uri, resp.Status)
+	}
 	bar := pb.New64(resp.ContentLength).Set(pb.Bytes, true)
 	reader := bar.NewProxyReader(resp.Body)
 	bar.Start()
@@ -134,10 +163,10 @@ func downloadImage(bk *builder.BackingImage) (err error) {
 		if err == io.EOF {
 			done = true
 		} else if err != nil {
-			return fmt.Errorf("failed to fetch image '%s', reason: '%s'", bk.ImageURI, err)
+			return fmt.Errorf("failed to fetch image '%s', reason: '%s'", uri, err)
 		}
 		if _, err = file.Write(buf[:bytesRead]); err != nil {
-			return fmt.Errorf("failed to write image '%s', reason: '%s'", bk.ImagePathXZ, err)
+			return fmt.Errorf("failed to write image '%s', reason: '%s'", path, err)
 		}
 		bytesRemaining -= int64(bytesRead)
 	}
@@ -0,0 +1,99 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	register(&PkgDiff)
+}
+
+// PkgDiff compares two builds of the same packages
+var PkgDiff = cmd.Sub{
+	Name:  "pkgdiff",
+	Alias: "diff",
+	Short: "Compare the files, metadata and dependencies of two builds of a package",
+	Flags: &PkgDiffFlags{},
+	Args:  &PkgDiffArgs{},
+	Run:   PkgDiffRun,
+}
+
+// PkgDiffFlags are flags for the "pkgdiff" sub-command
+type PkgDiffFlags struct {
+	Content bool `short:"c" long:"content" desc:"Show the changes within modified text files"`
+}
+
+// PkgDiffArgs are args for the "pkgdiff" sub-command
+type PkgDiffArgs struct {
+	Previous string `desc:"Previous .eopkg, or directory of them"`
+	Current  string `desc:"New .eopkg, or directory of them"`
+}
+
+// PkgDiffRun carries out the "pkgdiff" sub-command
+func PkgDiffRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*PkgDiffFlags)
+	args := s.Args.(*PkgDiffArgs)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	previous, err := eopkgsAt(args.Previous)
+	if err != nil {
+		log.Fatalf("Failed to find previous packages, reason: %s\n", err)
+	}
+	current, err := eopkgsAt(args.Current)
+	if err != nil {
+		log.Fatalf("Failed to find new packages, reason: %s\n", err)
+	}
+	diffs, err := builder.DiffPackages(previous, current)
+	if err != nil {
+		log.Fatalf("Failed to compare packages, reason: %s\n", err)
+	}
+	if sFlags.Content {
+		if err := builder.LoadContentDiffs(diffs); err != nil {
+			log.Fatalf("Failed to compare file contents, reason: %s\n", err)
+		}
+	}
+	builder.WritePackageDiffs(os.Stdout, diffs)
+}
+
+// eopkgsAt returns the eopkg at path, or every eopkg within the directory
+func eopkgsAt(path string) ([]string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return []string{path}, nil
+	}
+	return filepath.Glob(filepath.Join(path, "*.eopkg"))
+}
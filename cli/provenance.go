@@ -0,0 +1,74 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	register(&Provenance)
+}
+
+// Provenance reports where a built package came from
+var Provenance = cmd.Sub{
+	Name:  "provenance",
+	Short: "Show who built a package, from which recipe and in what environment",
+	Args:  &ProvenanceArgs{},
+	Run:   ProvenanceRun,
+}
+
+// ProvenanceArgs are args for the "provenance" sub-command
+type ProvenanceArgs struct {
+	Path []string `desc:"Built .eopkg files to inspect"`
+}
+
+// ProvenanceRun carries out the "provenance" sub-command
+func ProvenanceRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	verified := true
+	for i, path := range s.Args.(*ProvenanceArgs).Path {
+		prov, err := builder.NewProvenance(path)
+		if err != nil {
+			log.Fatalf("Failed to read provenance of %s, reason: %s\n", path, err)
+		}
+		if i > 0 {
+			os.Stdout.Write([]byte("\n"))
+		}
+		prov.Write(os.Stdout)
+		verified = verified && prov.IsVerified()
+	}
+	if !verified {
+		log.Errorln("Provenance could not be verified")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,168 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	register(&Prune)
+}
+
+// Prune applies the retention policies to the caches of solbuild
+var Prune = cmd.Sub{
+	Name:  "prune",
+	Short: "Remove old entries from the caches according to the retention policies",
+	Flags: &PruneFlags{},
+	Args:  &PruneArgs{},
+	Run:   PruneRun,
+}
+
+// PruneFlags are flags for the "prune" sub-command
+type PruneFlags struct {
+	Auto     bool   `long:"auto"                desc:"Quietly apply the configured policies, for use from a timer"`
+	DryRun   bool   `long:"dry-run"             desc:"Report what would be removed without removing it"`
+	KeepLast int    `short:"k" long:"keep-last" desc:"Entries of each package to keep, overriding keep_last"`
+	MaxAge   string `short:"a" long:"max-age"   desc:"Age beyond which entries are removed, i.e. 30d, overriding max_age"`
+	MaxSize  string `short:"s" long:"max-size"  desc:"Size to prune each cache to, overriding max_size"`
+}
+
+// PruneArgs are args for the "prune" sub-command
+type PruneArgs struct {
+	Caches []string `zero:"yes" desc:"Caches to prune, defaults to those with a policy"`
+}
+
+// PruneRun carries out the "prune" sub-command
+func PruneRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*PruneFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if !sFlags.DryRun && os.Geteuid() != 0 {
+		log.Fatalln("You must be root to prune the caches")
+	}
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration %s\n", err)
+	}
+	policies, err := builder.NewPrunePolicies(config)
+	if err != nil {
+		log.Fatalf("Invalid retention policy, reason: %s\n", err)
+	}
+	override, err := builder.NewPrunePolicy(&builder.PruneConfig{
+		MaxSize:  sFlags.MaxSize,
+		MaxAge:   sFlags.MaxAge,
+		KeepLast: sFlags.KeepLast,
+	})
+	if err != nil {
+		log.Fatalf("Invalid retention policy, reason: %s\n", err)
+	}
+
+	// Only one prune at a time, a timer mustn't stack up behind a slow one
+	if sFlags.Auto {
+		lock, err := builder.NewLockFile(filepath.Join(config.OverlayRootDir, "prune.lock"))
+		if err != nil {
+			log.Fatalf("Failed to create the prune lock, reason: %s\n", err)
+		}
+		if err := lock.Lock(); err != nil {
+			log.Debugln("Another prune is already running")
+			return
+		}
+		defer func() {
+			lock.Unlock()
+			lock.Clean()
+		}()
+	}
+
+	caches := s.Args.(*PruneArgs).Caches
+	if len(caches) == 0 {
+		caches = builder.PruneTargetNames
+	}
+	var totalReclaimed int64
+	for _, name := range caches {
+		target, err := builder.NewPruneTarget(name, config)
+		if err != nil {
+			log.Fatalf("%s: %s\n", err, name)
+		}
+		policy := policies[name]
+		if policy == nil {
+			policy = &builder.PrunePolicy{}
+		}
+		if override.MaxSize > 0 {
+			policy.MaxSize = override.MaxSize
+		}
+		if override.MaxAge > 0 {
+			policy.MaxAge = override.MaxAge
+		}
+		if override.KeepLast > 0 {
+			policy.KeepLast = override.KeepLast
+		}
+		if policy.IsEmpty() {
+			log.Debugf("No retention policy for %s\n", name)
+			continue
+		}
+		report, err := target.Prune(policy, sFlags.DryRun)
+		if err != nil {
+			log.Fatalf("Failed to prune %s, reason: %s\n", name, err)
+		}
+		for _, entry := range report.Removed {
+			if sFlags.Auto {
+				log.Debugf("Removed %s (%s)\n", entry.Path, humanReadableFormat(float64(entry.Size)))
+				continue
+			}
+			fmt.Printf("%s (%s)\n", entry.Path, humanReadableFormat(float64(entry.Size)))
+		}
+		if report.OverBy > 0 {
+			log.Warnf("'%s' remains '%s' over the size limit, only the newest entry of each package is left\n", name, humanReadableFormat(float64(report.OverBy)))
+		}
+		if len(report.Removed) > 0 || !sFlags.Auto {
+			log.Infof("%s %d entries from %s, reclaiming '%s'\n", pruneVerb(sFlags.DryRun), len(report.Removed), name, humanReadableFormat(float64(report.Reclaimed())))
+		}
+		totalReclaimed += report.Reclaimed()
+	}
+	if sFlags.Auto && totalReclaimed == 0 {
+		return
+	}
+	if sFlags.DryRun {
+		log.Infof("Would reclaim '%s'\n", humanReadableFormat(float64(totalReclaimed)))
+		return
+	}
+	log.Infof("Total reclaimed size: '%s'\n", humanReadableFormat(float64(totalReclaimed)))
+}
+
+// pruneVerb describes what prune does to the entries
+func pruneVerb(dryRun bool) string {
+	if dryRun {
+		return "Would remove"
+	}
+	return "Removed"
+}
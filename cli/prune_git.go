@@ -0,0 +1,88 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"github.com/getsolus/solbuild/builder/source"
+	"os"
+)
+
+func init() {
+	register(&PruneGit)
+}
+
+// PruneGit performs maintenance on the cached git clones
+var PruneGit = cmd.Sub{
+	Name:  "prune-git",
+	Alias: "pg",
+	Short: "Prune stale refs and repack cached git sources",
+	Flags: &PruneGitFlags{},
+	Run:   PruneGitRun,
+}
+
+// PruneGitFlags are flags for the "prune-git" sub-command
+type PruneGitFlags struct {
+	Offline bool `short:"o" long:"offline" desc:"Don't contact remotes to prune deleted refs"`
+}
+
+// PruneGitRun carries out the "prune-git" sub-command
+func PruneGitRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*PruneGitFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to maintain the git cache")
+	}
+	clones, err := source.FindGitClones()
+	if err != nil {
+		log.Fatalf("Failed to find cached git clones, reason: %s\n", err)
+	}
+	if len(clones) == 0 {
+		log.Infoln("No cached git clones found")
+		return
+	}
+
+	var totalReclaimed int64
+	failed := false
+	for _, clone := range clones {
+		log.Infof("Maintaining git clone '%s'\n", clone)
+		result := source.MaintainGitClone(clone, sFlags.Offline)
+		if result.Err != nil {
+			log.Errorf("Failed to maintain git clone '%s', reason: %s\n", clone, result.Err)
+			failed = true
+		}
+		log.Debugf("Reclaimed '%s' from '%s'\n", humanReadableFormat(float64(result.Reclaimed())), clone)
+		totalReclaimed += result.Reclaimed()
+	}
+	log.Infof("Total reclaimed size: '%s'\n", humanReadableFormat(float64(totalReclaimed)))
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	register(&PrunePackages)
+}
+
+// PrunePackages applies the retention policy to local repos and the package cache
+var PrunePackages = cmd.Sub{
+	Name:  "prune-packages",
+	Alias: "pp",
+	Short: "Remove superseded packages from local repos and the package cache",
+	Flags: &PrunePackagesFlags{},
+	Args:  &PrunePackagesArgs{},
+	Run:   PrunePackagesRun,
+}
+
+// PrunePackagesFlags are flags for the "prune-packages" sub-command
+type PrunePackagesFlags struct {
+	DryRun  bool   `long:"dry-run"            desc:"Report what would be removed without removing it"`
+	Keep    int    `short:"k" long:"keep"     desc:"Releases of each package to keep, overriding retain_releases"`
+	MaxSize string `short:"s" long:"max-size" desc:"Size to prune each directory to, overriding retain_size"`
+}
+
+// PrunePackagesArgs are args for the "prune-packages" sub-command
+type PrunePackagesArgs struct {
+	Dirs []string `zero:"yes" desc:"Directories to prune, defaults to the package cache and local repos"`
+}
+
+// PrunePackagesRun carries out the "prune-packages" sub-command
+func PrunePackagesRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*PrunePackagesFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if !sFlags.DryRun && os.Geteuid() != 0 {
+		log.Fatalln("You must be root to prune packages")
+	}
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration %s\n", err)
+	}
+	releases, size := config.RetainReleases, config.RetainSize
+	if sFlags.Keep > 0 {
+		releases = sFlags.Keep
+	}
+	if sFlags.MaxSize != "" {
+		size = sFlags.MaxSize
+	}
+	policy, err := builder.NewRetentionPolicy(releases, size)
+	if err != nil {
+		log.Fatalf("Invalid retention policy, reason: %s\n", err)
+	}
+	if policy.IsEmpty() {
+		log.Fatalln("No retention policy, set retain_releases or retain_size, or use --keep or --max-size")
+	}
+
+	dirs := s.Args.(*PrunePackagesArgs).Dirs
+	if len(dirs) == 0 {
+		dirs = builder.RetentionDirs()
+	}
+	var totalReclaimed int64
+	for _, dir := range dirs {
+		if !builder.PathExists(dir) {
+			log.Debugf("Skipping missing directory '%s'\n", dir)
+			continue
+		}
+		report, err := policy.Plan(dir)
+		if err != nil {
+			log.Fatalf("Failed to apply retention to '%s', reason: %s\n", dir, err)
+		}
+		for _, f := range report.Removed {
+			fmt.Printf("%s (%s)\n", f.Path, humanReadableFormat(float64(f.Size)))
+		}
+		if report.OverBy > 0 {
+			log.Warnf("'%s' remains '%s' over the size limit, only the newest releases are left\n", dir, humanReadableFormat(float64(report.OverBy)))
+		}
+		if len(report.Removed) == 0 || sFlags.DryRun {
+			totalReclaimed += report.Reclaimed()
+			continue
+		}
+		if err := report.Apply(); err != nil {
+			log.Fatalf("Failed to prune '%s', reason: %s\n", dir, err)
+		}
+		totalReclaimed += report.Reclaimed()
+		if filepath.Clean(dir) != builder.PackageCacheDirectory {
+			log.Infof("Pruned %d packages from '%s', it must be reindexed\n", len(report.Removed), dir)
+		}
+	}
+	if sFlags.DryRun {
+		log.Infof("Would reclaim '%s'\n", humanReadableFormat(float64(totalReclaimed)))
+		return
+	}
+	log.Infof("Total reclaimed size: '%s'\n", humanReadableFormat(float64(totalReclaimed)))
+}
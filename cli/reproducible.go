@@ -0,0 +1,153 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	log "github.com/DataDrake/waterlog"
+	"github.com/getsolus/libosdev/disk"
+	"github.com/getsolus/solbuild/builder"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// buildVariantEnv passes the build variant to each verification build
+	buildVariantEnv = "SOLBUILD_BUILD_VARIANT"
+
+	// verifyReproducibleFlag is stripped from the arguments of each
+	// verification build
+	verifyReproducibleFlag = "--verify-reproducible"
+)
+
+// setBuildVariant will apply the variant requested by a parent
+// verify-reproducible build, if any
+func setBuildVariant() {
+	v := os.Getenv(buildVariantEnv)
+	if v == "" {
+		return
+	}
+	variant, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s\n", buildVariantEnv, v)
+	}
+	builder.BuildVariant = variant
+}
+
+// reproducibleArgs will return the arguments for each verification build,
+// less the verification flag itself and the recipe. The values of other
+// flags are kept as they are, even if they match either.
+func reproducibleArgs(original []string, pkgPath string) []string {
+	values := valueFlagNames(&GlobalFlags{}, &BuildFlags{})
+	var args []string
+	recipe := false
+	for i := 0; i < len(original); i++ {
+		arg := original[i]
+		name := arg
+		if idx := strings.IndexByte(arg, '='); strings.HasPrefix(arg, "--") && idx > 2 {
+			name = arg[:idx]
+		}
+		switch {
+		case name == verifyReproducibleFlag:
+		case name == arg && values[arg] && i+1 < len(original):
+			args = append(args, arg, original[i+1])
+			i++
+		case arg == pkgPath && !recipe:
+			recipe = true
+		default:
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// verifyReproducible will build the package twice in separate processes,
+// each with a fresh overlay and the second with a perturbed environment,
+// then compare the packages. On success the packages of the first build
+// are collected as usual.
+func verifyReproducible(pkgPath string) {
+	absPath, err := filepath.Abs(pkgPath)
+	if err != nil {
+		log.Fatalf("Unable to find package, reason: %s\n", err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Unable to find solbuild, reason: %s\n", err)
+	}
+	tmp, err := ioutil.TempDir("", "solbuild-reproducible-")
+	if err != nil {
+		log.Fatalf("Failed to create build directory, reason: %s\n", err)
+	}
+
+	// Reuse our own arguments, with an absolute recipe path
+	args := append(reproducibleArgs(os.Args[1:], pkgPath), absPath)
+
+	var outDirs []string
+	for variant := 0; variant < 2; variant++ {
+		outDir := filepath.Join(tmp, fmt.Sprintf("build-%d", variant+1))
+		if err := os.MkdirAll(outDir, 00755); err != nil {
+			log.Fatalf("Failed to create build directory, reason: %s\n", err)
+		}
+		log.Infof("Starting build %d of 2\n", variant+1)
+		c := exec.Command(self, args...)
+		c.Dir = outDir
+		c.Env = append(os.Environ(), fmt.Sprintf("%s=%d", buildVariantEnv, variant))
+		if wd, err := os.Getwd(); err == nil {
+			c.Env = append(c.Env, fmt.Sprintf("%s=%s", collisionDirEnv, wd))
+		}
+		c.Stdin = os.Stdin
+		c.Stdout = builder.Stdout
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			log.Fatalf("Build %d failed, files kept in %s\n", variant+1, tmp)
+		}
+		outDirs = append(outDirs, outDir)
+	}
+
+	report, err := builder.CompareBuildOutputs(outDirs[0], outDirs[1])
+	if err != nil {
+		log.Fatalf("Failed to compare builds, reason: %s\n", err)
+	}
+	if !report.Reproducible() {
+		for _, issue := range report.Issues {
+			if issue.Path == "" {
+				log.Errorf("%s: %s\n", issue.Package, issue.Reason)
+			} else {
+				log.Errorf("%s: %s: %s\n", issue.Package, issue.Path, issue.Reason)
+			}
+		}
+		log.Fatalf("Build is not reproducible, %d difference(s) found. Files kept in %s\n", len(report.Issues), tmp)
+	}
+
+	usr := builder.GetUserInfo()
+	results, _ := filepath.Glob(filepath.Join(outDirs[0], "*"))
+	for _, p := range results {
+		tgt := filepath.Base(p)
+		if err := disk.CopyFile(p, tgt); err != nil {
+			log.Fatalf("Unable to collect build file, reason: %s\n", err)
+		}
+		if err := os.Chown(tgt, usr.UID, usr.GID); err != nil {
+			log.Errorf("Error in restoring file ownership %s, reason: %s\n", tgt, err)
+		}
+	}
+	os.RemoveAll(tmp)
+	log.Goodf("Build is reproducible, %d package(s) identical\n", report.Packages)
+}
@@ -19,11 +19,13 @@ package cli
 import (
 	"github.com/DataDrake/cli-ng/v2/cmd"
 	"os"
+	"reflect"
+	"strings"
 )
 
 func init() {
-	cmd.Register(&cmd.GenManPages)
-	cmd.Register(&cmd.Help)
+	register(&cmd.GenManPages)
+	register(&cmd.Help)
 }
 
 // Root is the root command for solbuild
@@ -35,9 +37,91 @@ var Root = cmd.Root{
 
 // GlobalFlags are available to all sub-commands
 type GlobalFlags struct {
-	Debug   bool   `short:"d" long:"debug"    desc:"Enable debug message"`
-	NoColor bool   `short:"n" long:"no-color" desc:"Disable color output"`
-	Profile string `short:"p" long:"profile"  desc:"Build profile to use"`
+	Debug     bool   `short:"d" long:"debug"    desc:"Enable debug message"`
+	LogFormat string `long:"log-format"         desc:"Format of the log output, text (default) or json"`
+	NoColor   bool   `short:"n" long:"no-color" desc:"Disable color output"`
+	Profile   string `short:"p" long:"profile"  desc:"Build profile to use"`
+}
+
+// rootValueFlags holds the names of the global flags that take a value, as
+// given on the command line
+var rootValueFlags = make(map[string]bool)
+
+// subValueFlags holds the names of the flags taking a value for each
+// sub-command, by name and alias, as the same flag may be a bool elsewhere
+var subValueFlags = make(map[string]map[string]bool)
+
+// Run will parse the command line and run the requested sub-command
+func Run() {
+	rootValueFlags = valueFlagNames(Root.Flags)
+	os.Args = splitFlagValues(os.Args)
+	Root.Run()
+}
+
+// register will register the sub-command, noting which of its flags take a
+// value so they may be given as --flag=value.
+func register(sub *cmd.Sub) {
+	names := valueFlagNames(sub.Flags)
+	subValueFlags[sub.Name] = names
+	if sub.Alias != "" {
+		subValueFlags[sub.Alias] = names
+	}
+	cmd.Register(sub)
+}
+
+// valueFlagNames returns the short and long names, as given on the command
+// line, of every non-bool field of the flag structs
+func valueFlagNames(sets ...interface{}) map[string]bool {
+	names := make(map[string]bool)
+	for _, flags := range sets {
+		if flags == nil {
+			continue
+		}
+		t := reflect.TypeOf(flags)
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			continue
+		}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Type.Kind() == reflect.Bool {
+				continue
+			}
+			if short := field.Tag.Get("short"); short != "" {
+				names["-"+short] = true
+			}
+			if long := field.Tag.Get("long"); long != "" {
+				names["--"+long] = true
+			}
+		}
+	}
+	return names
+}
+
+// splitFlagValues rewrites --flag=value into --flag value for the global
+// flags and those of the sub-command being run that take a value, as cli-ng
+// only accepts the latter. Bool flags are left as is so that cli-ng rejects
+// them. Nothing after a "--" is touched.
+func splitFlagValues(args []string) []string {
+	var subFlags map[string]bool
+	if len(args) > 1 {
+		subFlags = subValueFlags[args[1]]
+	}
+	out := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(out, args[i:]...)
+		}
+		idx := strings.IndexByte(arg, '=')
+		if strings.HasPrefix(arg, "--") && idx > 2 && (rootValueFlags[arg[:idx]] || subFlags[arg[:idx]]) {
+			out = append(out, arg[:idx], arg[idx+1:])
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
 }
 
 // FindLikelyArg will look in the current directory to see if common path names exist,
@@ -0,0 +1,176 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"os/exec"
+)
+
+func init() {
+	register(&Security)
+}
+
+// Security updates the recipes affected by an advisory, and writes a build
+// manifest for them
+var Security = cmd.Sub{
+	Name:  "security",
+	Short: "Fix and rebuild the recipes affected by a security advisory",
+	Flags: &SecurityFlags{},
+	Args:  &SecurityArgs{},
+	Run:   SecurityRun,
+}
+
+// SecurityFlags are flags for the "security" sub-command
+type SecurityFlags struct {
+	DryRun   bool   `long:"dry-run"            desc:"Only report the affected recipes and how they would be fixed"`
+	Output   string `short:"o" long:"output"   desc:"Directory the packages of each build are collected beneath"`
+	Manifest string `short:"m" long:"manifest" desc:"Where to write the build manifest, defaults to ID.builds.yml"`
+	Build    bool   `short:"b" long:"build"    desc:"Build the manifest once written"`
+}
+
+// SecurityArgs are arguments for the "security" sub-command
+type SecurityArgs struct {
+	Advisory string   `desc:"Advisory YAML, or an OSV formatted CVE feed entry (.json)"`
+	Tree     []string `zero:"yes" desc:"Source tree containing the recipes, defaults to the current directory"`
+}
+
+// SecurityRun carries out the "security" sub-command
+func SecurityRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*SecurityFlags)
+	args := s.Args.(*SecurityArgs)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	tree := "."
+	switch len(args.Tree) {
+	case 0:
+	case 1:
+		tree = args.Tree[0]
+	default:
+		log.Fatalln("Only a single source tree may be given")
+	}
+
+	advisory, err := builder.LoadAdvisory(args.Advisory)
+	if err != nil {
+		log.Fatalf("Failed to load the advisory, reason: %s\n", err)
+	}
+	fixes, err := advisory.Match(tree)
+	if err != nil {
+		log.Fatalf("Failed to search %s, reason: %s\n", tree, err)
+	}
+	if len(fixes) == 0 {
+		log.Infof("No recipes in %s are affected by %s\n", tree, advisory.ID)
+		return
+	}
+
+	failed := false
+	var applied []*builder.SecurityFix
+	for _, fix := range fixes {
+		switch fix.Action {
+		case builder.SecurityFixed:
+			log.Infof("%s is already fixed at %s\n", fix.Name, fix.Version)
+			continue
+		case builder.SecurityManual:
+			log.Warnf("%s %s has no fix in the advisory, update %s by hand\n", fix.Name, fix.Version, fix.Recipe)
+			failed = true
+			continue
+		}
+		if sFlags.DryRun {
+			log.Infof("Would %s %s (%s)\n", fix.Action, fix.Name, fix.Recipe)
+			continue
+		}
+		if err := advisory.Apply(fix); err != nil {
+			log.Errorf("Failed to fix %s, reason: %s\n", fix.Name, err)
+			failed = true
+			continue
+		}
+		if err := advisory.Commit(fix); err != nil {
+			log.Errorf("Failed to commit %s, reason: %s\n", fix.Name, err)
+			failed = true
+			continue
+		}
+		log.Infof("Applied the %s of %s\n", fix.Action, fix.Name)
+		applied = append(applied, fix)
+	}
+	if sFlags.DryRun {
+		return
+	}
+	if len(applied) == 0 {
+		log.Fatalln("No recipes were fixed, nothing to build")
+	}
+
+	output := sFlags.Output
+	if output == "" {
+		output = "."
+	}
+	manifestPath := sFlags.Manifest
+	if manifestPath == "" {
+		manifestPath = advisory.ID + ".builds.yml"
+	}
+	if err := advisory.Manifest(applied, output).Write(manifestPath); err != nil {
+		log.Fatalf("Failed to write the build manifest, reason: %s\n", err)
+	}
+	log.Infof("Wrote the build manifest for %d recipe(s) to %s\n", len(applied), manifestPath)
+
+	if sFlags.Build {
+		if err := buildSecurityManifest(rFlags, manifestPath); err != nil {
+			log.Errorf("Failed to build %s, reason: %s\n", manifestPath, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// buildSecurityManifest will build the manifest with another solbuild process
+func buildSecurityManifest(rFlags *GlobalFlags, manifestPath string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"build", "--manifest", manifestPath}
+	if rFlags.Profile != "" {
+		args = append(args, "-p", rFlags.Profile)
+	}
+	if rFlags.Debug {
+		args = append(args, "-d")
+	}
+	if rFlags.NoColor {
+		args = append(args, "-n")
+	}
+	if rFlags.LogFormat != "" {
+		args = append(args, "--log-format", rFlags.LogFormat)
+	}
+	c := exec.Command(self, args...)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	return c.Run()
+}
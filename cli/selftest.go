@@ -0,0 +1,96 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	register(&SelfTest)
+}
+
+// SelfTest builds fixture packages end to end to verify the installation
+var SelfTest = cmd.Sub{
+	Name:  "selftest",
+	Short: "Build fixture packages end to end against a scratch profile",
+	Flags: &SelfTestFlags{},
+	Run:   SelfTestRun,
+}
+
+// SelfTestFlags are flags for the "selftest" sub-command
+type SelfTestFlags struct {
+	Keep bool `short:"k" long:"keep" desc:"Keep the scratch directory for inspection"`
+}
+
+// SelfTestRun carries out the "selftest" sub-command
+func SelfTestRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*SelfTestFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+		builder.DisableColors = true
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to run the self test")
+	}
+
+	// Build against the image of the requested profile
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration %s\n", err)
+	}
+	profileName := rFlags.Profile
+	if profileName == "" {
+		profileName = config.DefaultProfile
+	}
+	profile, err := builder.NewProfile(profileName)
+	if err != nil {
+		builder.EmitProfileError(profileName)
+		os.Exit(1)
+	}
+
+	harness, err := builder.NewHarness(profile.Image)
+	if err != nil {
+		if err == builder.ErrProfileNotInstalled {
+			log.Fatalf("%s: Did you forget to init?\n", err)
+		}
+		log.Fatalf("Failed to set up the self test, reason: %s\n", err)
+	}
+	err = harness.Run(builder.HarnessFixtures)
+	if sFlags.Keep {
+		harness.Release()
+		log.Infof("Self test files kept in %s\n", harness.Dir)
+	} else {
+		harness.Close()
+	}
+	if err != nil {
+		log.Fatalf("Self test failed, reason: %s\n", err)
+	}
+	log.Goodln("Self test passed")
+}
@@ -0,0 +1,114 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"net"
+	"os"
+	"strconv"
+)
+
+func init() {
+	register(&Serve)
+}
+
+// Serve indexes a local repository and serves it over HTTP
+var Serve = cmd.Sub{
+	Name:  "serve",
+	Short: "Index the given directory and serve it as a repository over HTTP",
+	Flags: &ServeFlags{},
+	Args:  &ServeArgs{},
+	Run:   ServeRun,
+}
+
+// ServeFlags are flags for the "serve" sub-command
+type ServeFlags struct {
+	Address string `short:"a" long:"address"  desc:"Address to listen on, defaults to localhost"`
+	Port    int    `long:"port"               desc:"Port to listen on, defaults to 8080"`
+	NoIndex bool   `long:"no-index"           desc:"Serve the directory without indexing it first"`
+}
+
+// ServeArgs are args for the "serve" sub-command
+type ServeArgs struct {
+	Dir []string `zero:"yes" desc:"Directory of packages to serve, defaults to the current directory"`
+}
+
+// ServeRun carries out the "serve" sub-command
+func ServeRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*ServeFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to find the current directory, reason: %s\n", err)
+	}
+	if args := s.Args.(*ServeArgs); len(args.Dir) == 1 {
+		dir = args.Dir[0]
+	} else if len(args.Dir) > 1 {
+		log.Fatalln("Only one directory can be served")
+	}
+	port := sFlags.Port
+	if port == 0 {
+		port = builder.DefaultServePort
+	}
+	address := sFlags.Address
+	if address == "" {
+		address = "localhost"
+	}
+
+	if !sFlags.NoIndex {
+		if os.Geteuid() != 0 {
+			log.Fatalln("You must be root to index before serving, or use --no-index")
+		}
+		manager, err := builder.NewManager()
+		if err != nil {
+			os.Exit(1)
+		}
+		if err = manager.SetProfile(rFlags.Profile); err != nil {
+			os.Exit(1)
+		}
+		if err := manager.SetPackage(&builder.IndexPackage); err != nil {
+			if err == builder.ErrProfileNotInstalled {
+				fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
+			}
+			os.Exit(1)
+		}
+		if err := manager.Index(dir); err != nil {
+			log.Fatalln("Index failure")
+		}
+		log.Infoln("Indexing complete")
+	}
+
+	addr := net.JoinHostPort(address, strconv.Itoa(port))
+	if err := builder.ServeRepository(dir, addr); err != nil {
+		log.Fatalf("Failed to serve repository, reason: %s\n", err)
+	}
+}
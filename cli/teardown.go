@@ -0,0 +1,74 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+)
+
+func init() {
+	register(&Teardown)
+}
+
+// Teardown removes build roots kept for rebuilds
+var Teardown = cmd.Sub{
+	Name:  "teardown",
+	Short: "Tear down build roots kept after their builds",
+	Flags: &TeardownFlags{},
+	Run:   TeardownRun,
+}
+
+// TeardownFlags are flags for the "teardown" sub-command
+type TeardownFlags struct {
+	All  bool `short:"a" long:"all"  desc:"Tear down every kept root, even within its window"`
+	Wait bool `short:"w" long:"wait" desc:"Keep running until every kept root has been torn down"`
+}
+
+// TeardownRun carries out the "teardown" sub-command
+func TeardownRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*TeardownFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to tear down build roots")
+	}
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load solbuild configuration %s\n", err)
+	}
+	if sFlags.Wait && !sFlags.All {
+		err = builder.RunJanitor(config.OverlayRootDir)
+	} else {
+		_, err = builder.TearDownKeptRoots(config.OverlayRootDir, sFlags.All)
+	}
+	if err != nil {
+		log.Fatalf("Failed to tear down kept build roots, reason: %s\n", err)
+	}
+}
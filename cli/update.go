@@ -27,7 +27,7 @@ import (
 )
 
 func init() {
-	cmd.Register(&Update)
+	register(&Update)
 }
 
 // Update updates a solbuild image with the latest available packages
@@ -35,9 +35,15 @@ var Update = cmd.Sub{
 	Name:  "update",
 	Alias: "up",
 	Short: "Update a solbuild profile",
+	Flags: &UpdateFlags{},
 	Run:   UpdateRun,
 }
 
+// UpdateFlags are flags for the "update" sub-command
+type UpdateFlags struct {
+	Full bool `long:"full" desc:"Upgrade the image even if no packages changed since the last update"`
+}
+
 // UpdateRun carries out the "update" sub-command
 func UpdateRun(r *cmd.Root, c *cmd.Sub) {
 	rFlags := r.Flags.(*GlobalFlags)
@@ -47,9 +53,15 @@ func UpdateRun(r *cmd.Root, c *cmd.Sub) {
 	if rFlags.NoColor {
 		log.SetFormat(format.Un)
 	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
 	if os.Geteuid() != 0 {
 		log.Fatalln("You must be root to run init profiles")
 	}
+	if c.Flags.(*UpdateFlags).Full {
+		builder.FullUpdate = true
+	}
 	// Initialise the build manager
 	manager, err := builder.NewManager()
 	if err != nil {
@@ -27,7 +27,7 @@ const (
 )
 
 func init() {
-	cmd.Register(&Version)
+	register(&Version)
 }
 
 // Version prints out the version of this executable
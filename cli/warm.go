@@ -0,0 +1,158 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	register(&Warm)
+}
+
+// Warm pre-populates the solbuild caches for a set of recipes
+var Warm = cmd.Sub{
+	Name:  "warm",
+	Short: "Pre-download the image, sources and build dependencies of recipes",
+	Flags: &WarmFlags{},
+	Args:  &WarmArgs{},
+	Run:   WarmRun,
+}
+
+// WarmFlags are flags for the "warm" sub-command
+type WarmFlags struct {
+	Packages string `short:"l" long:"packages" desc:"File listing the recipes to warm, one per line"`
+}
+
+// WarmArgs are args for the "warm" sub-command
+type WarmArgs struct {
+	Paths []string `zero:"yes" desc:"Recipes or recipe directories to warm"`
+}
+
+// WarmRun carries out the "warm" sub-command
+func WarmRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*WarmFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+		builder.DisableColors = true
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to warm caches")
+	}
+
+	paths := s.Args.(*WarmArgs).Paths
+	if sFlags.Packages != "" {
+		listed, err := readRecipeList(sFlags.Packages)
+		if err != nil {
+			log.Fatalf("Failed to read package list %s, reason: %s\n", sFlags.Packages, err)
+		}
+		paths = append(paths, listed...)
+	}
+
+	// Ensure the image is present and the repository indexes are current
+	manager, err := builder.NewManager()
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if err = manager.SetProfile(rFlags.Profile); err != nil {
+		log.Fatalln(err.Error())
+	}
+	doInit(manager)
+	doUpdate(manager)
+
+	failed := 0
+	for _, path := range paths {
+		if err := warmRecipe(rFlags.Profile, path); err != nil {
+			log.Errorf("Failed to warm %s, reason: %s\n", path, err)
+			failed++
+			continue
+		}
+		log.Goodf("Warmed %s\n", path)
+	}
+	if failed > 0 {
+		log.Fatalf("Failed to warm %d of %d recipes\n", failed, len(paths))
+	}
+	log.Infoln("Caches successfully warmed")
+}
+
+// warmRecipe populates the caches for a single recipe using a fresh manager
+func warmRecipe(profile, path string) error {
+	if st, err := os.Stat(path); err == nil && st.IsDir() {
+		found := ""
+		for _, name := range []string{"package.yml", "pspec.xml"} {
+			if builder.PathExists(filepath.Join(path, name)) {
+				found = filepath.Join(path, name)
+				break
+			}
+		}
+		if found == "" {
+			return fmt.Errorf("no package.yml or pspec.xml file in %s", path)
+		}
+		path = found
+	}
+	manager, err := builder.NewManager()
+	if err != nil {
+		return err
+	}
+	if err := manager.SetProfile(profile); err != nil {
+		return err
+	}
+	pkg, err := builder.NewPackage(path)
+	if err != nil {
+		return err
+	}
+	if err := manager.SetPackage(pkg); err != nil {
+		return err
+	}
+	return manager.Warm()
+}
+
+// readRecipeList reads the recipe paths from a list file, ignoring blank
+// lines and comments.
+func readRecipeList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var paths []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, sc.Err()
+}
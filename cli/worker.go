@@ -0,0 +1,106 @@
+//
+// Copyright © 2016-2021 Solus Project <copyright@getsol.us>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cli
+
+import (
+	"github.com/DataDrake/cli-ng/v2/cmd"
+	log "github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/getsolus/solbuild/builder"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+func init() {
+	register(&Worker)
+}
+
+// Worker accepts builds dispatched by a coordinator over HTTP
+var Worker = cmd.Sub{
+	Name:  "worker",
+	Short: "Accept builds dispatched by another solbuild over HTTP",
+	Flags: &WorkerFlags{},
+	Run:   WorkerRun,
+}
+
+// WorkerFlags are flags for the "worker" sub-command
+type WorkerFlags struct {
+	Address  string `short:"a" long:"address" desc:"Address to listen on, defaults to localhost"`
+	Port     int    `long:"port"              desc:"Port to listen on, defaults to 8081"`
+	Jobs     int    `short:"j" long:"jobs"    desc:"Number of builds to run at once, defaults to 1"`
+	Cert     string `long:"cert"              desc:"TLS certificate to serve with"`
+	Key      string `long:"key"               desc:"TLS private key of the certificate"`
+	Insecure bool   `long:"insecure"          desc:"Serve over plain HTTP, sending the token in the clear"`
+}
+
+// WorkerRun carries out the "worker" sub-command
+func WorkerRun(r *cmd.Root, s *cmd.Sub) {
+	rFlags := r.Flags.(*GlobalFlags)
+	sFlags := s.Flags.(*WorkerFlags)
+	if rFlags.Debug {
+		log.SetLevel(level.Debug)
+	}
+	if rFlags.NoColor {
+		log.SetFormat(format.Un)
+	}
+	if err := builder.SetLogFormat(rFlags.LogFormat); err != nil {
+		log.Fatalln(err)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatalln("You must be root to run a worker")
+	}
+	if (sFlags.Cert == "") != (sFlags.Key == "") {
+		log.Fatalln("Both --cert and --key are required to use TLS")
+	}
+	if sFlags.Cert == "" && !sFlags.Insecure {
+		log.Fatalln("Workers need --cert and --key, or --insecure to serve over plain HTTP")
+	}
+	if sFlags.Cert != "" && sFlags.Insecure {
+		log.Fatalln("--insecure cannot be combined with --cert and --key")
+	}
+	address := sFlags.Address
+	if address == "" {
+		address = "localhost"
+	}
+	config, err := builder.NewConfig()
+	if err != nil {
+		log.Fatalf("Failed to load the configuration, reason: %s\n", err)
+	}
+	port := sFlags.Port
+	if port == 0 {
+		port = builder.DefaultWorkerPort
+	}
+
+	worker, err := builder.NewWorker(config.WorkerToken, filepath.Join(config.OverlayRootDir, "worker"), sFlags.Jobs)
+	if err != nil {
+		log.Fatalf("Failed to start the worker, reason: %s\n", err)
+	}
+	if rFlags.Profile != "" {
+		log.Infof("Builds without a profile will use %s\n", rFlags.Profile)
+		worker.Profile = rFlags.Profile
+	}
+	if worker.Webhooks, err = builder.NewWebhooks(config); err != nil {
+		log.Fatalf("Failed to start the worker, reason: %s\n", err)
+	}
+	addr := net.JoinHostPort(address, strconv.Itoa(port))
+	if err := worker.Serve(addr, sFlags.Cert, sFlags.Key); err != nil {
+		log.Fatalf("Failed to run the worker, reason: %s\n", err)
+	}
+}
@@ -32,5 +32,5 @@ func init() {
 }
 
 func main() {
-	cli.Root.Run()
+	cli.Run()
 }